@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/portforwarding"
+)
+
+// errChaosBind is returned for a bind failed on purpose
+var errChaosBind = errors.New("bind failed on purpose by --chaos-bind-fail-rate")
+
+// chaosClient fails binds and delays gateway requests on purpose, as
+// --chaos-bind-fail-rate and --chaos-latency ask, so hooks, alerting and
+// backoff can be tried out against realistic failures
+type chaosClient struct {
+	gatewayClient
+	ctx      context.Context
+	failRate float64
+	latency  time.Duration
+	// Return random numbers in [0, 1) and [0, n), replaceable for tests
+	randFloat64 func() float64
+	randInt64N  func(n int64) int64
+}
+
+// chaosEnabled reports whether any failure injection is configured
+func chaosEnabled(cfg *config.Config) bool {
+	return cfg.ChaosBindFailRate > 0 || cfg.ChaosLatency > 0
+}
+
+// newChaosClient wraps client with the configured failure injection. Delays
+// are cut short when ctx is done.
+func newChaosClient(ctx context.Context, cfg *config.Config, client gatewayClient) *chaosClient {
+	return &chaosClient{
+		gatewayClient: client,
+		ctx:           ctx,
+		failRate:      cfg.ChaosBindFailRate,
+		latency:       cfg.ChaosLatency,
+		randFloat64:   rand.Float64,
+		randInt64N:    rand.Int64N,
+	}
+}
+
+// GetPortForwarding requests a signature after the injected delay
+func (c *chaosClient) GetPortForwarding() (*portforwarding.PortForwardingInfo, error) {
+	if err := c.delay(); err != nil {
+		return nil, err
+	}
+	return c.gatewayClient.GetPortForwarding()
+}
+
+// BindPort binds the port after the injected delay, unless this bind is one
+// to fail
+func (c *chaosClient) BindPort(payload, signature string) error {
+	if err := c.delay(); err != nil {
+		return err
+	}
+	if c.randFloat64() < c.failRate {
+		return errChaosBind
+	}
+	return c.gatewayClient.BindPort(payload, signature)
+}
+
+// delay waits a random time up to the configured latency
+func (c *chaosClient) delay() error {
+	if c.latency <= 0 {
+		return nil
+	}
+	select {
+	case <-clk.After(time.Duration(c.randInt64N(int64(c.latency) + 1))):
+		return nil
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/portforwarding/pftest"
+)
+
+func TestChaosClient(t *testing.T) {
+	fake := useFakeClock(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	forwarder := pftest.NewForwarder(pftest.Signature(1000, fake.Now().Add(48*time.Hour)))
+	cfg := &config.Config{ChaosBindFailRate: 0.5, ChaosLatency: 10 * time.Second}
+	if !chaosEnabled(cfg) {
+		t.Fatalf("Expected chaos testing to be enabled")
+	}
+	client := newChaosClient(ctx, cfg, forwarder)
+	rolls := []float64{0.2, 0.7}
+	client.randFloat64 = func() float64 {
+		roll := rolls[0]
+		rolls = rolls[1:]
+		return roll
+	}
+	client.randInt64N = func(n int64) int64 { return n - 1 }
+
+	// Requests wait for the injected delay
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.GetPortForwarding()
+		done <- err
+	}()
+	if err := fake.BlockUntil(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	fake.Advance(10 * time.Second)
+	if err := <-done; err != nil {
+		t.Fatalf("Expected the signature request to go through, got %v", err)
+	}
+
+	// A roll below the rate fails the bind without reaching the gateway
+	client.latency = 0
+	if err := client.BindPort("payload-1000", "signature-1000"); !errors.Is(err, errChaosBind) {
+		t.Errorf("Expected an injected bind failure, got %v", err)
+	}
+	if err := client.BindPort("payload-1000", "signature-1000"); err != nil {
+		t.Errorf("Expected the bind to go through, got %v", err)
+	}
+	if forwarder.BindCalls() != 1 {
+		t.Errorf("Expected 1 bind to reach the gateway, got %d", forwarder.BindCalls())
+	}
+
+	// Shutdown cuts the delay short
+	client.latency = time.Hour
+	cancel()
+	if err := client.BindPort("payload-1000", "signature-1000"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the delay to end with the context, got %v", err)
+	}
+
+	if chaosEnabled(&config.Config{}) {
+		t.Errorf("Expected chaos testing to be off by default")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"runtime"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/redact"
+)
+
+// ANSI escape sequences used to color log lines
+const (
+	ansiReset     = "\x1b[0m"
+	ansiDim       = "\x1b[2m"
+	ansiRed       = "\x1b[31m"
+	ansiYellow    = "\x1b[33m"
+	ansiHighlight = "\x1b[1;36m"
+)
+
+var (
+	// logPrefix matches the date, time and, in debug mode, the source file the
+	// log package starts each line with
+	logPrefix = regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(\.\d+)? (\S+\.go:\d+: )?`)
+	// logHighlight matches the port and its expiry, which stand out in a line
+	logHighlight = regexp.MustCompile(`\b[Pp]ort[= ]\d+|\bexpires=[^\n,]*`)
+)
+
+// colorWriter colors log lines for a terminal: warnings yellow, errors red,
+// and the port and its expiry highlighted. The prefix is dimmed so the message
+// stands out. The log package writes each line with a single Write.
+type colorWriter struct {
+	out io.Writer
+}
+
+func (w *colorWriter) Write(p []byte) (int, error) {
+	if _, err := w.out.Write(colorLine(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// colorLine returns a log line with its colors added
+func colorLine(line []byte) []byte {
+	prefix := logPrefix.Find(line)
+	msg := bytes.TrimSuffix(line[len(prefix):], []byte("\n"))
+
+	// Warnings say so up front, errors are told apart like --quiet does
+	color := ""
+	switch {
+	case bytes.HasPrefix(msg, []byte("Warning:")):
+		color = ansiYellow
+	case notableLogLine.Match(msg):
+		color = ansiRed
+	}
+
+	var b bytes.Buffer
+	if len(prefix) > 0 {
+		b.WriteString(ansiDim)
+		b.Write(prefix)
+		b.WriteString(ansiReset)
+	}
+	b.WriteString(color)
+	b.Write(logHighlight.ReplaceAllFunc(msg, func(match []byte) []byte {
+		return []byte(ansiHighlight + string(match) + ansiReset + color)
+	}))
+	if color != "" {
+		b.WriteString(ansiReset)
+	}
+	b.WriteString("\n")
+	return b.Bytes()
+}
+
+// colorLog reports whether log lines written to w are colored with the
+// --log-color mode: always, never, or by default only when w is a terminal
+// and NO_COLOR isn't set (see https://no-color.org)
+func colorLog(mode string, w io.Writer) bool {
+	switch mode {
+	case config.LogColorAlways:
+		return true
+	case config.LogColorNever:
+		return false
+	}
+	// The Windows console only understands escape sequences once told to
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" || runtime.GOOS == "windows" {
+		return false
+	}
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// logWriter returns the writer log output to w goes through: redacted, and
+// colored if color is set. Secrets are redacted before colors are added, so
+// escape sequences can't split them.
+func logWriter(w io.Writer, color bool) io.Writer {
+	if color {
+		w = &colorWriter{out: w}
+	}
+	return redact.Default.Writer(w)
+}
+
+// setupColorLogging colors log lines on stderr from here on
+func setupColorLogging() {
+	log.SetOutput(logWriter(os.Stderr, true))
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/redact"
+)
+
+func TestColorLine(t *testing.T) {
+	testCases := []struct {
+		name     string
+		line     string
+		expected string
+	}{
+		{
+			name:     "Informational",
+			line:     "2024/03/02 12:00:00 Starting PIA port forwarding service\n",
+			expected: ansiDim + "2024/03/02 12:00:00 " + ansiReset + "Starting PIA port forwarding service\n",
+		},
+		{
+			name:     "Port and expiry",
+			line:     "2024/03/02 12:00:00 Obtained port forwarding: port=51234, expires=2024-03-03 12:00:00 +0000 UTC\n",
+			expected: ansiDim + "2024/03/02 12:00:00 " + ansiReset + "Obtained port forwarding: " + ansiHighlight + "port=51234" + ansiReset + ", " + ansiHighlight + "expires=2024-03-03 12:00:00 +0000 UTC" + ansiReset + "\n",
+		},
+		{
+			name:     "Warning",
+			line:     "2024/03/02 12:00:00 Warning: couldn't keep port 51234 after 5 attempts\n",
+			expected: ansiDim + "2024/03/02 12:00:00 " + ansiReset + ansiYellow + "Warning: couldn't keep " + ansiHighlight + "port 51234" + ansiReset + ansiYellow + " after 5 attempts" + ansiReset + "\n",
+		},
+		{
+			name:     "Error",
+			line:     "2024/03/02 12:00:00 Failed to bind port: connection refused\n",
+			expected: ansiDim + "2024/03/02 12:00:00 " + ansiReset + ansiRed + "Failed to bind port: connection refused" + ansiReset + "\n",
+		},
+		{
+			name:     "Debug prefix",
+			line:     "2024/03/02 12:00:00.123456 main.go:42: Successfully bound port 51234\n",
+			expected: ansiDim + "2024/03/02 12:00:00.123456 main.go:42: " + ansiReset + "Successfully bound " + ansiHighlight + "port 51234" + ansiReset + "\n",
+		},
+		{
+			name:     "No prefix",
+			line:     "Starting PIA port forwarding service\n",
+			expected: "Starting PIA port forwarding service\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := string(colorLine([]byte(tc.line))); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestColorLog(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "log"))
+	if err != nil {
+		t.Fatalf("Failed to create the log file: %v", err)
+	}
+	defer file.Close()
+	t.Setenv("NO_COLOR", "")
+	t.Setenv("TERM", "xterm")
+
+	// Files and pipes aren't terminals
+	if colorLog("", file) || colorLog(config.LogColorAuto, &bytes.Buffer{}) {
+		t.Error("Expected no colors off a terminal")
+	}
+	if !colorLog(config.LogColorAlways, file) {
+		t.Error("Expected colors with --log-color=always")
+	}
+
+	if tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0); err == nil {
+		defer tty.Close()
+		if colorLog(config.LogColorNever, tty) {
+			t.Error("Expected no colors with --log-color=never")
+		}
+		t.Setenv("NO_COLOR", "1")
+		if colorLog(config.LogColorAuto, tty) {
+			t.Error("Expected NO_COLOR to turn colors off")
+		}
+	}
+}
+
+func TestLogWriterRedactsBeforeColoring(t *testing.T) {
+	const token = "port=51234-0f3a9c"
+	redact.Default.Add("token", token)
+	var out bytes.Buffer
+	logger := log.New(logWriter(&out, true), "", 0)
+
+	// Colors added first would split the token at the highlighted port
+	logger.Printf("Warning: token %s", token)
+	if bytes.Contains(out.Bytes(), []byte("51234-0f3a9c")) {
+		t.Errorf("Expected the token to be redacted, got %q", out.String())
+	}
+	if !bytes.Contains(out.Bytes(), []byte(ansiYellow)) {
+		t.Errorf("Expected the warning to be colored, got %q", out.String())
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/meschansky/go-pia/internal/config"
+)
+
+// programName is the name used in generated completions and documentation
+const programName = "go-pia-port-forwarding"
+
+// command is a subcommand dispatched on the first argument
+type command struct {
+	// Name typed on the command line
+	name string
+	// Arguments shown in usage and the man page
+	usage string
+	// One-line description
+	description string
+	// Values accepted as the first argument, offered by shell completion
+	args []string
+	// Runs the command with the remaining arguments
+	run func(args []string) error
+}
+
+// commands returns every subcommand. It's a function rather than a variable so
+// commands can refer back to the list without an initialization cycle.
+func commands() []command {
+	cmds := []command{
+		{
+			name:        "completion",
+			usage:       "bash|zsh|fish",
+			description: "Print a shell completion script",
+			args:        []string{"bash", "zsh", "fish"},
+			run:         runCompletionCommand,
+		},
+		{
+			name:        "man",
+			description: "Print the man page in roff format",
+			run:         runManCommand,
+		},
+		{
+			name:        "status",
+			usage:       "[--json] [--state-file PATH] [OUTPUT_FILE]",
+			description: "Print the current port forwarding state",
+			run:         runStatusCommand,
+		},
+		{
+			name:        "config",
+			usage:       "show [--json] [OPTIONS] [OUTPUT_FILE]",
+			description: "Print the effective configuration and where each value came from, secrets masked",
+			args:        []string{"show"},
+			run:         runConfigCommand,
+		},
+		{
+			name:        "whoami",
+			usage:       "[--json] --credentials PATH|--token TOKEN",
+			description: "Check the credentials or token with PIA and print the subscription",
+			run:         runWhoamiCommand,
+		},
+		{
+			name:        "diag",
+			usage:       "[--output PATH] [OPTIONS] [OUTPUT_FILE]",
+			description: "Collect the configuration, state, logs and network details into an archive for a bug report, secrets redacted",
+			run:         runDiagBundleCommand,
+		},
+		{
+			name:        "renew",
+			usage:       "[--rebind-only] OUTPUT_FILE",
+			description: "Make the running service renew its signature, or bind the port again",
+			run:         runRenewCommand,
+		},
+		{
+			name:        "upgrade",
+			usage:       "OUTPUT_FILE",
+			description: "Make the running service hand its port over to the binary on disk without unbinding it",
+			run:         runUpgradeCommand,
+		},
+		{
+			name:        "udp-reflector",
+			usage:       "[--listen ADDR]",
+			description: "Answer UDP probes of a forwarded port, on a host outside the VPN",
+			run:         runUDPReflectorCommand,
+		},
+		{
+			name:        "version",
+			description: "Print the version and build information",
+			run:         runVersionCommand,
+		},
+		{
+			name:        "self-update",
+			usage:       "[--check] [--force]",
+			description: "Replace the binary with the latest verified GitHub release",
+			run:         runSelfUpdateCommand,
+		},
+	}
+
+	// Service management is only available where a service manager is supported
+	if len(serviceActions) > 0 {
+		cmds = append(cmds, command{
+			name:        "service",
+			usage:       "ACTION [OPTIONS] OUTPUT_FILE",
+			description: "Install or manage the service with the platform service manager",
+			args:        serviceActions,
+			run:         runServiceCommand,
+		})
+	}
+
+	return cmds
+}
+
+// commandFor returns the subcommand args run, or nil to run the service. Only
+// the first argument names a subcommand, so an output file named like one is
+// passed after a flag or "--", or as a path such as ./status.
+func commandFor(args []string) *command {
+	if len(args) == 0 {
+		return nil
+	}
+	return findCommand(args[0])
+}
+
+// findCommand returns the subcommand with the given name, or nil
+func findCommand(name string) *command {
+	for _, cmd := range commands() {
+		if cmd.name == name {
+			return &cmd
+		}
+	}
+	return nil
+}
+
+// configFlags returns a flag set with all configuration flags registered
+func configFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet(programName, flag.ContinueOnError)
+	config.RegisterFlags(fs, config.DefaultConfig())
+	return fs
+}
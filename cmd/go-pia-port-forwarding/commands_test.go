@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/meschansky/go-pia/internal/config"
+)
+
+func TestCommandFor(t *testing.T) {
+	testCases := []struct {
+		name       string
+		args       []string
+		command    string
+		outputFile string
+	}{
+		{name: "Subcommand", args: []string{"status", "--json"}, command: "status"},
+		{name: "Output file", args: []string{"/var/run/pia-port.txt"}, outputFile: "/var/run/pia-port.txt"},
+		{name: "No arguments"},
+		{name: "Output file after a flag", args: []string{"--debug", "status"}, outputFile: "status"},
+		{name: "Output file after --", args: []string{"--", "renew"}, outputFile: "renew"},
+		{name: "Output file with a separator", args: []string{"./upgrade"}, outputFile: "./upgrade"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd := commandFor(tc.args)
+			if tc.command != "" {
+				if cmd == nil || cmd.name != tc.command {
+					t.Errorf("Expected the %s command, got %v", tc.command, cmd)
+				}
+				return
+			}
+			if cmd != nil {
+				t.Fatalf("Expected the service to run, got the %s command", cmd.name)
+			}
+			cfg, err := config.ParseArgs(tc.args)
+			if err != nil {
+				t.Fatalf("Failed to parse %q: %v", tc.args, err)
+			}
+			if cfg.OutputFile != tc.outputFile {
+				t.Errorf("Expected output file %q, got %q", tc.outputFile, cfg.OutputFile)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+)
+
+// flagInfo describes a configuration flag for completions and documentation
+type flagInfo struct {
+	name        string
+	valueName   string
+	description string
+	isBool      bool
+	// Environment variable that sets the same option
+	env string
+}
+
+// flagInfos returns the registered flags in a flag set, sorted by name,
+// leaving out hidden developer flags
+func flagInfos(fs *flag.FlagSet) []flagInfo {
+	var infos []flagInfo
+	fs.VisitAll(func(f *flag.Flag) {
+		if config.Hidden(f.Name) {
+			return
+		}
+		valueName, description := config.UnquoteUsage(f)
+		boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool })
+		infos = append(infos, flagInfo{
+			name:        f.Name,
+			valueName:   valueName,
+			description: description,
+			isBool:      ok && boolFlag.IsBoolFlag(),
+			env:         config.EnvVar(f.Name),
+		})
+	})
+	return infos
+}
+
+// runCompletionCommand prints the completion script for the requested shell
+func runCompletionCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s completion bash|zsh|fish", programName)
+	}
+
+	flags := flagInfos(configFlags())
+	switch args[0] {
+	case "bash":
+		writeBashCompletion(os.Stdout, commands(), flags)
+	case "zsh":
+		writeZshCompletion(os.Stdout, commands(), flags)
+	case "fish":
+		writeFishCompletion(os.Stdout, commands(), flags)
+	default:
+		return fmt.Errorf("unsupported shell: %s (expected bash, zsh or fish)", args[0])
+	}
+	return nil
+}
+
+// runManCommand prints the man page
+func runManCommand(args []string) error {
+	// Honor SOURCE_DATE_EPOCH so packaged man pages are reproducible
+	date := time.Now()
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid SOURCE_DATE_EPOCH: %w", err)
+		}
+		date = time.Unix(seconds, 0).UTC()
+	}
+
+	writeManPage(os.Stdout, commands(), flagInfos(configFlags()), date)
+	return nil
+}
+
+// writeBashCompletion writes a bash completion script
+func writeBashCompletion(w io.Writer, cmds []command, flags []flagInfo) {
+	var names, options []string
+	for _, cmd := range cmds {
+		names = append(names, cmd.name)
+	}
+	for _, f := range flags {
+		options = append(options, "--"+f.name)
+	}
+
+	fmt.Fprintf(w, "# bash completion for %s\n", programName)
+	fmt.Fprintf(w, "_go_pia_port_forwarding() {\n")
+	fmt.Fprintf(w, "    local cur=\"${COMP_WORDS[COMP_CWORD]}\"\n\n")
+
+	// Complete the first argument of a subcommand
+	fmt.Fprintf(w, "    if [[ $COMP_CWORD -eq 2 ]]; then\n")
+	fmt.Fprintf(w, "        case \"${COMP_WORDS[1]}\" in\n")
+	for _, cmd := range cmds {
+		if len(cmd.args) > 0 {
+			fmt.Fprintf(w, "            %s) COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")); return ;;\n", cmd.name, strings.Join(cmd.args, " "))
+		}
+	}
+	fmt.Fprintf(w, "        esac\n")
+	fmt.Fprintf(w, "    fi\n\n")
+
+	fmt.Fprintf(w, "    if [[ $cur == -* ]]; then\n")
+	fmt.Fprintf(w, "        COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(options, " "))
+	fmt.Fprintf(w, "    elif [[ $COMP_CWORD -eq 1 ]]; then\n")
+	fmt.Fprintf(w, "        COMPREPLY=($(compgen -W \"%s\" -- \"$cur\") $(compgen -f -- \"$cur\"))\n", strings.Join(names, " "))
+	fmt.Fprintf(w, "    else\n")
+	fmt.Fprintf(w, "        COMPREPLY=($(compgen -f -- \"$cur\"))\n")
+	fmt.Fprintf(w, "    fi\n")
+	fmt.Fprintf(w, "}\n")
+	fmt.Fprintf(w, "complete -F _go_pia_port_forwarding %s\n", programName)
+}
+
+// writeZshCompletion writes a zsh completion script
+func writeZshCompletion(w io.Writer, cmds []command, flags []flagInfo) {
+	fmt.Fprintf(w, "#compdef %s\n\n", programName)
+	fmt.Fprintf(w, "_go_pia_port_forwarding() {\n")
+	fmt.Fprintf(w, "    local -a commands\n")
+	fmt.Fprintf(w, "    commands=(\n")
+	for _, cmd := range cmds {
+		fmt.Fprintf(w, "        %s\n", zshQuote(cmd.name+":"+cmd.description))
+	}
+	fmt.Fprintf(w, "    )\n\n")
+
+	// Complete the first argument of a subcommand
+	fmt.Fprintf(w, "    if (( CURRENT == 3 )); then\n")
+	fmt.Fprintf(w, "        case $words[2] in\n")
+	for _, cmd := range cmds {
+		if len(cmd.args) > 0 {
+			fmt.Fprintf(w, "            %s) _values %s %s; return ;;\n", cmd.name, zshQuote(cmd.name), strings.Join(cmd.args, " "))
+		}
+	}
+	fmt.Fprintf(w, "        esac\n")
+	fmt.Fprintf(w, "    fi\n\n")
+
+	fmt.Fprintf(w, "    _arguments \\\n")
+	for _, f := range flags {
+		description := zshEscapeDescription(f.description)
+		if f.isBool {
+			fmt.Fprintf(w, "        %s \\\n", zshQuote("--"+f.name+"["+description+"]"))
+		} else {
+			fmt.Fprintf(w, "        %s \\\n", zshQuote("--"+f.name+"=["+description+"]:"+f.valueName+":_files"))
+		}
+	}
+	fmt.Fprintf(w, "        '1: :->first' \\\n")
+	fmt.Fprintf(w, "        '*:file:_files'\n\n")
+	fmt.Fprintf(w, "    if [[ $state == first ]]; then\n")
+	fmt.Fprintf(w, "        _describe 'command' commands\n")
+	fmt.Fprintf(w, "        _files\n")
+	fmt.Fprintf(w, "    fi\n")
+	fmt.Fprintf(w, "}\n\n")
+	fmt.Fprintf(w, "_go_pia_port_forwarding \"$@\"\n")
+}
+
+// zshQuote single-quotes s for zsh
+func zshQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// zshEscapeDescription escapes characters that are special in _arguments descriptions
+func zshEscapeDescription(s string) string {
+	return strings.NewReplacer("[", `\[`, "]", `\]`, ":", `\:`).Replace(s)
+}
+
+// writeFishCompletion writes a fish completion script
+func writeFishCompletion(w io.Writer, cmds []command, flags []flagInfo) {
+	fmt.Fprintf(w, "# fish completion for %s\n", programName)
+	for _, cmd := range cmds {
+		fmt.Fprintf(w, "complete -c %s -n __fish_use_subcommand -a %s -d %s\n", programName, cmd.name, fishQuote(cmd.description))
+		if len(cmd.args) > 0 {
+			fmt.Fprintf(w, "complete -c %s -n '__fish_seen_subcommand_from %s' -f -a %s\n", programName, cmd.name, fishQuote(strings.Join(cmd.args, " ")))
+		}
+	}
+	for _, f := range flags {
+		if f.isBool {
+			fmt.Fprintf(w, "complete -c %s -l %s -d %s\n", programName, f.name, fishQuote(f.description))
+		} else {
+			fmt.Fprintf(w, "complete -c %s -l %s -r -d %s\n", programName, f.name, fishQuote(f.description))
+		}
+	}
+}
+
+// fishQuote single-quotes s for fish
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+// writeManPage writes a man page in roff format
+func writeManPage(w io.Writer, cmds []command, flags []flagInfo, date time.Time) {
+	fmt.Fprintf(w, ".TH %s 1 \"%s\"\n", strings.ToUpper(programName), date.Format("January 2006"))
+	fmt.Fprintf(w, ".SH NAME\n")
+	fmt.Fprintf(w, "%s \\- keep a Private Internet Access forwarded port open\n", roffEscape(programName))
+
+	fmt.Fprintf(w, ".SH SYNOPSIS\n")
+	fmt.Fprintf(w, ".B %s\n", roffEscape(programName))
+	fmt.Fprintf(w, "[\\fIOPTIONS\\fR] \\fIOUTPUT_FILE\\fR\n")
+	for _, cmd := range cmds {
+		fmt.Fprintf(w, ".br\n")
+		fmt.Fprintf(w, ".B %s %s\n", roffEscape(programName), roffEscape(cmd.name))
+		if cmd.usage != "" {
+			fmt.Fprintf(w, "\\fI%s\\fR\n", roffEscape(cmd.usage))
+		}
+	}
+
+	fmt.Fprintf(w, ".SH DESCRIPTION\n")
+	fmt.Fprintf(w, "Detects an active OpenVPN connection to Private Internet Access, requests a forwarded port, ")
+	fmt.Fprintf(w, "keeps it bound and writes the port number to \\fIOUTPUT_FILE\\fR.\n")
+	fmt.Fprintf(w, ".PP\n")
+	fmt.Fprintf(w, "Every option can also be set with the \\fBPIA_*\\fR environment variable listed with it; ")
+	fmt.Fprintf(w, "flags take precedence. The output file can be set with \\fBPIA_OUTPUT_FILE\\fR.\n")
+
+	fmt.Fprintf(w, ".SH OPTIONS\n")
+	for _, f := range flags {
+		fmt.Fprintf(w, ".TP\n")
+		if f.isBool {
+			fmt.Fprintf(w, "\\fB\\-\\-%s\\fR\n", roffEscape(f.name))
+		} else {
+			fmt.Fprintf(w, "\\fB\\-\\-%s\\fR=\\fI%s\\fR\n", roffEscape(f.name), roffEscape(f.valueName))
+		}
+		fmt.Fprintf(w, "%s\n", roffEscape(f.description))
+		if f.env != "" {
+			fmt.Fprintf(w, ".br\n")
+			fmt.Fprintf(w, "Environment: \\fB%s\\fR\n", roffEscape(f.env))
+		}
+	}
+
+	fmt.Fprintf(w, ".SH COMMANDS\n")
+	fmt.Fprintf(w, "A command is only recognized as the first argument. An output file named like one is given ")
+	fmt.Fprintf(w, "after \\fB\\-\\-\\fR or as a path such as \\fI./status\\fR.\n")
+	for _, cmd := range cmds {
+		fmt.Fprintf(w, ".TP\n")
+		fmt.Fprintf(w, "\\fB%s\\fR %s\n", roffEscape(cmd.name), roffEscape(cmd.usage))
+		fmt.Fprintf(w, "%s\n", roffEscape(cmd.description))
+	}
+}
+
+// roffEscape escapes text for roff, including control characters at the start of a line
+func roffEscape(s string) string {
+	s = strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(s)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
+	}
+	return s
+}
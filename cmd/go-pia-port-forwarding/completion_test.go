@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompletionScripts(t *testing.T) {
+	cmds := []command{{name: "completion", description: "Print a completion script", args: []string{"bash", "zsh", "fish"}}}
+	flags := []flagInfo{
+		{name: "credentials", valueName: "string", description: "Path to [the] credentials: it's a file"},
+		{name: "debug", description: "Enable debug logging", isBool: true},
+	}
+
+	testCases := []struct {
+		name     string
+		write    func(*bytes.Buffer)
+		expected []string
+	}{
+		{
+			name:  "bash",
+			write: func(b *bytes.Buffer) { writeBashCompletion(b, cmds, flags) },
+			expected: []string{
+				`completion) COMPREPLY=($(compgen -W "bash zsh fish" -- "$cur")); return ;;`,
+				`compgen -W "--credentials --debug"`,
+				"complete -F _go_pia_port_forwarding go-pia-port-forwarding",
+			},
+		},
+		{
+			name:  "zsh",
+			write: func(b *bytes.Buffer) { writeZshCompletion(b, cmds, flags) },
+			expected: []string{
+				"#compdef go-pia-port-forwarding",
+				`'--credentials=[Path to \[the\] credentials\: it'\''s a file]:string:_files'`,
+				`'--debug[Enable debug logging]'`,
+				"completion) _values 'completion' bash zsh fish; return ;;",
+			},
+		},
+		{
+			name:  "fish",
+			write: func(b *bytes.Buffer) { writeFishCompletion(b, cmds, flags) },
+			expected: []string{
+				"complete -c go-pia-port-forwarding -n __fish_use_subcommand -a completion -d 'Print a completion script'",
+				`complete -c go-pia-port-forwarding -l credentials -r -d 'Path to [the] credentials: it\'s a file'`,
+				"complete -c go-pia-port-forwarding -l debug -d 'Enable debug logging'",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var b bytes.Buffer
+			tc.write(&b)
+			for _, want := range tc.expected {
+				if !strings.Contains(b.String(), want) {
+					t.Errorf("Expected output to contain %q, got:\n%s", want, b.String())
+				}
+			}
+		})
+	}
+}
+
+func TestWriteManPage(t *testing.T) {
+	var b bytes.Buffer
+	writeManPage(&b, commands(), flagInfos(configFlags()), time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC))
+	page := b.String()
+
+	for _, want := range []string{
+		`.TH GO-PIA-PORT-FORWARDING 1 "March 2024"`,
+		`\fB\-\-credentials\fR=\fIstring\fR`,
+		`\fB\-\-debug\fR` + "\n",
+		`Environment: \fBPIA_CA_CERT\fR`,
+		`\fBcompletion\fR bash|zsh|fish`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("Expected man page to contain %q", want)
+		}
+	}
+	if strings.Contains(page, "chaos") {
+		t.Errorf("Expected developer flags to be left out of the man page")
+	}
+}
+
+func TestRoffEscape(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{input: "plain text", expected: "plain text"},
+		{input: "--refresh-interval", expected: `\-\-refresh\-interval`},
+		{input: `C:\path`, expected: `C:\epath`},
+		{input: ".hidden", expected: `\&.hidden`},
+		{input: "'quoted'", expected: `\&'quoted'`},
+	}
+
+	for _, tc := range testCases {
+		if got := roffEscape(tc.input); got != tc.expected {
+			t.Errorf("roffEscape(%q) = %q, expected %q", tc.input, got, tc.expected)
+		}
+	}
+}
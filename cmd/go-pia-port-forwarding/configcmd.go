@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/meschansky/go-pia/internal/config"
+)
+
+// runConfigCommand prints the effective configuration, merged from the
+// defaults, the environment and the flags given, so it's clear which one won
+func runConfigCommand(args []string) error {
+	if len(args) == 0 || args[0] != "show" {
+		return fmt.Errorf("usage: %s config show [--json] [OPTIONS] [OUTPUT_FILE]", programName)
+	}
+
+	cfg := config.DefaultConfig()
+	fs := flag.NewFlagSet("config show", flag.ContinueOnError)
+	jsonOutput := fs.Bool("json", false, "Print the configuration as JSON")
+	if err := config.ParseFlags(fs, cfg, args[1:]); err != nil {
+		return err
+	}
+	settings := config.Settings(fs, cfg)
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(settings)
+	}
+
+	writeSettings(os.Stdout, settings)
+	return nil
+}
+
+// writeSettings prints the settings as a table, one per line, followed by the
+// environment variables that were ignored
+func writeSettings(w io.Writer, settings []config.Setting) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "OPTION\tVALUE\tSOURCE\n")
+	for _, s := range settings {
+		name := "--" + s.Flag
+		if s.Flag == "" {
+			name = "OUTPUT_FILE"
+		}
+		value := s.Value
+		if value == "" {
+			value = "-"
+		}
+		source := s.Source
+		if source == config.SourceEnv {
+			source += " " + s.Env
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", name, value, source)
+	}
+	tw.Flush()
+
+	for _, s := range settings {
+		if s.Warning != "" {
+			fmt.Fprintf(w, "Warning: %s\n", s.Warning)
+		}
+	}
+}
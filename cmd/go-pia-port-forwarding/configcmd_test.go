@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/meschansky/go-pia/internal/config"
+)
+
+func TestWriteSettings(t *testing.T) {
+	settings := []config.Setting{
+		{Flag: "credentials", Env: "PIA_CREDENTIALS", Value: "/etc/pia.txt", Source: config.SourceFlag},
+		{Env: "PIA_OUTPUT_FILE", Value: "", Source: config.SourceDefault},
+		{Flag: "refresh-interval", Env: "PIA_REFRESH_INTERVAL", Value: "10m0s", Source: config.SourceEnv},
+		{Flag: "script-timeout", Env: "PIA_SCRIPT_TIMEOUT", Value: "30s", Source: config.SourceDefault, Warning: `PIA_SCRIPT_TIMEOUT="soon" isn't a valid value and was ignored`},
+	}
+
+	var b bytes.Buffer
+	writeSettings(&b, settings)
+
+	expected := `OPTION              VALUE         SOURCE
+--credentials       /etc/pia.txt  flag
+OUTPUT_FILE         -             default
+--refresh-interval  10m0s         env PIA_REFRESH_INTERVAL
+--script-timeout    30s           default
+Warning: PIA_SCRIPT_TIMEOUT="soon" isn't a valid value and was ignored
+`
+	if b.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, b.String())
+	}
+}
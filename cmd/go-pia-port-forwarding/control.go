@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/lock"
+)
+
+// controlAction is a request the renew command makes of a running service
+type controlAction int
+
+const (
+	// controlRenew requests a new signature, which usually changes the port
+	controlRenew controlAction = iota
+	// controlRebind binds the current signature again
+	controlRebind
+)
+
+func (a controlAction) String() string {
+	if a == controlRebind {
+		return "rebind"
+	}
+	return "signature renewal"
+}
+
+// controlTarget carries out control requests; portforwarding.Manager implements it
+type controlTarget interface {
+	Renew()
+	Rebind()
+}
+
+// controlQueue passes control requests on to the manager once it runs,
+// holding those that arrive while the service starts up until then
+type controlQueue struct {
+	mu     sync.Mutex
+	target controlTarget
+	renew  bool
+	rebind bool
+}
+
+// Renew passes a renewal request on, or holds it until start
+func (q *controlQueue) Renew() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.target == nil {
+		log.Printf("Signature renewal requested during startup, requesting it once port forwarding starts")
+		q.renew = true
+		return
+	}
+	q.target.Renew()
+}
+
+// Rebind passes a rebind request on, or holds it until start
+func (q *controlQueue) Rebind() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.target == nil {
+		log.Printf("Rebind requested during startup, binding again once port forwarding starts")
+		q.rebind = true
+		return
+	}
+	q.target.Rebind()
+}
+
+// start passes the held requests on to target, and every later one as it
+// arrives
+func (q *controlQueue) start(target controlTarget) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.target = target
+	if q.renew {
+		target.Renew()
+	}
+	if q.rebind {
+		target.Rebind()
+	}
+	q.renew, q.rebind = false, false
+}
+
+// runRenewCommand asks the service running for an output file to renew its
+// signature, or only to bind the current one again
+func runRenewCommand(args []string) error {
+	cfg := config.DefaultConfig()
+	fs := flag.NewFlagSet("renew", flag.ContinueOnError)
+	rebindOnly := fs.Bool("rebind-only", false, "Bind the current signature again instead of requesting a new one")
+	if err := config.ParseFlags(fs, cfg, args); err != nil {
+		return err
+	}
+
+	if cfg.OutputFile == "" {
+		return fmt.Errorf("usage: %s renew [--rebind-only] OUTPUT_FILE", programName)
+	}
+
+	// The lock file names the running service
+	lockPath := instanceLockPath(cfg)
+	if lockPath == "" {
+		return errors.New("a service streaming the port to stdout can only be found with --state-file, pass the same one")
+	}
+	pid := lock.HolderPID(lockPath)
+	if pid == 0 {
+		return fmt.Errorf("no service is running for %s", instanceName(cfg))
+	}
+
+	action := controlRenew
+	if *rebindOnly {
+		action = controlRebind
+	}
+	if err := sendControl(pid, action); err != nil {
+		return err
+	}
+
+	fmt.Printf("Requested %s from pid %d\n", action, pid)
+	return nil
+}
@@ -0,0 +1,53 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Signals the renew command sends to a running service
+const (
+	renewSignal  = syscall.SIGUSR1
+	rebindSignal = syscall.SIGUSR2
+)
+
+// handleControlSignals passes renew and rebind requests sent by the renew
+// command to target until ctx is done. The signals are caught before it
+// returns, so they no longer terminate the process.
+func handleControlSignals(ctx context.Context, target controlTarget) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, renewSignal, rebindSignal)
+
+	go func() {
+		defer signal.Stop(sigChan)
+		for {
+			select {
+			case sig := <-sigChan:
+				if sig == rebindSignal {
+					target.Rebind()
+				} else {
+					target.Renew()
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// sendControl signals the service with the given PID to carry out action
+func sendControl(pid int, action controlAction) error {
+	sig := renewSignal
+	if action == controlRebind {
+		sig = rebindSignal
+	}
+	if err := syscall.Kill(pid, sig); err != nil {
+		return fmt.Errorf("failed to signal pid %d: %w", pid, err)
+	}
+	return nil
+}
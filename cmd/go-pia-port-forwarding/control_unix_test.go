@@ -0,0 +1,99 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeControlTarget records control requests
+type fakeControlTarget struct {
+	requests chan string
+}
+
+func (f *fakeControlTarget) Renew()  { f.requests <- "renew" }
+func (f *fakeControlTarget) Rebind() { f.requests <- "rebind" }
+
+func TestControlSignals(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	target := &fakeControlTarget{requests: make(chan string, 2)}
+	handleControlSignals(ctx, target)
+
+	for _, tc := range []struct {
+		action   controlAction
+		expected string
+	}{
+		{controlRebind, "rebind"},
+		{controlRenew, "renew"},
+	} {
+		if err := sendControl(os.Getpid(), tc.action); err != nil {
+			t.Fatalf("Failed to send %s: %v", tc.action, err)
+		}
+		select {
+		case request := <-target.requests:
+			if request != tc.expected {
+				t.Errorf("Expected %s request, got %s", tc.expected, request)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected a %s request", tc.expected)
+		}
+	}
+}
+
+func TestControlSignalsDuringStartup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A request before the manager runs is held instead of terminating us
+	controls := &controlQueue{}
+	handleControlSignals(ctx, controls)
+	if err := sendControl(os.Getpid(), controlRenew); err != nil {
+		t.Fatalf("Failed to send a renewal: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		controls.mu.Lock()
+		held := controls.renew
+		controls.mu.Unlock()
+		if held {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the renewal to be held")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// It's passed on once the manager runs, and later ones right away
+	target := &fakeControlTarget{requests: make(chan string, 2)}
+	controls.start(target)
+	if err := sendControl(os.Getpid(), controlRebind); err != nil {
+		t.Fatalf("Failed to send a rebind: %v", err)
+	}
+	for _, expected := range []string{"renew", "rebind"} {
+		select {
+		case request := <-target.requests:
+			if request != expected {
+				t.Errorf("Expected %s request, got %s", expected, request)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected a %s request", expected)
+		}
+	}
+}
+
+func TestRenewCommandWithoutService(t *testing.T) {
+	outputFile := filepath.Join(t.TempDir(), "port.txt")
+
+	err := runRenewCommand([]string{"--rebind-only", outputFile})
+	if err == nil || !strings.Contains(err.Error(), "no service is running") {
+		t.Errorf("Expected an error naming the missing service, got %v", err)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// handleControlSignals does nothing; Windows has no signals to request a
+// renewal with
+func handleControlSignals(ctx context.Context, target controlTarget) {}
+
+// sendControl isn't supported on Windows
+func sendControl(pid int, action controlAction) error {
+	return errors.New("renew is not supported on Windows")
+}
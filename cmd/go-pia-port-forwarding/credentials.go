@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/auth"
+	"github.com/meschansky/go-pia/internal/config"
+)
+
+// credentialsPollInterval is how often the credentials file is checked for changes
+const credentialsPollInterval = 5 * time.Second
+
+// credentialsWatcher detects changes to the credentials file
+type credentialsWatcher struct {
+	cfg      *config.Config
+	modTime  time.Time
+	size     int64
+	username string
+	password string
+}
+
+// newCredentialsWatcher starts watching from the credentials currently in use
+func newCredentialsWatcher(cfg *config.Config, username, password string) *credentialsWatcher {
+	w := &credentialsWatcher{cfg: cfg, username: username, password: password}
+	if info, err := os.Stat(cfg.CredentialsFile); err == nil {
+		w.modTime = info.ModTime()
+		w.size = info.Size()
+	}
+	return w
+}
+
+// check reloads the credentials file if it changed on disk and reports whether
+// the username or password differ from the ones in use
+func (w *credentialsWatcher) check() (username, password string, changed bool) {
+	info, err := os.Stat(w.cfg.CredentialsFile)
+	if err != nil {
+		// The file may be briefly missing while it's being replaced
+		return "", "", false
+	}
+	if info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return "", "", false
+	}
+
+	username, password, err = w.cfg.LoadCredentials()
+	if err != nil {
+		// Keep the old credentials and look again once the file is complete
+		log.Printf("Warning: credentials file changed but can't be loaded: %v", err)
+		return "", "", false
+	}
+	w.modTime = info.ModTime()
+	w.size = info.Size()
+
+	if username == w.username && password == w.password {
+		return "", "", false
+	}
+	w.username = username
+	w.password = password
+	return username, password, true
+}
+
+// watchCredentials swaps new credentials into authClient whenever the credentials
+// file changes, until ctx is canceled. The next token is obtained with them.
+func watchCredentials(ctx context.Context, w *credentialsWatcher, authClient *auth.Client) {
+	ticker := clk.NewTicker(credentialsPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			if username, password, changed := w.check(); changed {
+				log.Printf("Credentials file changed, re-authenticating with the new credentials on the next token refresh")
+				authClient.SetCredentials(username, password)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+)
+
+func TestCredentialsWatcher(t *testing.T) {
+	credFile := filepath.Join(t.TempDir(), "credentials.txt")
+	writeCredentials := func(content string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(credFile, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write credentials: %v", err)
+		}
+		// Set the modification time explicitly, filesystem timestamps can be coarse
+		if err := os.Chtimes(credFile, modTime, modTime); err != nil {
+			t.Fatalf("Failed to set modification time: %v", err)
+		}
+	}
+
+	start := time.Now().Add(-time.Hour)
+	writeCredentials("user\npass", start)
+	w := newCredentialsWatcher(&config.Config{CredentialsFile: credFile}, "user", "pass")
+
+	testCases := []struct {
+		name             string
+		content          string
+		modTime          time.Time
+		expectChanged    bool
+		expectedUsername string
+		expectedPassword string
+	}{
+		{
+			name:    "Unchanged file",
+			content: "user\npass",
+			modTime: start,
+		},
+		{
+			name:    "Touched without changing credentials",
+			content: "user\npass",
+			modTime: start.Add(time.Minute),
+		},
+		{
+			name:             "Password rotated",
+			content:          "user\nnewpass",
+			modTime:          start.Add(2 * time.Minute),
+			expectChanged:    true,
+			expectedUsername: "user",
+			expectedPassword: "newpass",
+		},
+		{
+			name:    "Partially written file",
+			content: "user",
+			modTime: start.Add(3 * time.Minute),
+		},
+		{
+			name:             "Username changed",
+			content:          "other\nsecret",
+			modTime:          start.Add(4 * time.Minute),
+			expectChanged:    true,
+			expectedUsername: "other",
+			expectedPassword: "secret",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			writeCredentials(tc.content, tc.modTime)
+
+			username, password, changed := w.check()
+			if changed != tc.expectChanged {
+				t.Fatalf("Expected changed=%v, got %v", tc.expectChanged, changed)
+			}
+			if username != tc.expectedUsername || password != tc.expectedPassword {
+				t.Errorf("Expected %q/%q, got %q/%q", tc.expectedUsername, tc.expectedPassword, username, password)
+			}
+		})
+	}
+
+	// A missing file keeps the current credentials
+	os.Remove(credFile)
+	if _, _, changed := w.check(); changed {
+		t.Errorf("Expected no change while the file is missing")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/dbus"
+	"github.com/meschansky/go-pia/internal/events"
+)
+
+const (
+	// dbusSignalPath and dbusSignalInterface identify go-pia's signals
+	dbusSignalPath      = "/org/gopia/PortForwarding"
+	dbusSignalInterface = "org.gopia.PortForwarding"
+)
+
+// signalConn emits D-Bus signals, see dbus.Conn
+type signalConn interface {
+	Emit(path, iface, member, signature string, args ...any) error
+	Close() error
+}
+
+// dialSignalBus connects to the session or system bus, replaced in tests
+var dialSignalBus = func(bus string) (signalConn, error) {
+	if bus == config.DBusSession {
+		return dbus.SessionBus()
+	}
+	return dbus.SystemBus()
+}
+
+// dbusSignaler emits a PortChanged signal for every new port, and again when
+// a previous port's grace period ends. The bus is
+// connected on the first signal and again after it goes away, so go-pia can
+// start before the desktop session.
+type dbusSignaler struct {
+	bus  string
+	conn signalConn
+}
+
+// emit sends the port, its expiry as Unix seconds and the previous ports
+// still in their grace period, reconnecting once if the connection was lost
+func (s *dbusSignaler) emit(e events.Event) error {
+	previous := make([]uint32, len(e.PreviousPorts))
+	for i, port := range e.PreviousPorts {
+		previous[i] = uint32(port)
+	}
+	for attempt := 0; ; attempt++ {
+		if s.conn == nil {
+			conn, err := dialSignalBus(s.bus)
+			if err != nil {
+				return fmt.Errorf("failed to connect to the %s bus: %w", s.bus, err)
+			}
+			s.conn = conn
+		}
+
+		err := s.conn.Emit(dbusSignalPath, dbusSignalInterface, "PortChanged", "uxau", uint32(e.Port), e.ExpiresAt.Unix(), previous)
+		if err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+		if attempt > 0 {
+			return fmt.Errorf("failed to emit PortChanged on the %s bus: %w", s.bus, err)
+		}
+	}
+}
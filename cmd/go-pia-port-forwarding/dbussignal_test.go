@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/events"
+)
+
+// fakeSignalConn records emitted signals, failing them once broken
+type fakeSignalConn struct {
+	emitted [][]any
+	broken  bool
+	closed  bool
+}
+
+func (f *fakeSignalConn) Emit(path, iface, member, signature string, args ...any) error {
+	if f.broken {
+		return errors.New("connection reset by peer")
+	}
+	f.emitted = append(f.emitted, append([]any{path, iface, member, signature}, args...))
+	return nil
+}
+
+func (f *fakeSignalConn) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestDBusSignal(t *testing.T) {
+	var conns []*fakeSignalConn
+	var dialed []string
+	origDial := dialSignalBus
+	t.Cleanup(func() { dialSignalBus = origDial })
+	dialSignalBus = func(bus string) (signalConn, error) {
+		dialed = append(dialed, bus)
+		conn := &fakeSignalConn{}
+		conns = append(conns, conn)
+		return conn, nil
+	}
+
+	// Only new ports are signaled, on the configured bus
+	cfg := &config.Config{DBusSignal: config.DBusSession}
+	bus := events.NewBus()
+	subscribeHandlers(bus, bus, cfg, nil)
+	expiresAt := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	bus.Publish(events.Event{Type: events.PortBound, Port: 12345, ExpiresAt: expiresAt})
+	bus.Publish(events.Event{Type: events.PortChanged, Port: 12345, ExpiresAt: expiresAt})
+
+	if !reflect.DeepEqual(dialed, []string{"session"}) || len(conns[0].emitted) != 1 {
+		t.Fatalf("Expected one signal on the session bus, got %v on %v", conns[0].emitted, dialed)
+	}
+	expected := []any{"/org/gopia/PortForwarding", "org.gopia.PortForwarding", "PortChanged", "uxau", uint32(12345), expiresAt.Unix(), []uint32{}}
+	if !reflect.DeepEqual(conns[0].emitted[0], expected) {
+		t.Errorf("Expected %v, got %v", expected, conns[0].emitted[0])
+	}
+
+	// Ports in their grace period follow the expiry
+	bus.Publish(events.Event{Type: events.PreviousPortExpired, Port: 12345, ExpiresAt: expiresAt, PreviousPorts: []int{23456}})
+	expected = []any{"/org/gopia/PortForwarding", "org.gopia.PortForwarding", "PortChanged", "uxau", uint32(12345), expiresAt.Unix(), []uint32{23456}}
+	if len(conns[0].emitted) != 2 || !reflect.DeepEqual(conns[0].emitted[1], expected) {
+		t.Errorf("Expected %v when a grace period ends, got %v", expected, conns[0].emitted)
+	}
+
+	// A lost connection is replaced
+	conns[0].broken = true
+	bus.Publish(events.Event{Type: events.PortChanged, Port: 23456, ExpiresAt: expiresAt})
+	if len(conns) != 2 || !conns[0].closed || len(conns[1].emitted) != 1 {
+		t.Errorf("Expected the signal to be emitted on a new connection, got %d connections", len(conns))
+	}
+
+	// Failing dials are reported
+	dialSignalBus = func(bus string) (signalConn, error) {
+		return nil, errors.New("DBUS_SESSION_BUS_ADDRESS is not set")
+	}
+	signaler := &dbusSignaler{bus: config.DBusSession}
+	if err := signaler.emit(events.Event{Port: 12345}); err == nil {
+		t.Errorf("Expected an error without a bus")
+	}
+}
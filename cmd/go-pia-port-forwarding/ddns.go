@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/ddns"
+)
+
+// ddnsPublisher keeps a dynamic DNS name pointed at the exit IP, along with
+// the port record if one is configured
+type ddnsPublisher struct {
+	cfg     *config.Config
+	updater *ddns.Updater
+	// Exit IP and port last published, so unchanged ones aren't sent again
+	ip   netip.Addr
+	port int
+}
+
+// newDDNSPublisher returns a publisher for the configured provider
+func newDDNSPublisher(cfg *config.Config) (*ddnsPublisher, error) {
+	updater, err := ddns.New(ddns.Settings{
+		Provider:   cfg.DDNSProvider,
+		Name:       cfg.DDNSName,
+		Zone:       cfg.DDNSZone,
+		URL:        cfg.DDNSURL,
+		PortRecord: cfg.DDNSPortRecord,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cfg.DDNSIPURL != "" {
+		updater.IPURL = cfg.DDNSIPURL
+	}
+	return &ddnsPublisher{cfg: cfg, updater: updater}, nil
+}
+
+// publish looks up the exit IP and updates the records if it or the port
+// changed. It's called after every bind, so an exit IP that changes under a
+// kept port is noticed within a refresh interval, and a failed update is retried.
+func (p *ddnsPublisher) publish(ctx context.Context, port int) error {
+	if port == 0 {
+		return nil
+	}
+
+	ip, err := p.updater.ExitIP(ctx)
+	if err != nil {
+		return err
+	}
+	if ip == p.ip && port == p.port {
+		return nil
+	}
+
+	// Read the token every time, so a rotated one is picked up
+	if p.cfg.DDNSTokenFile != "" {
+		token, err := os.ReadFile(p.cfg.DDNSTokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read DDNS token: %w", err)
+		}
+		p.updater.Token = strings.TrimSpace(string(token))
+		if p.updater.Token == "" {
+			return errors.New("DDNS token file is empty")
+		}
+	}
+
+	if err := p.updater.Update(ctx, ip, port); err != nil {
+		return err
+	}
+	p.ip = ip
+	p.port = port
+	log.Printf("Published exit IP %s and port %d with %s", ip, port, p.cfg.DDNSProvider)
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/meschansky/go-pia/internal/config"
+)
+
+func TestDDNSPublisher(t *testing.T) {
+	exitIP := "203.0.113.7"
+	var updates []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ip" {
+			io.WriteString(w, exitIP)
+			return
+		}
+		updates = append(updates, r.URL.RawQuery+" "+r.Header.Get("Authorization"))
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(tokenFile, []byte("first\n"), 0600)
+	cfg := &config.Config{
+		DDNSProvider:  "http",
+		DDNSURL:       server.URL + "/update?ip={{.IP}}&port={{.Port}}",
+		DDNSTokenFile: tokenFile,
+		DDNSIPURL:     server.URL + "/ip",
+	}
+	publisher, err := newDDNSPublisher(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create publisher: %v", err)
+	}
+
+	// Only changes of the exit IP or port are published, with the current token
+	for _, port := range []int{12345, 12345, 23456} {
+		if err := publisher.publish(context.Background(), port); err != nil {
+			t.Fatalf("Failed to publish: %v", err)
+		}
+	}
+	os.WriteFile(tokenFile, []byte("second\n"), 0600)
+	exitIP = "203.0.113.8"
+	if err := publisher.publish(context.Background(), 23456); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+
+	expected := []string{
+		"ip=203.0.113.7&port=12345 Bearer first",
+		"ip=203.0.113.7&port=23456 Bearer first",
+		"ip=203.0.113.8&port=23456 Bearer second",
+	}
+	if !reflect.DeepEqual(updates, expected) {
+		t.Errorf("Expected %q, got %q", expected, updates)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/events"
+)
+
+// portChangeCoalescer passes PortChanged events on to another bus, holding
+// back those that follow the first for a window and passing on only the
+// latest, so a flapping VPN doesn't reconfigure other services on every change
+type portChangeCoalescer struct {
+	out    *events.Bus
+	window time.Duration
+	// Signaled when a change is held back
+	held chan struct{}
+
+	mu sync.Mutex
+	// Latest change held back and how many it stands for, nil if none is
+	pending *events.Event
+	changes int
+	// Port last passed on, 0 until one is
+	delivered int
+}
+
+// coalescePortChanges returns the bus hooks and integrations get PortChanged
+// events from. It's bus itself unless window is positive; then the first
+// change is passed on right away, and later ones are held for window after the
+// first of them, until ctx is done.
+func coalescePortChanges(ctx context.Context, bus *events.Bus, window time.Duration) *events.Bus {
+	if window <= 0 {
+		return bus
+	}
+	c := &portChangeCoalescer{out: events.NewBus(), window: window, held: make(chan struct{}, 1)}
+	bus.Subscribe(c.add, events.PortChanged)
+	go c.run(ctx)
+	return c.out
+}
+
+// add passes on the first change and holds back the rest
+func (c *portChangeCoalescer) add(e events.Event) {
+	c.mu.Lock()
+	if c.delivered == 0 && c.pending == nil {
+		c.delivered = e.Port
+		c.mu.Unlock()
+		c.out.Publish(e)
+		return
+	}
+	c.pending = &e
+	c.changes++
+	c.mu.Unlock()
+
+	select {
+	case c.held <- struct{}{}:
+	default:
+	}
+}
+
+// run passes on the latest held back change a window after the first of them,
+// until ctx is done
+func (c *portChangeCoalescer) run(ctx context.Context) {
+	var settle <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.held:
+			if settle == nil {
+				settle = clk.After(c.window)
+			}
+		case <-settle:
+			settle = nil
+			if e, ok := c.take(); ok {
+				c.out.Publish(e)
+			}
+		}
+	}
+}
+
+// take returns the latest held back change to pass on, with the port last
+// passed on as the previous one. There's none if the port went back to that one.
+func (c *portChangeCoalescer) take() (events.Event, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pending == nil {
+		return events.Event{}, false
+	}
+	e, changes := *c.pending, c.changes
+	c.pending, c.changes = nil, 0
+	if e.Port == c.delivered {
+		log.Printf("Port went back to %d after %d changes within %s, leaving hooks and integrations alone", e.Port, changes, c.window)
+		return events.Event{}, false
+	}
+	if changes > 1 {
+		log.Printf("Coalesced %d port changes within %s into one to port %d", changes, c.window, e.Port)
+	}
+	e.PreviousPort = c.delivered
+	c.delivered = e.Port
+	return e, true
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/events"
+)
+
+func TestCoalescePortChangesDisabled(t *testing.T) {
+	bus := events.NewBus()
+	if changes := coalescePortChanges(context.Background(), bus, 0); changes != bus {
+		t.Errorf("Expected port changes to come straight from the bus without a window")
+	}
+}
+
+func TestCoalescePortChanges(t *testing.T) {
+	testCases := []struct {
+		name     string
+		ports    []int
+		expected []events.Event
+	}{
+		{
+			name:     "Single change",
+			ports:    []int{1001, 1002},
+			expected: []events.Event{{Port: 1001}, {Port: 1002, PreviousPort: 1001}},
+		},
+		{
+			name:     "Latest of several",
+			ports:    []int{1001, 1002, 1003, 1004},
+			expected: []events.Event{{Port: 1001}, {Port: 1004, PreviousPort: 1001}},
+		},
+		{
+			name:     "Back to the delivered port",
+			ports:    []int{1001, 1002, 1001},
+			expected: []events.Event{{Port: 1001}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := useFakeClock(t)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			bus := events.NewBus()
+			delivered := make(chan events.Event, len(tc.ports))
+			coalescePortChanges(ctx, bus, time.Minute).Subscribe(func(e events.Event) {
+				delivered <- e
+			}, events.PortChanged)
+
+			previous := 0
+			for _, port := range tc.ports {
+				bus.Publish(events.Event{Type: events.PortChanged, Port: port, PreviousPort: previous})
+				previous = port
+			}
+
+			// The first change goes through at once, the rest a window later
+			if err := fake.BlockUntil(ctx, 1); err != nil {
+				t.Fatalf("Held back changes never waited for the window: %v", err)
+			}
+			fake.Advance(time.Minute)
+			if len(tc.expected) > 1 {
+				for len(delivered) < len(tc.expected) && ctx.Err() == nil {
+					time.Sleep(time.Millisecond)
+				}
+			} else {
+				// Nothing more should come; give the coalescer a moment to be wrong
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			if len(delivered) != len(tc.expected) {
+				t.Fatalf("Expected %d port changes, got %d", len(tc.expected), len(delivered))
+			}
+			for _, want := range tc.expected {
+				got := <-delivered
+				if got.Port != want.Port || got.PreviousPort != want.PreviousPort {
+					t.Errorf("Expected port %d (was %d), got %d (was %d)", want.Port, want.PreviousPort, got.Port, got.PreviousPort)
+				}
+			}
+		})
+	}
+}
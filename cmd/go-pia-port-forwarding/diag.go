@@ -0,0 +1,307 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/auth"
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/portforwarding"
+	"github.com/meschansky/go-pia/internal/redact"
+	"github.com/meschansky/go-pia/internal/resolver"
+	"github.com/meschansky/go-pia/internal/state"
+	"github.com/meschansky/go-pia/internal/vpn"
+)
+
+const (
+	// diagLogLines is how much of the end of the log the bundle includes
+	diagLogLines = 500
+	// diagCommandTimeout bounds each command and network probe
+	diagCommandTimeout = 10 * time.Second
+)
+
+// diagFile is a file in the diagnostic bundle
+type diagFile struct {
+	name string
+	data string
+}
+
+// diagCommands are run for the bundle on each platform: how the network and
+// the VPN look to the system, which the detection strategies rely on
+var diagCommands = map[string][][]string{
+	"linux": {
+		{"ip", "route", "show", "table", "all"},
+		{"ip", "-brief", "address"},
+		{"ip", "rule"},
+		{"route", "-n"},
+		{"nmcli", "-t", "connection", "show", "--active"},
+		{"journalctl", "--unit", systemdUnitName, "--lines", fmt.Sprint(diagLogLines), "--no-pager"},
+	},
+	"darwin": {
+		{"netstat", "-rn"},
+		{"ifconfig"},
+	},
+	"windows": {
+		{"route", "print"},
+		{"ipconfig", "/all"},
+	},
+}
+
+// runDiagCommand runs a command for the bundle, returning its combined
+// output; tests replace it
+var runDiagCommand = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, args...).CombinedOutput()
+}
+
+// runDiagBundleCommand collects what's needed to look into a problem into an
+// archive to attach to a bug report. Secrets are left out or redacted, and
+// nothing is sent anywhere.
+func runDiagBundleCommand(args []string) error {
+	cfg := config.DefaultConfig()
+	fs := flag.NewFlagSet("diag", flag.ContinueOnError)
+	output := fs.String("output", "go-pia-diag.tar.gz", "Path of the archive to write")
+	if err := config.ParseFlags(fs, cfg, args); err != nil {
+		return err
+	}
+
+	files := collectDiagnostics(cfg, fs)
+	if err := writeDiagBundle(*output, files, diagRedactor(cfg), time.Now()); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s, please look through it before attaching it to an issue\n", *output)
+	return nil
+}
+
+// diagRedactor returns a redactor for the secrets the configuration names,
+// including the username, so the bundle doesn't identify the account
+func diagRedactor(cfg *config.Config) *redact.Redactor {
+	r := redact.New()
+	r.Add("token", cfg.Token)
+	if cfg.CredentialsFile != "" {
+		if username, password, err := cfg.LoadCredentials(); err == nil {
+			r.Add("username", username)
+			r.Add("password", password)
+		}
+	}
+	for _, secret := range []struct{ label, path string }{
+		{"ddns-token", cfg.DDNSTokenFile},
+		{"notifier-token", cfg.NotifierTokenFile},
+		{"smtp-password", cfg.SMTPPasswordFile},
+	} {
+		if secret.path == "" {
+			continue
+		}
+		if data, err := os.ReadFile(secret.path); err == nil {
+			r.Add(secret.label, strings.TrimSpace(string(data)))
+		}
+	}
+	return r
+}
+
+// collectDiagnostics gathers the bundle's files. A part that can't be
+// collected holds the error instead, since that's worth knowing too.
+func collectDiagnostics(cfg *config.Config, fs *flag.FlagSet) []diagFile {
+	var version, settings strings.Builder
+	writeVersion(&version, readBuildInfo())
+	writeSettings(&settings, config.Settings(fs, cfg))
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(&settings, "\nValidation failed: %v\n", err)
+	}
+
+	files := []diagFile{
+		{name: "version.txt", data: version.String()},
+		{name: "config.txt", data: settings.String()},
+		{name: "state.json", data: diagState(cfg)},
+	}
+	if cfg.LogFile != "" {
+		files = append(files, diagFile{name: "log.txt", data: diagLog(cfg.LogFile)})
+	}
+
+	detection, connInfo := diagDetection(cfg)
+	files = append(files,
+		diagFile{name: "detection.txt", data: detection},
+		diagFile{name: "commands.txt", data: diagCommandOutputs(diagCommands[runtime.GOOS])},
+		diagFile{name: "network.txt", data: diagNetwork(cfg, connInfo)},
+	)
+	return files
+}
+
+// diagState returns the state file as the status command reads it
+func diagState(cfg *config.Config) string {
+	if cfg.StateFile == "" && cfg.OutputFile == "" {
+		return "No state file, pass --state-file or the output file\n"
+	}
+	st, err := state.Load(stateFilePath(cfg))
+	if err != nil {
+		return fmt.Sprintf("%v\n", err)
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return fmt.Sprintf("%v\n", err)
+	}
+	return string(data) + "\n"
+}
+
+// diagLog returns the last diagLogLines lines of the log file
+func diagLog(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Sprintf("%v\n", err)
+	}
+	return lastLines(string(data), diagLogLines)
+}
+
+// lastLines returns the last n lines of s
+func lastLines(s string, n int) string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "")
+}
+
+// diagDetection tries every detection strategy on its own and reports what
+// each found, returning the connection the configured chain detects
+func diagDetection(cfg *config.Config) (string, *vpn.ConnectionInfo) {
+	var b strings.Builder
+	detector, err := newDetector(cfg)
+	if err != nil {
+		fmt.Fprintf(&b, "Can't detect the VPN: %v\n", err)
+		return b.String(), nil
+	}
+
+	for _, name := range vpn.StrategyNames {
+		single := *detector
+		single.Strategies = []string{name}
+		if info, _, err := detectVPN(&single); err != nil {
+			fmt.Fprintf(&b, "%-20s %v\n", name+":", err)
+		} else {
+			fmt.Fprintf(&b, "%-20s gateway=%s, hostname=%s\n", name+":", info.GatewayIP, info.Hostname)
+		}
+	}
+
+	connInfo, strategy, err := detectVPN(detector)
+	if err != nil {
+		fmt.Fprintf(&b, "\nConfigured chain %s: %v\n", strings.Join(detector.Strategies, ","), err)
+		return b.String(), nil
+	}
+	fmt.Fprintf(&b, "\nConfigured chain %s: detected with %s\n", strings.Join(detector.Strategies, ","), strategy)
+	return b.String(), connInfo
+}
+
+// diagCommandOutputs runs each command and returns their outputs one after
+// another, each under the command line
+func diagCommandOutputs(commands [][]string) string {
+	var b strings.Builder
+	for _, command := range commands {
+		ctx, cancel := context.WithTimeout(context.Background(), diagCommandTimeout)
+		out, err := runDiagCommand(ctx, command[0], command[1:]...)
+		cancel()
+
+		fmt.Fprintf(&b, "$ %s\n", strings.Join(command, " "))
+		b.Write(out)
+		if len(out) > 0 && !bytes.HasSuffix(out, []byte("\n")) {
+			b.WriteString("\n")
+		}
+		if err != nil {
+			fmt.Fprintf(&b, "(%v)\n", err)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// diagNetwork checks that the PIA API and the gateway can be reached
+func diagNetwork(cfg *config.Config, connInfo *vpn.ConnectionInfo) string {
+	var b strings.Builder
+	ctx, cancel := context.WithTimeout(context.Background(), diagCommandTimeout)
+	defer cancel()
+
+	apiHost := "www.privateinternetaccess.com"
+	if u, err := url.Parse(auth.TokenURL); err == nil {
+		apiHost = u.Hostname()
+	}
+	started := time.Now()
+	addrs, err := resolver.New(cfg.DNSServer).LookupHost(ctx, apiHost)
+	if err != nil {
+		fmt.Fprintf(&b, "Resolve %s: %v\n", apiHost, err)
+	} else {
+		fmt.Fprintf(&b, "Resolve %s: %s in %s\n", apiHost, strings.Join(addrs, ", "), time.Since(started).Round(time.Millisecond))
+	}
+
+	started = time.Now()
+	dialer := net.Dialer{Timeout: diagCommandTimeout}
+	if conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(apiHost, "443")); err != nil {
+		fmt.Fprintf(&b, "Connect to %s:443: %v\n", apiHost, err)
+	} else {
+		conn.Close()
+		fmt.Fprintf(&b, "Connect to %s:443: ok in %s\n", apiHost, time.Since(started).Round(time.Millisecond))
+	}
+
+	if connInfo == nil {
+		b.WriteString("Gateway: not probed, no VPN connection detected\n")
+		return b.String()
+	}
+	client := portforwarding.NewClient("", connInfo.GatewayIP, connInfo.Hostname, "")
+	defer client.Close()
+	if cfg.GatewayPort != 0 {
+		client.SetAPIPort(cfg.GatewayPort)
+	}
+	started = time.Now()
+	if err := client.ProbeGateway(); err != nil {
+		fmt.Fprintf(&b, "Gateway %s: %v\n", connInfo.GatewayIP, err)
+	} else {
+		fmt.Fprintf(&b, "Gateway %s: accepts connections, ok in %s\n", connInfo.GatewayIP, time.Since(started).Round(time.Millisecond))
+	}
+	return b.String()
+}
+
+// writeDiagBundle writes the files to a gzipped tar archive at path, each
+// passed through r
+func writeDiagBundle(path string, files []diagFile, r *redact.Redactor, now time.Time) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		data := r.String(f.data)
+		header := &tar.Header{
+			Name:    "go-pia-diag/" + f.name,
+			Mode:    0600,
+			Size:    int64(len(data)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+		if _, err := tw.Write([]byte(data)); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	// The bundle may still hold details worth keeping private until reviewed
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+)
+
+func TestLastLines(t *testing.T) {
+	testCases := map[string]string{
+		"":                  "",
+		"one\n":             "one\n",
+		"one\ntwo\nthree\n": "two\nthree\n",
+		"one\ntwo\nthree":   "two\nthree",
+	}
+	for input, expected := range testCases {
+		if got := lastLines(input, 2); got != expected {
+			t.Errorf("Expected the last 2 lines of %q to be %q, got %q", input, expected, got)
+		}
+	}
+}
+
+func TestDiagCommandOutputs(t *testing.T) {
+	run := runDiagCommand
+	t.Cleanup(func() { runDiagCommand = run })
+	runDiagCommand = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		if name == "nmcli" {
+			return nil, errors.New("executable file not found in $PATH")
+		}
+		return []byte("default via 10.8.110.1 dev tun0"), nil
+	}
+
+	out := diagCommandOutputs([][]string{{"ip", "route"}, {"nmcli", "connection"}})
+	expected := "$ ip route\ndefault via 10.8.110.1 dev tun0\n\n$ nmcli connection\n(executable file not found in $PATH)\n\n"
+	if out != expected {
+		t.Errorf("Expected %q, got %q", expected, out)
+	}
+}
+
+func TestWriteDiagBundle(t *testing.T) {
+	dir := t.TempDir()
+	credentials := filepath.Join(dir, "credentials")
+	if err := os.WriteFile(credentials, []byte("p1234567\nsecret-password\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{CredentialsFile: credentials}
+
+	path := filepath.Join(dir, "bundle.tar.gz")
+	files := []diagFile{
+		{name: "log.txt", data: "Authenticating as p1234567 with secret-password\n"},
+		{name: "network.txt", data: "Gateway 10.8.110.1: ok\n"},
+	}
+	if err := writeDiagBundle(path, files, diagRedactor(cfg), time.Now()); err != nil {
+		t.Fatalf("Failed to write the bundle: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Expected a gzipped archive, got %v", err)
+	}
+	contents := make(map[string]string)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Failed to read the archive: %v", err)
+		}
+		data, _ := io.ReadAll(tr)
+		contents[header.Name] = string(data)
+	}
+
+	if len(contents) != 2 || contents["go-pia-diag/network.txt"] != "Gateway 10.8.110.1: ok\n" {
+		t.Errorf("Expected both files in the archive, got %v", contents)
+	}
+	log := contents["go-pia-diag/log.txt"]
+	if strings.Contains(log, "p1234567") || strings.Contains(log, "secret-password") || !strings.Contains(log, "[username ") {
+		t.Errorf("Expected the username and password to be redacted, got %q", log)
+	}
+}
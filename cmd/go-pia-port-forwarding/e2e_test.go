@@ -0,0 +1,460 @@
+//go:build e2e && unix
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/lock"
+	"github.com/meschansky/go-pia/internal/portforwarding/pftest"
+)
+
+// These tests build the real binary and run it against a mock gateway, with
+// the static detection strategy standing in for a VPN tunnel. Run them with:
+//
+//	go test -tags e2e ./cmd/go-pia-port-forwarding
+
+// buildBinary builds the service into a temporary directory and returns its path
+func buildBinary(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "go-pia-port-forwarding")
+	out, err := exec.Command("go", "build", "-o", path, ".").CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to build the binary: %v\n%s", err, out)
+	}
+	return path
+}
+
+// waitFor polls cond until it holds, failing the test after timeout
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// readTrimmed returns the contents of path without surrounding whitespace, or
+// "" if it can't be read
+func readTrimmed(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func TestEndToEnd(t *testing.T) {
+	binary := buildBinary(t)
+	gateway := pftest.NewGateway("e2e-token", 60*24*time.Hour, 40001, 40002)
+	defer gateway.Close()
+
+	dir := t.TempDir()
+	caCert := filepath.Join(dir, "ca.crt")
+	if err := os.WriteFile(caCert, gateway.CACert(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	portFile := filepath.Join(dir, "port.txt")
+	readyFile := filepath.Join(dir, "ready")
+	hookLog := filepath.Join(dir, "hooks.log")
+	exitLog := filepath.Join(dir, "exit.log")
+	hook := filepath.Join(dir, "hook.sh")
+	if err := os.WriteFile(hook, []byte("#!/bin/sh\necho \"$1 $PIA_PORT\" >> "+hookLog+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	exitHook := filepath.Join(dir, "exit.sh")
+	if err := os.WriteFile(exitHook, []byte("#!/bin/sh\necho \"$1\" > "+exitLog+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ip, port := gateway.Addr()
+	output, err := os.Create(filepath.Join(dir, "output.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+	cmd := exec.Command(binary,
+		"--token", "e2e-token",
+		"--detect", "static",
+		"--gateway", ip,
+		"--gateway-hostname", "mockgw",
+		"--gateway-port", strconv.Itoa(port),
+		"--ca-cert", caCert,
+		"--ready-file", readyFile,
+		"--refresh-interval", "1s",
+		"--force",
+		"--min-bind-interval", "0s",
+		"--on-port-change", hook,
+		"--sync-script",
+		"--on-exit", exitHook,
+		"--state-file", filepath.Join(dir, "state.json"),
+		portFile,
+	)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start the binary: %v", err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	defer func() {
+		if t.Failed() {
+			cmd.Process.Kill()
+			t.Logf("Output:\n%s", readTrimmed(output.Name()))
+		}
+	}()
+
+	// The first port is written, announced to the hook and marked ready
+	waitFor(t, 10*time.Second, "the first port", func() bool { return readTrimmed(portFile) == "40001" })
+	waitFor(t, 5*time.Second, "the ready file", func() bool { return readTrimmed(readyFile) == "40001" })
+	waitFor(t, 5*time.Second, "the port change hook", func() bool { return readTrimmed(hookLog) == "40001 40001" })
+
+	// The port is kept alive with the same signature
+	waitFor(t, 10*time.Second, "keepalive binds", func() bool { return len(gateway.Bound()) >= 3 })
+	if gateway.SignatureCalls() != 1 {
+		t.Errorf("Expected keepalives to reuse the signature, got %d signature requests", gateway.SignatureCalls())
+	}
+
+	// A renew request gets a new signature, and with it the next port
+	if err := cmd.Process.Signal(renewSignal); err != nil {
+		t.Fatalf("Failed to request a renewal: %v", err)
+	}
+	waitFor(t, 10*time.Second, "the renewed port", func() bool { return readTrimmed(portFile) == "40002" })
+	waitFor(t, 5*time.Second, "the hook for the renewed port", func() bool {
+		return readTrimmed(hookLog) == "40001 40001\n40002 40002"
+	})
+
+	// SIGTERM shuts down cleanly, running the exit script with the last port
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("Failed to stop the binary: %v", err)
+	}
+	select {
+	case err := <-exited:
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			t.Errorf("Expected a clean exit, got status %d", exitErr.ExitCode())
+		} else if err != nil {
+			t.Errorf("Failed waiting for the binary: %v", err)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatalf("Timed out waiting for the binary to shut down")
+	}
+	if got := readTrimmed(exitLog); got != "40002" {
+		t.Errorf("Expected the exit script to run with port 40002, got %q", got)
+	}
+	if _, err := os.Stat(readyFile); !os.IsNotExist(err) {
+		t.Errorf("Expected the ready file to be removed on shutdown, got %v", err)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	binary := buildBinary(t)
+	gateway := pftest.NewGateway("e2e-token", 60*24*time.Hour, 40001, 40002)
+	defer gateway.Close()
+
+	dir := t.TempDir()
+	caCert := filepath.Join(dir, "ca.crt")
+	if err := os.WriteFile(caCert, gateway.CACert(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	portFile := filepath.Join(dir, "port.txt")
+	readyFile := filepath.Join(dir, "ready")
+	hookLog := filepath.Join(dir, "hooks.log")
+	exitLog := filepath.Join(dir, "exit.log")
+	hook := filepath.Join(dir, "hook.sh")
+	if err := os.WriteFile(hook, []byte("#!/bin/sh\necho \"$1\" >> "+hookLog+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	exitHook := filepath.Join(dir, "exit.sh")
+	if err := os.WriteFile(exitHook, []byte("#!/bin/sh\necho \"$1\" >> "+exitLog+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ip, port := gateway.Addr()
+	output, err := os.Create(filepath.Join(dir, "output.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+	cmd := exec.Command(binary,
+		"--token", "e2e-token",
+		"--detect", "static",
+		"--gateway", ip,
+		"--gateway-hostname", "mockgw",
+		"--gateway-port", strconv.Itoa(port),
+		"--ca-cert", caCert,
+		"--ready-file", readyFile,
+		"--refresh-interval", "1s",
+		"--force",
+		"--min-bind-interval", "0s",
+		"--on-port-change", hook,
+		"--sync-script",
+		"--on-exit", exitHook,
+		"--state-file", filepath.Join(dir, "state.json"),
+		portFile,
+	)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start the binary: %v", err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	defer func() {
+		if t.Failed() {
+			cmd.Process.Kill()
+			t.Logf("Output:\n%s", readTrimmed(output.Name()))
+		}
+	}()
+
+	waitFor(t, 10*time.Second, "the first port", func() bool { return readTrimmed(portFile) == "40001" })
+	waitFor(t, 5*time.Second, "the port change hook", func() bool { return readTrimmed(hookLog) == "40001" })
+
+	// The running service hands over to a new process and exits cleanly
+	if err := cmd.Process.Signal(upgradeSignal); err != nil {
+		t.Fatalf("Failed to request an upgrade: %v", err)
+	}
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("Expected the old version to exit cleanly, got %v", err)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatalf("Timed out waiting for the old version to hand over")
+	}
+	successor := lock.HolderPID(lock.PathFor(portFile))
+	if successor == 0 || successor == cmd.Process.Pid {
+		t.Fatalf("Expected a new process to hold the lock, got pid %d", successor)
+	}
+	defer syscall.Kill(successor, syscall.SIGKILL)
+
+	// The new process keeps the same signature bound, without announcing a change
+	binds := len(gateway.Bound())
+	waitFor(t, 10*time.Second, "keepalive binds after the upgrade", func() bool { return len(gateway.Bound()) >= binds+2 })
+	if gateway.SignatureCalls() != 1 {
+		t.Errorf("Expected the signature to be handed over, got %d signature requests", gateway.SignatureCalls())
+	}
+	if got := readTrimmed(portFile); got != "40001" {
+		t.Errorf("Expected the port to stay 40001, got %q", got)
+	}
+	if got := readTrimmed(readyFile); got != "40001" {
+		t.Errorf("Expected the ready file to be kept, got %q", got)
+	}
+	if got := readTrimmed(hookLog); got != "40001" {
+		t.Errorf("Expected the port change hook not to run again, got %q", got)
+	}
+	if got := readTrimmed(exitLog); got != "" {
+		t.Errorf("Expected the exit script not to run on handover, got %q", got)
+	}
+
+	// The new process shuts down like the old one would have
+	if err := syscall.Kill(successor, syscall.SIGTERM); err != nil {
+		t.Fatalf("Failed to stop the new version: %v", err)
+	}
+	waitFor(t, 15*time.Second, "the exit script", func() bool { return readTrimmed(exitLog) == "40001" })
+	waitFor(t, 5*time.Second, "the lock to be released", func() bool { return lock.HolderPID(lock.PathFor(portFile)) == 0 })
+}
+
+func TestPortRangeAtStartup(t *testing.T) {
+	binary := buildBinary(t)
+	gateway := pftest.NewGateway("e2e-token", 60*24*time.Hour, 40001, 40002)
+	defer gateway.Close()
+
+	dir := t.TempDir()
+	caCert := filepath.Join(dir, "ca.crt")
+	if err := os.WriteFile(caCert, gateway.CACert(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	portFile := filepath.Join(dir, "port.txt")
+	readyFile := filepath.Join(dir, "ready")
+
+	ip, port := gateway.Addr()
+	output, err := os.Create(filepath.Join(dir, "output.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+	cmd := exec.Command(binary,
+		"--token", "e2e-token",
+		"--detect", "static",
+		"--gateway", ip,
+		"--gateway-hostname", "mockgw",
+		"--gateway-port", strconv.Itoa(port),
+		"--ca-cert", caCert,
+		"--ready-file", readyFile,
+		"--port-range", "40002-40002",
+		"--state-file", filepath.Join(dir, "state.json"),
+		portFile,
+	)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start the binary: %v", err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	defer func() {
+		cmd.Process.Kill()
+		if t.Failed() {
+			t.Logf("Output:\n%s", readTrimmed(output.Name()))
+		}
+	}()
+
+	// The first port is outside the range, but it's bound and the service
+	// starts without waiting for the signatures requested after it
+	waitFor(t, 5*time.Second, "the ready file", func() bool { return readTrimmed(readyFile) == "40001" })
+	waitFor(t, 20*time.Second, "a port in the range", func() bool { return readTrimmed(portFile) == "40002" })
+	select {
+	case err := <-exited:
+		t.Fatalf("Expected the service to keep running, it exited with %v", err)
+	default:
+	}
+	if bound := gateway.Bound(); len(bound) < 2 || bound[0] != 40001 || bound[len(bound)-1] != 40002 {
+		t.Errorf("Expected port 40001 bound, then 40002, got %v", bound)
+	}
+}
+
+func TestQuietDaemonize(t *testing.T) {
+	binary := buildBinary(t)
+	gateway := pftest.NewGateway("e2e-token", 60*24*time.Hour, 40001)
+	defer gateway.Close()
+
+	dir := t.TempDir()
+	caCert := filepath.Join(dir, "ca.crt")
+	if err := os.WriteFile(caCert, gateway.CACert(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	portFile := filepath.Join(dir, "port.txt")
+	logFile := filepath.Join(dir, "output.log")
+
+	ip, port := gateway.Addr()
+	cmd := exec.Command(binary,
+		"--quiet",
+		"--daemonize",
+		"--log-file", logFile,
+		"--token", "e2e-token",
+		"--detect", "static",
+		"--gateway", ip,
+		"--gateway-hostname", "mockgw",
+		"--gateway-port", strconv.Itoa(port),
+		"--ca-cert", caCert,
+		"--state-file", filepath.Join(dir, "state.json"),
+		portFile,
+	)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	defer func() {
+		// Stop the background process before its directory is removed
+		if pid := lock.HolderPID(lock.PathFor(portFile)); pid != 0 {
+			syscall.Kill(pid, syscall.SIGTERM)
+			waitFor(t, 15*time.Second, "the background process to exit", func() bool { return lock.HolderPID(lock.PathFor(portFile)) == 0 })
+		}
+		if t.Failed() {
+			t.Logf("Log:\n%s", readTrimmed(logFile))
+		}
+	}()
+
+	// The foreground process prints only the port, once the background one has bound it
+	stdout, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Failed to run the binary: %v\n%s", err, stderr.String())
+	}
+	if string(stdout) != "40001\n" {
+		t.Errorf("Expected just the port on stdout, got %q", stdout)
+	}
+	if stderr.Len() != 0 {
+		t.Errorf("Expected nothing on stderr, got %q", stderr.String())
+	}
+	if got := readTrimmed(portFile); got != "40001" {
+		t.Errorf("Expected the port to be written, got %q", got)
+	}
+
+	// Informational lines are left out of the log
+	if got := readTrimmed(logFile); strings.Contains(got, "Successfully bound port") {
+		t.Errorf("Expected informational lines to be hidden, got:\n%s", got)
+	}
+}
+
+func TestStreamToStdout(t *testing.T) {
+	binary := buildBinary(t)
+	gateway := pftest.NewGateway("e2e-token", 60*24*time.Hour, 40001)
+	defer gateway.Close()
+
+	dir := t.TempDir()
+	caCert := filepath.Join(dir, "ca.crt")
+	if err := os.WriteFile(caCert, gateway.CACert(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ip, port := gateway.Addr()
+	cmd := exec.Command(binary,
+		"--token", "e2e-token",
+		"--detect", "static",
+		"--gateway", ip,
+		"--gateway-hostname", "mockgw",
+		"--gateway-port", strconv.Itoa(port),
+		"--ca-cert", caCert,
+		"--refresh-interval", "1s",
+		"--force",
+		"--min-bind-interval", "0s",
+		"-",
+	)
+	cmd.Dir = dir
+	logFile := filepath.Join(t.TempDir(), "output.log")
+	cmd.Args = append(cmd.Args[:len(cmd.Args)-1], "--log-file", logFile, "-")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start the binary: %v", err)
+	}
+	defer func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		cmd.Wait()
+		if t.Failed() {
+			t.Logf("Log:\n%s", readTrimmed(logFile))
+		}
+	}()
+
+	// The port arrives as a line, however many times it's bound
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	select {
+	case line := <-lines:
+		if line != "40001" {
+			t.Fatalf("Expected the port on stdout, got %q", line)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("Timed out waiting for the port on stdout")
+	}
+	waitFor(t, 15*time.Second, "the port to be bound again", func() bool { return len(gateway.Bound()) >= 3 })
+	select {
+	case line := <-lines:
+		t.Errorf("Expected nothing more without a port change, got %q", line)
+	default:
+	}
+
+	// Nothing is written next to the working directory
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected only the CA certificate in the working directory, got %v", entries)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/portforwarding"
+	"github.com/meschansky/go-pia/internal/regions"
+)
+
+// Exit statuses, one per class of failure so wrappers and service managers can
+// tell them apart. They are part of the command's interface; don't renumber.
+const (
+	// exitOK is a clean shutdown
+	exitOK = 0
+	// exitFatal is a failure after port forwarding was up, or one that fits
+	// no other class
+	exitFatal = 1
+	// exitUnclean is a shutdown that gave up on running scripts, or was forced
+	// by a second signal
+	exitUnclean = 2
+	// exitConfig is an invalid configuration or unreadable credentials
+	exitConfig = 3
+	// exitAuth is a failure to authenticate with PIA
+	exitAuth = 4
+	// exitVPN is a VPN that couldn't be detected or brought up
+	exitVPN = 5
+	// exitPortForwardingUnsupported is a VPN region without port forwarding, or
+	// a legacy server without the port forwarding API
+	exitPortForwardingUnsupported = 6
+	// exitStartupTimeout is port forwarding that didn't come up in time
+	exitStartupTimeout = 7
+)
+
+// startupFailureStatus returns the status to exit with when port forwarding
+// failed to come up with err, blaming the server if it's a legacy one or the
+// region if it doesn't allow port forwarding
+func startupFailureStatus(cfg *config.Config, hostname string, err error, fallback int) int {
+	if errors.Is(err, portforwarding.ErrAuthRejected) {
+		return exitAuth
+	}
+	if errors.Is(err, portforwarding.ErrNotNextGen) {
+		log.Printf("Server %s isn't serving the port forwarding API on port %s; legacy PIA servers don't forward ports, connect to a next-gen one", hostname, portforwarding.APIPort)
+		fallback = exitPortForwardingUnsupported
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), serverListTimeout)
+	defer cancel()
+	cache, fetchErr := serverListCache(cfg)
+	var list *regions.List
+	if fetchErr == nil {
+		list, fetchErr = cache.Fetch(ctx, serverListClient(cfg), regions.ServerListURL)
+	}
+	if fetchErr != nil {
+		log.Printf("Failed to check whether the region allows port forwarding: %v", fetchErr)
+		return fallback
+	}
+	return regionFailureStatus(list, hostname, fallback)
+}
+
+// regionFailureStatus returns the status to exit with for a startup failure on
+// the server named hostname, going by the server list
+func regionFailureStatus(list *regions.List, hostname string, fallback int) int {
+	region, ok := findRegion(list, hostname)
+	if !ok {
+		// PIA moves regions to new servers; a config naming the old ones
+		// connects to servers that no longer forward ports
+		log.Printf("Server %s isn't in the PIA server list, its region may have moved; regenerate the OpenVPN config from PIA's current configuration files", hostname)
+		return fallback
+	}
+	if !region.PortForward {
+		log.Printf("Region %s (%s) doesn't allow port forwarding; connect to one that does", region.Name, hostname)
+		return exitPortForwardingUnsupported
+	}
+	return fallback
+}
+
+// findRegion returns the region of the server named hostname, in any group
+func findRegion(list *regions.List, hostname string) (regions.Region, bool) {
+	for _, group := range []string{regions.GroupWireGuard, regions.GroupOpenVPN, regions.GroupOpenVPNTCP} {
+		if region, ok := list.Find(group, hostname); ok {
+			return region, true
+		}
+	}
+	return regions.Region{}, false
+}
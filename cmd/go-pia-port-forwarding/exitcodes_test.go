@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/portforwarding"
+	"github.com/meschansky/go-pia/internal/regions"
+)
+
+func TestFindRegion(t *testing.T) {
+	list := &regions.List{Regions: []regions.Region{
+		{ID: "nl_amsterdam", PortForward: true, Servers: map[string][]regions.Server{"wg": {{IP: "158.173.21.200", CN: "amsterdam407"}}}},
+		{ID: "us_east", PortForward: false, Servers: map[string][]regions.Server{"ovpntcp": {{IP: "84.17.35.30", CN: "newjersey419"}}}},
+	}}
+
+	testCases := []struct {
+		hostname string
+		expected string
+	}{
+		{hostname: "amsterdam407", expected: "nl_amsterdam"},
+		{hostname: "newjersey419", expected: "us_east"},
+		{hostname: "tokyo401", expected: ""},
+		{hostname: "", expected: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.hostname, func(t *testing.T) {
+			region, ok := findRegion(list, tc.hostname)
+			if ok != (tc.expected != "") || region.ID != tc.expected {
+				t.Errorf("Expected region %q, got %q (found: %v)", tc.expected, region.ID, ok)
+			}
+		})
+	}
+}
+
+func TestStartupFailureStatusAuth(t *testing.T) {
+	err := fmt.Errorf("failed to get initial port forwarding info: %w", portforwarding.ErrAuthRejected)
+	if status := startupFailureStatus(&config.Config{}, "amsterdam407", err, exitFatal); status != exitAuth {
+		t.Errorf("Expected exit status %d for a rejected token, got %d", exitAuth, status)
+	}
+}
+
+func TestRegionFailureStatus(t *testing.T) {
+	list := &regions.List{Regions: []regions.Region{
+		{ID: "nl_amsterdam", PortForward: true, Servers: map[string][]regions.Server{"wg": {{IP: "158.173.21.200", CN: "amsterdam407"}}}},
+		{ID: "us_east", PortForward: false, Servers: map[string][]regions.Server{"ovpntcp": {{IP: "84.17.35.30", CN: "newjersey419"}}}},
+	}}
+
+	testCases := []struct {
+		name     string
+		hostname string
+		fallback int
+		expected int
+	}{
+		{name: "Region allows port forwarding", hostname: "amsterdam407", fallback: exitFatal, expected: exitFatal},
+		{name: "Region without port forwarding", hostname: "newjersey419", fallback: exitFatal, expected: exitPortForwardingUnsupported},
+		{name: "Server no longer listed", hostname: "tokyo401", fallback: exitStartupTimeout, expected: exitStartupTimeout},
+		{name: "Legacy server no longer listed", hostname: "tokyo401", fallback: exitPortForwardingUnsupported, expected: exitPortForwardingUnsupported},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if status := regionFailureStatus(list, tc.hostname, tc.fallback); status != tc.expected {
+				t.Errorf("Expected exit status %d, got %d", tc.expected, status)
+			}
+		})
+	}
+}
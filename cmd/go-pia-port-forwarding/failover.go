@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/events"
+	"github.com/meschansky/go-pia/internal/regions"
+	"github.com/meschansky/go-pia/internal/resolver"
+	"github.com/meschansky/go-pia/internal/tunnel"
+	"github.com/meschansky/go-pia/internal/vpn"
+)
+
+const (
+	// failoverCheckInterval is how often broken port forwarding is checked on
+	failoverCheckInterval = time.Minute
+	// serverListTimeout bounds downloading the server list
+	serverListTimeout = 30 * time.Second
+)
+
+// regionFailover switches the managed VPN to the next best region when port
+// forwarding stays broken
+type regionFailover struct {
+	cfg     *config.Config
+	bus     *events.Bus
+	tunnel  tunnel.Tunnel
+	fetch   func(ctx context.Context) (*regions.List, error)
+	measure regions.MeasureFunc
+
+	mu sync.Mutex
+	// When port forwarding last stopped working, zero while it works
+	brokenSince time.Time
+	// Region the VPN is connected to, empty until it's known
+	region string
+	// Regions left since port forwarding last worked, not to be tried again
+	tried []string
+	// Last server list fetched, used when it can't be fetched again
+	list *regions.List
+}
+
+// startRegionFailover watches port forwarding and switches regions when it
+// has been broken for cfg.FailoverAfter
+func startRegionFailover(ctx context.Context, cfg *config.Config, bus *events.Bus, t tunnel.Tunnel) {
+	client := serverListClient(cfg)
+	cache, cacheErr := serverListCache(cfg)
+	f := &regionFailover{
+		cfg:    cfg,
+		bus:    bus,
+		tunnel: t,
+		fetch: func(ctx context.Context) (*regions.List, error) {
+			if cacheErr != nil {
+				return nil, cacheErr
+			}
+			return cache.Fetch(ctx, client, regions.ServerListURL)
+		},
+		measure: regions.DialLatency,
+	}
+	f.subscribe()
+	go f.run(ctx)
+}
+
+// serverListClient returns the HTTP client the server list is downloaded with
+func serverListClient(cfg *config.Config) *http.Client {
+	dialer := &net.Dialer{Resolver: resolver.New(cfg.DNSServer)}
+	dial := dialer.DialContext
+	if cache := sharedDNSCache(cfg); cache != nil {
+		dial = cache.Dialer(dialer)
+	}
+	return &http.Client{
+		Timeout:   serverListTimeout,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, DialContext: dial},
+	}
+}
+
+// serverListCache returns the configured server list cache, or the default
+// next to the output file, checking signatures. Nothing is cached by default
+// when the port is streamed to stdout.
+func serverListCache(cfg *config.Config) (*regions.Cache, error) {
+	key, err := serverListKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+	path := cfg.ServerListCache
+	if path == "" && !cfg.StreamsOutput() {
+		path = regions.CachePathFor(cfg.OutputFile)
+	}
+	return &regions.Cache{Path: path, TTL: cfg.ServerListCacheTTL, PublicKey: key}, nil
+}
+
+// serverListKey returns the key the server list must be signed with: the
+// configured one, else PIA's, which is built in
+func serverListKey(cfg *config.Config) (*rsa.PublicKey, error) {
+	if cfg.ServerListKeyFile != "" {
+		data, err := os.ReadFile(cfg.ServerListKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the server list key: %w", err)
+		}
+		key, err := regions.ParsePublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server list key %s: %w", cfg.ServerListKeyFile, err)
+		}
+		return key, nil
+	}
+	return regions.PIAKey(), nil
+}
+
+// subscribe tracks since when port forwarding has been broken
+func (f *regionFailover) subscribe() {
+	f.bus.Subscribe(func(e events.Event) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		switch e.Type {
+		case events.PortBound:
+			f.brokenSince = time.Time{}
+			f.tried = nil
+		case events.BindFailed, events.SignatureFailed:
+			if f.brokenSince.IsZero() {
+				f.brokenSince = clk.Now()
+			}
+		}
+	}, events.PortBound, events.BindFailed, events.SignatureFailed)
+}
+
+// run checks on port forwarding until ctx is canceled
+func (f *regionFailover) run(ctx context.Context) {
+	ticker := clk.NewTicker(failoverCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+
+		if f.due() {
+			f.failover(ctx)
+		}
+	}
+}
+
+// due reports whether port forwarding has been broken long enough to switch
+func (f *regionFailover) due() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !f.brokenSince.IsZero() && clk.Now().Sub(f.brokenSince) >= f.cfg.FailoverAfter
+}
+
+// failover switches the VPN to the fastest region that allows port
+// forwarding and hasn't been tried since it last worked
+func (f *regionFailover) failover(ctx context.Context) {
+	list, err := f.fetch(ctx)
+	f.mu.Lock()
+	if err == nil {
+		f.list = list
+	} else if f.list != nil {
+		log.Printf("Failed to update the server list, using the last one: %v", err)
+		list = f.list
+	}
+	f.mu.Unlock()
+	if list == nil {
+		log.Printf("Can't switch regions: %v", err)
+		return
+	}
+
+	group := f.group()
+	f.mu.Lock()
+	current := f.region
+	if current == "" {
+		if region, ok := list.Find(group, f.currentHost()); ok {
+			current = region.ID
+		}
+	}
+	exclude := append([]string{current}, f.tried...)
+	f.mu.Unlock()
+
+	// Once every region has been tried, start over with the fastest
+	ranked := list.Rank(ctx, group, exclude, f.measure)
+	if len(ranked) == 0 && len(exclude) > 1 {
+		f.mu.Lock()
+		f.tried = nil
+		f.mu.Unlock()
+		ranked = list.Rank(ctx, group, []string{current}, f.measure)
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	// Give the next attempt the full delay, whether this one switches or not
+	f.mu.Lock()
+	f.brokenSince = clk.Now()
+	f.mu.Unlock()
+	if len(ranked) == 0 {
+		log.Printf("Port forwarding has been failing for %s but no other region allows it", f.cfg.FailoverAfter)
+		return
+	}
+
+	next := ranked[0]
+	log.Printf("Port forwarding has been failing for %s, switching to %s (%s, %s latency)", f.cfg.FailoverAfter, next.Region.Name, next.Server.CN, next.Latency.Round(time.Millisecond))
+	if err := f.tunnel.Switch(next.Server.IP, next.Server.CN); err != nil {
+		log.Printf("Failed to switch to %s: %v", next.Region.Name, err)
+		return
+	}
+
+	f.mu.Lock()
+	if current != "" {
+		f.tried = append(f.tried, current)
+	}
+	f.region = next.Region.ID
+	f.mu.Unlock()
+	f.bus.Publish(events.Event{Type: events.RegionChanged, Region: next.Region.ID, PreviousRegion: current, Hostname: next.Server.CN})
+}
+
+// group returns the server list group of the managed VPN
+func (f *regionFailover) group() string {
+	if f.cfg.ManageVPN == config.ManageWireGuard {
+		return regions.GroupWireGuard
+	}
+	if ovpn, err := vpn.LoadOVPNConfig(f.cfg.OpenVPNConfigFile); err == nil && len(ovpn.Remotes) > 0 && strings.HasPrefix(ovpn.Remotes[0].Proto, "tcp") {
+		return regions.GroupOpenVPNTCP
+	}
+	return regions.GroupOpenVPN
+}
+
+// currentHost returns the configured server the VPN connects to at startup
+func (f *regionFailover) currentHost() string {
+	if f.cfg.ManageVPN == config.ManageWireGuard {
+		return f.cfg.WireGuardHostname
+	}
+	ovpn, err := vpn.LoadOVPNConfig(f.cfg.OpenVPNConfigFile)
+	if err != nil || len(ovpn.Remotes) == 0 {
+		return ""
+	}
+	return ovpn.Remotes[0].Host
+}
+
+// executeRegionChangeScript runs the region change script with the new and
+// previous region IDs, waiting for it to finish
+func executeRegionChangeScript(cfg *config.Config, e events.Event) {
+	log.Printf("Executing region change script: %s", cfg.OnRegionChangeScript)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ScriptTimeout)
+	defer cancel()
+
+	cmd := execCommand(ctx, cfg.OnRegionChangeScript, e.Region, e.PreviousRegion)
+	cmd.Env = append(os.Environ(),
+		"PIA_REGION="+e.Region,
+		"PIA_PREVIOUS_REGION="+e.PreviousRegion,
+		"PIA_SERVER_HOSTNAME="+e.Hostname,
+	)
+	started := time.Now()
+	output, err := cmd.CombinedOutput()
+	hooks.record(ctx, hookRegionChange, started, err)
+	if err != nil {
+		log.Printf("Region change script failed: %v\nOutput: %s", err, string(output))
+	} else {
+		log.Printf("Region change script executed successfully\nOutput: %s", string(output))
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/events"
+	"github.com/meschansky/go-pia/internal/regions"
+	"github.com/meschansky/go-pia/internal/vpn"
+)
+
+// fakeTunnel records the servers it's switched to
+type fakeTunnel struct {
+	mu       sync.Mutex
+	switches []string
+}
+
+func (t *fakeTunnel) Run(ctx context.Context) error { return nil }
+func (t *fakeTunnel) Configure(d *vpn.Detector)     {}
+func (t *fakeTunnel) Switch(ip, hostname string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.switches = append(t.switches, hostname)
+	return nil
+}
+
+func TestRegionFailover(t *testing.T) {
+	fake := useFakeClock(t)
+	list := &regions.List{Regions: []regions.Region{
+		{ID: "nl_amsterdam", PortForward: true, Servers: map[string][]regions.Server{"wg": {{IP: "158.173.21.200", CN: "amsterdam407"}}}},
+		{ID: "de-frankfurt", PortForward: true, Servers: map[string][]regions.Server{"wg": {{IP: "212.102.57.139", CN: "frankfurt411"}}}},
+		{ID: "se", PortForward: true, Servers: map[string][]regions.Server{"wg": {{IP: "46.246.3.221", CN: "stockholm404"}}}},
+	}}
+	latencies := map[string]time.Duration{"158.173.21.200": 10 * time.Millisecond, "212.102.57.139": 20 * time.Millisecond, "46.246.3.221": 30 * time.Millisecond}
+
+	bus := events.NewBus()
+	var changes []string
+	bus.Subscribe(func(e events.Event) {
+		changes = append(changes, e.PreviousRegion+">"+e.Region)
+	}, events.RegionChanged)
+
+	tun := &fakeTunnel{}
+	fetches := 0
+	f := &regionFailover{
+		cfg: &config.Config{ManageVPN: config.ManageWireGuard, WireGuardHostname: "amsterdam407", FailoverAfter: 10 * time.Minute},
+		bus: bus,
+		fetch: func(ctx context.Context) (*regions.List, error) {
+			// Later fetches fail and fall back to the first list
+			if fetches++; fetches > 1 {
+				return nil, errors.New("unreachable")
+			}
+			return list, nil
+		},
+		measure: func(ctx context.Context, ip string) (time.Duration, error) { return latencies[ip], nil },
+		tunnel:  tun,
+	}
+	f.subscribe()
+
+	ctx := context.Background()
+	wait := func(d time.Duration, due bool) {
+		t.Helper()
+		fake.Advance(d)
+		if f.due() != due {
+			t.Fatalf("Expected due=%v after %s", due, d)
+		}
+	}
+
+	// Nothing happens until forwarding has been broken long enough
+	wait(time.Hour, false)
+	bus.Publish(events.Event{Type: events.BindFailed})
+	wait(9*time.Minute, false)
+	bus.Publish(events.Event{Type: events.SignatureFailed})
+	wait(time.Minute, true)
+	f.failover(ctx)
+
+	// Still broken in Frankfurt: go on to Sweden rather than back to Amsterdam
+	wait(9*time.Minute, false)
+	wait(time.Minute, true)
+	f.failover(ctx)
+
+	// Working again in Sweden: Amsterdam may be tried again next time
+	bus.Publish(events.Event{Type: events.PortBound})
+	wait(time.Hour, false)
+	bus.Publish(events.Event{Type: events.BindFailed})
+	wait(10*time.Minute, true)
+	f.failover(ctx)
+
+	if expected := []string{"frankfurt411", "stockholm404", "amsterdam407"}; !reflect.DeepEqual(tun.switches, expected) {
+		t.Errorf("Expected switches to %q, got %q", expected, tun.switches)
+	}
+	if expected := []string{"nl_amsterdam>de-frankfurt", "de-frankfurt>se", "se>nl_amsterdam"}; !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected region changes %q, got %q", expected, changes)
+	}
+}
+
+func TestServerListKey(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"regions":[]}`))
+	}))
+	defer server.Close()
+
+	// PIA's key is checked by default, so an unsigned list is rejected
+	cfg := &config.Config{OutputFile: filepath.Join(t.TempDir(), "port.txt")}
+	cache, err := serverListCache(cfg)
+	if err != nil {
+		t.Fatalf("Failed to set up the cache: %v", err)
+	}
+	if !cache.PublicKey.Equal(regions.PIAKey()) {
+		t.Errorf("Expected PIA's key by default")
+	}
+	if _, err := cache.Fetch(context.Background(), server.Client(), server.URL); !errors.Is(err, regions.ErrBadSignature) {
+		t.Errorf("Expected an unsigned list to be rejected, got %v", err)
+	}
+
+	// A configured key replaces it
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ServerListKeyFile = filepath.Join(t.TempDir(), "servers.pem")
+	if err := os.WriteFile(cfg.ServerListKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cache, err := serverListCache(cfg); err != nil || !cache.PublicKey.Equal(&key.PublicKey) {
+		t.Errorf("Expected the configured key, got %v", err)
+	}
+}
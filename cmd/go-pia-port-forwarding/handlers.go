@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/confpatch"
+	"github.com/meschansky/go-pia/internal/events"
+	"github.com/meschansky/go-pia/internal/metrics"
+	"github.com/meschansky/go-pia/internal/output"
+	"github.com/meschansky/go-pia/internal/portforwarding"
+	"github.com/meschansky/go-pia/internal/render"
+	"github.com/meschansky/go-pia/internal/state"
+	"github.com/meschansky/go-pia/internal/systemd"
+	"github.com/meschansky/go-pia/internal/udpprobe"
+)
+
+// Event metrics, updated by the metrics subscriber
+var (
+	portChanges       = metrics.Default.NewCounter("gopia_port_changes_total", "Number of times a different port was bound, including the first bind")
+	bindFailures      = metrics.Default.NewCounter("gopia_bind_failures_total", "Number of failed attempts to bind the port")
+	signatureRenewals = metrics.Default.NewCounter("gopia_signature_renewals_total", "Number of port forwarding signatures obtained")
+	vpnReconnects     = metrics.Default.NewCounter("gopia_vpn_reconnects_total", "Number of times the VPN connection was detected")
+	regionChanges     = metrics.Default.NewCounter("gopia_region_changes_total", "Number of times the managed VPN switched regions")
+	portKeepFailures  = metrics.Default.NewCounter("gopia_port_keep_failures_total", "Number of renewals that couldn't keep the previous port")
+	portOutOfRange    = metrics.Default.NewCounter("gopia_port_out_of_range_total", "Number of signatures bound with a port outside the port range")
+	portReleases      = metrics.Default.NewCounter("gopia_port_releases_total", "Number of times the port went unbound long enough to be released")
+	currentPort       = metrics.Default.NewGauge("gopia_port", "Currently forwarded port, 0 if none has been bound")
+	udpPortOpen       = metrics.Default.NewGauge("gopia_udp_port_open", "Whether the last UDP probe reached the forwarded port")
+	udpProbeLoss      = metrics.Default.NewGauge("gopia_udp_probe_loss_ratio", "Fraction of datagrams lost in the last UDP probe of the forwarded port")
+
+	hookRuns                = metrics.Default.NewCounterVec("gopia_hook_runs_total", "Number of times each hook script ran", "hook")
+	hookFailures            = metrics.Default.NewCounterVec("gopia_hook_failures_total", "Number of hook script runs that failed or couldn't start", "hook")
+	hookTimeouts            = metrics.Default.NewCounterVec("gopia_hook_timeouts_total", "Number of hook script runs stopped for running past the script timeout", "hook")
+	hookDuration            = metrics.Default.NewHistogramVec("gopia_hook_duration_seconds", "How long hook scripts ran", "hook", []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 300})
+	hookLastExitCode        = metrics.Default.NewGaugeVec("gopia_hook_last_exit_code", "Exit code of each hook script's last run, -1 if it didn't exit on its own", "hook")
+	hookConsecutiveFailures = metrics.Default.NewGaugeVec("gopia_hook_consecutive_failures", "Failed runs of each hook script since its last success", "hook")
+
+	outputWrites              = metrics.Default.NewCounterVec("gopia_output_writes_total", "Number of attempts to write the port to each output", "output")
+	outputFailures            = metrics.Default.NewCounterVec("gopia_output_failures_total", "Number of failed attempts to write the port to each output", "output")
+	outputConsecutiveFailures = metrics.Default.NewGaugeVec("gopia_output_consecutive_failures", "Failed attempts to write the port to each output since its last success", "output")
+)
+
+// subscribeHandlers subscribes everything that reacts to daemon events. Hooks
+// and integrations that reconfigure something for a new port take PortChanged
+// and PreviousPortExpired events from changes, which may coalesce quick
+// changes, and the rest from bus. Outputs written on every bind get the
+// previous ports from previous. The returned function stops retrying outputs
+// that failed.
+func subscribeHandlers(bus, changes *events.Bus, cfg *config.Config, previous *previousPortKeeper) (closeOutputs func()) {
+	bus.Subscribe(recordEventMetrics)
+
+	// Outputs are written side by side, each retried on its own, and report
+	// every attempt for the metrics and the status command
+	policies := outputRetryPolicies(cfg)
+	report := func(r output.Result) {
+		e := events.Event{Type: events.OutputWritten, Output: r.Output, Port: r.Port, Attempt: r.Attempt, Duration: r.Duration, ConsecutiveFailures: r.ConsecutiveFailures}
+		if r.Err != nil {
+			e.Error = r.Err.Error()
+		}
+		bus.Publish(e)
+	}
+	fileOutputs := output.NewDispatcher(report)
+	bindOutputs := output.NewDispatcher(report)
+	changeOutputs := output.NewDispatcher(report)
+	addOutput := func(d *output.Dispatcher, name string, write func(ctx context.Context, e events.Event) error) {
+		d.Add(output.Func(name, write), policies[name])
+	}
+
+	// Keep the output file current on every bind, and with the previous ports
+	// when they change
+	addOutput(fileOutputs, config.OutputNameFile, func(_ context.Context, e events.Event) error {
+		return handlePortOutput(e.Port, e.ExpiresAt, e.RenewsAt, previous.ports(), cfg)
+	})
+
+	// Keep files for manual-connections tooling current with every new signature
+	if cfg.ManualConnectionsDir != "" {
+		written := ""
+		addOutput(bindOutputs, config.OutputNameManualConnections, func(_ context.Context, e events.Event) error {
+			if e.Signature == written {
+				return nil
+			}
+			info := &portforwarding.PortForwardingInfo{Port: e.Port, ExpiresAt: e.ExpiresAt, Payload: e.Payload, Signature: e.Signature}
+			if err := portforwarding.WriteManualConnectionsFiles(cfg.ManualConnectionsDir, info, e.Gateway, e.Hostname); err != nil {
+				return err
+			}
+			written = e.Signature
+			log.Printf("Wrote port %d to manual-connections files in %s", e.Port, cfg.ManualConnectionsDir)
+			return nil
+		})
+	}
+
+	// Keep the dynamic DNS name on the exit IP, checking it after every bind
+	// since a reconnect can change it without changing the port
+	if cfg.DDNSProvider != "" {
+		publisher, err := newDDNSPublisher(cfg)
+		if err != nil {
+			log.Printf("Dynamic DNS disabled: %v", err)
+		} else {
+			addOutput(bindOutputs, config.OutputNameDDNS, func(ctx context.Context, e events.Event) error {
+				return publisher.publish(ctx, e.Port)
+			})
+		}
+	}
+
+	// Write every new port into the client's config file
+	if cfg.PatchFile != "" {
+		addOutput(changeOutputs, config.OutputNamePatchFile, func(_ context.Context, e events.Event) error {
+			changed, err := confpatch.Port(cfg.PatchFile, cfg.PatchKey, e.Port)
+			if err != nil {
+				return err
+			}
+			if changed {
+				log.Printf("Wrote port %d to %s (previous version in %s%s)", e.Port, cfg.PatchFile, cfg.PatchFile, confpatch.BackupSuffix)
+			}
+			return nil
+		})
+	}
+
+	// Render templates with every new port, and again when a previous port's
+	// grace period ends, reloading the service that uses them if any changed.
+	// The unit told about new ports is told about a changed template too.
+	if cfg.Templates != "" {
+		templates, _ := render.ParseTemplates(cfg.Templates)
+		reload, _ := render.ParseReload(cfg.TemplateReload)
+		addOutput(changeOutputs, config.OutputNameTemplates, func(_ context.Context, e events.Event) error {
+			changed, err := renderTemplates(templates, reload, e)
+			if changed && e.Type == events.PreviousPortExpired && cfg.NotifyUnit != "" {
+				notifyUnit(cfg, e.Port)
+			}
+			return err
+		})
+	}
+
+	// Tell OpenWrt about every new port
+	if cfg.Ubus {
+		addOutput(changeOutputs, config.OutputNameUbus, func(_ context.Context, e events.Event) error {
+			return sendUbusPortEvent(cfg, e.Port, e.ExpiresAt, e.RenewsAt, e.PreviousPorts)
+		})
+	}
+
+	// Announce every new port to desktop widgets and other local services
+	if cfg.DBusSignal != "" {
+		signaler := &dbusSignaler{bus: cfg.DBusSignal}
+		addOutput(changeOutputs, config.OutputNameDBusSignal, func(_ context.Context, e events.Event) error {
+			return signaler.emit(e)
+		})
+	}
+
+	bus.Subscribe(fileOutputs.Dispatch, events.PortBound)
+	bus.Subscribe(bindOutputs.Dispatch, events.PortBound)
+	if cfg.PreviousPortGrace > 0 {
+		changes.Subscribe(fileOutputs.Dispatch, events.PortChanged, events.PreviousPortExpired)
+	}
+	if changeOutputs.Len() > 0 {
+		changes.Subscribe(changeOutputs.Dispatch, events.PortChanged, events.PreviousPortExpired)
+	}
+
+	// Run the region change script whenever the managed VPN switches regions
+	if cfg.OnRegionChangeScript != "" {
+		bus.Subscribe(func(e events.Event) {
+			executeRegionChangeScript(cfg, e)
+		}, events.RegionChanged)
+	}
+
+	// Tell the user the port trackers know is gone
+	if cfg.OnPortKeepFailedScript != "" {
+		bus.Subscribe(func(e events.Event) {
+			executePortKeepFailedScript(cfg, e)
+		}, events.PortKeepFailed)
+	}
+
+	// Run the port change script on every new port, and again when a previous
+	// port's grace period ends. Scripts are handed the port file, so one for a
+	// port that couldn't be written to it waits for a retry that succeeds.
+	if cfg.OnPortChangeScript != "" {
+		var mu sync.Mutex
+		var file events.Event // Last attempt to write the port file
+		var held *events.Event
+		run := func(e events.Event) {
+			if e.Type == events.PreviousPortExpired {
+				log.Printf("Previous port's grace period ended, executing script")
+			} else {
+				log.Printf("Port changed, executing script")
+			}
+			executePortChangeScript(cfg, e.Port, e.ExpiresAt, e.RenewsAt, e.PreviousPorts)
+		}
+		bus.Subscribe(func(e events.Event) {
+			if e.Output != config.OutputNameFile {
+				return
+			}
+			mu.Lock()
+			file = e
+			ready := held
+			if e.Error != "" || ready == nil || ready.Port != e.Port {
+				ready = nil
+			} else {
+				held = nil
+			}
+			mu.Unlock()
+			if ready != nil {
+				log.Printf("Wrote port %d to the port file after all", e.Port)
+				run(*ready)
+			}
+		}, events.OutputWritten)
+		changes.Subscribe(func(e events.Event) {
+			mu.Lock()
+			if file.Port == e.Port && file.Error != "" {
+				held = &e
+				mu.Unlock()
+				log.Printf("Not executing the port change script until port %d is written to the port file: %s", e.Port, file.Error)
+				return
+			}
+			held = nil
+			mu.Unlock()
+			run(e)
+		}, events.PortChanged, events.PreviousPortExpired)
+	}
+
+	// Tell the unit using the port once everything else has been written
+	if cfg.NotifyUnit != "" {
+		changes.Subscribe(func(e events.Event) {
+			notifyUnit(cfg, e.Port)
+		}, events.PortChanged)
+	}
+
+	return func() {
+		fileOutputs.Close()
+		bindOutputs.Close()
+		changeOutputs.Close()
+	}
+}
+
+// runUnitAction runs an action on a unit, replaced in tests
+var runUnitAction = systemd.Action.RunOnSystemBus
+
+// notifyUnit tells --notify-unit about the port with --notify-signal
+func notifyUnit(cfg *config.Config, port int) {
+	action, _ := systemd.ParseAction(cfg.NotifySignal)
+	if err := runUnitAction(action, cfg.NotifyUnit); err != nil {
+		log.Printf("Failed to notify %s: %v", cfg.NotifyUnit, err)
+		return
+	}
+	log.Printf("Sent %s to %s for port %d", action, cfg.NotifyUnit, port)
+}
+
+// outputRetryPolicies returns the retry policy of every output: the default,
+// longer waits for dynamic DNS providers that rate limit updates, and whatever
+// --output-retry sets
+func outputRetryPolicies(cfg *config.Config) map[string]output.RetryPolicy {
+	policies := make(map[string]output.RetryPolicy)
+	for _, name := range config.OutputNames {
+		policies[name] = output.DefaultRetryPolicy
+	}
+	policies[config.OutputNameDDNS] = output.RetryPolicy{Retries: 5, Delay: 30 * time.Second}
+	overrides, _ := output.ParseRetryPolicies(cfg.OutputRetry)
+	maps.Copy(policies, overrides)
+	return policies
+}
+
+// recordEventMetrics updates the event metrics
+func recordEventMetrics(e events.Event) {
+	switch e.Type {
+	case events.PortChanged:
+		portChanges.Inc()
+		currentPort.Set(float64(e.Port))
+	case events.BindFailed:
+		bindFailures.Inc()
+	case events.SignatureRenewed:
+		signatureRenewals.Inc()
+	case events.VPNReconnected:
+		vpnReconnects.Inc()
+	case events.RegionChanged:
+		regionChanges.Inc()
+	case events.PortKeepFailed:
+		portKeepFailures.Inc()
+	case events.PortOutOfRange:
+		portOutOfRange.Inc()
+	case events.PortReleased:
+		portReleases.Inc()
+	case events.HookRan:
+		hookRuns.With(e.Hook).Inc()
+		if e.Error != "" {
+			hookFailures.With(e.Hook).Inc()
+		}
+		hookDuration.With(e.Hook).Observe(e.Duration.Seconds())
+		hookLastExitCode.With(e.Hook).Set(float64(e.ExitCode))
+		hookConsecutiveFailures.With(e.Hook).Set(float64(e.ConsecutiveFailures))
+	case events.HookTimedOut:
+		hookTimeouts.With(e.Hook).Inc()
+	case events.OutputWritten:
+		outputWrites.With(e.Output).Inc()
+		if e.Error != "" {
+			outputFailures.With(e.Output).Inc()
+		}
+		outputConsecutiveFailures.With(e.Output).Set(float64(e.ConsecutiveFailures))
+	case events.UDPProbed:
+		if e.Error == "" {
+			result := udpprobe.Result{Sent: e.ProbesSent, Received: e.ProbesReceived}
+			open := 0.0
+			if result.Open() {
+				open = 1
+			}
+			udpPortOpen.Set(open)
+			udpProbeLoss.Set(result.Loss())
+		}
+	}
+}
+
+// subscribeState records events in st and saves it for the status command.
+// Events may come from several goroutines, such as background hook scripts,
+// so st is only touched under a lock. The previous ports are taken from
+// previous, and change with the port changes on changes and when a grace
+// period ends. The returned function saves st with the latest token and
+// latency statistics under the same lock.
+func subscribeState(bus, changes *events.Bus, cfg *config.Config, st *state.State, tokens tokenSource, previous *previousPortKeeper) (flush func()) {
+	var mu sync.Mutex
+	record := func(e events.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		applyEvent(st, e)
+		st.PreviousPorts = previous.ports()
+		recordAuthStats(st, tokens.Stats())
+		recordLatency(st)
+		saveState(cfg, st)
+	}
+	bus.Subscribe(record)
+	if cfg.PreviousPortGrace > 0 {
+		changes.Subscribe(record, events.PortChanged, events.PreviousPortExpired)
+	}
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+
+		recordAuthStats(st, tokens.Stats())
+		recordLatency(st)
+		saveState(cfg, st)
+	}
+}
+
+// applyEvent updates the state with what an event reports
+func applyEvent(st *state.State, e events.Event) {
+	switch e.Type {
+	case events.SignatureRenewed:
+		st.Port = e.Port
+		st.ExpiresAt = e.ExpiresAt
+		st.RenewsAt = e.RenewsAt
+		st.SignatureRequests = state.RecordRequest(st.SignatureRequests, e.Time)
+	case events.SignatureFailed:
+		st.LastError = e.Error
+		st.SignatureRequests = state.RecordRequest(st.SignatureRequests, e.Time)
+	case events.SignatureRetried:
+		st.SignatureRequests = state.RecordRequest(st.SignatureRequests, e.Time)
+	case events.TokenRefreshed, events.AuthFailed:
+		st.TokenRequests = state.RecordRequest(st.TokenRequests, e.Time)
+	case events.PortBound:
+		st.Port = e.Port
+		st.ExpiresAt = e.ExpiresAt
+		st.RenewsAt = e.RenewsAt
+		st.LastBindAt = e.Time
+		st.ConsecutiveFailures = 0
+		st.LastError = ""
+		st.KnownGateway = &state.KnownGateway{Gateway: e.Gateway, Hostname: e.Hostname, Region: st.Region, BoundAt: e.Time}
+	case events.BindFailed:
+		st.BindFailures++
+		st.ConsecutiveFailures = e.ConsecutiveFailures
+		st.LastError = e.Error
+	case events.VPNReconnected:
+		st.Gateway = e.Gateway
+		st.Hostname = e.Hostname
+	case events.RegionChanged:
+		st.Region = e.Region
+	case events.UDPProbed:
+		st.LastUDPProbeAt = e.Time
+		st.UDPProbeError = e.Error
+		if e.Error == "" {
+			st.UDPProbesSent = e.ProbesSent
+			st.UDPProbesReceived = e.ProbesReceived
+		}
+	case events.HookRan, events.HookTimedOut:
+		if st.Hooks == nil {
+			st.Hooks = make(map[string]state.HookStats)
+		}
+		stats := st.Hooks[e.Hook]
+		if e.Type == events.HookTimedOut {
+			stats.Timeouts++
+		} else {
+			stats.Runs++
+			if e.Error != "" {
+				stats.Failures++
+			}
+			stats.ConsecutiveFailures = e.ConsecutiveFailures
+			stats.LastRunAt = e.Time
+			stats.LastDuration = e.Duration
+			stats.LastExitCode = e.ExitCode
+			stats.LastError = e.Error
+		}
+		st.Hooks[e.Hook] = stats
+	case events.OutputWritten:
+		if st.Outputs == nil {
+			st.Outputs = make(map[string]state.OutputStats)
+		}
+		stats := st.Outputs[e.Output]
+		stats.Writes++
+		stats.ConsecutiveFailures = e.ConsecutiveFailures
+		stats.LastPort = e.Port
+		stats.LastWriteAt = e.Time
+		stats.LastError = e.Error
+		if e.Error != "" {
+			stats.Failures++
+		} else {
+			stats.LastSuccessAt = e.Time
+		}
+		st.Outputs[e.Output] = stats
+	}
+}
+
+// subscribeReadiness reports readiness once the port is bound and withdraws it
+// while binding keeps failing
+func subscribeReadiness(bus *events.Bus, cfg *config.Config) {
+	ready := false
+	readyPort := 0
+	bus.Subscribe(func(e events.Event) {
+		switch e.Type {
+		case events.PortBound:
+			// Keep the ready file's port current
+			if !ready || e.Port != readyPort {
+				markReady(cfg, e.Port)
+				ready = true
+				readyPort = e.Port
+			}
+		case events.BindFailed:
+			// Dependent services shouldn't start while the port is likely gone
+			if ready && e.ConsecutiveFailures >= readyFailureThreshold {
+				markNotReady(cfg, errors.New(e.Error))
+				ready = false
+			}
+		}
+	}, events.PortBound, events.BindFailed)
+}
+
+// renderTemplates renders every template with the port from e, then runs
+// reload if a target changed and a reload is configured, reporting whether
+// one did. Templates that fail don't stop the others from being rendered.
+func renderTemplates(templates []render.Template, reload render.Reload, e events.Event) (bool, error) {
+	data := render.Data{
+		Port:          e.Port,
+		PreviousPort:  e.PreviousPort,
+		PreviousPorts: e.PreviousPorts,
+		ExpiresAt:     e.ExpiresAt,
+		RenewsAt:      e.RenewsAt,
+		Gateway:       e.Gateway,
+		Hostname:      e.Hostname,
+	}
+
+	changed := false
+	var errs []error
+	for _, t := range templates {
+		written, err := t.Render(data)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to render template: %w", err))
+			continue
+		}
+		if written {
+			log.Printf("Rendered %s to %s", t.Source, t.Target)
+			changed = true
+		}
+	}
+
+	if !changed || reload.Kind == "" {
+		return changed, errors.Join(errs...)
+	}
+	if err := reload.Run(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to reload after rendering templates: %w", err))
+		return changed, errors.Join(errs...)
+	}
+	log.Printf("Reloaded %s", reload)
+	return changed, errors.Join(errs...)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/events"
+	"github.com/meschansky/go-pia/internal/portforwarding"
+	"github.com/meschansky/go-pia/internal/state"
+)
+
+func TestEventMetrics(t *testing.T) {
+	bus := events.NewBus()
+	subscribeHandlers(bus, bus, &config.Config{}, nil)
+
+	changesBefore := portChanges.Value()
+	failuresBefore := bindFailures.Value()
+	renewalsBefore := signatureRenewals.Value()
+
+	bus.Publish(events.Event{Type: events.SignatureRenewed, Port: 12345})
+	bus.Publish(events.Event{Type: events.PortChanged, Port: 12345})
+	bus.Publish(events.Event{Type: events.BindFailed, Port: 12345})
+	bus.Publish(events.Event{Type: events.BindFailed, Port: 12345})
+	bus.Publish(events.Event{Type: events.PortChanged, Port: 54321, PreviousPort: 12345})
+
+	if n := portChanges.Value() - changesBefore; n != 2 {
+		t.Errorf("Expected 2 port changes, got %d", n)
+	}
+	if n := bindFailures.Value() - failuresBefore; n != 2 {
+		t.Errorf("Expected 2 bind failures, got %d", n)
+	}
+	if n := signatureRenewals.Value() - renewalsBefore; n != 1 {
+		t.Errorf("Expected 1 signature renewal, got %d", n)
+	}
+	if port := currentPort.Value(); port != 54321 {
+		t.Errorf("Expected current port 54321, got %v", port)
+	}
+}
+
+func TestApplyEvent(t *testing.T) {
+	boundAt := time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+	expiresAt := boundAt.Add(60 * 24 * time.Hour)
+	renewsAt := expiresAt.Add(-72 * time.Hour)
+	st := &state.State{}
+
+	applyEvent(st, events.Event{Type: events.SignatureRenewed, Port: 12345, ExpiresAt: expiresAt, RenewsAt: renewsAt})
+	applyEvent(st, events.Event{Type: events.BindFailed, Port: 12345, Error: "bind failed", ConsecutiveFailures: 1})
+	applyEvent(st, events.Event{Type: events.BindFailed, Port: 12345, Error: "bind failed", ConsecutiveFailures: 2})
+	if st.BindFailures != 2 || st.ConsecutiveFailures != 2 || st.LastError != "bind failed" {
+		t.Errorf("Expected 2 recorded failures, got %+v", st)
+	}
+
+	applyEvent(st, events.Event{Type: events.RegionChanged, Region: "de_berlin", PreviousRegion: "de-frankfurt"})
+	applyEvent(st, events.Event{Type: events.PortBound, Port: 12345, ExpiresAt: expiresAt, RenewsAt: renewsAt, Time: boundAt, Gateway: "10.8.110.1", Hostname: "berlin419"})
+	if st.Port != 12345 || !st.ExpiresAt.Equal(expiresAt) || !st.LastBindAt.Equal(boundAt) {
+		t.Errorf("Expected bound port 12345, got %+v", st)
+	}
+	if expected := (state.KnownGateway{Gateway: "10.8.110.1", Hostname: "berlin419", Region: "de_berlin", BoundAt: boundAt}); st.KnownGateway == nil || *st.KnownGateway != expected {
+		t.Errorf("Expected the gateway bound through to be known, got %+v", st.KnownGateway)
+	}
+	if !st.RenewsAt.Equal(renewsAt) {
+		t.Errorf("Expected renewal at %v, got %v", renewsAt, st.RenewsAt)
+	}
+	if st.BindFailures != 2 || st.ConsecutiveFailures != 0 || st.LastError != "" {
+		t.Errorf("Expected the bind to clear the current failures, got %+v", st)
+	}
+
+	applyEvent(st, events.Event{Type: events.VPNReconnected, Gateway: "10.9.0.1", Hostname: "berlin420"})
+	if st.Gateway != "10.9.0.1" || st.Hostname != "berlin420" {
+		t.Errorf("Expected the reconnected gateway, got %q %q", st.Gateway, st.Hostname)
+	}
+
+	// A probe that can't run keeps the last result
+	applyEvent(st, events.Event{Type: events.UDPProbed, Port: 12345, ProbesSent: 10, ProbesReceived: 8, Time: boundAt})
+	applyEvent(st, events.Event{Type: events.UDPProbed, Port: 12345, Error: "port 12345 is in use by another program", Time: boundAt.Add(time.Minute)})
+	if st.UDPProbesSent != 10 || st.UDPProbesReceived != 8 || st.UDPProbeError == "" || !st.LastUDPProbeAt.Equal(boundAt.Add(time.Minute)) {
+		t.Errorf("Expected the failed probe to keep the last result, got %+v", st)
+	}
+
+	// Token and signature requests are kept for restarts to check
+	applyEvent(st, events.Event{Type: events.TokenRefreshed, Time: boundAt})
+	applyEvent(st, events.Event{Type: events.AuthFailed, Time: boundAt.Add(time.Minute)})
+	applyEvent(st, events.Event{Type: events.SignatureFailed, Time: boundAt.Add(2 * time.Minute)})
+	applyEvent(st, events.Event{Type: events.SignatureRetried, Time: boundAt.Add(3 * time.Minute), Attempt: 1})
+	if len(st.TokenRequests) != 2 || len(st.SignatureRequests) != 2 {
+		t.Errorf("Expected 2 token and 2 signature requests, got %v and %v", st.TokenRequests, st.SignatureRequests)
+	}
+
+	// Hook runs are tallied by hook, a success clearing the last error
+	applyEvent(st, events.Event{Type: events.HookRan, Hook: hookPortChange, ExitCode: 1, Error: "exit status 1", ConsecutiveFailures: 1, Time: boundAt})
+	applyEvent(st, events.Event{Type: events.HookRan, Hook: hookExit, Duration: time.Second, Time: boundAt})
+	applyEvent(st, events.Event{Type: events.HookRan, Hook: hookPortChange, Duration: 2 * time.Second, Time: boundAt.Add(time.Minute)})
+	if stats := st.Hooks[hookPortChange]; stats.Runs != 2 || stats.Failures != 1 || stats.ConsecutiveFailures != 0 || stats.LastExitCode != 0 || stats.LastError != "" || stats.LastDuration != 2*time.Second || !stats.LastRunAt.Equal(boundAt.Add(time.Minute)) {
+		t.Errorf("Expected 2 port change runs, the last successful, got %+v", stats)
+	}
+	if stats := st.Hooks[hookExit]; stats.Runs != 1 || stats.Failures != 0 {
+		t.Errorf("Expected 1 exit run, got %+v", stats)
+	}
+
+	// A timeout is a failed run that's also counted separately
+	applyEvent(st, events.Event{Type: events.HookRan, Hook: hookExit, ExitCode: -1, Error: "timed out: signal: terminated", ConsecutiveFailures: 1, Time: boundAt})
+	applyEvent(st, events.Event{Type: events.HookTimedOut, Hook: hookExit, ExitCode: -1, Error: "timed out: signal: terminated", ConsecutiveFailures: 1, Time: boundAt})
+	if stats := st.Hooks[hookExit]; stats.Runs != 2 || stats.Failures != 1 || stats.Timeouts != 1 || stats.LastExitCode != -1 {
+		t.Errorf("Expected 2 exit runs, 1 timed out, got %+v", stats)
+	}
+
+	// Output writes are tallied by output, a success clearing the last error
+	applyEvent(st, events.Event{Type: events.OutputWritten, Output: config.OutputNameDDNS, Port: 12345, Attempt: 1, Error: "rate limited", ConsecutiveFailures: 1, Time: boundAt})
+	applyEvent(st, events.Event{Type: events.OutputWritten, Output: config.OutputNameDDNS, Port: 12345, Attempt: 2, Time: boundAt.Add(time.Minute)})
+	applyEvent(st, events.Event{Type: events.OutputWritten, Output: config.OutputNameFile, Port: 12345, Attempt: 1, Error: "read-only file system", ConsecutiveFailures: 1, Time: boundAt})
+	if stats := st.Outputs[config.OutputNameDDNS]; stats.Writes != 2 || stats.Failures != 1 || stats.ConsecutiveFailures != 0 || stats.LastError != "" || !stats.LastSuccessAt.Equal(boundAt.Add(time.Minute)) {
+		t.Errorf("Expected 2 ddns writes, the last successful, got %+v", stats)
+	}
+	if stats := st.Outputs[config.OutputNameFile]; stats.Failures != 1 || stats.LastError != "read-only file system" || !stats.LastSuccessAt.IsZero() || stats.LastPort != 12345 {
+		t.Errorf("Expected a failed output file write, got %+v", stats)
+	}
+}
+
+func TestOutputFailureIsolation(t *testing.T) {
+	dir := t.TempDir()
+	// A file where the manual-connections directory should be can't be written to
+	blocked := filepath.Join(dir, "blocked")
+	os.WriteFile(blocked, nil, 0644)
+	cfg := &config.Config{OutputFile: filepath.Join(dir, "port"), ManualConnectionsDir: filepath.Join(blocked, "pia"), OutputRetry: "manual-connections=0"}
+
+	bus := events.NewBus()
+	closeOutputs := subscribeHandlers(bus, bus, cfg, nil)
+	defer closeOutputs()
+	// Outputs report from their own goroutines
+	var mu sync.Mutex
+	var written []events.Event
+	bus.Subscribe(func(e events.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		written = append(written, e)
+	}, events.OutputWritten)
+
+	failuresBefore := outputFailures.With(config.OutputNameManualConnections).Value()
+	bus.Publish(events.Event{Type: events.PortBound, Port: 12345, Signature: "signature"})
+
+	if data, err := os.ReadFile(cfg.OutputFile); err != nil || string(data) != "12345" {
+		t.Errorf("Expected the output file to be written despite the failing output, got %q, %v", data, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	results := map[string]string{}
+	for _, e := range written {
+		results[e.Output] = e.Error
+	}
+	if err, ok := results[config.OutputNameFile]; !ok || err != "" {
+		t.Errorf("Expected a successful output file write to be reported, got %v", results)
+	}
+	if results[config.OutputNameManualConnections] == "" {
+		t.Errorf("Expected the manual-connections failure to be reported, got %v", results)
+	}
+	if n := outputFailures.With(config.OutputNameManualConnections).Value() - failuresBefore; n != 1 {
+		t.Errorf("Expected 1 manual-connections failure in the metrics, got %d", n)
+	}
+}
+
+func TestManualConnectionsFiles(t *testing.T) {
+	dir := t.TempDir()
+	bus := events.NewBus()
+	subscribeHandlers(bus, bus, &config.Config{OutputFile: filepath.Join(dir, "port"), ManualConnectionsDir: dir}, nil)
+
+	jsonFile := filepath.Join(dir, portforwarding.ManualConnectionsJSON)
+	bound := events.Event{Type: events.PortBound, Port: 12345, Payload: "payload", Signature: "signature-1"}
+	bus.Publish(bound)
+	if _, err := os.Stat(jsonFile); err != nil {
+		t.Fatalf("Expected %s after the first bind: %v", portforwarding.ManualConnectionsJSON, err)
+	}
+
+	// Keepalive binds with the same signature don't rewrite the files
+	os.Remove(jsonFile)
+	bus.Publish(bound)
+	if _, err := os.Stat(jsonFile); !os.IsNotExist(err) {
+		t.Errorf("Expected no rewrite for the same signature, got %v", err)
+	}
+
+	bound.Signature = "signature-2"
+	bus.Publish(bound)
+	if _, err := os.Stat(jsonFile); err != nil {
+		t.Errorf("Expected %s to be rewritten for a new signature: %v", portforwarding.ManualConnectionsJSON, err)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "haproxy.tmpl")
+	target := filepath.Join(dir, "haproxy.cfg")
+	os.WriteFile(source, []byte("bind :{{.Port}} # was {{.PreviousPort}} via {{.Gateway}}\n"), 0644)
+
+	bus := events.NewBus()
+	subscribeHandlers(bus, bus, &config.Config{OutputFile: filepath.Join(dir, "port"), Templates: source + "=" + target}, nil)
+
+	bus.Publish(events.Event{Type: events.PortChanged, Port: 23456, PreviousPort: 12345, Gateway: "10.0.0.1"})
+	data, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatalf("Expected the template to be rendered: %v", err)
+	}
+	if string(data) != "bind :23456 # was 12345 via 10.0.0.1\n" {
+		t.Errorf("Unexpected rendered template: %q", data)
+	}
+}
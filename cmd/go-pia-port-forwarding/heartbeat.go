@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/events"
+)
+
+const (
+	// heartbeatTimeout bounds each ping to the monitor
+	heartbeatTimeout = 10 * time.Second
+	// heartbeatQueueSize bounds the pings waiting to be sent; more are dropped
+	// while the monitor is unreachable
+	heartbeatQueueSize = 4
+)
+
+// heartbeat pings an uptime monitor after every bind, and its failure URL
+// while binding keeps failing
+type heartbeat struct {
+	okURL     string
+	failURL   string
+	userAgent string
+	client    *http.Client
+	// Pings waiting for run to send them, in order, so a late success can't
+	// cover up a failure
+	queue chan string
+}
+
+// startHeartbeat pings the configured monitor about events on bus until ctx is done
+func startHeartbeat(ctx context.Context, cfg *config.Config, bus *events.Bus) {
+	h := &heartbeat{
+		okURL:     cfg.HeartbeatURL,
+		failURL:   heartbeatFailURL(cfg),
+		userAgent: requestHeaders(cfg).Get("User-Agent"),
+		client:    &http.Client{Timeout: heartbeatTimeout},
+		queue:     make(chan string, heartbeatQueueSize),
+	}
+	bus.Subscribe(h.handle, events.PortBound, events.BindFailed)
+	go h.run(ctx)
+}
+
+// heartbeatFailURL returns the URL pinged on persistent failure:
+// --heartbeat-fail-url, or the heartbeat URL with /fail appended to its path
+// as healthchecks.io expects
+func heartbeatFailURL(cfg *config.Config) string {
+	if cfg.HeartbeatFailURL != "" {
+		return cfg.HeartbeatFailURL
+	}
+	u, err := url.Parse(cfg.HeartbeatURL)
+	if err != nil {
+		return ""
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/fail"
+	u.RawPath = ""
+	return u.String()
+}
+
+// handle queues the ping for e
+func (h *heartbeat) handle(e events.Event) {
+	target := h.okURL
+	if e.Type == events.BindFailed {
+		if e.ConsecutiveFailures < readyFailureThreshold {
+			return
+		}
+		target = h.failURL
+	}
+	select {
+	case h.queue <- target:
+	default:
+		log.Printf("Dropped heartbeat, the monitor isn't keeping up")
+	}
+}
+
+// run sends queued pings until ctx is done
+func (h *heartbeat) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case target := <-h.queue:
+			if err := h.ping(ctx, target); err != nil {
+				log.Printf("Heartbeat failed: %v", err)
+			}
+		}
+	}
+}
+
+// ping requests target. Errors leave out the URL, which identifies the check
+// and lets anyone who has it report to it.
+func (h *heartbeat) ping(ctx context.Context, target string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return fmt.Errorf("invalid heartbeat URL: %w", err)
+	}
+	if h.userAgent != "" {
+		req.Header.Set("User-Agent", h.userAgent)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("request to %s failed: %w", req.URL.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s replied %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
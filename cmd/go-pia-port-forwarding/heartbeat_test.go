@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/events"
+)
+
+func TestHeartbeatFailURL(t *testing.T) {
+	testCases := []struct {
+		name     string
+		cfg      config.Config
+		expected string
+	}{
+		{
+			name:     "healthchecks.io",
+			cfg:      config.Config{HeartbeatURL: "https://hc-ping.com/eb095278-f28d-448d-87fb-7b75c171a6aa"},
+			expected: "https://hc-ping.com/eb095278-f28d-448d-87fb-7b75c171a6aa/fail",
+		},
+		{
+			name:     "Trailing slash and query",
+			cfg:      config.Config{HeartbeatURL: "https://hc-ping.com/abc/?rid=1"},
+			expected: "https://hc-ping.com/abc/fail?rid=1",
+		},
+		{
+			name:     "Explicit",
+			cfg:      config.Config{HeartbeatURL: "https://kuma.lan/api/push/abc?status=up", HeartbeatFailURL: "https://kuma.lan/api/push/abc?status=down"},
+			expected: "https://kuma.lan/api/push/abc?status=down",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := heartbeatFailURL(&tc.cfg); got != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestHeartbeatPings(t *testing.T) {
+	requests := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.URL.Path + " " + r.Header.Get("User-Agent")
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bus := events.NewBus()
+	startHeartbeat(ctx, &config.Config{HeartbeatURL: server.URL + "/ping/abc", UserAgent: "test"}, bus)
+
+	for _, e := range []events.Event{
+		{Type: events.PortBound, Port: 12345},
+		{Type: events.BindFailed, Port: 12345, ConsecutiveFailures: 1},
+		{Type: events.BindFailed, Port: 12345, ConsecutiveFailures: 2},
+		{Type: events.BindFailed, Port: 12345, ConsecutiveFailures: 3},
+		{Type: events.PortBound, Port: 12345},
+	} {
+		bus.Publish(e)
+	}
+
+	var got []string
+	for range 3 {
+		got = append(got, <-requests)
+	}
+	expected := []string{"/ping/abc test", "/ping/abc/fail test", "/ping/abc test"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/events"
+)
+
+// Names the hook scripts are reported under
+const (
+	hookPortChange     = "port-change"
+	hookPortKeepFailed = "port-keep-failed"
+	hookRegionChange   = "region-change"
+	hookExit           = "exit"
+)
+
+// hookRecorder publishes a HookRan event for every hook script run, so
+// failures show in the metrics and the status command even when the script
+// runs in the background
+type hookRecorder struct {
+	mu  sync.Mutex
+	bus *events.Bus
+	// Failed runs since the last success, by hook
+	consecutiveFailures map[string]int
+}
+
+// hooks records the hook scripts run by this process
+var hooks = &hookRecorder{consecutiveFailures: make(map[string]int)}
+
+// publishTo sends the following HookRan events to bus
+func (h *hookRecorder) publishTo(bus *events.Bus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.bus = bus
+}
+
+// record reports a run of hook with the context it ran with, which started at
+// started and ended with err, nil if it exited successfully. A run stopped
+// because ctx timed out is also published as HookTimedOut.
+func (h *hookRecorder) record(ctx context.Context, hook string, started time.Time, err error) {
+	e := events.Event{Type: events.HookRan, Hook: hook, Duration: time.Since(started)}
+	timedOut := err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded)
+	if err != nil {
+		e.Error = err.Error()
+		if timedOut {
+			e.Error = "timed out: " + e.Error
+		}
+		e.ExitCode = -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			e.ExitCode = exitErr.ExitCode()
+		}
+	}
+
+	h.mu.Lock()
+	if err != nil {
+		h.consecutiveFailures[hook]++
+	} else {
+		h.consecutiveFailures[hook] = 0
+	}
+	e.ConsecutiveFailures = h.consecutiveFailures[hook]
+	bus := h.bus
+	h.mu.Unlock()
+
+	if timedOut {
+		log.Printf("Warning: the %s hook timed out and was stopped after %s", hook, e.Duration.Round(time.Millisecond))
+	}
+	if e.ConsecutiveFailures > 1 {
+		log.Printf("Warning: the %s hook has failed %d times in a row", hook, e.ConsecutiveFailures)
+	}
+	if bus == nil {
+		return
+	}
+	bus.Publish(e)
+	if timedOut {
+		e.Type = events.HookTimedOut
+		bus.Publish(e)
+	}
+}
@@ -0,0 +1,224 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/events"
+	"github.com/meschansky/go-pia/internal/portforwarding/pftest"
+	"github.com/meschansky/go-pia/internal/vpn"
+)
+
+// useHookRecorder gives a test its own hook recorder and returns the events it
+// publishes
+func useHookRecorder(t *testing.T) func() []events.Event {
+	t.Helper()
+	orig := hooks
+	hooks = &hookRecorder{consecutiveFailures: make(map[string]int)}
+	t.Cleanup(func() { hooks = orig })
+
+	var mu sync.Mutex
+	var ran []events.Event
+	bus := events.NewBus()
+	bus.Subscribe(func(e events.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		ran = append(ran, e)
+	}, events.HookRan, events.HookTimedOut)
+	hooks.publishTo(bus)
+
+	return func() []events.Event {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]events.Event(nil), ran...)
+	}
+}
+
+func TestHookRecorder(t *testing.T) {
+	useScriptTracker(t)
+	ran := useHookRecorder(t)
+	cfg := &config.Config{
+		OutputFile:    filepath.Join(t.TempDir(), "port.txt"),
+		ScriptTimeout: 5 * time.Second,
+	}
+
+	// Async scripts are recorded once they exit, a missing one right away
+	cfg.OnPortChangeScript = writeScript(t, "exit 3\n")
+	executePortChangeScript(cfg, 12345, time.Time{}, time.Time{}, nil)
+	executePortChangeScript(cfg, 12345, time.Time{}, time.Time{}, nil)
+	if !scripts.drain(5 * time.Second) {
+		t.Fatalf("Expected the scripts to finish")
+	}
+	cfg.OnPortChangeScript = filepath.Join(t.TempDir(), "missing.sh")
+	executePortChangeScript(cfg, 12345, time.Time{}, time.Time{}, nil)
+	cfg.SyncScript = true
+	cfg.OnPortChangeScript = writeScript(t, "exit 0\n")
+	executePortChangeScript(cfg, 12345, time.Time{}, time.Time{}, nil)
+
+	expected := []struct {
+		exitCode            int
+		consecutiveFailures int
+		failed              bool
+	}{
+		{3, 1, true},
+		{3, 2, true},
+		{-1, 3, true},
+		{0, 0, false},
+	}
+	got := ran()
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %d hook-ran events, got %+v", len(expected), got)
+	}
+	for i, want := range expected {
+		e := got[i]
+		if e.Hook != hookPortChange || e.ExitCode != want.exitCode || e.ConsecutiveFailures != want.consecutiveFailures || (e.Error != "") != want.failed {
+			t.Errorf("Run %d: expected exit code %d and %d failures in a row, got %+v", i+1, want.exitCode, want.consecutiveFailures, e)
+		}
+	}
+}
+
+func TestHookTimeoutStopsProcessGroup(t *testing.T) {
+	useScriptTracker(t)
+	ran := useHookRecorder(t)
+	out := filepath.Join(t.TempDir(), "out")
+	cfg := &config.Config{
+		// The child would write the file after the script has been stopped
+		OnPortChangeScript: writeScript(t, "(sleep 1; touch "+out+") &\nexec sleep 30\n"),
+		OutputFile:         filepath.Join(t.TempDir(), "port.txt"),
+		ScriptTimeout:      200 * time.Millisecond,
+	}
+
+	executePortChangeScript(cfg, 12345, time.Time{}, time.Time{}, nil)
+	if !scripts.drain(5 * time.Second) {
+		t.Fatalf("Expected the script to be stopped at its timeout")
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := os.Stat(out); err == nil {
+		t.Errorf("Expected the script's child to be stopped with it")
+	}
+
+	got := ran()
+	if len(got) != 2 || got[0].Type != events.HookRan || got[1].Type != events.HookTimedOut {
+		t.Fatalf("Expected hook-ran then hook-timed-out, got %+v", got)
+	}
+	if got[1].Hook != hookPortChange || got[1].ExitCode != -1 {
+		t.Errorf("Expected the port change hook stopped by a signal, got %+v", got[1])
+	}
+}
+
+// Test for script execution functionality, from the port a fake forwarder
+// hands the manager to the script's arguments
+func TestScriptExecution(t *testing.T) {
+	testCases := []struct {
+		name        string
+		syncScript  bool
+		missing     bool
+		expectError bool
+	}{
+		{name: "Valid script synchronous", syncScript: true},
+		{name: "Valid script asynchronous"},
+		{name: "Non-existent script", syncScript: true, missing: true, expectError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			useScriptTracker(t)
+			ran := useHookRecorder(t)
+			fake := useFakeClock(t)
+			dir := t.TempDir()
+			cfg := config.DefaultConfig()
+			cfg.OutputFile = filepath.Join(dir, "port.txt")
+			cfg.RefreshJitter = 0
+			cfg.SyncScript = tc.syncScript
+			out := filepath.Join(dir, "out")
+			cfg.OnPortChangeScript = writeScript(t, "echo \"$1 $2 $PIA_PORT\" > "+out+"\n")
+			if tc.missing {
+				cfg.OnPortChangeScript = filepath.Join(dir, "nonexistent.sh")
+			}
+
+			bus := events.NewBus()
+			defer subscribeHandlers(bus, bus, cfg, nil)()
+			forwarder := pftest.NewForwarder(pftest.Signature(12345, fake.Now().Add(48*time.Hour)))
+			connInfo := &vpn.ConnectionInfo{GatewayIP: "10.0.0.1", Hostname: "server"}
+			manager := newManager(cfg, bus, forwarder, newFixedToken("test-token"), connInfo)
+
+			// The manager waits for the keepalive once the port is bound
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error, 1)
+			go func() { done <- manager.Run(ctx) }()
+			if err := fake.BlockUntil(ctx, 1); err != nil {
+				t.Fatal(err)
+			}
+			cancel()
+			if err := <-done; err != nil {
+				t.Fatalf("Manager failed: %v", err)
+			}
+			if !scripts.drain(5 * time.Second) {
+				t.Fatalf("Expected the script to finish")
+			}
+
+			// Check if error matches expectation
+			results := ran()
+			if len(results) != 1 {
+				t.Fatalf("Expected the script to run once, got %+v", results)
+			}
+			if tc.expectError && results[0].Error == "" {
+				t.Errorf("Expected error but got nil")
+			}
+			if !tc.expectError && results[0].Error != "" {
+				t.Errorf("Expected no error but got: %v", results[0].Error)
+			}
+			if !tc.missing {
+				expected := "12345 " + cfg.OutputFile + " 12345\n"
+				if data, err := os.ReadFile(out); err != nil || string(data) != expected {
+					t.Errorf("Expected the script to get %q, got %q, %v", expected, data, err)
+				}
+			}
+		})
+	}
+}
+
+func TestPortChangeScriptWaitsForPortFile(t *testing.T) {
+	// A file stands where the port file's directory should be until after the
+	// first attempt
+	dir := filepath.Join(t.TempDir(), "pia")
+	os.WriteFile(dir, nil, 0644)
+	out := filepath.Join(t.TempDir(), "out")
+	cfg := &config.Config{
+		OutputFile:         filepath.Join(dir, "port.txt"),
+		OutputRetry:        "output-file=1/200ms",
+		OnPortChangeScript: writeScript(t, "cat \"$2\" > "+out+"\n"),
+		SyncScript:         true,
+		ScriptTimeout:      5 * time.Second,
+	}
+
+	bus := events.NewBus()
+	defer subscribeHandlers(bus, bus, cfg, nil)()
+	bus.Publish(events.Event{Type: events.PortBound, Port: 12345})
+	bus.Publish(events.Event{Type: events.PortChanged, Port: 12345})
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Fatalf("Expected the script to wait for the port file, got %v", err)
+	}
+
+	// The script runs once the retry writes the port file
+	os.Remove(dir)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, err := os.ReadFile(out)
+		if err == nil && string(data) == "12345" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the script to read the port from the port file, got %q, %v", data, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/portforwarding"
+	"github.com/meschansky/go-pia/internal/state"
+	"github.com/meschansky/go-pia/internal/vpn"
+)
+
+// probeKnownGateway checks that a gateway from the state file still accepts
+// connections on the API port; tests replace it
+var probeKnownGateway = func(cfg *config.Config, known *state.KnownGateway, caCertPath string) error {
+	client := portforwarding.NewClient("", known.Gateway, known.Hostname, caCertPath)
+	defer client.Close()
+	if cfg.GatewayPort != 0 {
+		client.SetAPIPort(cfg.GatewayPort)
+	}
+	return client.ProbeGateway()
+}
+
+// knownGateway returns the gateway the port was last bound through if that
+// was within --known-gateway-max-age and it still answers, so a restart
+// doesn't wait for detection. It returns nil when the VPN must be detected.
+func knownGateway(cfg *config.Config, known *state.KnownGateway, caCertPath string) *vpn.ConnectionInfo {
+	if known == nil || known.Gateway == "" || cfg.KnownGatewayMaxAge == 0 {
+		return nil
+	}
+	// A configured gateway needs no detection, a managed VPN may come up in
+	// another region, and a remote host's gateway can't be probed from here
+	if cfg.Gateway != "" || cfg.ManageVPN != "" || cfg.RemoteHost != "" {
+		return nil
+	}
+
+	age := clk.Now().Sub(known.BoundAt)
+	if age > cfg.KnownGatewayMaxAge {
+		log.Printf("Gateway %s was last bound %s ago, detecting the VPN again", known.Gateway, age.Round(time.Second))
+		return nil
+	}
+	if err := probeKnownGateway(cfg, known, caCertPath); err != nil {
+		log.Printf("Gateway %s from the state file doesn't answer (%v), detecting the VPN again", known.Gateway, err)
+		return nil
+	}
+	log.Printf("Reusing gateway %s (%s) from the state file, last bound %s ago", known.Gateway, known.Hostname, age.Round(time.Second))
+	return &vpn.ConnectionInfo{GatewayIP: known.Gateway, Hostname: known.Hostname}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/state"
+)
+
+func TestKnownGateway(t *testing.T) {
+	fake := useFakeClock(t)
+	probe := probeKnownGateway
+	t.Cleanup(func() { probeKnownGateway = probe })
+	unreachable := errors.New("connection timed out")
+
+	testCases := []struct {
+		name     string
+		modify   func(cfg *config.Config)
+		known    *state.KnownGateway
+		probe    error
+		expected bool
+	}{
+		{
+			name:     "Bound recently and answering",
+			known:    &state.KnownGateway{Gateway: "10.8.110.1", Hostname: "berlin419", BoundAt: fake.Now().Add(-10 * time.Minute)},
+			expected: true,
+		},
+		{
+			name:  "Bound too long ago",
+			known: &state.KnownGateway{Gateway: "10.8.110.1", Hostname: "berlin419", BoundAt: fake.Now().Add(-2 * time.Hour)},
+		},
+		{
+			name:  "Not answering",
+			known: &state.KnownGateway{Gateway: "10.8.110.1", Hostname: "berlin419", BoundAt: fake.Now().Add(-10 * time.Minute)},
+			probe: unreachable,
+		},
+		{
+			name: "Nothing recorded",
+		},
+		{
+			name:   "Disabled",
+			modify: func(cfg *config.Config) { cfg.KnownGatewayMaxAge = 0 },
+			known:  &state.KnownGateway{Gateway: "10.8.110.1", Hostname: "berlin419", BoundAt: fake.Now().Add(-10 * time.Minute)},
+		},
+		{
+			name:   "Managed VPN",
+			modify: func(cfg *config.Config) { cfg.ManageVPN = config.ManageOpenVPN },
+			known:  &state.KnownGateway{Gateway: "10.8.110.1", Hostname: "berlin419", BoundAt: fake.Now().Add(-10 * time.Minute)},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{KnownGatewayMaxAge: time.Hour}
+			if tc.modify != nil {
+				tc.modify(cfg)
+			}
+			probed := false
+			probeKnownGateway = func(cfg *config.Config, known *state.KnownGateway, caCertPath string) error {
+				probed = true
+				return tc.probe
+			}
+
+			connInfo := knownGateway(cfg, tc.known, "ca.crt")
+			if !tc.expected {
+				if connInfo != nil {
+					t.Errorf("Expected the VPN to be detected, got %+v", connInfo)
+				}
+				return
+			}
+			if connInfo == nil || connInfo.GatewayIP != "10.8.110.1" || connInfo.Hostname != "berlin419" {
+				t.Errorf("Expected the known gateway, got %+v", connInfo)
+			}
+			if !probed {
+				t.Error("Expected the known gateway to be probed")
+			}
+		})
+	}
+}
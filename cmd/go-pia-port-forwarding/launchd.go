@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	// launchdLabel identifies the service to launchd
+	launchdLabel = "com.github.meschansky.go-pia"
+	// launchdPlistPath is where the system-wide launch daemon is installed
+	launchdPlistPath = "/Library/LaunchDaemons/" + launchdLabel + ".plist"
+	// launchdLogPath receives the service's output
+	launchdLogPath = "/var/log/go-pia-port-forwarding.log"
+)
+
+// launchdJob describes what the launchd plist runs
+type launchdJob struct {
+	Program    string
+	Args       []string
+	WorkingDir string
+	Env        map[string]string
+	LogPath    string
+}
+
+// renderLaunchdPlist renders a launch daemon plist that keeps the job running
+func renderLaunchdPlist(job launchdJob) string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+`)
+	writePlistKey(&b, "Label", launchdLabel)
+
+	b.WriteString("\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, arg := range append([]string{job.Program}, job.Args...) {
+		b.WriteString("\t\t<string>" + xmlEscape(arg) + "</string>\n")
+	}
+	b.WriteString("\t</array>\n")
+
+	if job.WorkingDir != "" {
+		writePlistKey(&b, "WorkingDirectory", job.WorkingDir)
+	}
+
+	// Sort the environment so the plist is stable across installs
+	if len(job.Env) > 0 {
+		keys := make([]string, 0, len(job.Env))
+		for k := range job.Env {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		b.WriteString("\t<key>EnvironmentVariables</key>\n\t<dict>\n")
+		for _, k := range keys {
+			b.WriteString("\t\t<key>" + xmlEscape(k) + "</key>\n\t\t<string>" + xmlEscape(job.Env[k]) + "</string>\n")
+		}
+		b.WriteString("\t</dict>\n")
+	}
+
+	b.WriteString("\t<key>RunAtLoad</key>\n\t<true/>\n")
+	b.WriteString("\t<key>KeepAlive</key>\n\t<true/>\n")
+
+	if job.LogPath != "" {
+		writePlistKey(&b, "StandardOutPath", job.LogPath)
+		writePlistKey(&b, "StandardErrorPath", job.LogPath)
+	}
+
+	b.WriteString("</dict>\n</plist>\n")
+	return b.String()
+}
+
+// writePlistKey writes a string-valued key to a plist dict
+func writePlistKey(b *strings.Builder, key, value string) {
+	b.WriteString("\t<key>" + key + "</key>\n\t<string>" + xmlEscape(value) + "</string>\n")
+}
+
+// xmlEscape escapes s for use as XML character data
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// serviceEnvironment returns the PIA_* variables from the current environment so
+// the installed service sees the same configuration
+func serviceEnvironment() map[string]string {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		key, value, ok := strings.Cut(kv, "=")
+		if ok && strings.HasPrefix(key, "PIA_") {
+			env[key] = value
+		}
+	}
+	return env
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRenderLaunchdPlist(t *testing.T) {
+	plist := renderLaunchdPlist(launchdJob{
+		Program:    "/usr/local/bin/go-pia-port-forwarding",
+		Args:       []string{"--on-port-change=/opt/pia/notify.sh & echo", "/var/run/pia-port.txt"},
+		WorkingDir: "/Users/pia",
+		Env:        map[string]string{"PIA_DEBUG": "true", "PIA_CREDENTIALS": "/etc/pia.txt"},
+		LogPath:    "/var/log/go-pia-port-forwarding.log",
+	})
+
+	// The result must be well-formed XML
+	decoder := xml.NewDecoder(strings.NewReader(plist))
+	for {
+		if _, err := decoder.Token(); err != nil {
+			if err != io.EOF {
+				t.Fatalf("Invalid plist XML: %v", err)
+			}
+			break
+		}
+	}
+
+	for _, want := range []string{
+		"<string>" + launchdLabel + "</string>",
+		"<string>/usr/local/bin/go-pia-port-forwarding</string>",
+		"<string>--on-port-change=/opt/pia/notify.sh &amp; echo</string>",
+		"<key>WorkingDirectory</key>\n\t<string>/Users/pia</string>",
+		"<key>KeepAlive</key>",
+		"<key>StandardErrorPath</key>",
+	} {
+		if !strings.Contains(plist, want) {
+			t.Errorf("Expected plist to contain %q, got:\n%s", want, plist)
+		}
+	}
+
+	// Environment variables are sorted for stable output
+	if strings.Index(plist, "PIA_CREDENTIALS") > strings.Index(plist, "PIA_DEBUG") {
+		t.Errorf("Expected environment variables to be sorted:\n%s", plist)
+	}
+}
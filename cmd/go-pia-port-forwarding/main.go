@@ -2,25 +2,53 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/meschansky/go-pia/internal/auth"
+	"github.com/meschansky/go-pia/internal/clock"
 	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/daemon"
+	"github.com/meschansky/go-pia/internal/events"
+	"github.com/meschansky/go-pia/internal/fswait"
+	"github.com/meschansky/go-pia/internal/httplog"
+	"github.com/meschansky/go-pia/internal/lock"
+	"github.com/meschansky/go-pia/internal/metrics"
+	"github.com/meschansky/go-pia/internal/piaca"
 	"github.com/meschansky/go-pia/internal/portforwarding"
+	"github.com/meschansky/go-pia/internal/redact"
+	"github.com/meschansky/go-pia/internal/remote"
+	"github.com/meschansky/go-pia/internal/resolver"
+	"github.com/meschansky/go-pia/internal/runner"
+	"github.com/meschansky/go-pia/internal/state"
+	"github.com/meschansky/go-pia/internal/systemd"
 	"github.com/meschansky/go-pia/internal/vpn"
 )
 
 // Mock the exec.CommandContext function for testing
 var execCommand = exec.CommandContext
 
+// Mock the VPN detection for testing
+var detectVPN = (*vpn.Detector).Detect
+
+// clk is what retry loops and watchers wait on, a fake clock in tests
+var clk clock.Clock = clock.Real
+
 // getScriptMode returns a string describing the script execution mode
 func getScriptMode(cfg *config.Config) string {
 	if cfg.SyncScript {
@@ -29,43 +57,54 @@ func getScriptMode(cfg *config.Config) string {
 	return "asynchronous"
 }
 
-// executePortChangeScript runs the configured script when the port changes
-func executePortChangeScript(cfg *config.Config, port int) {
+// executePortChangeScript runs the configured script when the port changes. The
+// port and output file are passed as arguments, and the port, signature
+// validity and previous ports still in their grace period as environment
+// variables.
+func executePortChangeScript(cfg *config.Config, port int, expiresAt, renewsAt time.Time, previousPorts []int) {
 	log.Printf("Executing port change script: %s", cfg.OnPortChangeScript)
 
-	// Create a context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), cfg.ScriptTimeout)
-	defer cancel()
-
-	// Create the command using the execCommand variable for better testability
-	cmd := execCommand(ctx, cfg.OnPortChangeScript, strconv.Itoa(port), cfg.OutputFile)
-
 	// If running synchronously, capture output
 	if cfg.SyncScript {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ScriptTimeout)
+		defer cancel()
+		cmd := execCommand(ctx, cfg.OnPortChangeScript, strconv.Itoa(port), cfg.OutputFile)
+		cmd.Env = append(os.Environ(), scriptEnv(port, expiresAt, renewsAt)...)
+		cmd.Env = append(cmd.Env, "PIA_PREVIOUS_PORTS="+joinPorts(previousPorts))
+
 		// Capture output
+		started := time.Now()
 		output, err := cmd.CombinedOutput()
+		hooks.record(ctx, hookPortChange, started, err)
 		if err != nil {
 			log.Printf("Script execution failed: %v\nOutput: %s", err, string(output))
 		} else {
 			log.Printf("Script executed successfully\nOutput: %s", string(output))
 		}
 	} else {
-		// Run asynchronously with proper process detachment
+		// Run asynchronously with proper process detachment, tracked so shutdown
+		// can wait for it
+		ctx, done := scripts.start(cfg.ScriptTimeout)
+		cmd := execCommand(ctx, cfg.OnPortChangeScript, strconv.Itoa(port), cfg.OutputFile)
+		cmd.Env = append(os.Environ(), scriptEnv(port, expiresAt, renewsAt)...)
+		cmd.Env = append(cmd.Env, "PIA_PREVIOUS_PORTS="+joinPorts(previousPorts))
 		cmd.Stdout = nil
 		cmd.Stderr = nil
-		cmd.SysProcAttr = &syscall.SysProcAttr{
-			Setpgid: true,
-			Pgid:    0,
-		}
+		runner.Detach(cmd, scriptStopGrace)
 
+		started := time.Now()
 		if err := cmd.Start(); err != nil {
+			done()
+			hooks.record(ctx, hookPortChange, started, err)
 			log.Printf("Failed to start script: %v", err)
 		} else {
 			log.Printf("Started script asynchronously (pid: %d)", cmd.Process.Pid)
 
 			// Start a goroutine to log when the process completes
 			go func() {
+				defer done()
 				err := cmd.Wait()
+				hooks.record(ctx, hookPortChange, started, err)
 				if err != nil {
 					log.Printf("Async script execution failed (pid: %d): %v", cmd.Process.Pid, err)
 				} else {
@@ -76,22 +115,36 @@ func executePortChangeScript(cfg *config.Config, port int) {
 	}
 }
 
-// detectVPNWithRetry attempts to detect an OpenVPN connection with retries
+// detectVPNWithRetry attempts to detect an OpenVPN connection with retries,
+// giving up after --vpn-detect-max-attempts attempts or --vpn-detect-timeout
 func detectVPNWithRetry(ctx context.Context, cfg *config.Config) (*vpn.ConnectionInfo, error) {
+	deadline := clk.Now().Add(cfg.VPNDetectTimeout)
 	var lastErr error
-	for {
+	for attempt := 1; ; attempt++ {
 		// Try to detect the VPN connection
-		connInfo, err := vpn.DetectOpenVPNConnection(cfg.OpenVPNConfigFile)
+		connInfo, err := detectConnection(cfg)
 		if err == nil {
 			return connInfo, nil
 		}
-
 		lastErr = err
-		log.Printf("Failed to detect OpenVPN connection: %v. Retrying in %s...", err, cfg.VPNRetryInterval)
+
+		// Retry until the budget runs out; the last wait ends at the deadline
+		wait := cfg.VPNRetryInterval
+		if cfg.VPNDetectMaxAttempts > 0 && attempt >= cfg.VPNDetectMaxAttempts {
+			return nil, fmt.Errorf("gave up after %d attempts: %w", attempt, lastErr)
+		}
+		if cfg.VPNDetectTimeout > 0 {
+			remaining := deadline.Sub(clk.Now())
+			if remaining <= 0 {
+				return nil, fmt.Errorf("gave up after %s: %w", cfg.VPNDetectTimeout, lastErr)
+			}
+			wait = min(wait, remaining)
+		}
+		log.Printf("Failed to detect OpenVPN connection: %v. Retrying in %s...", err, wait)
 
 		// Wait for the retry interval or until context is canceled
 		select {
-		case <-time.After(cfg.VPNRetryInterval):
+		case <-clk.After(wait):
 			// Continue with the next attempt
 		case <-ctx.Done():
 			return nil, fmt.Errorf("VPN detection canceled: %w", lastErr)
@@ -99,8 +152,104 @@ func detectVPNWithRetry(ctx context.Context, cfg *config.Config) (*vpn.Connectio
 	}
 }
 
+// detectConnection detects the VPN connection with the configured strategies,
+// on this host or over SSH on the remote host if one is configured
+func detectConnection(cfg *config.Config) (*vpn.ConnectionInfo, error) {
+	detector, err := newDetector(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	connInfo, strategy, err := detectVPN(detector)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Detected VPN connection with the %s strategy", strategy)
+	return connInfo, nil
+}
+
+// newDetector returns a VPN detector for the configuration
+func newDetector(cfg *config.Config) (*vpn.Detector, error) {
+	strategies, err := vpn.ParseStrategies(cfg.Detect)
+	if err != nil {
+		return nil, err
+	}
+
+	detector := &vpn.Detector{
+		Strategies:     strategies,
+		OpenVPNConfig:  cfg.OpenVPNConfigFile,
+		RemoteIndex:    cfg.RemoteIndex,
+		Interface:      cfg.Interface,
+		ManagementAddr: cfg.OpenVPNManagement,
+		Gateway:        cfg.Gateway,
+		Hostname:       cfg.GatewayHostname,
+		Resolver:       resolver.New(cfg.DNSServer),
+	}
+	if cfg.RemoteHost != "" {
+		host, err := remote.Parse(cfg.RemoteHost)
+		if err != nil {
+			return nil, err
+		}
+		detector.Run = host.Output
+	}
+	if managedVPN != nil {
+		managedVPN.Configure(detector)
+	}
+	return detector, nil
+}
+
+// cleanups are run in reverse order when the process exits
+var (
+	cleanupsMu sync.Mutex
+	cleanups   []func()
+)
+
+// addCleanup registers a function to run on exit
+func addCleanup(f func()) {
+	cleanupsMu.Lock()
+	defer cleanupsMu.Unlock()
+	cleanups = append(cleanups, f)
+}
+
+// runCleanups runs all registered cleanups once, most recent first
+func runCleanups() {
+	cleanupsMu.Lock()
+	pending := cleanups
+	cleanups = nil
+	cleanupsMu.Unlock()
+
+	for i := len(pending) - 1; i >= 0; i-- {
+		pending[i]()
+	}
+}
+
+// fatalf logs the message, runs cleanups and exits with the given status
+func fatalf(status int, format string, args ...any) {
+	// --quiet never hides why we exit
+	if quietLog != nil {
+		quietLog.all.Store(true)
+	}
+	log.Printf(format, args...)
+	runCleanups()
+	os.Exit(status)
+}
+
+// setupLogOutput sends log output to the given file, appending to it, with
+// colors if color is set
+func setupLogOutput(path string, color bool) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	log.SetOutput(logWriter(file, color))
+	return nil
+}
+
 // setupLogging configures the logging based on debug mode
 func setupLogging(debug bool) {
+	// Tokens, passwords and signatures never reach the log, even in debug mode
+	log.SetOutput(redact.Default.Writer(log.Writer()))
+
 	if debug {
 		log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
 	} else {
@@ -111,35 +260,232 @@ func setupLogging(debug bool) {
 // logConfigInfo logs the configuration information
 func logConfigInfo(cfg *config.Config) {
 	log.Printf("Starting PIA port forwarding service")
-	log.Printf("Credentials file: %s", cfg.CredentialsFile)
-	log.Printf("Output file: %s", cfg.OutputFile)
+	if cfg.Token != "" {
+		log.Printf("Using the token given with --token, it won't be renewed")
+	} else {
+		log.Printf("Credentials file: %s", cfg.CredentialsFile)
+	}
+	if cfg.StreamsOutput() {
+		log.Printf("Output: streaming the port to stdout")
+	} else {
+		log.Printf("Output file: %s", cfg.OutputFile)
+	}
+	if cfg.RuntimeDir != "" {
+		log.Printf("Runtime directory: %s", cfg.RuntimeDir)
+	}
 	log.Printf("OpenVPN config file: %s", cfg.OpenVPNConfigFile)
+	if cfg.RemoteHost != "" {
+		log.Printf("Remote host: %s (OpenVPN config and output file are on it)", cfg.RemoteHost)
+	}
+	if cfg.RemoteIndex > 0 {
+		log.Printf("OpenVPN remote index: %d", cfg.RemoteIndex)
+	}
+	if cfg.Interface != "" {
+		log.Printf("VPN interface: %s", cfg.Interface)
+	}
+	if cfg.Detect != "" {
+		log.Printf("VPN detection strategies: %s", cfg.Detect)
+	}
+	if cfg.OpenVPNManagement != "" {
+		log.Printf("OpenVPN management interface: %s", cfg.OpenVPNManagement)
+	}
+	if cfg.Gateway != "" {
+		log.Printf("Static gateway: %s", cfg.Gateway)
+	}
+	if cfg.ConnectVia == config.ConnectViaHostname {
+		log.Printf("Connecting to the gateway hostname instead of its IP")
+	}
+	if cfg.ManageVPN == config.ManageWireGuard {
+		log.Printf("WireGuard server: %s (%s)", cfg.WireGuardHostname, cfg.WireGuardServer)
+	}
 	log.Printf("Refresh interval: %s", cfg.RefreshInterval)
+	for _, warning := range cfg.Warnings() {
+		log.Printf("WARNING: %s", warning)
+	}
+	if cfg.RefreshJitter > 0 {
+		log.Printf("Refresh jitter: up to %s", cfg.RefreshJitter)
+	}
 	log.Printf("VPN retry interval: %s", cfg.VPNRetryInterval)
+	if cfg.VPNUnit != "" {
+		log.Printf("VPN unit: %s", cfg.VPNUnit)
+	}
+	if cfg.Debug && cfg.DebugDir != "" {
+		log.Printf("Dumping PIA API requests to: %s", cfg.DebugDir)
+	}
+	if cfg.DNSServer != "" {
+		log.Printf("DNS server: %s", cfg.DNSServer)
+	}
+	if cfg.DNSCache {
+		log.Printf("Caching DNS lookups of PIA hostnames")
+	}
+
+	if cfg.Ubus {
+		log.Printf("Sending %s ubus events", ubusPortEvent)
+	}
+	if cfg.PatchFile != "" {
+		log.Printf("Writing the port into: %s", cfg.PatchFile)
+	}
+	if cfg.Templates != "" {
+		log.Printf("Templates: %s", cfg.Templates)
+		if cfg.TemplateReload != "" {
+			log.Printf("Template reload: %s", cfg.TemplateReload)
+		}
+	}
+	if cfg.DDNSProvider != "" {
+		log.Printf("Dynamic DNS provider: %s", cfg.DDNSProvider)
+		if cfg.DDNSName != "" {
+			log.Printf("DDNS name: %s", cfg.DDNSName)
+		}
+		if cfg.DDNSPortRecord != "" {
+			log.Printf("DDNS port record: %s", cfg.DDNSPortRecord)
+		}
+	}
+	if cfg.UDPProbe != "" {
+		log.Printf("UDP probe: %s every %s", cfg.UDPProbe, cfg.UDPProbeInterval)
+	}
+	if cfg.HeartbeatURL != "" {
+		// The URL is a secret, anyone who has it can report to the check
+		if u, err := url.Parse(cfg.HeartbeatURL); err == nil {
+			log.Printf("Sending heartbeats to %s", u.Host)
+		}
+	}
+	if cfg.Notifier != "" {
+		log.Printf("Push notifications: %s", cfg.Notifier)
+	}
+	if cfg.SMTPServer != "" {
+		log.Printf("Emailing notifications to %s through %s, at most every %s", cfg.SMTPTo, cfg.SMTPServer, cfg.SMTPBatchInterval)
+	}
+	if cfg.DBusSignal != "" {
+		log.Printf("Emitting D-Bus signals on the %s bus", cfg.DBusSignal)
+	}
+	if cfg.NotifyUnit != "" {
+		action, _ := systemd.ParseAction(cfg.NotifySignal)
+		log.Printf("Notifying systemd unit %s (%s)", cfg.NotifyUnit, action)
+	}
 
 	if cfg.OnPortChangeScript != "" {
 		log.Printf("Port change script: %s", cfg.OnPortChangeScript)
 		log.Printf("Script execution mode: %s", getScriptMode(cfg))
 		log.Printf("Script timeout: %s", cfg.ScriptTimeout)
 	}
+	if cfg.PortChangeDebounce > 0 {
+		log.Printf("Port changes coalesced within: %s", cfg.PortChangeDebounce)
+	}
+	if cfg.PreviousPortGrace > 0 {
+		log.Printf("Previous ports kept for: %s", cfg.PreviousPortGrace)
+	}
+	if cfg.OnExitScript != "" {
+		log.Printf("Exit script: %s", cfg.OnExitScript)
+	}
+	if cfg.KeepPortAttempts > 0 {
+		log.Printf("Keeping the port with up to %d extra signature requests", cfg.KeepPortAttempts)
+		if cfg.OnPortKeepFailedScript != "" {
+			log.Printf("Port keep failure script: %s", cfg.OnPortKeepFailedScript)
+		}
+	}
+	if cfg.RenewBefore != "" && cfg.RenewBefore != config.BuiltinConfig().RenewBefore {
+		if strings.HasSuffix(cfg.RenewBefore, "%") {
+			log.Printf("Renewing signatures once %s of their validity is left", cfg.RenewBefore)
+		} else {
+			log.Printf("Renewing signatures %s before they expire", cfg.RenewBefore)
+		}
+	}
+	if cfg.PortRange != "" {
+		log.Printf("Requesting a port in %s with up to %d extra signature requests", cfg.PortRange, cfg.PortRangeAttempts)
+	}
+	log.Printf("Shutdown timeout: %s", cfg.ShutdownTimeout)
 }
 
-// getAuthTokenWithRetry obtains a PIA authentication token with retry logic
-func getAuthTokenWithRetry(ctx context.Context, cfg *config.Config) (string, error) {
-	// Load credentials
+// newTokenSource returns the token given with --token, or a client that logs
+// in with the credentials and picks up changes to the file. Token requests and
+// failures are published on bus.
+func newTokenSource(ctx context.Context, cfg *config.Config, bus *events.Bus) tokenSource {
+	onFailure := func(err error) {
+		bus.Publish(events.Event{Type: events.AuthFailed, Error: err.Error()})
+	}
+	if cfg.Token != "" {
+		tokens := newFixedToken(cfg.Token)
+		tokens.onFailure = onFailure
+		return tokens
+	}
+
 	username, password, err := cfg.LoadCredentials()
 	if err != nil {
-		return "", fmt.Errorf("failed to load credentials: %w", err)
+		fatalf(exitConfig, "Failed to load credentials: %v", err)
 	}
+	authClient := newAuthClient(cfg, username, password)
+	context.AfterFunc(ctx, authClient.Close)
+	authClient.OnRefresh(func(issuedAt time.Time) {
+		bus.Publish(events.Event{Type: events.TokenRefreshed, Time: issuedAt})
+	})
+	authClient.OnFailure(onFailure)
+	go watchCredentials(ctx, newCredentialsWatcher(cfg, username, password), authClient)
+	return authClient
+}
 
-	// Create authentication client
+// newAuthClient creates an authentication client honoring the configured DNS
+// server and cache
+func newAuthClient(cfg *config.Config, username, password string) *auth.Client {
 	authClient := auth.NewClient(username, password)
+	authClient.UseClock(clk)
+	authClient.SetHeaders(requestHeaders(cfg))
+	authClient.UseTracer(newTracer(cfg))
+	if cache := sharedDNSCache(cfg); cache != nil {
+		authClient.UseResolverCache(cache)
+	} else if cfg.DNSServer != "" {
+		authClient.UseResolver(resolver.New(cfg.DNSServer))
+	}
+	return authClient
+}
+
+var (
+	dnsCacheOnce sync.Once
+	dnsCache     *resolver.Cache
+)
 
+// sharedDNSCache returns the DNS cache shared by everything that looks up PIA
+// hostnames, or nil without --dns-cache
+func sharedDNSCache(cfg *config.Config) *resolver.Cache {
+	if !cfg.DNSCache {
+		return nil
+	}
+	dnsCacheOnce.Do(func() { dnsCache = resolver.NewCache(cfg.DNSServer) })
+	return dnsCache
+}
+
+// newTracer returns a tracer for PIA API requests in debug mode, nil otherwise
+func newTracer(cfg *config.Config) *httplog.Tracer {
+	if !cfg.Debug {
+		return nil
+	}
+	return httplog.New(cfg.DebugDir)
+}
+
+// requestHeaders returns the headers sent on every PIA API request: the
+// User-Agent and any configured extra headers
+func requestHeaders(cfg *config.Config) http.Header {
+	// The headers were checked by Validate
+	headers, err := cfg.Headers()
+	if err != nil {
+		headers = http.Header{}
+	}
+	if cfg.UserAgent != "" {
+		headers.Set("User-Agent", cfg.UserAgent)
+	} else if headers.Get("User-Agent") == "" {
+		headers.Set("User-Agent", userAgent(readBuildInfo()))
+	}
+	return headers
+}
+
+// getAuthTokenWithRetry obtains a PIA authentication token with retry logic.
+// Each attempt uses the client's current credentials, so a corrected
+// credentials file is picked up without a restart.
+func getAuthTokenWithRetry(ctx context.Context, cfg *config.Config, tokens tokenSource) (string, error) {
 	var lastErr error
 	for {
 		// Try to get token
 		log.Printf("Obtaining PIA authentication token...")
-		token, err := authClient.GetToken()
+		token, err := tokens.GetToken()
 		if err == nil {
 			log.Printf("Successfully obtained PIA token")
 			return token, nil
@@ -150,7 +496,7 @@ func getAuthTokenWithRetry(ctx context.Context, cfg *config.Config) (string, err
 
 		// Wait for the retry interval or until context is canceled
 		select {
-		case <-time.After(cfg.VPNRetryInterval):
+		case <-clk.After(cfg.VPNRetryInterval):
 			// Continue with the next attempt
 		case <-ctx.Done():
 			return "", fmt.Errorf("authentication canceled: %w", lastErr)
@@ -167,7 +513,7 @@ func getAuthToken(cfg *config.Config) (string, error) {
 	}
 
 	// Create authentication client
-	authClient := auth.NewClient(username, password)
+	authClient := newAuthClient(cfg, username, password)
 
 	// Get token
 	log.Printf("Obtaining PIA authentication token...")
@@ -180,6 +526,29 @@ func getAuthToken(cfg *config.Config) (string, error) {
 	return token, nil
 }
 
+// startMetricsServer serves Prometheus metrics in the background on listener,
+// or on a new one on the given address if nil, and returns the listener. It
+// returns nil if it can't listen.
+func startMetricsServer(addr string, listener net.Listener) net.Listener {
+	if listener == nil {
+		var err error
+		if listener, err = net.Listen("tcp", addr); err != nil {
+			log.Printf("Metrics server failed: %v", err)
+			return nil
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default.Handler())
+
+	log.Printf("Serving metrics on http://%s/metrics", addr)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Metrics server failed: %v", err)
+		}
+	}()
+	return listener
+}
+
 // setupSignalHandler sets up a channel for OS signals
 func setupSignalHandler() chan os.Signal {
 	sigChan := make(chan os.Signal, 1)
@@ -187,207 +556,725 @@ func setupSignalHandler() chan os.Signal {
 	return sigChan
 }
 
-// resolveCACertPath resolves the CA certificate path
-func resolveCACertPath(certPath string) (string, error) {
-	if filepath.IsAbs(certPath) {
-		return certPath, nil
+// resolveCACertPath resolves the configured CA certificate path
+func resolveCACertPath(cfg *config.Config) (string, error) {
+	return cfg.CACertPath()
+}
+
+// caCertDownloadTimeout bounds downloading the CA certificate at startup
+const caCertDownloadTimeout = 30 * time.Second
+
+// downloadCACert makes sure PIA's CA certificate is saved next to the state
+// file, downloading it on the first run, and returns its path
+func downloadCACert(ctx context.Context, cfg *config.Config) (string, error) {
+	path := filepath.Join(filepath.Dir(stateFilePath(cfg)), piaca.FileName)
+	ctx, cancel := context.WithTimeout(ctx, caCertDownloadTimeout)
+	defer cancel()
+
+	downloaded, err := piaca.Fetch(ctx, http.DefaultClient, piaca.URL, path)
+	if err != nil {
+		return "", err
+	}
+	if downloaded {
+		log.Printf("Downloaded the CA certificate from %s to %s", piaca.URL, path)
 	}
+	return path, nil
+}
 
-	// If it's not an absolute path, look for it in the current directory
-	localPath := filepath.Join(".", certPath)
+// readyFailureThreshold is how many binds in a row must fail before the service
+// stops reporting itself as ready
+const readyFailureThreshold = 3
 
-	// Check if the file exists
-	if _, err := os.Stat(localPath); err == nil {
-		return localPath, nil
+// markReady creates the ready file and notifies the service manager once the port is bound
+func markReady(cfg *config.Config, port int) {
+	if cfg.ReadyFile != "" {
+		if err := portforwarding.WritePortToFile(port, cfg.ReadyFile); err != nil {
+			log.Printf("Warning: failed to write ready file: %v", err)
+		}
+	}
+	if _, err := daemon.Notify(fmt.Sprintf("READY=1\nSTATUS=Port %d bound", port)); err != nil {
+		log.Printf("Warning: %v", err)
 	}
+}
 
-	// If not, try to find it in the same directory as the examples
-	examplesPath := filepath.Join("/etc/openvpn/client", certPath)
-	if _, err := os.Stat(examplesPath); err == nil {
-		return examplesPath, nil
+// markNotReady removes the ready file while binding keeps failing
+func markNotReady(cfg *config.Config, bindErr error) {
+	log.Printf("Binding failed %d times in a row, no longer reporting ready", readyFailureThreshold)
+	if cfg.ReadyFile != "" {
+		if err := os.Remove(cfg.ReadyFile); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: failed to remove ready file: %v", err)
+		}
 	}
+	if _, err := daemon.Notify("STATUS=Binding failing: " + bindErr.Error()); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
 
-	return "", fmt.Errorf("CA certificate file not found: %s", certPath)
+// recordAuthStats copies the token lifecycle into the state for the status command
+func recordAuthStats(st *state.State, stats auth.Stats) {
+	st.TokenIssuedAt = stats.TokenIssuedAt
+	st.LastAuthAt = stats.LastSuccessAt
+	st.TokenRefreshes = stats.Refreshes
+	st.TokenRefreshFailures = stats.Failures
+	st.LastAuthError = stats.LastError
 }
 
-// runPortForwardingLoop handles the port forwarding refresh loop
-func runPortForwardingLoop(pfClient *portforwarding.Client, cfg *config.Config, sigChan chan os.Signal, refreshed chan struct{}) {
-	// Create a ticker for refreshing the port forwarding
-	ticker := time.NewTicker(cfg.RefreshInterval)
-	defer ticker.Stop()
+// recordLatency copies the recent gateway round-trip times into the state for
+// the status command
+func recordLatency(st *state.State) {
+	for _, endpoint := range []string{portforwarding.SignatureEndpoint, portforwarding.BindPortEndpoint} {
+		summary, ok := portforwarding.Latency(endpoint)
+		if !ok || summary.Len() == 0 {
+			continue
+		}
+		if st.Latency == nil {
+			st.Latency = make(map[string]state.LatencyStats)
+		}
+		st.Latency[endpoint] = state.LatencyStats{
+			Samples: summary.Len(),
+			P50:     secondsDuration(summary.Quantile(0.5)),
+			P90:     secondsDuration(summary.Quantile(0.9)),
+			P99:     secondsDuration(summary.Quantile(0.99)),
+		}
+	}
+}
 
-	// Get initial port forwarding info - this will be reused until it expires
-	var pfInfo *portforwarding.PortForwardingInfo
-	var err error
+// secondsDuration converts seconds, as metrics record them, to a duration
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
 
-	// Get the initial port forwarding info
-	pfInfo, err = pfClient.GetPortForwarding()
-	if err != nil {
-		log.Printf("Failed to get initial port forwarding info: %v", err)
-		return
+// PIA temporarily blocks accounts and addresses that request too many tokens
+// or signatures. A service restarting in a loop waits at startup rather than
+// add to them.
+const (
+	startupRequestLimit  = 5
+	startupRequestWindow = 15 * time.Minute
+)
+
+// waitForRequestLimit waits, if earlier runs already made startupRequestLimit
+// requests of a kind within startupRequestWindow. It returns false if ctx is
+// done first.
+func waitForRequestLimit(ctx context.Context, kind string, times []time.Time) bool {
+	delay := state.RequestDelay(times, clk.Now(), startupRequestLimit, startupRequestWindow)
+	if delay <= 0 {
+		return true
+	}
+	log.Printf("Requested %d or more %s in the last %s, likely restarting in a loop; waiting %s so PIA doesn't block the account", startupRequestLimit, kind, startupRequestWindow, delay.Round(time.Second))
+	if _, err := daemon.Notify(fmt.Sprintf("STATUS=Waiting %s before requesting more %s", delay.Round(time.Second), kind)); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	select {
+	case <-clk.After(delay):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// instanceLockPath returns the lock held while the service runs: the one next
+// to the output file, or to the state file when streaming to stdout, where
+// there's none without a state file
+func instanceLockPath(cfg *config.Config) string {
+	if !cfg.StreamsOutput() {
+		return lock.PathFor(cfg.OutputFile)
+	}
+	if cfg.StateFile != "" {
+		return lock.PathFor(cfg.StateFile)
 	}
+	return ""
+}
 
-	log.Printf("Obtained port forwarding: port=%d, expires=%s", pfInfo.Port, pfInfo.ExpiresAt)
+// instanceName names the service in messages by the file it's locked for
+func instanceName(cfg *config.Config) string {
+	if cfg.StreamsOutput() {
+		return cfg.StateFile
+	}
+	return cfg.OutputFile
+}
 
-	// Store the initial port for change detection
-	initialPort := pfInfo.Port
-	portChanged := true // Set to true for initial execution
+// stateFilePath returns the configured state file, or the default next to the
+// output file. It's empty if the port is streamed to stdout without one.
+func stateFilePath(cfg *config.Config) string {
+	if cfg.StateFile != "" || cfg.StreamsOutput() {
+		return cfg.StateFile
+	}
+	return state.PathFor(cfg.OutputFile)
+}
 
-	for {
-		// Check if we need to get a new signature (if close to expiration)
-		if time.Until(pfInfo.ExpiresAt) < 24*time.Hour {
-			pfInfo = refreshPortForwarding(pfClient, pfInfo, &initialPort, &portChanged)
-		}
-
-		// Bind the port
-		if err := pfClient.BindPort(pfInfo.Payload, pfInfo.Signature); err != nil {
-			log.Printf("Failed to bind port: %v", err)
-			// Wait for the next tick
-			select {
-			case <-ticker.C:
-				continue
-			case <-sigChan:
-				return
-			}
+// saveState records the current state for the status command
+func saveState(cfg *config.Config, st *state.State) {
+	path := stateFilePath(cfg)
+	if path == "" {
+		return
+	}
+	st.UpdatedAt = time.Now()
+	if err := state.Save(path, st); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// executePortKeepFailedScript runs the port keep failure script with the new
+// and the lost port. It runs in the background, since the new port is only
+// bound once the event's handlers return.
+func executePortKeepFailedScript(cfg *config.Config, e events.Event) {
+	ctx, done := scripts.start(cfg.ScriptTimeout)
+	go func() {
+		defer done()
+		log.Printf("Executing port keep failure script: %s", cfg.OnPortKeepFailedScript)
+
+		cmd := execCommand(ctx, cfg.OnPortKeepFailedScript, strconv.Itoa(e.Port), strconv.Itoa(e.PreviousPort))
+		cmd.Env = append(os.Environ(), scriptEnv(e.Port, e.ExpiresAt, e.RenewsAt)...)
+		cmd.Env = append(cmd.Env, "PIA_PREVIOUS_PORT="+strconv.Itoa(e.PreviousPort))
+		runner.Detach(cmd, scriptStopGrace)
+		started := time.Now()
+		output, err := cmd.CombinedOutput()
+		hooks.record(ctx, hookPortKeepFailed, started, err)
+		if err != nil {
+			log.Printf("Port keep failure script failed: %v\nOutput: %s", err, string(output))
+		} else {
+			log.Printf("Port keep failure script executed successfully\nOutput: %s", string(output))
 		}
+	}()
+}
 
-		log.Printf("Successfully bound port %d", pfInfo.Port)
+// scriptEnv returns the environment variables describing the port for the script
+func scriptEnv(port int, expiresAt, renewsAt time.Time) []string {
+	env := []string{"PIA_PORT=" + strconv.Itoa(port)}
+	if !expiresAt.IsZero() {
+		env = append(env,
+			"PIA_EXPIRES_AT="+expiresAt.UTC().Format(time.RFC3339),
+			"PIA_RENEWS_AT="+renewsAt.UTC().Format(time.RFC3339),
+		)
+	}
+	return env
+}
 
-		// Handle port file writing and script execution
-		handlePortOutput(pfInfo.Port, cfg, portChanged)
-		portChanged = false // Reset the flag after executing the script
+// joinPorts returns ports separated by commas
+func joinPorts(ports []int) string {
+	s := make([]string, len(ports))
+	for i, port := range ports {
+		s[i] = strconv.Itoa(port)
+	}
+	return strings.Join(s, ",")
+}
 
-		// Signal that the port forwarding has been refreshed
-		select {
-		case refreshed <- struct{}{}:
-		default:
-		}
+// handlePortOutput writes the port to the output file in the configured format,
+// or prints it to stdout if it changed when streaming. The JSON format also
+// has the previous ports still in their grace period.
+func handlePortOutput(port int, expiresAt, renewsAt time.Time, previousPorts []int, cfg *config.Config) error {
+	if cfg.StreamsOutput() {
+		return stdoutStream.write(port, expiresAt, renewsAt, previousPorts, cfg.OutputFormat)
+	}
 
-		// Wait for the next tick
-		select {
-		case <-ticker.C:
-		case <-sigChan:
-			return
-		}
+	var err error
+	if cfg.RemoteHost != "" {
+		err = writeRemotePortFile(port, expiresAt, renewsAt, previousPorts, cfg)
+	} else if cfg.OutputFormat == config.OutputFormatJSON {
+		err = portforwarding.WritePortJSON(port, expiresAt, renewsAt, previousPorts, cfg.OutputFile)
+	} else {
+		err = portforwarding.WritePortToFile(port, cfg.OutputFile)
 	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Wrote port %d to file: %s", port, cfg.OutputFile)
+	return nil
 }
 
-// refreshPortForwarding gets a new port forwarding signature when needed
-func refreshPortForwarding(pfClient *portforwarding.Client, pfInfo *portforwarding.PortForwardingInfo, initialPort *int, portChanged *bool) *portforwarding.PortForwardingInfo {
-	log.Printf("Port forwarding signature expiring soon, requesting a new one")
-	newPfInfo, err := pfClient.GetPortForwarding()
+// writeRemotePortFile writes the output file on the remote host over SSH
+func writeRemotePortFile(port int, expiresAt, renewsAt time.Time, previousPorts []int, cfg *config.Config) error {
+	host, err := remote.Parse(cfg.RemoteHost)
 	if err != nil {
-		log.Printf("Failed to get new port forwarding info: %v", err)
-		return pfInfo
+		return err
 	}
 
-	*portChanged = newPfInfo.Port != *initialPort
-	*initialPort = newPfInfo.Port
-	log.Printf("Obtained new port forwarding: port=%d, expires=%s", newPfInfo.Port, newPfInfo.ExpiresAt)
-	return newPfInfo
+	data := []byte(strconv.Itoa(port))
+	if cfg.OutputFormat == config.OutputFormatJSON {
+		if data, err = portforwarding.EncodePortJSON(port, expiresAt, renewsAt, previousPorts); err != nil {
+			return err
+		}
+	}
+	return host.WriteFile(cfg.OutputFile, data)
 }
 
-// handlePortOutput writes the port to file and executes script if needed
-func handlePortOutput(port int, cfg *config.Config, portChanged bool) {
-	// Write the port to the output file
-	if err := portforwarding.WritePortToFile(port, cfg.OutputFile); err != nil {
-		log.Printf("Failed to write port to file: %v", err)
+// waitForStartupFiles waits up to --wait-for-files for the credentials file and
+// OpenVPN config to appear. Any still missing are left for validation to report.
+func waitForStartupFiles(cfg *config.Config) {
+	missing := fswait.Missing(cfg.StartupFiles())
+	if len(missing) == 0 {
 		return
 	}
+	log.Printf("Waiting up to %s for %s to appear...", cfg.WaitForFiles, strings.Join(missing, " and "))
 
-	log.Printf("Wrote port %d to file: %s", port, cfg.OutputFile)
-
-	// Execute port change script if configured, but only if the port has changed
-	if cfg.OnPortChangeScript != "" && portChanged {
-		log.Printf("Port changed, executing script")
-		executePortChangeScript(cfg, port)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.WaitForFiles)
+	defer cancel()
+	if err := fswait.Wait(ctx, missing); err != nil {
+		log.Printf("Gave up waiting for %s after %s", strings.Join(fswait.Missing(missing), " and "), cfg.WaitForFiles)
+		return
 	}
+	log.Printf("Found %s", strings.Join(missing, " and "))
 }
 
 func main() {
-	// Create a default configuration
-	cfg := config.DefaultConfig()
+	// Dispatch subcommands before parsing the service flags
+	if cmd := commandFor(os.Args[1:]); cmd != nil {
+		if err := cmd.run(os.Args[2:]); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
 
-	// Setup and parse command line flags
-	config.SetupFlags(cfg)
+	// Build the configuration from the environment and command line flags
+	cfg, err := config.ParseArgs(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		fatalf(exitConfig, "Invalid arguments: %v", err)
+	}
+
+	// Give provisioning time to write the files validation checks
+	if cfg.WaitForFiles > 0 {
+		waitForStartupFiles(cfg)
+	}
 
 	// Validate configuration
 	if err := cfg.Validate(); err != nil {
-		log.Fatalf("Invalid configuration: %v", err)
+		// List each problem on its own line
+		fatalf(exitConfig, "Invalid configuration:\n  %s", strings.ReplaceAll(err.Error(), "\n", "\n  "))
 	}
 
-	// Set up logging
-	setupLogging(cfg.Debug)
+	// Let the platform service manager drive the service if it started us
+	if runningAsService() {
+		runService(cfg)
+		return
+	}
 
-	// Log configuration information
-	logConfigInfo(cfg)
+	// Detach from the terminal if requested; the background copy continues from here
+	if cfg.Daemonize && !daemon.IsChild() {
+		// Print the summary once the background copy has bound the port
+		if cfg.SummaryFormat() != "" {
+			_, summary, err := daemon.DaemonizeAndWait(cfg.LogFile)
+			if err != nil {
+				log.Fatalf("Failed to daemonize: %v", err)
+			}
+			fmt.Print(summary)
+			return
+		}
+		pid, err := daemon.Daemonize(cfg.LogFile)
+		if err != nil {
+			log.Fatalf("Failed to daemonize: %v", err)
+		}
+		log.Printf("Started in the background (pid: %d)", pid)
+		return
+	}
 
 	// Set up signal handling for graceful shutdown
-	sigChan := setupSignalHandler()
+	os.Exit(run(cfg, setupSignalHandler()))
+}
 
-	// Create a context that can be canceled on SIGINT/SIGTERM
-	ctx, cancelCtx := context.WithCancel(context.Background())
-	defer cancelCtx()
+// run starts port forwarding and blocks until a signal is received on sigChan,
+// returning the status to exit with
+func run(cfg *config.Config, sigChan chan os.Signal) (status int) {
+	// Set up logging
+	setupLogging(cfg.Debug)
+	if cfg.LogFile != "" {
+		if err := setupLogOutput(cfg.LogFile, cfg.LogColor == config.LogColorAlways); err != nil {
+			fatalf(exitConfig, "%v", err)
+		}
+	} else if colorLog(cfg.LogColor, os.Stderr) {
+		setupColorLogging()
+	}
+	if cfg.Quiet {
+		setupQuietLogging()
+	}
 
-	// Get authentication token with retry logic
-	token, err := getAuthTokenWithRetry(ctx, cfg)
+	// Run cleanups on every exit path, including fatal errors
+	defer runCleanups()
+
+	// Pick up the port, lock and listener if a previous version is handing
+	// over to us on upgrade
+	inherited, err := takeOver(cfg)
 	if err != nil {
-		log.Fatalf("%v", err)
+		fatalf(exitFatal, "Failed to take over from the previous version: %v", err)
 	}
+	// Set once we've handed over to a new version, which then owns the lock,
+	// the ready file and the state
+	var handedOver atomic.Bool
 
-	// Detect OpenVPN connection with retry logic
-	log.Printf("Detecting OpenVPN connection...")
-
-	// Setup a goroutine to handle signals and cancel the context
+	// Create a context that is canceled on SIGINT/SIGTERM; everything that runs
+	// until shutdown watches it instead of reading the signal channel itself.
+	// A second signal gives up on a shutdown that is taking too long.
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+	stopped := make(chan struct{})
+	defer close(stopped)
 	go func() {
-		<-sigChan
-		log.Println("Received termination signal, stopping VPN detection...")
+		select {
+		case <-sigChan:
+		case <-stopped:
+			return
+		}
+		log.Printf("Received signal, shutting down...")
 		cancelCtx()
-		// Re-send the signal to ensure clean termination after context is canceled
-		signal.Reset(syscall.SIGINT, syscall.SIGTERM)
-		p, _ := os.FindProcess(os.Getpid())
-		p.Signal(syscall.SIGTERM)
+
+		select {
+		case <-sigChan:
+			log.Printf("Received second signal, exiting without waiting for shutdown")
+			os.Exit(exitUnclean)
+		case <-stopped:
+		}
 	}()
 
-	// Try to detect the VPN connection, with retries
-	connInfo, err := detectVPNWithRetry(ctx, cfg)
+	// Make sure no other instance is writing the same output file
+	var instanceLock *lock.Lock
+	if inherited != nil {
+		instanceLock = inherited.lock
+	} else if lockPath := instanceLockPath(cfg); lockPath != "" {
+		instanceLock, err = lock.Acquire(lockPath)
+		if errors.Is(err, lock.ErrLocked) {
+			log.Fatalf("Another instance is already running for %s: %v", instanceName(cfg), err)
+		} else if err != nil {
+			log.Fatalf("Failed to acquire instance lock: %v", err)
+		}
+	}
+	addCleanup(func() {
+		if instanceLock != nil && !handedOver.Load() {
+			instanceLock.Release()
+		}
+	})
+
+	// The renew command can find us from here on, so catch its requests right
+	// away instead of being terminated by them, and hold them until the
+	// manager runs
+	controls := &controlQueue{}
+	handleControlSignals(ctx, controls)
+
+	// Write the PID file once we know we're the only instance. A version
+	// taking over writes it once it has.
+	if cfg.PIDFile != "" {
+		if inherited == nil {
+			if err := daemon.WritePIDFile(cfg.PIDFile); err != nil {
+				fatalf(exitFatal, "%v", err)
+			}
+		}
+		addCleanup(func() { daemon.RemovePIDFile(cfg.PIDFile) })
+	}
+
+	// A ready file left by a previous run doesn't mean this one has bound a
+	// port, unless that run is handing over to us
+	if cfg.ReadyFile != "" {
+		if inherited == nil {
+			os.Remove(cfg.ReadyFile)
+		}
+		addCleanup(func() {
+			if !handedOver.Load() {
+				os.Remove(cfg.ReadyFile)
+			}
+		})
+	}
+
+	// Log configuration information
+	logConfigInfo(cfg)
+
+	// Serve metrics if enabled
+	var metricsListener net.Listener
+	if cfg.MetricsAddr != "" {
+		if inherited != nil {
+			metricsListener = inherited.metrics
+		}
+		metricsListener = startMetricsServer(cfg.MetricsAddr, metricsListener)
+	}
+
+	// Everything that reacts to port forwarding activity subscribes to the bus
+	bus := events.NewBus()
+	hooks.publishTo(bus)
+	previousPorts := newPreviousPortKeeper(cfg.PreviousPortGrace)
+	changes := previousPorts.follow(ctx, bus, coalescePortChanges(ctx, bus, cfg.PortChangeDebounce))
+	addCleanup(subscribeHandlers(bus, changes, cfg, previousPorts))
+	if cfg.UDPProbe != "" {
+		startUDPProbe(ctx, cfg, bus)
+	}
+	if cfg.Notifier != "" || cfg.SMTPServer != "" {
+		startNotifier(ctx, cfg, bus, changes)
+	}
+	if cfg.HeartbeatURL != "" {
+		startHeartbeat(ctx, cfg, bus)
+	}
+
+	// On the way out, give async scripts time to finish, then run the exit
+	// script with the last port bound, unless a new version carries on with it
+	var lastBound events.Event
+	var lastMu sync.Mutex
+	bus.Subscribe(func(e events.Event) {
+		lastMu.Lock()
+		lastBound = e
+		lastMu.Unlock()
+	}, events.PortBound)
+	addCleanup(func() {
+		if !scripts.drain(cfg.ShutdownTimeout) {
+			log.Printf("Scripts still running after %s, killed them", cfg.ShutdownTimeout)
+			status = exitUnclean
+		}
+		if cfg.OnExitScript != "" && !handedOver.Load() {
+			lastMu.Lock()
+			port, expiresAt, renewsAt := lastBound.Port, lastBound.ExpiresAt, lastBound.RenewsAt
+			lastMu.Unlock()
+			executeExitScript(cfg, port, expiresAt, renewsAt)
+		}
+	})
+
+	tokens := newTokenSource(ctx, cfg, bus)
+	if authClient, ok := tokens.(*auth.Client); ok && inherited != nil && inherited.Token != "" {
+		authClient.SetToken(inherited.Token, inherited.TokenIssuedAt)
+	}
+
+	// Carry the request history over from the previous run, so a service
+	// restarting in a loop can hold back, and the gateway it bound through,
+	// which may spare detecting the VPN
+	previous, err := state.Load(stateFilePath(cfg))
 	if err != nil {
-		log.Fatalf("Failed to detect OpenVPN connection after retries: %v", err)
+		previous = &state.State{}
 	}
-	log.Printf("Detected OpenVPN connection: gateway=%s, hostname=%s", connInfo.GatewayIP, connInfo.Hostname)
+	st := &state.State{
+		PID:               os.Getpid(),
+		KnownGateway:      previous.KnownGateway,
+		TokenRequests:     previous.TokenRequests,
+		SignatureRequests: previous.SignatureRequests,
+	}
+	recordAuthStats(st, tokens.Stats())
+	saveState(cfg, st)
+	flushState := subscribeState(bus, changes, cfg, st, tokens, previousPorts)
+	addCleanup(func() {
+		if !handedOver.Load() {
+			flushState()
+		}
+	})
 
-	// Reset the signal handler for the main loop
-	signal.Reset(syscall.SIGINT, syscall.SIGTERM)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	// Get authentication token with retry logic
+	if cfg.Token == "" && inherited == nil && !waitForRequestLimit(ctx, "tokens", previous.TokenRequests) {
+		return exitOK
+	}
+	token, err := getAuthTokenWithRetry(ctx, cfg, tokens)
+	if ctx.Err() != nil {
+		return exitOK
+	} else if err != nil {
+		fatalf(exitAuth, "%v", err)
+	}
 
 	// Resolve CA certificate path
-	caCertPath, err := resolveCACertPath(cfg.CACertFile)
+	caCertPath, err := resolveCACertPath(cfg)
 	if err != nil {
-		log.Fatalf("%v", err)
+		fatalf(exitConfig, "%v", err)
+	}
+	if caCertPath == piaca.Download {
+		if caCertPath, err = downloadCACert(ctx, cfg); err != nil {
+			fatalf(exitFatal, "%v", err)
+		}
+	}
+	if caCertPath == piaca.Embedded {
+		log.Printf("Using the built-in CA certificate")
+	} else {
+		log.Printf("Using CA certificate: %s", caCertPath)
 	}
-	log.Printf("Using CA certificate: %s", caCertPath)
+
+	// Bring up the VPN if we manage it
+	if err := startManagedVPN(ctx, cfg, tokens, caCertPath); err != nil {
+		fatalf(exitVPN, "%v", err)
+	}
+	if managedVPN != nil && cfg.FailoverAfter > 0 {
+		startRegionFailover(ctx, cfg, bus, managedVPN)
+	}
+
+	// Wait for the unit running the VPN, as After= would
+	var unitStates <-chan string
+	if cfg.VPNUnit != "" {
+		log.Printf("Waiting for %s to become active...", cfg.VPNUnit)
+		unitStates, err = waitForVPNUnit(ctx, cfg)
+		if ctx.Err() != nil {
+			return exitOK
+		} else if err != nil {
+			fatalf(exitVPN, "%v", err)
+		}
+		log.Printf("%s is active", cfg.VPNUnit)
+	}
+
+	// Reuse the gateway bound before the restart if it still answers, or
+	// detect the VPN connection, with retries
+	connInfo := knownGateway(cfg, previous.KnownGateway, caCertPath)
+	if connInfo == nil {
+		log.Printf("Detecting OpenVPN connection...")
+		connInfo, err = detectVPNWithRetry(ctx, cfg)
+		if ctx.Err() != nil {
+			return exitOK
+		} else if err != nil {
+			fatalf(exitVPN, "Failed to detect OpenVPN connection: %v", err)
+		}
+		log.Printf("Detected OpenVPN connection: gateway=%s, hostname=%s", connInfo.GatewayIP, connInfo.Hostname)
+	}
+	bus.Publish(events.Event{Type: events.VPNReconnected, Gateway: connInfo.GatewayIP, Hostname: connInfo.Hostname})
 
 	// Create port forwarding client
 	pfClient := portforwarding.NewClient(token, connInfo.GatewayIP, connInfo.Hostname, caCertPath)
+	pfClient.SetTransportOptions(portforwarding.TransportOptions{
+		IdleConnTimeout: cfg.GatewayIdleTimeout,
+		MaxIdleConns:    cfg.GatewayMaxIdleConns,
+	})
+	pfClient.SetHeaders(requestHeaders(cfg))
+	if cfg.GatewayPort != 0 {
+		pfClient.SetAPIPort(cfg.GatewayPort)
+	}
+	if cfg.ConnectVia == config.ConnectViaHostname {
+		pfClient.UseHostname()
+	}
+	pfClient.UseTracer(newTracer(cfg))
+	if cache := sharedDNSCache(cfg); cache != nil {
+		pfClient.UseResolverCache(cache)
+	} else if cfg.DNSServer != "" {
+		pfClient.UseResolver(resolver.New(cfg.DNSServer))
+	}
+	context.AfterFunc(ctx, pfClient.Close)
+
+	// The gateway is only reachable from the remote host, so connect through it
+	if cfg.RemoteHost != "" {
+		host, err := remote.Parse(cfg.RemoteHost)
+		if err != nil {
+			fatalf(exitConfig, "%v", err)
+		}
+		pfClient.SetTunnel(host.DialContext)
+	}
+
+	// Legacy servers don't serve the port forwarding API, so requests would
+	// only time out on them
+	if err := pfClient.CheckNextGen(); err != nil {
+		fatalf(startupFailureStatus(cfg, connInfo.Hostname, err, exitFatal), "%v", err)
+	}
+
+	subscribeReadiness(bus, cfg)
+
+	// Signal when the port is first bound
+	refreshed := make(chan struct{}, 1)
+	bus.Subscribe(func(events.Event) {
+		select {
+		case refreshed <- struct{}{}:
+		default:
+		}
+	}, events.PortBound)
+
+	// Fail and slow down gateway requests on purpose if asked to
+	var client gatewayClient = pfClient
+	if chaosEnabled(cfg) {
+		log.Printf("Warning: chaos testing is on, failing %.0f%% of binds and delaying gateway requests by up to %s", cfg.ChaosBindFailRate*100, cfg.ChaosLatency)
+		client = newChaosClient(ctx, cfg, pfClient)
+	}
+
+	// Keep the port bound in the background
+	manager := newManager(cfg, bus, client, tokens, connInfo)
+	if inherited != nil {
+		manager.Resume = inherited.resume(connInfo.GatewayIP)
+	}
+	if manager.Resume == nil && !waitForRequestLimit(ctx, "signatures", previous.SignatureRequests) {
+		return exitOK
+	}
+	managerDone := make(chan error, 1)
+	go func() { managerDone <- manager.Run(ctx) }()
+
+	// Get a new signature whenever the VPN unit comes back up
+	if unitStates != nil {
+		go followVPNUnit(ctx, cfg, unitStates, manager.Renew)
+	}
 
-	// Create a channel to signal when the port forwarding is refreshed
-	refreshed := make(chan struct{})
+	// Let the renew command reach the manager, including requests made
+	// while starting up
+	controls.start(manager)
 
-	// Start the port forwarding refresh loop in a goroutine
-	go runPortForwardingLoop(pfClient, cfg, sigChan, refreshed)
+	// Let the upgrade command hand over to the binary on disk, after which we
+	// shut down without touching what the new version took over
+	handleUpgradeSignal(ctx, func() {
+		if upgrade(cfg, manager.Current(), tokens, instanceLock, metricsListener) {
+			handedOver.Store(true)
+			cancelCtx()
+		}
+	})
 
 	// Wait for the first port forwarding refresh
 	select {
 	case <-refreshed:
 		log.Printf("Port forwarding initialized successfully")
-	case <-time.After(30 * time.Second):
-		log.Fatalf("Timed out waiting for port forwarding initialization")
-	case <-sigChan:
-		log.Printf("Received signal, shutting down...")
-		return
+		if inherited != nil {
+			inherited.done(cfg)
+		} else {
+			lastMu.Lock()
+			bound := lastBound
+			lastMu.Unlock()
+			printSummary(cfg, bound)
+		}
+	case err := <-managerDone:
+		if ctx.Err() == nil {
+			fatalf(startupFailureStatus(cfg, connInfo.Hostname, err, exitFatal), "%v", err)
+		}
+		return exitOK
+	case <-clk.After(30 * time.Second):
+		fatalf(startupFailureStatus(cfg, connInfo.Hostname, nil, exitStartupTimeout), "Timed out waiting for port forwarding initialization")
+	case <-ctx.Done():
+		<-managerDone
+		return exitOK
 	}
 
-	// Wait for a signal to shut down
-	<-sigChan
-	log.Printf("Received signal, shutting down...")
+	// Run until a signal arrives, then let the manager finish its current step
+	<-ctx.Done()
+	<-managerDone
+	return exitOK
+}
+
+// gatewayClient is what the manager needs from the port forwarding client;
+// pftest.Forwarder stands in for it in tests
+type gatewayClient interface {
+	portforwarding.PortForwarder
+	SetToken(token string)
+	SetGateway(gatewayIP, hostname string)
+	ProbeGateway() error
+}
+
+// newManager returns a manager keeping the port bound through client, starting
+// with the gateway in connInfo
+func newManager(cfg *config.Config, bus *events.Bus, client gatewayClient, tokens tokenSource, connInfo *vpn.ConnectionInfo) *portforwarding.Manager {
+	manager := portforwarding.NewManager(client, bus, cfg.RefreshInterval)
+	manager.Clock = clk
+	manager.RefreshJitter = cfg.RefreshJitter
+	manager.MinBindInterval = cfg.MinBindInterval
+	manager.KeepPortAttempts = cfg.KeepPortAttempts
+	if cfg.RenewBefore != "" {
+		// Already validated
+		manager.RenewPolicy.Before, manager.RenewPolicy.Remaining, _ = config.ParseRenewBefore(cfg.RenewBefore)
+	}
+	if cfg.PortRange != "" {
+		// Already validated
+		manager.PortRangeMin, manager.PortRangeMax, _ = config.ParsePortRange(cfg.PortRange)
+		manager.PortRangeAttempts = cfg.PortRangeAttempts
+	}
+	manager.Gateway = connInfo.GatewayIP
+	manager.Hostname = connInfo.Hostname
+	manager.RefreshToken = func(invalidate bool) error {
+		if invalidate {
+			tokens.Invalidate()
+		}
+		token, err := tokens.GetToken()
+		if err != nil {
+			return err
+		}
+		client.SetToken(token)
+		return nil
+	}
+	manager.ProbeGateway = client.ProbeGateway
+	manager.Reconnect = func() (string, string, error) {
+		connInfo, err := detectConnection(cfg)
+		if err != nil {
+			return "", "", err
+		}
+		client.SetGateway(connInfo.GatewayIP, connInfo.Hostname)
+		return connInfo.GatewayIP, connInfo.Hostname, nil
+	}
+	return manager
 }
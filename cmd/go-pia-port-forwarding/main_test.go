@@ -2,40 +2,28 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
-	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/meschansky/go-pia/internal/clock"
 	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/events"
 	"github.com/meschansky/go-pia/internal/portforwarding"
+	"github.com/meschansky/go-pia/internal/portforwarding/pftest"
 	"github.com/meschansky/go-pia/internal/vpn"
 )
 
-// parseArgs parses command line arguments and returns a configuration object
-func parseArgs() (*config.Config, error) {
-	// Parse command line arguments
-	flag.Parse()
-
-	// Get the output file path from the first argument
-	if flag.NArg() != 1 {
-		return nil, errors.New("usage: go-pia-port-forwarding OUTPUT_FILE")
-	}
-	outputFile := flag.Arg(0)
-
-	// Create configuration
-	cfg := config.DefaultConfig()
-	cfg.OutputFile = outputFile
-
-	return cfg, nil
-}
-
 // setupConfig sets up the configuration from environment variables
 func setupConfig(cfg *config.Config) error {
 	// Check for credentials file
@@ -54,11 +42,11 @@ func setupConfig(cfg *config.Config) error {
 	// Check for refresh interval
 	refreshInterval := os.Getenv("PIA_REFRESH_INTERVAL")
 	if refreshInterval != "" {
-		seconds, err := strconv.Atoi(refreshInterval)
+		interval, _, err := config.ParseDuration(refreshInterval)
 		if err != nil {
-			return errors.New("PIA_REFRESH_INTERVAL must be a valid number of seconds")
+			return errors.New("PIA_REFRESH_INTERVAL must be a valid duration or number of seconds")
 		}
-		cfg.RefreshInterval = time.Duration(seconds) * time.Second
+		cfg.RefreshInterval = interval
 	}
 
 	// Check for port change script
@@ -68,11 +56,11 @@ func setupConfig(cfg *config.Config) error {
 
 	// Check for script timeout
 	if timeout := os.Getenv("PIA_SCRIPT_TIMEOUT"); timeout != "" {
-		seconds, err := strconv.Atoi(timeout)
+		scriptTimeout, _, err := config.ParseDuration(timeout)
 		if err != nil {
-			return errors.New("PIA_SCRIPT_TIMEOUT must be a valid number of seconds")
+			return errors.New("PIA_SCRIPT_TIMEOUT must be a valid duration or number of seconds")
 		}
-		cfg.ScriptTimeout = time.Duration(seconds) * time.Second
+		cfg.ScriptTimeout = scriptTimeout
 	}
 
 	// Check for sync script mode
@@ -84,10 +72,6 @@ func setupConfig(cfg *config.Config) error {
 }
 
 func TestParseArgs(t *testing.T) {
-	// Save original args
-	origArgs := os.Args
-	defer func() { os.Args = origArgs }()
-
 	// Test cases
 	testCases := []struct {
 		name        string
@@ -97,19 +81,19 @@ func TestParseArgs(t *testing.T) {
 	}{
 		{
 			name:        "Valid args",
-			args:        []string{"go-pia-port-forwarding", "/tmp/port.txt"},
+			args:        []string{"/tmp/port.txt"},
 			expectError: false,
 			outputFile:  "/tmp/port.txt",
 		},
 		{
 			name:        "No args",
-			args:        []string{"go-pia-port-forwarding"},
-			expectError: true,
+			args:        []string{},
+			expectError: false,
 			outputFile:  "",
 		},
 		{
 			name:        "Too many args",
-			args:        []string{"go-pia-port-forwarding", "/tmp/port.txt", "extra"},
+			args:        []string{"/tmp/port.txt", "extra"},
 			expectError: true,
 			outputFile:  "",
 		},
@@ -117,11 +101,8 @@ func TestParseArgs(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			// Set args
-			os.Args = tc.args
-
 			// Parse args
-			cfg, err := parseArgs()
+			cfg, err := config.ParseArgs(tc.args)
 
 			// Check error
 			if tc.expectError && err == nil {
@@ -139,30 +120,6 @@ func TestParseArgs(t *testing.T) {
 	}
 }
 
-// Mock for executePortChangeScript to use in tests
-func mockExecutePortChangeScript(cfg *config.Config, port int) error {
-	// Check if script path is valid
-	if cfg.OnPortChangeScript == "" {
-		return errors.New("no script specified")
-	}
-
-	// Check if script exists and is executable
-	if cfg.OnPortChangeScript != "/test/valid-script.sh" &&
-		cfg.OnPortChangeScript != "/test/mock-script.sh" {
-		return errors.New("script not found or not executable")
-	}
-
-	return nil
-}
-
-// Helper function for tests to avoid importing from main
-func testGetScriptMode(cfg *config.Config) string {
-	if cfg.SyncScript {
-		return "synchronous"
-	}
-	return "asynchronous"
-}
-
 // Test for the script mode function
 func TestGetScriptMode(t *testing.T) {
 	testCases := []struct {
@@ -188,7 +145,7 @@ func TestGetScriptMode(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			result := testGetScriptMode(tc.cfg)
+			result := getScriptMode(tc.cfg)
 			if result != tc.expected {
 				t.Errorf("Expected %s, got %s", tc.expected, result)
 			}
@@ -196,246 +153,239 @@ func TestGetScriptMode(t *testing.T) {
 	}
 }
 
-// Test helper function for script execution
-func testExecuteScript(cfg *config.Config, port int) error {
-	// Check if script exists
-	if _, err := os.Stat(cfg.OnPortChangeScript); os.IsNotExist(err) {
-		return err
-	}
-
-	// Create a command to execute the script
-	cmd := exec.Command(cfg.OnPortChangeScript, strconv.Itoa(port), cfg.OutputFile)
-
-	// If running synchronously, capture output
-	if cfg.SyncScript {
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("script execution failed: %v, output: %s", err, output)
-		}
-	} else {
-		// For async, just start the process
-		if err := cmd.Start(); err != nil {
-			return fmt.Errorf("failed to start script: %v", err)
-		}
-	}
+// useFakeClock replaces the clock retry loops wait on for the duration of a test
+func useFakeClock(t *testing.T) *clock.Fake {
+	t.Helper()
+	fake := clock.NewFake(time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC))
+	clk = fake
+	t.Cleanup(func() { clk = clock.Real })
+	return fake
+}
 
-	return nil
+// mockVPNDetector stands in for vpn.Detector.Detect, failing a number of times first
+type mockVPNDetector struct {
+	callCount   int
+	maxFailures int
 }
 
-// Test for script execution functionality
-func TestScriptExecution(t *testing.T) {
-	// Create a temporary test script
-	tmpDir := t.TempDir()
-	testScriptPath := filepath.Join(tmpDir, "test-script.sh")
+func (m *mockVPNDetector) detect(d *vpn.Detector) (*vpn.ConnectionInfo, string, error) {
+	m.callCount++
 
-	// Write a simple test script that outputs the arguments
-	testScriptContent := `#!/bin/sh
-echo "Port: $1"
-echo "File: $2"
-exit 0
-`
-	if err := os.WriteFile(testScriptPath, []byte(testScriptContent), 0755); err != nil {
-		t.Fatalf("Failed to create test script: %v", err)
+	// Return success after specified number of failures
+	if m.callCount <= m.maxFailures {
+		return nil, "", fmt.Errorf("mock VPN detection failure %d of %d", m.callCount, m.maxFailures)
 	}
 
-	// Test cases
+	// Success case
+	return &vpn.ConnectionInfo{
+		GatewayIP: "10.0.0.1",
+		Hostname:  "test.privacy.network",
+	}, "routes", nil
+}
+
+func TestNewDetector(t *testing.T) {
 	testCases := []struct {
-		name        string
-		cfg         *config.Config
-		port        int
-		expectError bool
+		name               string
+		cfg                *config.Config
+		expectedStrategies []string
+		expectRemote       bool
+		expectError        bool
 	}{
 		{
-			name: "Valid script synchronous",
-			cfg: &config.Config{
-				OnPortChangeScript: testScriptPath,
-				OutputFile:         filepath.Join(tmpDir, "port.txt"),
-				SyncScript:         true,
-				ScriptTimeout:      5 * time.Second,
-			},
-			port:        12345,
-			expectError: false,
+			name:               "Default chain",
+			cfg:                &config.Config{},
+			expectedStrategies: vpn.DefaultStrategies,
 		},
 		{
-			name: "Valid script asynchronous",
-			cfg: &config.Config{
-				OnPortChangeScript: testScriptPath,
-				OutputFile:         filepath.Join(tmpDir, "port.txt"),
-				SyncScript:         false,
-				ScriptTimeout:      5 * time.Second,
-			},
-			port:        12345,
-			expectError: false,
+			name:               "Configured chain on a remote host",
+			cfg:                &config.Config{Detect: "wireguard,ip-route", RemoteHost: "ssh://root@192.168.1.1"},
+			expectedStrategies: []string{"wireguard", "ip-route"},
+			expectRemote:       true,
 		},
 		{
-			name: "Non-existent script",
-			cfg: &config.Config{
-				OnPortChangeScript: filepath.Join(tmpDir, "nonexistent.sh"),
-				OutputFile:         filepath.Join(tmpDir, "port.txt"),
-				SyncScript:         true,
-				ScriptTimeout:      5 * time.Second,
-			},
-			port:        12345,
+			name:        "Unknown strategy",
+			cfg:         &config.Config{Detect: "routes,dhcp"},
 			expectError: true,
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			// Execute the script
-			err := testExecuteScript(tc.cfg, tc.port)
-
-			// Check if error matches expectation
-			if tc.expectError && err == nil {
-				t.Errorf("Expected error but got nil")
+			detector, err := newDetector(tc.cfg)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("Expected an error")
+				}
+				return
 			}
-			if !tc.expectError && err != nil {
-				t.Errorf("Expected no error but got: %v", err)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !slices.Equal(detector.Strategies, tc.expectedStrategies) {
+				t.Errorf("Expected strategies %v, got %v", tc.expectedStrategies, detector.Strategies)
+			}
+			if (detector.Run != nil) != tc.expectRemote {
+				t.Errorf("Expected remote %v, got Run %v", tc.expectRemote, detector.Run != nil)
 			}
 		})
 	}
 }
 
-// mockDetectOpenVPNConnection is a mock for vpn.DetectOpenVPNConnection used in tests
-type mockVPNDetector struct {
-	callCount   int
-	maxFailures int
-	delay       time.Duration
-}
-
-func (m *mockVPNDetector) detect(configPath string) (*vpn.ConnectionInfo, error) {
-	m.callCount++
-
-	// Simulate delay if configured
-	if m.delay > 0 {
-		time.Sleep(m.delay)
-	}
-
-	// Return success after specified number of failures
-	if m.callCount <= m.maxFailures {
-		return nil, fmt.Errorf("mock VPN detection failure %d of %d", m.callCount, m.maxFailures)
-	}
-
-	// Success case
-	return &vpn.ConnectionInfo{
-		GatewayIP: "10.0.0.1",
-		Hostname:  "test.privacy.network",
-	}, nil
-}
-
 // TestDetectVPNWithRetry tests the VPN detection retry logic
 func TestDetectVPNWithRetry(t *testing.T) {
 	// Create a test configuration
 	cfg := &config.Config{
-		VPNRetryInterval:  100 * time.Millisecond, // Short interval for tests
+		VPNRetryInterval:  time.Minute,
 		OpenVPNConfigFile: "test.ovpn",
 	}
 
 	testCases := []struct {
 		name          string
 		maxFailures   int
+		retries       int
 		expectedCalls int
-		ctxTimeout    time.Duration
 		expectSuccess bool
 	}{
 		{
 			name:          "Success on first try",
 			maxFailures:   0,
 			expectedCalls: 1,
-			ctxTimeout:    0, // No timeout
 			expectSuccess: true,
 		},
 		{
 			name:          "Success after 3 failures",
 			maxFailures:   3,
+			retries:       3,
 			expectedCalls: 4,
-			ctxTimeout:    0, // No timeout
 			expectSuccess: true,
 		},
 		{
 			name:          "Context cancellation",
 			maxFailures:   10,
-			expectedCalls: 3, // Expect around 3 calls in 250ms with 100ms retry interval
-			ctxTimeout:    250 * time.Millisecond,
+			retries:       2,
+			expectedCalls: 3,
 			expectSuccess: false,
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			// Create a mock detector
-			mockDetector := &mockVPNDetector{
-				maxFailures: tc.maxFailures,
-				delay:       10 * time.Millisecond, // Small delay to make context cancellation test reliable
-			}
+			fake := useFakeClock(t)
+			mockDetector := &mockVPNDetector{maxFailures: tc.maxFailures}
+			detectVPN = mockDetector.detect
+			t.Cleanup(func() { detectVPN = (*vpn.Detector).Detect })
 
-			// Create a context with timeout if specified
-			var ctx context.Context
-			var cancel context.CancelFunc
-			if tc.ctxTimeout > 0 {
-				ctx, cancel = context.WithTimeout(context.Background(), tc.ctxTimeout)
-			} else {
-				ctx, cancel = context.WithCancel(context.Background())
-			}
+			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
 
-			// Create a custom detectVPNWithRetry function that uses our mock
-			detectVPN := func(ctx context.Context, cfg *config.Config) (*vpn.ConnectionInfo, error) {
-				var lastErr error
-				for {
-					// Try to detect the VPN connection using our mock
-					connInfo, err := mockDetector.detect(cfg.OpenVPNConfigFile)
-					if err == nil {
-						return connInfo, nil
-					}
-
-					lastErr = err
-
-					// Wait for the retry interval or until context is canceled
-					select {
-					case <-time.After(cfg.VPNRetryInterval):
-						// Continue with the next attempt
-					case <-ctx.Done():
-						return nil, fmt.Errorf("VPN detection canceled: %w", lastErr)
-					}
+			type result struct {
+				connInfo *vpn.ConnectionInfo
+				err      error
+			}
+			done := make(chan result, 1)
+			go func() {
+				connInfo, err := detectVPNWithRetry(ctx, cfg)
+				done <- result{connInfo, err}
+			}()
+
+			// Let each retry interval pass, then give up if detection still fails
+			for i := 0; i < tc.retries; i++ {
+				if err := fake.BlockUntil(ctx, 1); err != nil {
+					t.Fatalf("Detection did not wait for a retry: %v", err)
 				}
+				fake.Advance(cfg.VPNRetryInterval)
 			}
-
-			// Call the function
-			connInfo, err := detectVPN(ctx, cfg)
+			if !tc.expectSuccess {
+				if err := fake.BlockUntil(ctx, 1); err != nil {
+					t.Fatalf("Detection did not wait for a retry: %v", err)
+				}
+				cancel()
+			}
+			r := <-done
 
 			// Check results
 			if tc.expectSuccess {
-				if err != nil {
-					t.Errorf("Expected success, got error: %v", err)
+				if r.err != nil {
+					t.Errorf("Expected success, got error: %v", r.err)
 				}
-				if connInfo == nil {
+				if r.connInfo == nil {
 					t.Error("Expected connection info, got nil")
-				} else {
-					if connInfo.GatewayIP != "10.0.0.1" || connInfo.Hostname != "test.privacy.network" {
-						t.Errorf("Unexpected connection info: %+v", connInfo)
-					}
+				} else if r.connInfo.GatewayIP != "10.0.0.1" || r.connInfo.Hostname != "test.privacy.network" {
+					t.Errorf("Unexpected connection info: %+v", r.connInfo)
 				}
 			} else {
-				if err == nil {
+				if r.err == nil {
 					t.Error("Expected error, got success")
 				}
-				if connInfo != nil {
-					t.Errorf("Expected nil connection info, got: %+v", connInfo)
+				if r.connInfo != nil {
+					t.Errorf("Expected nil connection info, got: %+v", r.connInfo)
 				}
 			}
 
-			// Check call count (with some flexibility for the timeout case)
-			if tc.ctxTimeout > 0 {
-				// For timeout case, just check that we made some calls but not too many
-				if mockDetector.callCount < 1 || mockDetector.callCount > tc.maxFailures {
-					t.Errorf("Expected between 1 and %d calls, got %d", tc.maxFailures, mockDetector.callCount)
+			if mockDetector.callCount != tc.expectedCalls {
+				t.Errorf("Expected %d calls, got %d", tc.expectedCalls, mockDetector.callCount)
+			}
+		})
+	}
+}
+
+func TestDetectVPNWithRetryBudget(t *testing.T) {
+	testCases := []struct {
+		name          string
+		cfg           *config.Config
+		expectedCalls int
+		expectedError string
+	}{
+		{
+			name:          "Attempts run out",
+			cfg:           &config.Config{VPNRetryInterval: time.Minute, VPNDetectMaxAttempts: 3},
+			expectedCalls: 3,
+			expectedError: "gave up after 3 attempts",
+		},
+		{
+			// Attempts at 0, 1m, 2m and, cut short, 2m30s
+			name:          "Time runs out",
+			cfg:           &config.Config{VPNRetryInterval: time.Minute, VPNDetectTimeout: 150 * time.Second},
+			expectedCalls: 4,
+			expectedError: "gave up after 2m30s",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := useFakeClock(t)
+			mockDetector := &mockVPNDetector{maxFailures: 100}
+			detectVPN = mockDetector.detect
+			t.Cleanup(func() { detectVPN = (*vpn.Detector).Detect })
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			done := make(chan error, 1)
+			go func() {
+				_, err := detectVPNWithRetry(ctx, tc.cfg)
+				done <- err
+			}()
+
+			var err error
+		wait:
+			for {
+				select {
+				case err = <-done:
+					break wait
+				default:
 				}
-			} else {
-				// For non-timeout cases, check exact call count
-				if mockDetector.callCount != tc.expectedCalls {
-					t.Errorf("Expected %d calls, got %d", tc.expectedCalls, mockDetector.callCount)
+				waitCtx, cancelWait := context.WithTimeout(ctx, 10*time.Millisecond)
+				if fake.BlockUntil(waitCtx, 1) == nil {
+					fake.Advance(time.Minute)
 				}
+				cancelWait()
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+				t.Errorf("Expected an error containing %q, got %v", tc.expectedError, err)
+			}
+			if mockDetector.callCount != tc.expectedCalls {
+				t.Errorf("Expected %d calls, got %d", tc.expectedCalls, mockDetector.callCount)
 			}
 		})
 	}
@@ -495,15 +445,22 @@ func TestResolveCACertPath(t *testing.T) {
 
 	// Test cases
 	testCases := []struct {
-		name      string
-		certPath  string
-		expectErr bool
+		name       string
+		certPath   string
+		searchPath string
+		expectErr  bool
 	}{
 		{
 			name:      "Absolute path",
 			certPath:  testCertPath,
 			expectErr: false,
 		},
+		{
+			name:       "Relative path in the search path",
+			certPath:   testCertName,
+			searchPath: tmpDir,
+			expectErr:  false,
+		},
 		{
 			name:      "Non-existent file",
 			certPath:  "non-existent-file.crt",
@@ -514,7 +471,7 @@ func TestResolveCACertPath(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			// Call the function
-			path, err := resolveCACertPath(tc.certPath)
+			path, err := resolveCACertPath(&config.Config{CACertFile: tc.certPath, CACertSearchPath: tc.searchPath})
 
 			// Check results
 			if tc.expectErr {
@@ -616,8 +573,13 @@ func TestHandlePortOutput(t *testing.T) {
 			scriptOutputFile := filepath.Join(tmpDir, "script-output.txt")
 			os.Remove(scriptOutputFile)
 
-			// Call the function
-			handlePortOutput(tc.port, cfg, tc.portChanged)
+			// Write the port, and publish a change the way the refresh loop does
+			bus := events.NewBus()
+			subscribeHandlers(bus, bus, cfg, nil)
+			handlePortOutput(tc.port, time.Time{}, time.Time{}, nil, cfg)
+			if tc.portChanged {
+				bus.Publish(events.Event{Type: events.PortChanged, Port: tc.port})
+			}
 
 			// Check if the port was written to the output file
 			if tc.outputFile != "" {
@@ -660,109 +622,51 @@ func TestHandlePortOutput(t *testing.T) {
 	}
 }
 
-// TestRefreshPortForwarding tests the port forwarding refresh function
-func TestRefreshPortForwarding(t *testing.T) {
-	// Create a mock port forwarding client
-	type mockPFClient struct {
-		refreshError bool
+func TestHandlePortOutputJSON(t *testing.T) {
+	cfg := &config.Config{
+		OutputFile:   filepath.Join(t.TempDir(), "port.json"),
+		OutputFormat: config.OutputFormatJSON,
 	}
+	expiresAt := time.Date(2024, time.March, 3, 12, 0, 0, 0, time.UTC)
+	renewsAt := expiresAt.Add(-72 * time.Hour)
 
-	// Define a test version of refreshPortForwarding that accepts our mock client and signature function
-	testRefreshPortForwarding := func(client interface{}, getSignature func(c *mockPFClient, pfInfo *portforwarding.PortForwardingInfo) (*portforwarding.PortForwardingInfo, error), pfInfo *portforwarding.PortForwardingInfo, initialPort *int, portChanged *bool) *portforwarding.PortForwardingInfo {
-		mockClient := client.(*mockPFClient)
-		newPfInfo, err := getSignature(mockClient, pfInfo)
-		if err != nil {
-			return pfInfo
-		}
+	handlePortOutput(12345, expiresAt, renewsAt, nil, cfg)
 
-		*portChanged = newPfInfo.Port != *initialPort
-		*initialPort = newPfInfo.Port
-		return newPfInfo
+	data, err := os.ReadFile(cfg.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read output file: %v", err)
 	}
-
-	// Mock GetSignature method
-	mockGetSignature := func(c *mockPFClient, pfInfo *portforwarding.PortForwardingInfo) (*portforwarding.PortForwardingInfo, error) {
-		if c.refreshError {
-			return nil, errors.New("mock refresh error")
-		}
-
-		// Return a new port forwarding info with a different port and future expiry
-		return &portforwarding.PortForwardingInfo{
-			Port:      54321, // Different from initial port
-			ExpiresAt: time.Now().Add(48 * time.Hour),
-			Signature: "new-signature",
-			Payload:   "new-payload",
-		}, nil
+	var decoded portforwarding.PortFile
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Expected JSON in the output file, got %q: %v", data, err)
+	}
+	if decoded.Port != 12345 || !decoded.ExpiresAt.Equal(expiresAt) || !decoded.RenewsAt.Equal(renewsAt) {
+		t.Errorf("Unexpected output file contents: %+v", decoded)
 	}
+}
 
-	// Test cases
+func TestScriptEnv(t *testing.T) {
 	testCases := []struct {
-		name              string
-		initialPort       int
-		refreshError      bool
-		expectPort        int
-		expectPortChanged bool
+		name      string
+		expiresAt time.Time
+		expected  []string
 	}{
 		{
-			name:              "Successful refresh with port change",
-			initialPort:       12345,
-			refreshError:      false,
-			expectPort:        54321,
-			expectPortChanged: true,
+			name:      "Known expiry",
+			expiresAt: time.Date(2024, time.March, 3, 13, 0, 0, 0, time.FixedZone("CET", 3600)),
+			expected:  []string{"PIA_PORT=12345", "PIA_EXPIRES_AT=2024-03-03T12:00:00Z", "PIA_RENEWS_AT=2024-03-02T12:00:00Z"},
 		},
 		{
-			name:              "Failed refresh",
-			initialPort:       12345,
-			refreshError:      true,
-			expectPort:        12345, // Should keep initial port
-			expectPortChanged: false,
+			name:     "Unknown expiry",
+			expected: []string{"PIA_PORT=12345"},
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			// Create mock client
-			mockClient := &mockPFClient{refreshError: tc.refreshError}
-
-			// Create initial port forwarding info
-			initialInfo := &portforwarding.PortForwardingInfo{
-				Port:      tc.initialPort,
-				ExpiresAt: time.Now().Add(1 * time.Hour),
-				Signature: "initial-signature",
-				Payload:   "initial-payload",
-			}
-
-			// Variables to track port changes
-			initialPortVar := tc.initialPort
-			portChanged := false
-
-			// Call a modified version of refreshPortForwarding for testing
-			resultInfo := testRefreshPortForwarding(mockClient, mockGetSignature, initialInfo, &initialPortVar, &portChanged)
-
-			// Check results
-			if tc.refreshError {
-				// Should return the original info on error
-				if resultInfo != initialInfo {
-					t.Errorf("Expected original info to be returned on error, got different info")
-				}
-			} else {
-				// Should return new info on success
-				if resultInfo.Port != tc.expectPort {
-					t.Errorf("Expected port %d, got %d", tc.expectPort, resultInfo.Port)
-				}
-				if resultInfo.Signature != "new-signature" {
-					t.Errorf("Expected new signature, got %s", resultInfo.Signature)
-				}
-			}
-
-			// Check port change tracking
-			if portChanged != tc.expectPortChanged {
-				t.Errorf("Expected portChanged to be %v, got %v", tc.expectPortChanged, portChanged)
-			}
-
-			// Check initial port variable
-			if initialPortVar != tc.expectPort {
-				t.Errorf("Expected initialPort to be %d, got %d", tc.expectPort, initialPortVar)
+			env := scriptEnv(12345, tc.expiresAt, tc.expiresAt.Add(-24*time.Hour))
+			if !slices.Equal(env, tc.expected) {
+				t.Errorf("Expected %q, got %q", tc.expected, env)
 			}
 		})
 	}
@@ -829,6 +733,22 @@ func TestSetupConfig(t *testing.T) {
 			expectedTimeout:    60 * time.Second,
 			expectedSyncScript: true,
 		},
+		{
+			name:               "Duration refresh interval",
+			envCredentials:     credFile,
+			envDebug:           "false",
+			envRefreshInt:      "15m",
+			envOnPortChange:    "",
+			envScriptTimeout:   "1m",
+			envSyncScript:      "",
+			outputFile:         filepath.Join(tmpDir, "port.txt"),
+			expectError:        false,
+			expectedDebug:      false,
+			expectedRefresh:    15 * time.Minute,
+			expectedScript:     "",
+			expectedTimeout:    time.Minute,
+			expectedSyncScript: false,
+		},
 		{
 			name:               "Missing credentials",
 			envCredentials:     "",
@@ -917,3 +837,166 @@ func TestSetupConfig(t *testing.T) {
 		})
 	}
 }
+
+// TestRunCleanups tests that cleanups run once, most recent first
+func TestRunCleanups(t *testing.T) {
+	var order []int
+	addCleanup(func() { order = append(order, 1) })
+	addCleanup(func() { order = append(order, 2) })
+
+	runCleanups()
+	runCleanups()
+
+	if len(order) != 2 || order[0] != 2 || order[1] != 1 {
+		t.Errorf("Expected cleanups to run once in reverse order, got %v", order)
+	}
+}
+
+func TestReadyFile(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	cfg := &config.Config{ReadyFile: filepath.Join(t.TempDir(), "ready")}
+
+	markReady(cfg, 51234)
+	data, err := os.ReadFile(cfg.ReadyFile)
+	if err != nil {
+		t.Fatalf("Expected ready file to exist: %v", err)
+	}
+	if string(data) != "51234" {
+		t.Errorf("Expected ready file to contain the port, got %q", data)
+	}
+
+	markNotReady(cfg, errors.New("bind failed"))
+	if _, err := os.Stat(cfg.ReadyFile); !os.IsNotExist(err) {
+		t.Errorf("Expected ready file to be removed")
+	}
+
+	// Removing an already removed ready file is harmless
+	markNotReady(cfg, errors.New("bind failed"))
+}
+
+func TestWaitForRequestLimit(t *testing.T) {
+	fake := useFakeClock(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if !waitForRequestLimit(ctx, "tokens", []time.Time{fake.Now().Add(-time.Minute)}) {
+		t.Fatal("Expected no wait below the limit")
+	}
+
+	// A restart loop made the limit's worth of requests in the last minutes
+	recentRequests := func() []time.Time {
+		var times []time.Time
+		for i := startupRequestLimit; i > 0; i-- {
+			times = append(times, fake.Now().Add(-time.Duration(i)*time.Minute))
+		}
+		return times
+	}
+	done := make(chan bool, 1)
+	go func() { done <- waitForRequestLimit(ctx, "tokens", recentRequests()) }()
+	if err := fake.BlockUntil(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	fake.Advance(startupRequestWindow - time.Duration(startupRequestLimit)*time.Minute)
+	if !<-done {
+		t.Error("Expected the wait to end once the oldest request left the window")
+	}
+
+	go func() { done <- waitForRequestLimit(ctx, "tokens", recentRequests()) }()
+	if err := fake.BlockUntil(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if <-done {
+		t.Error("Expected false once the context is canceled")
+	}
+}
+
+func TestManagerEndToEnd(t *testing.T) {
+	fake := useFakeClock(t)
+	start := fake.Now()
+	cfg := config.DefaultConfig()
+	cfg.OutputFile = filepath.Join(t.TempDir(), "port.txt")
+	cfg.RefreshJitter = 0
+
+	bus := events.NewBus()
+	subscribeHandlers(bus, bus, cfg, nil)
+	var mu sync.Mutex
+	var seen []events.Event
+	bus.Subscribe(func(e events.Event) {
+		mu.Lock()
+		seen = append(seen, e)
+		mu.Unlock()
+	})
+
+	// The first signature is renewed 30 minutes in; the first keepalive fails
+	forwarder := pftest.NewForwarder(
+		pftest.Signature(1000, start.Add(portforwarding.SignatureRenewBefore+30*time.Minute)),
+		pftest.Signature(2000, start.Add(48*time.Hour)),
+	)
+	forwarder.FailBinds(nil, errors.New("gateway error"), nil)
+	connInfo := &vpn.ConnectionInfo{GatewayIP: "10.0.0.1", Hostname: "server"}
+	manager := newManager(cfg, bus, forwarder, newFixedToken("test-token"), connInfo)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- manager.Run(ctx) }()
+
+	// First bind, failed keepalive, retry, then a keepalive after the renewal is due
+	for _, step := range []time.Duration{cfg.RefreshInterval, 5 * time.Second, cfg.RefreshInterval} {
+		if err := fake.BlockUntil(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+		fake.Advance(step)
+	}
+	if err := fake.BlockUntil(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Manager failed: %v", err)
+	}
+
+	if bound := forwarder.Bound(); !slices.Equal(bound, []string{"signature-1000", "signature-1000", "signature-2000"}) {
+		t.Errorf("Expected the first port bound twice, then the renewed one, got %v", bound)
+	}
+	if forwarder.Token() != "test-token" {
+		t.Errorf("Expected the renewal to hand the forwarder the token, got %q", forwarder.Token())
+	}
+	data, err := os.ReadFile(cfg.OutputFile)
+	if err != nil || string(data) != "2000" {
+		t.Errorf("Expected the output file to hold the renewed port, got %q, %v", data, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var types []events.Type
+	var changes [][2]int
+	outputWrites := 0
+	for _, e := range seen {
+		// Every bind writes the output file, reported as it happens
+		if e.Type == events.OutputWritten {
+			outputWrites++
+			continue
+		}
+		types = append(types, e.Type)
+		if e.Type == events.PortChanged {
+			changes = append(changes, [2]int{e.PreviousPort, e.Port})
+		}
+	}
+	want := []events.Type{
+		events.SignatureRenewed, events.PortBound, events.PortChanged,
+		events.BindFailed,
+		events.PortBound,
+		events.SignatureRenewed, events.PortBound, events.PortChanged,
+	}
+	if !slices.Equal(types, want) {
+		t.Errorf("Expected events %v, got %v", want, types)
+	}
+	if !slices.Equal(changes, [][2]int{{0, 1000}, {1000, 2000}}) {
+		t.Errorf("Expected port changes 0->1000->2000, got %v", changes)
+	}
+	if outputWrites != 3 {
+		t.Errorf("Expected the output file written on each of the 3 binds, got %d writes", outputWrites)
+	}
+}
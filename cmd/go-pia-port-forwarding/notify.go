@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/events"
+	"github.com/meschansky/go-pia/internal/notify"
+)
+
+const (
+	// notifyQueueSize bounds the push notifications waiting to be sent; more
+	// are dropped while the provider is unreachable
+	notifyQueueSize = 16
+	// maxEmailBatch bounds the notifications collected for one email
+	maxEmailBatch = 100
+)
+
+// notificationFilter turns events into notifications. Failures are only
+// reported once they've persisted for readyFailureThreshold attempts, and
+// again after they've cleared.
+type notificationFilter struct {
+	events map[string]bool
+
+	mu sync.Mutex
+	// Set once a bind failure has been reported, until the next bind
+	bindFailing bool
+	// Authentication failures in a row
+	authFailures int
+}
+
+// message returns the notification for e, if the event it belongs to is enabled
+func (f *notificationFilter) message(e events.Event) (notify.Message, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch e.Type {
+	case events.PortChanged:
+		body := fmt.Sprintf("Forwarded port is now %d", e.Port)
+		if e.PreviousPort != 0 {
+			body += fmt.Sprintf(" (was %d)", e.PreviousPort)
+		}
+		if e.Hostname != "" {
+			body += " on " + e.Hostname
+		}
+		return notify.Message{Title: "PIA port changed", Body: body, Time: e.Time}, f.events[notify.EventPortChange]
+	case events.PortBound:
+		if !f.bindFailing {
+			return notify.Message{}, false
+		}
+		f.bindFailing = false
+		return notify.Message{Title: "PIA port forwarding recovered", Body: fmt.Sprintf("Port %d is bound again", e.Port), Time: e.Time}, f.events[notify.EventBindFailure]
+	case events.BindFailed:
+		if f.bindFailing || e.ConsecutiveFailures < readyFailureThreshold {
+			return notify.Message{}, false
+		}
+		f.bindFailing = true
+		body := fmt.Sprintf("Binding port %d failed %d times in a row: %s", e.Port, e.ConsecutiveFailures, e.Error)
+		return notify.Message{Title: "PIA port forwarding failing", Body: body, Urgent: true, Time: e.Time}, f.events[notify.EventBindFailure]
+	case events.TokenRefreshed:
+		f.authFailures = 0
+	case events.AuthFailed:
+		f.authFailures++
+		if f.authFailures != readyFailureThreshold {
+			return notify.Message{}, false
+		}
+		body := fmt.Sprintf("Failed %d times in a row to get a PIA token: %s", f.authFailures, e.Error)
+		return notify.Message{Title: "PIA authentication failing", Body: body, Urgent: true, Time: e.Time}, f.events[notify.EventAuthFailure]
+	}
+	return notify.Message{}, false
+}
+
+// startNotifier sends push notifications and emails about events on bus, and
+// port changes on changes, until ctx is done
+func startNotifier(ctx context.Context, cfg *config.Config, bus, changes *events.Bus) {
+	selected, err := notify.ParseEvents(cfg.NotifierEvents)
+	if err != nil {
+		log.Printf("Notifications disabled: %v", err)
+		return
+	}
+	filter := &notificationFilter{events: selected}
+
+	var sinks []func(notify.Message)
+	if cfg.Notifier != "" {
+		if p, err := newPushNotifier(cfg); err != nil {
+			log.Printf("Push notifications disabled: %v", err)
+		} else {
+			sinks = append(sinks, p.add)
+			go p.run(ctx)
+		}
+	}
+	if cfg.SMTPServer != "" {
+		m, err := newEmailNotifier(cfg)
+		if err != nil {
+			log.Printf("Email notifications disabled: %v", err)
+		} else {
+			sinks = append(sinks, m.add)
+			go m.run(ctx)
+		}
+	}
+	if len(sinks) == 0 {
+		return
+	}
+
+	send := func(e events.Event) {
+		if m, ok := filter.message(e); ok {
+			for _, sink := range sinks {
+				sink(m)
+			}
+		}
+	}
+	changes.Subscribe(send, events.PortChanged)
+	bus.Subscribe(send, events.PortBound, events.BindFailed, events.TokenRefreshed, events.AuthFailed)
+}
+
+// pushNotifier sends notifications with a push provider
+type pushNotifier struct {
+	cfg    *config.Config
+	sender *notify.Notifier
+	// Messages waiting for run to send them, so handlers never wait on the provider
+	queue chan notify.Message
+}
+
+// newPushNotifier returns a notifier for the configured provider
+func newPushNotifier(cfg *config.Config) (*pushNotifier, error) {
+	sender, err := notify.New(notify.Settings{Provider: cfg.Notifier, URL: cfg.NotifierURL, User: cfg.NotifierUser})
+	if err != nil {
+		return nil, err
+	}
+	return &pushNotifier{cfg: cfg, sender: sender, queue: make(chan notify.Message, notifyQueueSize)}, nil
+}
+
+// add queues m for sending
+func (p *pushNotifier) add(m notify.Message) {
+	select {
+	case p.queue <- m:
+	default:
+		log.Printf("Dropped notification %q, too many are waiting to be sent", m.Title)
+	}
+}
+
+// run sends queued notifications until ctx is done
+func (p *pushNotifier) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case m := <-p.queue:
+			if err := p.send(ctx, m); err != nil {
+				log.Printf("Failed to send notification: %v", err)
+			}
+		}
+	}
+}
+
+// send delivers m with the current token
+func (p *pushNotifier) send(ctx context.Context, m notify.Message) error {
+	// Read the token every time, so a rotated one is picked up
+	token, err := readSecretFile(p.cfg.NotifierTokenFile, "notifier token")
+	if err != nil {
+		return err
+	}
+	p.sender.Token = token
+	return p.sender.Send(ctx, m)
+}
+
+// emailNotifier emails notifications, collecting those that arrive within
+// cfg.SMTPBatchInterval of the first into one email
+type emailNotifier struct {
+	cfg    *config.Config
+	mailer *notify.Mailer
+	// Emails a batch, replaced in tests
+	deliver func(ctx context.Context, batch []notify.Message) error
+	// Signaled when a batch is started
+	started chan struct{}
+
+	mu      sync.Mutex
+	pending []notify.Message
+}
+
+// newEmailNotifier returns a notifier for the configured SMTP server
+func newEmailNotifier(cfg *config.Config) (*emailNotifier, error) {
+	mailer := cfg.Mailer()
+	if err := mailer.Check(); err != nil {
+		return nil, err
+	}
+	n := &emailNotifier{cfg: cfg, mailer: mailer, started: make(chan struct{}, 1)}
+	n.deliver = n.send
+	return n, nil
+}
+
+// add adds m to the current batch, starting one if there's none
+func (n *emailNotifier) add(m notify.Message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if len(n.pending) >= maxEmailBatch {
+		log.Printf("Dropped notification %q, the email batch is full", m.Title)
+		return
+	}
+	n.pending = append(n.pending, m)
+	if len(n.pending) == 1 {
+		select {
+		case n.started <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run emails each batch once its interval is up, until ctx is done
+func (n *emailNotifier) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-n.started:
+		}
+		if n.cfg.SMTPBatchInterval > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-clk.After(n.cfg.SMTPBatchInterval):
+			}
+		}
+
+		n.mu.Lock()
+		batch := n.pending
+		n.pending = nil
+		n.mu.Unlock()
+		if err := n.deliver(ctx, batch); err != nil {
+			log.Printf("Failed to email notifications: %v", err)
+		}
+	}
+}
+
+// send emails batch with the current password
+func (n *emailNotifier) send(ctx context.Context, batch []notify.Message) error {
+	// Read the password every time, so a rotated one is picked up
+	password, err := readSecretFile(n.cfg.SMTPPasswordFile, "SMTP password")
+	if err != nil {
+		return err
+	}
+	n.mailer.Password = password
+	return n.mailer.Send(ctx, batch)
+}
+
+// readSecretFile returns the trimmed contents of a file holding a secret, or
+// an empty string if no file is configured
+func readSecretFile(path, name string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", errors.New(name + " file is empty")
+	}
+	return secret, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/events"
+	"github.com/meschansky/go-pia/internal/notify"
+)
+
+func TestNotificationFilter(t *testing.T) {
+	testCases := []struct {
+		name     string
+		events   string
+		sequence []events.Event
+		expected []string
+	}{
+		{
+			name: "Port changes",
+			sequence: []events.Event{
+				{Type: events.PortChanged, Port: 12345},
+				{Type: events.PortBound, Port: 12345},
+				{Type: events.PortChanged, Port: 23456, PreviousPort: 12345, Hostname: "frankfurt403"},
+			},
+			expected: []string{"Forwarded port is now 12345", "Forwarded port is now 23456 (was 12345) on frankfurt403"},
+		},
+		{
+			name: "Persistent bind failure and recovery",
+			sequence: []events.Event{
+				{Type: events.BindFailed, Port: 12345, ConsecutiveFailures: 1, Error: "timeout"},
+				{Type: events.BindFailed, Port: 12345, ConsecutiveFailures: 2, Error: "timeout"},
+				{Type: events.BindFailed, Port: 12345, ConsecutiveFailures: 3, Error: "timeout"},
+				{Type: events.BindFailed, Port: 12345, ConsecutiveFailures: 4, Error: "timeout"},
+				{Type: events.PortBound, Port: 12345},
+				{Type: events.PortBound, Port: 12345},
+			},
+			expected: []string{"Binding port 12345 failed 3 times in a row: timeout", "Port 12345 is bound again"},
+		},
+		{
+			name: "Authentication failures are counted until a token is obtained",
+			sequence: []events.Event{
+				{Type: events.AuthFailed, Error: "401"},
+				{Type: events.AuthFailed, Error: "401"},
+				{Type: events.TokenRefreshed},
+				{Type: events.AuthFailed, Error: "401"},
+				{Type: events.AuthFailed, Error: "401"},
+				{Type: events.AuthFailed, Error: "401"},
+				{Type: events.AuthFailed, Error: "401"},
+			},
+			expected: []string{"Failed 3 times in a row to get a PIA token: 401"},
+		},
+		{
+			name:   "Disabled events are left out",
+			events: "auth-failure",
+			sequence: []events.Event{
+				{Type: events.PortChanged, Port: 12345},
+				{Type: events.BindFailed, Port: 12345, ConsecutiveFailures: 3},
+			},
+			expected: nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			selected, err := notify.ParseEvents(tc.events)
+			if err != nil {
+				t.Fatalf("Failed to parse events: %v", err)
+			}
+			filter := &notificationFilter{events: selected}
+
+			var bodies []string
+			for _, e := range tc.sequence {
+				if m, ok := filter.message(e); ok {
+					bodies = append(bodies, m.Body)
+				}
+			}
+			if !reflect.DeepEqual(bodies, tc.expected) {
+				t.Errorf("Expected %q, got %q", tc.expected, bodies)
+			}
+		})
+	}
+}
+
+func TestPushNotifierSend(t *testing.T) {
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, r.Header.Get("X-Gotify-Key")+" "+string(body))
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(tokenFile, []byte("app-token\n"), 0600)
+	p, err := newPushNotifier(&config.Config{Notifier: "gotify", NotifierURL: server.URL, NotifierTokenFile: tokenFile})
+	if err != nil {
+		t.Fatalf("Failed to create notifier: %v", err)
+	}
+
+	m := notify.Message{Title: "PIA port changed", Body: "Forwarded port is now 12345"}
+	if err := p.send(context.Background(), m); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	expected := []string{`app-token {"title":"PIA port changed","message":"Forwarded port is now 12345","priority":5}`}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("Expected %q, got %q", expected, received)
+	}
+
+	os.WriteFile(tokenFile, nil, 0600)
+	if err := p.send(context.Background(), m); err == nil {
+		t.Error("Expected an empty token file to be an error")
+	}
+}
+
+func TestEmailNotifierBatches(t *testing.T) {
+	fake := useFakeClock(t)
+	cfg := &config.Config{SMTPServer: "smtp.example.com:587", SMTPFrom: "pia@example.com", SMTPTo: "me@example.com", SMTPBatchInterval: 5 * time.Minute}
+	n, err := newEmailNotifier(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create notifier: %v", err)
+	}
+	batches := make(chan []string, 10)
+	n.deliver = func(ctx context.Context, batch []notify.Message) error {
+		var titles []string
+		for _, m := range batch {
+			titles = append(titles, m.Title)
+		}
+		batches <- titles
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.run(ctx)
+
+	// Everything within the interval of the first notification goes out together
+	n.add(notify.Message{Title: "failing"})
+	if err := fake.BlockUntil(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	n.add(notify.Message{Title: "recovered"})
+	n.add(notify.Message{Title: "failing again"})
+	fake.Advance(5 * time.Minute)
+	if got := <-batches; !reflect.DeepEqual(got, []string{"failing", "recovered", "failing again"}) {
+		t.Errorf("Expected one batch of three, got %q", got)
+	}
+
+	// The next notification starts a new batch
+	n.add(notify.Message{Title: "port changed"})
+	if err := fake.BlockUntil(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	fake.Advance(5 * time.Minute)
+	if got := <-batches; !reflect.DeepEqual(got, []string{"port changed"}) {
+		t.Errorf("Expected a batch of one, got %q", got)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/events"
+)
+
+// previousPortKeeper passes PortChanged events on to another bus with the
+// ports before them that are still in their grace period, and publishes
+// PreviousPortExpired there once a grace period ends, so rules that let peers
+// reach an old port can stay until they've moved on
+type previousPortKeeper struct {
+	out   *events.Bus
+	grace time.Duration
+
+	mu sync.Mutex
+	// Ports in their grace period and when it ends, newest first
+	previous []previousPort
+	// Latest change passed on, kept current by binds of its port and
+	// repeated when a grace period ends
+	last *events.Event
+}
+
+// previousPort is a port in its grace period
+type previousPort struct {
+	port  int
+	until time.Time
+}
+
+// newPreviousPortKeeper returns a keeper with the given grace period, which
+// keeps no ports unless it's positive
+func newPreviousPortKeeper(grace time.Duration) *previousPortKeeper {
+	return &previousPortKeeper{grace: grace}
+}
+
+// follow returns the bus hooks and integrations get PortChanged events from.
+// It's changes itself without a grace period; otherwise every change lists
+// the ports before it whose grace period hasn't ended, and the end of each is
+// published as PreviousPortExpired until ctx is done. Binds on bus keep the
+// expiry the end of a grace period repeats current.
+func (k *previousPortKeeper) follow(ctx context.Context, bus, changes *events.Bus) *events.Bus {
+	if k.grace <= 0 {
+		return changes
+	}
+	k.out = events.NewBus()
+	bus.Subscribe(k.bound, events.PortBound)
+	changes.Subscribe(func(e events.Event) {
+		k.add(ctx, e)
+	}, events.PortChanged)
+	return k.out
+}
+
+// ports returns the ports in their grace period, newest first
+func (k *previousPortKeeper) ports() []int {
+	if k == nil {
+		return nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.portsLocked()
+}
+
+// add starts the grace period of the port e replaces and passes e on
+func (k *previousPortKeeper) add(ctx context.Context, e events.Event) {
+	k.mu.Lock()
+	// A port that comes back is current again, and one that leaves again
+	// starts its grace period over
+	k.previous = slices.DeleteFunc(k.previous, func(p previousPort) bool {
+		return p.port == e.Port || p.port == e.PreviousPort
+	})
+	if e.PreviousPort != 0 {
+		until := clk.Now().Add(k.grace)
+		k.previous = slices.Insert(k.previous, 0, previousPort{port: e.PreviousPort, until: until})
+		go k.expireAfter(ctx, e.PreviousPort, k.grace)
+	}
+	e.PreviousPorts = k.portsLocked()
+	k.last = &e
+	k.mu.Unlock()
+
+	k.out.Publish(e)
+}
+
+// bound keeps the last change current when its port is bound with a renewed
+// signature
+func (k *previousPortKeeper) bound(e events.Event) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.last != nil && k.last.Port == e.Port {
+		k.last.ExpiresAt, k.last.RenewsAt = e.ExpiresAt, e.RenewsAt
+	}
+}
+
+// expireAfter ends the grace period of port after d, unless ctx is done first
+func (k *previousPortKeeper) expireAfter(ctx context.Context, port int, d time.Duration) {
+	select {
+	case <-clk.After(d):
+		k.expire(port)
+	case <-ctx.Done():
+	}
+}
+
+// expire ends the grace period of port and publishes the last change without
+// it. There's nothing to do if the port came back or its grace period started
+// over.
+func (k *previousPortKeeper) expire(port int) {
+	k.mu.Lock()
+	i := slices.IndexFunc(k.previous, func(p previousPort) bool { return p.port == port })
+	if i < 0 || k.previous[i].until.After(clk.Now()) {
+		k.mu.Unlock()
+		return
+	}
+	k.previous = slices.Delete(k.previous, i, i+1)
+	e := *k.last
+	e.Type = events.PreviousPortExpired
+	e.Time = time.Time{}
+	e.PreviousPorts = k.portsLocked()
+	k.mu.Unlock()
+
+	log.Printf("Grace period of previous port %d ended after %s", port, k.grace)
+	k.out.Publish(e)
+}
+
+// portsLocked returns the ports in their grace period, newest first; k.mu
+// must be held
+func (k *previousPortKeeper) portsLocked() []int {
+	var ports []int
+	for _, p := range k.previous {
+		ports = append(ports, p.port)
+	}
+	return ports
+}
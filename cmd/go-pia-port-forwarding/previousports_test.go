@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/events"
+	"github.com/meschansky/go-pia/internal/portforwarding"
+	"github.com/meschansky/go-pia/internal/state"
+	"github.com/meschansky/go-pia/internal/systemd"
+)
+
+func TestKeepPreviousPortsDisabled(t *testing.T) {
+	bus := events.NewBus()
+	k := newPreviousPortKeeper(0)
+	if changes := k.follow(context.Background(), bus, bus); changes != bus {
+		t.Errorf("Expected port changes to come straight from the bus without a grace period")
+	}
+	bus.Publish(events.Event{Type: events.PortChanged, Port: 1002, PreviousPort: 1001})
+	if ports := k.ports(); ports != nil {
+		t.Errorf("Expected no previous ports without a grace period, got %v", ports)
+	}
+}
+
+func TestKeepPreviousPorts(t *testing.T) {
+	fake := useFakeClock(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	bus := events.NewBus()
+	delivered := make(chan events.Event, 10)
+	newPreviousPortKeeper(30*time.Minute).follow(ctx, bus, bus).Subscribe(func(e events.Event) {
+		delivered <- e
+	}, events.PortChanged, events.PreviousPortExpired)
+
+	next := func() events.Event {
+		t.Helper()
+		select {
+		case e := <-delivered:
+			return e
+		case <-ctx.Done():
+			t.Fatalf("Expected another event")
+			return events.Event{}
+		}
+	}
+	expect := func(e events.Event, typ events.Type, port int, previous []int) {
+		t.Helper()
+		if e.Type != typ || e.Port != port || !slices.Equal(e.PreviousPorts, previous) {
+			t.Errorf("Expected %s for port %d with previous ports %v, got %s for port %d with %v", typ, port, previous, e.Type, e.Port, e.PreviousPorts)
+		}
+	}
+
+	bus.Publish(events.Event{Type: events.PortChanged, Port: 1001})
+	expect(next(), events.PortChanged, 1001, nil)
+	bus.Publish(events.Event{Type: events.PortChanged, Port: 1002, PreviousPort: 1001})
+	expect(next(), events.PortChanged, 1002, []int{1001})
+
+	if err := fake.BlockUntil(ctx, 1); err != nil {
+		t.Fatalf("Grace period never started: %v", err)
+	}
+	fake.Advance(10 * time.Minute)
+	bus.Publish(events.Event{Type: events.PortChanged, Port: 1003, PreviousPort: 1002})
+	expect(next(), events.PortChanged, 1003, []int{1002, 1001})
+
+	// Each grace period ends on its own, repeating the last change without it
+	// and with the expiry of the signature bound since
+	if err := fake.BlockUntil(ctx, 2); err != nil {
+		t.Fatalf("Second grace period never started: %v", err)
+	}
+	renewed := time.Date(2024, time.May, 1, 0, 0, 0, 0, time.UTC)
+	bus.Publish(events.Event{Type: events.PortBound, Port: 1003, ExpiresAt: renewed})
+	fake.Advance(20 * time.Minute)
+	e := next()
+	expect(e, events.PreviousPortExpired, 1003, []int{1002})
+	if !e.ExpiresAt.Equal(renewed) {
+		t.Errorf("Expected the renewed expiry %s, got %s", renewed, e.ExpiresAt)
+	}
+	fake.Advance(10 * time.Minute)
+	expect(next(), events.PreviousPortExpired, 1003, nil)
+}
+
+func TestKeepPreviousPortsPortComesBack(t *testing.T) {
+	fake := useFakeClock(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	bus := events.NewBus()
+	delivered := make(chan events.Event, 10)
+	newPreviousPortKeeper(30*time.Minute).follow(ctx, bus, bus).Subscribe(func(e events.Event) {
+		delivered <- e
+	}, events.PortChanged, events.PreviousPortExpired)
+
+	bus.Publish(events.Event{Type: events.PortChanged, Port: 1001})
+	bus.Publish(events.Event{Type: events.PortChanged, Port: 1002, PreviousPort: 1001})
+	bus.Publish(events.Event{Type: events.PortChanged, Port: 1001, PreviousPort: 1002})
+	for range 3 {
+		<-delivered
+	}
+
+	// Port 1001 is current again, so only 1002's grace period ends
+	if err := fake.BlockUntil(ctx, 2); err != nil {
+		t.Fatalf("Grace periods never started: %v", err)
+	}
+	fake.Advance(30 * time.Minute)
+	select {
+	case e := <-delivered:
+		if e.Type != events.PreviousPortExpired || e.Port != 1001 || len(e.PreviousPorts) != 0 {
+			t.Errorf("Expected port 1002's grace period to end, got %s for port %d with %v", e.Type, e.Port, e.PreviousPorts)
+		}
+	case <-ctx.Done():
+		t.Fatalf("Port 1002's grace period never ended")
+	}
+
+	// Give the keeper a moment to wrongly end 1001's grace period too
+	time.Sleep(50 * time.Millisecond)
+	if len(delivered) != 0 {
+		t.Errorf("Expected no more events, got %+v", <-delivered)
+	}
+}
+
+func TestPreviousPortsInOutputs(t *testing.T) {
+	fake := useFakeClock(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var sent []string
+	origExecCommand := execCommand
+	t.Cleanup(func() { execCommand = origExecCommand })
+	execCommand = func(ctx context.Context, command string, args ...string) *exec.Cmd {
+		sent = append(sent, args[len(args)-1])
+		return exec.CommandContext(ctx, "true")
+	}
+	notified := 0
+	origRunUnitAction := runUnitAction
+	t.Cleanup(func() { runUnitAction = origRunUnitAction })
+	runUnitAction = func(systemd.Action, string) error {
+		notified++
+		return nil
+	}
+
+	dir := t.TempDir()
+	source := filepath.Join(dir, "nft.tmpl")
+	target := filepath.Join(dir, "nft.conf")
+	os.WriteFile(source, []byte("allow {{.Port}}{{range .PreviousPorts}} {{.}}{{end}}\n"), 0644)
+	cfg := &config.Config{
+		OutputFile:        filepath.Join(dir, "port"),
+		OutputFormat:      config.OutputFormatJSON,
+		StateFile:         filepath.Join(dir, "state.json"),
+		Ubus:              true,
+		Templates:         source + "=" + target,
+		NotifyUnit:        "nftables.service",
+		PreviousPortGrace: 30 * time.Minute,
+	}
+
+	bus := events.NewBus()
+	keeper := newPreviousPortKeeper(cfg.PreviousPortGrace)
+	changes := keeper.follow(ctx, bus, bus)
+	defer subscribeHandlers(bus, changes, cfg, keeper)()
+	subscribeState(bus, changes, cfg, &state.State{}, newFixedToken("token"), keeper)
+	expired := make(chan struct{}, 1)
+	changes.Subscribe(func(events.Event) { expired <- struct{}{} }, events.PreviousPortExpired)
+
+	expect := func(previous []int) {
+		t.Helper()
+		var portFile portforwarding.PortFile
+		if data, err := os.ReadFile(cfg.OutputFile); err != nil || json.Unmarshal(data, &portFile) != nil || !slices.Equal(portFile.PreviousPorts, previous) {
+			t.Errorf("Expected previous ports %v in the port file, got %q, %v", previous, data, err)
+		}
+		if st, err := state.Load(cfg.StateFile); err != nil || !slices.Equal(st.PreviousPorts, previous) {
+			t.Errorf("Expected previous ports %v in the state, got %+v, %v", previous, st, err)
+		}
+		var message portforwarding.PortFile
+		if len(sent) == 0 || json.Unmarshal([]byte(sent[len(sent)-1]), &message) != nil || !slices.Equal(message.PreviousPorts, previous) {
+			t.Errorf("Expected previous ports %v in the ubus event, got %q", previous, sent)
+		}
+	}
+
+	bus.Publish(events.Event{Type: events.PortBound, Port: 1001})
+	bus.Publish(events.Event{Type: events.PortChanged, Port: 1001})
+	bus.Publish(events.Event{Type: events.PortBound, Port: 1002})
+	bus.Publish(events.Event{Type: events.PortChanged, Port: 1002, PreviousPort: 1001})
+	expect([]int{1001})
+	if notified != 2 {
+		t.Errorf("Expected the unit to be told about both ports, got %d notifications", notified)
+	}
+
+	// The end of the grace period is written everywhere, and the unit is
+	// told because the rendered template changed
+	if err := fake.BlockUntil(ctx, 1); err != nil {
+		t.Fatalf("Grace period never started: %v", err)
+	}
+	fake.Advance(30 * time.Minute)
+	select {
+	case <-expired:
+	case <-ctx.Done():
+		t.Fatalf("Grace period never ended")
+	}
+	expect(nil)
+	if data, _ := os.ReadFile(target); string(data) != "allow 1002\n" {
+		t.Errorf("Expected the template without the previous port, got %q", data)
+	}
+	if notified != 3 {
+		t.Errorf("Expected the unit to be told about the changed template, got %d notifications", notified)
+	}
+}
+
+func TestPreviousPortExpiredUnchangedTemplate(t *testing.T) {
+	notified := 0
+	origRunUnitAction := runUnitAction
+	t.Cleanup(func() { runUnitAction = origRunUnitAction })
+	runUnitAction = func(systemd.Action, string) error {
+		notified++
+		return nil
+	}
+
+	dir := t.TempDir()
+	source := filepath.Join(dir, "haproxy.tmpl")
+	os.WriteFile(source, []byte("bind :{{.Port}}\n"), 0644)
+	cfg := &config.Config{OutputFile: filepath.Join(dir, "port"), Templates: source + "=" + filepath.Join(dir, "haproxy.cfg"), NotifyUnit: "haproxy.service"}
+
+	bus := events.NewBus()
+	defer subscribeHandlers(bus, bus, cfg, nil)()
+	bus.Publish(events.Event{Type: events.PortChanged, Port: 1002, PreviousPort: 1001, PreviousPorts: []int{1001}})
+	bus.Publish(events.Event{Type: events.PreviousPortExpired, Port: 1002})
+	if notified != 1 {
+		t.Errorf("Expected the unit to be told only about the new port, got %d notifications", notified)
+	}
+}
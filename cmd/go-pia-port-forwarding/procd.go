@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/remote"
+)
+
+const (
+	// procdScriptPath is where the generated OpenWrt init script is installed
+	procdScriptPath = "/etc/init.d/go-pia-port-forwarding"
+	// rpcdPluginPath is the rpcd plugin that exposes the go-pia ubus object
+	rpcdPluginPath = "/usr/libexec/rpcd/go-pia"
+	// rpcdACLPath grants LuCI read access to the go-pia ubus object
+	rpcdACLPath = "/usr/share/rpcd/acl.d/go-pia.json"
+	// ubusObject is the name of the ubus object served by the rpcd plugin
+	ubusObject = "go-pia"
+)
+
+// shellSafe matches arguments that need no quoting in a POSIX shell
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// renderProcdScript renders an OpenWrt init script that runs exePath with cfg
+// in the foreground under procd. procd restarts it if it exits and passes its
+// output to logd, so the service neither daemonizes nor writes its own log.
+func renderProcdScript(exePath string, cfg *config.Config) string {
+	serviceCfg := *cfg
+	serviceCfg.Daemonize = false
+	serviceCfg.PIDFile = ""
+	serviceCfg.LogFile = ""
+
+	command := []string{shellQuote(exePath)}
+	for _, arg := range serviceCfg.Args() {
+		command = append(command, shellQuote(arg))
+	}
+
+	var b strings.Builder
+	b.WriteString("#!/bin/sh /etc/rc.common\n")
+	b.WriteString("# Generated by go-pia-port-forwarding service install --procd\n\n")
+	b.WriteString("USE_PROCD=1\n")
+	// Start after openvpn, which uses START=90
+	b.WriteString("START=95\n")
+	b.WriteString("STOP=10\n\n")
+	b.WriteString("start_service() {\n")
+	b.WriteString("\tprocd_open_instance\n")
+	fmt.Fprintf(&b, "\tprocd_set_param command %s\n", strings.Join(command, " \\\n\t\t"))
+	b.WriteString("\tprocd_set_param respawn 3600 30 0\n")
+	b.WriteString("\tprocd_set_param stdout 1\n")
+	b.WriteString("\tprocd_set_param stderr 1\n")
+	b.WriteString("\tprocd_close_instance\n")
+	b.WriteString("}\n")
+
+	return b.String()
+}
+
+// renderRpcdPlugin renders an rpcd plugin that serves the go-pia ubus object.
+// Its status method returns what the status command reports for cfg, so LuCI
+// and scripts can read the port with "ubus call go-pia status".
+func renderRpcdPlugin(exePath string, cfg *config.Config) string {
+	status := []string{shellQuote(exePath), "status", "--json"}
+	if cfg.StateFile != "" {
+		status = append(status, shellQuote("--state-file="+cfg.StateFile))
+	}
+	if cfg.OutputFile != "" {
+		status = append(status, shellQuote(cfg.OutputFile))
+	}
+
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n")
+	b.WriteString("# Generated by go-pia-port-forwarding service install --procd --ubus\n\n")
+	b.WriteString("case \"$1\" in\n")
+	b.WriteString("list)\n")
+	b.WriteString("\techo '{ \"status\": {} }'\n")
+	b.WriteString("\t;;\n")
+	b.WriteString("call)\n")
+	b.WriteString("\tcase \"$2\" in\n")
+	b.WriteString("\tstatus)\n")
+	fmt.Fprintf(&b, "\t\texec %s\n", strings.Join(status, " "))
+	b.WriteString("\t\t;;\n")
+	b.WriteString("\tesac\n")
+	b.WriteString("\t;;\n")
+	b.WriteString("esac\n")
+
+	return b.String()
+}
+
+// rpcdACL lets LuCI sessions call the status method of the go-pia ubus object
+const rpcdACL = `{
+	"go-pia": {
+		"description": "Read the forwarded PIA port",
+		"read": {
+			"ubus": {
+				"go-pia": [ "status" ]
+			}
+		}
+	}
+}
+`
+
+// shellQuote quotes arg for a POSIX shell unless it only has safe characters
+func shellQuote(arg string) string {
+	if shellSafe.MatchString(arg) {
+		return arg
+	}
+	return remote.Quote(arg)
+}
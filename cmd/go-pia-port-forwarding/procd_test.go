@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+)
+
+func TestRenderProcdScript(t *testing.T) {
+	cfg := &config.Config{
+		CredentialsFile:    "/etc/openvpn/pia.txt",
+		OpenVPNConfigFile:  "/etc/openvpn/pia.ovpn",
+		OutputFile:         "/tmp/go-pia/port.txt",
+		RefreshInterval:    15 * time.Minute,
+		ScriptTimeout:      30 * time.Second,
+		VPNRetryInterval:   time.Minute,
+		OnPortChangeScript: "/etc/go-pia/it's here.sh",
+		Daemonize:          true,
+		PIDFile:            "/var/run/go-pia.pid",
+		LogFile:            "/tmp/go-pia.log",
+		Ubus:               true,
+	}
+
+	script := renderProcdScript("/usr/bin/go-pia-port-forwarding", cfg)
+
+	for _, want := range []string{
+		"#!/bin/sh /etc/rc.common\n",
+		"USE_PROCD=1\nSTART=95\n",
+		"\tprocd_set_param command /usr/bin/go-pia-port-forwarding \\\n\t\t--credentials=/etc/openvpn/pia.txt",
+		`'--on-port-change=/etc/go-pia/it'\''s here.sh'`,
+		"--ubus",
+		"\tprocd_set_param respawn 3600 30 0\n",
+		"\tprocd_set_param stderr 1\n",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("Expected script to contain %q, got:\n%s", want, script)
+		}
+	}
+
+	// procd supervises the process and collects its output
+	for _, unwanted := range []string{"--daemonize", "--pid-file", "--log-file"} {
+		if strings.Contains(script, unwanted) {
+			t.Errorf("Expected script not to contain %q, got:\n%s", unwanted, script)
+		}
+	}
+}
+
+func TestRenderRpcdPlugin(t *testing.T) {
+	cfg := &config.Config{
+		OutputFile: "/tmp/go-pia/port.txt",
+		StateFile:  "/tmp/go-pia/state.json",
+	}
+
+	plugin := renderRpcdPlugin("/usr/bin/go-pia-port-forwarding", cfg)
+
+	for _, want := range []string{
+		"list)\n\techo '{ \"status\": {} }'\n",
+		"\tstatus)\n\t\texec /usr/bin/go-pia-port-forwarding status --json --state-file=/tmp/go-pia/state.json /tmp/go-pia/port.txt\n",
+	} {
+		if !strings.Contains(plugin, want) {
+			t.Errorf("Expected plugin to contain %q, got:\n%s", want, plugin)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{"--refresh-interval=15m0s", "--refresh-interval=15m0s"},
+		{"/tmp/port.txt", "/tmp/port.txt"},
+		{"/opt/my scripts/notify.sh", "'/opt/my scripts/notify.sh'"},
+		{"$HOME", "'$HOME'"},
+		{"it's", `'it'\''s'`},
+		{"", "''"},
+	}
+
+	for _, tc := range testCases {
+		if got := shellQuote(tc.input); got != tc.expected {
+			t.Errorf("shellQuote(%q) = %q, expected %q", tc.input, got, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/daemon"
+	"github.com/meschansky/go-pia/internal/events"
+	"github.com/meschansky/go-pia/internal/portforwarding"
+)
+
+// notableLogLine matches the log lines --quiet keeps: warnings and errors
+var notableLogLine = regexp.MustCompile(`(?i)warning|error|fail|can't|cannot|unable|invalid|rejected|refus|timed out|already running|not supported|killed`)
+
+// quietWriter passes on only log lines reporting warnings and errors. The log
+// package writes each line with a single Write.
+type quietWriter struct {
+	out io.Writer
+	// Set to pass on every line from then on, e.g. for a fatal error
+	all atomic.Bool
+}
+
+func (w *quietWriter) Write(p []byte) (int, error) {
+	if !w.all.Load() && !notableLogLine.Match(p) {
+		return len(p), nil
+	}
+	return w.out.Write(p)
+}
+
+// quietLog filters the log with --quiet, nil otherwise
+var quietLog *quietWriter
+
+// setupQuietLogging hides informational log lines from here on
+func setupQuietLogging() {
+	quietLog = &quietWriter{out: log.Writer()}
+	log.SetOutput(quietLog)
+}
+
+// startupSummary is the line --summary=json prints once the port is bound
+type startupSummary struct {
+	portforwarding.PortFile
+	Gateway  string `json:"gateway"`
+	Hostname string `json:"hostname"`
+	PID      int    `json:"pid"`
+}
+
+// formatSummary returns the line the summary format prints for the port bound in e
+func formatSummary(format string, e events.Event) (string, error) {
+	if format != config.SummaryJSON {
+		return strconv.Itoa(e.Port) + "\n", nil
+	}
+	data, err := json.Marshal(startupSummary{
+		PortFile: portforwarding.PortFile{Port: e.Port, ExpiresAt: e.ExpiresAt, RenewsAt: e.RenewsAt},
+		Gateway:  e.Gateway,
+		Hostname: e.Hostname,
+		PID:      os.Getpid(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode the summary: %w", err)
+	}
+	return string(data) + "\n", nil
+}
+
+// printSummary prints the summary for the port bound in e to stdout, or hands
+// it to the process that daemonized us to print, if a summary is configured
+func printSummary(cfg *config.Config, e events.Event) {
+	format := cfg.SummaryFormat()
+	if format == "" {
+		return
+	}
+	line, err := formatSummary(format, e)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return
+	}
+	if sent, err := daemon.Ready(line); err != nil {
+		log.Printf("Warning: %v", err)
+	} else if !sent {
+		fmt.Print(line)
+	}
+}
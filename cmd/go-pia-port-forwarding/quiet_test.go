@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/events"
+)
+
+func TestQuietWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := &quietWriter{out: &out}
+	logger := log.New(w, "", 0)
+
+	logger.Printf("Starting PIA port forwarding service")
+	logger.Printf("Successfully bound port %d", 12345)
+	logger.Printf("Warning: the token given with --token is over 24h0m0s old")
+	logger.Printf("Failed to bind port: connection refused")
+	logger.Printf("Gateway rejected the authentication token")
+	expected := "Warning: the token given with --token is over 24h0m0s old\nFailed to bind port: connection refused\nGateway rejected the authentication token\n"
+	if out.String() != expected {
+		t.Errorf("Expected only warnings and errors, got:\n%s", out.String())
+	}
+
+	// Fatal errors are never hidden, whatever they say
+	out.Reset()
+	w.all.Store(true)
+	logger.Printf("no route to 10.0.0.1")
+	if out.String() != "no route to 10.0.0.1\n" {
+		t.Errorf("Expected every line to be passed on, got %q", out.String())
+	}
+}
+
+func TestFormatSummary(t *testing.T) {
+	e := events.Event{
+		Type:      events.PortBound,
+		Port:      12345,
+		ExpiresAt: time.Date(2024, time.May, 1, 0, 0, 0, 0, time.UTC),
+		RenewsAt:  time.Date(2024, time.April, 30, 0, 0, 0, 0, time.UTC),
+		Gateway:   "10.0.0.1",
+		Hostname:  "server1",
+	}
+
+	line, err := formatSummary(config.SummaryPort, e)
+	if err != nil || line != "12345\n" {
+		t.Errorf("Expected just the port, got %q, %v", line, err)
+	}
+
+	line, err = formatSummary(config.SummaryJSON, e)
+	if err != nil {
+		t.Fatalf("Failed to format the summary: %v", err)
+	}
+	if strings.Count(line, "\n") != 1 || !strings.HasSuffix(line, "\n") {
+		t.Errorf("Expected a single line, got %q", line)
+	}
+	var summary map[string]any
+	if err := json.Unmarshal([]byte(line), &summary); err != nil {
+		t.Fatalf("Expected JSON, got %q: %v", line, err)
+	}
+	for key, expected := range map[string]any{
+		"port":       float64(12345),
+		"expires_at": "2024-05-01T00:00:00Z",
+		"renews_at":  "2024-04-30T00:00:00Z",
+		"gateway":    "10.0.0.1",
+		"hostname":   "server1",
+		"pid":        float64(os.Getpid()),
+	} {
+		if summary[key] != expected {
+			t.Errorf("Expected %s to be %v, got %v", key, expected, summary[key])
+		}
+	}
+}
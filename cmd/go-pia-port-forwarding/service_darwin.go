@@ -0,0 +1,96 @@
+//go:build darwin
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/meschansky/go-pia/internal/config"
+)
+
+// serviceActions lists the actions accepted by the service subcommand
+var serviceActions = []string{"install", "uninstall"}
+
+// runServiceCommand handles the "service" subcommand
+func runServiceCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s service install|uninstall [OPTIONS] OUTPUT_FILE", filepath.Base(os.Args[0]))
+	}
+
+	switch args[0] {
+	case "install":
+		return installService(args[1:])
+	case "uninstall":
+		return uninstallService()
+	default:
+		return fmt.Errorf("unknown service command: %s", args[0])
+	}
+}
+
+// installService writes a launch daemon plist for the current binary and loads it
+func installService(args []string) error {
+	exePath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to determine executable path: %w", err)
+	}
+	workDir, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to determine working directory: %w", err)
+	}
+
+	if _, err := os.Stat(launchdPlistPath); err == nil {
+		return fmt.Errorf("service already installed at %s", launchdPlistPath)
+	}
+
+	plist := renderLaunchdPlist(launchdJob{
+		Program:    exePath,
+		Args:       args,
+		WorkingDir: workDir,
+		Env:        serviceEnvironment(),
+		LogPath:    launchdLogPath,
+	})
+
+	// The plist may contain credentials passed through the environment
+	if err := os.WriteFile(launchdPlistPath, []byte(plist), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", launchdPlistPath, err)
+	}
+
+	if output, err := exec.Command("launchctl", "load", "-w", launchdPlistPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to load %s: %v: %s", launchdPlistPath, err, output)
+	}
+
+	log.Printf("Installed and loaded %s (logs: %s)", launchdPlistPath, launchdLogPath)
+	return nil
+}
+
+// uninstallService unloads and removes the launch daemon plist
+func uninstallService() error {
+	if _, err := os.Stat(launchdPlistPath); err != nil {
+		return fmt.Errorf("service is not installed (%s not found)", launchdPlistPath)
+	}
+
+	if output, err := exec.Command("launchctl", "unload", "-w", launchdPlistPath).CombinedOutput(); err != nil {
+		log.Printf("Warning: failed to unload %s: %v: %s", launchdPlistPath, err, output)
+	}
+
+	if err := os.Remove(launchdPlistPath); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", launchdPlistPath, err)
+	}
+
+	log.Printf("Uninstalled %s", launchdPlistPath)
+	return nil
+}
+
+// runningAsService reports whether a platform service manager started the process
+func runningAsService() bool {
+	return false
+}
+
+// runService runs under the platform service manager
+func runService(cfg *config.Config) {
+	os.Exit(run(cfg, setupSignalHandler()))
+}
@@ -0,0 +1,238 @@
+//go:build linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/piaca"
+)
+
+// serviceActions lists the actions accepted by the service subcommand
+var serviceActions = []string{"install", "uninstall"}
+
+// runServiceCommand handles the "service" subcommand
+func runServiceCommand(args []string) error {
+	usage := fmt.Errorf("usage: %s service install --systemd|--procd [--enable] [OPTIONS] OUTPUT_FILE | service uninstall", filepath.Base(os.Args[0]))
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "install":
+		return installService(args[1:])
+	case "uninstall":
+		return uninstallService()
+	default:
+		return usage
+	}
+}
+
+// installService renders a systemd unit or OpenWrt init script from the given
+// options. It's printed unless --enable is set, in which case it's installed
+// and started.
+func installService(args []string) error {
+	cfg := config.DefaultConfig()
+	fs := flag.NewFlagSet("service install", flag.ContinueOnError)
+	systemd := fs.Bool("systemd", false, "Generate a systemd unit")
+	procd := fs.Bool("procd", false, "Generate an OpenWrt procd init script")
+	enable := fs.Bool("enable", false, "Install the unit to "+systemdUnitPath+" or the init script to "+procdScriptPath+" and enable it")
+	if err := config.ParseFlags(fs, cfg, args); err != nil {
+		return err
+	}
+
+	if *systemd == *procd {
+		return fmt.Errorf("pass either --systemd or --procd")
+	}
+	// A token isn't renewed, so a service would stop working within a day
+	if cfg.Token != "" {
+		return fmt.Errorf("a service can't run with --token, it expires within 24 hours; install it with --credentials")
+	}
+	if cfg.CredentialsFile == "" {
+		return fmt.Errorf("credentials file path is required (set PIA_CREDENTIALS or --credentials)")
+	}
+	if cfg.OutputFile == "" {
+		return fmt.Errorf("output file path is required")
+	}
+
+	// The service doesn't run from the current directory, so pin every path
+	if caCertPath, err := resolveCACertPath(cfg); err == nil {
+		cfg.CACertFile = caCertPath
+	}
+	for _, path := range []*string{&cfg.CredentialsFile, &cfg.OpenVPNConfigFile, &cfg.CACertFile, &cfg.OutputFile, &cfg.LogFile, &cfg.OnPortChangeScript, &cfg.OnExitScript, &cfg.OnPortKeepFailedScript, &cfg.StateFile, &cfg.ServerListCache, &cfg.ServerListKeyFile, &cfg.ReadyFile, &cfg.ManualConnectionsDir, &cfg.PatchFile, &cfg.DDNSTokenFile, &cfg.NotifierTokenFile, &cfg.SMTPPasswordFile, &cfg.DebugDir} {
+		if *path == "" || (path == &cfg.CACertFile && (*path == piaca.Embedded || *path == piaca.Download)) {
+			continue
+		}
+		abs, err := filepath.Abs(*path)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", *path, err)
+		}
+		*path = abs
+	}
+
+	exePath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to determine executable path: %w", err)
+	}
+
+	if *procd {
+		return installProcdService(exePath, cfg, *enable)
+	}
+
+	unit := renderSystemdUnit(exePath, cfg)
+	if !*enable {
+		fmt.Print(unit)
+		return nil
+	}
+
+	if err := os.WriteFile(systemdUnitPath, []byte(unit), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", systemdUnitPath, err)
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	if err := systemctl("enable", "--now", systemdUnitName); err != nil {
+		return err
+	}
+
+	log.Printf("Installed and started %s", systemdUnitPath)
+	return nil
+}
+
+// installProcdService prints the OpenWrt init script, and the rpcd plugin if
+// ubus is enabled, or installs and starts them if enable is set
+func installProcdService(exePath string, cfg *config.Config, enable bool) error {
+	files := []serviceFile{{procdScriptPath, renderProcdScript(exePath, cfg), 0755}}
+	if cfg.Ubus {
+		files = append(files,
+			serviceFile{rpcdPluginPath, renderRpcdPlugin(exePath, cfg), 0755},
+			serviceFile{rpcdACLPath, rpcdACL, 0644},
+		)
+	}
+
+	if !enable {
+		for i, file := range files {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("# ==> %s <==\n%s", file.path, file.content)
+		}
+		return nil
+	}
+
+	for _, file := range files {
+		if err := os.WriteFile(file.path, []byte(file.content), file.mode); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file.path, err)
+		}
+		// WriteFile keeps the mode of an existing file
+		if err := os.Chmod(file.path, file.mode); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file.path, err)
+		}
+	}
+	if cfg.Ubus {
+		// rpcd only picks up new plugins when it's reloaded
+		if err := initScript("/etc/init.d/rpcd", "reload"); err != nil {
+			return err
+		}
+	}
+	if err := initScript(procdScriptPath, "enable"); err != nil {
+		return err
+	}
+	if err := initScript(procdScriptPath, "start"); err != nil {
+		return err
+	}
+
+	log.Printf("Installed and started %s", procdScriptPath)
+	return nil
+}
+
+// uninstallService stops, disables and removes the generated systemd unit or
+// OpenWrt init script
+func uninstallService() error {
+	if _, err := os.Stat(procdScriptPath); err == nil {
+		return uninstallProcdService()
+	}
+	if _, err := os.Stat(systemdUnitPath); err != nil {
+		return fmt.Errorf("service is not installed (%s not found)", systemdUnitPath)
+	}
+
+	if err := systemctl("disable", "--now", systemdUnitName); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	if err := os.Remove(systemdUnitPath); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", systemdUnitPath, err)
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+
+	log.Printf("Uninstalled %s", systemdUnitPath)
+	return nil
+}
+
+// uninstallProcdService stops, disables and removes the OpenWrt init script and
+// the rpcd plugin
+func uninstallProcdService() error {
+	if err := initScript(procdScriptPath, "stop"); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	if err := initScript(procdScriptPath, "disable"); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	if err := os.Remove(procdScriptPath); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", procdScriptPath, err)
+	}
+
+	if _, err := os.Stat(rpcdPluginPath); err == nil {
+		for _, path := range []string{rpcdPluginPath, rpcdACLPath} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove %s: %w", path, err)
+			}
+		}
+		if err := initScript("/etc/init.d/rpcd", "reload"); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+
+	log.Printf("Uninstalled %s", procdScriptPath)
+	return nil
+}
+
+// initScript runs an OpenWrt init script action, including its output in any error
+func initScript(path, action string) error {
+	if output, err := exec.Command(path, action).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s failed: %v: %s", path, action, err, output)
+	}
+	return nil
+}
+
+// serviceFile is a file written by service install
+type serviceFile struct {
+	path    string
+	content string
+	mode    os.FileMode
+}
+
+// systemctl runs a systemctl command, including its output in any error
+func systemctl(args ...string) error {
+	if output, err := exec.Command("systemctl", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("systemctl %v failed: %v: %s", args, err, output)
+	}
+	return nil
+}
+
+// runningAsService reports whether a platform service manager started the process
+func runningAsService() bool {
+	return false
+}
+
+// runService runs under the platform service manager
+func runService(cfg *config.Config) {
+	os.Exit(run(cfg, setupSignalHandler()))
+}
@@ -0,0 +1,29 @@
+//go:build !windows && !darwin && !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/meschansky/go-pia/internal/config"
+)
+
+// serviceActions lists the actions accepted by the service subcommand
+var serviceActions []string
+
+// runServiceCommand handles the "service" subcommand
+func runServiceCommand(args []string) error {
+	return fmt.Errorf("service management is not supported on %s", runtime.GOOS)
+}
+
+// runningAsService reports whether a platform service manager started the process
+func runningAsService() bool {
+	return false
+}
+
+// runService runs under the platform service manager
+func runService(cfg *config.Config) {
+	os.Exit(run(cfg, setupSignalHandler()))
+}
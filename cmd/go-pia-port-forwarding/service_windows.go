@@ -0,0 +1,259 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/redact"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	// serviceName is the name the service is registered under
+	serviceName = "go-pia-port-forwarding"
+	// serviceDisplayName is shown in the Services console
+	serviceDisplayName = "PIA Port Forwarding"
+	// serviceStopTimeout bounds how long a stop request waits for shutdown
+	serviceStopTimeout = 30 * time.Second
+)
+
+// serviceActions lists the actions accepted by the service subcommand
+var serviceActions = []string{"install", "uninstall", "start", "stop"}
+
+// runServiceCommand handles the "service" subcommand
+func runServiceCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s service install|uninstall|start|stop [OPTIONS] OUTPUT_FILE", filepath.Base(os.Args[0]))
+	}
+
+	switch args[0] {
+	case "install":
+		return installService(args[1:])
+	case "uninstall":
+		return uninstallService()
+	case "start":
+		return startService()
+	case "stop":
+		return stopService()
+	default:
+		return fmt.Errorf("unknown service command: %s", args[0])
+	}
+}
+
+// installService registers the service to start automatically with the given arguments
+func installService(args []string) error {
+	exePath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to determine executable path: %w", err)
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", serviceName)
+	}
+
+	s, err := m.CreateService(serviceName, exePath, mgr.Config{
+		DisplayName: serviceDisplayName,
+		Description: "Keeps a Private Internet Access forwarded port open",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("failed to create service: %w", err)
+	}
+	defer s.Close()
+
+	// Register the event log source so service logs show up in the Event Viewer
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("failed to register event log source: %w", err)
+	}
+
+	log.Printf("Installed service %s (%s %s)", serviceName, exePath, strings.Join(args, " "))
+	return nil
+}
+
+// uninstallService removes the service and its event log source
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("failed to delete service: %w", err)
+	}
+	if err := eventlog.Remove(serviceName); err != nil {
+		return fmt.Errorf("failed to remove event log source: %w", err)
+	}
+
+	log.Printf("Uninstalled service %s", serviceName)
+	return nil
+}
+
+// startService asks the service manager to start the service
+func startService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+
+	if err := s.Start(); err != nil {
+		return fmt.Errorf("failed to start service: %w", err)
+	}
+
+	log.Printf("Started service %s", serviceName)
+	return nil
+}
+
+// stopService asks the service manager to stop the service and waits for it to stop
+func stopService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return fmt.Errorf("failed to stop service: %w", err)
+	}
+
+	deadline := time.Now().Add(serviceStopTimeout)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for service to stop")
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return fmt.Errorf("failed to query service status: %w", err)
+		}
+	}
+
+	log.Printf("Stopped service %s", serviceName)
+	return nil
+}
+
+// runningAsService reports whether the Windows service manager started the process
+func runningAsService() bool {
+	isService, err := svc.IsWindowsService()
+	return err == nil && isService
+}
+
+// runService runs under the Windows service manager, logging to the event log
+func runService(cfg *config.Config) {
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		log.Fatalf("Failed to open event log: %v", err)
+	}
+	defer elog.Close()
+	log.SetOutput(redact.Default.Writer(eventLogWriter{elog}))
+
+	if err := svc.Run(serviceName, &serviceHandler{cfg: cfg}); err != nil {
+		elog.Error(1, fmt.Sprintf("Service failed: %v", err))
+	}
+}
+
+// serviceHandler bridges service manager requests to the port forwarding loop
+type serviceHandler struct {
+	cfg *config.Config
+}
+
+// Execute runs the service until the service manager asks it to stop
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	// Stop requests are delivered the same way as console signals
+	sigChan := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	var exitStatus int
+	go func() {
+		defer close(done)
+		exitStatus = run(h.cfg, sigChan)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case <-done:
+			return false, uint32(exitStatus)
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				if !stopRun(sigChan, done, serviceStopTimeout+h.cfg.ShutdownTimeout) {
+					return false, exitUnclean
+				}
+				return false, uint32(exitStatus)
+			}
+		}
+	}
+}
+
+// stopRun signals run to shut down and waits for it to return, giving up after
+// timeout. It reports whether run returned. Only one signal is sent,
+// since a second one makes run exit without cleaning up.
+func stopRun(sigChan chan os.Signal, done chan struct{}, timeout time.Duration) bool {
+	select {
+	case sigChan <- os.Interrupt:
+	default:
+	}
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		log.Printf("Timed out waiting for shutdown")
+		return false
+	}
+}
+
+// eventLogWriter sends log output to the Windows event log
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+// Write logs p as an informational event
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	if err := w.elog.Info(1, strings.TrimRight(string(p), "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
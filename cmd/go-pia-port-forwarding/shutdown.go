@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+)
+
+// scriptTracker keeps track of async scripts so shutdown can wait for them
+type scriptTracker struct {
+	wg sync.WaitGroup
+	// Canceled when shutdown stops waiting, killing scripts still running
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// scripts tracks the async scripts started by this process
+var scripts = newScriptTracker()
+
+// scriptStopGrace is how long an async script that timed out or is stopped at
+// shutdown has to exit after SIGTERM before it's killed
+var scriptStopGrace = 5 * time.Second
+
+// newScriptTracker returns a tracker with no scripts running
+func newScriptTracker() *scriptTracker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &scriptTracker{ctx: ctx, cancel: cancel}
+}
+
+// start registers a script and returns the context to run it with, along with
+// the function to call once it has exited
+func (s *scriptTracker) start(timeout time.Duration) (context.Context, func()) {
+	s.wg.Add(1)
+	ctx, cancel := context.WithTimeout(s.ctx, timeout)
+	return ctx, func() {
+		cancel()
+		s.wg.Done()
+	}
+}
+
+// drain waits up to timeout for running scripts to exit, then kills the rest.
+// It reports whether they all exited in time.
+func (s *scriptTracker) drain(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-clk.After(timeout):
+		// Stopping a script takes at most scriptStopGrace, so wait for that
+		// rather than exit and leave it running
+		s.cancel()
+		<-done
+		return false
+	}
+}
+
+// executeExitScript runs the exit script with the last bound port, or 0 if none
+// was bound, waiting for it to finish
+func executeExitScript(cfg *config.Config, port int, expiresAt, renewsAt time.Time) {
+	log.Printf("Executing exit script: %s", cfg.OnExitScript)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ScriptTimeout)
+	defer cancel()
+
+	cmd := execCommand(ctx, cfg.OnExitScript, strconv.Itoa(port), cfg.OutputFile)
+	cmd.Env = append(os.Environ(), scriptEnv(port, expiresAt, renewsAt)...)
+	started := time.Now()
+	output, err := cmd.CombinedOutput()
+	hooks.record(ctx, hookExit, started, err)
+	if err != nil {
+		log.Printf("Exit script failed: %v\nOutput: %s", err, string(output))
+	} else {
+		log.Printf("Exit script executed successfully\nOutput: %s", string(output))
+	}
+}
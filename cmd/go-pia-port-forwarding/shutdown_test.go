@@ -0,0 +1,144 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/events"
+)
+
+// useScriptTracker gives a test its own async script tracker
+func useScriptTracker(t *testing.T) {
+	t.Helper()
+	orig := scripts
+	scripts = newScriptTracker()
+	t.Cleanup(func() { scripts = orig })
+}
+
+// writeScript writes an executable shell script and returns its path
+func writeScript(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "script.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0755); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	return path
+}
+
+func TestDrainWaitsForAsyncScripts(t *testing.T) {
+	useScriptTracker(t)
+	out := filepath.Join(t.TempDir(), "out")
+	cfg := &config.Config{
+		OnPortChangeScript: writeScript(t, "sleep 0.2\necho \"$1\" > "+out+"\n"),
+		OutputFile:         filepath.Join(t.TempDir(), "port.txt"),
+		ScriptTimeout:      5 * time.Second,
+	}
+
+	executePortChangeScript(cfg, 12345, time.Time{}, time.Time{}, nil)
+	if !scripts.drain(5 * time.Second) {
+		t.Fatalf("Expected the script to finish within the shutdown timeout")
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Expected the script to have written its output: %v", err)
+	}
+	if strings.TrimSpace(string(data)) != "12345" {
+		t.Errorf("Expected port 12345, got %q", data)
+	}
+}
+
+func TestPortKeepFailedScript(t *testing.T) {
+	useScriptTracker(t)
+	out := filepath.Join(t.TempDir(), "out")
+	cfg := &config.Config{
+		OnPortKeepFailedScript: writeScript(t, "echo \"$1 $2 $PIA_PORT $PIA_PREVIOUS_PORT\" > "+out+"\n"),
+		KeepPortAttempts:       3,
+		ScriptTimeout:          5 * time.Second,
+	}
+
+	// The script runs in the background, so the new port isn't held up
+	bus := events.NewBus()
+	subscribeHandlers(bus, bus, cfg, nil)
+	bus.Publish(events.Event{Type: events.PortKeepFailed, Port: 54321, PreviousPort: 12345})
+	if !scripts.drain(5 * time.Second) {
+		t.Fatalf("Expected the script to finish")
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Expected the script to have written its output: %v", err)
+	}
+	if strings.TrimSpace(string(data)) != "54321 12345 54321 12345" {
+		t.Errorf("Expected the new and lost ports, got %q", data)
+	}
+}
+
+func TestDrainKillsScriptsAfterTimeout(t *testing.T) {
+	useScriptTracker(t)
+	fake := useFakeClock(t)
+	cfg := &config.Config{
+		OnPortChangeScript: writeScript(t, "exec sleep 30\n"),
+		OutputFile:         filepath.Join(t.TempDir(), "port.txt"),
+		ScriptTimeout:      time.Minute,
+	}
+	executePortChangeScript(cfg, 12345, time.Time{}, time.Time{}, nil)
+
+	drained := make(chan bool, 1)
+	go func() { drained <- scripts.drain(10 * time.Second) }()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := fake.BlockUntil(ctx, 1); err != nil {
+		t.Fatalf("Drain never started waiting: %v", err)
+	}
+	fake.Advance(10 * time.Second)
+
+	select {
+	case ok := <-drained:
+		if ok {
+			t.Errorf("Expected drain to report scripts still running")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Drain didn't give up after the timeout")
+	}
+
+	// The script is killed, so it stops being tracked
+	done := make(chan struct{})
+	go func() {
+		scripts.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the script to be killed")
+	}
+}
+
+func TestExecuteExitScript(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	expiresAt := time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+	cfg := &config.Config{
+		OnExitScript:  writeScript(t, "echo \"$1 $2 $PIA_PORT $PIA_EXPIRES_AT\" > "+out+"\n"),
+		OutputFile:    "/tmp/port.txt",
+		ScriptTimeout: 5 * time.Second,
+	}
+
+	executeExitScript(cfg, 12345, expiresAt, expiresAt.Add(-24*time.Hour))
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Expected the exit script to have run: %v", err)
+	}
+	expected := "12345 /tmp/port.txt 12345 2024-03-01T00:00:00Z"
+	if strings.TrimSpace(string(data)) != expected {
+		t.Errorf("Expected %q, got %q", expected, strings.TrimSpace(string(data)))
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/lock"
+	"github.com/meschansky/go-pia/internal/state"
+	"github.com/meschansky/go-pia/internal/udpprobe"
+)
+
+// runStatusCommand prints the state recorded by a running service
+func runStatusCommand(args []string) error {
+	cfg := config.DefaultConfig()
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	jsonOutput := fs.Bool("json", false, "Print the state as JSON")
+	if err := config.ParseFlags(fs, cfg, args); err != nil {
+		return err
+	}
+
+	if cfg.StateFile == "" && cfg.OutputFile == "" {
+		return fmt.Errorf("usage: %s status [--json] [--state-file PATH] [OUTPUT_FILE]", programName)
+	}
+
+	if stateFilePath(cfg) == "" {
+		return errors.New("a service streaming the port to stdout keeps its state only with --state-file, pass the same one")
+	}
+
+	st, err := state.Load(stateFilePath(cfg))
+	if err != nil {
+		return err
+	}
+
+	// The lock is held for as long as the service runs
+	if cfg.OutputFile != "" {
+		st.Running = lock.Held(instanceLockPath(cfg))
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(st)
+	}
+
+	writeStatus(os.Stdout, st, time.Now())
+	return nil
+}
+
+// writeStatus prints the state in human readable form
+func writeStatus(w io.Writer, st *state.State, now time.Time) {
+	status := "stopped"
+	if st.Running {
+		status = "running"
+	}
+	fmt.Fprintf(w, "Status:      %s (pid %d)\n", status, st.PID)
+
+	if st.Port != 0 {
+		fmt.Fprintf(w, "Port:        %d\n", st.Port)
+	} else {
+		fmt.Fprintf(w, "Port:        not assigned\n")
+	}
+	if len(st.PreviousPorts) > 0 {
+		fmt.Fprintf(w, "Previous:    %s (in their grace period)\n", joinPorts(st.PreviousPorts))
+	}
+	fmt.Fprintf(w, "Gateway:     %s (%s)\n", st.Gateway, st.Hostname)
+	if !st.ExpiresAt.IsZero() {
+		fmt.Fprintf(w, "Expires:     %s\n", st.ExpiresAt.Local().Format(time.RFC3339))
+	}
+	if !st.RenewsAt.IsZero() {
+		fmt.Fprintf(w, "Renews:      %s (in %s)\n", st.RenewsAt.Local().Format(time.RFC3339), st.RenewsAt.Sub(now).Round(time.Minute))
+	}
+	if !st.LastBindAt.IsZero() {
+		fmt.Fprintf(w, "Last bind:   %s (%s ago)\n", st.LastBindAt.Local().Format(time.RFC3339), now.Sub(st.LastBindAt).Round(time.Second))
+	} else {
+		fmt.Fprintf(w, "Last bind:   never\n")
+	}
+	fmt.Fprintf(w, "Failures:    %d consecutive, %d total\n", st.ConsecutiveFailures, st.BindFailures)
+	if st.LastError != "" {
+		fmt.Fprintf(w, "Last error:  %s\n", st.LastError)
+	}
+	if !st.TokenIssuedAt.IsZero() {
+		fmt.Fprintf(w, "Token:       obtained %s (%s ago)\n", st.TokenIssuedAt.Local().Format(time.RFC3339), now.Sub(st.TokenIssuedAt).Round(time.Second))
+	} else {
+		fmt.Fprintf(w, "Token:       none\n")
+	}
+	if !st.LastAuthAt.IsZero() {
+		fmt.Fprintf(w, "Last auth:   %s (%s ago)\n", st.LastAuthAt.Local().Format(time.RFC3339), now.Sub(st.LastAuthAt).Round(time.Second))
+	} else {
+		fmt.Fprintf(w, "Last auth:   never\n")
+	}
+	fmt.Fprintf(w, "Auth:        %d tokens obtained, %d failures\n", st.TokenRefreshes, st.TokenRefreshFailures)
+	if st.LastAuthError != "" {
+		fmt.Fprintf(w, "Auth error:  %s\n", st.LastAuthError)
+	}
+	if !st.LastUDPProbeAt.IsZero() {
+		fmt.Fprintf(w, "UDP:         %s (probed %s ago)\n", udpStatus(st), now.Sub(st.LastUDPProbeAt).Round(time.Second))
+	}
+	for _, name := range slices.Sorted(maps.Keys(st.Outputs)) {
+		fmt.Fprintf(w, "Output:      %s\n", outputStatus(name, st.Outputs[name], now))
+		if stats := st.Outputs[name]; stats.LastError != "" {
+			fmt.Fprintf(w, "Output error: %s\n", stats.LastError)
+		}
+	}
+	for _, endpoint := range slices.Sorted(maps.Keys(st.Latency)) {
+		fmt.Fprintf(w, "Latency:     %s\n", latencyStatus(endpoint, st.Latency[endpoint]))
+	}
+	for _, hook := range slices.Sorted(maps.Keys(st.Hooks)) {
+		fmt.Fprintf(w, "Hook:        %s\n", hookStatus(hook, st.Hooks[hook], now))
+		if stats := st.Hooks[hook]; stats.LastError != "" {
+			fmt.Fprintf(w, "Hook error:  %s\n", stats.LastError)
+		}
+	}
+	fmt.Fprintf(w, "Updated:     %s\n", st.UpdatedAt.Local().Format(time.RFC3339))
+}
+
+// hookStatus describes how a hook script has been doing
+func hookStatus(hook string, stats state.HookStats, now time.Time) string {
+	status := fmt.Sprintf("%s ran %d times, %d failed", hook, stats.Runs, stats.Failures)
+	if stats.Timeouts > 0 {
+		status += fmt.Sprintf(", %d timed out", stats.Timeouts)
+	}
+	if stats.ConsecutiveFailures > 0 {
+		status += fmt.Sprintf(" (%d in a row)", stats.ConsecutiveFailures)
+	}
+	return status + fmt.Sprintf(", last exited %d after %s (%s ago)", stats.LastExitCode, stats.LastDuration.Round(time.Millisecond), now.Sub(stats.LastRunAt).Round(time.Second))
+}
+
+// outputStatus describes how writing the port to an output has been going
+func outputStatus(name string, stats state.OutputStats, now time.Time) string {
+	status := fmt.Sprintf("%s written %d times, %d failed", name, stats.Writes, stats.Failures)
+	if stats.ConsecutiveFailures > 0 {
+		status += fmt.Sprintf(" (%d in a row)", stats.ConsecutiveFailures)
+	}
+	if stats.LastSuccessAt.IsZero() {
+		return status + ", never succeeded"
+	}
+	return status + fmt.Sprintf(", last succeeded %s ago", now.Sub(stats.LastSuccessAt).Round(time.Second))
+}
+
+// latencyStatus describes how long recent requests to a gateway endpoint took
+func latencyStatus(endpoint string, stats state.LatencyStats) string {
+	return fmt.Sprintf("%s p50 %s, p90 %s, p99 %s (last %d requests)", endpoint,
+		stats.P50.Round(time.Millisecond), stats.P90.Round(time.Millisecond), stats.P99.Round(time.Millisecond), stats.Samples)
+}
+
+// udpStatus describes the last UDP probe: whether datagrams reached the port,
+// and how many were lost
+func udpStatus(st *state.State) string {
+	if st.UDPProbeError != "" {
+		return "not probed: " + st.UDPProbeError
+	}
+	result := udpprobe.Result{Sent: st.UDPProbesSent, Received: st.UDPProbesReceived}
+	if !result.Open() {
+		return fmt.Sprintf("dead, none of %d datagrams arrived", result.Sent)
+	}
+	return fmt.Sprintf("open, %.0f%% loss (%d of %d datagrams arrived)", result.Loss()*100, result.Received, result.Sent)
+}
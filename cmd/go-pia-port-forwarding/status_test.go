@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/state"
+)
+
+func TestWriteStatus(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name     string
+		state    state.State
+		expected []string
+	}{
+		{
+			name: "Bound",
+			state: state.State{
+				PID:               1234,
+				Running:           true,
+				Port:              51234,
+				PreviousPorts:     []int{41234, 31234},
+				Gateway:           "10.8.110.1",
+				Hostname:          "frankfurt404",
+				ExpiresAt:         now.Add(48 * time.Hour),
+				RenewsAt:          now.Add(24 * time.Hour),
+				LastBindAt:        now.Add(-3 * time.Minute),
+				BindFailures:      2,
+				TokenIssuedAt:     now.Add(-2 * time.Hour),
+				LastAuthAt:        now.Add(-2 * time.Hour),
+				TokenRefreshes:    3,
+				LastUDPProbeAt:    now.Add(-time.Minute),
+				UDPProbesSent:     10,
+				UDPProbesReceived: 9,
+				Hooks: map[string]state.HookStats{
+					"port-change": {Runs: 4, LastRunAt: now.Add(-3 * time.Minute), LastDuration: 1200 * time.Millisecond},
+				},
+				Outputs: map[string]state.OutputStats{
+					"ddns":        {Writes: 3, Failures: 2, ConsecutiveFailures: 2, LastPort: 51234, LastWriteAt: now, LastSuccessAt: now.Add(-time.Hour), LastError: "rate limited"},
+					"output-file": {Writes: 4, LastPort: 51234, LastWriteAt: now.Add(-3 * time.Minute), LastSuccessAt: now.Add(-3 * time.Minute)},
+				},
+				Latency: map[string]state.LatencyStats{
+					"bindPort":     {Samples: 40, P50: 85 * time.Millisecond, P90: 140 * time.Millisecond, P99: 1234567 * time.Microsecond},
+					"getSignature": {Samples: 1, P50: 210 * time.Millisecond, P90: 210 * time.Millisecond, P99: 210 * time.Millisecond},
+				},
+				UpdatedAt: now,
+			},
+			expected: []string{"Hook:        port-change ran 4 times, 0 failed, last exited 0 after 1.2s (3m0s ago)", "running (pid 1234)", "Port:        51234\nPrevious:    41234,31234 (in their grace period)", "10.8.110.1 (frankfurt404)", "(in 24h0m0s)", "(3m0s ago)", "0 consecutive, 2 total", "(2h0m0s ago)", "3 tokens obtained, 0 failures", "UDP:         open, 10% loss (9 of 10 datagrams arrived) (probed 1m0s ago)", "Output:      ddns written 3 times, 2 failed (2 in a row), last succeeded 1h0m0s ago\nOutput error: rate limited\nOutput:      output-file written 4 times, 0 failed, last succeeded 3m0s ago", "Latency:     bindPort p50 85ms, p90 140ms, p99 1.235s (last 40 requests)\nLatency:     getSignature p50 210ms"},
+		},
+		{
+			name: "Failing",
+			state: state.State{
+				PID:                  1234,
+				Gateway:              "10.8.110.1",
+				BindFailures:         3,
+				ConsecutiveFailures:  3,
+				LastError:            "connection refused",
+				TokenRefreshFailures: 4,
+				LastAuthError:        "API error: Invalid credentials",
+				LastUDPProbeAt:       now,
+				UDPProbesSent:        10,
+				Hooks: map[string]state.HookStats{
+					"exit":        {Runs: 1, LastRunAt: now.Add(-time.Hour), LastDuration: 30 * time.Second},
+					"port-change": {Runs: 5, Failures: 3, Timeouts: 1, ConsecutiveFailures: 2, LastRunAt: now, LastDuration: 20 * time.Millisecond, LastExitCode: 127, LastError: "exit status 127"},
+				},
+				UpdatedAt: now,
+			},
+			expected: []string{"port-change ran 5 times, 3 failed, 1 timed out (2 in a row), last exited 127 after 20ms (0s ago)\nHook error:  exit status 127", "Hook:        exit ran 1 times", "stopped (pid 1234)", "not assigned", "Last bind:   never", "3 consecutive, 3 total", "Last error:  connection refused", "Token:       none", "Last auth:   never", "0 tokens obtained, 4 failures", "Auth error:  API error: Invalid credentials", "UDP:         dead, none of 10 datagrams arrived"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var b bytes.Buffer
+			writeStatus(&b, &tc.state, now)
+			for _, want := range tc.expected {
+				if !strings.Contains(b.String(), want) {
+					t.Errorf("Expected output to contain %q, got:\n%s", want, b.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/portforwarding"
+)
+
+// portStream prints the port as one line per change, for output file "-".
+// Each line goes out with a single Write, so a reader never sees part of one.
+type portStream struct {
+	out io.Writer
+	mu  sync.Mutex
+	// Line printed last, not printed again
+	last string
+}
+
+// stdoutStream streams the port to stdout, which Go doesn't buffer
+var stdoutStream = &portStream{out: os.Stdout}
+
+// write prints the port, or the port with its expiry and previous ports as
+// one line of JSON, unless that's the line printed last
+func (s *portStream) write(port int, expiresAt, renewsAt time.Time, previousPorts []int, format string) error {
+	line := strconv.Itoa(port) + "\n"
+	if format == config.OutputFormatJSON {
+		data, err := json.Marshal(portforwarding.PortFile{Port: port, ExpiresAt: expiresAt, RenewsAt: renewsAt, PreviousPorts: previousPorts})
+		if err != nil {
+			return fmt.Errorf("failed to encode port: %w", err)
+		}
+		line = string(data) + "\n"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if line == s.last {
+		return nil
+	}
+	if _, err := io.WriteString(s.out, line); err != nil {
+		return fmt.Errorf("failed to print port: %w", err)
+	}
+	s.last = line
+	return nil
+}
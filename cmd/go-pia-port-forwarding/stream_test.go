@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/portforwarding"
+)
+
+func TestPortStream(t *testing.T) {
+	var out bytes.Buffer
+	s := &portStream{out: &out}
+	expiresAt := time.Date(2024, time.March, 3, 12, 0, 0, 0, time.UTC)
+
+	// Rebinding the same port prints nothing new
+	for _, port := range []int{12345, 12345, 54321, 54321, 12345} {
+		if err := s.write(port, expiresAt, portforwarding.RenewsAt(expiresAt), nil, config.OutputFormatText); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if out.String() != "12345\n54321\n12345\n" {
+		t.Errorf("Expected one line per change, got %q", out.String())
+	}
+
+	// JSON lines change with the expiry and the previous ports too
+	out.Reset()
+	s = &portStream{out: &out}
+	s.write(12345, expiresAt, portforwarding.RenewsAt(expiresAt), nil, config.OutputFormatJSON)
+	s.write(12345, expiresAt, portforwarding.RenewsAt(expiresAt), nil, config.OutputFormatJSON)
+	s.write(12345, expiresAt.Add(24*time.Hour), portforwarding.RenewsAt(expiresAt.Add(24*time.Hour)), nil, config.OutputFormatJSON)
+	s.write(12345, expiresAt.Add(24*time.Hour), portforwarding.RenewsAt(expiresAt.Add(24*time.Hour)), []int{23456}, config.OutputFormatJSON)
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected three lines, got %q", out.String())
+	}
+	var decoded portforwarding.PortFile
+	if err := json.Unmarshal([]byte(lines[1]), &decoded); err != nil {
+		t.Fatalf("Expected a line of JSON, got %q: %v", lines[1], err)
+	}
+	if decoded.Port != 12345 || !decoded.ExpiresAt.Equal(expiresAt.Add(24*time.Hour)) || decoded.PreviousPorts != nil {
+		t.Errorf("Expected port 12345 with the new expiry, got %+v", decoded)
+	}
+	if err := json.Unmarshal([]byte(lines[2]), &decoded); err != nil || !slices.Equal(decoded.PreviousPorts, []int{23456}) {
+		t.Errorf("Expected previous port 23456, got %q (%v)", lines[2], err)
+	}
+}
+
+func TestStreamedOutputPaths(t *testing.T) {
+	cfg := &config.Config{OutputFile: config.StdoutOutput}
+	if path := stateFilePath(cfg); path != "" {
+		t.Errorf("Expected no state file by default, got %s", path)
+	}
+	if path := instanceLockPath(cfg); path != "" {
+		t.Errorf("Expected no instance lock by default, got %s", path)
+	}
+	if cache, err := serverListCache(cfg); err != nil || cache.Path != "" {
+		t.Errorf("Expected the server list not to be cached by default, got %+v (%v)", cache, err)
+	}
+
+	cfg.StateFile = "/run/go-pia/state.json"
+	if path := stateFilePath(cfg); path != cfg.StateFile {
+		t.Errorf("Expected the state file %s, got %s", cfg.StateFile, path)
+	}
+	if path := instanceLockPath(cfg); path != "/run/go-pia/state.json.lock" {
+		t.Errorf("Expected the lock next to the state file, got %s", path)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/portforwarding"
+	"github.com/meschansky/go-pia/internal/render"
+)
+
+const (
+	// systemdUnitName is the name of the generated unit
+	systemdUnitName = "go-pia-port-forwarding.service"
+	// systemdUnitPath is where the generated unit is installed
+	systemdUnitPath = "/etc/systemd/system/" + systemdUnitName
+	// credentialsCredential is the LoadCredential name of the PIA login file
+	credentialsCredential = "pia-credentials"
+	// openVPNConfigCredential is the LoadCredential name of the OpenVPN config
+	openVPNConfigCredential = "openvpn-config"
+	// ddnsTokenCredential is the LoadCredential name of the DDNS token file
+	ddnsTokenCredential = "ddns-token"
+	// notifierTokenCredential is the LoadCredential name of the notifier token file
+	notifierTokenCredential = "notifier-token"
+	// smtpPasswordCredential is the LoadCredential name of the SMTP password file
+	smtpPasswordCredential = "smtp-password"
+)
+
+// systemdHardening sandboxes the service when it only forwards the port
+const systemdHardening = `
+# Security hardening. Scripts run by --on-port-change are sandboxed as well
+DynamicUser=yes
+ProtectSystem=strict
+ProtectHome=yes
+PrivateTmp=yes
+PrivateDevices=yes
+NoNewPrivileges=yes
+ProtectKernelTunables=yes
+ProtectKernelModules=yes
+ProtectControlGroups=yes
+RestrictAddressFamilies=AF_UNIX AF_INET AF_INET6 AF_NETLINK
+RestrictNamespaces=yes
+RestrictRealtime=yes
+LockPersonality=yes
+MemoryDenyWriteExecute=yes
+SystemCallArchitectures=native
+`
+
+// systemdManagedVPNHardening sandboxes the service when it also runs the VPN,
+// which needs root's network privileges, the tun device and sysctls
+const systemdManagedVPNHardening = `
+# Security hardening. Managing the VPN needs root, so this is looser than usual
+ProtectSystem=full
+ProtectHome=yes
+PrivateTmp=yes
+DevicePolicy=closed
+DeviceAllow=/dev/net/tun rw
+NoNewPrivileges=yes
+ProtectControlGroups=yes
+RestrictRealtime=yes
+LockPersonality=yes
+SystemCallArchitectures=native
+`
+
+// renderSystemdUnit renders a hardened systemd unit that runs exePath with cfg.
+// The PIA login, OpenVPN config and the DDNS, notifier and SMTP secrets are
+// passed with LoadCredential so the dynamic user can read them without access
+// to the originals.
+func renderSystemdUnit(exePath string, cfg *config.Config) string {
+	openVPNUnit := "openvpn-client@" + strings.TrimSuffix(filepath.Base(cfg.OpenVPNConfigFile), filepath.Ext(cfg.OpenVPNConfigFile)) + ".service"
+
+	// Files handed over as credentials are referenced through %d, the credentials directory
+	serviceCfg := *cfg
+	serviceCfg.CredentialsFile = ""
+	serviceCfg.OpenVPNConfigFile = ""
+	serviceCfg.DDNSTokenFile = ""
+	serviceCfg.NotifierTokenFile = ""
+	serviceCfg.SMTPPasswordFile = ""
+	serviceCfg.Daemonize = false
+	serviceCfg.PIDFile = ""
+
+	execStart := []string{
+		systemdEscape(exePath),
+		"--credentials=%d/" + credentialsCredential,
+		"--openvpn-config=%d/" + openVPNConfigCredential,
+	}
+	if cfg.DDNSTokenFile != "" {
+		execStart = append(execStart, "--ddns-token-file=%d/"+ddnsTokenCredential)
+	}
+	if cfg.NotifierTokenFile != "" {
+		execStart = append(execStart, "--notifier-token-file=%d/"+notifierTokenCredential)
+	}
+	if cfg.SMTPPasswordFile != "" {
+		execStart = append(execStart, "--smtp-password-file=%d/"+smtpPasswordCredential)
+	}
+	for _, arg := range serviceCfg.Args() {
+		execStart = append(execStart, systemdEscape(arg))
+	}
+
+	var b strings.Builder
+	b.WriteString("# Generated by go-pia-port-forwarding service install --systemd\n")
+	b.WriteString("[Unit]\n")
+	b.WriteString("Description=PIA VPN Port Forwarding Service\n")
+	if cfg.ManageVPN == "" {
+		fmt.Fprintf(&b, "After=network-online.target %s\n", openVPNUnit)
+		fmt.Fprintf(&b, "Wants=network-online.target %s\n", openVPNUnit)
+	} else {
+		// We bring the VPN up ourselves, so its own unit must stay stopped
+		b.WriteString("After=network-online.target\n")
+		b.WriteString("Wants=network-online.target\n")
+		fmt.Fprintf(&b, "Conflicts=%s\n", openVPNUnit)
+	}
+	b.WriteString("\n[Service]\n")
+	b.WriteString("Type=simple\n")
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(execStart, " \\\n  "))
+	fmt.Fprintf(&b, "LoadCredential=%s:%s\n", credentialsCredential, cfg.CredentialsFile)
+	fmt.Fprintf(&b, "LoadCredential=%s:%s\n", openVPNConfigCredential, cfg.OpenVPNConfigFile)
+	if cfg.DDNSTokenFile != "" {
+		fmt.Fprintf(&b, "LoadCredential=%s:%s\n", ddnsTokenCredential, cfg.DDNSTokenFile)
+	}
+	if cfg.NotifierTokenFile != "" {
+		fmt.Fprintf(&b, "LoadCredential=%s:%s\n", notifierTokenCredential, cfg.NotifierTokenFile)
+	}
+	if cfg.SMTPPasswordFile != "" {
+		fmt.Fprintf(&b, "LoadCredential=%s:%s\n", smtpPasswordCredential, cfg.SMTPPasswordFile)
+	}
+	if cfg.ManageVPN == "" {
+		// Reloading hands over to the binary on disk, which then becomes the main process
+		b.WriteString("ExecReload=/bin/kill -HUP $MAINPID\n")
+		b.WriteString("NotifyAccess=all\n")
+	}
+	b.WriteString("Restart=on-failure\n")
+	b.WriteString("RestartSec=30\n")
+	// A bad configuration won't fix itself by restarting
+	fmt.Fprintf(&b, "RestartPreventExitStatus=%d\n", exitConfig)
+
+	// Give the dynamic user somewhere to write the port and log files
+	b.WriteString("\n# Writable locations; the output directory must be writable by the dynamic user\n")
+	for _, line := range writableDirectives(cfg.OutputFile, cfg.LogFile, cfg.StateFile, cfg.ServerListCache, cfg.ReadyFile, manualConnectionsFile(cfg)) {
+		b.WriteString(line + "\n")
+	}
+	// Other programs own these directories, so they're only opened up, never
+	// created or taken over as state directories
+	if cfg.PatchFile != "" {
+		fmt.Fprintf(&b, "ReadWritePaths=%s\n", systemdEscape(filepath.Dir(cfg.PatchFile)))
+	}
+	templates, _ := render.ParseTemplates(cfg.Templates)
+	for _, t := range templates {
+		fmt.Fprintf(&b, "ReadWritePaths=%s\n", systemdEscape(filepath.Dir(t.Target)))
+	}
+
+	if cfg.ManageVPN == "" {
+		b.WriteString(systemdHardening)
+	} else {
+		b.WriteString(systemdManagedVPNHardening)
+	}
+	b.WriteString("\n[Install]\nWantedBy=multi-user.target\n")
+
+	return b.String()
+}
+
+// writableDirectives returns the directives that make the directories of paths
+// writable. Directories under /run and /var/lib are created by systemd and owned
+// by the dynamic user; anything else is only opened up with ReadWritePaths.
+func writableDirectives(paths ...string) []string {
+	seen := make(map[string]bool)
+	var lines []string
+	add := func(line string) {
+		if !seen[line] {
+			seen[line] = true
+			lines = append(lines, line)
+		}
+	}
+
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		dir := filepath.Dir(path)
+
+		switch {
+		case strings.HasPrefix(dir, "/run/"):
+			add("RuntimeDirectory=" + strings.TrimPrefix(dir, "/run/"))
+			add("RuntimeDirectoryPreserve=yes")
+		case strings.HasPrefix(dir, "/var/run/"):
+			add("RuntimeDirectory=" + strings.TrimPrefix(dir, "/var/run/"))
+			add("RuntimeDirectoryPreserve=yes")
+		case strings.HasPrefix(dir, "/var/lib/"):
+			add("StateDirectory=" + strings.TrimPrefix(dir, "/var/lib/"))
+		default:
+			add("ReadWritePaths=" + systemdEscape(dir))
+		}
+	}
+
+	return lines
+}
+
+// systemdEscape quotes a command line argument for systemd, escaping specifiers
+// and variable expansion
+func systemdEscape(arg string) string {
+	arg = strings.ReplaceAll(arg, "%", "%%")
+	arg = strings.ReplaceAll(arg, "$", "$$")
+	if !strings.ContainsAny(arg, " \t\"'\\;") {
+		return arg
+	}
+
+	arg = strings.ReplaceAll(arg, `\`, `\\`)
+	arg = strings.ReplaceAll(arg, `"`, `\"`)
+	return `"` + arg + `"`
+}
+
+// manualConnectionsFile returns a file in the manual-connections directory, or
+// an empty string if it's disabled
+func manualConnectionsFile(cfg *config.Config) string {
+	if cfg.ManualConnectionsDir == "" {
+		return ""
+	}
+	return filepath.Join(cfg.ManualConnectionsDir, portforwarding.ManualConnectionsJSON)
+}
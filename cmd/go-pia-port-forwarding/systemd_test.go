@@ -0,0 +1,132 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+)
+
+func TestRenderSystemdUnit(t *testing.T) {
+	cfg := &config.Config{
+		CredentialsFile:      "/etc/openvpn/client/pia.txt",
+		OpenVPNConfigFile:    "/etc/openvpn/client/pia.conf",
+		CACertFile:           "/usr/local/etc/ca.rsa.4096.crt",
+		OutputFile:           "/run/go-pia/port.txt",
+		RefreshInterval:      15 * time.Minute,
+		ScriptTimeout:        30 * time.Second,
+		VPNRetryInterval:     time.Minute,
+		GatewayIdleTimeout:   20 * time.Minute,
+		GatewayMaxIdleConns:  2,
+		OnPortChangeScript:   "/opt/my scripts/notify.sh",
+		Daemonize:            true,
+		PIDFile:              "/run/go-pia.pid",
+		ManualConnectionsDir: "/opt/piavpn-manual",
+		PatchFile:            "/var/lib/transmission-daemon/settings.json",
+		Templates:            "/etc/go-pia/nginx.tmpl=/etc/nginx/stream.d/pia.conf",
+		DDNSProvider:         "duckdns",
+		DDNSName:             "mygame",
+		DDNSTokenFile:        "/etc/go-pia/duckdns-token",
+		Notifier:             "gotify",
+		NotifierURL:          "https://gotify.example.com",
+		NotifierTokenFile:    "/etc/go-pia/gotify-token",
+		SMTPServer:           "smtp.example.com:587",
+		SMTPFrom:             "pia@example.com",
+		SMTPTo:               "me@example.com",
+		SMTPUsername:         "pia@example.com",
+		SMTPPasswordFile:     "/etc/go-pia/smtp-password",
+	}
+
+	unit := renderSystemdUnit("/usr/local/bin/go-pia-port-forwarding", cfg)
+
+	for _, want := range []string{
+		"After=network-online.target openvpn-client@pia.service",
+		"ExecReload=/bin/kill -HUP $MAINPID",
+		"ExecStart=/usr/local/bin/go-pia-port-forwarding \\\n  --credentials=%d/pia-credentials",
+		"--openvpn-config=%d/openvpn-config",
+		`"--on-port-change=/opt/my scripts/notify.sh"`,
+		"LoadCredential=pia-credentials:/etc/openvpn/client/pia.txt",
+		"LoadCredential=openvpn-config:/etc/openvpn/client/pia.conf",
+		"--ddns-token-file=%d/ddns-token",
+		"LoadCredential=ddns-token:/etc/go-pia/duckdns-token",
+		"--notifier-token-file=%d/notifier-token",
+		"LoadCredential=notifier-token:/etc/go-pia/gotify-token",
+		"--smtp-password-file=%d/smtp-password",
+		"LoadCredential=smtp-password:/etc/go-pia/smtp-password",
+		"RuntimeDirectory=go-pia\nRuntimeDirectoryPreserve=yes",
+		"DynamicUser=yes",
+		"ProtectSystem=strict",
+		"  /run/go-pia/port.txt\n",
+		"ReadWritePaths=/opt/piavpn-manual",
+		"ReadWritePaths=/var/lib/transmission-daemon\n",
+		"ReadWritePaths=/etc/nginx/stream.d\n",
+	} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("Expected unit to contain %q, got:\n%s", want, unit)
+		}
+	}
+
+	// Options that conflict with systemd supervision are dropped
+	for _, unwanted := range []string{"--daemonize", "--pid-file", "/etc/openvpn/client/pia.txt \\", "--ddns-token-file=/etc", "--notifier-token-file=/etc", "--smtp-password-file=/etc"} {
+		if strings.Contains(unit, unwanted) {
+			t.Errorf("Expected unit not to contain %q, got:\n%s", unwanted, unit)
+		}
+	}
+}
+
+func TestRenderSystemdUnitManagedVPN(t *testing.T) {
+	cfg := &config.Config{
+		CredentialsFile:   "/etc/openvpn/client/pia.txt",
+		OpenVPNConfigFile: "/etc/openvpn/client/pia.conf",
+		OutputFile:        "/run/go-pia/port.txt",
+		ManageVPN:         config.ManageOpenVPN,
+	}
+
+	unit := renderSystemdUnit("/usr/local/bin/go-pia-port-forwarding", cfg)
+
+	for _, want := range []string{
+		"After=network-online.target\n",
+		"Conflicts=openvpn-client@pia.service",
+		"--manage-vpn=openvpn",
+		"DeviceAllow=/dev/net/tun rw",
+	} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("Expected unit to contain %q, got:\n%s", want, unit)
+		}
+	}
+	for _, unwanted := range []string{"DynamicUser=yes", "PrivateDevices=yes", "Wants=network-online.target openvpn-client", "ExecReload="} {
+		if strings.Contains(unit, unwanted) {
+			t.Errorf("Expected unit not to contain %q", unwanted)
+		}
+	}
+}
+
+func TestSystemdEscape(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{input: "/var/run/pia-port.txt", expected: "/var/run/pia-port.txt"},
+		{input: "--refresh-interval=15m0s", expected: "--refresh-interval=15m0s"},
+		{input: "/opt/my scripts/run.sh", expected: `"/opt/my scripts/run.sh"`},
+		{input: `say "hi"`, expected: `"say \"hi\""`},
+		{input: "100%", expected: "100%%"},
+		{input: "$HOME/port", expected: "$$HOME/port"},
+	}
+
+	for _, tc := range testCases {
+		if got := systemdEscape(tc.input); got != tc.expected {
+			t.Errorf("systemdEscape(%q) = %q, expected %q", tc.input, got, tc.expected)
+		}
+	}
+}
+
+func TestWritableDirectives(t *testing.T) {
+	lines := writableDirectives("/var/lib/go-pia/port.txt", "/srv/pia/go-pia.log", "/var/lib/go-pia/other.txt", "")
+	expected := []string{"StateDirectory=go-pia", "ReadWritePaths=/srv/pia"}
+
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected %v, got %v", expected, lines)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/auth"
+	"github.com/meschansky/go-pia/internal/redact"
+)
+
+// tokenSource hands out PIA authentication tokens: an auth.Client logging in
+// with the credentials, or a fixedToken given with --token
+type tokenSource interface {
+	GetToken() (string, error)
+	Invalidate()
+	Stats() auth.Stats
+}
+
+// errTokenRejected is returned for a --token the gateway has rejected
+var errTokenRejected = errors.New("PIA rejected the token given with --token, it has likely expired: restart with a new token, or use --credentials to have tokens renewed")
+
+// fixedToken is a token given with --token. It can't be renewed, so once the
+// gateway rejects it every request fails with errTokenRejected.
+type fixedToken struct {
+	token string
+	// Called when the token is rejected
+	onFailure func(err error)
+
+	mu       sync.Mutex
+	rejected bool
+	// When the token was given; when it was issued is unknown
+	givenAt time.Time
+	warned  bool
+}
+
+// newFixedToken returns a source that always hands out token
+func newFixedToken(token string) *fixedToken {
+	redact.Default.Add("token", token)
+	return &fixedToken{token: token, givenAt: clk.Now()}
+}
+
+// GetToken returns the token unless it has been rejected
+func (f *fixedToken) GetToken() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.rejected {
+		return "", errTokenRejected
+	}
+	// Only the gateway knows, so keep using it, but explain why it may stop working
+	if !f.warned && clk.Now().Sub(f.givenAt) >= auth.TokenValidityDuration {
+		f.warned = true
+		log.Printf("Warning: the token given with --token is over %s old and will be rejected once it expires", auth.TokenValidityDuration)
+	}
+	return f.token, nil
+}
+
+// Invalidate records that the gateway rejected the token
+func (f *fixedToken) Invalidate() {
+	f.mu.Lock()
+	first := !f.rejected
+	f.rejected = true
+	f.mu.Unlock()
+
+	if first {
+		log.Printf("%v", errTokenRejected)
+		if f.onFailure != nil {
+			f.onFailure(errTokenRejected)
+		}
+	}
+}
+
+// Stats reports the token as obtained when it was given, until it's rejected
+func (f *fixedToken) Stats() auth.Stats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.rejected {
+		return auth.Stats{Failures: 1, LastError: errTokenRejected.Error()}
+	}
+	return auth.Stats{TokenIssuedAt: f.givenAt, LastSuccessAt: f.givenAt}
+}
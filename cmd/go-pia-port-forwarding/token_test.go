@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/auth"
+)
+
+func TestFixedToken(t *testing.T) {
+	fake := useFakeClock(t)
+	var failures []error
+	tokens := newFixedToken("abc123")
+	tokens.onFailure = func(err error) { failures = append(failures, err) }
+
+	if token, err := tokens.GetToken(); token != "abc123" || err != nil {
+		t.Fatalf("Expected the given token, got %q, %v", token, err)
+	}
+	if stats := tokens.Stats(); !stats.TokenIssuedAt.Equal(fake.Now()) || stats.Failures != 0 {
+		t.Errorf("Expected the token to count as obtained at startup, got %+v", stats)
+	}
+
+	// An old token is still used, the gateway decides whether it has expired
+	fake.Advance(auth.TokenValidityDuration + time.Hour)
+	if token, err := tokens.GetToken(); token != "abc123" || err != nil {
+		t.Fatalf("Expected the old token, got %q, %v", token, err)
+	}
+
+	// Once rejected it can't be renewed
+	tokens.Invalidate()
+	tokens.Invalidate()
+	if _, err := tokens.GetToken(); !errors.Is(err, errTokenRejected) {
+		t.Errorf("Expected errTokenRejected, got %v", err)
+	}
+	if len(failures) != 1 {
+		t.Errorf("Expected the rejection to be reported once, got %v", failures)
+	}
+	if stats := tokens.Stats(); stats.LastError == "" || !stats.TokenIssuedAt.IsZero() {
+		t.Errorf("Expected the rejection in the stats, got %+v", stats)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/tunnel"
+)
+
+const (
+	// defaultWireGuardInterface names the managed WireGuard interface unless --interface is set
+	defaultWireGuardInterface = "pia"
+	// windowsManagementAddr is where the managed OpenVPN's management interface
+	// listens on Windows, which OpenVPN doesn't support unix sockets on
+	windowsManagementAddr = "127.0.0.1:7505"
+)
+
+// managedVPN is the VPN go-pia runs itself with --manage-vpn, or nil
+var managedVPN tunnel.Tunnel
+
+// startManagedVPN brings up the VPN if go-pia manages it, and keeps it up in
+// the background. It's taken down when ctx is canceled or the process exits.
+func startManagedVPN(ctx context.Context, cfg *config.Config, tokens tokenSource, caCertPath string) error {
+	switch cfg.ManageVPN {
+	case "":
+		return nil
+	case config.ManageOpenVPN:
+		addr, err := openVPNManagementAddr(cfg.RuntimeDir)
+		if err != nil {
+			return err
+		}
+		managedVPN = tunnel.NewOpenVPN(cfg.OpenVPNConfigFile, cfg.CredentialsFile, addr)
+	case config.ManageWireGuard:
+		iface := cfg.Interface
+		if iface == "" {
+			iface = defaultWireGuardInterface
+		}
+		wireGuard := tunnel.NewWireGuard(cfg.WireGuardServer, cfg.WireGuardHostname, iface, caCertPath, tokens.GetToken)
+		wireGuard.TempDir = cfg.RuntimeDir
+		managedVPN = wireGuard
+	default:
+		return fmt.Errorf("unknown managed VPN %q", cfg.ManageVPN)
+	}
+	log.Printf("Managing the VPN with %s", cfg.ManageVPN)
+
+	// Fatal errors exit through the cleanups, which must still take the VPN down
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := managedVPN.Run(ctx); err != nil {
+			log.Printf("Managed VPN stopped: %v", err)
+		}
+	}()
+	addCleanup(func() {
+		cancel()
+		<-done
+	})
+	return nil
+}
+
+// openVPNManagementAddr returns where the managed OpenVPN's management
+// interface listens: a socket in a directory only we can reach, created under
+// parent or the system temporary directory if it's empty
+func openVPNManagementAddr(parent string) (string, error) {
+	if runtime.GOOS == "windows" {
+		return windowsManagementAddr, nil
+	}
+
+	dir, err := os.MkdirTemp(parent, "go-pia-openvpn")
+	if err != nil {
+		return "", fmt.Errorf("failed to create OpenVPN management directory: %w", err)
+	}
+	addCleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "management.sock"), nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/portforwarding"
+	"github.com/meschansky/go-pia/internal/remote"
+)
+
+const (
+	// ubusPortEvent is sent on the ubus whenever the port changes
+	ubusPortEvent = ubusObject + ".port"
+	// ubusTimeout bounds how long sending an event may take
+	ubusTimeout = 10 * time.Second
+)
+
+// sendUbusPortEvent sends the port, its expiry and the previous ports still in
+// their grace period as a go-pia.port ubus event, on the remote host if one
+// is configured. Firewall includes and hotplug scripts can wait for it with
+// "ubus listen go-pia.port".
+func sendUbusPortEvent(cfg *config.Config, port int, expiresAt, renewsAt time.Time, previousPorts []int) error {
+	data, err := portforwarding.EncodePortJSON(port, expiresAt, renewsAt, previousPorts)
+	if err != nil {
+		return err
+	}
+	message := string(bytes.TrimSpace(data))
+
+	if cfg.RemoteHost != "" {
+		host, err := remote.Parse(cfg.RemoteHost)
+		if err != nil {
+			return err
+		}
+		if _, err := host.Output(strings.Join([]string{"ubus", "send", ubusPortEvent, remote.Quote(message)}, " ")); err != nil {
+			return fmt.Errorf("failed to send ubus event on %s: %w", host, err)
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ubusTimeout)
+	defer cancel()
+	if output, err := execCommand(ctx, "ubus", "send", ubusPortEvent, message).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to send ubus event: %v: %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/events"
+	"github.com/meschansky/go-pia/internal/portforwarding"
+)
+
+func TestSendUbusPortEvent(t *testing.T) {
+	var sent [][]string
+	origExecCommand := execCommand
+	t.Cleanup(func() { execCommand = origExecCommand })
+	execCommand = func(ctx context.Context, command string, args ...string) *exec.Cmd {
+		sent = append(sent, append([]string{command}, args...))
+		return exec.CommandContext(ctx, "true")
+	}
+
+	// Only new ports are sent
+	cfg := &config.Config{Ubus: true}
+	bus := events.NewBus()
+	subscribeHandlers(bus, bus, cfg, nil)
+	expiresAt := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	renewsAt := portforwarding.RenewsAt(expiresAt)
+	bus.Publish(events.Event{Type: events.PortBound, Port: 12345, ExpiresAt: expiresAt, RenewsAt: renewsAt})
+	bus.Publish(events.Event{Type: events.PortChanged, Port: 12345, ExpiresAt: expiresAt, RenewsAt: renewsAt})
+
+	if len(sent) != 1 {
+		t.Fatalf("Expected one ubus command, got %q", sent)
+	}
+	if expected := []string{"ubus", "send", "go-pia.port"}; !reflect.DeepEqual(sent[0][:3], expected) {
+		t.Errorf("Expected %q, got %q", expected, sent[0])
+	}
+
+	var message portforwarding.PortFile
+	if err := json.Unmarshal([]byte(sent[0][3]), &message); err != nil {
+		t.Fatalf("Failed to decode event %q: %v", sent[0][3], err)
+	}
+	if message.Port != 12345 || !message.ExpiresAt.Equal(expiresAt) || !message.RenewsAt.Equal(renewsAt) {
+		t.Errorf("Unexpected event %+v", message)
+	}
+
+	// Failures include what ubus printed
+	execCommand = func(ctx context.Context, command string, args ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "sh", "-c", "echo 'Failed to connect to ubus' >&2; exit 1")
+	}
+	if err := sendUbusPortEvent(cfg, 12345, expiresAt, renewsAt, nil); err == nil || !strings.Contains(err.Error(), "Failed to connect to ubus") {
+		t.Errorf("Expected the ubus error, got %v", err)
+	}
+}
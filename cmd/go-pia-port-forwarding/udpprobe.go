@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/events"
+	"github.com/meschansky/go-pia/internal/udpprobe"
+)
+
+// udpProber probes the forwarded port over UDP, separately from binding it
+type udpProber struct {
+	cfg    *config.Config
+	bus    *events.Bus
+	prober *udpprobe.Prober
+
+	mu sync.Mutex
+	// Port last bound, 0 until one is
+	port int
+	// Signaled when the port changes, so the new one is probed right away
+	changed chan struct{}
+}
+
+// startUDPProbe probes the port every cfg.UDPProbeInterval and whenever it
+// changes, publishing each result as a UDPProbed event
+func startUDPProbe(ctx context.Context, cfg *config.Config, bus *events.Bus) {
+	p := &udpProber{
+		cfg:     cfg,
+		bus:     bus,
+		prober:  udpprobe.NewProber(cfg.UDPProbe),
+		changed: make(chan struct{}, 1),
+	}
+	bus.Subscribe(func(e events.Event) {
+		p.mu.Lock()
+		p.port = e.Port
+		p.mu.Unlock()
+		if e.Type == events.PortChanged {
+			select {
+			case p.changed <- struct{}{}:
+			default:
+			}
+		}
+	}, events.PortBound, events.PortChanged)
+	go p.run(ctx)
+}
+
+// run probes until ctx is done
+func (p *udpProber) run(ctx context.Context) {
+	ticker := clk.NewTicker(p.cfg.UDPProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		case <-p.changed:
+		}
+
+		p.mu.Lock()
+		port := p.port
+		p.mu.Unlock()
+		if port != 0 {
+			p.probe(ctx, port)
+		}
+	}
+}
+
+// probe runs one probe of port and publishes the result
+func (p *udpProber) probe(ctx context.Context, port int) {
+	result, err := p.prober.Probe(ctx, port)
+	if ctx.Err() != nil {
+		return
+	}
+
+	e := events.Event{Type: events.UDPProbed, Port: port, ProbesSent: result.Sent, ProbesReceived: result.Received}
+	switch {
+	case errors.Is(err, udpprobe.ErrPortInUse):
+		// The game server has the port, which is where the datagrams should go
+		e.Error = fmt.Sprintf("port %d is in use by another program", port)
+	case err != nil:
+		log.Printf("UDP probe of port %d failed: %v", port, err)
+		e.Error = err.Error()
+	case !result.Open():
+		log.Printf("Warning: UDP port %d looks dead, none of %d datagrams from %s arrived", port, result.Sent, p.cfg.UDPProbe)
+	case result.Loss() > 0:
+		log.Printf("UDP probe of port %d lost %.0f%% of datagrams", port, result.Loss()*100)
+	}
+	p.bus.Publish(e)
+}
+
+// runUDPReflectorCommand answers UDP probes, for running on a host outside the VPN
+func runUDPReflectorCommand(args []string) error {
+	fs := flag.NewFlagSet("udp-reflector", flag.ContinueOnError)
+	listen := fs.String("listen", ":"+udpprobe.DefaultPort, "Address to answer probes on")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	conn, err := net.ListenPacket("udp", *listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	defer conn.Close()
+	log.Printf("Answering UDP probes on %s", conn.LocalAddr())
+	return udpprobe.Serve(conn)
+}
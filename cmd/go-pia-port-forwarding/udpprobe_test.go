@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/events"
+	"github.com/meschansky/go-pia/internal/udpprobe"
+)
+
+func TestUDPProbe(t *testing.T) {
+	useFakeClock(t)
+	reflector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer reflector.Close()
+	go udpprobe.Serve(reflector)
+
+	// Find a port nothing listens on to stand in for the forwarded one
+	free, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	port := free.LocalAddr().(*net.UDPAddr).Port
+	free.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bus := events.NewBus()
+	probed := make(chan events.Event, 1)
+	bus.Subscribe(func(e events.Event) { probed <- e }, events.UDPProbed)
+	startUDPProbe(ctx, &config.Config{UDPProbe: reflector.LocalAddr().String(), UDPProbeInterval: time.Hour}, bus)
+
+	// A new port is probed without waiting for the interval
+	bus.Publish(events.Event{Type: events.PortChanged, Port: port})
+	select {
+	case e := <-probed:
+		if e.Port != port || e.Error != "" || e.ProbesSent == 0 || e.ProbesReceived != e.ProbesSent {
+			t.Errorf("Expected every datagram to arrive, got %+v", e)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected a probe after the port changed")
+	}
+}
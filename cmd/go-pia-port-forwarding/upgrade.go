@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/daemon"
+	"github.com/meschansky/go-pia/internal/lock"
+	"github.com/meschansky/go-pia/internal/portforwarding"
+)
+
+// upgradeEnv marks a process started by a running service to take over from it
+const upgradeEnv = "GO_PIA_UPGRADE"
+
+// Descriptors a service passes to the version taking over from it, after
+// stdin, stdout and stderr
+const (
+	// The handoff, as JSON
+	handoffFD = 3
+	// Written to once the new version has bound the port
+	upgradeReadyFD = 4
+	// The instance lock
+	upgradeLockFD = 5
+	// The metrics listener, if metrics are served
+	upgradeMetricsFD = 6
+)
+
+// upgradeTimeout bounds how long a service waits for the new version to bind
+// the port before giving up on the upgrade and carrying on itself
+var upgradeTimeout = time.Minute
+
+// handoff is what a running service passes to the version taking over from
+// it, so the port stays bound without a new signature or login
+type handoff struct {
+	// Token obtained with the credentials, empty with --token
+	Token         string    `json:"token,omitempty"`
+	TokenIssuedAt time.Time `json:"token_issued_at,omitzero"`
+	// Gateway the signature was obtained from
+	Gateway  string `json:"gateway"`
+	Hostname string `json:"hostname"`
+	// Signature last bound
+	Port      int       `json:"port"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Payload   string    `json:"payload"`
+	Signature string    `json:"signature"`
+	// When the signature was obtained, which the renewal may be measured from
+	ObtainedAt time.Time `json:"obtained_at,omitzero"`
+	// Whether the metrics listener is passed along
+	Metrics bool `json:"metrics,omitempty"`
+}
+
+// newHandoff returns the handoff for the port last bound, with the current
+// token unless a fixed one was given
+func newHandoff(cfg *config.Config, bound portforwarding.PortStatus, tokens tokenSource) handoff {
+	h := handoff{
+		Gateway:    bound.Gateway,
+		Hostname:   bound.Hostname,
+		Port:       bound.Port,
+		ExpiresAt:  bound.ExpiresAt,
+		Payload:    bound.Payload,
+		Signature:  bound.Signature,
+		ObtainedAt: bound.ObtainedAt,
+		Metrics:    cfg.MetricsAddr != "",
+	}
+	if cfg.Token == "" {
+		if issuedAt := tokens.Stats().TokenIssuedAt; !issuedAt.IsZero() {
+			if token, err := tokens.GetToken(); err == nil {
+				h.Token, h.TokenIssuedAt = token, issuedAt
+			}
+		}
+	}
+	return h
+}
+
+// resume returns the signature to keep bound, if it's from gateway
+func (h *handoff) resume(gateway string) *portforwarding.PortForwardingInfo {
+	if h.Gateway != gateway {
+		log.Printf("The gateway changed from %s to %s during the upgrade, requesting a new signature", h.Gateway, gateway)
+		return nil
+	}
+	return &portforwarding.PortForwardingInfo{
+		Port:       h.Port,
+		ExpiresAt:  h.ExpiresAt,
+		Payload:    h.Payload,
+		Signature:  h.Signature,
+		ObtainedAt: h.ObtainedAt,
+	}
+}
+
+// takeover is what this process inherited from the version it replaces
+type takeover struct {
+	handoff
+	lock *lock.Lock
+	// The metrics listener, nil if metrics aren't served
+	metrics net.Listener
+	// Closed once written to by done
+	ready *os.File
+}
+
+// takeOver picks up what the version this process replaces passed down, or
+// returns nil if it wasn't started by an upgrade
+func takeOver(cfg *config.Config) (*takeover, error) {
+	if os.Getenv(upgradeEnv) != "1" {
+		return nil, nil
+	}
+	// Scripts and later upgrades mustn't think they're taking over
+	os.Unsetenv(upgradeEnv)
+
+	in := inheritFile(handoffFD, "handoff")
+	defer in.Close()
+	t := &takeover{ready: inheritFile(upgradeReadyFD, "upgrade-ready")}
+	if err := json.NewDecoder(in).Decode(&t.handoff); err != nil {
+		return nil, fmt.Errorf("failed to read the handoff: %w", err)
+	}
+	t.lock = lock.Inherit(instanceLockPath(cfg), inheritFile(upgradeLockFD, "lock"))
+	if t.Metrics {
+		file := inheritFile(upgradeMetricsFD, "metrics")
+		defer file.Close()
+		listener, err := net.FileListener(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inherit the metrics listener: %w", err)
+		}
+		t.metrics = listener
+	}
+	log.Printf("Taking over port %d from the previous version", t.Port)
+	return t, nil
+}
+
+// done tells the previous version this one has bound the port, so it can hand
+// over the lock and exit
+func (t *takeover) done(cfg *config.Config) {
+	if cfg.PIDFile != "" {
+		if err := daemon.WritePIDFile(cfg.PIDFile); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	if _, err := t.ready.Write([]byte{1}); err != nil {
+		log.Printf("Warning: failed to tell the previous version the upgrade is done: %v", err)
+	}
+	t.ready.Close()
+}
+
+// upgrade starts the binary on disk to take over the port last bound from
+// this process, and reports whether it did. On failure this process carries
+// on as before.
+func upgrade(cfg *config.Config, bound portforwarding.PortStatus, tokens tokenSource, instanceLock *lock.Lock, metricsListener net.Listener) bool {
+	if cfg.ManageVPN != "" {
+		log.Printf("Can't upgrade without downtime while managing the VPN, restart the service instead")
+		return false
+	}
+	if cfg.StreamsOutput() {
+		log.Printf("Can't upgrade without downtime while streaming the port to stdout, restart instead")
+		return false
+	}
+	if bound.Port == 0 {
+		log.Printf("Can't upgrade before a port is bound, restart the service instead")
+		return false
+	}
+
+	log.Printf("Upgrade requested, starting the new version to take over port %d", bound.Port)
+	pid, err := handOver(newHandoff(cfg, bound, tokens), instanceLock, metricsListener)
+	if err != nil {
+		log.Printf("Upgrade failed, carrying on: %v", err)
+		return false
+	}
+
+	// The new version is the service's main process from now on
+	if _, err := daemon.Notify("MAINPID=" + strconv.Itoa(pid)); err != nil {
+		log.Printf("Warning: failed to notify systemd of the new main process: %v", err)
+	}
+	if err := instanceLock.HandOver(pid); err != nil {
+		log.Printf("Warning: failed to hand over the instance lock: %v", err)
+	}
+	log.Printf("Handed over to pid %d, exiting", pid)
+	return true
+}
+
+// writeHandoff sends h to the new version and closes w
+func writeHandoff(w io.WriteCloser, h handoff) error {
+	err := json.NewEncoder(w).Encode(h)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// runUpgradeCommand asks the service running for an output file to hand over
+// to the binary on disk, and waits for the new version to take over
+func runUpgradeCommand(args []string) error {
+	cfg := config.DefaultConfig()
+	fs := flag.NewFlagSet("upgrade", flag.ContinueOnError)
+	if err := config.ParseFlags(fs, cfg, args); err != nil {
+		return err
+	}
+
+	if cfg.OutputFile == "" {
+		return fmt.Errorf("usage: %s upgrade OUTPUT_FILE", programName)
+	}
+	if cfg.StreamsOutput() {
+		return errors.New("a service streaming the port to stdout can't be found to upgrade, restart it instead")
+	}
+
+	// The lock file names the running service, and then the one taking over
+	lockPath := lock.PathFor(cfg.OutputFile)
+	pid := lock.HolderPID(lockPath)
+	if pid == 0 {
+		return fmt.Errorf("no service is running for %s", cfg.OutputFile)
+	}
+	if err := sendUpgrade(pid); err != nil {
+		return err
+	}
+	fmt.Printf("Requested an upgrade from pid %d\n", pid)
+
+	deadline := time.Now().Add(upgradeTimeout + 10*time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(250 * time.Millisecond)
+		switch holder := lock.HolderPID(lockPath); holder {
+		case pid:
+		case 0:
+			return fmt.Errorf("the service for %s stopped during the upgrade", cfg.OutputFile)
+		default:
+			fmt.Printf("Upgraded, pid %d has taken over\n", holder)
+			return nil
+		}
+	}
+	return fmt.Errorf("pid %d is still running the old version, see its log for why the upgrade failed", pid)
+}
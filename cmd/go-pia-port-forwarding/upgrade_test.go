@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/auth"
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/portforwarding"
+)
+
+func TestNewHandoff(t *testing.T) {
+	expiresAt := time.Date(2024, time.May, 1, 0, 0, 0, 0, time.UTC)
+	bound := portforwarding.PortStatus{
+		Port:      12345,
+		ExpiresAt: expiresAt,
+		Payload:   "payload",
+		Signature: "signature",
+		Gateway:   "10.0.0.1",
+		Hostname:  "server1",
+	}
+	issuedAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	tokens := auth.NewClient("user", "pass")
+	tokens.SetToken("handed-over", issuedAt)
+
+	cfg := &config.Config{MetricsAddr: ":9090"}
+	h := newHandoff(cfg, bound, tokens)
+	if h.Port != 12345 || h.Signature != "signature" || h.Gateway != "10.0.0.1" || !h.Metrics {
+		t.Errorf("Expected the bound signature and metrics listener to be handed over, got %+v", h)
+	}
+	if h.Token != "handed-over" || !h.TokenIssuedAt.Equal(issuedAt) {
+		t.Errorf("Expected the token to be handed over, got %q issued at %s", h.Token, h.TokenIssuedAt)
+	}
+
+	// A token given with --token is given to the new version the same way
+	cfg = &config.Config{Token: "fixed"}
+	if h := newHandoff(cfg, bound, newFixedToken("fixed")); h.Token != "" || h.Metrics {
+		t.Errorf("Expected neither token nor metrics listener to be handed over, got %+v", h)
+	}
+
+	// The signature is only resumed on the gateway it came from
+	if info := h.resume("10.0.0.1"); info == nil || info.Port != 12345 || !info.ExpiresAt.Equal(expiresAt) || info.Payload != "payload" {
+		t.Errorf("Expected the signature to be resumed, got %+v", info)
+	}
+	if info := h.resume("10.0.0.2"); info != nil {
+		t.Errorf("Expected a new signature on another gateway, got %+v", info)
+	}
+}
+
+func TestTakeOverWithoutUpgrade(t *testing.T) {
+	t.Setenv(upgradeEnv, "")
+	inherited, err := takeOver(&config.Config{OutputFile: "port.txt"})
+	if inherited != nil || err != nil {
+		t.Errorf("Expected nothing to take over, got %+v, %v", inherited, err)
+	}
+}
@@ -0,0 +1,135 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/lock"
+)
+
+// upgradeSignal is what the upgrade command, or systemctl reload, sends to a
+// running service
+const upgradeSignal = syscall.SIGHUP
+
+// handleUpgradeSignal calls upgrade for every upgrade request until ctx is
+// done. The signal is caught before it returns, so it no longer terminates
+// the process.
+func handleUpgradeSignal(ctx context.Context, upgrade func()) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, upgradeSignal)
+
+	go func() {
+		defer signal.Stop(sigChan)
+		for {
+			select {
+			case <-sigChan:
+				upgrade()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// sendUpgrade asks the service with the given PID to upgrade
+func sendUpgrade(pid int) error {
+	if err := syscall.Kill(pid, upgradeSignal); err != nil {
+		return fmt.Errorf("failed to signal pid %d: %w", pid, err)
+	}
+	return nil
+}
+
+// inheritFile returns a descriptor passed down by the previous version, closed
+// on exec so scripts we run don't hold on to the lock or listener
+func inheritFile(fd uintptr, name string) *os.File {
+	syscall.CloseOnExec(int(fd))
+	return os.NewFile(fd, name)
+}
+
+// handOver starts the binary on disk with our arguments, passes it h, the
+// instance lock and the metrics listener, which may be nil, and waits for it
+// to bind the port. It returns the new process's PID; on failure the new
+// process is stopped.
+func handOver(h handoff, instanceLock *lock.Lock, metricsListener net.Listener) (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("failed to find executable: %w", err)
+	}
+
+	handoffReader, handoffWriter, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer handoffReader.Close()
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		handoffWriter.Close()
+		return 0, err
+	}
+	defer readyReader.Close()
+	defer readyWriter.Close()
+
+	// The descriptors are numbered from 3 in this order
+	files := []*os.File{handoffReader, readyWriter, instanceLock.File()}
+	if metricsListener != nil {
+		listener, ok := metricsListener.(*net.TCPListener)
+		if !ok {
+			handoffWriter.Close()
+			return 0, fmt.Errorf("can't pass on a %T metrics listener", metricsListener)
+		}
+		file, err := listener.File()
+		if err != nil {
+			handoffWriter.Close()
+			return 0, fmt.Errorf("failed to pass on the metrics listener: %w", err)
+		}
+		defer file.Close()
+		files = append(files, file)
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), upgradeEnv+"=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		handoffWriter.Close()
+		return 0, fmt.Errorf("failed to start %s: %w", executable, err)
+	}
+
+	// Only the new process may hold the write end, so its exit ends the read
+	readyWriter.Close()
+	if err := writeHandoff(handoffWriter, h); err != nil {
+		return 0, stopSuccessor(cmd, fmt.Errorf("failed to pass on the port: %w", err))
+	}
+
+	readyReader.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	if _, err := readyReader.Read(make([]byte, 1)); errors.Is(err, os.ErrDeadlineExceeded) {
+		return 0, stopSuccessor(cmd, fmt.Errorf("the new version didn't bind the port within %s", upgradeTimeout))
+	} else if errors.Is(err, io.EOF) {
+		return 0, stopSuccessor(cmd, errors.New("the new version exited before binding the port"))
+	} else if err != nil {
+		return 0, stopSuccessor(cmd, err)
+	}
+
+	// It outlives us
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+	return pid, nil
+}
+
+// stopSuccessor stops a new version that failed to take over and returns err
+func stopSuccessor(cmd *exec.Cmd, err error) error {
+	cmd.Process.Kill()
+	cmd.Wait()
+	return err
+}
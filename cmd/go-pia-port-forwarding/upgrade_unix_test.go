@@ -0,0 +1,38 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpgradeSignal(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	requests := make(chan struct{}, 1)
+	handleUpgradeSignal(ctx, func() { requests <- struct{}{} })
+
+	if err := sendUpgrade(os.Getpid()); err != nil {
+		t.Fatalf("Failed to request an upgrade: %v", err)
+	}
+	select {
+	case <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected an upgrade request")
+	}
+}
+
+func TestUpgradeCommandWithoutService(t *testing.T) {
+	outputFile := filepath.Join(t.TempDir(), "port.txt")
+
+	err := runUpgradeCommand([]string{outputFile})
+	if err == nil || !strings.Contains(err.Error(), "no service is running") {
+		t.Errorf("Expected an error naming the missing service, got %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+
+	"github.com/meschansky/go-pia/internal/lock"
+)
+
+// handleUpgradeSignal does nothing; Windows has no signals to request an
+// upgrade with
+func handleUpgradeSignal(ctx context.Context, upgrade func()) {}
+
+// sendUpgrade isn't supported on Windows
+func sendUpgrade(pid int) error {
+	return errors.New("upgrade is not supported on Windows")
+}
+
+// inheritFile returns a descriptor passed down by the previous version
+func inheritFile(fd uintptr, name string) *os.File {
+	return os.NewFile(fd, name)
+}
+
+// handOver isn't supported on Windows
+func handOver(h handoff, instanceLock *lock.Lock, metricsListener net.Listener) (int, error) {
+	return 0, errors.New("upgrade is not supported on Windows")
+}
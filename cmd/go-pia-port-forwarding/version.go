@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"github.com/meschansky/go-pia/internal/update"
+)
+
+// releasePublicKey is the base64 ed25519 key release checksums are signed with,
+// set at build time with -ldflags "-X main.releasePublicKey=..."
+var releasePublicKey string
+
+// buildInfo describes the running binary
+type buildInfo struct {
+	version   string
+	commit    string
+	modified  bool
+	buildTime string
+	goVersion string
+}
+
+// readBuildInfo returns the version and VCS details embedded by the Go toolchain
+func readBuildInfo() buildInfo {
+	info := buildInfo{version: "(devel)", goVersion: runtime.Version()}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if bi.Main.Version != "" {
+		info.version = bi.Main.Version
+	}
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.commit = setting.Value
+		case "vcs.modified":
+			info.modified = setting.Value == "true"
+		case "vcs.time":
+			info.buildTime = setting.Value
+		}
+	}
+
+	return info
+}
+
+// userAgent identifies the program on API requests, e.g. go-pia-port-forwarding/v1.2.0
+func userAgent(info buildInfo) string {
+	version := strings.Trim(info.version, "()")
+	return programName + "/" + version
+}
+
+// writeVersion prints the build information
+func writeVersion(w io.Writer, info buildInfo) {
+	fmt.Fprintf(w, "%s %s\n", programName, info.version)
+	if info.commit != "" {
+		commit := info.commit
+		if info.modified {
+			commit += " (modified)"
+		}
+		fmt.Fprintf(w, "  commit:   %s\n", commit)
+	}
+	if info.buildTime != "" {
+		fmt.Fprintf(w, "  built:    %s\n", info.buildTime)
+	}
+	fmt.Fprintf(w, "  go:       %s\n", info.goVersion)
+	fmt.Fprintf(w, "  platform: %s/%s\n", runtime.GOOS, runtime.GOARCH)
+}
+
+// runVersionCommand prints the version and build information
+func runVersionCommand(args []string) error {
+	writeVersion(os.Stdout, readBuildInfo())
+	return nil
+}
+
+// runSelfUpdateCommand replaces the running binary with the latest release
+func runSelfUpdateCommand(args []string) error {
+	fs := flag.NewFlagSet("self-update", flag.ContinueOnError)
+	check := fs.Bool("check", false, "Only report whether an update is available")
+	force := fs.Bool("force", false, "Install the latest release even if it isn't newer, or for development builds")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var publicKey ed25519.PublicKey
+	if releasePublicKey != "" {
+		key, err := base64.StdEncoding.DecodeString(releasePublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("invalid release public key embedded in this build")
+		}
+		publicKey = key
+	}
+
+	ctx := context.Background()
+	updater := update.NewUpdater(publicKey)
+	release, err := updater.Latest(ctx)
+	if err != nil {
+		return err
+	}
+
+	current := readBuildInfo().version
+	if release.TagName == current && !*force {
+		log.Printf("Already running the latest release %s", current)
+		return nil
+	}
+	if *check {
+		log.Printf("Release %s is available (running %s)", release.TagName, current)
+		return nil
+	}
+	if current == "(devel)" && !*force {
+		return fmt.Errorf("refusing to replace a development build with %s (use --force)", release.TagName)
+	}
+
+	if publicKey == nil {
+		log.Printf("Warning: this build has no release public key; only the checksum will be verified")
+	}
+
+	binary, err := updater.Download(ctx, release)
+	if err != nil {
+		return err
+	}
+
+	exePath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to determine executable path: %w", err)
+	}
+	if err := update.Replace(exePath, binary); err != nil {
+		return err
+	}
+
+	log.Printf("Updated %s from %s to %s; restart the service, or run %s upgrade OUTPUT_FILE to switch to it without losing the port", exePath, current, release.TagName, programName)
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/meschansky/go-pia/internal/config"
+)
+
+func TestWriteVersion(t *testing.T) {
+	var b bytes.Buffer
+	writeVersion(&b, buildInfo{
+		version:   "v1.2.3",
+		commit:    "0123456789abcdef",
+		modified:  true,
+		buildTime: "2024-03-01T12:00:00Z",
+		goVersion: "go1.24.1",
+	})
+
+	for _, want := range []string{
+		"go-pia-port-forwarding v1.2.3\n",
+		"commit:   0123456789abcdef (modified)",
+		"built:    2024-03-01T12:00:00Z",
+		"go:       go1.24.1",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, b.String())
+		}
+	}
+
+	// Missing VCS details are omitted
+	b.Reset()
+	writeVersion(&b, buildInfo{version: "(devel)", goVersion: "go1.24.1"})
+	if strings.Contains(b.String(), "commit:") || strings.Contains(b.String(), "built:") {
+		t.Errorf("Expected no VCS details, got:\n%s", b.String())
+	}
+}
+
+func TestRequestHeaders(t *testing.T) {
+	defaultAgent := userAgent(readBuildInfo())
+
+	testCases := []struct {
+		name       string
+		cfg        *config.Config
+		expectedUA string
+		extra      string
+	}{
+		{
+			name:       "Default user agent",
+			cfg:        &config.Config{},
+			expectedUA: defaultAgent,
+		},
+		{
+			name:       "Configured user agent",
+			cfg:        &config.Config{UserAgent: "my-nas/1.0"},
+			expectedUA: "my-nas/1.0",
+		},
+		{
+			name:       "User agent given as an extra header",
+			cfg:        &config.Config{RequestHeaders: "User-Agent: other/2.0; X-Debug: 1"},
+			expectedUA: "other/2.0",
+			extra:      "1",
+		},
+		{
+			name:       "Configured user agent wins over extra header",
+			cfg:        &config.Config{UserAgent: "my-nas/1.0", RequestHeaders: "User-Agent: other/2.0"},
+			expectedUA: "my-nas/1.0",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			headers := requestHeaders(tc.cfg)
+			if ua := headers.Get("User-Agent"); ua != tc.expectedUA {
+				t.Errorf("Expected User-Agent %q, got %q", tc.expectedUA, ua)
+			}
+			if debug := headers.Get("X-Debug"); debug != tc.extra {
+				t.Errorf("Expected X-Debug %q, got %q", tc.extra, debug)
+			}
+		})
+	}
+
+	if ua := userAgent(buildInfo{version: "(devel)"}); ua != "go-pia-port-forwarding/devel" {
+		t.Errorf("Expected go-pia-port-forwarding/devel, got %q", ua)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/systemd"
+)
+
+// watchUnit follows the state of a systemd unit; tests replace it
+var watchUnit = systemd.WatchUnit
+
+// waitForVPNUnit waits for --vpn-unit to become active, giving up after
+// --vpn-detect-timeout if one is set, and returns its state changes from then
+// on
+func waitForVPNUnit(ctx context.Context, cfg *config.Config) (<-chan string, error) {
+	states, err := watchUnit(ctx, cfg.VPNUnit)
+	if err != nil {
+		return nil, err
+	}
+
+	var timeout <-chan time.Time
+	if cfg.VPNDetectTimeout > 0 {
+		timeout = clk.After(cfg.VPNDetectTimeout)
+	}
+	for {
+		select {
+		case state, ok := <-states:
+			if !ok {
+				return nil, fmt.Errorf("lost the connection to systemd while waiting for %s", cfg.VPNUnit)
+			}
+			if state == systemd.StateActive {
+				return states, nil
+			}
+			log.Printf("Waiting for %s to become active, it's %s", cfg.VPNUnit, state)
+		case <-timeout:
+			return nil, fmt.Errorf("%s didn't become active within %s", cfg.VPNUnit, cfg.VPNDetectTimeout)
+		}
+	}
+}
+
+// followVPNUnit calls renew whenever --vpn-unit becomes active again after
+// leaving the active state, e.g. after a restart, since the VPN reconnected
+// and the signature from before is no good. When the connection to systemd is
+// lost, it's made again after --vpn-retry-interval.
+func followVPNUnit(ctx context.Context, cfg *config.Config, states <-chan string, renew func()) {
+	down := false
+	for {
+		for state := range states {
+			switch {
+			case state != systemd.StateActive && !down:
+				log.Printf("%s is %s, the VPN is going down", cfg.VPNUnit, state)
+				down = true
+			case state == systemd.StateActive && down:
+				log.Printf("%s is active again, requesting a new signature", cfg.VPNUnit)
+				down = false
+				renew()
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("Warning: lost the connection to systemd, following %s again in %s", cfg.VPNUnit, cfg.VPNRetryInterval)
+		for {
+			select {
+			case <-clk.After(cfg.VPNRetryInterval):
+			case <-ctx.Done():
+				return
+			}
+			var err error
+			if states, err = watchUnit(ctx, cfg.VPNUnit); err == nil {
+				break
+			}
+			log.Printf("Failed to follow %s: %v", cfg.VPNUnit, err)
+		}
+	}
+}
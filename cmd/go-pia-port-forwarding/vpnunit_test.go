@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/systemd"
+)
+
+// fakeUnitWatches stands in for systemd.WatchUnit, handing out the given
+// channels in turn and failing once they're used up
+func fakeUnitWatches(t *testing.T, watches ...chan string) *int {
+	t.Helper()
+	count := 0
+	watchUnit = func(ctx context.Context, unit string) (<-chan string, error) {
+		if count == len(watches) {
+			return nil, errors.New("no more watches")
+		}
+		count++
+		return watches[count-1], nil
+	}
+	t.Cleanup(func() { watchUnit = systemd.WatchUnit })
+	return &count
+}
+
+func TestWaitForVPNUnit(t *testing.T) {
+	cfg := &config.Config{VPNUnit: "openvpn-client@pia.service"}
+
+	// Startup goes on once the unit is active
+	states := make(chan string, 3)
+	states <- "inactive"
+	states <- "activating"
+	states <- "active"
+	fakeUnitWatches(t, states)
+	if _, err := waitForVPNUnit(context.Background(), cfg); err != nil {
+		t.Errorf("Expected the unit to become active, got %v", err)
+	}
+
+	// Losing systemd is an error
+	states = make(chan string, 1)
+	states <- "activating"
+	close(states)
+	fakeUnitWatches(t, states)
+	if _, err := waitForVPNUnit(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "lost the connection") {
+		t.Errorf("Expected an error for a lost connection, got %v", err)
+	}
+}
+
+func TestWaitForVPNUnitTimeout(t *testing.T) {
+	fake := useFakeClock(t)
+	cfg := &config.Config{VPNUnit: "openvpn-client@pia.service", VPNDetectTimeout: 5 * time.Minute}
+	states := make(chan string, 1)
+	states <- "failed"
+	fakeUnitWatches(t, states)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := waitForVPNUnit(ctx, cfg)
+		done <- err
+	}()
+	if err := fake.BlockUntil(ctx, 1); err != nil {
+		t.Fatalf("Expected a wait for the unit: %v", err)
+	}
+	fake.Advance(5 * time.Minute)
+
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "didn't become active within 5m0s") {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+}
+
+func TestFollowVPNUnit(t *testing.T) {
+	fake := useFakeClock(t)
+	cfg := &config.Config{VPNUnit: "openvpn-client@pia.service", VPNRetryInterval: time.Minute}
+	first, second := make(chan string), make(chan string)
+	watches := fakeUnitWatches(t, second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	renewals := make(chan struct{}, 3)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		followVPNUnit(ctx, cfg, first, func() { renewals <- struct{}{} })
+	}()
+
+	// A restart gets a new signature once the unit is back up
+	for _, state := range []string{"deactivating", "inactive", "activating"} {
+		first <- state
+	}
+	if len(renewals) != 0 {
+		t.Fatalf("Expected no renewal while the unit is down")
+	}
+	first <- "active"
+	select {
+	case <-renewals:
+	case <-ctx.Done():
+		t.Fatal("Expected a renewal once the unit was active again")
+	}
+
+	// A lost connection to systemd is made again after the retry interval
+	close(first)
+	if err := fake.BlockUntil(ctx, 1); err != nil {
+		t.Fatalf("Expected a wait before following the unit again: %v", err)
+	}
+	fake.Advance(time.Minute)
+	second <- "active"
+	if *watches != 1 || len(renewals) != 0 {
+		t.Errorf("Expected one more watch and no renewal for a unit that stayed up, got %d and %d", *watches, len(renewals))
+	}
+
+	cancel()
+	close(second)
+	<-done
+}
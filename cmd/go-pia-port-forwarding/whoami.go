@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/auth"
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/redact"
+)
+
+// runWhoamiCommand checks the credentials or --token against PIA and prints the
+// subscription they belong to. It fails if they're rejected or the
+// subscription has lapsed, which port forwarding can't recover from.
+func runWhoamiCommand(args []string) error {
+	cfg := config.DefaultConfig()
+	fs := flag.NewFlagSet("whoami", flag.ContinueOnError)
+	jsonOutput := fs.Bool("json", false, "Print the account as JSON")
+	if err := config.ParseFlags(fs, cfg, args); err != nil {
+		return err
+	}
+	if cfg.Token == "" && cfg.CredentialsFile == "" {
+		return fmt.Errorf("usage: %s whoami [--json] --credentials PATH|--token TOKEN", programName)
+	}
+
+	token := cfg.Token
+	var client *auth.Client
+	if token != "" {
+		redact.Default.Add("token", token)
+		client = newAuthClient(cfg, "", "")
+	} else {
+		username, password, err := cfg.LoadCredentials()
+		if err != nil {
+			return err
+		}
+		client = newAuthClient(cfg, username, password)
+		if token, err = client.GetToken(); err != nil {
+			return fmt.Errorf("failed to log in to PIA: %w", err)
+		}
+	}
+	defer client.Close()
+
+	account, err := client.Account(token)
+	if errors.Is(err, auth.ErrTokenRejected) && cfg.Token != "" {
+		return fmt.Errorf("%w: the token given with --token has likely expired", err)
+	} else if err != nil {
+		return fmt.Errorf("failed to get the PIA account: %w", err)
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(account); err != nil {
+			return err
+		}
+	} else {
+		writeAccount(os.Stdout, account, time.Now())
+	}
+
+	if subscriptionLapsed(account, time.Now()) {
+		return errors.New("the PIA subscription has lapsed, port forwarding won't work until it's renewed")
+	}
+	return nil
+}
+
+// subscriptionLapsed reports whether the subscription has ended. PIA may leave
+// out fields, so only an explicit expiry counts.
+func subscriptionLapsed(a *auth.Account, now time.Time) bool {
+	expiresAt := a.ExpiresAt()
+	return a.Expired || (!expiresAt.IsZero() && !expiresAt.After(now))
+}
+
+// writeAccount prints the account in human readable form
+func writeAccount(w io.Writer, a *auth.Account, now time.Time) {
+	fmt.Fprintf(w, "Username:     %s\n", a.Username)
+	if a.Plan != "" {
+		fmt.Fprintf(w, "Plan:         %s\n", a.Plan)
+	}
+	if subscriptionLapsed(a, now) {
+		fmt.Fprintf(w, "Subscription: expired\n")
+	} else {
+		fmt.Fprintf(w, "Subscription: active\n")
+	}
+	if expiresAt := a.ExpiresAt(); !expiresAt.IsZero() {
+		renewal := "doesn't renew automatically"
+		if a.Recurring {
+			renewal = "renews automatically"
+		}
+		fmt.Fprintf(w, "Expires:      %s (%d days), %s\n", expiresAt.Local().Format(time.RFC3339), a.DaysRemaining, renewal)
+	}
+	if a.NeedsPayment {
+		fmt.Fprintf(w, "Payment:      due\n")
+	}
+	fmt.Fprintf(w, "Token:        accepted\n")
+}
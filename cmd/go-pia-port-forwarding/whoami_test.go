@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/auth"
+)
+
+func TestWriteAccount(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name     string
+		account  auth.Account
+		lapsed   bool
+		expected []string
+	}{
+		{
+			name:     "Active",
+			account:  auth.Account{Username: "p1234567", Plan: "yearly", Active: true, ExpirationTime: now.Add(42 * 24 * time.Hour).Unix(), DaysRemaining: 42, Recurring: true},
+			expected: []string{"Username:     p1234567", "Plan:         yearly", "Subscription: active", "(42 days), renews automatically", "Token:        accepted"},
+		},
+		{
+			name:     "Expired",
+			account:  auth.Account{Username: "p1234567", Expired: true, NeedsPayment: true},
+			lapsed:   true,
+			expected: []string{"Subscription: expired", "Payment:      due"},
+		},
+		{
+			name:     "Past its expiry",
+			account:  auth.Account{Username: "p1234567", ExpirationTime: now.Add(-time.Hour).Unix()},
+			lapsed:   true,
+			expected: []string{"Subscription: expired", "doesn't renew automatically"},
+		},
+		{
+			name:     "Without details",
+			account:  auth.Account{Username: "p1234567"},
+			expected: []string{"Subscription: active"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if lapsed := subscriptionLapsed(&tc.account, now); lapsed != tc.lapsed {
+				t.Errorf("Expected lapsed %v, got %v", tc.lapsed, lapsed)
+			}
+			var b bytes.Buffer
+			writeAccount(&b, &tc.account, now)
+			for _, want := range tc.expected {
+				if !strings.Contains(b.String(), want) {
+					t.Errorf("Expected output to contain %q, got:\n%s", want, b.String())
+				}
+			}
+		})
+	}
+}
@@ -1,3 +1,5 @@
 module github.com/meschansky/go-pia
 
 go 1.24.1
+
+require golang.org/x/sys v0.40.0
@@ -0,0 +1,39 @@
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "port.txt")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatalf("Failed to write the file: %v", err)
+	}
+
+	if err := WriteFile(path, []byte("12345\n"), 0600); err != nil {
+		t.Fatalf("Failed to replace the file: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "12345\n" {
+		t.Errorf("Expected the new contents, got %q (%v)", data, err)
+	}
+	if info, err := os.Stat(path); err == nil && runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, got %v", info.Mode().Perm())
+	}
+
+	// No temporary files are left behind
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected only the file, got %d entries", len(entries))
+	}
+}
+
+func TestWriteFileMissingDir(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing", "port.txt")
+	if err := WriteFile(path, []byte("12345\n"), 0644); err == nil {
+		t.Errorf("Expected an error for a missing directory")
+	}
+}
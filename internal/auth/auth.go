@@ -2,12 +2,22 @@ package auth
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/meschansky/go-pia/internal/clock"
+	"github.com/meschansky/go-pia/internal/httpjson"
+	"github.com/meschansky/go-pia/internal/httplog"
+	"github.com/meschansky/go-pia/internal/metrics"
+	"github.com/meschansky/go-pia/internal/redact"
+	"github.com/meschansky/go-pia/internal/resolver"
 )
 
 const (
@@ -15,59 +25,337 @@ const (
 	TokenURL = "https://www.privateinternetaccess.com/api/client/v2/token"
 	// TokenValidityDuration is how long a token is valid (24 hours)
 	TokenValidityDuration = 24 * time.Hour
+	// AccountURL is the URL for the PIA account API
+	AccountURL = "https://www.privateinternetaccess.com/api/client/v2/account"
 )
 
+// ErrTokenRejected is returned when PIA doesn't accept a token
+var ErrTokenRejected = errors.New("PIA rejected the token")
+
+// Token lifecycle metrics, shared by all clients since the service uses one
+var (
+	tokenRefreshes       = metrics.Default.NewCounter("gopia_auth_token_refreshes_total", "Number of authentication tokens obtained")
+	tokenRefreshFailures = metrics.Default.NewCounter("gopia_auth_token_refresh_failures_total", "Number of failed attempts to obtain an authentication token")
+	// Unix nanoseconds of the cached token and the last successful authentication, 0 if none
+	tokenIssuedAt   atomic.Int64
+	lastAuthSuccess atomic.Int64
+)
+
+func init() {
+	metrics.Default.NewGaugeFunc("gopia_auth_token_age_seconds", "Age of the cached authentication token, 0 if no token is cached", func() float64 {
+		return secondsSince(tokenIssuedAt.Load())
+	})
+	metrics.Default.NewGaugeFunc("gopia_auth_last_success_age_seconds", "Seconds since the last successful authentication, 0 if there hasn't been one", func() float64 {
+		return secondsSince(lastAuthSuccess.Load())
+	})
+}
+
+// secondsSince returns the seconds elapsed since a Unix nanosecond timestamp, or 0 if it's unset
+func secondsSince(unixNano int64) float64 {
+	if unixNano == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, unixNano)).Seconds()
+}
+
+// Stats describes a client's token lifecycle
+type Stats struct {
+	// When the cached token was obtained, zero if no token is cached
+	TokenIssuedAt time.Time
+	// When a token was last obtained successfully
+	LastSuccessAt time.Time
+	// Number of tokens obtained
+	Refreshes int
+	// Number of failed attempts to obtain a token
+	Failures int
+	// Error from the most recent failed attempt, cleared on success
+	LastError string
+}
+
 // TokenResponse represents the response from the PIA token API
 type TokenResponse struct {
 	Token string `json:"token"`
 	Error string `json:"error"`
 }
 
+// Account is the subscription a token belongs to, as the PIA account API
+// reports it. Fields PIA leaves out stay zero.
+type Account struct {
+	Username string `json:"username"`
+	// Subscription plan, such as "monthly" or "yearly"
+	Plan string `json:"plan"`
+	// Whether the subscription is active and has expired
+	Active  bool `json:"active"`
+	Expired bool `json:"expired"`
+	// When the subscription ends, in Unix seconds
+	ExpirationTime int64 `json:"expiration_time"`
+	DaysRemaining  int   `json:"days_remaining"`
+	// Whether the subscription renews by itself
+	Recurring bool `json:"recurring"`
+	// Whether a payment is due to keep the subscription
+	NeedsPayment bool `json:"needs_payment"`
+}
+
+// ExpiresAt returns when the subscription ends, or the zero time if PIA didn't say
+func (a *Account) ExpiresAt() time.Time {
+	if a.ExpirationTime == 0 {
+		return time.Time{}
+	}
+	return time.Unix(a.ExpirationTime, 0)
+}
+
+// tokenRefresh is a token request in flight, shared by every GetToken call
+// made while it runs
+type tokenRefresh struct {
+	// Closed once token and err are set
+	done  chan struct{}
+	token string
+	err   error
+}
+
 // Client handles authentication with the PIA API
 type Client struct {
 	httpClient *http.Client
-	username   string
-	password   string
-	token      string
-	expiresAt  time.Time
+	// Decides when the cached token expires
+	clock clock.Clock
+	// Guards the credentials and token, which may be swapped while in use
+	mu        sync.Mutex
+	username  string
+	password  string
+	token     string
+	expiresAt time.Time
+	stats     Stats
+	// Token request in flight, if any
+	refresh *tokenRefresh
+	// Bumped whenever the token is dropped, so a request started before
+	// isn't cached
+	generation uint64
+	// Called after a new token is obtained or one can't be, outside the lock
+	onRefresh func(issuedAt time.Time)
+	onFailure func(err error)
+	// Sent on every request
+	headers http.Header
+	// Logs requests when debugging, nil otherwise
+	tracer *httplog.Tracer
+	// Canceled by Close to abort requests in flight
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // NewClient creates a new authentication client
 func NewClient(username, password string) *Client {
+	redact.Default.Add("password", password)
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Client{
 		httpClient: &http.Client{
 			Timeout: 10 * time.Second,
 		},
+		clock:    clock.Real,
 		username: username,
 		password: password,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Close aborts a token request in flight and fails later ones, for shutdown
+func (c *Client) Close() {
+	c.cancel()
+}
+
+// UseClock makes the client use the given clock for token expiry. It must be
+// set before the client is used.
+func (c *Client) UseClock(clk clock.Clock) {
+	c.clock = clk
+}
+
+// UseResolver makes the client resolve the PIA API hostname with the given resolver
+func (c *Client) UseResolver(resolver *net.Resolver) {
+	dialer := &net.Dialer{
+		Timeout:  10 * time.Second,
+		Resolver: resolver,
 	}
+	c.useDialer(dialer.DialContext)
+}
+
+// UseResolverCache makes the client resolve the PIA API hostname through
+// cache, which may be shared with other clients
+func (c *Client) UseResolverCache(cache *resolver.Cache) {
+	c.useDialer(cache.Dialer(&net.Dialer{Timeout: 10 * time.Second}))
+}
+
+// useDialer makes the client open connections to the PIA API with dial
+func (c *Client) useDialer(dial func(ctx context.Context, network, address string) (net.Conn, error)) {
+	c.httpClient.Transport = c.tracer.Wrap(&http.Transport{
+		Proxy:       http.ProxyFromEnvironment,
+		DialContext: dial,
+	})
+}
+
+// UseTracer logs a summary of every API request with the given tracer
+func (c *Client) UseTracer(tracer *httplog.Tracer) {
+	c.tracer = tracer
+	c.httpClient.Transport = tracer.Wrap(c.httpClient.Transport)
+}
+
+// SetHeaders sets headers, such as User-Agent, sent on every API request. It
+// must be set before the client is used.
+func (c *Client) SetHeaders(headers http.Header) {
+	c.headers = headers.Clone()
+}
+
+// OnRefresh registers fn to be called whenever a new token is obtained. It must
+// be set before the client is used.
+func (c *Client) OnRefresh(fn func(issuedAt time.Time)) {
+	c.onRefresh = fn
+}
+
+// OnFailure registers fn to be called whenever a token can't be obtained. It
+// must be set before the client is used.
+func (c *Client) OnFailure(fn func(err error)) {
+	c.onFailure = fn
+}
+
+// SetCredentials replaces the username and password. The cached token is
+// dropped so the next GetToken authenticates with the new credentials.
+func (c *Client) SetCredentials(username, password string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	redact.Default.Add("password", password)
+	c.username = username
+	c.password = password
+	c.dropToken()
 }
 
-// GetToken returns a valid token, obtaining a new one if necessary
+// SetToken caches a token obtained at issuedAt by someone else, such as the
+// process that handed over to this one on upgrade, so GetToken uses it instead
+// of logging in until it expires
+func (c *Client) SetToken(token string, issuedAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	redact.Default.Add("token", token)
+	c.generation++
+	c.refresh = nil
+	c.token = token
+	c.expiresAt = issuedAt.Add(TokenValidityDuration)
+	c.stats.TokenIssuedAt = issuedAt
+	tokenIssuedAt.Store(issuedAt.UnixNano())
+}
+
+// Invalidate drops the cached token so the next GetToken obtains a new one
+func (c *Client) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.dropToken()
+}
+
+// dropToken forgets the cached token, and any being obtained; c.mu must be held
+func (c *Client) dropToken() {
+	c.generation++
+	c.refresh = nil
+	c.token = ""
+	c.expiresAt = time.Time{}
+	c.stats.TokenIssuedAt = time.Time{}
+	tokenIssuedAt.Store(0)
+}
+
+// Stats returns the client's token lifecycle statistics
+func (c *Client) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stats
+}
+
+// GetToken returns a valid token, obtaining a new one if necessary. It's safe
+// for concurrent use: callers arriving while a token is being obtained wait for
+// that request instead of making their own.
 func (c *Client) GetToken() (string, error) {
+	c.mu.Lock()
 	// If we have a valid token, return it
-	if c.token != "" && time.Now().Before(c.expiresAt) {
-		return c.token, nil
+	if c.token != "" && c.clock.Now().Before(c.expiresAt) {
+		token := c.token
+		c.mu.Unlock()
+		return token, nil
+	}
+	if r := c.refresh; r != nil {
+		c.mu.Unlock()
+		<-r.done
+		return r.token, r.err
+	}
+	r := &tokenRefresh{done: make(chan struct{})}
+	c.refresh = r
+	username, password, generation := c.username, c.password, c.generation
+	c.mu.Unlock()
+
+	// Otherwise, get a new token without holding the lock, so Stats and
+	// Invalidate don't wait on the API
+	r.token, r.err = c.refreshToken(username, password)
+	issuedAt := c.finishRefresh(r, generation)
+	close(r.done)
+
+	// Only the caller that made the request reports it
+	if r.err == nil && c.onRefresh != nil {
+		c.onRefresh(issuedAt)
+	}
+	if r.err != nil && c.onFailure != nil {
+		c.onFailure(r.err)
+	}
+	return r.token, r.err
+}
+
+// finishRefresh records the outcome of r and returns when the token was
+// obtained. The token is only cached if the credentials haven't been replaced
+// and the token dropped since r started at generation.
+func (c *Client) finishRefresh(r *tokenRefresh, generation uint64) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.refresh == r {
+		c.refresh = nil
+	}
+	if r.err != nil {
+		c.stats.Failures++
+		c.stats.LastError = r.err.Error()
+		tokenRefreshFailures.Inc()
+		return time.Time{}
 	}
 
-	// Otherwise, get a new token
-	return c.refreshToken()
+	now := c.clock.Now()
+	c.stats.LastSuccessAt = now
+	c.stats.Refreshes++
+	c.stats.LastError = ""
+	tokenRefreshes.Inc()
+	lastAuthSuccess.Store(now.UnixNano())
+	if generation == c.generation {
+		c.token = r.token
+		c.expiresAt = now.Add(TokenValidityDuration)
+		c.stats.TokenIssuedAt = now
+		tokenIssuedAt.Store(now.UnixNano())
+	}
+	return now
 }
 
 // refreshToken obtains a new token from the PIA API
-func (c *Client) refreshToken() (string, error) {
+func (c *Client) refreshToken(username, password string) (string, error) {
 	// Create form data
 	form := url.Values{}
-	form.Add("username", c.username)
-	form.Add("password", c.password)
+	form.Add("username", username)
+	form.Add("password", password)
 
 	// Create request
-	req, err := http.NewRequest("POST", TokenURL, bytes.NewBufferString(form.Encode()))
+	req, err := http.NewRequestWithContext(c.ctx, "POST", TokenURL, bytes.NewBufferString(form.Encode()))
 	if err != nil {
 		return "", fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for name, values := range c.headers {
+		req.Header[name] = values
+	}
 
 	// Send request
 	resp, err := c.httpClient.Do(req)
@@ -76,16 +364,10 @@ func (c *Client) refreshToken() (string, error) {
 	}
 	defer resp.Body.Close()
 
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response body: %w", err)
-	}
-
 	// Parse response
 	var tokenResp TokenResponse
-	if err := json.Unmarshal(body, &tokenResp); err != nil {
-		return "", fmt.Errorf("failed to parse response: %w", err)
+	if err := httpjson.Decode(resp, &tokenResp); err != nil {
+		return "", err
 	}
 
 	// Check for error
@@ -98,9 +380,39 @@ func (c *Client) refreshToken() (string, error) {
 		return "", fmt.Errorf("received empty token")
 	}
 
-	// Update client state
-	c.token = tokenResp.Token
-	c.expiresAt = time.Now().Add(TokenValidityDuration)
+	// Keep the token out of the logs
+	redact.Default.Add("token", tokenResp.Token)
+
+	return tokenResp.Token, nil
+}
+
+// Account returns the subscription token belongs to. A token PIA no longer
+// accepts fails with ErrTokenRejected.
+func (c *Client) Account(token string) (*Account, error) {
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodGet, AccountURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	for name, values := range c.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Authorization", "Token "+token)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
 
-	return c.token, nil
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, fmt.Errorf("%w (HTTP %d)", ErrTokenRejected, resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, httpjson.StatusError(resp)
+	}
+	var account Account
+	if err := httpjson.Decode(resp, &account); err != nil {
+		return nil, err
+	}
+	return &account, nil
 }
@@ -2,11 +2,17 @@ package auth
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/meschansky/go-pia/internal/clock"
+	"github.com/meschansky/go-pia/internal/redact"
 )
 
 // testClient is a wrapper around Client that allows us to inject a test server
@@ -152,9 +158,6 @@ func TestRefreshToken(t *testing.T) {
 			// Create test client
 			client := newTestClient(server, "testuser", "testpass")
 
-			// Force token refresh
-			client.expiresAt = time.Now().Add(-1 * time.Hour)
-
 			// Get token
 			_, err := client.GetToken()
 
@@ -183,6 +186,8 @@ func TestTokenExpiration(t *testing.T) {
 
 	// Create test client
 	client := newTestClient(server, "testuser", "testpass")
+	clk := clock.NewFake(time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC))
+	client.UseClock(clk)
 
 	// Get token
 	token1, err := client.GetToken()
@@ -195,7 +200,8 @@ func TestTokenExpiration(t *testing.T) {
 		t.Errorf("Expected token to be token-1, got %s", token1)
 	}
 
-	// Get token again (should use cache)
+	// Get token again just before it expires (should use cache)
+	clk.Advance(TokenValidityDuration - time.Second)
 	token2, err := client.GetToken()
 	if err != nil {
 		t.Fatalf("Failed to get token on second call: %v", err)
@@ -205,7 +211,7 @@ func TestTokenExpiration(t *testing.T) {
 	}
 
 	// Expire token
-	client.expiresAt = time.Now().Add(-1 * time.Hour)
+	clk.Advance(time.Second)
 
 	// Get token again (should refresh)
 	token3, err := client.GetToken()
@@ -223,3 +229,301 @@ func TestTokenExpiration(t *testing.T) {
 		t.Errorf("Expected 2 server calls, got %d", callCount)
 	}
 }
+
+func TestSetCredentials(t *testing.T) {
+	// Issue a token naming the user it was requested for
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("Failed to parse form: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(TokenResponse{Token: "token-" + r.Form.Get("username") + "-" + r.Form.Get("password")})
+	}))
+	defer server.Close()
+
+	client := newTestClient(server, "olduser", "oldpass")
+	token, err := client.GetToken()
+	if err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+	if token != "token-olduser-oldpass" {
+		t.Errorf("Expected token-olduser-oldpass, got %s", token)
+	}
+
+	// New credentials must not reuse the cached token
+	client.SetCredentials("newuser", "newpass")
+	token, err = client.GetToken()
+	if err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+	if token != "token-newuser-newpass" {
+		t.Errorf("Expected token-newuser-newpass, got %s", token)
+	}
+}
+
+func TestSetToken(t *testing.T) {
+	callCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount++
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(TokenResponse{Token: "new-token"})
+	}))
+	defer server.Close()
+
+	client := newTestClient(server, "testuser", "testpass")
+	clk := clock.NewFake(time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC))
+	client.UseClock(clk)
+
+	// A handed over token is used until it expires, counted from when it was issued
+	issuedAt := clk.Now().Add(-time.Hour)
+	client.SetToken("handed-over", issuedAt)
+	if token, err := client.GetToken(); err != nil || token != "handed-over" {
+		t.Errorf("Expected the handed over token, got %q, %v", token, err)
+	}
+	if got := client.Stats().TokenIssuedAt; !got.Equal(issuedAt) {
+		t.Errorf("Expected the token to be issued at %s, got %s", issuedAt, got)
+	}
+	if callCount != 0 {
+		t.Errorf("Expected no token requests, got %d", callCount)
+	}
+
+	clk.Advance(TokenValidityDuration - time.Hour)
+	if token, err := client.GetToken(); err != nil || token != "new-token" {
+		t.Errorf("Expected a new token once the handed over one expired, got %q, %v", token, err)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	callCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount++
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(TokenResponse{Token: "test-token"})
+	}))
+	defer server.Close()
+
+	client := newTestClient(server, "testuser", "testpass")
+	refreshes := 0
+	client.OnRefresh(func(time.Time) { refreshes++ })
+
+	client.GetToken()
+	client.GetToken()
+	if callCount != 1 || refreshes != 1 {
+		t.Errorf("Expected the token to be cached, got %d requests and %d refreshes", callCount, refreshes)
+	}
+
+	client.Invalidate()
+	client.GetToken()
+	if callCount != 2 || refreshes != 2 {
+		t.Errorf("Expected a new token after Invalidate, got %d requests and %d refreshes", callCount, refreshes)
+	}
+}
+
+func TestConcurrentGetToken(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(TokenResponse{Token: "test-token"})
+	}))
+	defer server.Close()
+
+	client := newTestClient(server, "testuser", "testpass")
+	var refreshes atomic.Int32
+	client.OnRefresh(func(time.Time) { refreshes.Add(1) })
+
+	const callers = 10
+	var wg sync.WaitGroup
+	tokens := make([]string, callers)
+	errs := make([]error, callers)
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tokens[i], errs[i] = client.GetToken()
+		}()
+	}
+
+	// Stats and Invalidate don't wait for the request
+	for requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	client.Stats()
+	close(release)
+	wg.Wait()
+
+	for i := range callers {
+		if errs[i] != nil || tokens[i] != "test-token" {
+			t.Errorf("Caller %d got %q, %v", i, tokens[i], errs[i])
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("Expected 1 token request, got %d", n)
+	}
+	if n := refreshes.Load(); n != 1 {
+		t.Errorf("Expected 1 refresh, got %d", n)
+	}
+}
+
+func TestInvalidateDuringRefresh(t *testing.T) {
+	var requests atomic.Int32
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		r.ParseForm()
+		started <- struct{}{}
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(TokenResponse{Token: "token-for-" + r.FormValue("username")})
+	}))
+	defer server.Close()
+
+	client := newTestClient(server, "olduser", "oldpass")
+	done := make(chan string)
+	go func() {
+		token, _ := client.GetToken()
+		done <- token
+	}()
+	<-started
+
+	// A token obtained with the old credentials isn't cached
+	client.SetCredentials("newuser", "newpass")
+	close(release)
+	if token := <-done; token != "token-for-olduser" {
+		t.Errorf("Expected the old request to finish with its token, got %q", token)
+	}
+	token, err := client.GetToken()
+	if err != nil || token != "token-for-newuser" {
+		t.Errorf("Expected a token for the new credentials, got %q, %v", token, err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("Expected 2 token requests, got %d", n)
+	}
+}
+
+func TestStats(t *testing.T) {
+	fail := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if fail {
+			json.NewEncoder(w).Encode(TokenResponse{Error: "Invalid credentials"})
+			return
+		}
+		json.NewEncoder(w).Encode(TokenResponse{Token: "test-token"})
+	}))
+	defer server.Close()
+
+	client := newTestClient(server, "testuser", "testpass")
+	refreshesBefore := tokenRefreshes.Value()
+	failuresBefore := tokenRefreshFailures.Value()
+
+	if _, err := client.GetToken(); err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+	stats := client.Stats()
+	if stats.Refreshes != 1 || stats.Failures != 0 {
+		t.Errorf("Expected 1 refresh and 0 failures, got %d and %d", stats.Refreshes, stats.Failures)
+	}
+	if stats.TokenIssuedAt.IsZero() || !stats.TokenIssuedAt.Equal(stats.LastSuccessAt) {
+		t.Errorf("Expected token issue and last success times to be set, got %v and %v", stats.TokenIssuedAt, stats.LastSuccessAt)
+	}
+
+	// A failed refresh keeps the last success but drops the token
+	fail = true
+	client.Invalidate()
+	if _, err := client.GetToken(); err == nil {
+		t.Fatalf("Expected error but got nil")
+	}
+	stats = client.Stats()
+	if stats.Failures != 1 || stats.LastError == "" {
+		t.Errorf("Expected 1 failure with an error, got %d and %q", stats.Failures, stats.LastError)
+	}
+	if !stats.TokenIssuedAt.IsZero() {
+		t.Errorf("Expected no token issue time after Invalidate, got %v", stats.TokenIssuedAt)
+	}
+	if stats.LastSuccessAt.IsZero() {
+		t.Errorf("Expected last success time to be kept")
+	}
+
+	if n := tokenRefreshes.Value() - refreshesBefore; n != 1 {
+		t.Errorf("Expected refresh counter to increase by 1, got %d", n)
+	}
+	if n := tokenRefreshFailures.Value() - failuresBefore; n != 1 {
+		t.Errorf("Expected failure counter to increase by 1, got %d", n)
+	}
+}
+
+func TestSetHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ua := r.Header.Get("User-Agent"); ua != "go-pia-port-forwarding/v1.2.3" {
+			t.Errorf("Expected User-Agent go-pia-port-forwarding/v1.2.3, got %q", ua)
+		}
+		if r.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+			t.Errorf("Expected form content type, got %q", r.Header.Get("Content-Type"))
+		}
+		json.NewEncoder(w).Encode(TokenResponse{Token: "test-token"})
+	}))
+	defer server.Close()
+
+	client := newTestClient(server, "testuser", "testpass")
+	client.SetHeaders(http.Header{"User-Agent": {"go-pia-port-forwarding/v1.2.3"}})
+
+	if _, err := client.GetToken(); err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+}
+
+func TestSecretsAreRedacted(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(TokenResponse{Token: "redacted-test-token"})
+	}))
+	defer server.Close()
+
+	client := newTestClient(server, "testuser", "redacted-test-password")
+	if _, err := client.GetToken(); err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+	client.SetCredentials("testuser", "rotated-test-password")
+
+	line := redact.Default.String("token=redacted-test-token password=redacted-test-password rotated=rotated-test-password")
+	for _, secret := range []string{"redacted-test-token", "redacted-test-password", "rotated-test-password"} {
+		if strings.Contains(line, secret) {
+			t.Errorf("Expected %s to be redacted, got %q", secret, line)
+		}
+	}
+}
+
+func TestAccount(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/client/v2/account" {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Token good-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"username":"p1234567","plan":"yearly","active":true,"expired":false,"expiration_time":1735689600,"days_remaining":42,"recurring":true}`))
+	}))
+	defer server.Close()
+	client := newTestClient(server, "", "")
+
+	account, err := client.Account("good-token")
+	if err != nil {
+		t.Fatalf("Failed to get account: %v", err)
+	}
+	expected := Account{Username: "p1234567", Plan: "yearly", Active: true, ExpirationTime: 1735689600, DaysRemaining: 42, Recurring: true}
+	if *account != expected {
+		t.Errorf("Expected %+v, got %+v", expected, *account)
+	}
+	if !account.ExpiresAt().Equal(time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected expiry %v", account.ExpiresAt())
+	}
+
+	if _, err := client.Account("stale-token"); !errors.Is(err, ErrTokenRejected) {
+		t.Errorf("Expected ErrTokenRejected, got %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package clock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Fake is a Clock that only moves when Advance is called, for tests
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*waiter
+	// Closed and replaced whenever a waiter is added
+	added chan struct{}
+}
+
+// waiter is a pending After channel or ticker
+type waiter struct {
+	at     time.Time
+	ch     chan time.Time
+	period time.Duration
+}
+
+// NewFake creates a fake clock set to now
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now, added: make(chan struct{})}
+}
+
+// Now returns the fake time
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.now
+}
+
+// After returns a channel that receives the time once the clock has advanced by d
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w := &waiter{at: f.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.ch <- f.now
+		return w.ch
+	}
+	f.addWaiter(w)
+	return w.ch
+}
+
+// NewTicker returns a ticker that ticks every time the clock advances by d. Like
+// time.Ticker, it drops ticks a slow receiver doesn't pick up.
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w := &waiter{at: f.now.Add(d), ch: make(chan time.Time, 1), period: d}
+	f.addWaiter(w)
+	return &fakeTicker{clock: f, w: w}
+}
+
+// addWaiter registers a waiter; f.mu must be held
+func (f *Fake) addWaiter(w *waiter) {
+	f.waiters = append(f.waiters, w)
+	close(f.added)
+	f.added = make(chan struct{})
+}
+
+// removeWaiter unregisters a waiter; f.mu must be held
+func (f *Fake) removeWaiter(w *waiter) {
+	for i, other := range f.waiters {
+		if other == w {
+			f.waiters = append(f.waiters[:i:i], f.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// Advance moves the clock forward by d, firing every timer and ticker that
+// becomes due
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = f.now.Add(d)
+
+	pending := f.waiters[:0:0]
+	for _, w := range f.waiters {
+		if w.at.After(f.now) {
+			pending = append(pending, w)
+			continue
+		}
+
+		// Deliver without blocking; a full ticker channel drops the tick
+		select {
+		case w.ch <- f.now:
+		default:
+		}
+
+		if w.period > 0 {
+			// Schedule the next tick after now, skipping missed ones
+			for !w.at.After(f.now) {
+				w.at = w.at.Add(w.period)
+			}
+			pending = append(pending, w)
+		}
+	}
+	f.waiters = pending
+}
+
+// Waiters returns the number of pending timers and tickers
+func (f *Fake) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.waiters)
+}
+
+// BlockUntil waits until at least n timers or tickers are pending, so a test
+// can advance the clock once the code under test is waiting on it. It returns
+// ctx's error if ctx is done first.
+func (f *Fake) BlockUntil(ctx context.Context, n int) error {
+	for {
+		f.mu.Lock()
+		count := len(f.waiters)
+		added := f.added
+		f.mu.Unlock()
+
+		if count >= n {
+			return nil
+		}
+
+		select {
+		case <-added:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// fakeTicker is a ticker driven by a Fake
+type fakeTicker struct {
+	clock *Fake
+	w     *waiter
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.w.ch }
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	t.clock.removeWaiter(t.w)
+}
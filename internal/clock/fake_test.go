@@ -0,0 +1,91 @@
+package clock
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// received reports whether ch has a value ready
+func received(ch <-chan time.Time) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestFakeAfter(t *testing.T) {
+	start := time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+
+	ch := f.After(time.Minute)
+	if received(ch) {
+		t.Fatalf("Expected no tick before the clock advances")
+	}
+
+	f.Advance(59 * time.Second)
+	if received(ch) {
+		t.Fatalf("Expected no tick before the duration has passed")
+	}
+
+	f.Advance(time.Second)
+	if !received(ch) {
+		t.Fatalf("Expected a tick once the duration has passed")
+	}
+	if f.Waiters() != 0 {
+		t.Errorf("Expected the fired timer to be removed, got %d waiters", f.Waiters())
+	}
+	if !f.Now().Equal(start.Add(time.Minute)) {
+		t.Errorf("Expected time %v, got %v", start.Add(time.Minute), f.Now())
+	}
+
+	if !received(f.After(0)) {
+		t.Errorf("Expected a zero duration to fire immediately")
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	f := NewFake(time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC))
+	ticker := f.NewTicker(time.Minute)
+
+	f.Advance(time.Minute)
+	if !received(ticker.C()) {
+		t.Fatalf("Expected a tick after one period")
+	}
+
+	// Missed ticks are dropped, not queued
+	f.Advance(3 * time.Minute)
+	if !received(ticker.C()) {
+		t.Fatalf("Expected a tick after several periods")
+	}
+	if received(ticker.C()) {
+		t.Fatalf("Expected only one pending tick")
+	}
+
+	ticker.Stop()
+	f.Advance(time.Minute)
+	if received(ticker.C()) {
+		t.Errorf("Expected no tick after Stop")
+	}
+}
+
+func TestFakeBlockUntil(t *testing.T) {
+	f := NewFake(time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC))
+
+	done := make(chan error, 1)
+	go func() { done <- f.BlockUntil(context.Background(), 2) }()
+
+	f.After(time.Minute)
+	f.After(time.Hour)
+	if err := <-done; err != nil {
+		t.Fatalf("Expected BlockUntil to return once 2 timers are pending, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := f.BlockUntil(ctx, 3); err == nil {
+		t.Errorf("Expected an error when the context is done")
+	}
+}
@@ -1,190 +1,1267 @@
 package config
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/meschansky/go-pia/internal/confpatch"
+	"github.com/meschansky/go-pia/internal/ddns"
+	"github.com/meschansky/go-pia/internal/lines"
+	"github.com/meschansky/go-pia/internal/notify"
+	"github.com/meschansky/go-pia/internal/output"
+	"github.com/meschansky/go-pia/internal/piaca"
+	"github.com/meschansky/go-pia/internal/regions"
+	"github.com/meschansky/go-pia/internal/remote"
+	"github.com/meschansky/go-pia/internal/render"
+	"github.com/meschansky/go-pia/internal/resolver"
+	"github.com/meschansky/go-pia/internal/systemd"
+	"github.com/meschansky/go-pia/internal/udpprobe"
+	"github.com/meschansky/go-pia/internal/vpn"
+)
+
+// MaxRefreshInterval is the longest refresh interval that still satisfies PIA's
+// keepalive requirement; the port is released if bindPort isn't called this often
+const MaxRefreshInterval = 15 * time.Minute
+
+// MinRefreshInterval is the shortest refresh interval allowed without --force;
+// binding more often only adds load on the gateway
+const MinRefreshInterval = time.Minute
+
+// MinInterval is the shortest refresh interval, script timeout and VPN retry
+// interval accepted. Shorter ones are more likely a wrong unit, such as 30ms
+// for 30s, than meant, and would leave scripts no time or spin the loops.
+const MinInterval = time.Second
+
+// MaxRenewBefore bounds --renew-before well within the two months PIA
+// signatures are valid for, so a new signature isn't due as soon as it's obtained
+const MaxRenewBefore = 30 * 24 * time.Hour
+
+// MaxKeepPortAttempts bounds how long a renewal can spend asking for the same
+// port again, at 10 seconds per attempt
+const MaxKeepPortAttempts = 30
+
+// MinUDPProbeInterval keeps UDP probes from flooding the reflector
+const MinUDPProbeInterval = 30 * time.Second
+
+// DefaultRuntimeOutputFile is the output file's name in the runtime directory
+// when none is given
+const DefaultRuntimeOutputFile = "port.txt"
+
+// StdoutOutput as the output file streams the port to stdout, one line per
+// change, instead of writing a file
+const StdoutOutput = "-"
+
+// VPNs go-pia can manage itself
+const (
+	// ManageOpenVPN runs openvpn with the OpenVPN config
+	ManageOpenVPN = "openvpn"
+	// ManageWireGuard brings up a WireGuard interface with wg-quick
+	ManageWireGuard = "wireguard"
 )
 
+// Output file formats
+const (
+	// OutputFormatText writes just the port number
+	OutputFormatText = "text"
+	// OutputFormatJSON writes the port with its expiry and renewal times
+	OutputFormatJSON = "json"
+
+	// SummaryPort prints just the port once it's bound
+	SummaryPort = "port"
+	// SummaryJSON prints the port with its expiry and gateway as one line of JSON
+	SummaryJSON = "json"
+
+	// ConnectViaGateway dials the gateway IP for port forwarding requests
+	ConnectViaGateway = "gateway"
+	// ConnectViaHostname dials the gateway hostname, resolved by DNS
+	ConnectViaHostname = "hostname"
+
+	// LogColorAuto colors log lines when stderr is a terminal and NO_COLOR
+	// isn't set
+	LogColorAuto = "auto"
+	// LogColorAlways colors log lines wherever they go
+	LogColorAlways = "always"
+	// LogColorNever leaves log lines plain
+	LogColorNever = "never"
+
+	// DBusSession emits D-Bus signals on the user's session bus
+	DBusSession = "session"
+	// DBusSystem emits D-Bus signals on the system bus
+	DBusSystem = "system"
+)
+
+// Names of the outputs the port is written to, as used by --output-retry,
+// the metrics and the status command
+const (
+	OutputNameFile              = "output-file"
+	OutputNameManualConnections = "manual-connections"
+	OutputNameDDNS              = "ddns"
+	OutputNamePatchFile         = "patch-file"
+	OutputNameTemplates         = "templates"
+	OutputNameUbus              = "ubus"
+	OutputNameDBusSignal        = "dbus-signal"
+)
+
+// OutputNames lists every output name
+var OutputNames = []string{OutputNameFile, OutputNameManualConnections, OutputNameDDNS, OutputNamePatchFile, OutputNameTemplates, OutputNameUbus, OutputNameDBusSignal}
+
 // Config holds the application configuration
 type Config struct {
 	// Path to the file containing PIA credentials (username and password)
 	CredentialsFile string
+	// Reject credentials files with whitespace, blank lines, a byte order mark
+	// or extra lines instead of skipping them
+	StrictCredentials bool
+	// PIA authentication token to use instead of logging in with the credentials
+	Token string
 	// Path to the file where the forwarded port will be written
 	OutputFile string
+	// Format of the output file: "text" for just the port, or "json"
+	OutputFormat string
 	// Path to the OpenVPN configuration file
 	OpenVPNConfigFile string
+	// How long startup waits for the credentials file and OpenVPN config to
+	// appear before validating them (0 doesn't wait)
+	WaitForFiles time.Duration
+	// 1-based index of the OpenVPN remote to use (0 detects the connected one)
+	RemoteIndex int
+	// Host the VPN runs on, as ssh://[user@]host[:port]; the VPN is detected and
+	// the output file written there over SSH (this host if empty)
+	RemoteHost string
+	// Interface of the PIA tunnel, to pick it when several tunnels are up (any tun
+	// interface if empty)
+	Interface string
+	// Comma-separated VPN detection strategies to try in order (the default chain if empty)
+	Detect string
+	// Address of the OpenVPN management interface, as host:port or a unix socket path
+	OpenVPNManagement string
+	// Gateway to use instead of detecting one, with the static strategy
+	Gateway string
+	// Hostname of the configured gateway (made up from its IP if empty)
+	GatewayHostname string
+	// VPN go-pia brings up and supervises itself: "openvpn", "wireguard", or
+	// empty to use one that's already running
+	ManageVPN string
+	// IP address and hostname of the PIA WireGuard server for ManageVPN=wireguard
+	WireGuardServer   string
+	WireGuardHostname string
+	// How long port forwarding may stay broken before the managed VPN switches
+	// to the next best region (0 disables)
+	FailoverAfter time.Duration
+	// Path to script to execute when the managed VPN switches regions
+	OnRegionChangeScript string
+	// Path to the cached PIA server list (derived from the output file if empty)
+	ServerListCache string
+	// How long the cached server list is used before it's downloaded again
+	ServerListCacheTTL time.Duration
+	// Path to the PEM key the server list must be signed with (PIA's key,
+	// built in, when empty)
+	ServerListKeyFile string
 	// Path to the CA certificate file
 	CACertFile string
+	// Directories, separated like PATH, searched first for a relative CA
+	// certificate path
+	CACertSearchPath string
 	// Refresh interval for port forwarding (in seconds)
 	RefreshInterval time.Duration
+	// Maximum random jitter subtracted from each refresh interval
+	RefreshJitter time.Duration
+	// Keepalive binds are skipped if the port was bound more recently than this
+	MinBindInterval time.Duration
+	// How long before expiry a new signature is requested, as a duration or a
+	// percentage of the validity left, e.g. 72h or 25%
+	RenewBefore string
+	// Signature requests retried when a new signature has a different port, to
+	// keep the one trackers know (0 takes any port)
+	KeepPortAttempts int
+	// Path to script to execute when the port couldn't be kept
+	OnPortKeepFailedScript string
+	// Inclusive range the port should be in, as MIN-MAX (any port if empty)
+	PortRange string
+	// Signature requests retried when a new signature's port is outside the
+	// port range (0 takes the first port given)
+	PortRangeAttempts int
 	// Enable debug logging
 	Debug bool
+	// Only log warnings and errors, and print the port once it's bound
+	Quiet bool
+	// Summary printed to stdout once the port is bound: "port" or "json"
+	// ("port" with Quiet, none otherwise if empty)
+	Summary string
 	// Path to script to execute when port changes
 	OnPortChangeScript string
 	// Whether to run the script synchronously (wait for completion)
 	SyncScript bool
+	// How long a port change is held back so quick changes after it are
+	// coalesced into one run of the hooks and integrations (0 runs them at once)
+	PortChangeDebounce time.Duration
+	// How long hooks and integrations keep being told about a port after it
+	// changed, so rules for it can stay until peers move on (0 disables)
+	PreviousPortGrace time.Duration
 	// Timeout for script execution (in seconds)
 	ScriptTimeout time.Duration
-	// Retry interval for VPN connection attempts (in seconds)
+	// Path to script to execute when the service shuts down
+	OnExitScript string
+	// How long shutdown waits for running scripts before giving up on them
+	ShutdownTimeout time.Duration
+	// Retry interval for VPN connection attempts
 	VPNRetryInterval time.Duration
+	// How long startup keeps trying to detect the VPN (0 for as long as it takes)
+	VPNDetectTimeout time.Duration
+	// Attempts startup makes to detect the VPN (0 for no limit)
+	VPNDetectMaxAttempts int
+	// systemd unit running the VPN, waited for before detection and followed
+	// for reconnects
+	VPNUnit string
+	// How long after its last bind the gateway recorded in the state file is
+	// reused at startup instead of detecting the VPN (0 always detects)
+	KnownGatewayMaxAge time.Duration
+	// How long idle connections to the gateway are kept open (0 disables keep-alives)
+	GatewayIdleTimeout time.Duration
+	// Maximum number of idle connections kept open to the gateway
+	GatewayMaxIdleConns int
+	// What port forwarding requests connect to: the gateway IP or the
+	// hostname (the gateway IP if empty)
+	ConnectVia string
+	// Path to write the process ID to (disabled if empty)
+	PIDFile string
+	// Run in the background, detached from the terminal
+	Daemonize bool
+	// Path to append log output to (stderr if empty)
+	LogFile string
+	// When to color log lines: auto, always or never (auto if empty)
+	LogColor string
+	// Address to serve Prometheus metrics on (disabled if empty)
+	MetricsAddr string
+	// DNS server used for all hostname lookups (system resolver if empty)
+	DNSServer string
+	// Cache hostname lookups in-process, following their TTLs
+	DNSCache bool
+	// Allow settings that are known to break port forwarding
+	Force bool
+	// Path to the JSON state file (derived from the output file if empty)
+	StateFile string
+	// Path to a marker file that exists only while the port is bound (disabled if empty)
+	ReadyFile string
+	// Directory everything written goes under, so nothing touches the current
+	// directory or /etc (disabled if empty)
+	RuntimeDir string
+	// User-Agent sent on PIA API requests (program name and version if empty)
+	UserAgent string
+	// Extra headers sent on PIA API requests, as "Name: value" pairs separated by ";"
+	RequestHeaders string
+	// Directory port_forward.json and port_forward.env are written to, in the
+	// format of PIA's manual-connections scripts (disabled if empty)
+	ManualConnectionsDir string
+	// Config file of a client the port is written into whenever it changes,
+	// e.g. Transmission's settings.json or qBittorrent.conf (disabled if empty)
+	PatchFile string
+	// Key set in the patch file: a dotted JSON path for .json files, otherwise
+	// a key=value key with an optional [section] prefix (default by file type)
+	PatchKey string
+	// Templates rendered with the port whenever it changes, as SOURCE=TARGET
+	// pairs separated by commas (disabled if empty)
+	Templates string
+	// Service told to reload after templates change: pidfile:PATH sends it
+	// SIGHUP, systemctl:UNIT runs systemctl reload (disabled if empty)
+	TemplateReload string
+	// systemd unit told about every new port over D-Bus (disabled if empty)
+	NotifyUnit string
+	// What's done to the notify unit: reload, restart, reload-or-restart or a
+	// signal such as HUP sent to its main process (default: reload)
+	NotifySignal string
+	// D-Bus bus PortChanged signals are emitted on: session or system
+	// (disabled if empty)
+	DBusSignal string
+	// Dynamic DNS provider the exit IP and port are published with:
+	// cloudflare, duckdns or http (disabled if empty)
+	DDNSProvider string
+	// Name pointed at the exit IP: a hostname in the Cloudflare zone or a
+	// DuckDNS subdomain
+	DDNSName string
+	// Cloudflare zone ID of the name
+	DDNSZone string
+	// Update URL template of the http provider, with {{.IP}}, {{.Port}} and {{.Name}}
+	DDNSURL string
+	// File holding the provider's API token
+	DDNSTokenFile string
+	// Where the port is published: txt, or an SRV service such as
+	// _minecraft._tcp (not published if empty)
+	DDNSPortRecord string
+	// URL returning the exit IP as plain text (ddns.DefaultIPURL if empty)
+	DDNSIPURL string
+	// Retry policies of outputs that differ from their defaults, as
+	// NAME=RETRIES[/DELAY] pairs separated by commas
+	OutputRetry string
+	// UDP reflector, as host[:port], asked to send datagrams to the forwarded
+	// port to check that UDP reaches it (disabled if empty)
+	UDPProbe string
+	// How often the UDP probe runs
+	UDPProbeInterval time.Duration
+	// Push notification provider: ntfy, gotify or pushover (disabled if empty)
+	Notifier string
+	// ntfy topic URL or Gotify server URL
+	NotifierURL string
+	// Pushover user or group key
+	NotifierUser string
+	// File holding the provider's access or application token
+	NotifierTokenFile string
+	// Comma-separated events to notify about, by push and email (all of them if empty)
+	NotifierEvents string
+	// Uptime monitor push URL requested after every successful bind (disabled if empty)
+	HeartbeatURL string
+	// URL requested while binding keeps failing (HeartbeatURL with /fail appended if empty)
+	HeartbeatFailURL string
+	// SMTP server notifications are emailed through, as host:port (disabled if empty)
+	SMTPServer string
+	// SMTP connection security: starttls, tls or none (by port if empty)
+	SMTPSecurity string
+	// Sender address of notification emails
+	SMTPFrom string
+	// Comma-separated recipient addresses
+	SMTPTo string
+	// SMTP login (no authentication if empty)
+	SMTPUsername string
+	// File holding the SMTP password
+	SMTPPasswordFile string
+	// How long notifications are collected before they're emailed together
+	SMTPBatchInterval time.Duration
+	// Publish port events on the OpenWrt ubus with the ubus command
+	Ubus bool
+	// Directory full HTTP request and response dumps are written to in debug mode (disabled if empty)
+	DebugDir string
+	// Fraction of binds failed on purpose, to try out hooks and alerting (disabled if 0)
+	ChaosBindFailRate float64
+	// Random delay of up to this long added to every gateway request (disabled if 0)
+	ChaosLatency time.Duration
+	// Port the gateway API is reached on instead of PIA's, for a mock gateway
+	// in tests (PIA's if 0)
+	GatewayPort int
 }
 
-// DefaultConfig returns the default configuration
+// DefaultConfig returns the default configuration, overridden by any PIA_*
+// environment variables that are set
 func DefaultConfig() *Config {
-	// Parse refresh interval from environment if set
-	refreshInterval := 15 * time.Minute
-	if refreshStr := os.Getenv("PIA_REFRESH_INTERVAL"); refreshStr != "" {
-		if refreshSec, err := time.ParseDuration(refreshStr); err == nil {
-			refreshInterval = refreshSec
+	cfg := BuiltinConfig()
+	applyEnv(cfg)
+	return cfg
+}
+
+// BuiltinConfig returns the defaults used when neither a flag nor an
+// environment variable sets an option
+func BuiltinConfig() *Config {
+	return &Config{
+		OpenVPNConfigFile:   "/etc/openvpn/client/pia.ovpn",
+		CACertFile:          "ca.rsa.4096.crt", // Will look for this in the current directory
+		RefreshInterval:     15 * time.Minute,
+		MinBindInterval:     30 * time.Second,
+		RenewBefore:         "24h",
+		ScriptTimeout:       30 * time.Second,
+		ShutdownTimeout:     10 * time.Second,
+		VPNRetryInterval:    60 * time.Second,
+		KnownGatewayMaxAge:  time.Hour,
+		GatewayIdleTimeout:  20 * time.Minute,
+		GatewayMaxIdleConns: 2,
+		OutputFormat:        OutputFormatText,
+		UDPProbeInterval:    5 * time.Minute,
+		SMTPBatchInterval:   5 * time.Minute,
+		ServerListCacheTTL:  time.Hour,
+		PortRangeAttempts:   10,
+	}
+}
+
+// ParseArgs builds a configuration from the environment and the command line
+// arguments (without the program name). Flags override environment variables.
+func ParseArgs(args []string) (*Config, error) {
+	cfg := DefaultConfig()
+	fs := flag.NewFlagSet("go-pia-port-forwarding", flag.ContinueOnError)
+	if err := ParseFlags(fs, cfg, args); err != nil {
+		return nil, err
+	}
+	// The service doesn't start with settings it would silently ignore
+	if err := checkEnv(fs); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ParseFlags registers the configuration flags on fs and parses args into cfg.
+// The output file is taken from the only positional argument, if given.
+func ParseFlags(fs *flag.FlagSet, cfg *Config, args []string) error {
+	RegisterFlags(fs, cfg)
+
+	// Parse the flags
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// Get the output file from the first non-flag argument
+	if fs.NArg() > 1 {
+		return fmt.Errorf("unexpected arguments after output file: %s", strings.Join(fs.Args()[1:], " "))
+	}
+	if fs.NArg() == 1 {
+		cfg.OutputFile = fs.Arg(0)
+	}
+
+	cfg.applyRuntimeDir()
+	return nil
+}
+
+// applyRuntimeDir moves the writable paths under the runtime directory and
+// switches a default CA certificate to the built-in one. Nothing changes if the
+// directory isn't absolute, which Validate reports.
+func (c *Config) applyRuntimeDir() {
+	if !filepath.IsAbs(c.RuntimeDir) {
+		return
+	}
+
+	if c.OutputFile == "" {
+		c.OutputFile = filepath.Join(c.RuntimeDir, DefaultRuntimeOutputFile)
+	}
+	// Streaming to stdout involves no file
+	if c.OutputFile != StdoutOutput && !filepath.IsAbs(c.OutputFile) {
+		c.OutputFile = filepath.Join(c.RuntimeDir, c.OutputFile)
+	}
+	for _, path := range []*string{&c.StateFile, &c.ServerListCache, &c.ReadyFile, &c.PIDFile, &c.LogFile, &c.DebugDir} {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(c.RuntimeDir, *path)
 		}
 	}
 
-	// Parse script timeout from environment if set
-	scriptTimeout := 30 * time.Second
-	if timeoutStr := os.Getenv("PIA_SCRIPT_TIMEOUT"); timeoutStr != "" {
-		if timeout, err := time.ParseDuration(timeoutStr); err == nil {
-			scriptTimeout = timeout
+	// The relative default would be looked up in the current directory and /etc
+	if c.CACertFile == BuiltinConfig().CACertFile {
+		c.CACertFile = piaca.Embedded
+	}
+}
+
+// RegisterFlags defines command line flags for all configuration options on fs,
+// using the current values in cfg as defaults. Hidden options are left out of
+// fs's usage message.
+func RegisterFlags(fs *flag.FlagSet, cfg *Config) {
+	for _, o := range options() {
+		if o.flag != "" {
+			o.define(fs, o.flag, cfg)
 		}
 	}
+	fs.Usage = func() { printUsage(fs) }
+}
 
-	// Parse VPN retry interval from environment if set
-	vpnRetryInterval := 60 * time.Second
-	if retryStr := os.Getenv("PIA_VPN_RETRY_INTERVAL"); retryStr != "" {
-		if retry, err := time.ParseDuration(retryStr); err == nil {
-			vpnRetryInterval = retry
+// Args returns command line arguments that reproduce the configuration; unset
+// optional settings are omitted and the output file comes last
+func (c *Config) Args() []string {
+	var args []string
+	builtin := BuiltinConfig()
+	unset := &Config{}
+	for _, o := range options() {
+		if o.flag == "" {
+			continue
+		}
+
+		// Leave out zero values unless the flag would otherwise default to something else
+		value := o.value(c).String()
+		zero := o.value(unset).String()
+		if value == zero && o.value(builtin).String() == zero {
+			continue
+		}
+
+		if o.isBool() && value == "true" {
+			args = append(args, "--"+o.flag)
+		} else {
+			args = append(args, "--"+o.flag+"="+value)
 		}
 	}
 
-	return &Config{
-		CredentialsFile:    os.Getenv("PIA_CREDENTIALS"),
-		OpenVPNConfigFile:  "/etc/openvpn/client/pia.ovpn",
-		CACertFile:         "ca.rsa.4096.crt", // Will look for this in the current directory
-		RefreshInterval:    refreshInterval,
-		Debug:              os.Getenv("PIA_DEBUG") == "true",
-		OnPortChangeScript: os.Getenv("PIA_ON_PORT_CHANGE"),
-		SyncScript:         os.Getenv("PIA_SYNC_SCRIPT") == "true",
-		ScriptTimeout:      scriptTimeout,
-		VPNRetryInterval:   vpnRetryInterval,
+	if c.OutputFile != "" {
+		args = append(args, c.OutputFile)
 	}
+
+	return args
 }
 
-// SetupFlags registers command line flags for all configuration options
-func SetupFlags(cfg *Config) {
-	// Define command line flags for all configuration options
-	flag.StringVar(&cfg.CredentialsFile, "credentials", cfg.CredentialsFile, "Path to the file containing PIA credentials (username and password)")
+// Validate checks if the configuration is valid. Every problem found is
+// reported at once, joined into a single error.
+func (c *Config) Validate() error {
+	var errs []error
+	addError := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Token != "" {
+		if c.CredentialsFile != "" {
+			addError("--token and --credentials are mutually exclusive")
+		}
+		if c.ManageVPN == ManageOpenVPN {
+			addError("managing OpenVPN requires --credentials, OpenVPN logs in with them")
+		}
+	} else if c.CredentialsFile == "" {
+		addError("credentials file path is required (set PIA_CREDENTIALS or --credentials, or pass a token with PIA_TOKEN)")
+	} else if err := checkReadable(c.CredentialsFile); err != nil {
+		addError("credentials file %s is not readable: %v", c.CredentialsFile, unwrapPathError(err))
+	}
+
+	if c.OutputFile == "" {
+		addError("output file path is required (provide as first argument or set PIA_OUTPUT_FILE)")
+	}
+
+	// An unset format is plain text
+	if c.OutputFormat != "" && c.OutputFormat != OutputFormatText && c.OutputFormat != OutputFormatJSON {
+		addError("output format must be %q or %q, got %q", OutputFormatText, OutputFormatJSON, c.OutputFormat)
+	}
+
+	if c.CACertFile == "" {
+		addError("CA certificate path is required (set --ca-cert)")
+	} else if caCertPath, err := c.CACertPath(); err != nil {
+		addError("%v (download it as described in CA_CERTIFICATE.md or set --ca-cert)", err)
+	} else if caCertPath == piaca.Embedded || caCertPath == piaca.Download {
+		// Built into the binary, or downloaded at startup
+	} else if err := checkReadable(caCertPath); err != nil {
+		addError("CA certificate %s is not readable: %v", caCertPath, unwrapPathError(err))
+	}
 
-	flag.StringVar(&cfg.OpenVPNConfigFile, "openvpn-config", cfg.OpenVPNConfigFile, "Path to the OpenVPN configuration file")
+	if c.OnPortChangeScript != "" {
+		if _, err := exec.LookPath(c.OnPortChangeScript); err != nil {
+			addError("--on-port-change script %s is not an executable file (check that it exists and has the execute bit set): %v", c.OnPortChangeScript, unwrapPathError(err))
+		}
+	}
 
-	flag.StringVar(&cfg.CACertFile, "ca-cert", cfg.CACertFile, "Path to the CA certificate file")
+	// Intervals must be positive or the loops would spin
+	checkInterval := func(name string, d time.Duration) {
+		if d <= 0 {
+			addError("%s must be positive, got %s", name, d)
+		} else if d < MinInterval {
+			addError("%s must be at least %s, got %s", name, MinInterval, d)
+		}
+	}
+	checkInterval("refresh interval", c.RefreshInterval)
+	if c.RefreshInterval > MaxRefreshInterval && !c.Force {
+		// PIA releases the port if it isn't bound at least every 15 minutes
+		addError("refresh interval %s exceeds the %s PIA keepalive limit and the port would be released (use --force to override)", c.RefreshInterval, MaxRefreshInterval)
+	} else if c.RefreshInterval >= MinInterval && c.RefreshInterval < MinRefreshInterval && !c.Force {
+		addError("refresh interval %s is below %s and would hammer the PIA API (use --force to override)", c.RefreshInterval, MinRefreshInterval)
+	}
 
-	// Use a string variable for duration flags, will be parsed after flag.Parse()
-	refreshIntervalStr := flag.String("refresh-interval", "", "Refresh interval for port forwarding (e.g., 15m, 900s)")
+	if c.RefreshJitter < 0 {
+		addError("refresh jitter must not be negative, got %s", c.RefreshJitter)
+	}
 
-	scriptTimeoutStr := flag.String("script-timeout", "", "Timeout for script execution (e.g., 30s, 1m)")
+	if c.MinBindInterval < 0 {
+		addError("minimum bind interval must not be negative, got %s", c.MinBindInterval)
+	}
 
-	vpnRetryIntervalStr := flag.String("vpn-retry-interval", "", "Retry interval for VPN connection attempts (e.g., 60s, 1m)")
+	if c.KeepPortAttempts < 0 || c.KeepPortAttempts > MaxKeepPortAttempts {
+		addError("keep port attempts must be between 0 and %d, got %d", MaxKeepPortAttempts, c.KeepPortAttempts)
+	}
+	if c.OnPortKeepFailedScript != "" {
+		if c.KeepPortAttempts == 0 {
+			addError("--on-port-keep-failed requires --keep-port-attempts")
+		} else if _, err := exec.LookPath(c.OnPortKeepFailedScript); err != nil {
+			addError("--on-port-keep-failed script %s is not an executable file (check that it exists and has the execute bit set): %v", c.OnPortKeepFailedScript, unwrapPathError(err))
+		}
+	}
 
-	flag.BoolVar(&cfg.Debug, "debug", cfg.Debug, "Enable debug logging")
+	if c.RenewBefore != "" {
+		if _, _, err := ParseRenewBefore(c.RenewBefore); err != nil {
+			addError("invalid --renew-before: %w", err)
+		}
+	}
 
-	flag.StringVar(&cfg.OnPortChangeScript, "on-port-change", cfg.OnPortChangeScript, "Script to execute when port changes")
+	if c.PortRange != "" {
+		if _, _, err := ParsePortRange(c.PortRange); err != nil {
+			addError("invalid port range: %w", err)
+		}
+	}
+	if c.PortRangeAttempts < 0 || c.PortRangeAttempts > MaxKeepPortAttempts {
+		addError("port range attempts must be between 0 and %d, got %d", MaxKeepPortAttempts, c.PortRangeAttempts)
+	}
 
-	flag.BoolVar(&cfg.SyncScript, "sync-script", cfg.SyncScript, "Whether to run the script synchronously (wait for completion)")
+	if c.PortChangeDebounce < 0 {
+		addError("port change debounce must not be negative, got %s", c.PortChangeDebounce)
+	}
+	if c.PreviousPortGrace < 0 {
+		addError("previous port grace must not be negative, got %s", c.PreviousPortGrace)
+	}
 
-	// Parse the flags
-	flag.Parse()
+	checkInterval("script timeout", c.ScriptTimeout)
 
-	// Get the output file from the first non-flag argument
-	if flag.NArg() > 0 {
-		cfg.OutputFile = flag.Arg(0)
+	if c.OnExitScript != "" {
+		if _, err := exec.LookPath(c.OnExitScript); err != nil {
+			addError("--on-exit script %s is not an executable file (check that it exists and has the execute bit set): %v", c.OnExitScript, unwrapPathError(err))
+		}
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		addError("shutdown timeout must be positive, got %s", c.ShutdownTimeout)
+	}
+
+	checkInterval("VPN retry interval", c.VPNRetryInterval)
+	if c.WaitForFiles < 0 {
+		addError("wait for files must not be negative, got %s", c.WaitForFiles)
+	}
+	if c.VPNDetectTimeout < 0 {
+		addError("VPN detect timeout must not be negative, got %s", c.VPNDetectTimeout)
+	}
+	if c.VPNDetectMaxAttempts < 0 {
+		addError("VPN detect max attempts must not be negative, got %d", c.VPNDetectMaxAttempts)
+	}
+	if c.KnownGatewayMaxAge < 0 {
+		addError("known gateway max age must not be negative, got %s", c.KnownGatewayMaxAge)
+	}
+
+	if c.RemoteIndex < 0 {
+		addError("remote index must not be negative")
+	}
+
+	if c.RemoteHost != "" {
+		if _, err := remote.Parse(c.RemoteHost); err != nil {
+			addError("invalid remote host: %w", err)
+		}
+	}
+
+	if c.RuntimeDir != "" {
+		if !filepath.IsAbs(c.RuntimeDir) {
+			addError("runtime directory must be an absolute path, got %q", c.RuntimeDir)
+		}
+		if c.RemoteHost != "" {
+			addError("--runtime-dir places the output file on this host and can't be used with a remote host")
+		}
+	}
+
+	if _, err := vpn.ParseStrategies(c.Detect); err != nil {
+		addError("invalid detection strategies: %w", err)
+	}
+
+	if c.Gateway != "" && net.ParseIP(c.Gateway) == nil {
+		addError("gateway must be an IP address, got %q", c.Gateway)
+	}
+
+	switch c.ManageVPN {
+	case "":
+	case ManageOpenVPN, ManageWireGuard:
+		if c.RemoteHost != "" {
+			addError("the VPN can't be managed on a remote host")
+		}
+		commands := []string{"openvpn"}
+		if c.ManageVPN == ManageWireGuard {
+			commands = []string{"wg-quick", "wg"}
+			if net.ParseIP(c.WireGuardServer) == nil {
+				addError("managing WireGuard requires the server IP address, got %q", c.WireGuardServer)
+			}
+			if c.WireGuardHostname == "" {
+				addError("managing WireGuard requires the server hostname")
+			}
+		}
+		for _, command := range commands {
+			if _, err := exec.LookPath(command); err != nil {
+				addError("managing %s requires the %s command: %w", c.ManageVPN, command, err)
+			}
+		}
+	default:
+		addError("managed VPN must be %q or %q, got %q", ManageOpenVPN, ManageWireGuard, c.ManageVPN)
+	}
+
+	if c.FailoverAfter < 0 {
+		addError("failover delay must not be negative, got %s", c.FailoverAfter)
+	} else if c.FailoverAfter > 0 && c.ManageVPN == "" {
+		addError("region failover requires a managed VPN (set --manage-vpn)")
+	}
+
+	if c.ServerListCacheTTL < 0 {
+		addError("server list cache TTL must not be negative, got %s", c.ServerListCacheTTL)
+	}
+	if c.ServerListKeyFile != "" {
+		if data, err := os.ReadFile(c.ServerListKeyFile); err != nil {
+			addError("server list key %s is not readable: %v", c.ServerListKeyFile, unwrapPathError(err))
+		} else if _, err := regions.ParsePublicKey(data); err != nil {
+			addError("server list key %s is invalid: %v", c.ServerListKeyFile, err)
+		}
+	}
+
+	if c.OnRegionChangeScript != "" {
+		if _, err := exec.LookPath(c.OnRegionChangeScript); err != nil {
+			addError("--on-region-change script %s is not an executable file (check that it exists and has the execute bit set): %v", c.OnRegionChangeScript, unwrapPathError(err))
+		}
+	}
+
+	if c.PatchFile != "" {
+		if c.RemoteHost != "" {
+			addError("--patch-file edits a local file and can't be used with a remote host")
+		} else if err := confpatch.Check(c.PatchFile); err != nil {
+			addError("--patch-file %s can't be patched (it must exist, and .json files must hold a JSON object): %v", c.PatchFile, unwrapPathError(err))
+		}
+	} else if c.PatchKey != "" {
+		addError("--patch-key requires --patch-file")
+	}
+
+	if templates, err := render.ParseTemplates(c.Templates); err != nil {
+		addError("invalid templates: %w", err)
+	} else if len(templates) > 0 && c.RemoteHost != "" {
+		addError("--templates renders local files and can't be used with a remote host")
+	} else {
+		for _, t := range templates {
+			if err := t.Check(); err != nil {
+				addError("template %s: %v", t.Source, unwrapPathError(err))
+			}
+		}
+	}
+	if c.TemplateReload != "" {
+		if _, err := render.ParseReload(c.TemplateReload); err != nil {
+			addError("invalid template reload: %w", err)
+		} else if c.Templates == "" {
+			addError("--template-reload requires --templates")
+		}
+	}
+
+	if policies, err := output.ParseRetryPolicies(c.OutputRetry); err != nil {
+		addError("invalid output retry: %w", err)
+	} else {
+		for name := range policies {
+			if !slices.Contains(OutputNames, name) {
+				addError("invalid output retry: unknown output %q, expected one of %s", name, strings.Join(OutputNames, ", "))
+			}
+		}
+	}
+
+	if c.VPNUnit != "" {
+		if runtime.GOOS != "linux" {
+			addError("--vpn-unit requires systemd, which is only available on Linux")
+		} else if c.RemoteHost != "" {
+			addError("--vpn-unit follows the local systemd and can't be used with a remote host")
+		}
+		if c.ManageVPN != "" {
+			addError("--vpn-unit can't be used with --manage-vpn, which runs the VPN itself")
+		}
 	}
 
-	// Parse duration flags if provided
-	if *refreshIntervalStr != "" {
-		if d, err := time.ParseDuration(*refreshIntervalStr); err == nil {
-			cfg.RefreshInterval = d
+	if c.NotifyUnit != "" {
+		if runtime.GOOS != "linux" {
+			addError("--notify-unit requires systemd, which is only available on Linux")
+		} else if c.RemoteHost != "" {
+			addError("--notify-unit talks to the local systemd and can't be used with a remote host")
 		}
+	} else if c.NotifySignal != "" {
+		addError("--notify-signal requires --notify-unit")
+	}
+	if c.NotifySignal != "" {
+		if _, err := systemd.ParseAction(c.NotifySignal); err != nil {
+			addError("invalid notify signal: %w", err)
+		}
+	}
+
+	switch c.DBusSignal {
+	case "", DBusSession, DBusSystem:
+		if c.DBusSignal != "" && runtime.GOOS == "windows" {
+			addError("D-Bus signals aren't available on Windows")
+		}
+	default:
+		addError("D-Bus signal bus must be %q or %q, got %q", DBusSession, DBusSystem, c.DBusSignal)
+	}
+
+	if c.DDNSProvider != "" {
+		settings := ddns.Settings{Provider: c.DDNSProvider, Name: c.DDNSName, Zone: c.DDNSZone, URL: c.DDNSURL, PortRecord: c.DDNSPortRecord}
+		if err := settings.Check(); err != nil {
+			addError("invalid dynamic DNS settings: %w", err)
+		}
+		if c.RemoteHost != "" {
+			addError("--ddns-provider looks up the exit IP from this host and can't be used with a remote host")
+		}
+		if c.DDNSTokenFile != "" {
+			if err := checkReadable(c.DDNSTokenFile); err != nil {
+				addError("DDNS token file %s is not readable: %v", c.DDNSTokenFile, unwrapPathError(err))
+			}
+		} else if c.DDNSProvider != ddns.ProviderHTTP {
+			addError("--ddns-provider=%s requires --ddns-token-file", c.DDNSProvider)
+		}
+	} else if c.DDNSName != "" || c.DDNSZone != "" || c.DDNSURL != "" || c.DDNSTokenFile != "" || c.DDNSPortRecord != "" || c.DDNSIPURL != "" {
+		addError("--ddns-* options require --ddns-provider")
+	}
+
+	if c.Notifier != "" {
+		settings := notify.Settings{Provider: c.Notifier, URL: c.NotifierURL, User: c.NotifierUser}
+		if err := settings.Check(); err != nil {
+			addError("invalid notifier settings: %w", err)
+		}
+		if c.NotifierTokenFile != "" {
+			if err := checkReadable(c.NotifierTokenFile); err != nil {
+				addError("notifier token file %s is not readable: %v", c.NotifierTokenFile, unwrapPathError(err))
+			}
+		} else if c.Notifier != notify.ProviderNtfy {
+			addError("--notifier=%s requires --notifier-token-file", c.Notifier)
+		}
+	} else if c.NotifierURL != "" || c.NotifierUser != "" || c.NotifierTokenFile != "" {
+		addError("--notifier-* options require --notifier")
+	}
+
+	if c.HeartbeatURL != "" {
+		for _, u := range []struct{ flag, value string }{{"heartbeat-url", c.HeartbeatURL}, {"heartbeat-fail-url", c.HeartbeatFailURL}} {
+			if u.value == "" {
+				continue
+			}
+			if parsed, err := url.Parse(u.value); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				addError("--%s must be an http or https URL", u.flag)
+			}
+		}
+	} else if c.HeartbeatFailURL != "" {
+		addError("--heartbeat-fail-url requires --heartbeat-url")
+	}
+
+	if c.SMTPServer != "" {
+		if err := c.Mailer().Check(); err != nil {
+			addError("invalid SMTP settings: %w", err)
+		}
+		if c.SMTPPasswordFile != "" {
+			if err := checkReadable(c.SMTPPasswordFile); err != nil {
+				addError("SMTP password file %s is not readable: %v", c.SMTPPasswordFile, unwrapPathError(err))
+			}
+			if c.SMTPUsername == "" {
+				addError("--smtp-password-file requires --smtp-username")
+			}
+		}
+		if c.SMTPBatchInterval < 0 {
+			addError("SMTP batch interval must not be negative, got %s", c.SMTPBatchInterval)
+		}
+	} else if c.SMTPSecurity != "" || c.SMTPFrom != "" || c.SMTPTo != "" || c.SMTPUsername != "" || c.SMTPPasswordFile != "" {
+		addError("--smtp-* options require --smtp-server")
+	}
+
+	if c.Notifier != "" || c.SMTPServer != "" {
+		if _, err := notify.ParseEvents(c.NotifierEvents); err != nil {
+			addError("invalid notifier events: %w", err)
+		}
+	} else if c.NotifierEvents != "" {
+		addError("--notifier-events requires --notifier or --smtp-server")
+	}
+
+	if c.UDPProbe != "" {
+		if _, err := udpprobe.ReflectorAddress(c.UDPProbe); err != nil {
+			addError("invalid UDP probe reflector: %w", err)
+		}
+		if c.RemoteHost != "" {
+			addError("--udp-probe listens on the forwarded port on this host and can't be used with a remote host")
+		}
+		if c.UDPProbeInterval < MinUDPProbeInterval {
+			addError("UDP probe interval must be at least %s, got %s", MinUDPProbeInterval, c.UDPProbeInterval)
+		}
+	}
+
+	// With a remote host, ubus is the remote host's
+	if c.Ubus && c.RemoteHost == "" {
+		if _, err := exec.LookPath("ubus"); err != nil {
+			addError("ubus events require the ubus command, which is only available on OpenWrt: %w", err)
+		}
+	}
+
+	if c.GatewayIdleTimeout < 0 {
+		addError("gateway idle timeout must not be negative")
 	}
 
-	if *scriptTimeoutStr != "" {
-		if d, err := time.ParseDuration(*scriptTimeoutStr); err == nil {
-			cfg.ScriptTimeout = d
+	if c.GatewayMaxIdleConns < 0 {
+		addError("gateway max idle connections must not be negative")
+	}
+
+	if c.Summary != "" && c.Summary != SummaryPort && c.Summary != SummaryJSON {
+		addError("--summary must be %q or %q, got %q", SummaryPort, SummaryJSON, c.Summary)
+	}
+	if c.LogColor != "" && c.LogColor != LogColorAuto && c.LogColor != LogColorAlways && c.LogColor != LogColorNever {
+		addError("--log-color must be %q, %q or %q, got %q", LogColorAuto, LogColorAlways, LogColorNever, c.LogColor)
+	}
+	if c.Quiet && c.Debug {
+		addError("--quiet and --debug can't be combined")
+	}
+
+	// Streaming needs stdout to stay attached to whatever reads it
+	if c.StreamsOutput() {
+		if c.Daemonize {
+			addError("--daemonize can't be used with output file %s, the port is streamed to stdout", StdoutOutput)
+		}
+		if c.Summary != "" {
+			addError("--summary can't be used with output file %s, the port is streamed to stdout", StdoutOutput)
+		}
+		if c.RemoteHost != "" {
+			addError("--remote-host can't be used with output file %s, the port is streamed to stdout", StdoutOutput)
+		}
+		if c.CACertFile == piaca.Download && c.StateFile == "" {
+			addError("--ca-cert=%s with output file %s requires --state-file, the certificate is saved next to it", piaca.Download, StdoutOutput)
 		}
 	}
 
-	if *vpnRetryIntervalStr != "" {
-		if d, err := time.ParseDuration(*vpnRetryIntervalStr); err == nil {
-			cfg.VPNRetryInterval = d
+	if c.ConnectVia != "" && c.ConnectVia != ConnectViaGateway && c.ConnectVia != ConnectViaHostname {
+		addError("--connect-via must be %q or %q, got %q", ConnectViaGateway, ConnectViaHostname, c.ConnectVia)
+	}
+
+	if c.DNSServer != "" {
+		if err := resolver.Validate(c.DNSServer); err != nil {
+			addError("invalid DNS server: %w", err)
 		}
 	}
+
+	if _, err := c.Headers(); err != nil {
+		addError("invalid request headers: %w", err)
+	}
+
+	if strings.ContainsAny(c.UserAgent, "\r\n") {
+		addError("user agent must be a single line")
+	}
+
+	if c.ChaosBindFailRate < 0 || c.ChaosBindFailRate > 1 {
+		addError("chaos bind fail rate must be between 0 and 1, got %v", c.ChaosBindFailRate)
+	}
+	if c.ChaosLatency < 0 {
+		addError("chaos latency must not be negative, got %s", c.ChaosLatency)
+	}
+	if c.GatewayPort < 0 || c.GatewayPort > 65535 {
+		addError("gateway port must be between 0 and 65535, got %d", c.GatewayPort)
+	}
+
+	// Files written by the service must not overwrite each other
+	if c.OutputFile != "" && !c.StreamsOutput() {
+		for _, other := range []struct{ name, path string }{
+			{"state file", c.StateFile},
+			{"server list cache", c.ServerListCache},
+			{"ready file", c.ReadyFile},
+			{"PID file", c.PIDFile},
+			{"log file", c.LogFile},
+		} {
+			if other.path != "" && filepath.Clean(other.path) == filepath.Clean(c.OutputFile) {
+				addError("%s and output file must be different paths (both are %s)", other.name, c.OutputFile)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	// Ensure the runtime and output file directories exist
+	if c.RuntimeDir != "" {
+		if err := os.MkdirAll(c.RuntimeDir, 0755); err != nil {
+			return fmt.Errorf("failed to create runtime directory: %w", err)
+		}
+	}
+	var dirs []struct{ name, path string }
+	if !c.StreamsOutput() {
+		outputDir := filepath.Dir(c.OutputFile)
+		if _, err := os.Stat(outputDir); os.IsNotExist(err) {
+			if err := os.MkdirAll(outputDir, 0755); err != nil {
+				return fmt.Errorf("failed to create output directory: %w", err)
+			}
+		}
+		dirs = append(dirs, struct{ name, path string }{"output directory", outputDir})
+	}
+	if c.StateFile != "" && (c.StreamsOutput() || filepath.Dir(c.StateFile) != filepath.Dir(c.OutputFile)) {
+		dirs = append(dirs, struct{ name, path string }{"state file directory", filepath.Dir(c.StateFile)})
+	}
+
+	// Fail now rather than at the first bind if they can't be written to,
+	// e.g. on a read-only mount
+	for _, dir := range dirs {
+		if err := checkWritableDir(dir.path); err != nil {
+			errs = append(errs, fmt.Errorf("%s %s is not writable: %w", dir.name, dir.path, err))
+		}
+	}
+	return errors.Join(errs...)
 }
 
-// Validate checks if the configuration is valid
-func (c *Config) Validate() error {
-	if c.CredentialsFile == "" {
-		return fmt.Errorf("credentials file path is required (set PIA_CREDENTIALS environment variable)")
+// checkWritableDir creates and removes a file in dir. If that fails, the
+// error names the mount dir is on and its options, such as ro, where known.
+func checkWritableDir(dir string) error {
+	file, err := os.CreateTemp(dir, ".go-pia-write-test-*")
+	if err != nil {
+		err = unwrapPathError(err)
+		if mountPoint, options, ok := mountOptions(dir); ok {
+			return fmt.Errorf("%w (mounted at %s with %s)", err, mountPoint, options)
+		}
+		return err
 	}
+	file.Close()
+	return os.Remove(file.Name())
+}
 
-	if c.OutputFile == "" {
-		return fmt.Errorf("output file path is required (provide as first argument)")
+// Mailer returns a mailer for the SMTP settings, without the password, which
+// is read from its file just before sending
+func (c *Config) Mailer() *notify.Mailer {
+	var to []string
+	for _, addr := range strings.Split(c.SMTPTo, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			to = append(to, addr)
+		}
+	}
+	return &notify.Mailer{
+		Server:   c.SMTPServer,
+		Security: c.SMTPSecurity,
+		From:     c.SMTPFrom,
+		To:       to,
+		Username: c.SMTPUsername,
+	}
+}
+
+// ResolveCACertPath finds the CA certificate. Relative paths are looked up in
+// the directories CACertSearchDirs returns by default.
+func ResolveCACertPath(certPath string) (string, error) {
+	return FindCACert(certPath, CACertSearchDirs(""))
+}
+
+// Warnings returns the settings that are allowed but likely to cause trouble:
+// refresh intervals outside PIA's limits, which --force lets through, and a
+// script timeout longer than the refresh interval
+func (c *Config) Warnings() []string {
+	var warnings []string
+	if c.RefreshInterval > MaxRefreshInterval {
+		warnings = append(warnings, fmt.Sprintf("refresh interval %s exceeds the %s PIA keepalive limit, the forwarded port will be released between refreshes", c.RefreshInterval, MaxRefreshInterval))
+	} else if c.RefreshInterval < MinRefreshInterval {
+		warnings = append(warnings, fmt.Sprintf("refresh interval %s is below %s, binding this often only adds load on the PIA gateway", c.RefreshInterval, MinRefreshInterval))
+	}
+	if c.ScriptTimeout > c.RefreshInterval {
+		warnings = append(warnings, fmt.Sprintf("script timeout %s exceeds the refresh interval %s, so a slow script may still run when the port changes again", c.ScriptTimeout, c.RefreshInterval))
+	}
+	return warnings
+}
+
+// StartupFiles returns the files startup can wait for with --wait-for-files:
+// the credentials file and, when it's read on this host for OpenVPN, the
+// OpenVPN config
+func (c *Config) StartupFiles() []string {
+	var files []string
+	if c.CredentialsFile != "" {
+		files = append(files, c.CredentialsFile)
 	}
+	if c.OpenVPNConfigFile != "" && c.RemoteHost == "" && c.ManageVPN != ManageWireGuard {
+		files = append(files, c.OpenVPNConfigFile)
+	}
+	return files
+}
+
+// StreamsOutput reports whether the port is streamed to stdout instead of
+// written to a file
+func (c *Config) StreamsOutput() bool {
+	return c.OutputFile == StdoutOutput
+}
+
+// SummaryFormat returns how the summary is printed once the port is bound,
+// or "" if it isn't
+func (c *Config) SummaryFormat() string {
+	// The port stream is all that goes to stdout
+	if c.StreamsOutput() {
+		return ""
+	}
+	if c.Summary == "" && c.Quiet {
+		return SummaryPort
+	}
+	return c.Summary
+}
+
+// CACertPath finds the configured CA certificate, looking a relative path up
+// in the configured search path first
+func (c *Config) CACertPath() (string, error) {
+	return FindCACert(c.CACertFile, CACertSearchDirs(c.CACertSearchPath))
+}
+
+// CACertSearchDirs returns the directories a relative CA certificate path is
+// looked up in: those in searchPath, a list separated like PATH, then the
+// current directory, the binary's directory, go-pia in the XDG data
+// directories, and /etc/openvpn/client. Containers and packages install the
+// certificate next to the binary or under /usr/share rather than in the
+// directory the service starts in.
+func CACertSearchDirs(searchPath string) []string {
+	var dirs []string
+	if searchPath != "" {
+		dirs = append(dirs, filepath.SplitList(searchPath)...)
+	}
+	dirs = append(dirs, ".")
+	if exe, err := os.Executable(); err == nil {
+		dirs = append(dirs, filepath.Dir(exe))
+	}
+
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			dataHome = filepath.Join(home, ".local", "share")
+		}
+	}
+	dataDirs := os.Getenv("XDG_DATA_DIRS")
+	if dataDirs == "" {
+		dataDirs = "/usr/local/share:/usr/share"
+	}
+	for _, dir := range append([]string{dataHome}, filepath.SplitList(dataDirs)...) {
+		if dir != "" {
+			dirs = append(dirs, filepath.Join(dir, "go-pia"))
+		}
+	}
+
+	return append(dirs, "/etc/openvpn/client")
+}
 
-	// Check if credentials file exists
-	if _, err := os.Stat(c.CredentialsFile); os.IsNotExist(err) {
-		return fmt.Errorf("credentials file does not exist: %s", c.CredentialsFile)
+// FindCACert returns certPath if it's absolute, the built-in certificate or
+// one to download, or else the first file by that name in dirs
+func FindCACert(certPath string, dirs []string) (string, error) {
+	if filepath.IsAbs(certPath) || certPath == piaca.Embedded || certPath == piaca.Download {
+		return certPath, nil
 	}
 
-	// Ensure the output file directory exists
-	outputDir := filepath.Dir(c.OutputFile)
-	if _, err := os.Stat(outputDir); os.IsNotExist(err) {
-		if err := os.MkdirAll(outputDir, 0755); err != nil {
-			return fmt.Errorf("failed to create output directory: %w", err)
+	for _, dir := range dirs {
+		path := filepath.Join(dir, certPath)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
 		}
 	}
 
+	return "", fmt.Errorf("CA certificate file not found: %s (searched %s)", certPath, strings.Join(dirs, ", "))
+}
+
+// checkReadable verifies that a regular file can be opened for reading
+func checkReadable(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("is a directory")
+	}
 	return nil
 }
 
-// LoadCredentials loads the PIA credentials from the credentials file
+// unwrapPathError drops the path from an error that's already reported alongside it
+func unwrapPathError(err error) error {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+	var execErr *exec.Error
+	if errors.As(err, &execErr) {
+		return execErr.Err
+	}
+	return err
+}
+
+// LoadCredentials loads the PIA credentials from the credentials file, as
+// parseCredentials reads them
 func (c *Config) LoadCredentials() (username, password string, err error) {
 	data, err := os.ReadFile(c.CredentialsFile)
 	if err != nil {
 		return "", "", fmt.Errorf("failed to read credentials file: %w", err)
 	}
 
-	lines := splitLines(string(data))
-	if len(lines) < 2 {
-		return "", "", fmt.Errorf("invalid credentials file format: expected at least 2 lines")
+	username, password, extra, err := parseCredentials(string(data), c.StrictCredentials)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid credentials file %s: %w", c.CredentialsFile, err)
+	}
+	if extra > 0 {
+		log.Printf("Warning: ignored %d lines after the password in credentials file %s", extra, c.CredentialsFile)
+	}
+	return username, password, nil
+}
+
+// parseCredentials reads the username and password from the first two lines
+// of a credentials file and counts the lines after them. Whitespace around
+// them, blank lines and a byte order mark, as copying and pasting leave, are
+// skipped; strict makes them errors, as well as lines after the password.
+// Errors only give line numbers, never what the lines hold.
+func parseCredentials(data string, strict bool) (username, password string, extra int, err error) {
+	if strict && strings.HasPrefix(data, "\uFEFF") {
+		return "", "", 0, errors.New("starts with a byte order mark")
 	}
 
-	return lines[0], lines[1], nil
+	var values []string
+	for i, line := range lines.Split(data) {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strict && trimmed == "":
+			return "", "", 0, fmt.Errorf("line %d is blank", i+1)
+		case strict && trimmed != line:
+			return "", "", 0, fmt.Errorf("line %d has whitespace around it", i+1)
+		case trimmed != "":
+			values = append(values, trimmed)
+		}
+	}
+
+	switch {
+	case len(values) == 0:
+		return "", "", 0, errors.New("no username or password found, expected them on the first two lines")
+	case len(values) == 1:
+		return "", "", 0, errors.New("no password found, expected it on the line after the username")
+	case strict && len(values) > 2:
+		return "", "", 0, fmt.Errorf("expected 2 lines, found %d", len(values))
+	}
+	return values[0], values[1], len(values) - 2, nil
 }
 
-// Helper function to split a string into lines
-func splitLines(s string) []string {
-	var lines []string
-	var line string
+// ParsePortRange parses a port range given as MIN-MAX, both inclusive
+func ParsePortRange(s string) (lowest, highest int, err error) {
+	lowText, highText, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("expected MIN-MAX, got %q", s)
+	}
+	lowest, lowErr := strconv.Atoi(strings.TrimSpace(lowText))
+	highest, highErr := strconv.Atoi(strings.TrimSpace(highText))
+	if lowErr != nil || highErr != nil {
+		return 0, 0, fmt.Errorf("expected MIN-MAX, got %q", s)
+	}
+	if lowest < 1 || highest > 65535 || lowest > highest {
+		return 0, 0, fmt.Errorf("%d-%d is not a range of ports from 1 to 65535", lowest, highest)
+	}
+	return lowest, highest, nil
+}
 
-	for _, r := range s {
-		switch r {
-		case '\r':
-			// ignore carriage returns to support Windows line endings
-			continue
-		case '\n':
-			lines = append(lines, line)
-			line = ""
-		default:
-			line += string(r)
+// ParseRenewBefore parses when a new signature is requested: a duration
+// before expiry, such as 72h, or a percentage of the validity the signature
+// had when obtained that's left, such as 25%. Only one of the results is set.
+func ParseRenewBefore(s string) (before time.Duration, remaining float64, err error) {
+	s = strings.TrimSpace(s)
+	if percent, ok := strings.CutSuffix(s, "%"); ok {
+		value, err := strconv.ParseFloat(strings.TrimSpace(percent), 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) || value <= 0 || value >= 100 {
+			return 0, 0, fmt.Errorf("expected a percentage between 0 and 100, got %q", s)
 		}
+		return 0, value / 100, nil
 	}
 
-	// Add the last line if there's any content or if the string ended with a newline
-	// and we've already added all previous content
-	if line != "" || (len(s) > 0 && (s[len(s)-1] == '\n' || s[len(s)-1] == '\r')) {
-		lines = append(lines, line)
+	before, err = time.ParseDuration(s)
+	if err != nil {
+		return 0, 0, fmt.Errorf("expected a duration such as 72h or a percentage such as 25%%, got %q", s)
 	}
+	if before <= 0 || before > MaxRenewBefore {
+		return 0, 0, fmt.Errorf("%s is not between 0 and %s", before, MaxRenewBefore)
+	}
+	return before, 0, nil
+}
+
+// Headers parses the extra request headers. An empty string yields no headers.
+func (c *Config) Headers() (http.Header, error) {
+	headers := http.Header{}
+	for _, entry := range strings.Split(c.RequestHeaders, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
 
-	return lines
+		name, value, ok := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%q is not in the form Name: value", entry)
+		}
+		if strings.ContainsAny(name, " \t\r\n") || strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("%q contains invalid characters", entry)
+		}
+		headers.Add(name, strings.TrimSpace(value))
+	}
+	return headers, nil
 }
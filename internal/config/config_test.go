@@ -1,10 +1,21 @@
 package config
 
 import (
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/meschansky/go-pia/internal/piaca"
 )
 
 func TestDefaultConfig(t *testing.T) {
@@ -77,66 +88,1046 @@ func TestDefaultConfig(t *testing.T) {
 }
 
 func TestValidate(t *testing.T) {
-	// Create a temporary credentials file
+	// Create temporary credentials, CA certificate and script files
 	tmpDir := t.TempDir()
 	credFile := filepath.Join(tmpDir, "credentials.txt")
 	if err := os.WriteFile(credFile, []byte("username\npassword"), 0644); err != nil {
 		t.Fatalf("Failed to create test credentials file: %v", err)
 	}
+	caCertFile := filepath.Join(tmpDir, "ca.rsa.4096.crt")
+	if err := os.WriteFile(caCertFile, []byte("certificate"), 0644); err != nil {
+		t.Fatalf("Failed to create test CA certificate: %v", err)
+	}
+	script := filepath.Join(tmpDir, "script.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatalf("Failed to create test script: %v", err)
+	}
+	nonExecutable := filepath.Join(tmpDir, "not-executable.sh")
+	if err := os.WriteFile(nonExecutable, []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatalf("Failed to create test script: %v", err)
+	}
+	outputFile := filepath.Join(tmpDir, "output.txt")
+
+	// Nothing, including ubus, is found on the PATH
+	t.Setenv("PATH", t.TempDir())
+
+	// validConfig returns a config that passes validation
+	validConfig := func() *Config {
+		return &Config{
+			CredentialsFile:  credFile,
+			OutputFile:       outputFile,
+			CACertFile:       caCertFile,
+			RefreshInterval:  10 * time.Minute,
+			ScriptTimeout:    30 * time.Second,
+			ShutdownTimeout:  10 * time.Second,
+			VPNRetryInterval: time.Minute,
+		}
+	}
 
 	// Test cases
+	testCases := []struct {
+		name   string
+		modify func(c *Config)
+		// Substrings that must all appear in the error; no error is expected if empty
+		expectErrors []string
+	}{
+		{
+			name:   "Valid config",
+			modify: func(c *Config) {},
+		},
+		{
+			name:         "Missing credentials file",
+			modify:       func(c *Config) { c.CredentialsFile = "" },
+			expectErrors: []string{"credentials file path is required"},
+		},
+		{
+			name: "Token instead of credentials",
+			modify: func(c *Config) {
+				c.CredentialsFile = ""
+				c.Token = "abc123"
+			},
+		},
+		{
+			name:         "Token and credentials",
+			modify:       func(c *Config) { c.Token = "abc123" },
+			expectErrors: []string{"--token and --credentials are mutually exclusive"},
+		},
+		{
+			name:         "Missing output file",
+			modify:       func(c *Config) { c.OutputFile = "" },
+			expectErrors: []string{"output file path is required"},
+		},
+		{
+			name:         "Unknown output format",
+			modify:       func(c *Config) { c.OutputFormat = "yaml" },
+			expectErrors: []string{`output format must be "text" or "json", got "yaml"`},
+		},
+		{
+			name:         "Refresh interval above keepalive limit",
+			modify:       func(c *Config) { c.RefreshInterval = 15 * time.Hour },
+			expectErrors: []string{"use --force to override"},
+		},
+		{
+			name: "Refresh interval above keepalive limit with force",
+			modify: func(c *Config) {
+				c.RefreshInterval = 15 * time.Hour
+				c.Force = true
+			},
+		},
+		{
+			name:   "Refresh interval at keepalive limit",
+			modify: func(c *Config) { c.RefreshInterval = MaxRefreshInterval },
+		},
+		{
+			name:         "Refresh interval below minimum",
+			modify:       func(c *Config) { c.RefreshInterval = MinRefreshInterval - time.Second },
+			expectErrors: []string{"refresh interval 59s is below 1m0s and would hammer the PIA API (use --force to override)"},
+		},
+		{
+			name: "Refresh interval below minimum with force",
+			modify: func(c *Config) {
+				c.RefreshInterval = time.Second
+				c.Force = true
+			},
+		},
+		{
+			name:   "Refresh interval at minimum",
+			modify: func(c *Config) { c.RefreshInterval = MinRefreshInterval },
+		},
+		{
+			name:         "VPN retry interval just below a second",
+			modify:       func(c *Config) { c.VPNRetryInterval = time.Second - time.Millisecond },
+			expectErrors: []string{"VPN retry interval must be at least 1s, got 999ms"},
+		},
+		{
+			name:   "VPN retry interval of a second",
+			modify: func(c *Config) { c.VPNRetryInterval = time.Second },
+		},
+		{
+			name:         "Zero refresh interval",
+			modify:       func(c *Config) { c.RefreshInterval = 0 },
+			expectErrors: []string{"refresh interval must be positive"},
+		},
+		{
+			name:         "Negative refresh jitter",
+			modify:       func(c *Config) { c.RefreshJitter = -time.Second },
+			expectErrors: []string{"refresh jitter must not be negative"},
+		},
+		{
+			name:         "Negative port change debounce",
+			modify:       func(c *Config) { c.PortChangeDebounce = -time.Second },
+			expectErrors: []string{"port change debounce must not be negative"},
+		},
+		{
+			name:         "Negative previous port grace",
+			modify:       func(c *Config) { c.PreviousPortGrace = -time.Second },
+			expectErrors: []string{"previous port grace must not be negative"},
+		},
+		{
+			name:         "Negative minimum bind interval",
+			modify:       func(c *Config) { c.MinBindInterval = -time.Second },
+			expectErrors: []string{"minimum bind interval must not be negative"},
+		},
+		{
+			name:   "Valid DNS server",
+			modify: func(c *Config) { c.DNSServer = "10.0.0.243" },
+		},
+		{
+			name:         "DNS server given as hostname",
+			modify:       func(c *Config) { c.DNSServer = "dns.example.com" },
+			expectErrors: []string{"invalid DNS server"},
+		},
+		{
+			name:   "Valid remote host",
+			modify: func(c *Config) { c.RemoteHost = "ssh://root@192.168.1.1" },
+		},
+		{
+			name:         "Remote host without ssh scheme",
+			modify:       func(c *Config) { c.RemoteHost = "root@192.168.1.1" },
+			expectErrors: []string{"invalid remote host"},
+		},
+		{
+			name:   "Detection strategies",
+			modify: func(c *Config) { c.Detect = "wireguard, ip-route" },
+		},
+		{
+			name:         "Unknown detection strategy",
+			modify:       func(c *Config) { c.Detect = "routes,dhcp" },
+			expectErrors: []string{"unknown detection strategy \"dhcp\""},
+		},
+		{
+			name:         "Gateway given as hostname",
+			modify:       func(c *Config) { c.Gateway = "gateway.example.com" },
+			expectErrors: []string{"gateway must be an IP address"},
+		},
+		{
+			name:         "Managed OpenVPN without openvpn",
+			modify:       func(c *Config) { c.ManageVPN = ManageOpenVPN },
+			expectErrors: []string{"requires the openvpn command"},
+		},
+		{
+			name: "Managed WireGuard without a server",
+			modify: func(c *Config) {
+				c.ManageVPN = ManageWireGuard
+				c.RemoteHost = "ssh://root@192.168.1.1"
+			},
+			expectErrors: []string{"remote host", "server IP address", "server hostname", "requires the wg-quick command"},
+		},
+		{
+			name:         "Unknown managed VPN",
+			modify:       func(c *Config) { c.ManageVPN = "ipsec" },
+			expectErrors: []string{`managed VPN must be "openvpn" or "wireguard"`},
+		},
+		{
+			name:         "Zero shutdown timeout",
+			modify:       func(c *Config) { c.ShutdownTimeout = 0 },
+			expectErrors: []string{"shutdown timeout must be positive"},
+		},
+		{
+			name:         "Missing exit script",
+			modify:       func(c *Config) { c.OnExitScript = "/nonexistent/close-port.sh" },
+			expectErrors: []string{"--on-exit script /nonexistent/close-port.sh is not an executable file"},
+		},
+		{
+			name:         "Negative failover delay",
+			modify:       func(c *Config) { c.FailoverAfter = -time.Minute },
+			expectErrors: []string{"failover delay must not be negative"},
+		},
+		{
+			name:         "Failover without a managed VPN",
+			modify:       func(c *Config) { c.FailoverAfter = 15 * time.Minute },
+			expectErrors: []string{"region failover requires a managed VPN"},
+		},
+		{
+			name:         "Ubus without the ubus command",
+			modify:       func(c *Config) { c.Ubus = true },
+			expectErrors: []string{"require the ubus command"},
+		},
+		{
+			name: "Ubus on a remote host",
+			modify: func(c *Config) {
+				c.Ubus = true
+				c.RemoteHost = "ssh://root@192.168.1.1"
+			},
+		},
+		{
+			name:         "Missing patch file",
+			modify:       func(c *Config) { c.PatchFile = "/nonexistent/settings.json" },
+			expectErrors: []string{"--patch-file /nonexistent/settings.json can't be patched"},
+		},
+		{
+			name:         "Patch key without a patch file",
+			modify:       func(c *Config) { c.PatchKey = "peer-port" },
+			expectErrors: []string{"--patch-key requires --patch-file"},
+		},
+		{
+			name:         "Malformed templates",
+			modify:       func(c *Config) { c.Templates = "/etc/go-pia/nginx.tmpl" },
+			expectErrors: []string{"invalid templates"},
+		},
+		{
+			name:         "Missing template",
+			modify:       func(c *Config) { c.Templates = "/nonexistent/nginx.tmpl=/tmp/pia.conf" },
+			expectErrors: []string{"template /nonexistent/nginx.tmpl"},
+		},
+		{
+			name:         "Template reload without templates",
+			modify:       func(c *Config) { c.TemplateReload = "pidfile:/run/nginx.pid" },
+			expectErrors: []string{"--template-reload requires --templates"},
+		},
+		{
+			name:         "Malformed template reload",
+			modify:       func(c *Config) { c.TemplateReload = "nginx" },
+			expectErrors: []string{"invalid template reload"},
+		},
+		{
+			name:         "Notify signal without a unit",
+			modify:       func(c *Config) { c.NotifySignal = "HUP" },
+			expectErrors: []string{"--notify-signal requires --notify-unit"},
+		},
+		{
+			name: "Unknown notify signal",
+			modify: func(c *Config) {
+				c.NotifyUnit = "transmission-daemon.service"
+				c.NotifySignal = "KILL"
+			},
+			expectErrors: []string{"invalid notify signal"},
+		},
+		{
+			name:         "DDNS without a token",
+			modify:       func(c *Config) { c.DDNSProvider = "duckdns"; c.DDNSName = "mygame" },
+			expectErrors: []string{"--ddns-provider=duckdns requires --ddns-token-file"},
+		},
+		{
+			name:         "DDNS options without a provider",
+			modify:       func(c *Config) { c.DDNSName = "mygame" },
+			expectErrors: []string{"--ddns-* options require --ddns-provider"},
+		},
+		{
+			name:         "Keep port script without attempts",
+			modify:       func(c *Config) { c.OnPortKeepFailedScript = "/bin/true" },
+			expectErrors: []string{"--on-port-keep-failed requires --keep-port-attempts"},
+		},
+		{
+			name:         "UDP probes too often",
+			modify:       func(c *Config) { c.UDPProbe = "probe.example.com"; c.UDPProbeInterval = time.Second },
+			expectErrors: []string{"UDP probe interval must be at least 30s"},
+		},
+		{
+			name:         "Invalid output retry",
+			modify:       func(c *Config) { c.OutputRetry = "ddns=often" },
+			expectErrors: []string{"invalid output retry"},
+		},
+		{
+			name:         "Output retry for an unknown output",
+			modify:       func(c *Config) { c.OutputRetry = "mqtt=3" },
+			expectErrors: []string{`unknown output "mqtt"`},
+		},
+		{
+			name:         "Unknown D-Bus signal bus",
+			modify:       func(c *Config) { c.DBusSignal = "user" },
+			expectErrors: []string{"D-Bus signal bus must be"},
+		},
+		{
+			name:         "Gotify without token file",
+			modify:       func(c *Config) { c.Notifier = "gotify"; c.NotifierURL = "https://gotify.example.com" },
+			expectErrors: []string{"--notifier=gotify requires --notifier-token-file"},
+		},
+		{
+			name:         "ntfy without token file",
+			modify:       func(c *Config) { c.Notifier = "ntfy"; c.NotifierURL = "https://ntfy.sh/go-pia" },
+			expectErrors: nil,
+		},
+		{
+			name: "Unknown notifier event",
+			modify: func(c *Config) {
+				c.Notifier = "ntfy"
+				c.NotifierURL = "https://ntfy.sh/go-pia"
+				c.NotifierEvents = "reboot"
+			},
+			expectErrors: []string{"invalid notifier events"},
+		},
+		{
+			name:         "Server list key that isn't a key",
+			modify:       func(c *Config) { c.ServerListKeyFile = c.CredentialsFile },
+			expectErrors: []string{"is invalid: no PEM block found"},
+		},
+		{
+			name:         "Negative server list cache TTL",
+			modify:       func(c *Config) { c.ServerListCacheTTL = -time.Hour },
+			expectErrors: []string{"server list cache TTL must not be negative"},
+		},
+		{
+			name:         "Heartbeat URL without scheme",
+			modify:       func(c *Config) { c.HeartbeatURL = "hc-ping.com/abc" },
+			expectErrors: []string{"--heartbeat-url must be an http or https URL"},
+		},
+		{
+			name:         "Heartbeat fail URL alone",
+			modify:       func(c *Config) { c.HeartbeatFailURL = "https://hc-ping.com/abc/fail" },
+			expectErrors: []string{"--heartbeat-fail-url requires --heartbeat-url"},
+		},
+		{
+			name: "Email without recipients",
+			modify: func(c *Config) {
+				c.SMTPServer = "smtp.example.com:587"
+				c.SMTPFrom = "pia@example.com"
+			},
+			expectErrors: []string{"invalid SMTP settings: no recipients"},
+		},
+		{
+			name: "Email notifier events",
+			modify: func(c *Config) {
+				c.SMTPServer = "smtp.example.com:587"
+				c.SMTPFrom = "pia@example.com"
+				c.SMTPTo = "me@example.com"
+				c.NotifierEvents = "bind-failure"
+			},
+			expectErrors: nil,
+		},
+		{
+			name:         "SMTP options without server",
+			modify:       func(c *Config) { c.SMTPTo = "me@example.com" },
+			expectErrors: []string{"--smtp-* options require --smtp-server"},
+		},
+		{
+			name:         "Notifier events without a notifier",
+			modify:       func(c *Config) { c.NotifierEvents = "port-change" },
+			expectErrors: []string{"--notifier-events requires --notifier or --smtp-server"},
+		},
+		{
+			name:         "Notifier options without notifier",
+			modify:       func(c *Config) { c.NotifierUser = "abc" },
+			expectErrors: []string{"--notifier-* options require --notifier"},
+		},
+		{
+			name:         "Relative runtime directory",
+			modify:       func(c *Config) { c.RuntimeDir = "run/go-pia" },
+			expectErrors: []string{"runtime directory must be an absolute path"},
+		},
+		{
+			name:         "Runtime directory with remote host",
+			modify:       func(c *Config) { c.RuntimeDir = "/run/go-pia"; c.RemoteHost = "root@router" },
+			expectErrors: []string{"--runtime-dir places the output file on this host"},
+		},
+		{
+			name:         "Embedded CA certificate",
+			modify:       func(c *Config) { c.CACertFile = "embedded" },
+			expectErrors: nil,
+		},
+		{
+			name:         "Malformed request header",
+			modify:       func(c *Config) { c.RequestHeaders = "X-Debug" },
+			expectErrors: []string{"invalid request headers"},
+		},
+		{
+			name:         "Multi-line user agent",
+			modify:       func(c *Config) { c.UserAgent = "agent\r\nX-Injected: 1" },
+			expectErrors: []string{"user agent must be a single line"},
+		},
+		{
+			name:         "Unknown summary format",
+			modify:       func(c *Config) { c.Summary = "yaml" },
+			expectErrors: []string{`--summary must be "port" or "json"`},
+		},
+		{
+			name:         "Quiet debug logging",
+			modify:       func(c *Config) { c.Quiet, c.Debug = true, true },
+			expectErrors: []string{"--quiet and --debug can't be combined"},
+		},
+		{
+			name: "Output directory that can't be written to",
+			modify: func(c *Config) {
+				c.OutputFile = filepath.Join(credFile, "port.txt")
+				c.StateFile = filepath.Join(caCertFile, "state.json")
+			},
+			expectErrors: []string{
+				"output directory " + credFile + " is not writable",
+				"state file directory " + caCertFile + " is not writable",
+			},
+		},
+		{
+			name:         "Streaming to stdout",
+			modify:       func(c *Config) { c.OutputFile, c.Quiet, c.StateFile = StdoutOutput, true, outputFile },
+			expectErrors: nil,
+		},
+		{
+			name: "Streaming to stdout in the background",
+			modify: func(c *Config) {
+				c.OutputFile, c.Daemonize, c.Summary, c.CACertFile = StdoutOutput, true, SummaryJSON, "download"
+			},
+			expectErrors: []string{
+				"--daemonize can't be used with output file -",
+				"--summary can't be used with output file -",
+				"--ca-cert=download with output file - requires --state-file",
+			},
+		},
+		{
+			name: "Intervals below a second",
+			modify: func(c *Config) {
+				c.RefreshInterval, c.ScriptTimeout, c.VPNRetryInterval = 500*time.Millisecond, 30*time.Millisecond, time.Millisecond
+			},
+			expectErrors: []string{
+				"refresh interval must be at least 1s, got 500ms",
+				"script timeout must be at least 1s, got 30ms",
+				"VPN retry interval must be at least 1s, got 1ms",
+			},
+		},
+		{
+			name:         "Negative wait for files",
+			modify:       func(c *Config) { c.WaitForFiles = -time.Second },
+			expectErrors: []string{"wait for files must not be negative"},
+		},
+		{
+			name:         "Negative VPN detection budget",
+			modify:       func(c *Config) { c.VPNDetectTimeout, c.VPNDetectMaxAttempts = -time.Second, -1 },
+			expectErrors: []string{"VPN detect timeout must not be negative", "VPN detect max attempts must not be negative"},
+		},
+		{
+			name:         "Negative known gateway max age",
+			modify:       func(c *Config) { c.KnownGatewayMaxAge = -time.Minute },
+			expectErrors: []string{"known gateway max age must not be negative"},
+		},
+		{
+			name: "VPN unit with a managed VPN",
+			modify: func(c *Config) {
+				c.VPNUnit = "openvpn-client@pia.service"
+				c.ManageVPN = ManageOpenVPN
+			},
+			expectErrors: []string{"--vpn-unit can't be used with --manage-vpn"},
+		},
+		{
+			name:         "Malformed port range",
+			modify:       func(c *Config) { c.PortRange = "40000" },
+			expectErrors: []string{"invalid port range"},
+		},
+		{
+			name:         "Too many port range attempts",
+			modify:       func(c *Config) { c.PortRangeAttempts = MaxKeepPortAttempts + 1 },
+			expectErrors: []string{"port range attempts must be between 0 and"},
+		},
+		{
+			name:         "Chaos bind fail rate above 1",
+			modify:       func(c *Config) { c.ChaosBindFailRate = 1.5 },
+			expectErrors: []string{"chaos bind fail rate must be between 0 and 1"},
+		},
+		{
+			name:         "Negative chaos latency",
+			modify:       func(c *Config) { c.ChaosLatency = -time.Second },
+			expectErrors: []string{"chaos latency must not be negative"},
+		},
+		{
+			name:         "Renewal window too long",
+			modify:       func(c *Config) { c.RenewBefore = "90d" },
+			expectErrors: []string{"invalid --renew-before"},
+		},
+		{
+			name:         "Unknown log color mode",
+			modify:       func(c *Config) { c.LogColor = "yes" },
+			expectErrors: []string{"--log-color must be"},
+		},
+		{
+			name:         "Unknown connect-via mode",
+			modify:       func(c *Config) { c.ConnectVia = "ip" },
+			expectErrors: []string{"--connect-via must be"},
+		},
+		{
+			name:         "Gateway port out of range",
+			modify:       func(c *Config) { c.GatewayPort = 70000 },
+			expectErrors: []string{"gateway port must be between 0 and 65535"},
+		},
+		{
+			name:         "Non-existent credentials file",
+			modify:       func(c *Config) { c.CredentialsFile = filepath.Join(tmpDir, "nonexistent.txt") },
+			expectErrors: []string{"credentials file", "is not readable"},
+		},
+		{
+			name:         "Non-existent CA certificate",
+			modify:       func(c *Config) { c.CACertFile = filepath.Join(tmpDir, "nonexistent.crt") },
+			expectErrors: []string{"CA certificate"},
+		},
+		{
+			name:         "CA certificate is a directory",
+			modify:       func(c *Config) { c.CACertFile = tmpDir },
+			expectErrors: []string{"is a directory"},
+		},
+		{
+			name:   "Executable script",
+			modify: func(c *Config) { c.OnPortChangeScript = script },
+		},
+		{
+			name:         "Missing script",
+			modify:       func(c *Config) { c.OnPortChangeScript = filepath.Join(tmpDir, "nonexistent.sh") },
+			expectErrors: []string{"--on-port-change script", "is not an executable file"},
+		},
+		{
+			name:         "State file same as output file",
+			modify:       func(c *Config) { c.StateFile = outputFile },
+			expectErrors: []string{"state file and output file must be different paths"},
+		},
+		{
+			name: "Every problem is reported",
+			modify: func(c *Config) {
+				c.CredentialsFile = ""
+				c.RefreshInterval = 0
+				c.ScriptTimeout = 0
+				c.RemoteIndex = -1
+				c.PIDFile = outputFile
+			},
+			expectErrors: []string{
+				"credentials file path is required",
+				"refresh interval must be positive",
+				"script timeout must be positive",
+				"remote index must not be negative",
+				"PID file and output file must be different paths",
+			},
+		},
+	}
+
+	// The execute bit isn't meaningful on Windows
+	if runtime.GOOS != "windows" {
+		testCases = append(testCases, struct {
+			name         string
+			modify       func(c *Config)
+			expectErrors []string
+		}{
+			name:         "Script without execute bit",
+			modify:       func(c *Config) { c.OnPortChangeScript = nonExecutable },
+			expectErrors: []string{"is not an executable file"},
+		})
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := validConfig()
+			tc.modify(cfg)
+
+			err := cfg.Validate()
+			if len(tc.expectErrors) == 0 {
+				if err != nil {
+					t.Errorf("Expected no error but got: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Expected error but got nil")
+			}
+			for _, expected := range tc.expectErrors {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("Expected error to contain %q, got: %v", expected, err)
+				}
+			}
+		})
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	t.Setenv("PIA_CREDENTIALS", "/env/credentials.txt")
+	t.Setenv("PIA_REFRESH_INTERVAL", "10m")
+
 	testCases := []struct {
 		name        string
-		config      *Config
+		args        []string
 		expectError bool
+		check       func(t *testing.T, cfg *Config)
 	}{
 		{
-			name: "Valid config",
-			config: &Config{
-				CredentialsFile: credFile,
-				OutputFile:      filepath.Join(tmpDir, "output.txt"),
+			name: "Environment values are used by default",
+			args: []string{"/tmp/port.txt"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.CredentialsFile != "/env/credentials.txt" || cfg.RefreshInterval != 10*time.Minute {
+					t.Errorf("Expected environment values, got %+v", cfg)
+				}
+				if cfg.OutputFile != "/tmp/port.txt" {
+					t.Errorf("Expected output file /tmp/port.txt, got %s", cfg.OutputFile)
+				}
 			},
-			expectError: false,
 		},
 		{
-			name: "Missing credentials file",
-			config: &Config{
-				CredentialsFile: "",
-				OutputFile:      filepath.Join(tmpDir, "output.txt"),
+			name: "Flags override the environment",
+			args: []string{"--credentials=/flag/credentials.txt", "--refresh-interval=5m", "--debug", "/tmp/port.txt"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.CredentialsFile != "/flag/credentials.txt" || cfg.RefreshInterval != 5*time.Minute || !cfg.Debug {
+					t.Errorf("Expected flag values, got %+v", cfg)
+				}
 			},
-			expectError: true,
 		},
 		{
-			name: "Missing output file",
-			config: &Config{
-				CredentialsFile: credFile,
-				OutputFile:      "",
+			name: "Runtime directory holds the writable paths",
+			args: []string{"--runtime-dir=/run/go-pia", "--state-file=state.json", "--ready-file=/tmp/ready"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.OutputFile != "/run/go-pia/port.txt" || cfg.StateFile != "/run/go-pia/state.json" || cfg.ReadyFile != "/tmp/ready" {
+					t.Errorf("Expected paths under the runtime directory, got %+v", cfg)
+				}
+				if cfg.CACertFile != "embedded" {
+					t.Errorf("Expected the embedded CA certificate, got %s", cfg.CACertFile)
+				}
 			},
-			expectError: true,
 		},
 		{
-			name: "Non-existent credentials file",
-			config: &Config{
-				CredentialsFile: filepath.Join(tmpDir, "nonexistent.txt"),
-				OutputFile:      filepath.Join(tmpDir, "output.txt"),
+			name: "Runtime directory keeps an explicit CA certificate",
+			args: []string{"--runtime-dir=/run/go-pia", "--ca-cert=/etc/pia/ca.crt", "port"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.OutputFile != "/run/go-pia/port" || cfg.CACertFile != "/etc/pia/ca.crt" {
+					t.Errorf("Expected the output under the runtime directory and the given CA certificate, got %+v", cfg)
+				}
 			},
+		},
+		{
+			name: "Runtime directory leaves a streamed output alone",
+			args: []string{"--runtime-dir=/run/go-pia", "-"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.OutputFile != StdoutOutput || !cfg.StreamsOutput() {
+					t.Errorf("Expected the port streamed to stdout, got output file %s", cfg.OutputFile)
+				}
+			},
+		},
+		{
+			name:        "Invalid duration",
+			args:        []string{"--refresh-interval=soon", "/tmp/port.txt"},
+			expectError: true,
+		},
+		{
+			name:        "Unknown flag",
+			args:        []string{"--no-such-flag", "/tmp/port.txt"},
+			expectError: true,
+		},
+		{
+			name:        "Extra positional arguments",
+			args:        []string{"/tmp/port.txt", "/tmp/other.txt"},
 			expectError: true,
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			err := tc.config.Validate()
-			if tc.expectError && err == nil {
-				t.Errorf("Expected error but got nil")
+			cfg, err := ParseArgs(tc.args)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("Expected error but got nil")
+				}
+				return
 			}
-			if !tc.expectError && err != nil {
-				t.Errorf("Expected no error but got: %v", err)
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
 			}
+			tc.check(t, cfg)
 		})
 	}
 }
 
+func TestArgsRoundTrip(t *testing.T) {
+	cfg := &Config{
+		CredentialsFile:        "/etc/pia.txt",
+		StrictCredentials:      true,
+		Token:                  "abc123",
+		OutputFile:             "/run/pia/port.txt",
+		OpenVPNConfigFile:      "/etc/openvpn/client/pia.ovpn",
+		WaitForFiles:           5 * time.Minute,
+		RemoteIndex:            2,
+		RemoteHost:             "ssh://root@192.168.1.1:2222",
+		Interface:              "tun1",
+		Detect:                 "openvpn-management,routes",
+		OpenVPNManagement:      "127.0.0.1:7505",
+		Gateway:                "10.7.128.1",
+		GatewayHostname:        "nl-amsterdam.privacy.network",
+		ManageVPN:              "wireguard",
+		WireGuardServer:        "158.173.21.201",
+		WireGuardHostname:      "amsterdam407",
+		FailoverAfter:          15 * time.Minute,
+		ServerListCache:        "/var/cache/pia/servers.json",
+		ServerListCacheTTL:     6 * time.Hour,
+		ServerListKeyFile:      "/etc/pia/servers.pem",
+		CACertSearchPath:       "/opt/pia:/srv/pia",
+		OnRegionChangeScript:   "/opt/pia/region.sh",
+		CACertFile:             "/usr/local/etc/ca.rsa.4096.crt",
+		RefreshInterval:        10 * time.Minute,
+		RefreshJitter:          time.Minute,
+		MinBindInterval:        time.Minute,
+		KeepPortAttempts:       5,
+		PortRange:              "40000-49999",
+		PortRangeAttempts:      3,
+		OnPortKeepFailedScript: "/etc/go-pia/port-lost.sh",
+		Debug:                  true,
+		Quiet:                  true,
+		Summary:                "json",
+		LogColor:               "always",
+		RenewBefore:            "25%",
+		OnPortChangeScript:     "/opt/pia/notify.sh",
+		PortChangeDebounce:     time.Minute,
+		PreviousPortGrace:      30 * time.Minute,
+		ScriptTimeout:          45 * time.Second,
+		OnExitScript:           "/opt/pia/close-port.sh",
+		ShutdownTimeout:        20 * time.Second,
+		VPNRetryInterval:       30 * time.Second,
+		VPNDetectTimeout:       5 * time.Minute,
+		VPNDetectMaxAttempts:   10,
+		VPNUnit:                "openvpn-client@pia.service",
+		KnownGatewayMaxAge:     6 * time.Hour,
+		GatewayIdleTimeout:     5 * time.Minute,
+		GatewayMaxIdleConns:    1,
+		ConnectVia:             "hostname",
+		MetricsAddr:            "127.0.0.1:9876",
+		DNSServer:              "10.0.0.243",
+		DNSCache:               true,
+		StateFile:              "/run/pia/state.json",
+		ReadyFile:              "/run/pia/ready",
+		RuntimeDir:             "/run/pia",
+		PatchFile:              "/var/lib/transmission/settings.json",
+		PatchKey:               "peer-port",
+		Templates:              "/etc/go-pia/nginx.tmpl=/etc/nginx/stream.d/pia.conf",
+		TemplateReload:         "systemctl:nginx.service",
+		NotifyUnit:             "transmission-daemon.service",
+		NotifySignal:           "HUP",
+		DBusSignal:             "system",
+		DDNSProvider:           "cloudflare",
+		DDNSName:               "plex.example.com",
+		DDNSZone:               "023e105f4ecef8ad9ca31a8372d0c353",
+		DDNSURL:                "https://dyn.example.com/update?ip={{.IP}}",
+		DDNSTokenFile:          "/etc/go-pia/cloudflare-token",
+		DDNSPortRecord:         "_plex._tcp",
+		DDNSIPURL:              "https://ifconfig.me/ip",
+		OutputRetry:            "ddns=5/1m0s,ubus=0/5s",
+		UDPProbe:               "probe.example.com:7787",
+		UDPProbeInterval:       time.Minute,
+		Notifier:               "pushover",
+		NotifierURL:            "https://ntfy.sh/go-pia",
+		NotifierUser:           "uQiRzpo4DXghDmr9QzzfQu27cmVRsG",
+		NotifierTokenFile:      "/etc/go-pia/pushover-token",
+		NotifierEvents:         "port-change,bind-failure",
+		HeartbeatURL:           "https://hc-ping.com/eb095278-f28d-448d-87fb-7b75c171a6aa",
+		HeartbeatFailURL:       "https://hc-ping.com/eb095278-f28d-448d-87fb-7b75c171a6aa/fail",
+		SMTPServer:             "smtp.example.com:587",
+		SMTPSecurity:           "starttls",
+		SMTPFrom:               "go-pia <pia@example.com>",
+		SMTPTo:                 "me@example.com,you@example.com",
+		SMTPUsername:           "pia@example.com",
+		SMTPPasswordFile:       "/etc/go-pia/smtp-password",
+		SMTPBatchInterval:      10 * time.Minute,
+		Ubus:                   true,
+		ChaosBindFailRate:      0.25,
+		ChaosLatency:           2 * time.Second,
+		GatewayPort:            8443,
+	}
+
+	parsed := &Config{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	if err := ParseFlags(fs, parsed, cfg.Args()); err != nil {
+		t.Fatalf("Failed to parse generated args %v: %v", cfg.Args(), err)
+	}
+
+	if *parsed != *cfg {
+		t.Errorf("Round trip mismatch:\nexpected %+v\ngot      %+v", cfg, parsed)
+	}
+}
+
+func TestOptionsCoverEveryField(t *testing.T) {
+	cfg := &Config{}
+	fields := reflect.ValueOf(cfg).Elem()
+	covered := make(map[string]bool)
+	flags := make(map[string]bool)
+	envs := make(map[string]bool)
+
+	for _, o := range options() {
+		ptr := reflect.ValueOf(o.field(cfg)).Pointer()
+		for i := 0; i < fields.NumField(); i++ {
+			if fields.Field(i).Addr().Pointer() == ptr {
+				name := fields.Type().Field(i).Name
+				if covered[name] {
+					t.Errorf("Field %s is covered by more than one option", name)
+				}
+				covered[name] = true
+			}
+		}
+
+		if !strings.HasPrefix(o.env, "PIA_") {
+			t.Errorf("Option %q has environment variable %q without the PIA_ prefix", o.flag, o.env)
+		}
+		if envs[o.env] {
+			t.Errorf("Environment variable %s is used by more than one option", o.env)
+		}
+		envs[o.env] = true
+
+		if o.flag != "" {
+			if flags[o.flag] {
+				t.Errorf("Flag %s is used by more than one option", o.flag)
+			}
+			flags[o.flag] = true
+		}
+	}
+
+	for i := 0; i < fields.NumField(); i++ {
+		if name := fields.Type().Field(i).Name; !covered[name] {
+			t.Errorf("Field %s has no option", name)
+		}
+	}
+}
+
+func TestEnvironmentOverrides(t *testing.T) {
+	t.Setenv("PIA_CA_CERT", "/etc/pia/ca.crt")
+	t.Setenv("PIA_OPENVPN_CONFIG", "/etc/openvpn/pia.conf")
+	t.Setenv("PIA_OUTPUT_FILE", "/run/pia/port.txt")
+	t.Setenv("PIA_GATEWAY_MAX_IDLE_CONNS", "not-a-number")
+	t.Setenv("PIA_DEBUG", "1")
+
+	cfg := DefaultConfig()
+	if cfg.CACertFile != "/etc/pia/ca.crt" {
+		t.Errorf("Expected CACertFile from PIA_CA_CERT, got %s", cfg.CACertFile)
+	}
+	if cfg.OpenVPNConfigFile != "/etc/openvpn/pia.conf" {
+		t.Errorf("Expected OpenVPNConfigFile from PIA_OPENVPN_CONFIG, got %s", cfg.OpenVPNConfigFile)
+	}
+	if cfg.OutputFile != "/run/pia/port.txt" {
+		t.Errorf("Expected OutputFile from PIA_OUTPUT_FILE, got %s", cfg.OutputFile)
+	}
+	if cfg.GatewayMaxIdleConns != 2 {
+		t.Errorf("Expected GatewayMaxIdleConns to keep its default with invalid input, got %d", cfg.GatewayMaxIdleConns)
+	}
+	if !cfg.Debug {
+		t.Errorf("Expected Debug to be true")
+	}
+
+	// The positional argument overrides PIA_OUTPUT_FILE
+	parsed, err := ParseArgs([]string{"/tmp/port.txt"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if parsed.OutputFile != "/tmp/port.txt" {
+		t.Errorf("Expected OutputFile from the argument, got %s", parsed.OutputFile)
+	}
+}
+
+func TestCACertSearchDirs(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", "/home/pia/.local/share")
+	t.Setenv("XDG_DATA_DIRS", "/usr/share:/opt/share")
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dirs := CACertSearchDirs("/srv/pia" + string(os.PathListSeparator) + "/opt/pia")
+	expected := []string{"/srv/pia", "/opt/pia", ".", filepath.Dir(exe), "/home/pia/.local/share/go-pia", "/usr/share/go-pia", "/opt/share/go-pia", "/etc/openvpn/client"}
+	if !slices.Equal(dirs, expected) {
+		t.Errorf("Expected %v, got %v", expected, dirs)
+	}
+}
+
+func TestFindCACert(t *testing.T) {
+	first, second := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(second, "ca.crt"), []byte("cert"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := FindCACert("ca.crt", []string{first, second})
+	if err != nil || path != filepath.Join(second, "ca.crt") {
+		t.Errorf("Expected the certificate in the second directory, got %q (%v)", path, err)
+	}
+	if path, err := FindCACert(piaca.Embedded, nil); err != nil || path != piaca.Embedded {
+		t.Errorf("Expected the built-in certificate as is, got %q (%v)", path, err)
+	}
+
+	// The error lists where the certificate was looked for
+	_, err = FindCACert("missing.crt", []string{first, second})
+	if err == nil || !strings.Contains(err.Error(), first) || !strings.Contains(err.Error(), second) {
+		t.Errorf("Expected an error naming the directories searched, got %v", err)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	testCases := []struct {
+		value      string
+		expected   time.Duration
+		deprecated bool
+		expectErr  bool
+	}{
+		{value: "15m", expected: 15 * time.Minute},
+		{value: "900s", expected: 15 * time.Minute},
+		{value: "900", expected: 15 * time.Minute, deprecated: true},
+		{value: "0", expected: 0},
+		{value: "-30", expected: -30 * time.Second, deprecated: true},
+		{value: "15 minutes", expectErr: true},
+		{value: "", expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			d, deprecated, err := ParseDuration(tc.value)
+			if tc.expectErr != (err != nil) {
+				t.Fatalf("Expected error: %v, got %v", tc.expectErr, err)
+			}
+			if d != tc.expected || deprecated != tc.deprecated {
+				t.Errorf("Expected %s (deprecated: %v), got %s (deprecated: %v)", tc.expected, tc.deprecated, d, deprecated)
+			}
+		})
+	}
+}
+
+func TestEnvironmentDurationForms(t *testing.T) {
+	t.Setenv("PIA_REFRESH_INTERVAL", "600")
+	t.Setenv("PIA_SCRIPT_TIMEOUT", "2m")
+
+	cfg := DefaultConfig()
+	if cfg.RefreshInterval != 10*time.Minute {
+		t.Errorf("Expected PIA_REFRESH_INTERVAL=600 to be taken as seconds, got %s", cfg.RefreshInterval)
+	}
+	if cfg.ScriptTimeout != 2*time.Minute {
+		t.Errorf("Expected PIA_SCRIPT_TIMEOUT=2m as a duration, got %s", cfg.ScriptTimeout)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	if err := ParseFlags(fs, cfg, nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, s := range Settings(fs, cfg) {
+		if s.Env == "PIA_REFRESH_INTERVAL" && (s.Source != SourceEnv || !strings.Contains(s.Warning, "deprecated")) {
+			t.Errorf("Expected the bare number of seconds to be used with a deprecation warning, got %+v", s)
+		}
+	}
+}
+
+func TestDurationFlags(t *testing.T) {
+	// Flags take bare numbers of seconds too
+	cfg := BuiltinConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	if err := ParseFlags(fs, cfg, []string{"--refresh-interval=600", "--script-timeout=1m"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.RefreshInterval != 10*time.Minute || cfg.ScriptTimeout != time.Minute {
+		t.Errorf("Expected 10m0s and 1m0s, got %s and %s", cfg.RefreshInterval, cfg.ScriptTimeout)
+	}
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	err := ParseFlags(fs, BuiltinConfig(), []string{"--vpn-retry-interval=often"})
+	if err == nil || !strings.Contains(err.Error(), "expected a duration such as 90s or 15m, or a number of seconds") {
+		t.Errorf("Expected an error for an invalid duration, got %v", err)
+	}
+
+	// Invalid durations in the environment stop the service, unless a flag
+	// overrides them
+	t.Setenv("PIA_SCRIPT_TIMEOUT", "not-a-duration")
+	if _, err := ParseArgs([]string{"/tmp/port.txt"}); err == nil || !strings.Contains(err.Error(), `invalid value "not-a-duration" for PIA_SCRIPT_TIMEOUT`) {
+		t.Errorf("Expected an error naming PIA_SCRIPT_TIMEOUT, got %v", err)
+	}
+	if _, err := ParseArgs([]string{"--script-timeout=45s", "/tmp/port.txt"}); err != nil {
+		t.Errorf("Expected the flag to override the invalid variable, got %v", err)
+	}
+}
+
+func TestSettings(t *testing.T) {
+	t.Setenv("PIA_REFRESH_INTERVAL", "10m")
+	t.Setenv("PIA_SCRIPT_TIMEOUT", "not-a-duration")
+	t.Setenv("PIA_CREDENTIALS", "/env/credentials.txt")
+	t.Setenv("PIA_TOKEN", "secret-token")
+
+	cfg := DefaultConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	if err := ParseFlags(fs, cfg, []string{"--credentials", "/flag/credentials.txt", "--chaos-latency=1s", "/tmp/port.txt"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	settings := make(map[string]Setting)
+	for _, s := range Settings(fs, cfg) {
+		settings[s.Env] = s
+	}
+	expected := map[string]Setting{
+		"PIA_CREDENTIALS":      {Flag: "credentials", Env: "PIA_CREDENTIALS", Value: "/flag/credentials.txt", Source: SourceFlag},
+		"PIA_OUTPUT_FILE":      {Env: "PIA_OUTPUT_FILE", Value: "/tmp/port.txt", Source: SourceFlag},
+		"PIA_REFRESH_INTERVAL": {Flag: "refresh-interval", Env: "PIA_REFRESH_INTERVAL", Value: "10m0s", Source: SourceEnv},
+		"PIA_TOKEN":            {Flag: "token", Env: "PIA_TOKEN", Value: maskedValue, Source: SourceEnv},
+		"PIA_CHAOS_LATENCY":    {Flag: "chaos-latency", Env: "PIA_CHAOS_LATENCY", Value: "1s", Source: SourceFlag},
+		"PIA_SHUTDOWN_TIMEOUT": {Flag: "shutdown-timeout", Env: "PIA_SHUTDOWN_TIMEOUT", Value: "10s", Source: SourceDefault},
+		"PIA_SCRIPT_TIMEOUT": {
+			Flag: "script-timeout", Env: "PIA_SCRIPT_TIMEOUT", Value: "30s", Source: SourceDefault,
+			Warning: `PIA_SCRIPT_TIMEOUT="not-a-duration" isn't a valid value and was ignored`,
+		},
+	}
+	for env, want := range expected {
+		if got := settings[env]; got != want {
+			t.Errorf("Expected %+v, got %+v", want, got)
+		}
+	}
+
+	// Developer options are only shown when changed
+	if _, ok := settings["PIA_CHAOS_BIND_FAIL_RATE"]; ok {
+		t.Errorf("Expected an unchanged developer option to be left out")
+	}
+}
+
+func TestArgsKeepNonDefaultZeroValues(t *testing.T) {
+	cfg := BuiltinConfig()
+	cfg.GatewayIdleTimeout = 0
+
+	parsed := BuiltinConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	if err := ParseFlags(fs, parsed, cfg.Args()); err != nil {
+		t.Fatalf("Failed to parse generated args %v: %v", cfg.Args(), err)
+	}
+	if parsed.GatewayIdleTimeout != 0 {
+		t.Errorf("Expected a zero gateway idle timeout to survive the round trip, got %s", parsed.GatewayIdleTimeout)
+	}
+}
+
 func TestLoadCredentials(t *testing.T) {
 	// Create a temporary credentials file
 	tmpDir := t.TempDir()
@@ -178,45 +1169,344 @@ func TestLoadCredentials(t *testing.T) {
 	}
 }
 
-func TestSplitLines(t *testing.T) {
+func TestParsePortRange(t *testing.T) {
 	testCases := []struct {
-		input    string
-		expected []string
+		input       string
+		lowest      int
+		highest     int
+		expectError bool
+	}{
+		{input: "40000-49999", lowest: 40000, highest: 49999},
+		{input: " 1024 - 65535 ", lowest: 1024, highest: 65535},
+		{input: "50000-50000", lowest: 50000, highest: 50000},
+		{input: "50000", expectError: true},
+		{input: "high-low", expectError: true},
+		{input: "0-1000", expectError: true},
+		{input: "60000-70000", expectError: true},
+		{input: "50000-40000", expectError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			lowest, highest, err := ParsePortRange(tc.input)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("Expected error, got %d-%d", lowest, highest)
+				}
+				return
+			}
+			if err != nil || lowest != tc.lowest || highest != tc.highest {
+				t.Errorf("Expected %d-%d, got %d-%d, %v", tc.lowest, tc.highest, lowest, highest, err)
+			}
+		})
+	}
+}
+
+func TestParseRenewBefore(t *testing.T) {
+	testCases := []struct {
+		input       string
+		before      time.Duration
+		remaining   float64
+		expectError bool
+	}{
+		{input: "72h", before: 72 * time.Hour},
+		{input: " 24h ", before: 24 * time.Hour},
+		{input: "25%", remaining: 0.25},
+		{input: "12.5 %", remaining: 0.125},
+		{input: "0%", expectError: true},
+		{input: "100%", expectError: true},
+		{input: "half%", expectError: true},
+		{input: "NaN%", expectError: true},
+		{input: "Inf%", expectError: true},
+		{input: "0s", expectError: true},
+		{input: "-1h", expectError: true},
+		{input: "1000h", expectError: true},
+		{input: "3 days", expectError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			before, remaining, err := ParseRenewBefore(tc.input)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("Expected error, got %s, %v", before, remaining)
+				}
+				return
+			}
+			if err != nil || before != tc.before || remaining != tc.remaining {
+				t.Errorf("Expected %s, %v, got %s, %v, %v", tc.before, tc.remaining, before, remaining, err)
+			}
+		})
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	testCases := []struct {
+		name        string
+		input       string
+		expected    http.Header
+		expectError bool
 	}{
 		{
-			input:    "line1\nline2\nline3",
-			expected: []string{"line1", "line2", "line3"},
+			name:     "Empty",
+			input:    "",
+			expected: http.Header{},
 		},
 		{
-			input:    "single_line",
-			expected: []string{"single_line"},
+			name:     "Single header",
+			input:    "X-Debug: 1",
+			expected: http.Header{"X-Debug": {"1"}},
 		},
 		{
-			input:    "",
-			expected: []string{},
+			name:     "Several headers with spacing",
+			input:    " x-client:nas ;X-Debug: 1; ",
+			expected: http.Header{"X-Client": {"nas"}, "X-Debug": {"1"}},
+		},
+		{
+			name:     "Value containing a colon",
+			input:    "X-Contact: mailto:admin@example.com",
+			expected: http.Header{"X-Contact": {"mailto:admin@example.com"}},
 		},
 		{
-			input:    "line_with_trailing_newline\n",
-			expected: []string{"line_with_trailing_newline", ""},
+			name:        "Missing colon",
+			input:       "X-Debug",
+			expectError: true,
+		},
+		{
+			name:        "Missing name",
+			input:       ": value",
+			expectError: true,
 		},
 		{
-			input:    "line1\r\nline2\r\n",
-			expected: []string{"line1", "line2", ""},
+			name:        "Space in name",
+			input:       "X Debug: 1",
+			expectError: true,
 		},
 	}
 
-	for i, tc := range testCases {
-		result := splitLines(tc.input)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{RequestHeaders: tc.input}
+			headers, err := cfg.Headers()
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("Expected error but got %v", headers)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+			if !reflect.DeepEqual(headers, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, headers)
+			}
+		})
+	}
+}
+
+func TestHiddenOptions(t *testing.T) {
+	var out bytes.Buffer
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(&out)
+	if err := ParseFlags(fs, &Config{}, []string{"-h"}); !errors.Is(err, flag.ErrHelp) {
+		t.Fatalf("Expected flag.ErrHelp, got %v", err)
+	}
+	if !strings.Contains(out.String(), "-credentials") {
+		t.Errorf("Expected the usage message to list --credentials, got:\n%s", out.String())
+	}
+	if strings.Contains(out.String(), "chaos") || strings.Contains(out.String(), "gateway-port") {
+		t.Errorf("Expected the usage message to leave out developer options, got:\n%s", out.String())
+	}
+
+	// Hidden options still work
+	cfg := &Config{}
+	if err := ParseFlags(flag.NewFlagSet("test", flag.ContinueOnError), cfg, []string{"--chaos-bind-fail-rate=0.5"}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ChaosBindFailRate != 0.5 {
+		t.Errorf("Expected the fail rate to be parsed, got %v", cfg.ChaosBindFailRate)
+	}
+}
 
-		if len(result) != len(tc.expected) {
-			t.Errorf("Test case %d: Expected %d lines, got %d", i, len(tc.expected), len(result))
-			continue
+func BenchmarkParseArgs(b *testing.B) {
+	args := []string{"--credentials=/etc/go-pia/credentials", "--refresh-interval=10m", "--debug", "/var/run/pia-port.txt"}
+	for b.Loop() {
+		if _, err := ParseArgs(args); err != nil {
+			b.Fatal(err)
 		}
+	}
+}
 
-		for j, line := range result {
-			if line != tc.expected[j] {
-				t.Errorf("Test case %d, line %d: Expected %q, got %q", i, j, tc.expected[j], line)
+func TestParseCredentials(t *testing.T) {
+	testCases := []struct {
+		name        string
+		input       string
+		expectExtra int
+		// Errors in lenient and strict mode, empty if the credentials are read
+		expectError       string
+		expectStrictError string
+	}{
+		{name: "Two lines", input: "p1234567\nsecret\n"},
+		{name: "No final newline", input: "p1234567\nsecret"},
+		{name: "CRLF", input: "p1234567\r\nsecret\r\n"},
+		{name: "Trailing spaces", input: "p1234567  \nsecret \t\n", expectStrictError: "line 1 has whitespace around it"},
+		{name: "Leading spaces", input: "p1234567\n  secret\n", expectStrictError: "line 2 has whitespace around it"},
+		{name: "Blank lines", input: "\np1234567\n\nsecret\n\n", expectStrictError: "line 1 is blank"},
+		{name: "Byte order mark", input: "\uFEFFp1234567\nsecret\n", expectStrictError: "byte order mark"},
+		{name: "Extra lines", input: "p1234567\nsecret\nremember me\n", expectExtra: 1, expectStrictError: "expected 2 lines, found 3"},
+		{name: "Empty", input: "", expectError: "no username or password", expectStrictError: "no username or password"},
+		{name: "Only whitespace", input: " \n\t\n", expectError: "no username or password", expectStrictError: "line 1 is blank"},
+		{name: "Username only", input: "p1234567\n", expectError: "no password", expectStrictError: "no password"},
+		{name: "Blank password", input: "p1234567\n   \n", expectError: "no password", expectStrictError: "line 2 is blank"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, strict := range []bool{false, true} {
+				expectError := tc.expectError
+				if strict {
+					expectError = tc.expectStrictError
+				}
+
+				username, password, extra, err := parseCredentials(tc.input, strict)
+				if expectError != "" {
+					if err == nil || !strings.Contains(err.Error(), expectError) {
+						t.Errorf("strict=%v: expected error containing %q, got %v", strict, expectError, err)
+					}
+					if err != nil && (strings.Contains(err.Error(), "secret") || strings.Contains(err.Error(), "p1234567")) {
+						t.Errorf("strict=%v: expected the error not to reveal the credentials, got %v", strict, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("strict=%v: unexpected error: %v", strict, err)
+					continue
+				}
+				if username != "p1234567" || password != "secret" || extra != tc.expectExtra {
+					t.Errorf("strict=%v: expected p1234567/secret with %d extra lines, got %q/%q with %d", strict, tc.expectExtra, username, password, extra)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadCredentialsLineEndings(t *testing.T) {
+	tmpDir := t.TempDir()
+	for name, content := range map[string]string{
+		"BOM and CRLF": "\uFEFFtestuser\r\ntestpass\r\n",
+		"Lone CR":      "testuser\rtestpass",
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{CredentialsFile: filepath.Join(tmpDir, "credentials.txt")}
+			if err := os.WriteFile(cfg.CredentialsFile, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			username, password, err := cfg.LoadCredentials()
+			if err != nil || username != "testuser" || password != "testpass" {
+				t.Errorf("Expected testuser/testpass, got %q/%q, %v", username, password, err)
 			}
+		})
+	}
+
+	// A trailing newline is not an empty password
+	cfg := &Config{CredentialsFile: filepath.Join(tmpDir, "username-only.txt")}
+	if err := os.WriteFile(cfg.CredentialsFile, []byte("testuser\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cfg.LoadCredentials(); err == nil {
+		t.Errorf("Expected a file with only a username to be rejected")
+	}
+}
+
+func TestSummaryFormat(t *testing.T) {
+	testCases := []struct {
+		quiet      bool
+		summary    string
+		outputFile string
+		expected   string
+	}{
+		{quiet: false, summary: "", expected: ""},
+		{quiet: true, summary: "", expected: SummaryPort},
+		{quiet: true, summary: SummaryJSON, expected: SummaryJSON},
+		{quiet: false, summary: SummaryJSON, expected: SummaryJSON},
+		{quiet: true, summary: "", outputFile: StdoutOutput, expected: ""},
+	}
+
+	for _, tc := range testCases {
+		cfg := &Config{Quiet: tc.quiet, Summary: tc.summary, OutputFile: tc.outputFile}
+		if got := cfg.SummaryFormat(); got != tc.expected {
+			t.Errorf("Expected quiet=%v summary=%q to print %q, got %q", tc.quiet, tc.summary, tc.expected, got)
 		}
 	}
 }
+
+func TestStartupFiles(t *testing.T) {
+	testCases := []struct {
+		name     string
+		modify   func(c *Config)
+		expected []string
+	}{
+		{name: "OpenVPN", expected: []string{"/etc/openvpn/client/pia.txt", "/etc/openvpn/client/pia.ovpn"}},
+		{name: "Token", modify: func(c *Config) { c.CredentialsFile = "" }, expected: []string{"/etc/openvpn/client/pia.ovpn"}},
+		{name: "Remote host", modify: func(c *Config) { c.RemoteHost = "ssh://root@192.168.1.1" }, expected: []string{"/etc/openvpn/client/pia.txt"}},
+		{name: "WireGuard", modify: func(c *Config) { c.ManageVPN = ManageWireGuard }, expected: []string{"/etc/openvpn/client/pia.txt"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.CredentialsFile = "/etc/openvpn/client/pia.txt"
+			if tc.modify != nil {
+				tc.modify(cfg)
+			}
+			if files := cfg.StartupFiles(); !reflect.DeepEqual(files, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, files)
+			}
+		})
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	testCases := []struct {
+		name            string
+		refreshInterval time.Duration
+		scriptTimeout   time.Duration
+		expected        []string
+	}{
+		{name: "Defaults", refreshInterval: 15 * time.Minute, scriptTimeout: 30 * time.Second},
+		{name: "At the minimum", refreshInterval: MinRefreshInterval, scriptTimeout: MinRefreshInterval},
+		{
+			name:            "Below the minimum",
+			refreshInterval: 30 * time.Second,
+			scriptTimeout:   10 * time.Second,
+			expected:        []string{"refresh interval 30s is below 1m0s"},
+		},
+		{
+			name:            "Above the keepalive limit",
+			refreshInterval: MaxRefreshInterval + time.Second,
+			scriptTimeout:   30 * time.Second,
+			expected:        []string{"refresh interval 15m1s exceeds the 15m0s PIA keepalive limit"},
+		},
+		{
+			name:            "Script timeout above the refresh interval",
+			refreshInterval: 5 * time.Minute,
+			scriptTimeout:   5*time.Minute + time.Second,
+			expected:        []string{"script timeout 5m1s exceeds the refresh interval 5m0s"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{RefreshInterval: tc.refreshInterval, ScriptTimeout: tc.scriptTimeout}
+			warnings := cfg.Warnings()
+			if len(warnings) != len(tc.expected) {
+				t.Fatalf("Expected %d warnings, got %q", len(tc.expected), warnings)
+			}
+			for i, expected := range tc.expected {
+				if !strings.Contains(warnings[i], expected) {
+					t.Errorf("Expected a warning containing %q, got %q", expected, warnings[i])
+				}
+			}
+		})
+	}
+}
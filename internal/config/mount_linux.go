@@ -0,0 +1,70 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// mountOptions returns the mount point path is on and its mount options, such
+// as "ro,nosuid", as the kernel lists them in /proc/self/mountinfo
+func mountOptions(path string) (mountPoint, options string, ok bool) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return "", "", false
+	}
+	return findMount(string(data), path)
+}
+
+// findMount returns the mount in mountinfo holding path, the one mounted last
+// at the longest mount point above it
+func findMount(mountinfo, path string) (mountPoint, options string, ok bool) {
+	for _, line := range strings.Split(mountinfo, "\n") {
+		// ID, parent ID, device, root, mount point, options, ...
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+		point := unescapeMountPoint(fields[4])
+		if !isUnder(path, point) || len(point) < len(mountPoint) {
+			continue
+		}
+		mountPoint, options, ok = point, fields[5], true
+	}
+	return mountPoint, options, ok
+}
+
+// isUnder reports whether path is dir or inside it
+func isUnder(path, dir string) bool {
+	if dir == "/" || path == dir {
+		return true
+	}
+	return strings.HasPrefix(path, dir+"/")
+}
+
+// unescapeMountPoint decodes the octal escapes, such as \040 for a space,
+// mountinfo uses in paths
+func unescapeMountPoint(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,29 @@
+package config
+
+import "testing"
+
+func TestFindMount(t *testing.T) {
+	mountinfo := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+25 22 0:21 / /run rw,nosuid,nodev shared:5 - tmpfs tmpfs rw,mode=755
+31 22 8:2 / /var/lib/go\040pia ro,noexec,relatime shared:9 - ext4 /dev/sda2 ro
+32 25 0:30 / /run rw,nosuid shared:6 - tmpfs tmpfs rw
+`
+	testCases := []struct {
+		path       string
+		mountPoint string
+		options    string
+	}{
+		{path: "/etc", mountPoint: "/", options: "rw,relatime"},
+		{path: "/var/lib/go pia/state", mountPoint: "/var/lib/go pia", options: "ro,noexec,relatime"},
+		{path: "/var/lib/go piaz", mountPoint: "/", options: "rw,relatime"},
+		// The last mount over /run hides the first
+		{path: "/run/go-pia", mountPoint: "/run", options: "rw,nosuid"},
+	}
+
+	for _, tc := range testCases {
+		mountPoint, options, ok := findMount(mountinfo, tc.path)
+		if !ok || mountPoint != tc.mountPoint || options != tc.options {
+			t.Errorf("For %s, expected %s with %s, got %s with %s (%v)", tc.path, tc.mountPoint, tc.options, mountPoint, options, ok)
+		}
+	}
+}
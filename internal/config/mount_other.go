@@ -0,0 +1,8 @@
+//go:build !linux
+
+package config
+
+// mountOptions isn't known outside Linux
+func mountOptions(path string) (mountPoint, options string, ok bool) {
+	return "", "", false
+}
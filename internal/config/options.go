@@ -0,0 +1,883 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// option describes a configuration setting; flags, environment variables and
+// generated arguments are all derived from the options table
+type option struct {
+	// Command line flag name (no flag if empty)
+	flag string
+	// Environment variable name
+	env string
+	// Help text
+	usage string
+	// Returns a pointer to the field in cfg: *string, *bool, *int, *float64 or
+	// *time.Duration
+	field func(cfg *Config) any
+	// Developer option left out of the usage message, completions and man page
+	hidden bool
+	// Value, such as a token or a URL that grants access, masked when the
+	// configuration is shown
+	secret bool
+}
+
+// options returns every configuration setting in the order they're documented
+func options() []option {
+	return []option{
+		{
+			flag:  "credentials",
+			env:   "PIA_CREDENTIALS",
+			usage: "Path to the file containing PIA credentials (username and password)",
+			field: func(cfg *Config) any { return &cfg.CredentialsFile },
+		},
+		{
+			flag:  "strict-credentials",
+			env:   "PIA_STRICT_CREDENTIALS",
+			usage: "Reject a credentials file with whitespace around the username or password, blank lines, a byte order mark or extra lines, instead of skipping them",
+			field: func(cfg *Config) any { return &cfg.StrictCredentials },
+		},
+		{
+			flag:   "token",
+			env:    "PIA_TOKEN",
+			usage:  "PIA authentication token to use instead of --credentials; it isn't renewed, so restart with a new one within 24 hours",
+			field:  func(cfg *Config) any { return &cfg.Token },
+			secret: true,
+		},
+		{
+			// The output file is the positional argument on the command line
+			env:   "PIA_OUTPUT_FILE",
+			usage: "Path to the file where the forwarded port will be written",
+			field: func(cfg *Config) any { return &cfg.OutputFile },
+		},
+		{
+			flag:  "output-format",
+			env:   "PIA_OUTPUT_FORMAT",
+			usage: "Format of the output file: text for just the port, or json to include expires_at and renews_at",
+			field: func(cfg *Config) any { return &cfg.OutputFormat },
+		},
+		{
+			flag:  "openvpn-config",
+			env:   "PIA_OPENVPN_CONFIG",
+			usage: "Path to the OpenVPN configuration file",
+			field: func(cfg *Config) any { return &cfg.OpenVPNConfigFile },
+		},
+		{
+			flag:  "wait-for-files",
+			env:   "PIA_WAIT_FOR_FILES",
+			usage: "Wait up to this long, e.g. 5m, for the credentials file and OpenVPN config to appear before starting (default: don't wait)",
+			field: func(cfg *Config) any { return &cfg.WaitForFiles },
+		},
+		{
+			flag:  "remote-index",
+			env:   "PIA_REMOTE_INDEX",
+			usage: "1-based index of the OpenVPN remote to use (0 detects the connected one)",
+			field: func(cfg *Config) any { return &cfg.RemoteIndex },
+		},
+		{
+			flag:  "remote",
+			env:   "PIA_REMOTE",
+			usage: "Host the VPN runs on, as ssh://user@host[:port]; the VPN is detected and the output file written there",
+			field: func(cfg *Config) any { return &cfg.RemoteHost },
+		},
+		{
+			flag:  "interface",
+			env:   "PIA_INTERFACE",
+			usage: "Interface of the PIA tunnel, needed when several tunnels are up (default: any tun interface)",
+			field: func(cfg *Config) any { return &cfg.Interface },
+		},
+		{
+			flag:  "detect",
+			env:   "PIA_DETECT",
+			usage: "Comma-separated VPN detection strategies to try in order (default: static,networkmanager,openvpn-management,wireguard,routes)",
+			field: func(cfg *Config) any { return &cfg.Detect },
+		},
+		{
+			flag:  "openvpn-management",
+			env:   "PIA_OPENVPN_MANAGEMENT",
+			usage: "Address of the OpenVPN management interface, as host:port or a unix socket path",
+			field: func(cfg *Config) any { return &cfg.OpenVPNManagement },
+		},
+		{
+			flag:  "gateway",
+			env:   "PIA_GATEWAY",
+			usage: "Gateway IP to use instead of detecting the VPN (static strategy)",
+			field: func(cfg *Config) any { return &cfg.Gateway },
+		},
+		{
+			flag:  "gateway-hostname",
+			env:   "PIA_GATEWAY_HOSTNAME",
+			usage: "Hostname of the gateway set with --gateway",
+			field: func(cfg *Config) any { return &cfg.GatewayHostname },
+		},
+		{
+			flag:  "manage-vpn",
+			env:   "PIA_MANAGE_VPN",
+			usage: "Bring up and supervise the VPN: openvpn or wireguard (default: use a running VPN)",
+			field: func(cfg *Config) any { return &cfg.ManageVPN },
+		},
+		{
+			flag:  "wireguard-server",
+			env:   "PIA_WIREGUARD_SERVER",
+			usage: "IP address of the PIA WireGuard server, with --manage-vpn=wireguard",
+			field: func(cfg *Config) any { return &cfg.WireGuardServer },
+		},
+		{
+			flag:  "wireguard-hostname",
+			env:   "PIA_WIREGUARD_HOSTNAME",
+			usage: "Hostname of the PIA WireGuard server (e.g. amsterdam407), with --manage-vpn=wireguard",
+			field: func(cfg *Config) any { return &cfg.WireGuardHostname },
+		},
+		{
+			flag:  "failover-after",
+			env:   "PIA_FAILOVER_AFTER",
+			usage: "Switch the managed VPN to the next best region after port forwarding fails for this long (e.g., 15m; 0 disables)",
+			field: func(cfg *Config) any { return &cfg.FailoverAfter },
+		},
+		{
+			flag:  "on-region-change",
+			env:   "PIA_ON_REGION_CHANGE",
+			usage: "Script to execute when the managed VPN switches regions",
+			field: func(cfg *Config) any { return &cfg.OnRegionChangeScript },
+		},
+		{
+			flag:  "server-list-cache",
+			env:   "PIA_SERVER_LIST_CACHE",
+			usage: "Path to the cached PIA server list, used when it can't be downloaded (default: OUTPUT_FILE.servers.json)",
+			field: func(cfg *Config) any { return &cfg.ServerListCache },
+		},
+		{
+			flag:  "server-list-cache-ttl",
+			env:   "PIA_SERVER_LIST_CACHE_TTL",
+			usage: "How long the cached server list is used before it's downloaded again (0 always downloads)",
+			field: func(cfg *Config) any { return &cfg.ServerListCacheTTL },
+		},
+		{
+			flag:  "server-list-key",
+			env:   "PIA_SERVER_LIST_KEY",
+			usage: "PEM file with the RSA key PIA signs the server list with; lists not signed with it are rejected (default: PIA's key, built in)",
+			field: func(cfg *Config) any { return &cfg.ServerListKeyFile },
+		},
+		{
+			flag:  "ca-cert",
+			env:   "PIA_CA_CERT",
+			usage: "Path to the CA certificate file; embedded uses the copy built in, download fetches PIA's into the state file's directory on first run and checks its SHA-256",
+			field: func(cfg *Config) any { return &cfg.CACertFile },
+		},
+		{
+			flag:  "ca-cert-path",
+			env:   "PIA_CA_CERT_PATH",
+			usage: "Directories, separated like PATH, searched for a relative --ca-cert before the current directory, the binary's directory, the XDG data directories and /etc/openvpn/client",
+			field: func(cfg *Config) any { return &cfg.CACertSearchPath },
+		},
+		{
+			flag:  "refresh-interval",
+			env:   "PIA_REFRESH_INTERVAL",
+			usage: "Refresh interval for port forwarding (e.g., 15m, 900s)",
+			field: func(cfg *Config) any { return &cfg.RefreshInterval },
+		},
+		{
+			flag:  "refresh-jitter",
+			env:   "PIA_REFRESH_JITTER",
+			usage: "Maximum random jitter subtracted from each refresh interval (e.g., 1m)",
+			field: func(cfg *Config) any { return &cfg.RefreshJitter },
+		},
+		{
+			flag:  "min-bind-interval",
+			env:   "PIA_MIN_BIND_INTERVAL",
+			usage: "Skip keepalive binds if the port was bound more recently than this (0 disables)",
+			field: func(cfg *Config) any { return &cfg.MinBindInterval },
+		},
+		{
+			flag:  "renew-before",
+			env:   "PIA_RENEW_BEFORE",
+			usage: "Request a new signature this long before the current one expires (e.g., 72h), or once this much of its validity is left (e.g., 25%)",
+			field: func(cfg *Config) any { return &cfg.RenewBefore },
+		},
+		{
+			flag:  "keep-port-attempts",
+			env:   "PIA_KEEP_PORT_ATTEMPTS",
+			usage: "When a new signature has a different port, request another up to this many times to keep the old one (0 takes any port)",
+			field: func(cfg *Config) any { return &cfg.KeepPortAttempts },
+		},
+		{
+			flag:  "on-port-keep-failed",
+			env:   "PIA_ON_PORT_KEEP_FAILED",
+			usage: "Script to execute when the port couldn't be kept",
+			field: func(cfg *Config) any { return &cfg.OnPortKeepFailedScript },
+		},
+		{
+			flag:  "port-range",
+			env:   "PIA_PORT_RANGE",
+			usage: "Range the port should be in, as MIN-MAX, e.g. the ports a firewall lets through (default: any port)",
+			field: func(cfg *Config) any { return &cfg.PortRange },
+		},
+		{
+			flag:  "port-range-attempts",
+			env:   "PIA_PORT_RANGE_ATTEMPTS",
+			usage: "When a new signature's port is outside --port-range, request another up to this many times before taking it",
+			field: func(cfg *Config) any { return &cfg.PortRangeAttempts },
+		},
+		{
+			flag:  "script-timeout",
+			env:   "PIA_SCRIPT_TIMEOUT",
+			usage: "Timeout for script execution (e.g., 30s, 1m)",
+			field: func(cfg *Config) any { return &cfg.ScriptTimeout },
+		},
+		{
+			flag:  "on-exit",
+			env:   "PIA_ON_EXIT",
+			usage: "Script to execute when the service shuts down",
+			field: func(cfg *Config) any { return &cfg.OnExitScript },
+		},
+		{
+			flag:  "shutdown-timeout",
+			env:   "PIA_SHUTDOWN_TIMEOUT",
+			usage: "How long shutdown waits for running scripts (e.g., 10s)",
+			field: func(cfg *Config) any { return &cfg.ShutdownTimeout },
+		},
+		{
+			flag:  "vpn-retry-interval",
+			env:   "PIA_VPN_RETRY_INTERVAL",
+			usage: "Retry interval for VPN connection attempts (e.g., 60s, 1m)",
+			field: func(cfg *Config) any { return &cfg.VPNRetryInterval },
+		},
+		{
+			flag:  "vpn-detect-timeout",
+			env:   "PIA_VPN_DETECT_TIMEOUT",
+			usage: "Give up detecting the VPN at startup after this long, e.g. 5m (default: keep trying)",
+			field: func(cfg *Config) any { return &cfg.VPNDetectTimeout },
+		},
+		{
+			flag:  "vpn-detect-max-attempts",
+			env:   "PIA_VPN_DETECT_MAX_ATTEMPTS",
+			usage: "Give up detecting the VPN at startup after this many attempts (default: keep trying)",
+			field: func(cfg *Config) any { return &cfg.VPNDetectMaxAttempts },
+		},
+		{
+			flag:  "vpn-unit",
+			env:   "PIA_VPN_UNIT",
+			usage: "systemd unit running the VPN, e.g. openvpn-client@pia.service, to wait for before detecting the VPN and to follow for reconnects",
+			field: func(cfg *Config) any { return &cfg.VPNUnit },
+		},
+		{
+			flag:  "known-gateway-max-age",
+			env:   "PIA_KNOWN_GATEWAY_MAX_AGE",
+			usage: "Reuse the gateway from the state file at startup if it was bound within this long and answers, instead of detecting the VPN (0 always detects)",
+			field: func(cfg *Config) any { return &cfg.KnownGatewayMaxAge },
+		},
+		{
+			flag:  "debug",
+			env:   "PIA_DEBUG",
+			usage: "Enable debug logging",
+			field: func(cfg *Config) any { return &cfg.Debug },
+		},
+		{
+			flag:  "debug-dir",
+			env:   "PIA_DEBUG_DIR",
+			usage: "Directory to dump full PIA API requests and responses to, with secrets redacted (requires --debug)",
+			field: func(cfg *Config) any { return &cfg.DebugDir },
+		},
+		{
+			flag:  "quiet",
+			env:   "PIA_QUIET",
+			usage: "Only log warnings and errors, and print the port to stdout once it's bound (see --summary)",
+			field: func(cfg *Config) any { return &cfg.Quiet },
+		},
+		{
+			flag:  "summary",
+			env:   "PIA_SUMMARY",
+			usage: "Print one line to stdout once the port is bound: port for just the port, or json (default: port with --quiet)",
+			field: func(cfg *Config) any { return &cfg.Summary },
+		},
+		{
+			flag:  "on-port-change",
+			env:   "PIA_ON_PORT_CHANGE",
+			usage: "Script to execute when port changes",
+			field: func(cfg *Config) any { return &cfg.OnPortChangeScript },
+		},
+		{
+			flag:  "sync-script",
+			env:   "PIA_SYNC_SCRIPT",
+			usage: "Whether to run the script synchronously (wait for completion)",
+			field: func(cfg *Config) any { return &cfg.SyncScript },
+		},
+		{
+			flag:  "port-change-debounce",
+			env:   "PIA_PORT_CHANGE_DEBOUNCE",
+			usage: "Hold port changes back this long and run hooks and integrations once for the latest (e.g., 1m, 0 disables)",
+			field: func(cfg *Config) any { return &cfg.PortChangeDebounce },
+		},
+		{
+			flag:  "previous-port-grace",
+			env:   "PIA_PREVIOUS_PORT_GRACE",
+			usage: "Keep passing the previous port to scripts and templates this long after a change, so its rules stay (e.g., 30m, 0 disables)",
+			field: func(cfg *Config) any { return &cfg.PreviousPortGrace },
+		},
+		{
+			flag:  "gateway-idle-timeout",
+			env:   "PIA_GATEWAY_IDLE_TIMEOUT",
+			usage: "How long idle connections to the gateway are kept open, 0 disables keep-alives (e.g., 20m)",
+			field: func(cfg *Config) any { return &cfg.GatewayIdleTimeout },
+		},
+		{
+			flag:  "gateway-max-idle-conns",
+			env:   "PIA_GATEWAY_MAX_IDLE_CONNS",
+			usage: "Maximum number of idle connections kept open to the gateway",
+			field: func(cfg *Config) any { return &cfg.GatewayMaxIdleConns },
+		},
+		{
+			flag:  "connect-via",
+			env:   "PIA_CONNECT_VIA",
+			usage: "What port forwarding requests connect to: gateway for the gateway IP, or hostname for the gateway hostname resolved by DNS and sent as SNI, for policy routing (default: gateway)",
+			field: func(cfg *Config) any { return &cfg.ConnectVia },
+		},
+		{
+			flag:  "pid-file",
+			env:   "PIA_PID_FILE",
+			usage: "Path to write the process ID to",
+			field: func(cfg *Config) any { return &cfg.PIDFile },
+		},
+		{
+			flag:  "daemonize",
+			env:   "PIA_DAEMONIZE",
+			usage: "Run in the background, detached from the terminal",
+			field: func(cfg *Config) any { return &cfg.Daemonize },
+		},
+		{
+			flag:  "log-file",
+			env:   "PIA_LOG_FILE",
+			usage: "Path to append log output to (default: stderr)",
+			field: func(cfg *Config) any { return &cfg.LogFile },
+		},
+		{
+			flag:  "log-color",
+			env:   "PIA_LOG_COLOR",
+			usage: "Color log lines: auto (on a terminal, unless NO_COLOR is set), always or never (default: auto)",
+			field: func(cfg *Config) any { return &cfg.LogColor },
+		},
+		{
+			flag:  "metrics-addr",
+			env:   "PIA_METRICS_ADDR",
+			usage: "Address to serve Prometheus metrics on (e.g., 127.0.0.1:9876)",
+			field: func(cfg *Config) any { return &cfg.MetricsAddr },
+		},
+		{
+			flag:  "dns-server",
+			env:   "PIA_DNS_SERVER",
+			usage: "DNS server used for all hostname lookups, e.g. PIA's 10.0.0.243 (default: system resolver)",
+			field: func(cfg *Config) any { return &cfg.DNSServer },
+		},
+		{
+			flag:  "dns-cache",
+			env:   "PIA_DNS_CACHE",
+			usage: "Cache lookups of PIA hostnames for as long as their TTLs allow, and use them past it while the DNS server is unreachable",
+			field: func(cfg *Config) any { return &cfg.DNSCache },
+		},
+		{
+			flag:  "force",
+			env:   "PIA_FORCE",
+			usage: "Allow settings that are known to break port forwarding (e.g., refresh interval above 15m)",
+			field: func(cfg *Config) any { return &cfg.Force },
+		},
+		{
+			flag:  "state-file",
+			env:   "PIA_STATE_FILE",
+			usage: "Path to the JSON state file read by the status command (default: OUTPUT_FILE.state.json)",
+			field: func(cfg *Config) any { return &cfg.StateFile },
+		},
+		{
+			flag:  "ready-file",
+			env:   "PIA_READY_FILE",
+			usage: "Path to a marker file created after the first successful bind and removed while binding keeps failing",
+			field: func(cfg *Config) any { return &cfg.ReadyFile },
+		},
+		{
+			flag:  "runtime-dir",
+			env:   "PIA_RUNTIME_DIR",
+			usage: "Absolute directory for everything go-pia writes, e.g. /run/go-pia; relative state, ready, PID, log and debug paths go under it, the output file defaults to DIR/port.txt and the built-in CA certificate is used, for read-only root filesystems",
+			field: func(cfg *Config) any { return &cfg.RuntimeDir },
+		},
+		{
+			flag:  "manual-connections-dir",
+			env:   "PIA_MANUAL_CONNECTIONS_DIR",
+			usage: "Directory to write port_forward.json and port_forward.env to, as PIA's manual-connections scripts would",
+			field: func(cfg *Config) any { return &cfg.ManualConnectionsDir },
+		},
+		{
+			flag:  "patch-file",
+			env:   "PIA_PATCH_FILE",
+			usage: "Client config file to write the port into whenever it changes, e.g. Transmission's settings.json or qBittorrent.conf",
+			field: func(cfg *Config) any { return &cfg.PatchFile },
+		},
+		{
+			flag:  "patch-key",
+			env:   "PIA_PATCH_KEY",
+			usage: "Key set in the patch file: a dotted JSON path, or a key=value key with an optional [section] prefix (default: peer-port for .json, [BitTorrent]Session\\Port otherwise)",
+			field: func(cfg *Config) any { return &cfg.PatchKey },
+		},
+		{
+			flag:  "templates",
+			env:   "PIA_TEMPLATES",
+			usage: "Templates to render with the port whenever it changes, as SOURCE=TARGET pairs separated by commas",
+			field: func(cfg *Config) any { return &cfg.Templates },
+		},
+		{
+			flag:  "template-reload",
+			env:   "PIA_TEMPLATE_RELOAD",
+			usage: "Service to reload after templates change: pidfile:PATH sends SIGHUP, systemctl:UNIT runs systemctl reload",
+			field: func(cfg *Config) any { return &cfg.TemplateReload },
+		},
+		{
+			flag:  "notify-unit",
+			env:   "PIA_NOTIFY_UNIT",
+			usage: "systemd unit to reload, restart or signal over D-Bus whenever the port changes",
+			field: func(cfg *Config) any { return &cfg.NotifyUnit },
+		},
+		{
+			flag:  "notify-signal",
+			env:   "PIA_NOTIFY_SIGNAL",
+			usage: "What's done to the notify unit: reload, restart, reload-or-restart, or a signal such as HUP sent to its main process (default: reload)",
+			field: func(cfg *Config) any { return &cfg.NotifySignal },
+		},
+		{
+			flag:  "dbus-signal",
+			env:   "PIA_DBUS_SIGNAL",
+			usage: "Emit an org.gopia.PortForwarding.PortChanged D-Bus signal whenever the port changes, on the session or system bus",
+			field: func(cfg *Config) any { return &cfg.DBusSignal },
+		},
+		{
+			flag:  "ddns-provider",
+			env:   "PIA_DDNS_PROVIDER",
+			usage: "Publish the VPN exit IP, and optionally the port, with a dynamic DNS provider whenever either changes: cloudflare, duckdns or http",
+			field: func(cfg *Config) any { return &cfg.DDNSProvider },
+		},
+		{
+			flag:  "ddns-name",
+			env:   "PIA_DDNS_NAME",
+			usage: "Name pointed at the exit IP: a hostname in the Cloudflare zone, or a DuckDNS subdomain",
+			field: func(cfg *Config) any { return &cfg.DDNSName },
+		},
+		{
+			flag:  "ddns-zone",
+			env:   "PIA_DDNS_ZONE",
+			usage: "Cloudflare zone ID of --ddns-name",
+			field: func(cfg *Config) any { return &cfg.DDNSZone },
+		},
+		{
+			flag:   "ddns-url",
+			env:    "PIA_DDNS_URL",
+			usage:  "Update URL requested by the http provider, with {{.IP}}, {{.Port}} and {{.Name}} replaced",
+			field:  func(cfg *Config) any { return &cfg.DDNSURL },
+			secret: true,
+		},
+		{
+			flag:  "ddns-token-file",
+			env:   "PIA_DDNS_TOKEN_FILE",
+			usage: "File holding the DDNS provider's API token, read before every update",
+			field: func(cfg *Config) any { return &cfg.DDNSTokenFile },
+		},
+		{
+			flag:  "ddns-port-record",
+			env:   "PIA_DDNS_PORT_RECORD",
+			usage: "Also publish the port: txt for a port=N TXT record on --ddns-name, or an SRV service such as _minecraft._tcp",
+			field: func(cfg *Config) any { return &cfg.DDNSPortRecord },
+		},
+		{
+			flag:  "ddns-ip-url",
+			env:   "PIA_DDNS_IP_URL",
+			usage: "URL returning the exit IP as plain text (default: https://api.ipify.org)",
+			field: func(cfg *Config) any { return &cfg.DDNSIPURL },
+		},
+		{
+			flag:  "output-retry",
+			env:   "PIA_OUTPUT_RETRY",
+			usage: "Retry policies of outputs such as ddns or output-file, as NAME=RETRIES[/DELAY] pairs separated by commas, e.g. ddns=5/1m",
+			field: func(cfg *Config) any { return &cfg.OutputRetry },
+		},
+		{
+			flag:  "udp-probe",
+			env:   "PIA_UDP_PROBE",
+			usage: "UDP reflector (host[:port], default port 7787) asked to send datagrams to the forwarded port, reporting UDP loss separately",
+			field: func(cfg *Config) any { return &cfg.UDPProbe },
+		},
+		{
+			flag:  "udp-probe-interval",
+			env:   "PIA_UDP_PROBE_INTERVAL",
+			usage: "How often the forwarded port is probed over UDP",
+			field: func(cfg *Config) any { return &cfg.UDPProbeInterval },
+		},
+		{
+			flag:  "notifier",
+			env:   "PIA_NOTIFIER",
+			usage: "Send push notifications on port changes and persistent bind or authentication failures: ntfy, gotify or pushover",
+			field: func(cfg *Config) any { return &cfg.Notifier },
+		},
+		{
+			flag:   "notifier-url",
+			env:    "PIA_NOTIFIER_URL",
+			usage:  "ntfy topic URL, such as https://ntfy.sh/my-topic, or Gotify server URL",
+			field:  func(cfg *Config) any { return &cfg.NotifierURL },
+			secret: true,
+		},
+		{
+			flag:   "notifier-user",
+			env:    "PIA_NOTIFIER_USER",
+			usage:  "Pushover user or group key",
+			field:  func(cfg *Config) any { return &cfg.NotifierUser },
+			secret: true,
+		},
+		{
+			flag:  "notifier-token-file",
+			env:   "PIA_NOTIFIER_TOKEN_FILE",
+			usage: "File holding the ntfy access token or the Gotify or Pushover application token, read before every notification",
+			field: func(cfg *Config) any { return &cfg.NotifierTokenFile },
+		},
+		{
+			flag:  "notifier-events",
+			env:   "PIA_NOTIFIER_EVENTS",
+			usage: "Comma-separated events to notify about by push and email: port-change, bind-failure and auth-failure (default: all)",
+			field: func(cfg *Config) any { return &cfg.NotifierEvents },
+		},
+		{
+			flag:  "smtp-server",
+			env:   "PIA_SMTP_SERVER",
+			usage: "SMTP server (host:port) to email notifications through, on port changes and persistent failures",
+			field: func(cfg *Config) any { return &cfg.SMTPServer },
+		},
+		{
+			flag:  "smtp-security",
+			env:   "PIA_SMTP_SECURITY",
+			usage: "SMTP connection security: starttls, tls or none (default: tls on port 465, starttls otherwise)",
+			field: func(cfg *Config) any { return &cfg.SMTPSecurity },
+		},
+		{
+			flag:  "smtp-from",
+			env:   "PIA_SMTP_FROM",
+			usage: "Sender address of notification emails",
+			field: func(cfg *Config) any { return &cfg.SMTPFrom },
+		},
+		{
+			flag:  "smtp-to",
+			env:   "PIA_SMTP_TO",
+			usage: "Comma-separated addresses notification emails are sent to",
+			field: func(cfg *Config) any { return &cfg.SMTPTo },
+		},
+		{
+			flag:  "smtp-username",
+			env:   "PIA_SMTP_USERNAME",
+			usage: "SMTP login, if the server requires one",
+			field: func(cfg *Config) any { return &cfg.SMTPUsername },
+		},
+		{
+			flag:  "smtp-password-file",
+			env:   "PIA_SMTP_PASSWORD_FILE",
+			usage: "File holding the SMTP password, read before every email",
+			field: func(cfg *Config) any { return &cfg.SMTPPasswordFile },
+		},
+		{
+			flag:  "smtp-batch-interval",
+			env:   "PIA_SMTP_BATCH_INTERVAL",
+			usage: "How long notifications are collected before they're emailed together, so flapping sends one email (0 sends each right away)",
+			field: func(cfg *Config) any { return &cfg.SMTPBatchInterval },
+		},
+		{
+			flag:   "heartbeat-url",
+			env:    "PIA_HEARTBEAT_URL",
+			usage:  "Uptime monitor push URL (healthchecks.io, Uptime Kuma) requested after every successful bind",
+			field:  func(cfg *Config) any { return &cfg.HeartbeatURL },
+			secret: true,
+		},
+		{
+			flag:   "heartbeat-fail-url",
+			env:    "PIA_HEARTBEAT_FAIL_URL",
+			usage:  "URL requested while binding keeps failing (default: --heartbeat-url with /fail appended)",
+			field:  func(cfg *Config) any { return &cfg.HeartbeatFailURL },
+			secret: true,
+		},
+		{
+			flag:  "ubus",
+			env:   "PIA_UBUS",
+			usage: "Send a go-pia.port event on the OpenWrt ubus whenever the port changes",
+			field: func(cfg *Config) any { return &cfg.Ubus },
+		},
+		{
+			flag:  "user-agent",
+			env:   "PIA_USER_AGENT",
+			usage: "User-Agent sent on PIA API requests (default: go-pia-port-forwarding/VERSION)",
+			field: func(cfg *Config) any { return &cfg.UserAgent },
+		},
+		{
+			flag:   "request-headers",
+			env:    "PIA_REQUEST_HEADERS",
+			usage:  "Extra headers sent on PIA API requests, as \"Name: value\" pairs separated by \";\"",
+			field:  func(cfg *Config) any { return &cfg.RequestHeaders },
+			secret: true,
+		},
+		{
+			flag:   "chaos-bind-fail-rate",
+			env:    "PIA_CHAOS_BIND_FAIL_RATE",
+			usage:  "Fraction of binds, from 0 to 1, failed on purpose to try out hooks, alerting and backoff",
+			field:  func(cfg *Config) any { return &cfg.ChaosBindFailRate },
+			hidden: true,
+		},
+		{
+			flag:   "chaos-latency",
+			env:    "PIA_CHAOS_LATENCY",
+			usage:  "Add a random delay of up to this long to every gateway request",
+			field:  func(cfg *Config) any { return &cfg.ChaosLatency },
+			hidden: true,
+		},
+		{
+			flag:   "gateway-port",
+			env:    "PIA_GATEWAY_PORT",
+			usage:  "Reach the gateway API on this port instead of PIA's, e.g. for a mock gateway",
+			field:  func(cfg *Config) any { return &cfg.GatewayPort },
+			hidden: true,
+		},
+	}
+}
+
+// define registers the option on fs, bound to its field in cfg
+func (o option) define(fs *flag.FlagSet, name string, cfg *Config) {
+	switch p := o.field(cfg).(type) {
+	case *string:
+		fs.StringVar(p, name, *p, o.usage)
+	case *bool:
+		fs.BoolVar(p, name, *p, o.usage)
+	case *int:
+		fs.IntVar(p, name, *p, o.usage)
+	case *float64:
+		fs.Float64Var(p, name, *p, o.usage)
+	case *time.Duration:
+		fs.DurationVar(p, name, *p, o.usage)
+		f := fs.Lookup(name)
+		f.Value = &secondsValue{Value: f.Value, name: name}
+	default:
+		panic(fmt.Sprintf("config: unsupported type %T for option %s", p, name))
+	}
+}
+
+// secondsValue wraps a duration flag so it also takes a bare number of seconds,
+// which older releases did
+type secondsValue struct {
+	flag.Value
+	name string
+}
+
+// errDuration is returned for a value that's neither a duration nor a number
+var errDuration = errors.New("expected a duration such as 90s or 15m, or a number of seconds")
+
+func (v *secondsValue) Set(s string) error {
+	d, bare, err := ParseDuration(s)
+	if err != nil {
+		return errDuration
+	}
+	if bare {
+		log.Printf("Warning: --%s=%s is a number of seconds, which is deprecated; pass %s instead", v.name, s, d)
+	}
+	return v.Value.Set(d.String())
+}
+
+// unwrap returns the flag value a secondsValue wraps, or value itself
+func unwrap(value flag.Value) flag.Value {
+	if v, ok := value.(*secondsValue); ok {
+		return v.Value
+	}
+	return value
+}
+
+// UnquoteUsage is flag.UnquoteUsage, naming the value of duration flags as it
+// names that of flags defined with flag.Duration
+func UnquoteUsage(f *flag.Flag) (name, usage string) {
+	unwrapped := *f
+	unwrapped.Value = unwrap(f.Value)
+	return flag.UnquoteUsage(&unwrapped)
+}
+
+// value returns the option's field in cfg as a flag value
+func (o option) value(cfg *Config) flag.Value {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	o.define(fs, "value", cfg)
+	return fs.Lookup("value").Value
+}
+
+// isBool reports whether the option is a boolean switch
+func (o option) isBool() bool {
+	_, ok := o.field(&Config{}).(*bool)
+	return ok
+}
+
+// ParseDuration parses a duration setting: a Go duration such as "15m", or a
+// bare number of seconds such as "900", which older releases took from the
+// environment. The second result reports the deprecated bare form.
+func ParseDuration(s string) (time.Duration, bool, error) {
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil && seconds != 0 {
+		return time.Duration(seconds) * time.Second, true, nil
+	}
+	d, err := time.ParseDuration(s)
+	return d, false, err
+}
+
+// envValue returns the value of the option's environment variable in the form
+// its flag takes, and whether it's a deprecated bare number of seconds
+func (o option) envValue(value string) (string, bool) {
+	if _, ok := o.field(&Config{}).(*time.Duration); ok {
+		if d, bare, err := ParseDuration(value); err == nil && bare {
+			return d.String(), true
+		}
+	}
+	return value, false
+}
+
+// applyEnv sets every option whose environment variable is set. Values that
+// can't be parsed are ignored and the current value is kept; checkEnv reports
+// the durations among them.
+func applyEnv(cfg *Config) {
+	for _, o := range options() {
+		if value, ok := os.LookupEnv(o.env); ok && value != "" {
+			parsed, deprecated := o.envValue(value)
+			if deprecated {
+				log.Printf("Warning: %s=%s is a number of seconds, which is deprecated; set it to %s instead", o.env, value, parsed)
+			}
+
+			// Set on a copy, flag values may be overwritten even when parsing fails
+			updated := *cfg
+			if err := o.value(&updated).Set(parsed); err == nil {
+				*cfg = updated
+			}
+		}
+	}
+}
+
+// checkEnv returns an error naming every environment variable of a duration
+// option set to a value that isn't one, unless the option's flag was given on
+// fs. Those would otherwise leave a timer at its default unnoticed.
+func checkEnv(fs *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	var errs []error
+	for _, o := range options() {
+		if _, ok := o.field(&Config{}).(*time.Duration); !ok {
+			continue
+		}
+		value, ok := os.LookupEnv(o.env)
+		if !ok || value == "" || o.flag != "" && given[o.flag] {
+			continue
+		}
+		parsed, _ := o.envValue(value)
+		if err := o.value(&Config{}).Set(parsed); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value %q for %s: %w", value, o.env, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Hidden reports whether the option with the given flag name is a developer
+// option that isn't documented
+func Hidden(flagName string) bool {
+	for _, o := range options() {
+		if o.flag != "" && o.flag == flagName {
+			return o.hidden
+		}
+	}
+	return false
+}
+
+// printUsage prints fs's usage message like the flag package does, leaving
+// out hidden options
+func printUsage(fs *flag.FlagSet) {
+	if fs.Name() == "" {
+		fmt.Fprintf(fs.Output(), "Usage:\n")
+	} else {
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", fs.Name())
+	}
+	visible := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	visible.SetOutput(fs.Output())
+	fs.VisitAll(func(f *flag.Flag) {
+		if !Hidden(f.Name) {
+			visible.Var(unwrap(f.Value), f.Name, f.Usage)
+			visible.Lookup(f.Name).DefValue = f.DefValue
+		}
+	})
+	visible.PrintDefaults()
+}
+
+// EnvVar returns the environment variable that sets the option with the given
+// flag name, or an empty string if there's no such option
+func EnvVar(flagName string) string {
+	for _, o := range options() {
+		if o.flag != "" && o.flag == flagName {
+			return o.env
+		}
+	}
+	return ""
+}
+
+// Where a setting's value came from
+const (
+	SourceDefault = "default"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+)
+
+// maskedValue replaces the value of a secret setting
+const maskedValue = "********"
+
+// Setting is the effective value of a configuration option and where it came
+// from
+type Setting struct {
+	// Command line flag, empty for the output file
+	Flag string `json:"flag,omitempty"`
+	// Environment variable
+	Env string `json:"env"`
+	// Effective value, masked for secrets
+	Value string `json:"value"`
+	// SourceDefault, SourceEnv or SourceFlag
+	Source string `json:"source"`
+	// Why the environment variable, if set, was ignored
+	Warning string `json:"warning,omitempty"`
+}
+
+// Settings returns the effective value of every documented option in cfg, and
+// of developer options that were changed, with secret values masked. cfg must
+// have been parsed from fs with ParseFlags, which records the flags given.
+func Settings(fs *flag.FlagSet, cfg *Config) []Setting {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	var settings []Setting
+	for _, o := range options() {
+		setting := Setting{Flag: o.flag, Env: o.env, Value: o.value(cfg).String(), Source: SourceDefault}
+		if o.flag == "" && fs.NArg() == 1 || o.flag != "" && given[o.flag] {
+			setting.Source = SourceFlag
+		} else if value, ok := os.LookupEnv(o.env); ok && value != "" {
+			parsed, deprecated := o.envValue(value)
+			if err := o.value(&Config{}).Set(parsed); err != nil {
+				setting.Warning = fmt.Sprintf("%s=%q isn't a valid value and was ignored", o.env, value)
+			} else {
+				setting.Source = SourceEnv
+			}
+			if deprecated {
+				setting.Warning = fmt.Sprintf("%s=%s is a number of seconds, which is deprecated; set it to %s instead", o.env, value, parsed)
+			}
+		}
+
+		if o.hidden && setting.Source == SourceDefault {
+			continue
+		}
+		if o.secret && setting.Value != "" {
+			setting.Value = maskedValue
+		}
+		settings = append(settings, setting)
+	}
+	return settings
+}
@@ -0,0 +1,307 @@
+// Package confpatch writes the forwarded port into another program's config
+// file, for clients like Transmission and qBittorrent that read their listening
+// port at startup
+package confpatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/meschansky/go-pia/internal/atomicfile"
+)
+
+// Strategies for finding the port in a config file
+const (
+	// FormatJSON sets a dotted path of object keys in a JSON file
+	FormatJSON = "json"
+	// FormatKeyValue sets a key=value line, optionally within an INI [section]
+	FormatKeyValue = "keyvalue"
+)
+
+// Keys patched when none is given: Transmission's settings.json and the
+// qBittorrent.conf of qBittorrent 4.4 and later
+const (
+	DefaultJSONKey     = "peer-port"
+	DefaultKeyValueKey = `[BitTorrent]Session\Port`
+)
+
+// BackupSuffix is appended to the file's name for the copy kept of it before
+// it's changed
+const BackupSuffix = ".bak"
+
+// FormatFor returns the strategy used for path: JSON for .json files, key=value
+// for everything else
+func FormatFor(path string) string {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return FormatJSON
+	}
+	return FormatKeyValue
+}
+
+// DefaultKey returns the key patched in files of the given format when none is
+// configured
+func DefaultKey(format string) string {
+	if format == FormatJSON {
+		return DefaultJSONKey
+	}
+	return DefaultKeyValueKey
+}
+
+// Check reports whether path can be patched: it must exist and parse in its
+// format
+func Check(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if FormatFor(path) == FormatJSON {
+		var v map[string]any
+		if err := json.Unmarshal(data, &v); err != nil {
+			return fmt.Errorf("%s is not a JSON object: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// Port sets key in the config file at path to port, using the strategy
+// FormatFor picks. An empty key means DefaultKey. The file's previous contents
+// are copied to path+BackupSuffix and the result is checked before it replaces
+// the file. It reports whether the file changed.
+func Port(path, key string, port int) (bool, error) {
+	format := FormatFor(path)
+	if key == "" {
+		key = DefaultKey(format)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	// Patch the contents, then read the port back to make sure it took
+	var patched []byte
+	var got int
+	if format == FormatJSON {
+		patched, err = patchJSON(data, key, port)
+		if err == nil {
+			got, err = readJSON(patched, key)
+		}
+	} else {
+		patched = patchKeyValue(data, key, port)
+		got, err = readKeyValue(patched, key)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to patch %s: %w", path, err)
+	}
+	if got != port {
+		return false, fmt.Errorf("failed to patch %s: %s reads back as %d, not %d", path, key, got, port)
+	}
+	if bytes.Equal(patched, data) {
+		return false, nil
+	}
+
+	// Keep the previous contents before replacing them
+	if err := atomicfile.WriteFile(path+BackupSuffix, data, info.Mode().Perm()); err != nil {
+		return false, fmt.Errorf("failed to back up %s: %w", path, err)
+	}
+	if err := atomicfile.WriteFile(path, patched, info.Mode().Perm()); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// patchJSON sets the dotted path key to port in a JSON object, creating
+// objects along the way. Keys come out sorted, as Transmission writes them.
+func patchJSON(data []byte, key string, port int) ([]byte, error) {
+	var root map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&root); err != nil {
+		return nil, fmt.Errorf("not a JSON object: %w", err)
+	}
+	if root == nil {
+		root = map[string]any{}
+	}
+
+	parts := strings.Split(key, ".")
+	obj := root
+	for _, part := range parts[:len(parts)-1] {
+		switch next := obj[part].(type) {
+		case map[string]any:
+			obj = next
+		case nil:
+			child := map[string]any{}
+			obj[part] = child
+			obj = child
+		default:
+			return nil, fmt.Errorf("%s in %s is not an object", part, key)
+		}
+	}
+
+	// Leave the file alone if the port is already there
+	last := parts[len(parts)-1]
+	if n, ok := obj[last].(json.Number); ok && n.String() == strconv.Itoa(port) {
+		return data, nil
+	}
+	obj[last] = port
+
+	// Paths and URLs in the file are kept as they are, "&" and all
+	var patched bytes.Buffer
+	encoder := json.NewEncoder(&patched)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "    ")
+	if err := encoder.Encode(root); err != nil {
+		return nil, err
+	}
+	return patched.Bytes(), nil
+}
+
+// readJSON returns the port at the dotted path key
+func readJSON(data []byte, key string) (int, error) {
+	var v any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		return 0, err
+	}
+	for _, part := range strings.Split(key, ".") {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return 0, fmt.Errorf("%s not found", key)
+		}
+		v = obj[part]
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("%s is not a number", key)
+	}
+	port, err := strconv.Atoi(n.String())
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a port: %w", key, err)
+	}
+	return port, nil
+}
+
+// splitKey separates the optional [section] prefix from a key=value key
+func splitKey(key string) (section, name string) {
+	if strings.HasPrefix(key, "[") {
+		if end := strings.Index(key, "]"); end > 0 {
+			return key[1:end], key[end+1:]
+		}
+	}
+	return "", key
+}
+
+// keyValueLine is one line of a key=value file
+type keyValueLine struct {
+	text    string
+	section string
+	// Name before the "=", empty for headers, comments and blank lines
+	name string
+}
+
+// parseKeyValue splits data into lines, noting the section each is in
+func parseKeyValue(data []byte) ([]keyValueLine, string) {
+	newline := "\n"
+	if bytes.Contains(data, []byte("\r\n")) {
+		newline = "\r\n"
+	}
+	text := strings.TrimSuffix(string(data), newline)
+	if text == "" {
+		return nil, newline
+	}
+
+	var lines []keyValueLine
+	section := ""
+	for _, line := range strings.Split(text, newline) {
+		trimmed := strings.TrimSpace(line)
+		l := keyValueLine{text: line, section: section}
+		switch {
+		case strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]"):
+			section = trimmed[1 : len(trimmed)-1]
+			l.section = section
+		case strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, ";"):
+		default:
+			if name, _, ok := strings.Cut(trimmed, "="); ok {
+				l.name = strings.TrimSpace(name)
+			}
+		}
+		lines = append(lines, l)
+	}
+	return lines, newline
+}
+
+// matches reports whether line sets name, in section if one is given
+func (l keyValueLine) matches(section, name string) bool {
+	return l.name == name && (section == "" || l.section == section)
+}
+
+// patchKeyValue sets the key's value to port, keeping the spacing around "=".
+// A missing key is added at the end of its section, which is created if needed.
+func patchKeyValue(data []byte, key string, port int) []byte {
+	section, name := splitKey(key)
+	lines, newline := parseKeyValue(data)
+	value := strconv.Itoa(port)
+
+	found := false
+	lastInSection := -1
+	for i, l := range lines {
+		if l.matches(section, name) {
+			eq := strings.Index(l.text, "=")
+			spacing := len(l.text[eq+1:]) - len(strings.TrimLeft(l.text[eq+1:], " \t"))
+			lines[i].text = l.text[:eq+1+spacing] + value
+			found = true
+		}
+		if section != "" && l.section == section && strings.TrimSpace(l.text) != "" {
+			lastInSection = i
+		}
+	}
+
+	if !found {
+		added := keyValueLine{text: name + "=" + value, section: section, name: name}
+		switch {
+		case section == "":
+			lines = append(lines, added)
+		case lastInSection >= 0:
+			lines = append(lines[:lastInSection+1], append([]keyValueLine{added}, lines[lastInSection+1:]...)...)
+		default:
+			if len(lines) > 0 {
+				lines = append(lines, keyValueLine{})
+			}
+			lines = append(lines, keyValueLine{text: "[" + section + "]", section: section}, added)
+		}
+	}
+
+	var b strings.Builder
+	for _, l := range lines {
+		b.WriteString(l.text + newline)
+	}
+	return []byte(b.String())
+}
+
+// readKeyValue returns the port the key is set to
+func readKeyValue(data []byte, key string) (int, error) {
+	section, name := splitKey(key)
+	lines, _ := parseKeyValue(data)
+	for _, l := range lines {
+		if l.matches(section, name) {
+			_, value, _ := strings.Cut(l.text, "=")
+			port, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return 0, fmt.Errorf("%s is not a port: %w", key, err)
+			}
+			return port, nil
+		}
+	}
+	return 0, errors.New(key + " not found")
+}
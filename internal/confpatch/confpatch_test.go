@@ -0,0 +1,147 @@
+package confpatch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPort(t *testing.T) {
+	testCases := []struct {
+		name     string
+		file     string
+		key      string
+		before   string
+		expected string
+	}{
+		{
+			name:     "Transmission settings",
+			file:     "settings.json",
+			before:   `{"peer-port": 51413, "download-dir": "/downloads/a&b", "ratio-limit": 2.5}`,
+			expected: "{\n    \"download-dir\": \"/downloads/a&b\",\n    \"peer-port\": 12345,\n    \"ratio-limit\": 2.5\n}\n",
+		},
+		{
+			name:     "Nested JSON key",
+			file:     "config.json",
+			key:      "network.listen.port",
+			before:   `{"network": {"host": "0.0.0.0"}}`,
+			expected: "{\n    \"network\": {\n        \"host\": \"0.0.0.0\",\n        \"listen\": {\n            \"port\": 12345\n        }\n    }\n}\n",
+		},
+		{
+			name:     "qBittorrent config",
+			file:     "qBittorrent.conf",
+			before:   "[BitTorrent]\nSession\\DefaultSavePath=/downloads\nSession\\Port=51413\n\n[Preferences]\nGeneral\\Locale=en\n",
+			expected: "[BitTorrent]\nSession\\DefaultSavePath=/downloads\nSession\\Port=12345\n\n[Preferences]\nGeneral\\Locale=en\n",
+		},
+		{
+			name:     "Key added to its section",
+			file:     "qBittorrent.conf",
+			before:   "[BitTorrent]\nSession\\DefaultSavePath=/downloads\n\n[Preferences]\nGeneral\\Locale=en\n",
+			expected: "[BitTorrent]\nSession\\DefaultSavePath=/downloads\nSession\\Port=12345\n\n[Preferences]\nGeneral\\Locale=en\n",
+		},
+		{
+			name:     "Section added",
+			file:     "qBittorrent.conf",
+			before:   "[Preferences]\r\nGeneral\\Locale=en\r\n",
+			expected: "[Preferences]\r\nGeneral\\Locale=en\r\n\r\n[BitTorrent]\r\nSession\\Port=12345\r\n",
+		},
+		{
+			name:     "Plain key with spacing kept",
+			file:     "client.conf",
+			key:      "listen_port",
+			before:   "# comment\nlisten_port = 51413\nother = 1\n",
+			expected: "# comment\nlisten_port = 12345\nother = 1\n",
+		},
+		{
+			name:     "Plain key in the wrong section ignored",
+			file:     "client.conf",
+			key:      "[net]port",
+			before:   "[ui]\nport=8080\n[net]\nport=51413\n",
+			expected: "[ui]\nport=8080\n[net]\nport=12345\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tc.file)
+			if err := os.WriteFile(path, []byte(tc.before), 0640); err != nil {
+				t.Fatalf("Failed to write config: %v", err)
+			}
+
+			changed, err := Port(path, tc.key, 12345)
+			if err != nil {
+				t.Fatalf("Failed to patch: %v", err)
+			}
+			if !changed {
+				t.Errorf("Expected the file to change")
+			}
+			data, _ := os.ReadFile(path)
+			if string(data) != tc.expected {
+				t.Errorf("Expected:\n%q\ngot:\n%q", tc.expected, data)
+			}
+
+			// The previous contents are kept, with the same permissions
+			backup, err := os.ReadFile(path + BackupSuffix)
+			if err != nil || string(backup) != tc.before {
+				t.Errorf("Expected the backup to hold the previous contents, got %q (%v)", backup, err)
+			}
+			if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0640 {
+				t.Errorf("Expected the file mode to be kept, got %v (%v)", info.Mode(), err)
+			}
+
+			// Patching the same port again leaves the file alone
+			if changed, err := Port(path, tc.key, 12345); err != nil || changed {
+				t.Errorf("Expected no change the second time, got changed=%v err=%v", changed, err)
+			}
+		})
+	}
+}
+
+func TestPortErrors(t *testing.T) {
+	testCases := []struct {
+		name    string
+		file    string
+		key     string
+		content string
+	}{
+		{name: "Invalid JSON", file: "settings.json", content: "<html>"},
+		{name: "JSON path through a value", file: "settings.json", key: "peer-port.value", content: `{"peer-port": 51413}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tc.file)
+			os.WriteFile(path, []byte(tc.content), 0644)
+
+			if _, err := Port(path, tc.key, 12345); err == nil {
+				t.Errorf("Expected an error")
+			}
+			data, _ := os.ReadFile(path)
+			if string(data) != tc.content {
+				t.Errorf("Expected the file to be left alone, got %q", data)
+			}
+		})
+	}
+
+	if _, err := Port(filepath.Join(t.TempDir(), "missing.json"), "", 12345); err == nil {
+		t.Errorf("Expected an error for a missing file")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "settings.json")
+	invalid := filepath.Join(dir, "broken.json")
+	os.WriteFile(valid, []byte(`{"peer-port": 51413}`), 0644)
+	os.WriteFile(invalid, []byte(`{"peer-port":`), 0644)
+
+	if err := Check(valid); err != nil {
+		t.Errorf("Expected %s to be patchable, got %v", valid, err)
+	}
+	if err := Check(invalid); err == nil {
+		t.Errorf("Expected an error for invalid JSON")
+	}
+	if err := Check(filepath.Join(dir, "missing.conf")); err == nil {
+		t.Errorf("Expected an error for a missing file")
+	}
+}
@@ -0,0 +1,123 @@
+package daemon
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// childEnv marks a process started by Daemonize so it doesn't daemonize again
+const childEnv = "GO_PIA_DAEMONIZED"
+
+// readyEnv tells a process started by DaemonizeAndWait that its parent waits
+// for Ready on readyFD
+const readyEnv = "GO_PIA_DAEMONIZED_READY"
+
+// readyFD is the descriptor Ready writes to, the first after stdin, stdout and stderr
+const readyFD = 3
+
+// IsChild reports whether this process was started by Daemonize
+func IsChild() bool {
+	return os.Getenv(childEnv) == "1"
+}
+
+// Daemonize re-executes the current binary with the same arguments as a detached
+// background process in its own session and returns its PID. The caller (the
+// original foreground process) should exit afterwards. Output of the child goes
+// to logFile if set, otherwise it is discarded.
+func Daemonize(logFile string) (int, error) {
+	return start(logFile, nil)
+}
+
+// DaemonizeAndWait is Daemonize, but waits for the background process to call
+// Ready and returns the message it passed, e.g. to print it before exiting. It
+// fails if the background process exits first.
+func DaemonizeAndWait(logFile string) (int, string, error) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return 0, "", err
+	}
+	defer reader.Close()
+
+	pid, err := start(logFile, writer)
+	// Only the child may hold the write end, so its exit ends the read
+	writer.Close()
+	if err != nil {
+		return 0, "", err
+	}
+
+	message, err := bufio.NewReader(reader).ReadString('\n')
+	if err != nil {
+		return pid, "", fmt.Errorf("background process %d exited before it was ready", pid)
+	}
+	return pid, message, nil
+}
+
+// Ready passes message, a single line, to the process waiting in
+// DaemonizeAndWait, which then returns. It returns false without an error when
+// no process is waiting.
+func Ready(message string) (bool, error) {
+	if os.Getenv(readyEnv) != "1" {
+		return false, nil
+	}
+	// Only the first call is waited for
+	os.Unsetenv(readyEnv)
+
+	file := os.NewFile(readyFD, "ready")
+	defer file.Close()
+	if _, err := file.WriteString(strings.TrimSuffix(message, "\n") + "\n"); err != nil {
+		return false, fmt.Errorf("failed to report readiness: %w", err)
+	}
+	return true, nil
+}
+
+// start starts the detached background process, passing it ready if not nil
+func start(logFile string, ready *os.File) (int, error) {
+	procAttr := detachedProcAttr()
+	if procAttr == nil {
+		return 0, fmt.Errorf("daemonizing is not supported on this platform")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("failed to find executable: %w", err)
+	}
+
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %s: %w", os.DevNull, err)
+	}
+	defer devNull.Close()
+
+	output := devNull
+	if logFile != "" {
+		output, err = os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return 0, fmt.Errorf("failed to open log file: %w", err)
+		}
+		defer output.Close()
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), childEnv+"=1")
+	if ready != nil {
+		cmd.Env = append(cmd.Env, readyEnv+"=1")
+		cmd.ExtraFiles = []*os.File{ready}
+	}
+	cmd.Stdin = devNull
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.SysProcAttr = procAttr
+
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("failed to start background process: %w", err)
+	}
+
+	// Don't wait for the child, it outlives us
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+
+	return pid, nil
+}
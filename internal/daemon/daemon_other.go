@@ -0,0 +1,10 @@
+//go:build !unix
+
+package daemon
+
+import "syscall"
+
+// detachedProcAttr returns nil on platforms without sessions
+func detachedProcAttr() *syscall.SysProcAttr {
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build unix
+
+package daemon
+
+import "syscall"
+
+// detachedProcAttr starts the child in a new session, detached from the controlling terminal
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
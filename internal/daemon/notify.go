@@ -0,0 +1,35 @@
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// notifySocketEnv names the service manager's notification socket (systemd's sd_notify protocol)
+const notifySocketEnv = "NOTIFY_SOCKET"
+
+// Notify sends a state message such as "READY=1" to the service manager. It
+// returns false without an error when no notification socket is configured.
+func Notify(message string) (bool, error) {
+	socket := os.Getenv(notifySocketEnv)
+	if socket == "" {
+		return false, nil
+	}
+
+	// A leading @ denotes a socket in the abstract namespace
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to notification socket: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(message)); err != nil {
+		return false, fmt.Errorf("failed to send notification: %w", err)
+	}
+	return true, nil
+}
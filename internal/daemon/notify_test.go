@@ -0,0 +1,38 @@
+//go:build linux
+
+package daemon
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestNotify(t *testing.T) {
+	// Without a socket, notifications are silently skipped
+	t.Setenv(notifySocketEnv, "")
+	if sent, err := Notify("READY=1"); sent || err != nil {
+		t.Errorf("Expected no notification without a socket, got sent=%v err=%v", sent, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	t.Setenv(notifySocketEnv, path)
+	if sent, err := Notify("READY=1"); !sent || err != nil {
+		t.Fatalf("Expected notification to be sent, got sent=%v err=%v", sent, err)
+	}
+
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read notification: %v", err)
+	}
+	if string(buf[:n]) != "READY=1" {
+		t.Errorf("Expected READY=1, got %q", buf[:n])
+	}
+}
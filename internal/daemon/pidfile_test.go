@@ -0,0 +1,76 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestWritePIDFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", "go-pia.pid")
+
+	if err := WritePIDFile(path); err != nil {
+		t.Fatalf("Failed to write PID file: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read PID file: %v", err)
+	}
+	if string(data) != strconv.Itoa(os.Getpid())+"\n" {
+		t.Errorf("Expected PID file to contain %d, got %q", os.Getpid(), string(data))
+	}
+
+	// No temporary files are left behind
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("Expected only the PID file in the directory, got %d entries", len(entries))
+	}
+
+	if err := RemovePIDFile(path); err != nil {
+		t.Fatalf("Failed to remove PID file: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected PID file to be removed")
+	}
+
+	// Removing a missing PID file is not an error
+	if err := RemovePIDFile(path); err != nil {
+		t.Errorf("Expected no error removing missing PID file, got: %v", err)
+	}
+}
+
+func TestRemovePIDFileOwnedByOtherProcess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "go-pia.pid")
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid()+1)+"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write PID file: %v", err)
+	}
+
+	if err := RemovePIDFile(path); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected PID file of another process to be kept")
+	}
+}
+
+func TestIsChild(t *testing.T) {
+	t.Setenv(childEnv, "")
+	if IsChild() {
+		t.Errorf("Expected IsChild to be false without marker")
+	}
+
+	t.Setenv(childEnv, "1")
+	if !IsChild() {
+		t.Errorf("Expected IsChild to be true with marker")
+	}
+}
+
+func TestReadyWithoutWaitingParent(t *testing.T) {
+	t.Setenv(readyEnv, "")
+	sent, err := Ready("12345")
+	if sent || err != nil {
+		t.Errorf("Expected nothing to be sent without a waiting parent, got %v, %v", sent, err)
+	}
+}
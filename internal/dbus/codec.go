@@ -0,0 +1,517 @@
+package dbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ObjectPath is a value of type o
+type ObjectPath string
+
+// Signature is a value of type g
+type Signature string
+
+// Variant is a value of type v, along with its signature
+type Variant struct {
+	Signature string
+	Value     any
+}
+
+// Values are decoded to these Go types:
+//
+//	y byte, b bool, n int16, q uint16, i int32, u uint32, h uint32,
+//	x int64, t uint64, d float64, s string, o ObjectPath, g Signature,
+//	v Variant, a []any, (...) []any, a{...} map[string]any for string
+//	and object path keys, map[any]any otherwise
+//
+// The encoder accepts the same types, and any slice or map for arrays.
+
+// basicTypes are the types dict entry keys can have
+const basicTypes = "ybnqiuxtdhsog"
+
+// splitSignature splits a signature into its complete types
+func splitSignature(signature string) ([]string, error) {
+	var types []string
+	for signature != "" {
+		n, err := typeLength(signature)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, signature[:n])
+		signature = signature[n:]
+	}
+	return types, nil
+}
+
+// typeLength returns the length of the complete type at the start of signature
+func typeLength(signature string) (int, error) {
+	if signature == "" {
+		return 0, errors.New("incomplete signature")
+	}
+
+	switch signature[0] {
+	case 'y', 'b', 'n', 'q', 'i', 'u', 'x', 't', 'd', 'h', 's', 'o', 'g', 'v':
+		return 1, nil
+	case 'a':
+		n, err := typeLength(signature[1:])
+		return n + 1, err
+	case '(', '{':
+		closing := byte(')')
+		if signature[0] == '{' {
+			closing = '}'
+		}
+		i := 1
+		for i < len(signature) && signature[i] != closing {
+			n, err := typeLength(signature[i:])
+			if err != nil {
+				return 0, err
+			}
+			i += n
+		}
+		if i >= len(signature) {
+			return 0, fmt.Errorf("unterminated %q in signature", signature[0])
+		}
+		// An empty struct takes no bytes, so an array of them would never end
+		if i == 1 {
+			return 0, fmt.Errorf("empty %q in signature", signature[:2])
+		}
+		return i + 1, nil
+	default:
+		return 0, fmt.Errorf("unsupported type %q in signature", signature[0])
+	}
+}
+
+// alignment returns the alignment of values of the type at the start of signature
+func alignment(signature string) int {
+	switch signature[0] {
+	case 'y', 'g', 'v':
+		return 1
+	case 'n', 'q':
+		return 2
+	case 'x', 't', 'd', '(', '{':
+		return 8
+	default:
+		return 4
+	}
+}
+
+// encoder appends little-endian values to a message
+type encoder struct {
+	buf []byte
+}
+
+// newEncoder returns an encoder for a buffer starting at an 8-byte boundary
+func newEncoder() *encoder {
+	return &encoder{}
+}
+
+// align pads the buffer with zeros to a multiple of n
+func (e *encoder) align(n int) {
+	for len(e.buf)%n != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+// uint32 appends an aligned 32-bit value
+func (e *encoder) uint32(v uint32) {
+	e.align(4)
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, v)
+}
+
+// encode appends v as a value of the complete type signature
+func (e *encoder) encode(signature string, v any) error {
+	e.align(alignment(signature))
+
+	switch signature[0] {
+	case 'y':
+		b, ok := v.(byte)
+		if !ok {
+			return encodeError(signature, v)
+		}
+		e.buf = append(e.buf, b)
+	case 'b':
+		b, ok := v.(bool)
+		if !ok {
+			return encodeError(signature, v)
+		}
+		if b {
+			e.uint32(1)
+		} else {
+			e.uint32(0)
+		}
+	case 'n':
+		n, ok := v.(int16)
+		if !ok {
+			return encodeError(signature, v)
+		}
+		e.buf = binary.LittleEndian.AppendUint16(e.buf, uint16(n))
+	case 'q':
+		n, ok := v.(uint16)
+		if !ok {
+			return encodeError(signature, v)
+		}
+		e.buf = binary.LittleEndian.AppendUint16(e.buf, n)
+	case 'i':
+		n, ok := v.(int32)
+		if !ok {
+			return encodeError(signature, v)
+		}
+		e.uint32(uint32(n))
+	case 'u', 'h':
+		n, ok := v.(uint32)
+		if !ok {
+			return encodeError(signature, v)
+		}
+		e.uint32(n)
+	case 'x':
+		n, ok := v.(int64)
+		if !ok {
+			return encodeError(signature, v)
+		}
+		e.buf = binary.LittleEndian.AppendUint64(e.buf, uint64(n))
+	case 't':
+		n, ok := v.(uint64)
+		if !ok {
+			return encodeError(signature, v)
+		}
+		e.buf = binary.LittleEndian.AppendUint64(e.buf, n)
+	case 'd':
+		f, ok := v.(float64)
+		if !ok {
+			return encodeError(signature, v)
+		}
+		e.buf = binary.LittleEndian.AppendUint64(e.buf, math.Float64bits(f))
+	case 's', 'o':
+		s, ok := stringValue(v)
+		if !ok {
+			return encodeError(signature, v)
+		}
+		e.uint32(uint32(len(s)))
+		e.buf = append(append(e.buf, s...), 0)
+	case 'g':
+		s, ok := stringValue(v)
+		if !ok || len(s) > 255 {
+			return encodeError(signature, v)
+		}
+		e.buf = append(append(append(e.buf, byte(len(s))), s...), 0)
+	case 'v':
+		variant, ok := v.(Variant)
+		if !ok {
+			return encodeError(signature, v)
+		}
+		if n, err := typeLength(variant.Signature); err != nil || n != len(variant.Signature) {
+			return fmt.Errorf("invalid variant signature %q", variant.Signature)
+		}
+		if err := e.encode("g", Signature(variant.Signature)); err != nil {
+			return err
+		}
+		return e.encode(variant.Signature, variant.Value)
+	case 'a':
+		return e.encodeArray(signature[1:], v)
+	case '(':
+		fields, ok := v.([]any)
+		if !ok {
+			return encodeError(signature, v)
+		}
+		types, err := splitSignature(signature[1 : len(signature)-1])
+		if err != nil {
+			return err
+		}
+		if len(types) != len(fields) {
+			return fmt.Errorf("struct %s has %d fields, got %d", signature, len(types), len(fields))
+		}
+		for i, t := range types {
+			if err := e.encode(t, fields[i]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported type %q", signature)
+	}
+
+	return nil
+}
+
+// encodeArray appends a slice, or a map for an array of dict entries
+func (e *encoder) encodeArray(elem string, v any) error {
+	rv := reflect.ValueOf(v)
+
+	// The length excludes the padding before the first element
+	e.uint32(0)
+	lengthAt := len(e.buf) - 4
+	e.align(alignment(elem))
+	start := len(e.buf)
+
+	if elem[0] == '{' {
+		if rv.Kind() != reflect.Map {
+			return encodeError("a"+elem, v)
+		}
+		types, err := splitSignature(elem[1 : len(elem)-1])
+		if err != nil || len(types) != 2 {
+			return fmt.Errorf("invalid dict entry %s", elem)
+		}
+
+		// Sort the keys so the encoding is deterministic
+		keys := rv.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		for _, key := range keys {
+			e.align(8)
+			if err := e.encode(types[0], key.Interface()); err != nil {
+				return err
+			}
+			if err := e.encode(types[1], rv.MapIndex(key).Interface()); err != nil {
+				return err
+			}
+		}
+	} else {
+		if rv.Kind() != reflect.Slice {
+			return encodeError("a"+elem, v)
+		}
+		for i := 0; i < rv.Len(); i++ {
+			if err := e.encode(elem, rv.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+	}
+
+	binary.LittleEndian.PutUint32(e.buf[lengthAt:], uint32(len(e.buf)-start))
+	return nil
+}
+
+// stringValue returns the string underlying v
+func stringValue(v any) (string, bool) {
+	switch s := v.(type) {
+	case string:
+		return s, true
+	case ObjectPath:
+		return string(s), true
+	case Signature:
+		return string(s), true
+	}
+	return "", false
+}
+
+// encodeError reports a value that can't be encoded as the given type
+func encodeError(signature string, v any) error {
+	return fmt.Errorf("can't encode %T as %s", v, signature)
+}
+
+// errTruncated is returned when a message ends in the middle of a value
+var errTruncated = errors.New("message truncated")
+
+// decoder reads values from a message
+type decoder struct {
+	buf   []byte
+	pos   int
+	order binary.ByteOrder
+}
+
+// align skips padding to a multiple of n
+func (d *decoder) align(n int) error {
+	pos := d.pos + (n-d.pos%n)%n
+	if pos > len(d.buf) {
+		return errTruncated
+	}
+	d.pos = pos
+	return nil
+}
+
+// read returns the next n bytes
+func (d *decoder) read(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.buf) {
+		return nil, errTruncated
+	}
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// readString returns the next string of length bytes, checking the length
+// against what's left before converting it so it can't overflow an int
+func (d *decoder) readString(length uint64) (string, error) {
+	// The string is followed by a nul byte
+	if length >= uint64(len(d.buf)-d.pos) {
+		return "", errTruncated
+	}
+	b, err := d.read(int(length) + 1)
+	if err != nil {
+		return "", err
+	}
+	return string(b[:length]), nil
+}
+
+// decode reads a value of the complete type signature
+func (d *decoder) decode(signature string) (any, error) {
+	if err := d.align(alignment(signature)); err != nil {
+		return nil, err
+	}
+
+	switch signature[0] {
+	case 'y':
+		b, err := d.read(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0], nil
+	case 'n', 'q':
+		b, err := d.read(2)
+		if err != nil {
+			return nil, err
+		}
+		if signature[0] == 'n' {
+			return int16(d.order.Uint16(b)), nil
+		}
+		return d.order.Uint16(b), nil
+	case 'b', 'i', 'u', 'h':
+		b, err := d.read(4)
+		if err != nil {
+			return nil, err
+		}
+		n := d.order.Uint32(b)
+		switch signature[0] {
+		case 'b':
+			return n != 0, nil
+		case 'i':
+			return int32(n), nil
+		}
+		return n, nil
+	case 'x', 't', 'd':
+		b, err := d.read(8)
+		if err != nil {
+			return nil, err
+		}
+		n := d.order.Uint64(b)
+		switch signature[0] {
+		case 'x':
+			return int64(n), nil
+		case 'd':
+			return math.Float64frombits(n), nil
+		}
+		return n, nil
+	case 's', 'o':
+		b, err := d.read(4)
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.readString(uint64(d.order.Uint32(b)))
+		if err != nil {
+			return nil, err
+		}
+		if signature[0] == 'o' {
+			return ObjectPath(s), nil
+		}
+		return s, nil
+	case 'g':
+		b, err := d.read(1)
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.readString(uint64(b[0]))
+		if err != nil {
+			return nil, err
+		}
+		return Signature(s), nil
+	case 'v':
+		sig, err := d.decode("g")
+		if err != nil {
+			return nil, err
+		}
+		s := string(sig.(Signature))
+		if n, err := typeLength(s); err != nil || n != len(s) {
+			return nil, fmt.Errorf("invalid variant signature %q", s)
+		}
+		value, err := d.decode(s)
+		if err != nil {
+			return nil, err
+		}
+		return Variant{Signature: s, Value: value}, nil
+	case 'a':
+		return d.decodeArray(signature[1:])
+	case '(':
+		types, err := splitSignature(signature[1 : len(signature)-1])
+		if err != nil {
+			return nil, err
+		}
+		fields := make([]any, 0, len(types))
+		for _, t := range types {
+			v, err := d.decode(t)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, v)
+		}
+		return fields, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %q", signature)
+	}
+}
+
+// decodeArray reads an array, returning dict entries as a map
+func (d *decoder) decodeArray(elem string) (any, error) {
+	b, err := d.read(4)
+	if err != nil {
+		return nil, err
+	}
+	length := uint64(d.order.Uint32(b))
+	if err := d.align(alignment(elem)); err != nil {
+		return nil, err
+	}
+	if length > uint64(len(d.buf)-d.pos) {
+		return nil, errTruncated
+	}
+	end := d.pos + int(length)
+
+	if elem[0] == '{' {
+		types, err := splitSignature(elem[1 : len(elem)-1])
+		if err != nil || len(types) != 2 {
+			return nil, fmt.Errorf("invalid dict entry %s", elem)
+		}
+		// Keys must be basic types, which can be map keys
+		if len(types[0]) != 1 || !strings.ContainsRune(basicTypes, rune(types[0][0])) {
+			return nil, fmt.Errorf("invalid dict entry %s: key isn't a basic type", elem)
+		}
+		stringKeys := types[0] == "s" || types[0] == "o"
+		byString := make(map[string]any)
+		others := make(map[any]any)
+		for d.pos < end {
+			if err := d.align(8); err != nil {
+				return nil, err
+			}
+			key, err := d.decode(types[0])
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.decode(types[1])
+			if err != nil {
+				return nil, err
+			}
+			if stringKeys {
+				s, _ := stringValue(key)
+				byString[s] = value
+			} else {
+				others[key] = value
+			}
+		}
+		if stringKeys {
+			return byString, nil
+		}
+		return others, nil
+	}
+
+	values := []any{}
+	for d.pos < end {
+		v, err := d.decode(elem)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
@@ -0,0 +1,452 @@
+package dbus
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// systemBusAddress is used if DBUS_SYSTEM_BUS_ADDRESS isn't set
+	systemBusAddress = "unix:path=/var/run/dbus/system_bus_socket"
+	// callTimeout bounds how long a method call may take
+	callTimeout = 5 * time.Second
+	// maxMessageSize is the largest message the specification allows
+	maxMessageSize = 128 << 20
+
+	// busName, busPath and busInterface address the message bus itself
+	busName      = "org.freedesktop.DBus"
+	busPath      = "/org/freedesktop/DBus"
+	busInterface = "org.freedesktop.DBus"
+	// propertiesInterface is the standard interface for reading properties
+	propertiesInterface = "org.freedesktop.DBus.Properties"
+
+	// ErrorServiceUnknown is the error name returned for a service that isn't running
+	ErrorServiceUnknown = "org.freedesktop.DBus.Error.ServiceUnknown"
+)
+
+// Message types
+const (
+	typeMethodCall   = 1
+	typeMethodReturn = 2
+	typeError        = 3
+	typeSignal       = 4
+)
+
+// flagNoReplyExpected marks a message that isn't answered
+const flagNoReplyExpected = 1
+
+// Header field codes
+const (
+	fieldPath        = 1
+	fieldInterface   = 2
+	fieldMember      = 3
+	fieldErrorName   = 4
+	fieldReplySerial = 5
+	fieldDestination = 6
+	fieldSignature   = 8
+)
+
+// Error is an error reply to a method call
+type Error struct {
+	// Name of the error, such as org.freedesktop.DBus.Error.ServiceUnknown
+	Name string
+	// Message describing the error, if any
+	Message string
+}
+
+// Error returns the error name and message
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return e.Name
+	}
+	return e.Name + ": " + e.Message
+}
+
+// Conn is a connection to a message bus. Method calls are made one at a time,
+// and anything other than a reply is dropped until Watch hands the connection
+// over to signals. Signals can be emitted either way.
+type Conn struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	serial uint32
+	// Set once Watch reads the connection, which leaves no replies for Call
+	watching bool
+}
+
+// Signal is a signal received from the bus
+type Signal struct {
+	// Path of the object that emitted it
+	Path ObjectPath
+	// Interface and Member name the signal
+	Interface string
+	Member    string
+	// Body holds the values it carries
+	Body []any
+}
+
+// SystemBus connects to the system message bus
+func SystemBus() (*Conn, error) {
+	address := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS")
+	if address == "" {
+		address = systemBusAddress
+	}
+	return Dial(address)
+}
+
+// SessionBus connects to the message bus of the user's login session
+func SessionBus() (*Conn, error) {
+	address := os.Getenv("DBUS_SESSION_BUS_ADDRESS")
+	if address == "" {
+		return nil, errors.New("no session bus: DBUS_SESSION_BUS_ADDRESS is not set")
+	}
+	return Dial(address)
+}
+
+// Dial connects to the bus at a D-Bus address such as unix:path=/run/dbus/socket,
+// trying each of several addresses separated by semicolons
+func Dial(address string) (*Conn, error) {
+	var errs []error
+	for _, entry := range strings.Split(address, ";") {
+		socket, err := unixSocket(entry)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		conn, err := net.DialTimeout("unix", socket, callTimeout)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		c, err := NewConn(conn)
+		if err != nil {
+			conn.Close()
+			errs = append(errs, err)
+			continue
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("failed to connect to D-Bus: %w", errors.Join(errs...))
+}
+
+// unixSocket returns the socket path of a unix: address
+func unixSocket(entry string) (string, error) {
+	transport, params, ok := strings.Cut(entry, ":")
+	if !ok || transport != "unix" {
+		return "", fmt.Errorf("unsupported D-Bus address %q", entry)
+	}
+	for _, param := range strings.Split(params, ",") {
+		key, value, _ := strings.Cut(param, "=")
+		switch key {
+		case "path":
+			return value, nil
+		case "abstract":
+			return "@" + value, nil
+		}
+	}
+	return "", fmt.Errorf("D-Bus address %q has no socket path", entry)
+}
+
+// NewConn authenticates on conn as the current user and registers with the bus
+func NewConn(conn net.Conn) (*Conn, error) {
+	conn.SetDeadline(time.Now().Add(callTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	// The credentials byte is followed by the EXTERNAL mechanism, which proves
+	// who we are with the socket's peer credentials
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := io.WriteString(conn, "\x00AUTH EXTERNAL "+uid+"\r\n"); err != nil {
+		return nil, err
+	}
+	line, err := readLine(conn)
+	if err != nil {
+		return nil, fmt.Errorf("D-Bus authentication failed: %w", err)
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return nil, fmt.Errorf("D-Bus authentication rejected: %s", line)
+	}
+	if _, err := io.WriteString(conn, "BEGIN\r\n"); err != nil {
+		return nil, err
+	}
+
+	c := &Conn{conn: conn}
+	if _, err := c.Call(busName, busPath, busInterface, "Hello", ""); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// readLine reads an authentication line a byte at a time, so nothing after it
+// is buffered away from the message reader
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < 1024 {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", errors.New("authentication line too long")
+}
+
+// Close closes the connection
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// Call calls a method and returns the values in its reply. signature describes
+// args, which must have the Go types the decoder produces for it.
+func (c *Conn) Call(destination, path, iface, member, signature string, args ...any) ([]any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.watching {
+		return nil, fmt.Errorf("can't call %s.%s on a connection watching for signals", iface, member)
+	}
+	c.serial++
+	serial := c.serial
+
+	fields := []any{
+		[]any{byte(fieldPath), Variant{"o", ObjectPath(path)}},
+		[]any{byte(fieldInterface), Variant{"s", iface}},
+		[]any{byte(fieldMember), Variant{"s", member}},
+		[]any{byte(fieldDestination), Variant{"s", destination}},
+	}
+	if signature != "" {
+		fields = append(fields, []any{byte(fieldSignature), Variant{"g", Signature(signature)}})
+	}
+	msg, err := encodeMessage(typeMethodCall, 0, serial, fields, signature, args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s.%s call: %w", iface, member, err)
+	}
+
+	c.conn.SetDeadline(time.Now().Add(callTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+	if _, err := c.conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	for {
+		reply, err := readMessage(c.conn)
+		if err != nil {
+			return nil, err
+		}
+		if reply.replySerial != serial {
+			continue
+		}
+
+		switch reply.typ {
+		case typeMethodReturn:
+			return reply.body, nil
+		case typeError:
+			dbusErr := &Error{Name: reply.errorName}
+			if len(reply.body) > 0 {
+				dbusErr.Message, _ = reply.body[0].(string)
+			}
+			return nil, dbusErr
+		}
+	}
+}
+
+// Watch asks the bus for the signals matching rule, such as
+// "type='signal',interface='org.example.Interface'", and passes them on until
+// the connection is closed, when the channel is closed too. Signals must be
+// received promptly, since reading stops while one waits. Methods can't be
+// called on the connection afterwards.
+func (c *Conn) Watch(rule string) (<-chan *Signal, error) {
+	if _, err := c.Call(busName, busPath, busInterface, "AddMatch", "s", rule); err != nil {
+		return nil, fmt.Errorf("failed to watch for signals: %w", err)
+	}
+
+	c.mu.Lock()
+	c.watching = true
+	c.mu.Unlock()
+
+	signals := make(chan *Signal, 16)
+	go func() {
+		defer close(signals)
+		for {
+			msg, err := readMessage(c.conn)
+			if err != nil {
+				return
+			}
+			if msg.typ == typeSignal {
+				signals <- &Signal{Path: msg.path, Interface: msg.iface, Member: msg.member, Body: msg.body}
+			}
+		}
+	}()
+	return signals, nil
+}
+
+// Emit broadcasts a signal from the object at path. signature describes args,
+// as for Call.
+func (c *Conn) Emit(path, iface, member, signature string, args ...any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.serial++
+	fields := []any{
+		[]any{byte(fieldPath), Variant{"o", ObjectPath(path)}},
+		[]any{byte(fieldInterface), Variant{"s", iface}},
+		[]any{byte(fieldMember), Variant{"s", member}},
+	}
+	if signature != "" {
+		fields = append(fields, []any{byte(fieldSignature), Variant{"g", Signature(signature)}})
+	}
+	msg, err := encodeMessage(typeSignal, flagNoReplyExpected, c.serial, fields, signature, args)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s.%s signal: %w", iface, member, err)
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(callTimeout))
+	defer c.conn.SetWriteDeadline(time.Time{})
+	_, err = c.conn.Write(msg)
+	return err
+}
+
+// GetProperty returns the value of a property
+func (c *Conn) GetProperty(destination, path, iface, property string) (any, error) {
+	body, err := c.Call(destination, path, propertiesInterface, "Get", "ss", iface, property)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) != 1 {
+		return nil, fmt.Errorf("unexpected reply to Get %s.%s", iface, property)
+	}
+	variant, ok := body[0].(Variant)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply to Get %s.%s", iface, property)
+	}
+	return variant.Value, nil
+}
+
+// message is a decoded message
+type message struct {
+	typ         byte
+	serial      uint32
+	path        ObjectPath
+	iface       string
+	member      string
+	replySerial uint32
+	errorName   string
+	body        []any
+}
+
+// encodeMessage encodes a little-endian message with the given flags, header
+// fields and body
+func encodeMessage(typ, flags byte, serial uint32, fields []any, signature string, args []any) ([]byte, error) {
+	body := newEncoder()
+	types, err := splitSignature(signature)
+	if err != nil {
+		return nil, err
+	}
+	if len(types) != len(args) {
+		return nil, fmt.Errorf("signature %q has %d values, got %d", signature, len(types), len(args))
+	}
+	for i, t := range types {
+		if err := body.encode(t, args[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	header := newEncoder()
+	header.buf = append(header.buf, 'l', typ, flags, 1)
+	header.uint32(uint32(len(body.buf)))
+	header.uint32(serial)
+	if err := header.encode("a(yv)", fields); err != nil {
+		return nil, err
+	}
+	// The body starts on an 8-byte boundary
+	header.align(8)
+
+	return append(header.buf, body.buf...), nil
+}
+
+// readMessage reads and decodes a message
+func readMessage(r io.Reader) (*message, error) {
+	// The fixed header is followed by the length of the header field array
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+
+	var order binary.ByteOrder
+	switch fixed[0] {
+	case 'l':
+		order = binary.LittleEndian
+	case 'B':
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid D-Bus message endianness %q", fixed[0])
+	}
+
+	bodyLen := order.Uint32(fixed[4:])
+	fieldsLen := order.Uint32(fixed[12:])
+	headerLen := 16 + int(fieldsLen)
+	headerLen += (8 - headerLen%8) % 8
+	if uint64(headerLen)+uint64(bodyLen) > maxMessageSize {
+		return nil, fmt.Errorf("D-Bus message too large (%d bytes)", uint64(headerLen)+uint64(bodyLen))
+	}
+
+	data := make([]byte, headerLen+int(bodyLen))
+	copy(data, fixed)
+	if _, err := io.ReadFull(r, data[16:]); err != nil {
+		return nil, err
+	}
+
+	msg := &message{typ: fixed[1], serial: order.Uint32(fixed[8:])}
+
+	// Decode the header fields in place, since alignment is relative to the start
+	header := &decoder{buf: data[:16+fieldsLen], pos: 12, order: order}
+	value, err := header.decode("a(yv)")
+	if err != nil {
+		return nil, fmt.Errorf("invalid D-Bus message header: %w", err)
+	}
+	signature := ""
+	for _, f := range value.([]any) {
+		field := f.([]any)
+		variant := field[1].(Variant)
+		switch field[0].(byte) {
+		case fieldPath:
+			msg.path, _ = variant.Value.(ObjectPath)
+		case fieldInterface:
+			msg.iface, _ = variant.Value.(string)
+		case fieldMember:
+			msg.member, _ = variant.Value.(string)
+		case fieldReplySerial:
+			msg.replySerial, _ = variant.Value.(uint32)
+		case fieldErrorName:
+			msg.errorName, _ = variant.Value.(string)
+		case fieldSignature:
+			sig, _ := variant.Value.(Signature)
+			signature = string(sig)
+		}
+	}
+
+	types, err := splitSignature(signature)
+	if err != nil {
+		return nil, err
+	}
+	body := &decoder{buf: data[headerLen:], order: order}
+	for _, t := range types {
+		v, err := body.decode(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid D-Bus message body: %w", err)
+		}
+		msg.body = append(msg.body, v)
+	}
+
+	return msg, nil
+}
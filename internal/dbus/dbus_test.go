@@ -0,0 +1,300 @@
+package dbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	testCases := []struct {
+		signature string
+		value     any
+	}{
+		{"y", byte(7)},
+		{"b", true},
+		{"n", int16(-2)},
+		{"q", uint16(443)},
+		{"i", int32(-70000)},
+		{"u", uint32(2)},
+		{"x", int64(-1) << 40},
+		{"t", uint64(1) << 63},
+		{"d", 1.5},
+		{"s", "org.freedesktop.NetworkManager"},
+		{"o", ObjectPath("/org/freedesktop/NetworkManager/ActiveConnection/3")},
+		{"g", Signature("a{sv}")},
+		{"v", Variant{"s", "10.8.110.1"}},
+		{"ao", []any{ObjectPath("/a"), ObjectPath("/b")}},
+		{"as", []any{}},
+		{"(yv)", []any{byte(5), Variant{"u", uint32(9)}}},
+		{"a{sv}", map[string]any{"id": Variant{"s", "PIA"}, "autoconnect": Variant{"b", false}}},
+		{"a{sa{sv}}", map[string]any{"vpn": map[string]any{"data": Variant{"a{ss}", map[string]any{"remote": "nl-amsterdam.privacy.network"}}}}},
+		{"a{us}", map[any]any{uint32(1): "one"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.signature, func(t *testing.T) {
+			// Start off an 8-byte boundary so alignment is exercised
+			e := newEncoder()
+			e.buf = append(e.buf, 0xff)
+			if err := e.encode(tc.signature, tc.value); err != nil {
+				t.Fatalf("Failed to encode: %v", err)
+			}
+
+			d := &decoder{buf: e.buf, pos: 1, order: binary.LittleEndian}
+			decoded, err := d.decode(tc.signature)
+			if err != nil {
+				t.Fatalf("Failed to decode: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, tc.value) {
+				t.Errorf("Expected %#v, got %#v", tc.value, decoded)
+			}
+			if d.pos != len(e.buf) {
+				t.Errorf("Expected to decode all %d bytes, stopped at %d", len(e.buf), d.pos)
+			}
+		})
+	}
+}
+
+func TestCodecErrors(t *testing.T) {
+	e := newEncoder()
+	if err := e.encode("u", 1); err == nil {
+		t.Errorf("Expected an error encoding an int as u")
+	}
+	if _, err := splitSignature("a{sv"); err == nil {
+		t.Errorf("Expected an error for an unterminated signature")
+	}
+
+	if _, err := splitSignature("a()"); err == nil {
+		t.Errorf("Expected an error for an empty struct")
+	}
+
+	// Malformed values are errors, not panics
+	testCases := []struct {
+		name      string
+		signature string
+		buf       []byte
+		truncated bool
+	}{
+		{"String past the end", "s", []byte{0xff, 0, 0, 0, 'a'}, true},
+		{"String of the largest length", "s", []byte{0xff, 0xff, 0xff, 0xff, 'a', 0}, true},
+		{"String without its nul byte", "o", []byte{1, 0, 0, 0, '/'}, true},
+		{"Signature past the end", "g", []byte{0xff, 'a', 0}, true},
+		{"Array past the end", "ay", []byte{0xff, 0xff, 0xff, 0xff, 1}, true},
+		{"Variant with an empty struct", "v", []byte{2, '(', ')', 0}, false},
+		{"Dict with a variant key", "a{vs}", []byte{0, 0, 0, 0}, false},
+		{"Dict with a struct key", "a{(y)s}", []byte{0, 0, 0, 0}, false},
+		{"Variant dict with an array key", "v", []byte{5, 'a', '{', 'a', 'y', 's', '}', 0}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &decoder{buf: tc.buf, order: binary.LittleEndian}
+			_, err := d.decode(tc.signature)
+			if err == nil || tc.truncated && !errors.Is(err, errTruncated) {
+				t.Errorf("Expected an error (truncated: %v), got %v", tc.truncated, err)
+			}
+		})
+	}
+}
+
+func FuzzReadMessage(f *testing.F) {
+	signal, _ := encodeMessage(typeSignal, 0, 1, []any{
+		[]any{byte(fieldPath), Variant{"o", ObjectPath("/org/gopia/PortForwarding")}},
+		[]any{byte(fieldMember), Variant{"s", "PortChanged"}},
+		[]any{byte(fieldSignature), Variant{"g", Signature("uxau")}},
+	}, "uxau", []any{uint32(12345), int64(1772366400), []uint32{23456}})
+	f.Add(signal)
+	reply, _ := encodeMessage(typeMethodReturn, 0, 2, []any{
+		[]any{byte(fieldReplySerial), Variant{"u", uint32(1)}},
+		[]any{byte(fieldSignature), Variant{"g", Signature("a{sv}")}},
+	}, "a{sv}", []any{map[string]any{"id": Variant{"a{us}", map[any]any{uint32(1): "one"}}}})
+	f.Add(reply)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Anything may be wrong with the message, but reading it mustn't panic
+		// or hang
+		readMessage(bytes.NewReader(data))
+	})
+}
+
+// fakeBus answers Hello, AddMatch and Properties.Get calls on the server end of
+// a pipe. Properties missing from props get an error reply, and a match is
+// followed by a signal carrying its rule. Signals are passed on to
+// signals.
+func fakeBus(t *testing.T, server net.Conn, props map[string]Variant, signals chan<- *message) {
+	t.Helper()
+	go func() {
+		defer server.Close()
+
+		auth, err := readLine(server)
+		if err != nil || !strings.HasPrefix(auth, "\x00AUTH EXTERNAL ") {
+			t.Errorf("Unexpected authentication %q (%v)", auth, err)
+			return
+		}
+		server.Write([]byte("OK 0123456789abcdef\r\n"))
+		if begin, err := readLine(server); err != nil || begin != "BEGIN" {
+			t.Errorf("Expected BEGIN, got %q (%v)", begin, err)
+			return
+		}
+
+		for {
+			call, err := readMessage(server)
+			if err != nil {
+				return
+			}
+			if call.typ == typeSignal {
+				signals <- call
+				continue
+			}
+
+			// Signals the client didn't ask for are skipped
+			signal, _ := encodeMessage(typeSignal, 0, 100, []any{[]any{byte(fieldMember), Variant{"s", "NameAcquired"}}}, "s", []any{":1.42"})
+			server.Write(signal)
+
+			fields := []any{[]any{byte(fieldReplySerial), Variant{"u", call.serial}}}
+			var reply []byte
+			if call.member == "AddMatch" {
+				// The match is acknowledged, then a signal it asked for sent
+				reply, _ = encodeMessage(typeMethodReturn, 0, 100, fields, "", nil)
+				server.Write(reply)
+				reply, _ = encodeMessage(typeSignal, 0, 101, []any{
+					[]any{byte(fieldPath), Variant{"o", ObjectPath("/org/example/Object")}},
+					[]any{byte(fieldInterface), Variant{"s", "org.example.Interface"}},
+					[]any{byte(fieldMember), Variant{"s", "Changed"}},
+					[]any{byte(fieldSignature), Variant{"g", Signature("s")}},
+				}, "s", []any{call.body[0]})
+			} else if len(call.body) == 0 {
+				// Hello
+				fields = append(fields, []any{byte(fieldSignature), Variant{"g", Signature("s")}})
+				reply, _ = encodeMessage(typeMethodReturn, 0, 100, fields, "s", []any{":1.42"})
+			} else if value, ok := props[call.body[1].(string)]; ok {
+				fields = append(fields, []any{byte(fieldSignature), Variant{"g", Signature("v")}})
+				reply, _ = encodeMessage(typeMethodReturn, 0, 100, fields, "v", []any{value})
+			} else {
+				fields = append(fields,
+					[]any{byte(fieldErrorName), Variant{"s", "org.freedesktop.DBus.Error.InvalidArgs"}},
+					[]any{byte(fieldSignature), Variant{"g", Signature("s")}},
+				)
+				reply, _ = encodeMessage(typeError, 0, 100, fields, "s", []any{"No such property"})
+			}
+			server.Write(reply)
+		}
+	}()
+}
+
+func TestConnGetProperty(t *testing.T) {
+	client, server := net.Pipe()
+	fakeBus(t, server, map[string]Variant{
+		"Gateway":           {"s", "10.8.110.1"},
+		"ActiveConnections": {"ao", []any{ObjectPath("/org/freedesktop/NetworkManager/ActiveConnection/3")}},
+	}, nil)
+
+	conn, err := NewConn(client)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	gateway, err := conn.GetProperty("org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager/IP4Config/7", "org.freedesktop.NetworkManager.IP4Config", "Gateway")
+	if err != nil || gateway != "10.8.110.1" {
+		t.Errorf("Expected the gateway, got %v (%v)", gateway, err)
+	}
+
+	active, err := conn.GetProperty("org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager", "org.freedesktop.NetworkManager", "ActiveConnections")
+	if expected := []any{ObjectPath("/org/freedesktop/NetworkManager/ActiveConnection/3")}; err != nil || !reflect.DeepEqual(active, expected) {
+		t.Errorf("Expected %v, got %v (%v)", expected, active, err)
+	}
+
+	// Error replies carry their name and message
+	_, err = conn.GetProperty("org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager", "org.freedesktop.NetworkManager", "Missing")
+	var dbusErr *Error
+	if !errors.As(err, &dbusErr) || dbusErr.Name != "org.freedesktop.DBus.Error.InvalidArgs" || dbusErr.Message != "No such property" {
+		t.Errorf("Expected an InvalidArgs error, got %v", err)
+	}
+}
+
+func TestConnEmit(t *testing.T) {
+	client, server := net.Pipe()
+	signals := make(chan *message, 1)
+	fakeBus(t, server, nil, signals)
+
+	conn, err := NewConn(client)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.Emit("/org/example/Object", "org.example.Interface", "Changed", "ux", uint32(12345), int64(1709424000)); err != nil {
+		t.Fatalf("Failed to emit signal: %v", err)
+	}
+	signal := <-signals
+	if signal.member != "Changed" || !reflect.DeepEqual(signal.body, []any{uint32(12345), int64(1709424000)}) {
+		t.Errorf("Unexpected signal %s%v", signal.member, signal.body)
+	}
+
+	// Arguments must match the signature
+	if err := conn.Emit("/org/example/Object", "org.example.Interface", "Changed", "u", "12345"); err == nil {
+		t.Errorf("Expected an error for a mismatched argument")
+	}
+}
+
+func TestConnWatch(t *testing.T) {
+	client, server := net.Pipe()
+	fakeBus(t, server, nil, nil)
+
+	conn, err := NewConn(client)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	rule := "type='signal',interface='org.example.Interface'"
+	signals, err := conn.Watch(rule)
+	if err != nil {
+		t.Fatalf("Failed to watch: %v", err)
+	}
+	expected := &Signal{Path: "/org/example/Object", Interface: "org.example.Interface", Member: "Changed", Body: []any{rule}}
+	if signal := <-signals; !reflect.DeepEqual(signal, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, signal)
+	}
+
+	// The connection only carries signals now
+	if _, err := conn.GetProperty("org.example", "/org/example/Object", "org.example.Interface", "Name"); err == nil {
+		t.Errorf("Expected an error calling a method while watching")
+	}
+
+	// Closing it ends the signals
+	conn.Close()
+	if _, ok := <-signals; ok {
+		t.Errorf("Expected the signals to end with the connection")
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	testCases := []struct {
+		address     string
+		expected    string
+		expectError bool
+	}{
+		{address: "unix:path=/var/run/dbus/system_bus_socket", expected: "/var/run/dbus/system_bus_socket"},
+		{address: "unix:abstract=/tmp/dbus-test,guid=0123", expected: "@/tmp/dbus-test"},
+		{address: "tcp:host=localhost,port=1234", expectError: true},
+		{address: "unix:guid=0123", expectError: true},
+	}
+
+	for _, tc := range testCases {
+		socket, err := unixSocket(tc.address)
+		if tc.expectError {
+			if err == nil {
+				t.Errorf("Expected an error for %q", tc.address)
+			}
+			continue
+		}
+		if err != nil || socket != tc.expected {
+			t.Errorf("unixSocket(%q) = %q, %v; expected %q", tc.address, socket, err, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package ddns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/meschansky/go-pia/internal/httpjson"
+)
+
+// cloudflareRecord is a DNS record as the Cloudflare API represents it
+type cloudflareRecord struct {
+	ID      string         `json:"id,omitempty"`
+	Type    string         `json:"type"`
+	Name    string         `json:"name"`
+	Content string         `json:"content,omitempty"`
+	Data    *cloudflareSRV `json:"data,omitempty"`
+	TTL     int            `json:"ttl"`
+}
+
+// cloudflareSRV is the data of an SRV record
+type cloudflareSRV struct {
+	Priority int    `json:"priority"`
+	Weight   int    `json:"weight"`
+	Port     int    `json:"port"`
+	Target   string `json:"target"`
+}
+
+// cloudflareResponse wraps every Cloudflare API reply
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+// updateCloudflare points an A or AAAA record at ip, and sets the port record
+func (u *Updater) updateCloudflare(ctx context.Context, ip netip.Addr, port int) error {
+	address := cloudflareRecord{Type: "A", Name: u.Name, Content: ip.String(), TTL: cloudflareTTL}
+	if ip.Is6() {
+		address.Type = "AAAA"
+	}
+	if err := u.upsertCloudflare(ctx, address); err != nil {
+		return err
+	}
+
+	service, _ := parseSRVService(u.PortRecord)
+	switch {
+	case service != "":
+		srv := cloudflareRecord{
+			Type: "SRV",
+			Name: service + "." + u.Name,
+			Data: &cloudflareSRV{Port: port, Target: u.Name},
+			TTL:  cloudflareTTL,
+		}
+		return u.upsertCloudflare(ctx, srv)
+	case u.PortRecord == PortRecordTXT:
+		// Cloudflare expects TXT content in quotes, as in a zone file
+		txt := cloudflareRecord{Type: "TXT", Name: u.Name, Content: `"` + portTXT(port) + `"`, TTL: cloudflareTTL}
+		return u.upsertCloudflare(ctx, txt)
+	}
+	return nil
+}
+
+// upsertCloudflare updates the record of the same type and name, or creates
+// it if there's none
+func (u *Updater) upsertCloudflare(ctx context.Context, record cloudflareRecord) error {
+	query := url.Values{"type": {record.Type}, "name": {record.Name}}
+	var existing []cloudflareRecord
+	if err := u.cloudflare(ctx, http.MethodGet, "dns_records?"+query.Encode(), nil, &existing); err != nil {
+		return fmt.Errorf("failed to look up %s record %s: %w", record.Type, record.Name, err)
+	}
+
+	if len(existing) > 0 {
+		err := u.cloudflare(ctx, http.MethodPut, "dns_records/"+url.PathEscape(existing[0].ID), record, nil)
+		if err != nil {
+			return fmt.Errorf("failed to update %s record %s: %w", record.Type, record.Name, err)
+		}
+		return nil
+	}
+	if err := u.cloudflare(ctx, http.MethodPost, "dns_records", record, nil); err != nil {
+		return fmt.Errorf("failed to create %s record %s: %w", record.Type, record.Name, err)
+	}
+	return nil
+}
+
+// cloudflare calls the zone's API at path, decoding the result into result if
+// it's not nil
+func (u *Updater) cloudflare(ctx context.Context, method, path string, body, result any) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	endpoint := fmt.Sprintf("%s/zones/%s/%s", u.CloudflareURL, url.PathEscape(u.Zone), path)
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+u.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := u.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request to %s failed: %w", req.URL.Host, err)
+	}
+	defer resp.Body.Close()
+
+	// Failures come with a JSON body listing what went wrong, whatever the status
+	var reply cloudflareResponse
+	if err := httpjson.Decode(resp, &reply); err != nil {
+		return err
+	}
+	if !reply.Success {
+		var messages []string
+		for _, e := range reply.Errors {
+			messages = append(messages, fmt.Sprintf("%s (code %d)", e.Message, e.Code))
+		}
+		if len(messages) == 0 {
+			messages = append(messages, "HTTP "+resp.Status)
+		}
+		return fmt.Errorf("cloudflare: %s", strings.Join(messages, "; "))
+	}
+	if result != nil {
+		if err := json.Unmarshal(reply.Result, result); err != nil {
+			return fmt.Errorf("failed to parse cloudflare result: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+// Package ddns points a dynamic DNS name at the VPN's exit IP, optionally
+// publishing the forwarded port in a TXT or SRV record next to it
+package ddns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/httpjson"
+)
+
+// Providers
+const (
+	// ProviderCloudflare updates records in a Cloudflare zone with an API token
+	ProviderCloudflare = "cloudflare"
+	// ProviderDuckDNS updates a duckdns.org subdomain
+	ProviderDuckDNS = "duckdns"
+	// ProviderHTTP requests a URL template, for providers with a dyndns-style update URL
+	ProviderHTTP = "http"
+)
+
+const (
+	// DefaultIPURL returns the caller's public IP as plain text
+	DefaultIPURL = "https://api.ipify.org"
+	// DefaultCloudflareURL is the Cloudflare API endpoint
+	DefaultCloudflareURL = "https://api.cloudflare.com/client/v4"
+	// DefaultDuckDNSURL is the DuckDNS update endpoint
+	DefaultDuckDNSURL = "https://www.duckdns.org/update"
+	// PortRecordTXT publishes the port as a "port=N" TXT record on the name
+	PortRecordTXT = "txt"
+	// requestTimeout bounds each request to the IP lookup and the provider
+	requestTimeout = 30 * time.Second
+	// cloudflareTTL keeps resolvers from caching an old IP or port for long
+	cloudflareTTL = 60
+)
+
+// Settings say where and how records are published
+type Settings struct {
+	Provider string
+	// Name pointed at the exit IP: a hostname in the Cloudflare zone, or a
+	// DuckDNS subdomain
+	Name string
+	// Cloudflare zone ID
+	Zone string
+	// Update URL template for the http provider, with {{.IP}}, {{.Port}} and {{.Name}}
+	URL string
+	// Where the port is published: "txt", an SRV service such as
+	// _minecraft._tcp, or nowhere if empty
+	PortRecord string
+	// API token, sent as a bearer token to Cloudflare and the http provider
+	Token string
+}
+
+// Check reports settings the provider can't use. The token isn't checked,
+// since it's usually read from a file just before updating.
+func (s Settings) Check() error {
+	switch s.Provider {
+	case ProviderCloudflare:
+		if s.Name == "" || s.Zone == "" {
+			return errors.New("cloudflare requires a record name and a zone ID")
+		}
+	case ProviderDuckDNS:
+		if s.Name == "" {
+			return errors.New("duckdns requires a subdomain name")
+		}
+		if s.PortRecord != "" && s.PortRecord != PortRecordTXT {
+			return errors.New("duckdns can only publish the port in a TXT record")
+		}
+	case ProviderHTTP:
+		if s.URL == "" {
+			return errors.New("http requires an update URL")
+		}
+		if _, err := parseURLTemplate(s.URL); err != nil {
+			return err
+		}
+		if s.PortRecord != "" {
+			return errors.New("http can't publish a port record, use {{.Port}} in the update URL instead")
+		}
+	default:
+		return fmt.Errorf("unknown provider %q, expected %s, %s or %s", s.Provider, ProviderCloudflare, ProviderDuckDNS, ProviderHTTP)
+	}
+
+	if s.Zone != "" && s.Provider != ProviderCloudflare {
+		return errors.New("a zone ID only applies to cloudflare")
+	}
+	if s.URL != "" && s.Provider != ProviderHTTP {
+		return errors.New("an update URL only applies to http")
+	}
+	if _, err := parseSRVService(s.PortRecord); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseSRVService returns the service and protocol labels of an SRV port
+// record such as _minecraft._tcp, or "" if the port isn't published in one
+func parseSRVService(portRecord string) (string, error) {
+	if portRecord == "" || portRecord == PortRecordTXT {
+		return "", nil
+	}
+	service, proto, ok := strings.Cut(portRecord, ".")
+	if !ok || len(service) < 2 || service[0] != '_' || (proto != "_tcp" && proto != "_udp") {
+		return "", fmt.Errorf("invalid port record %q, expected %s or an SRV service such as _minecraft._tcp", portRecord, PortRecordTXT)
+	}
+	return portRecord, nil
+}
+
+// parseURLTemplate parses the http provider's update URL template
+func parseURLTemplate(s string) (*template.Template, error) {
+	tmpl, err := template.New("url").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid update URL: %w", err)
+	}
+	return tmpl, nil
+}
+
+// Updater publishes the exit IP and port
+type Updater struct {
+	Settings
+	// Endpoints, replaced in tests
+	IPURL         string
+	CloudflareURL string
+	DuckDNSURL    string
+	// HTTP client used for all requests
+	Client *http.Client
+}
+
+// New returns an updater for valid settings
+func New(settings Settings) (*Updater, error) {
+	if err := settings.Check(); err != nil {
+		return nil, err
+	}
+	return &Updater{
+		Settings:      settings,
+		IPURL:         DefaultIPURL,
+		CloudflareURL: DefaultCloudflareURL,
+		DuckDNSURL:    DefaultDuckDNSURL,
+		Client:        &http.Client{Timeout: requestTimeout},
+	}, nil
+}
+
+// ExitIP looks up the public IP requests leave from, which is the VPN's exit IP
+// while the VPN is up
+func (u *Updater) ExitIP(ctx context.Context) (netip.Addr, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.IPURL, nil)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	body, err := u.do(req)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to look up the exit IP: %w", err)
+	}
+	ip, err := netip.ParseAddr(strings.TrimSpace(string(body)))
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("IP lookup returned something other than an IP: %s", httpjson.Snippet(body))
+	}
+	return ip.Unmap(), nil
+}
+
+// Update points the name at ip and publishes port if a port record is set
+func (u *Updater) Update(ctx context.Context, ip netip.Addr, port int) error {
+	switch u.Provider {
+	case ProviderCloudflare:
+		return u.updateCloudflare(ctx, ip, port)
+	case ProviderDuckDNS:
+		return u.updateDuckDNS(ctx, ip, port)
+	default:
+		return u.updateHTTP(ctx, ip, port)
+	}
+}
+
+// updateDuckDNS sets the subdomain's IP, then its TXT record, which DuckDNS
+// only accepts in a separate request
+func (u *Updater) updateDuckDNS(ctx context.Context, ip netip.Addr, port int) error {
+	params := url.Values{"domains": {strings.TrimSuffix(u.Name, ".duckdns.org")}, "token": {u.Token}}
+	if ip.Is4() {
+		params.Set("ip", ip.String())
+	} else {
+		params.Set("ipv6", ip.String())
+	}
+	if err := u.duckDNS(ctx, params); err != nil {
+		return fmt.Errorf("failed to update %s: %w", u.Name, err)
+	}
+
+	if u.PortRecord == PortRecordTXT {
+		params.Del("ip")
+		params.Del("ipv6")
+		params.Set("txt", portTXT(port))
+		if err := u.duckDNS(ctx, params); err != nil {
+			return fmt.Errorf("failed to update the TXT record of %s: %w", u.Name, err)
+		}
+	}
+	return nil
+}
+
+// duckDNS makes an update request, which DuckDNS answers with OK or KO
+func (u *Updater) duckDNS(ctx context.Context, params url.Values) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.DuckDNSURL+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	body, err := u.do(req)
+	if err != nil {
+		return err
+	}
+	if reply := strings.TrimSpace(string(body)); reply != "OK" {
+		return fmt.Errorf("DuckDNS replied %q (check the subdomain and token)", reply)
+	}
+	return nil
+}
+
+// urlData is what the http provider's URL template can use
+type urlData struct {
+	IP   string
+	Port int
+	Name string
+}
+
+// updateHTTP requests the update URL, which succeeds with any 2xx status
+func (u *Updater) updateHTTP(ctx context.Context, ip netip.Addr, port int) error {
+	tmpl, err := parseURLTemplate(u.URL)
+	if err != nil {
+		return err
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, urlData{IP: ip.String(), Port: port, Name: url.QueryEscape(u.Name)}); err != nil {
+		return fmt.Errorf("failed to render update URL: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rendered.String(), nil)
+	if err != nil {
+		return fmt.Errorf("invalid update URL: %w", err)
+	}
+	if u.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+u.Token)
+	}
+	if _, err := u.do(req); err != nil {
+		return fmt.Errorf("failed to update %s: %w", req.URL.Host, err)
+	}
+	return nil
+}
+
+// do sends req and returns the body of a 2xx response. Errors leave out the
+// URL, which can hold a token.
+func (u *Updater) do(req *http.Request) ([]byte, error) {
+	resp, err := u.Client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("request to %s failed: %w", req.URL.Host, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, httpjson.StatusError(resp)
+	}
+	return httpjson.Read(resp)
+}
+
+// portTXT is the TXT record content the port is published as
+func portTXT(port int) string {
+	return fmt.Sprintf("port=%d", port)
+}
@@ -0,0 +1,191 @@
+package ddns
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestUpdater returns an updater for settings with every endpoint on server
+func newTestUpdater(t *testing.T, settings Settings, server *httptest.Server) *Updater {
+	t.Helper()
+	u, err := New(settings)
+	if err != nil {
+		t.Fatalf("Failed to create updater: %v", err)
+	}
+	u.IPURL = server.URL + "/ip"
+	u.CloudflareURL = server.URL + "/client/v4"
+	u.DuckDNSURL = server.URL + "/update"
+	u.Client = server.Client()
+	return u
+}
+
+func TestSettingsCheck(t *testing.T) {
+	testCases := []struct {
+		name        string
+		settings    Settings
+		expectError string
+	}{
+		{name: "Cloudflare", settings: Settings{Provider: "cloudflare", Name: "plex.example.com", Zone: "023e105f4ecef8ad9ca31a8372d0c353", PortRecord: "_plex._tcp"}},
+		{name: "Cloudflare without zone", settings: Settings{Provider: "cloudflare", Name: "plex.example.com"}, expectError: "zone ID"},
+		{name: "DuckDNS TXT", settings: Settings{Provider: "duckdns", Name: "mygame", PortRecord: "txt"}},
+		{name: "DuckDNS SRV", settings: Settings{Provider: "duckdns", Name: "mygame", PortRecord: "_minecraft._tcp"}, expectError: "only publish the port in a TXT record"},
+		{name: "HTTP", settings: Settings{Provider: "http", URL: "https://dyn.example.com/update?ip={{.IP}}&port={{.Port}}"}},
+		{name: "HTTP bad template", settings: Settings{Provider: "http", URL: "https://dyn.example.com/update?ip={{.IP}"}, expectError: "invalid update URL"},
+		{name: "HTTP zone", settings: Settings{Provider: "http", URL: "https://dyn.example.com/", Zone: "abc"}, expectError: "only applies to cloudflare"},
+		{name: "Bad SRV service", settings: Settings{Provider: "cloudflare", Name: "a.example.com", Zone: "abc", PortRecord: "minecraft.tcp"}, expectError: "invalid port record"},
+		{name: "Unknown provider", settings: Settings{Provider: "noip"}, expectError: "unknown provider"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.settings.Check()
+			if tc.expectError == "" {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.expectError) {
+				t.Errorf("Expected error containing %q, got %v", tc.expectError, err)
+			}
+		})
+	}
+}
+
+func TestExitIP(t *testing.T) {
+	reply := "203.0.113.7\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, reply)
+	}))
+	defer server.Close()
+	u := newTestUpdater(t, Settings{Provider: "http", URL: server.URL}, server)
+
+	ip, err := u.ExitIP(context.Background())
+	if err != nil || ip != netip.MustParseAddr("203.0.113.7") {
+		t.Errorf("Expected 203.0.113.7, got %v (%v)", ip, err)
+	}
+
+	reply = "<html>Captive portal</html>"
+	if _, err := u.ExitIP(context.Background()); err == nil || !strings.Contains(err.Error(), "Captive portal") {
+		t.Errorf("Expected an error quoting the reply, got %v", err)
+	}
+}
+
+func TestUpdateCloudflare(t *testing.T) {
+	var requests []string
+	var written []cloudflareRecord
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer cf-token" {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `{"success":false,"errors":[{"code":10000,"message":"Authentication error"}]}`)
+			return
+		}
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodGet {
+			// The A record exists, the SRV record doesn't yet
+			result := "[]"
+			if r.URL.Query().Get("type") == "A" {
+				result = `[{"id":"372e67954025e0ba6aaa6d586b9e0b59","type":"A","name":"plex.example.com","content":"198.51.100.1"}]`
+			}
+			io.WriteString(w, `{"success":true,"errors":[],"result":`+result+`}`)
+			return
+		}
+		var record cloudflareRecord
+		json.NewDecoder(r.Body).Decode(&record)
+		written = append(written, record)
+		io.WriteString(w, `{"success":true,"errors":[],"result":{}}`)
+	}))
+	defer server.Close()
+
+	u := newTestUpdater(t, Settings{Provider: "cloudflare", Name: "plex.example.com", Zone: "zone1", PortRecord: "_plex._tcp", Token: "cf-token"}, server)
+	if err := u.Update(context.Background(), netip.MustParseAddr("203.0.113.7"), 32400); err != nil {
+		t.Fatalf("Failed to update: %v", err)
+	}
+
+	expectedRequests := []string{
+		"GET /client/v4/zones/zone1/dns_records",
+		"PUT /client/v4/zones/zone1/dns_records/372e67954025e0ba6aaa6d586b9e0b59",
+		"GET /client/v4/zones/zone1/dns_records",
+		"POST /client/v4/zones/zone1/dns_records",
+	}
+	if !reflect.DeepEqual(requests, expectedRequests) {
+		t.Errorf("Expected requests %q, got %q", expectedRequests, requests)
+	}
+	expectedRecords := []cloudflareRecord{
+		{Type: "A", Name: "plex.example.com", Content: "203.0.113.7", TTL: 60},
+		{Type: "SRV", Name: "_plex._tcp.plex.example.com", Data: &cloudflareSRV{Port: 32400, Target: "plex.example.com"}, TTL: 60},
+	}
+	if !reflect.DeepEqual(written, expectedRecords) {
+		t.Errorf("Expected records %+v, got %+v", expectedRecords, written)
+	}
+
+	// Cloudflare's error messages are passed on
+	u.Token = "wrong"
+	if err := u.Update(context.Background(), netip.MustParseAddr("203.0.113.7"), 32400); err == nil || !strings.Contains(err.Error(), "Authentication error (code 10000)") {
+		t.Errorf("Expected the authentication error, got %v", err)
+	}
+}
+
+func TestUpdateDuckDNS(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+		if r.URL.Query().Get("token") != "duck-token" {
+			io.WriteString(w, "KO")
+			return
+		}
+		io.WriteString(w, "OK")
+	}))
+	defer server.Close()
+
+	u := newTestUpdater(t, Settings{Provider: "duckdns", Name: "mygame.duckdns.org", PortRecord: "txt", Token: "duck-token"}, server)
+	if err := u.Update(context.Background(), netip.MustParseAddr("2001:db8::7"), 25565); err != nil {
+		t.Fatalf("Failed to update: %v", err)
+	}
+	expected := []string{
+		"domains=mygame&ipv6=2001%3Adb8%3A%3A7&token=duck-token",
+		"domains=mygame&token=duck-token&txt=port%3D25565",
+	}
+	if !reflect.DeepEqual(queries, expected) {
+		t.Errorf("Expected %q, got %q", expected, queries)
+	}
+
+	// A rejected token fails without quoting it
+	u.Token = "secret-but-wrong"
+	err := u.Update(context.Background(), netip.MustParseAddr("203.0.113.7"), 25565)
+	if err == nil || !strings.Contains(err.Error(), `replied "KO"`) || strings.Contains(err.Error(), "secret-but-wrong") {
+		t.Errorf("Expected a KO error without the token, got %v", err)
+	}
+}
+
+func TestUpdateHTTP(t *testing.T) {
+	var got *http.Request
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.WriteHeader(status)
+		io.WriteString(w, "badauth")
+	}))
+	defer server.Close()
+
+	u := newTestUpdater(t, Settings{Provider: "http", Name: "home", URL: server.URL + "/nic/update?hostname={{.Name}}&myip={{.IP}}&port={{.Port}}", Token: "http-token"}, server)
+	if err := u.Update(context.Background(), netip.MustParseAddr("203.0.113.7"), 8080); err != nil {
+		t.Fatalf("Failed to update: %v", err)
+	}
+	if got.URL.RawQuery != "hostname=home&myip=203.0.113.7&port=8080" || got.Header.Get("Authorization") != "Bearer http-token" {
+		t.Errorf("Unexpected request %s with %q", got.URL, got.Header.Get("Authorization"))
+	}
+
+	status = http.StatusUnauthorized
+	if err := u.Update(context.Background(), netip.MustParseAddr("203.0.113.7"), 8080); err == nil || !strings.Contains(err.Error(), "badauth") {
+		t.Errorf("Expected the status error, got %v", err)
+	}
+}
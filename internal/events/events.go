@@ -0,0 +1,180 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Type identifies what happened
+type Type string
+
+const (
+	// PortChanged is published when a different port than before is bound,
+	// including the first bind after startup
+	PortChanged Type = "port-changed"
+	// PortBound is published after every successful bind
+	PortBound Type = "port-bound"
+	// BindFailed is published when binding the port fails
+	BindFailed Type = "bind-failed"
+	// SignatureRenewed is published when a new port forwarding signature is obtained
+	SignatureRenewed Type = "signature-renewed"
+	// SignatureFailed is published when a port forwarding signature can't be obtained
+	SignatureFailed Type = "signature-failed"
+	// VPNReconnected is published when the VPN connection is detected
+	VPNReconnected Type = "vpn-reconnected"
+	// TokenRefreshed is published when a new authentication token is obtained
+	TokenRefreshed Type = "token-refreshed"
+	// AuthFailed is published when an authentication token can't be obtained
+	AuthFailed Type = "auth-failed"
+	// RegionChanged is published when the managed VPN switches to another region
+	RegionChanged Type = "region-changed"
+	// PortKeepFailed is published when a new signature has a different port
+	// and requesting more didn't get the previous one back
+	PortKeepFailed Type = "port-keep-failed"
+	// PortOutOfRange is published when a new signature's port is outside the
+	// wanted range and requesting more didn't get one inside it
+	PortOutOfRange Type = "port-out-of-range"
+	// SignatureRetried is published for each signature requested again to
+	// keep the port or get one in the range, with the port obtained, or the
+	// one held and Error set if the request failed
+	SignatureRetried Type = "signature-retried"
+	// PortReleased is published when the port went without a bind for longer
+	// than PIA keeps it, so a new signature is requested before binding again
+	PortReleased Type = "port-released"
+	// PreviousPortExpired is published, after PortChanged events, when a
+	// previous port's grace period ends. It repeats the last PortChanged
+	// event with the port left out of PreviousPorts.
+	PreviousPortExpired Type = "previous-port-expired"
+	// UDPProbed is published after each UDP probe of the forwarded port
+	UDPProbed Type = "udp-probed"
+	// HookRan is published when a hook script exits or can't be started
+	HookRan Type = "hook-ran"
+	// HookTimedOut is published after HookRan when a hook script ran past the
+	// script timeout and was stopped
+	HookTimedOut Type = "hook-timed-out"
+	// OutputWritten is published after every attempt to write the port to an
+	// output such as the output file or dynamic DNS, with Error set if it failed
+	OutputWritten Type = "output-written"
+)
+
+// Event describes something that happened in the daemon. Fields that don't
+// apply to the event type are left zero.
+type Event struct {
+	Type Type      `json:"type"`
+	Time time.Time `json:"time"`
+	// Forwarded port the event is about
+	Port int `json:"port,omitempty"`
+	// Port bound before a PortChanged event, 0 on the first bind, or the port
+	// that couldn't be kept for PortKeepFailed
+	PreviousPort int `json:"previous_port,omitempty"`
+	// Ports bound before, newest first, whose grace period hasn't ended, for
+	// PortChanged and PreviousPortExpired
+	PreviousPorts []int `json:"previous_ports,omitempty"`
+	// When the port forwarding signature expires
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	// When a new signature is requested, set along with ExpiresAt
+	RenewsAt time.Time `json:"renews_at,omitzero"`
+	// Ports wanted, as MIN-MAX, for PortOutOfRange
+	PortRange string `json:"port_range,omitempty"`
+	// PIA gateway IP and server hostname
+	Gateway  string `json:"gateway,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	// Region IDs after and before a RegionChanged event
+	Region         string `json:"region,omitempty"`
+	PreviousRegion string `json:"previous_region,omitempty"`
+	// Error that caused a failure event
+	Error string `json:"error,omitempty"`
+	// Failures in a row, for BindFailed, HookRan, HookTimedOut and OutputWritten
+	ConsecutiveFailures int `json:"consecutive_failures,omitempty"`
+	// Hook that ran, e.g. "port-change", its exit code (-1 if it didn't exit
+	// on its own) and how long it ran, for HookRan and HookTimedOut. For
+	// PortReleased, Duration is how long the port went without a bind.
+	Hook     string        `json:"hook,omitempty"`
+	ExitCode int           `json:"exit_code,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+	// Output written to, e.g. "ddns", and which attempt at writing the port
+	// it was, for OutputWritten, which also sets Duration to how long the
+	// attempt took. SignatureRetried sets Attempt too.
+	Output  string `json:"output,omitempty"`
+	Attempt int    `json:"attempt,omitempty"`
+	// Datagrams a UDPProbed probe had sent to the port and those that arrived
+	ProbesSent     int `json:"probes_sent,omitempty"`
+	ProbesReceived int `json:"probes_received,omitempty"`
+	// Port forwarding payload and signature, for PortBound. They're never
+	// serialized since the signature is a secret.
+	Payload   string `json:"-"`
+	Signature string `json:"-"`
+}
+
+// Handler is called with each event a subscriber is interested in
+type Handler func(Event)
+
+// subscription is a handler and the event types it receives
+type subscription struct {
+	id      int
+	types   map[Type]bool
+	handler Handler
+}
+
+// Bus delivers published events to subscribers. Handlers run synchronously in
+// the publisher's goroutine, in the order they subscribed, so they should hand
+// slow work off to their own goroutine.
+type Bus struct {
+	mu     sync.Mutex
+	nextID int
+	subs   []subscription
+}
+
+// NewBus creates a bus without subscribers
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe calls handler for events of the given types, or for every event if
+// no types are given. The returned function removes the subscription.
+func (b *Bus) Subscribe(handler Handler, types ...Type) (unsubscribe func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub := subscription{id: b.nextID, handler: handler}
+	b.nextID++
+	if len(types) > 0 {
+		sub.types = make(map[Type]bool, len(types))
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+	b.subs = append(b.subs, sub)
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		for i, s := range b.subs {
+			if s.id == sub.id {
+				b.subs = append(b.subs[:i:i], b.subs[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Publish delivers an event to every interested subscriber, setting its time
+// if it isn't set
+func (b *Bus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	// Copy the subscribers so handlers can subscribe or unsubscribe
+	b.mu.Lock()
+	subs := make([]subscription, len(b.subs))
+	copy(subs, b.subs)
+	b.mu.Unlock()
+
+	for _, s := range subs {
+		if s.types == nil || s.types[e.Type] {
+			s.handler(e)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package events
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBusDelivery(t *testing.T) {
+	testCases := []struct {
+		name      string
+		types     []Type
+		published []Type
+		expected  []Type
+	}{
+		{
+			name:      "Filtered by type",
+			types:     []Type{PortChanged},
+			published: []Type{BindFailed, PortChanged, TokenRefreshed},
+			expected:  []Type{PortChanged},
+		},
+		{
+			name:      "Several types",
+			types:     []Type{PortChanged, BindFailed},
+			published: []Type{BindFailed, SignatureRenewed, PortChanged},
+			expected:  []Type{BindFailed, PortChanged},
+		},
+		{
+			name:      "All types",
+			published: []Type{VPNReconnected, TokenRefreshed},
+			expected:  []Type{VPNReconnected, TokenRefreshed},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			bus := NewBus()
+			var received []Type
+			bus.Subscribe(func(e Event) { received = append(received, e.Type) }, tc.types...)
+
+			for _, typ := range tc.published {
+				bus.Publish(Event{Type: typ})
+			}
+
+			if !reflect.DeepEqual(received, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, received)
+			}
+		})
+	}
+}
+
+func TestBusOrderAndUnsubscribe(t *testing.T) {
+	bus := NewBus()
+	var calls []string
+	bus.Subscribe(func(Event) { calls = append(calls, "first") })
+	unsubscribe := bus.Subscribe(func(Event) { calls = append(calls, "second") })
+	bus.Subscribe(func(Event) { calls = append(calls, "third") })
+
+	bus.Publish(Event{Type: PortChanged})
+	unsubscribe()
+	bus.Publish(Event{Type: PortChanged})
+
+	expected := []string{"first", "second", "third", "first", "third"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Expected %v, got %v", expected, calls)
+	}
+}
+
+func TestPublishSetsTime(t *testing.T) {
+	bus := NewBus()
+	var received Event
+	bus.Subscribe(func(e Event) { received = e })
+
+	before := time.Now()
+	bus.Publish(Event{Type: PortChanged, Port: 12345})
+	if received.Time.Before(before) || received.Port != 12345 {
+		t.Errorf("Expected a timestamped event for port 12345, got %+v", received)
+	}
+
+	fixed := time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+	bus.Publish(Event{Type: PortChanged, Time: fixed})
+	if !received.Time.Equal(fixed) {
+		t.Errorf("Expected the given time to be kept, got %v", received.Time)
+	}
+}
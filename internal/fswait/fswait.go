@@ -0,0 +1,65 @@
+// Package fswait waits for files to appear, e.g. ones written by provisioning
+// that may still be running when the service starts on first boot
+package fswait
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// pollInterval is how often files are checked for when their directory can't
+// be watched, e.g. because it doesn't exist yet
+var pollInterval = time.Second
+
+// Wait returns once every path names a file that isn't empty, or with the
+// error of ctx once it's done. Directories are watched for changes where the
+// platform allows, and polled otherwise.
+func Wait(ctx context.Context, paths []string) error {
+	for {
+		missing := Missing(paths)
+		if len(missing) == 0 {
+			return nil
+		}
+
+		// The watch starts before the files are checked again, so one written
+		// in between isn't missed
+		dirs := make([]string, len(missing))
+		for i, path := range missing {
+			dirs[i] = filepath.Dir(path)
+		}
+		w := watch(dirs)
+		if len(Missing(missing)) == 0 {
+			w.close()
+			return nil
+		}
+		err := w.wait(ctx)
+		w.close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Missing returns the paths that don't name a file that isn't empty
+func Missing(paths []string) []string {
+	var missing []string
+	for _, path := range paths {
+		if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+			missing = append(missing, path)
+		}
+	}
+	return missing
+}
+
+// pollWait waits for the poll interval or ctx, for directories that can't be
+// watched
+func pollWait(ctx context.Context) error {
+	select {
+	case <-time.After(pollInterval):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,71 @@
+package fswait
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWait(t *testing.T) {
+	dir := t.TempDir()
+	credentials := filepath.Join(dir, "pia.txt")
+	// Its directory doesn't exist yet either, so it's polled for
+	config := filepath.Join(dir, "client", "pia.ovpn")
+	pollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { pollInterval = time.Second })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- Wait(ctx, []string{credentials, config}) }()
+
+	// An empty file is still being written
+	if err := os.WriteFile(credentials, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(credentials, []byte("p1234567\nsecret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Expected to wait for the OpenVPN config, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := os.Mkdir(filepath.Dir(config), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(config, []byte("client\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Expected the files to be found, got %v", err)
+	}
+}
+
+func TestWaitCanceled(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "pia.txt")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := Wait(ctx, []string{missing}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to end the wait, got %v", err)
+	}
+}
+
+func TestMissing(t *testing.T) {
+	dir := t.TempDir()
+	present := filepath.Join(dir, "present")
+	empty := filepath.Join(dir, "empty")
+	os.WriteFile(present, []byte("x"), 0600)
+	os.WriteFile(empty, nil, 0600)
+
+	missing := Missing([]string{present, empty, dir, filepath.Join(dir, "absent")})
+	if expected := []string{empty, dir, filepath.Join(dir, "absent")}; !reflect.DeepEqual(missing, expected) {
+		t.Errorf("Expected %v, got %v", expected, missing)
+	}
+}
@@ -0,0 +1,69 @@
+package fswait
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// watchEvents are the changes to a directory that may make a file appear
+const watchEvents = syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB
+
+// watcher watches directories with inotify
+type watcher struct {
+	// nil if inotify isn't available
+	file *os.File
+	// Set if a directory couldn't be watched, so it's polled too
+	poll bool
+}
+
+// watch starts watching dirs for changes
+func watch(dirs []string) *watcher {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return &watcher{poll: true}
+	}
+	// A non-blocking descriptor is read through the runtime poller, so reads
+	// honour deadlines
+	w := &watcher{file: os.NewFile(uintptr(fd), "inotify")}
+	for _, dir := range dirs {
+		if _, err := syscall.InotifyAddWatch(fd, dir, watchEvents); err != nil {
+			w.poll = true
+		}
+	}
+	return w
+}
+
+// wait returns after a change in a watched directory or, if one couldn't be
+// watched, the poll interval, or with the error of ctx once it's done
+func (w *watcher) wait(ctx context.Context) error {
+	if w.file == nil {
+		return pollWait(ctx)
+	}
+	if w.poll {
+		w.file.SetReadDeadline(time.Now().Add(pollInterval))
+	}
+	stop := context.AfterFunc(ctx, func() { w.file.SetReadDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	// The events only say something changed, which is checked for afresh
+	buf := make([]byte, 4096)
+	_, err := w.file.Read(buf)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		// Without a working watch, fall back to polling
+		return pollWait(ctx)
+	}
+	return nil
+}
+
+// close stops watching
+func (w *watcher) close() {
+	if w.file != nil {
+		w.file.Close()
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package fswait
+
+import "context"
+
+// watcher polls, since only Linux directories are watched
+type watcher struct{}
+
+// watch returns a watcher that polls dirs
+func watch(dirs []string) *watcher {
+	return &watcher{}
+}
+
+// wait returns after the poll interval, or with the error of ctx once it's done
+func (w *watcher) wait(ctx context.Context) error {
+	return pollWait(ctx)
+}
+
+// close does nothing
+func (w *watcher) close() {}
@@ -0,0 +1,82 @@
+// Package httpjson reads JSON responses from PIA's APIs, turning captive
+// portals, block pages and other surprises into errors that say what came back
+package httpjson
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/meschansky/go-pia/internal/httplog"
+)
+
+const (
+	// MaxBody is the largest response read; PIA's replies are a few hundred bytes
+	MaxBody = 64 << 10
+	// snippetLength is how much of an unexpected body is quoted in errors
+	snippetLength = 200
+)
+
+// Decode reads resp's body into v. The body must be at most MaxBody bytes and
+// JSON, by its content type if it has one, or the error quotes its start.
+func Decode(resp *http.Response, v any) error {
+	body, err := Read(resp)
+	if err != nil {
+		return err
+	}
+
+	if !isJSONType(resp.Header.Get("Content-Type")) {
+		return fmt.Errorf("expected JSON, got %s (HTTP %d): %s", resp.Header.Get("Content-Type"), resp.StatusCode, Snippet(body))
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("failed to parse response (HTTP %d): %w: %s", resp.StatusCode, err, Snippet(body))
+	}
+	return nil
+}
+
+// Read reads resp's body, failing if it's larger than MaxBody
+func Read(resp *http.Response) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MaxBody+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if len(body) > MaxBody {
+		return nil, fmt.Errorf("response body larger than %d bytes (HTTP %d): %s", MaxBody, resp.StatusCode, Snippet(body))
+	}
+	return body, nil
+}
+
+// StatusError returns an error for a response with an unexpected status,
+// quoting the start of its body
+func StatusError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, MaxBody))
+	return fmt.Errorf("unexpected HTTP status %s: %s", resp.Status, Snippet(body))
+}
+
+// Snippet returns the start of body on one line, with secrets redacted
+func Snippet(body []byte) string {
+	s := httplog.RedactBody(strings.Join(strings.Fields(string(body)), " "))
+	if s == "" {
+		return "(empty body)"
+	}
+	if len(s) > snippetLength {
+		s = s[:snippetLength] + "..."
+	}
+	return fmt.Sprintf("%q", s)
+}
+
+// isJSONType reports whether a Content-Type allows a JSON body. Plain text
+// and a missing type are let through, since not every server labels its JSON.
+func isJSONType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || mediaType == "text/json" || mediaType == "text/plain" || strings.HasSuffix(mediaType, "+json")
+}
@@ -0,0 +1,69 @@
+package httpjson
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// response builds a response with the given status, content type and body
+func response(status int, contentType, body string) *http.Response {
+	resp := &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+	if contentType != "" {
+		resp.Header.Set("Content-Type", contentType)
+	}
+	return resp
+}
+
+func TestDecode(t *testing.T) {
+	testCases := []struct {
+		name        string
+		contentType string
+		body        string
+		expectError string
+	}{
+		{name: "JSON", contentType: "application/json; charset=utf-8", body: `{"status":"OK"}`},
+		{name: "No content type", body: `{"status":"OK"}`},
+		{name: "Plain text", contentType: "text/plain", body: `{"status":"OK"}`},
+		{name: "Block page", contentType: "text/html", body: "<html>\n  <title>Access denied</title>", expectError: `expected JSON, got text/html (HTTP 200): "<html> <title>Access denied</title>"`},
+		{name: "Not JSON", contentType: "application/json", body: "Bad Gateway", expectError: `failed to parse response (HTTP 200)`},
+		{name: "Too large", contentType: "application/json", body: `{"status":"` + strings.Repeat("x", MaxBody) + `"}`, expectError: "larger than 65536 bytes"},
+		{name: "Secrets quoted", contentType: "text/html", body: `{"token":"abc123"}`, expectError: `REDACTED`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var v struct {
+				Status string `json:"status"`
+			}
+			err := Decode(response(http.StatusOK, tc.contentType, tc.body), &v)
+			if tc.expectError == "" {
+				if err != nil || v.Status != "OK" {
+					t.Errorf("Expected status OK, got %q (%v)", v.Status, err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.expectError) {
+				t.Errorf("Expected an error containing %q, got %v", tc.expectError, err)
+			}
+			if err != nil && strings.Contains(err.Error(), "abc123") {
+				t.Errorf("Error leaks a secret: %v", err)
+			}
+		})
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	err := StatusError(response(http.StatusBadGateway, "text/html", "<h1>"+strings.Repeat("Bad Gateway ", 50)+"</h1>"))
+	if !strings.HasPrefix(err.Error(), `unexpected HTTP status Bad Gateway: "<h1>Bad Gateway`) || !strings.HasSuffix(err.Error(), `..."`) {
+		t.Errorf("Expected a truncated snippet, got %v", err)
+	}
+
+	if err := StatusError(response(http.StatusInternalServerError, "", "")); !strings.Contains(err.Error(), "(empty body)") {
+		t.Errorf("Expected an empty body to be named, got %v", err)
+	}
+}
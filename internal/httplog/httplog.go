@@ -0,0 +1,217 @@
+package httplog
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/redact"
+)
+
+// DefaultMaxBody is how much of a response body is logged
+const DefaultMaxBody = 512
+
+// Redacted replaces secret values in logs and dumps
+const Redacted = "REDACTED"
+
+// secretParams are query, form and JSON fields whose values are never logged.
+// The bindPort payload is base64 JSON that holds the token.
+var secretParams = []string{"token", "password", "signature", "payload"}
+
+// secretJSON matches secret string fields in JSON bodies
+var secretJSON = regexp.MustCompile(`("(?:` + strings.Join(secretParams, "|") + `)"\s*:\s*)"[^"]*"`)
+
+// Tracer logs a summary of every request made through a transport it wraps
+// and optionally dumps full request and response bodies to a directory
+type Tracer struct {
+	// Receives the summaries, log.Printf by default
+	Logf func(format string, args ...any)
+	// Directory full bodies are written to (disabled if empty)
+	Dir string
+	// Maximum number of response body bytes logged, DefaultMaxBody if 0
+	MaxBody int
+	// Numbers dump files so they sort in request order
+	seq atomic.Int64
+}
+
+// New creates a tracer that logs with log.Printf and dumps bodies to dir, if set
+func New(dir string) *Tracer {
+	return &Tracer{Logf: log.Printf, Dir: dir}
+}
+
+// Wrap returns a transport that traces requests made through base, or through
+// http.DefaultTransport if base is nil. A nil tracer returns base unchanged.
+func (t *Tracer) Wrap(base http.RoundTripper) http.RoundTripper {
+	if t == nil {
+		return base
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{tracer: t, base: base}
+}
+
+// transport traces requests before handing them to base
+type transport struct {
+	tracer *Tracer
+	base   http.RoundTripper
+}
+
+func (tr *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t := tr.tracer
+	name := path.Base(req.URL.Path)
+
+	// Keep a copy of the request body for the dump
+	var reqBody []byte
+	if req.Body != nil && req.Body != http.NoBody && t.Dir != "" {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		reqBody = body
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	start := time.Now()
+	resp, err := tr.base.RoundTrip(req)
+	latency := time.Since(start).Round(time.Millisecond)
+
+	if err != nil {
+		t.logf("HTTP %s %s %s failed after %s: %v", name, req.Method, RedactURL(req.URL), latency, err)
+		t.dump(name, req, reqBody, nil, nil)
+		return nil, err
+	}
+
+	// Read the body so it can be logged, and hand the caller a fresh reader
+	respBody, readErr := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	var body io.Reader = bytes.NewReader(respBody)
+	if readErr != nil {
+		// The caller still sees the read error after what was received
+		body = io.MultiReader(body, errReader{readErr})
+	}
+	resp.Body = io.NopCloser(body)
+
+	t.logf("HTTP %s %s %s -> %s (%s) body: %s", name, req.Method, RedactURL(req.URL), resp.Status, latency, t.summarize(respBody))
+	t.dump(name, req, reqBody, resp, respBody)
+	return resp, nil
+}
+
+// errReader returns err once the buffered body has been read
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+// logf logs with the configured function
+func (t *Tracer) logf(format string, args ...any) {
+	if t.Logf != nil {
+		t.Logf(format, args...)
+	}
+}
+
+// summarize returns a redacted body truncated to MaxBody bytes
+func (t *Tracer) summarize(body []byte) string {
+	maxBody := t.MaxBody
+	if maxBody <= 0 {
+		maxBody = DefaultMaxBody
+	}
+
+	s := strings.TrimSpace(RedactBody(string(body)))
+	if s == "" {
+		return "(empty)"
+	}
+	if len(s) > maxBody {
+		return fmt.Sprintf("%s... (%d bytes)", s[:maxBody], len(body))
+	}
+	return s
+}
+
+// dump writes the redacted request and response to a file in Dir
+func (t *Tracer) dump(name string, req *http.Request, reqBody []byte, resp *http.Response, respBody []byte) {
+	if t.Dir == "" {
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s\n", req.Method, RedactURL(req.URL))
+	writeHeaders(&b, req.Header)
+	if len(reqBody) > 0 {
+		fmt.Fprintf(&b, "\n%s\n", RedactBody(string(reqBody)))
+	}
+	if resp != nil {
+		fmt.Fprintf(&b, "\n%s %s\n", resp.Proto, resp.Status)
+		writeHeaders(&b, resp.Header)
+		fmt.Fprintf(&b, "\n%s\n", RedactBody(string(respBody)))
+	}
+
+	file := filepath.Join(t.Dir, fmt.Sprintf("%s-%04d-%s.txt", time.Now().Format("20060102T150405"), t.seq.Add(1), name))
+	if err := os.MkdirAll(t.Dir, 0700); err != nil {
+		t.logf("Failed to create HTTP dump directory: %v", err)
+		return
+	}
+	if err := os.WriteFile(file, []byte(b.String()), 0600); err != nil {
+		t.logf("Failed to write HTTP dump: %v", err)
+	}
+}
+
+// writeHeaders writes headers in a stable order, hiding credentials
+func writeHeaders(b *strings.Builder, headers http.Header) {
+	redacted := headers.Clone()
+	for _, name := range []string{"Authorization", "Cookie", "Set-Cookie"} {
+		if redacted.Get(name) != "" {
+			redacted.Set(name, Redacted)
+		}
+	}
+	redacted.Write(b)
+}
+
+// RedactURL returns the URL with secret query parameters replaced
+func RedactURL(u *url.URL) string {
+	redacted := *u
+	redacted.RawQuery = redactQuery(u.RawQuery)
+	return redacted.String()
+}
+
+// RedactBody replaces secrets in a form-encoded or JSON body, and any secret
+// registered with redact.Default
+func RedactBody(body string) string {
+	isForm := strings.Contains(body, "=") && !strings.ContainsAny(body, "{} \n")
+	if values, err := url.ParseQuery(body); err == nil && isForm {
+		return redactValues(values).Encode()
+	}
+	return redact.Default.String(secretJSON.ReplaceAllString(body, `$1"`+Redacted+`"`))
+}
+
+// redactQuery replaces secret parameters in an encoded query
+func redactQuery(query string) string {
+	if query == "" {
+		return ""
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return Redacted
+	}
+	return redactValues(values).Encode()
+}
+
+// redactValues replaces secret parameters in values
+func redactValues(values url.Values) url.Values {
+	for _, name := range secretParams {
+		if values.Has(name) {
+			values.Set(name, Redacted)
+		}
+	}
+	return values
+}
@@ -0,0 +1,160 @@
+package httplog
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRedactURL(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "Token",
+			input:    "https://10.0.0.1:19999/getSignature?token=secret",
+			expected: "https://10.0.0.1:19999/getSignature?token=REDACTED",
+		},
+		{
+			name:     "Payload and signature",
+			input:    "https://10.0.0.1:19999/bindPort?payload=abc&signature=secret",
+			expected: "https://10.0.0.1:19999/bindPort?payload=REDACTED&signature=REDACTED",
+		},
+		{
+			name:     "No query",
+			input:    "https://www.privateinternetaccess.com/api/client/v2/token",
+			expected: "https://www.privateinternetaccess.com/api/client/v2/token",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := url.Parse(tc.input)
+			if err != nil {
+				t.Fatalf("Failed to parse URL: %v", err)
+			}
+			if redacted := RedactURL(u); redacted != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, redacted)
+			}
+		})
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "Form",
+			input:    "password=secret&username=p1234567",
+			expected: "password=REDACTED&username=p1234567",
+		},
+		{
+			name:     "JSON token",
+			input:    `{"token": "secret"}`,
+			expected: `{"token": "REDACTED"}`,
+		},
+		{
+			name:     "JSON payload and signature",
+			input:    `{"status":"OK","payload":"abc","signature":"secret"}`,
+			expected: `{"status":"OK","payload":"REDACTED","signature":"REDACTED"}`,
+		},
+		{
+			name:     "JSON error",
+			input:    `{"status":"ERROR","message":"Invalid token"}`,
+			expected: `{"status":"ERROR","message":"Invalid token"}`,
+		},
+		{
+			name:     "Plain text",
+			input:    "Unauthorized",
+			expected: "Unauthorized",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if redacted := RedactBody(tc.input); redacted != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, redacted)
+			}
+		})
+	}
+}
+
+func TestTracer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "password=secret&username=user" {
+			t.Errorf("Expected the request body to reach the server, got %q", body)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"token":"secret-token","padding":"%s"}`, strings.Repeat("x", 100))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	var logs []string
+	tracer := &Tracer{
+		Logf:    func(format string, args ...any) { logs = append(logs, fmt.Sprintf(format, args...)) },
+		Dir:     dir,
+		MaxBody: 40,
+	}
+	client := &http.Client{Transport: tracer.Wrap(nil)}
+
+	resp, err := client.Post(server.URL+"/api/client/v2/token?token=query-secret", "application/x-www-form-urlencoded", strings.NewReader("password=secret&username=user"))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// The caller still gets the full response
+	if !strings.Contains(string(body), "secret-token") {
+		t.Errorf("Expected the caller to receive the unredacted body, got %s", body)
+	}
+
+	if len(logs) != 1 {
+		t.Fatalf("Expected 1 log line, got %d: %v", len(logs), logs)
+	}
+	for _, want := range []string{"HTTP token POST", "token=REDACTED", "200 OK", `"token":"REDACTED"`, "... ("} {
+		if !strings.Contains(logs[0], want) {
+			t.Errorf("Expected log to contain %q, got: %s", want, logs[0])
+		}
+	}
+
+	// The dump has the whole exchange without secrets
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected 1 dump file, got %v (%v)", entries, err)
+	}
+	if !strings.HasSuffix(entries[0].Name(), "-token.txt") {
+		t.Errorf("Expected the dump to be named after the endpoint, got %s", entries[0].Name())
+	}
+	dump, err := os.ReadFile(dir + "/" + entries[0].Name())
+	if err != nil {
+		t.Fatalf("Failed to read dump: %v", err)
+	}
+	for _, secret := range []string{"secret-token", "query-secret", "password=secret"} {
+		if strings.Contains(string(dump), secret) {
+			t.Errorf("Expected %q to be redacted in the dump:\n%s", secret, dump)
+		}
+	}
+	if !strings.Contains(string(dump), strings.Repeat("x", 100)) || !strings.Contains(string(dump), "username=user") {
+		t.Errorf("Expected the full bodies in the dump:\n%s", dump)
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	if rt := tracer.Wrap(http.DefaultTransport); rt != http.DefaultTransport {
+		t.Errorf("Expected a nil tracer to return the transport unchanged")
+	}
+}
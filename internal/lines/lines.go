@@ -0,0 +1,75 @@
+// Package lines splits text written on any platform into lines: LF, CRLF and
+// lone CR line endings are all accepted, and a leading UTF-8 byte order mark,
+// as Windows editors like to add, is dropped
+package lines
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+)
+
+// bom is the UTF-8 byte order mark
+const bom = "\uFEFF"
+
+// Split returns the lines in s without their line endings. Like
+// bufio.Scanner, a final line ending doesn't start another line.
+func Split(s string) []string {
+	s = strings.TrimPrefix(s, bom)
+	if s == "" {
+		return nil
+	}
+	lines := make([]string, 0, strings.Count(s, "\n")+1)
+	for s != "" {
+		i := strings.IndexAny(s, "\r\n")
+		if i < 0 {
+			lines = append(lines, s)
+			break
+		}
+		lines = append(lines, s[:i])
+		if s[i] == '\r' && i+1 < len(s) && s[i+1] == '\n' {
+			i++
+		}
+		s = s[i+1:]
+	}
+	return lines
+}
+
+// NewScanner returns a scanner reading r line by line, the way Split splits
+func NewScanner(r io.Reader) *bufio.Scanner {
+	br := bufio.NewReader(r)
+	if prefix, err := br.Peek(len(bom)); err == nil && string(prefix) == bom {
+		br.Discard(len(bom))
+	}
+	scanner := bufio.NewScanner(br)
+	scanner.Split(scanLines)
+	return scanner
+}
+
+// scanLines is a bufio.SplitFunc like bufio.ScanLines that also ends lines at a lone CR
+func scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		if data[i] == '\n' {
+			return i + 1, data[:i], nil
+		}
+		// Whether the CR is part of a CRLF takes the next byte to tell
+		if i+1 < len(data) {
+			if data[i+1] == '\n' {
+				return i + 2, data[:i], nil
+			}
+			return i + 1, data[:i], nil
+		}
+		if atEOF {
+			return i + 1, data[:i], nil
+		}
+		return 0, nil, nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
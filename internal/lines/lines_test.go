@@ -0,0 +1,78 @@
+package lines
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+var testCases = []struct {
+	name     string
+	input    string
+	expected []string
+}{
+	{name: "LF", input: "line1\nline2\nline3", expected: []string{"line1", "line2", "line3"}},
+	{name: "Single line", input: "single_line", expected: []string{"single_line"}},
+	{name: "Empty", input: "", expected: nil},
+	{name: "Trailing newline", input: "line1\n", expected: []string{"line1"}},
+	{name: "CRLF", input: "line1\r\nline2\r\n", expected: []string{"line1", "line2"}},
+	{name: "Lone CR", input: "line1\rline2\r", expected: []string{"line1", "line2"}},
+	{name: "Mixed endings", input: "a\r\nb\nc\rd", expected: []string{"a", "b", "c", "d"}},
+	{name: "Blank lines", input: "a\n\r\n\rb", expected: []string{"a", "", "", "b"}},
+	{name: "CR before blank LF line", input: "a\r\r\nb", expected: []string{"a", "", "b"}},
+	{name: "Byte order mark", input: "\uFEFFuser\r\npass\r\n", expected: []string{"user", "pass"}},
+	{name: "Byte order mark only", input: "\uFEFF", expected: nil},
+	{name: "Byte order mark later is kept", input: "a\n\uFEFFb", expected: []string{"a", "\uFEFFb"}},
+}
+
+func TestSplit(t *testing.T) {
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if result := Split(tc.input); !reflect.DeepEqual(result, tc.expected) {
+				t.Errorf("Expected %q, got %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestNewScanner(t *testing.T) {
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Reading a byte at a time splits CRLF pairs and the byte order mark across reads
+			for _, r := range []io.Reader{strings.NewReader(tc.input), iotest.OneByteReader(strings.NewReader(tc.input))} {
+				var result []string
+				scanner := NewScanner(r)
+				for scanner.Scan() {
+					result = append(result, scanner.Text())
+				}
+				if err := scanner.Err(); err != nil {
+					t.Fatalf("Scan failed: %v", err)
+				}
+				if !reflect.DeepEqual(result, tc.expected) {
+					t.Errorf("Expected %q, got %q", tc.expected, result)
+				}
+			}
+		})
+	}
+}
+
+// benchmarkInput is a config file of a typical size with Windows line endings
+var benchmarkInput = strings.Repeat("remote us-east.privacy.network 1198\r\n", 200)
+
+func BenchmarkSplit(b *testing.B) {
+	b.SetBytes(int64(len(benchmarkInput)))
+	for b.Loop() {
+		Split(benchmarkInput)
+	}
+}
+
+func BenchmarkScanner(b *testing.B) {
+	b.SetBytes(int64(len(benchmarkInput)))
+	for b.Loop() {
+		scanner := NewScanner(strings.NewReader(benchmarkInput))
+		for scanner.Scan() {
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package lock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrLocked is returned when another process holds the lock
+var ErrLocked = errors.New("lock is held by another process")
+
+// Lock is an exclusive advisory lock on a file, held until Release is called or the process exits
+type Lock struct {
+	path string
+	file *os.File
+}
+
+// PathFor returns the lock file used to guard the given output file
+func PathFor(outputFile string) string {
+	return outputFile + ".lock"
+}
+
+// Acquire takes an exclusive lock on path without blocking. If another process
+// holds it, the returned error wraps ErrLocked and names the holder's PID.
+func Acquire(path string) (*Lock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	if err := lockFile(file); err != nil {
+		file.Close()
+		if errors.Is(err, ErrLocked) {
+			if pid := readPID(path); pid != 0 {
+				return nil, fmt.Errorf("%w (pid %d, lock file %s)", ErrLocked, pid, path)
+			}
+			return nil, fmt.Errorf("%w (lock file %s)", ErrLocked, path)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+
+	// Record our PID so a second instance can report who holds the lock
+	l := &Lock{path: path, file: file}
+	l.writePID(os.Getpid())
+	return l, nil
+}
+
+// Inherit adopts a lock passed down in file by the process holding it, such
+// as a previous version handing over on upgrade. The lock stays held
+// throughout, and the lock file names the previous holder until it calls
+// HandOver.
+func Inherit(path string, file *os.File) *Lock {
+	return &Lock{path: path, file: file}
+}
+
+// File returns the locked file, to pass to a process that will Inherit the lock
+func (l *Lock) File() *os.File {
+	return l.file
+}
+
+// HandOver records pid as the holder and closes our copy of the lock file
+// without unlocking it, leaving the lock to the process it was passed to
+func (l *Lock) HandOver(pid int) error {
+	l.writePID(pid)
+	return l.file.Close()
+}
+
+// Held reports whether another process currently holds the lock at path. It
+// only opens the lock file for reading and never writes it, so it works for
+// users who can't write the file and doesn't disturb the holder.
+func Held(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	return probeFile(file)
+}
+
+// HolderPID returns the PID of the process holding the lock at path, or 0 if
+// the lock isn't held
+func HolderPID(path string) int {
+	if !Held(path) {
+		return 0
+	}
+	return readPID(path)
+}
+
+// Release unlocks the lock file. The file is left in place: a process that
+// opened it before it was removed could still lock it after, while another
+// locks a new file at the same path, and both would run.
+func (l *Lock) Release() error {
+	unlockFile(l.file)
+	return l.file.Close()
+}
+
+// writePID records pid as the holder in the lock file
+func (l *Lock) writePID(pid int) {
+	if err := l.file.Truncate(0); err == nil {
+		l.file.WriteAt([]byte(strconv.Itoa(pid)+"\n"), 0)
+	}
+}
+
+// readPID returns the PID recorded in a lock file, or 0 if unknown
+func readPID(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
@@ -0,0 +1,20 @@
+//go:build !unix && !windows
+
+package lock
+
+import "os"
+
+// lockFile is a no-op on platforms without flock
+func lockFile(file *os.File) error {
+	return nil
+}
+
+// probeFile never finds the file locked on platforms without flock
+func probeFile(file *os.File) bool {
+	return false
+}
+
+// unlockFile is a no-op on platforms without flock
+func unlockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,179 @@
+//go:build unix
+
+package lock
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestAcquire(t *testing.T) {
+	path := PathFor(filepath.Join(t.TempDir(), "port.txt"))
+
+	first, err := Acquire(path)
+	if err != nil {
+		t.Fatalf("Failed to acquire lock: %v", err)
+	}
+
+	// The lock file records our PID
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read lock file: %v", err)
+	}
+	if strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("Expected lock file to contain PID %d, got %q", os.Getpid(), string(data))
+	}
+
+	// A second acquisition fails fast and names the holder
+	_, err = Acquire(path)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("Expected ErrLocked, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "pid "+strconv.Itoa(os.Getpid())) {
+		t.Errorf("Expected error to name the holder PID, got %q", err.Error())
+	}
+
+	// Once released, the lock can be taken again
+	if err := first.Release(); err != nil {
+		t.Fatalf("Failed to release lock: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected lock file to be kept on release: %v", err)
+	}
+
+	second, err := Acquire(path)
+	if err != nil {
+		t.Fatalf("Failed to reacquire lock: %v", err)
+	}
+	second.Release()
+}
+
+func TestReleaseKeepsTheLockFile(t *testing.T) {
+	path := PathFor(filepath.Join(t.TempDir(), "port.txt"))
+
+	first, err := Acquire(path)
+	if err != nil {
+		t.Fatalf("Failed to acquire lock: %v", err)
+	}
+	// Another instance opened the lock file while the first held it, and
+	// locks it once the first lets go
+	waiting, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer waiting.Close()
+	if err := first.Release(); err != nil {
+		t.Fatalf("Failed to release lock: %v", err)
+	}
+	if err := lockFile(waiting); err != nil {
+		t.Fatalf("Expected the waiting instance to get the lock, got %v", err)
+	}
+
+	// A third instance finds the lock taken, rather than locking a new file
+	if _, err := Acquire(path); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked, got %v", err)
+	}
+}
+
+func TestAcquireUnwritableDirectory(t *testing.T) {
+	if _, err := Acquire(filepath.Join(t.TempDir(), "missing", "port.txt.lock")); err == nil {
+		t.Errorf("Expected error for missing directory")
+	}
+}
+
+func TestHeld(t *testing.T) {
+	path := PathFor(filepath.Join(t.TempDir(), "port.txt"))
+
+	if Held(path) {
+		t.Errorf("Expected lock not to be held")
+	}
+	if pid := HolderPID(path); pid != 0 {
+		t.Errorf("Expected no holder, got pid %d", pid)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected probing not to leave a lock file behind")
+	}
+
+	l, err := Acquire(path)
+	if err != nil {
+		t.Fatalf("Failed to acquire lock: %v", err)
+	}
+	defer l.Release()
+
+	if !Held(path) {
+		t.Errorf("Expected lock to be held")
+	}
+	if pid := HolderPID(path); pid != os.Getpid() {
+		t.Errorf("Expected holder pid %d, got %d", os.Getpid(), pid)
+	}
+}
+
+func TestHeldOnlyReads(t *testing.T) {
+	path := PathFor(filepath.Join(t.TempDir(), "port.txt"))
+
+	// A lock file left behind, which the user checking may not be allowed to write
+	if err := os.WriteFile(path, []byte("4242\n"), 0444); err != nil {
+		t.Fatal(err)
+	}
+	if Held(path) {
+		t.Errorf("Expected a lock file nobody holds not to be held")
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "4242\n" {
+		t.Errorf("Expected probing to leave the lock file alone, got %q, %v", data, err)
+	}
+
+	// A lock held by a service whose lock file the user can only read
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	l, err := Acquire(path)
+	if err != nil {
+		t.Fatalf("Failed to acquire lock: %v", err)
+	}
+	defer l.Release()
+	if err := os.Chmod(path, 0444); err != nil {
+		t.Fatal(err)
+	}
+	if !Held(path) {
+		t.Errorf("Expected lock to be held")
+	}
+	if pid := HolderPID(path); pid != os.Getpid() {
+		t.Errorf("Expected holder pid %d, got %d", os.Getpid(), pid)
+	}
+}
+
+func TestInherit(t *testing.T) {
+	path := PathFor(filepath.Join(t.TempDir(), "port.txt"))
+
+	parent, err := Acquire(path)
+	if err != nil {
+		t.Fatalf("Failed to acquire lock: %v", err)
+	}
+
+	// A child process gets its own descriptor for the same open file
+	fd, err := syscall.Dup(int(parent.File().Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	child := Inherit(path, os.NewFile(uintptr(fd), path))
+
+	// The lock survives the parent letting go of it, and names the new holder
+	if err := parent.HandOver(4242); err != nil {
+		t.Fatalf("Failed to hand over lock: %v", err)
+	}
+	if pid := HolderPID(path); pid != 4242 {
+		t.Errorf("Expected the inherited lock to be held by pid 4242, got %d", pid)
+	}
+
+	if err := child.Release(); err != nil {
+		t.Fatalf("Failed to release lock: %v", err)
+	}
+	if Held(path) {
+		t.Errorf("Expected the lock to be released")
+	}
+}
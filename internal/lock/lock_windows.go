@@ -0,0 +1,42 @@
+//go:build windows
+
+package lock
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockOverlapped places the lock past the PID so other processes can still read it
+func lockOverlapped() *windows.Overlapped {
+	return &windows.Overlapped{OffsetHigh: 1}
+}
+
+// lockFile takes a non-blocking exclusive lock on a single byte of the file
+func lockFile(file *os.File) error {
+	err := windows.LockFileEx(windows.Handle(file.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, lockOverlapped())
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return ErrLocked
+	}
+	return err
+}
+
+// probeFile reports whether another process holds the lock taken by lockFile,
+// taking a shared lock on the same byte for an instant
+func probeFile(file *os.File) bool {
+	handle := windows.Handle(file.Fd())
+	err := windows.LockFileEx(handle, windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, lockOverlapped())
+	if err != nil {
+		return errors.Is(err, windows.ERROR_LOCK_VIOLATION)
+	}
+	windows.UnlockFileEx(handle, 0, 1, 0, lockOverlapped())
+	return false
+}
+
+// unlockFile releases the lock taken by lockFile
+func unlockFile(file *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, lockOverlapped())
+}
@@ -0,0 +1,569 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Default is the registry used by the application
+var Default = NewRegistry()
+
+// metric is anything that can be written in the Prometheus text format
+type metric interface {
+	name() string
+	write(w io.Writer) error
+}
+
+// Registry holds a set of metrics
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// register adds a metric, panicking on duplicate names since that's a programming error
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.metrics[m.name()]; exists {
+		panic(fmt.Sprintf("metrics: duplicate metric %q", m.name()))
+	}
+	r.metrics[m.name()] = m
+}
+
+// NewCounter creates and registers a monotonically increasing counter
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{metricName: name, help: help}
+	r.register(c)
+	return c
+}
+
+// NewGauge creates and registers a gauge
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{metricName: name, help: help}
+	r.register(g)
+	return g
+}
+
+// NewGaugeFunc creates and registers a gauge whose value is computed by fn when
+// the metrics are written
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{metricName: name, help: help, fn: fn}
+	r.register(g)
+	return g
+}
+
+// NewHistogram creates and registers a histogram with the given bucket upper
+// bounds, which must be sorted
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := newHistogram(buckets)
+	h.metricName, h.help = name, help
+	r.register(h)
+	return h
+}
+
+// NewCounterVec creates and registers a family of counters told apart by the
+// value of label
+func (r *Registry) NewCounterVec(name, help, label string) *CounterVec {
+	v := &CounterVec{vec{metricName: name, help: help, kind: "counter", label: label}}
+	r.register(&v.vec)
+	return v
+}
+
+// NewGaugeVec creates and registers a family of gauges told apart by the value
+// of label
+func (r *Registry) NewGaugeVec(name, help, label string) *GaugeVec {
+	v := &GaugeVec{vec{metricName: name, help: help, kind: "gauge", label: label}}
+	r.register(&v.vec)
+	return v
+}
+
+// NewHistogramVec creates and registers a family of histograms with the given
+// bucket upper bounds, told apart by the value of label
+func (r *Registry) NewHistogramVec(name, help, label string, buckets []float64) *HistogramVec {
+	v := &HistogramVec{vec: vec{metricName: name, help: help, kind: "histogram", label: label}, buckets: buckets}
+	r.register(&v.vec)
+	return v
+}
+
+// NewSummaryVec creates and registers a family of summaries told apart by the
+// value of label, each reporting the given quantiles over its last window
+// observations
+func (r *Registry) NewSummaryVec(name, help, label string, window int, quantiles []float64) *SummaryVec {
+	v := &SummaryVec{vec: vec{metricName: name, help: help, kind: "summary", label: label}, window: window, quantiles: quantiles}
+	r.register(&v.vec)
+	return v
+}
+
+// Write writes all metrics in the Prometheus text exposition format, sorted by name
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]metric, len(names))
+	for i, name := range names {
+		metrics[i] = r.metrics[name]
+	}
+	r.mu.Unlock()
+
+	for _, m := range metrics {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler serves the registry in the Prometheus text exposition format
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+// Counter is a metric that only goes up
+type Counter struct {
+	metricName string
+	help       string
+	value      atomic.Uint64
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Add increments the counter by n
+func (c *Counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+// Value returns the current count
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+func (c *Counter) name() string {
+	return c.metricName
+}
+
+func (c *Counter) write(w io.Writer) error {
+	if err := writeHeader(w, c.metricName, c.help, "counter"); err != nil {
+		return err
+	}
+	return c.writeSamples(w, c.metricName, "")
+}
+
+func (c *Counter) writeSamples(w io.Writer, name, labels string) error {
+	_, err := fmt.Fprintf(w, "%s%s %d\n", name, labelSet(labels), c.Value())
+	return err
+}
+
+// Gauge is a metric that can go up and down
+type Gauge struct {
+	metricName string
+	help       string
+	bits       atomic.Uint64
+}
+
+// Set sets the gauge to v
+func (g *Gauge) Set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+}
+
+// Value returns the current value
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+func (g *Gauge) name() string {
+	return g.metricName
+}
+
+func (g *Gauge) write(w io.Writer) error {
+	if err := writeHeader(w, g.metricName, g.help, "gauge"); err != nil {
+		return err
+	}
+	return g.writeSamples(w, g.metricName, "")
+}
+
+func (g *Gauge) writeSamples(w io.Writer, name, labels string) error {
+	_, err := fmt.Fprintf(w, "%s%s %s\n", name, labelSet(labels), formatFloat(g.Value()))
+	return err
+}
+
+// GaugeFunc is a gauge computed on demand, for values such as ages that change
+// without any event to record them
+type GaugeFunc struct {
+	metricName string
+	help       string
+	fn         func() float64
+}
+
+// Value returns the current value
+func (g *GaugeFunc) Value() float64 {
+	return g.fn()
+}
+
+func (g *GaugeFunc) name() string {
+	return g.metricName
+}
+
+func (g *GaugeFunc) write(w io.Writer) error {
+	if err := writeHeader(w, g.metricName, g.help, "gauge"); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s %s\n", g.metricName, formatFloat(g.Value()))
+	return err
+}
+
+// Histogram counts observations, such as durations, in buckets by upper bound
+type Histogram struct {
+	metricName string
+	help       string
+	buckets    []float64
+
+	mu sync.Mutex
+	// Observations in each bucket and above the last one, not cumulative
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// newHistogram returns an unregistered histogram with the given buckets
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+}
+
+// Observe records one observation
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.counts[sort.SearchFloat64s(h.buckets, v)]++
+	h.count++
+	h.sum += v
+}
+
+// Count returns the number of observations
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.count
+}
+
+// Sum returns the sum of all observations
+func (h *Histogram) Sum() float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.sum
+}
+
+func (h *Histogram) name() string {
+	return h.metricName
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	if err := writeHeader(w, h.metricName, h.help, "histogram"); err != nil {
+		return err
+	}
+	return h.writeSamples(w, h.metricName, "")
+}
+
+func (h *Histogram) writeSamples(w io.Writer, name, labels string) error {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	count, sum := h.count, h.sum
+	h.mu.Unlock()
+
+	cumulative := uint64(0)
+	for i, bound := range h.buckets {
+		cumulative += counts[i]
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", name, labelSet(joinLabels(labels, labelPair("le", formatFloat(bound)))), cumulative); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", name, labelSet(joinLabels(labels, labelPair("le", "+Inf"))), count); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", name, labelSet(labels), formatFloat(sum), name, labelSet(labels), count)
+	return err
+}
+
+// Summary reports quantiles of its most recent observations, so they follow
+// changes in what is being observed rather than averaging over all time. The
+// sum and count still cover every observation.
+type Summary struct {
+	quantiles []float64
+
+	mu sync.Mutex
+	// Ring buffer of the most recent observations, next is where the next one goes
+	recent []float64
+	next   int
+	count  uint64
+	sum    float64
+}
+
+// newSummary returns a summary of the last window observations
+func newSummary(window int, quantiles []float64) *Summary {
+	return &Summary{quantiles: quantiles, recent: make([]float64, 0, window)}
+}
+
+// Observe records one observation, dropping the oldest from the window if it
+// is full
+func (s *Summary) Observe(v float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.recent) < cap(s.recent) {
+		s.recent = append(s.recent, v)
+	} else {
+		s.recent[s.next] = v
+	}
+	s.next = (s.next + 1) % cap(s.recent)
+	s.count++
+	s.sum += v
+}
+
+// Count returns the number of observations, including those no longer in the
+// window
+func (s *Summary) Count() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.count
+}
+
+// Sum returns the sum of all observations
+func (s *Summary) Sum() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sum
+}
+
+// Len returns the number of observations in the window
+func (s *Summary) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.recent)
+}
+
+// Quantile returns the q-quantile of the observations in the window by
+// nearest rank, or NaN if there are none
+func (s *Summary) Quantile(q float64) float64 {
+	s.mu.Lock()
+	sorted := append([]float64(nil), s.recent...)
+	s.mu.Unlock()
+
+	sort.Float64s(sorted)
+	return quantile(sorted, q)
+}
+
+func (s *Summary) writeSamples(w io.Writer, name, labels string) error {
+	s.mu.Lock()
+	sorted := append([]float64(nil), s.recent...)
+	count, sum := s.count, s.sum
+	s.mu.Unlock()
+
+	sort.Float64s(sorted)
+	for _, q := range s.quantiles {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", name, labelSet(joinLabels(labels, labelPair("quantile", formatFloat(q)))), formatFloat(quantile(sorted, q))); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", name, labelSet(labels), formatFloat(sum), name, labelSet(labels), count)
+	return err
+}
+
+// quantile returns the q-quantile of sorted by nearest rank, or NaN if it's empty
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+	return sorted[max(0, min(rank, len(sorted)-1))]
+}
+
+// sampler writes the samples of one metric under the given name and labels,
+// so families can write their members
+type sampler interface {
+	writeSamples(w io.Writer, name, labels string) error
+}
+
+// vec is a family of metrics of one kind, told apart by the value of a label
+type vec struct {
+	metricName string
+	help       string
+	kind       string
+	label      string
+
+	mu      sync.Mutex
+	members map[string]sampler
+}
+
+// with returns the member for value, creating it with create if needed
+func (v *vec) with(value string, create func() sampler) sampler {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if m, ok := v.members[value]; ok {
+		return m
+	}
+	if v.members == nil {
+		v.members = make(map[string]sampler)
+	}
+	m := create()
+	v.members[value] = m
+	return m
+}
+
+// lookup returns the member for value, if there is one
+func (v *vec) lookup(value string) (sampler, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	m, ok := v.members[value]
+	return m, ok
+}
+
+func (v *vec) name() string {
+	return v.metricName
+}
+
+// write writes every member, sorted by label value. A family without members
+// writes nothing.
+func (v *vec) write(w io.Writer) error {
+	v.mu.Lock()
+	values := make([]string, 0, len(v.members))
+	for value := range v.members {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	members := make([]sampler, len(values))
+	for i, value := range values {
+		members[i] = v.members[value]
+	}
+	v.mu.Unlock()
+
+	if len(members) == 0 {
+		return nil
+	}
+	if err := writeHeader(w, v.metricName, v.help, v.kind); err != nil {
+		return err
+	}
+	for i, m := range members {
+		if err := m.writeSamples(w, v.metricName, labelPair(v.label, values[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CounterVec is a family of counters told apart by the value of a label
+type CounterVec struct {
+	vec
+}
+
+// With returns the counter for the label value, creating it at zero if needed
+func (v *CounterVec) With(value string) *Counter {
+	return v.with(value, func() sampler { return &Counter{} }).(*Counter)
+}
+
+// GaugeVec is a family of gauges told apart by the value of a label
+type GaugeVec struct {
+	vec
+}
+
+// With returns the gauge for the label value, creating it at zero if needed
+func (v *GaugeVec) With(value string) *Gauge {
+	return v.with(value, func() sampler { return &Gauge{} }).(*Gauge)
+}
+
+// HistogramVec is a family of histograms with the same buckets, told apart by
+// the value of a label
+type HistogramVec struct {
+	vec
+	buckets []float64
+}
+
+// With returns the histogram for the label value, creating it empty if needed
+func (v *HistogramVec) With(value string) *Histogram {
+	return v.with(value, func() sampler { return newHistogram(v.buckets) }).(*Histogram)
+}
+
+// SummaryVec is a family of summaries with the same window and quantiles, told
+// apart by the value of a label
+type SummaryVec struct {
+	vec
+	window    int
+	quantiles []float64
+}
+
+// With returns the summary for the label value, creating it empty if needed
+func (v *SummaryVec) With(value string) *Summary {
+	return v.with(value, func() sampler { return newSummary(v.window, v.quantiles) }).(*Summary)
+}
+
+// Lookup returns the summary for the label value without creating it, so
+// readers don't add empty members
+func (v *SummaryVec) Lookup(value string) (*Summary, bool) {
+	m, ok := v.lookup(value)
+	if !ok {
+		return nil, false
+	}
+	return m.(*Summary), true
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric
+func writeHeader(w io.Writer, name, help, kind string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	return err
+}
+
+// labelPair formats one label as name="value", escaping the value
+func labelPair(name, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return name + `="` + value + `"`
+}
+
+// labelSet returns the comma-separated labels in braces, or nothing if there
+// are none
+func labelSet(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+// joinLabels joins two comma-separated label lists, either possibly empty
+func joinLabels(a, b string) string {
+	if a == "" || b == "" {
+		return a + b
+	}
+	return a + "," + b
+}
+
+// formatFloat formats a sample value the shortest way that reads back exactly
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
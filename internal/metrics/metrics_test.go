@@ -0,0 +1,191 @@
+package metrics
+
+import (
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.NewCounter("test_requests_total", "Number of test requests")
+	gauge := registry.NewGauge("test_port", "Current test port")
+
+	counter.Inc()
+	counter.Add(2)
+	gauge.Set(12345)
+
+	var out strings.Builder
+	if err := registry.Write(&out); err != nil {
+		t.Fatalf("Failed to write metrics: %v", err)
+	}
+
+	expected := `# HELP test_port Current test port
+# TYPE test_port gauge
+test_port 12345
+# HELP test_requests_total Number of test requests
+# TYPE test_requests_total counter
+test_requests_total 3
+`
+	if out.String() != expected {
+		t.Errorf("Unexpected output:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	registry := NewRegistry()
+	value := 1.5
+	registry.NewGaugeFunc("test_age_seconds", "Age of the test value", func() float64 { return value })
+
+	// The value is computed each time the metrics are written
+	value = 42
+	var out strings.Builder
+	if err := registry.Write(&out); err != nil {
+		t.Fatalf("Failed to write metrics: %v", err)
+	}
+
+	expected := `# HELP test_age_seconds Age of the test value
+# TYPE test_age_seconds gauge
+test_age_seconds 42
+`
+	if out.String() != expected {
+		t.Errorf("Unexpected output:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	registry := NewRegistry()
+	histogram := registry.NewHistogram("test_duration_seconds", "Duration of the test", []float64{0.5, 1, 5})
+
+	for _, v := range []float64{0.25, 1, 1, 2, 10} {
+		histogram.Observe(v)
+	}
+
+	var out strings.Builder
+	if err := registry.Write(&out); err != nil {
+		t.Fatalf("Failed to write metrics: %v", err)
+	}
+
+	// Buckets are cumulative and include observations equal to their bound
+	expected := `# HELP test_duration_seconds Duration of the test
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.5"} 1
+test_duration_seconds_bucket{le="1"} 3
+test_duration_seconds_bucket{le="5"} 4
+test_duration_seconds_bucket{le="+Inf"} 5
+test_duration_seconds_sum 14.25
+test_duration_seconds_count 5
+`
+	if out.String() != expected {
+		t.Errorf("Unexpected output:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+}
+
+func TestVecs(t *testing.T) {
+	registry := NewRegistry()
+	runs := registry.NewCounterVec("test_runs_total", "Number of test runs", "hook")
+	exitCodes := registry.NewGaugeVec("test_exit_code", "Last exit code", "hook")
+	durations := registry.NewHistogramVec("test_run_seconds", "Duration of test runs", "hook", []float64{1})
+	registry.NewCounterVec("test_unused_total", "Never used", "hook")
+
+	runs.With("port-change").Inc()
+	runs.With("exit").Inc()
+	runs.With("port-change").Inc()
+	exitCodes.With(`say "hi"`).Set(2)
+	durations.With("exit").Observe(0.5)
+
+	var out strings.Builder
+	if err := registry.Write(&out); err != nil {
+		t.Fatalf("Failed to write metrics: %v", err)
+	}
+
+	// Members are sorted by label value, and families without any are left out
+	expected := `# HELP test_exit_code Last exit code
+# TYPE test_exit_code gauge
+test_exit_code{hook="say \"hi\""} 2
+# HELP test_run_seconds Duration of test runs
+# TYPE test_run_seconds histogram
+test_run_seconds_bucket{hook="exit",le="1"} 1
+test_run_seconds_bucket{hook="exit",le="+Inf"} 1
+test_run_seconds_sum{hook="exit"} 0.5
+test_run_seconds_count{hook="exit"} 1
+# HELP test_runs_total Number of test runs
+# TYPE test_runs_total counter
+test_runs_total{hook="exit"} 1
+test_runs_total{hook="port-change"} 2
+`
+	if out.String() != expected {
+		t.Errorf("Unexpected output:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+}
+
+func TestSummaryVec(t *testing.T) {
+	registry := NewRegistry()
+	latency := registry.NewSummaryVec("test_latency_seconds", "Latency of test requests", "endpoint", 4, []float64{0.5, 0.9})
+
+	if _, ok := latency.Lookup("bind"); ok {
+		t.Errorf("Expected no summary before the first use")
+	}
+	summary := latency.With("bind")
+	if found, ok := latency.Lookup("bind"); !ok || found != summary {
+		t.Errorf("Expected Lookup to find the summary")
+	}
+	if !math.IsNaN(summary.Quantile(0.5)) {
+		t.Errorf("Expected NaN for an empty summary, got %v", summary.Quantile(0.5))
+	}
+	for _, v := range []float64{10, 1, 3, 2, 4} {
+		summary.Observe(v)
+	}
+
+	// The first observation has left the window, but still counts in the sum
+	if summary.Len() != 4 {
+		t.Errorf("Expected 4 observations in the window, got %d", summary.Len())
+	}
+	if got := summary.Quantile(0.5); got != 2 {
+		t.Errorf("Expected median 2, got %v", got)
+	}
+
+	var out strings.Builder
+	if err := registry.Write(&out); err != nil {
+		t.Fatalf("Failed to write metrics: %v", err)
+	}
+
+	expected := `# HELP test_latency_seconds Latency of test requests
+# TYPE test_latency_seconds summary
+test_latency_seconds{endpoint="bind",quantile="0.5"} 2
+test_latency_seconds{endpoint="bind",quantile="0.9"} 4
+test_latency_seconds_sum{endpoint="bind"} 20
+test_latency_seconds_count{endpoint="bind"} 5
+`
+	if out.String() != expected {
+		t.Errorf("Unexpected output:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+}
+
+func TestRegistryDuplicateName(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounter("test_total", "First")
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected panic on duplicate metric name")
+		}
+	}()
+	registry.NewGauge("test_total", "Second")
+}
+
+func TestHandler(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounter("test_total", "Test counter").Inc()
+
+	recorder := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Expected text/plain content type, got %s", recorder.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(recorder.Body.String(), "test_total 1\n") {
+		t.Errorf("Expected counter in output, got %s", recorder.Body.String())
+	}
+}
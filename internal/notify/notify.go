@@ -0,0 +1,251 @@
+// Package notify sends push notifications through ntfy, Gotify or Pushover,
+// and emails them through an SMTP server
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/httpjson"
+)
+
+// Providers
+const (
+	// ProviderNtfy publishes to an ntfy topic URL
+	ProviderNtfy = "ntfy"
+	// ProviderGotify posts to a Gotify server with an application token
+	ProviderGotify = "gotify"
+	// ProviderPushover posts to the Pushover API with an application token and user key
+	ProviderPushover = "pushover"
+)
+
+// Events notifications can be sent for
+const (
+	// EventPortChange is a new port being bound, including the first
+	EventPortChange = "port-change"
+	// EventBindFailure is binding the port failing several times in a row
+	EventBindFailure = "bind-failure"
+	// EventAuthFailure is PIA authentication failing several times in a row
+	EventAuthFailure = "auth-failure"
+)
+
+// AllEvents lists every event, in the order they're documented
+var AllEvents = []string{EventPortChange, EventBindFailure, EventAuthFailure}
+
+const (
+	// DefaultPushoverURL is the Pushover message endpoint
+	DefaultPushoverURL = "https://api.pushover.net/1/messages.json"
+	// requestTimeout bounds each request to the provider
+	requestTimeout = 30 * time.Second
+)
+
+// ParseEvents parses a comma-separated list of events. An empty list selects
+// every event.
+func ParseEvents(s string) (map[string]bool, error) {
+	selected := make(map[string]bool, len(AllEvents))
+	if strings.TrimSpace(s) == "" {
+		for _, event := range AllEvents {
+			selected[event] = true
+		}
+		return selected, nil
+	}
+
+	for _, event := range strings.Split(s, ",") {
+		event = strings.TrimSpace(event)
+		known := false
+		for _, e := range AllEvents {
+			known = known || e == event
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown event %q, expected %s", event, strings.Join(AllEvents, ", "))
+		}
+		selected[event] = true
+	}
+	return selected, nil
+}
+
+// Message is a notification
+type Message struct {
+	Title string
+	Body  string
+	// Urgent messages are sent with a raised priority
+	Urgent bool
+	// When it happened, listed when several messages are emailed together
+	Time time.Time
+}
+
+// Settings say where notifications go
+type Settings struct {
+	Provider string
+	// ntfy topic URL such as https://ntfy.sh/my-topic, or the Gotify server URL
+	URL string
+	// Pushover user or group key
+	User string
+	// Access token: optional for ntfy, the application token for Gotify and Pushover
+	Token string
+}
+
+// Check reports settings the provider can't use. The token isn't checked,
+// since it's usually read from a file just before sending.
+func (s Settings) Check() error {
+	switch s.Provider {
+	case ProviderNtfy, ProviderGotify:
+		if s.URL == "" {
+			return fmt.Errorf("%s requires a URL", s.Provider)
+		}
+		u, err := url.Parse(s.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid %s URL %q, expected an http or https URL", s.Provider, s.URL)
+		}
+		if s.Provider == ProviderNtfy && strings.Trim(u.Path, "/") == "" {
+			return errors.New("ntfy URL must include the topic, such as https://ntfy.sh/my-topic")
+		}
+		if s.User != "" {
+			return errors.New("a user key only applies to pushover")
+		}
+	case ProviderPushover:
+		if s.User == "" {
+			return errors.New("pushover requires a user key")
+		}
+		if s.URL != "" {
+			return errors.New("pushover doesn't take a URL")
+		}
+	default:
+		return fmt.Errorf("unknown provider %q, expected %s, %s or %s", s.Provider, ProviderNtfy, ProviderGotify, ProviderPushover)
+	}
+	return nil
+}
+
+// Notifier sends messages to a provider
+type Notifier struct {
+	Settings
+	// Pushover endpoint, replaced in tests
+	PushoverURL string
+	// HTTP client used for all requests
+	Client *http.Client
+}
+
+// New returns a notifier for valid settings
+func New(settings Settings) (*Notifier, error) {
+	if err := settings.Check(); err != nil {
+		return nil, err
+	}
+	return &Notifier{
+		Settings:    settings,
+		PushoverURL: DefaultPushoverURL,
+		Client:      &http.Client{Timeout: requestTimeout},
+	}, nil
+}
+
+// Send delivers m
+func (n *Notifier) Send(ctx context.Context, m Message) error {
+	var req *http.Request
+	var err error
+	switch n.Provider {
+	case ProviderNtfy:
+		req, err = n.ntfyRequest(ctx, m)
+	case ProviderGotify:
+		req, err = n.gotifyRequest(ctx, m)
+	default:
+		req, err = n.pushoverRequest(ctx, m)
+	}
+	if err != nil {
+		return err
+	}
+	if err := n.do(req); err != nil {
+		return fmt.Errorf("failed to notify %s: %w", n.Provider, err)
+	}
+	return nil
+}
+
+// ntfyRequest publishes the body to the topic, with the title and priority in headers
+func (n *Notifier) ntfyRequest(ctx context.Context, m Message) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, strings.NewReader(m.Body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Title", m.Title)
+	if m.Urgent {
+		req.Header.Set("Priority", "high")
+		req.Header.Set("Tags", "warning")
+	}
+	if n.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.Token)
+	}
+	return req, nil
+}
+
+// gotifyMessage is the body of a Gotify message request
+type gotifyMessage struct {
+	Title    string `json:"title"`
+	Message  string `json:"message"`
+	Priority int    `json:"priority"`
+}
+
+// gotifyRequest posts the message to the server's message endpoint
+func (n *Notifier) gotifyRequest(ctx context.Context, m Message) (*http.Request, error) {
+	// Gotify shows priority 8 and above as a heads-up notification on Android
+	message := gotifyMessage{Title: m.Title, Message: m.Body, Priority: 5}
+	if m.Urgent {
+		message.Priority = 8
+	}
+	body, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(n.URL, "/")+"/message", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", n.Token)
+	return req, nil
+}
+
+// pushoverRequest posts the message as a form to the Pushover API
+func (n *Notifier) pushoverRequest(ctx context.Context, m Message) (*http.Request, error) {
+	priority := 0
+	if m.Urgent {
+		priority = 1
+	}
+	form := url.Values{
+		"token":    {n.Token},
+		"user":     {n.User},
+		"title":    {m.Title},
+		"message":  {m.Body},
+		"priority": {strconv.Itoa(priority)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.PushoverURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// do sends req and checks for a 2xx response. Errors leave out the URL, which
+// can hold a secret topic name.
+func (n *Notifier) do(req *http.Request) error {
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("request to %s failed: %w", req.URL.Host, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return httpjson.StatusError(resp)
+	}
+	return nil
+}
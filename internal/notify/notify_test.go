@@ -0,0 +1,139 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSettingsCheck(t *testing.T) {
+	testCases := []struct {
+		name        string
+		settings    Settings
+		expectError string
+	}{
+		{name: "ntfy", settings: Settings{Provider: "ntfy", URL: "https://ntfy.sh/my-topic"}},
+		{name: "ntfy without topic", settings: Settings{Provider: "ntfy", URL: "https://ntfy.sh/"}, expectError: "must include the topic"},
+		{name: "Gotify", settings: Settings{Provider: "gotify", URL: "https://gotify.example.com"}},
+		{name: "Gotify without URL", settings: Settings{Provider: "gotify"}, expectError: "requires a URL"},
+		{name: "Gotify bad URL", settings: Settings{Provider: "gotify", URL: "gotify.example.com"}, expectError: "invalid gotify URL"},
+		{name: "Gotify user", settings: Settings{Provider: "gotify", URL: "https://gotify.example.com", User: "u"}, expectError: "only applies to pushover"},
+		{name: "Pushover", settings: Settings{Provider: "pushover", User: "uQiRzpo4DXghDmr9QzzfQu27cmVRsG"}},
+		{name: "Pushover without user", settings: Settings{Provider: "pushover"}, expectError: "requires a user key"},
+		{name: "Unknown provider", settings: Settings{Provider: "slack"}, expectError: "unknown provider"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.settings.Check()
+			if tc.expectError == "" {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.expectError) {
+				t.Errorf("Expected error containing %q, got %v", tc.expectError, err)
+			}
+		})
+	}
+}
+
+func TestParseEvents(t *testing.T) {
+	all, err := ParseEvents("")
+	if err != nil || len(all) != len(AllEvents) {
+		t.Errorf("Expected every event, got %v (%v)", all, err)
+	}
+	some, err := ParseEvents("port-change, auth-failure")
+	if err != nil || !reflect.DeepEqual(some, map[string]bool{EventPortChange: true, EventAuthFailure: true}) {
+		t.Errorf("Expected port-change and auth-failure, got %v (%v)", some, err)
+	}
+	if _, err := ParseEvents("port-change,reboot"); err == nil {
+		t.Error("Expected an unknown event to be rejected")
+	}
+}
+
+// request is what a provider received
+type request struct {
+	path   string
+	header http.Header
+	body   string
+}
+
+// newTestServer records each request it receives
+func newTestServer(t *testing.T, requests *[]request) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		*requests = append(*requests, request{path: r.URL.Path, header: r.Header, body: string(body)})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSend(t *testing.T) {
+	message := Message{Title: "Port changed", Body: "Forwarded port is now 12345", Urgent: true}
+
+	t.Run("ntfy", func(t *testing.T) {
+		var requests []request
+		server := newTestServer(t, &requests)
+		n, _ := New(Settings{Provider: "ntfy", URL: server.URL + "/my-topic", Token: "tk_secret"})
+		if err := n.Send(context.Background(), message); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		r := requests[0]
+		if r.path != "/my-topic" || r.body != message.Body || r.header.Get("Title") != message.Title ||
+			r.header.Get("Priority") != "high" || r.header.Get("Authorization") != "Bearer tk_secret" {
+			t.Errorf("Unexpected request %+v", r)
+		}
+	})
+
+	t.Run("Gotify", func(t *testing.T) {
+		var requests []request
+		server := newTestServer(t, &requests)
+		n, _ := New(Settings{Provider: "gotify", URL: server.URL + "/", Token: "app-token"})
+		if err := n.Send(context.Background(), message); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		r := requests[0]
+		var got gotifyMessage
+		json.Unmarshal([]byte(r.body), &got)
+		if r.path != "/message" || r.header.Get("X-Gotify-Key") != "app-token" || got != (gotifyMessage{Title: message.Title, Message: message.Body, Priority: 8}) {
+			t.Errorf("Unexpected request %+v", r)
+		}
+	})
+
+	t.Run("Pushover", func(t *testing.T) {
+		var requests []request
+		server := newTestServer(t, &requests)
+		n, _ := New(Settings{Provider: "pushover", User: "user-key", Token: "app-token"})
+		n.PushoverURL = server.URL + "/1/messages.json"
+		if err := n.Send(context.Background(), Message{Title: "Port changed", Body: "12345"}); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		form, _ := url.ParseQuery(requests[0].body)
+		expected := url.Values{"token": {"app-token"}, "user": {"user-key"}, "title": {"Port changed"}, "message": {"12345"}, "priority": {"0"}}
+		if !reflect.DeepEqual(form, expected) {
+			t.Errorf("Expected form %v, got %v", expected, form)
+		}
+	})
+}
+
+func TestSendError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	n, _ := New(Settings{Provider: "ntfy", URL: server.URL + "/secret-topic"})
+	err := n.Send(context.Background(), Message{Title: "t", Body: "b"})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected a 401 error, got %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTP connection security
+const (
+	// SMTPStartTLS upgrades a plain connection with STARTTLS, usually on port 587
+	SMTPStartTLS = "starttls"
+	// SMTPTLS connects with TLS from the start, usually on port 465
+	SMTPTLS = "tls"
+	// SMTPNone sends in the clear, for a relay on the local network
+	SMTPNone = "none"
+)
+
+// smtpTimeout bounds a whole delivery, from connecting to QUIT
+const smtpTimeout = time.Minute
+
+// Mailer emails messages through an SMTP server
+type Mailer struct {
+	// Server as host:port
+	Server string
+	// Connection security: starttls, tls or none (tls on port 465,
+	// starttls otherwise, if empty)
+	Security string
+	// Sender and recipient addresses
+	From string
+	To   []string
+	// Login, if the server requires one
+	Username string
+	Password string
+	// TLS settings, replaced in tests
+	TLSConfig *tls.Config
+}
+
+// Check reports settings that can't be used to send mail. The password isn't
+// checked, since it's usually read from a file just before sending.
+func (m *Mailer) Check() error {
+	host, port, err := net.SplitHostPort(m.Server)
+	if err != nil || host == "" || port == "" {
+		return fmt.Errorf("invalid SMTP server %q, expected host:port", m.Server)
+	}
+	switch m.Security {
+	case "", SMTPStartTLS, SMTPTLS, SMTPNone:
+	default:
+		return fmt.Errorf("unknown SMTP security %q, expected %s, %s or %s", m.Security, SMTPStartTLS, SMTPTLS, SMTPNone)
+	}
+	// The password is only sent in the clear to this host, so logging in
+	// anywhere else would fail on every email
+	if m.Security == SMTPNone && m.Username != "" && host != "localhost" && host != "127.0.0.1" && host != "::1" {
+		return fmt.Errorf("can't log in to %s without TLS, use %s or %s or drop the username", host, SMTPStartTLS, SMTPTLS)
+	}
+	if _, err := mail.ParseAddress(m.From); err != nil {
+		return fmt.Errorf("invalid sender address %q: %w", m.From, err)
+	}
+	if len(m.To) == 0 {
+		return errors.New("no recipients")
+	}
+	for _, to := range m.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return fmt.Errorf("invalid recipient address %q: %w", to, err)
+		}
+	}
+	return nil
+}
+
+// security returns the connection security, defaulting by port
+func (m *Mailer) security() string {
+	if m.Security != "" {
+		return m.Security
+	}
+	if _, port, _ := net.SplitHostPort(m.Server); port == "465" {
+		return SMTPTLS
+	}
+	return SMTPStartTLS
+}
+
+// Send emails messages as a single mail
+func (m *Mailer) Send(ctx context.Context, messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	if err := m.send(ctx, m.compose(messages, time.Now())); err != nil {
+		return fmt.Errorf("failed to email %s: %w", strings.Join(m.To, ", "), err)
+	}
+	return nil
+}
+
+// send delivers a composed mail to every recipient
+func (m *Mailer) send(ctx context.Context, msg []byte) error {
+	host, _, _ := net.SplitHostPort(m.Server)
+	tlsConfig := m.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: host}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+	var conn net.Conn
+	var err error
+	if m.security() == SMTPTLS {
+		dialer := &tls.Dialer{Config: tlsConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", m.Server)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", m.Server)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if m.security() == SMTPStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("server doesn't offer STARTTLS (set the security to none to send in the clear)")
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if m.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.Username, m.Password, host)); err != nil {
+			return fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+
+	from, _ := mail.ParseAddress(m.From)
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, to := range m.To {
+		addr, _ := mail.ParseAddress(to)
+		if err := client.Rcpt(addr.Address); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// compose formats messages as a plain text mail. A single message is sent
+// under its own title, several under a count with each one listed.
+func (m *Mailer) compose(messages []Message, now time.Time) []byte {
+	subject := messages[0].Title
+	if len(messages) > 1 {
+		subject = fmt.Sprintf("PIA port forwarding: %d notifications", len(messages))
+	}
+	urgent := false
+	for _, msg := range messages {
+		urgent = urgent || msg.Urgent
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", m.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@go-pia>\r\n", messageID())
+	if urgent {
+		b.WriteString("X-Priority: 1\r\nImportance: high\r\n")
+	}
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+
+	for i, msg := range messages {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		if len(messages) > 1 {
+			if !msg.Time.IsZero() {
+				fmt.Fprintf(&b, "%s ", msg.Time.Format(time.DateTime))
+			}
+			fmt.Fprintf(&b, "%s\r\n", msg.Title)
+		}
+		fmt.Fprintf(&b, "%s\r\n", strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	}
+	return b.Bytes()
+}
+
+// messageID returns a random Message-ID local part
+func messageID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
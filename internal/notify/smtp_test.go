@@ -0,0 +1,197 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is a minimal SMTP server that records the commands and mail it receives
+type fakeSMTP struct {
+	addr     string
+	commands chan string
+	mails    chan string
+}
+
+// startFakeSMTP serves one SMTP session at a time on a loopback port, offering
+// AUTH PLAIN but not STARTTLS
+func startFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	f := &fakeSMTP{addr: listener.Addr().String(), commands: make(chan string, 100), mails: make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// serve answers one session
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		f.commands <- line
+		verb := strings.ToUpper(strings.Fields(line + " x")[0])
+		switch verb {
+		case "EHLO":
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			reply("235 Authenticated")
+		case "DATA":
+			reply("354 Go ahead")
+			var mail strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil || line == ".\r\n" {
+					break
+				}
+				mail.WriteString(line)
+			}
+			f.mails <- mail.String()
+			reply("250 Queued")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestMailerCheck(t *testing.T) {
+	testCases := []struct {
+		name        string
+		mailer      Mailer
+		expectError string
+	}{
+		{name: "Valid", mailer: Mailer{Server: "smtp.example.com:587", From: "go-pia <pia@example.com>", To: []string{"me@example.com"}}},
+		{name: "Missing port", mailer: Mailer{Server: "smtp.example.com", From: "pia@example.com", To: []string{"me@example.com"}}, expectError: "expected host:port"},
+		{name: "Unknown security", mailer: Mailer{Server: "smtp.example.com:25", Security: "ssl", From: "pia@example.com", To: []string{"me@example.com"}}, expectError: "unknown SMTP security"},
+		{name: "Login without TLS", mailer: Mailer{Server: "smtp.example.com:25", Security: SMTPNone, Username: "pia", From: "pia@example.com", To: []string{"me@example.com"}}, expectError: "can't log in to smtp.example.com without TLS"},
+		{name: "Login without TLS to localhost", mailer: Mailer{Server: "localhost:25", Security: SMTPNone, Username: "pia", From: "pia@example.com", To: []string{"me@example.com"}}},
+		{name: "Relay without TLS", mailer: Mailer{Server: "192.168.1.1:25", Security: SMTPNone, From: "pia@example.com", To: []string{"me@example.com"}}},
+		{name: "Bad sender", mailer: Mailer{Server: "smtp.example.com:587", From: "pia", To: []string{"me@example.com"}}, expectError: "invalid sender address"},
+		{name: "No recipients", mailer: Mailer{Server: "smtp.example.com:587", From: "pia@example.com"}, expectError: "no recipients"},
+		{name: "Bad recipient", mailer: Mailer{Server: "smtp.example.com:587", From: "pia@example.com", To: []string{"me"}}, expectError: "invalid recipient address"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.mailer.Check()
+			if tc.expectError == "" {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.expectError) {
+				t.Errorf("Expected error containing %q, got %v", tc.expectError, err)
+			}
+		})
+	}
+}
+
+func TestMailerSecurity(t *testing.T) {
+	testCases := []struct {
+		server   string
+		security string
+		expected string
+	}{
+		{server: "smtp.example.com:465", expected: SMTPTLS},
+		{server: "smtp.example.com:587", expected: SMTPStartTLS},
+		{server: "relay.lan:25", security: SMTPNone, expected: SMTPNone},
+	}
+	for _, tc := range testCases {
+		m := &Mailer{Server: tc.server, Security: tc.security}
+		if got := m.security(); got != tc.expected {
+			t.Errorf("%s %q: expected %s, got %s", tc.server, tc.security, tc.expected, got)
+		}
+	}
+}
+
+func TestMailerSend(t *testing.T) {
+	server := startFakeSMTP(t)
+	m := &Mailer{
+		Server:   server.addr,
+		Security: SMTPNone,
+		From:     "go-pia <pia@example.com>",
+		To:       []string{"me@example.com", "Other <other@example.com>"},
+		Username: "pia",
+		Password: "secret",
+	}
+
+	messages := []Message{
+		{Title: "PIA port changed", Body: "Forwarded port is now 12345", Time: time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)},
+		{Title: "PIA port forwarding failing", Body: "Binding port 12345 failed 3 times in a row", Urgent: true, Time: time.Date(2024, time.March, 1, 10, 5, 0, 0, time.UTC)},
+	}
+	if err := m.Send(context.Background(), messages); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	close(server.commands)
+	var commands []string
+	for c := range server.commands {
+		commands = append(commands, c)
+	}
+	joined := strings.Join(commands, "\n")
+	for _, want := range []string{"AUTH PLAIN", "MAIL FROM:<pia@example.com>", "RCPT TO:<me@example.com>", "RCPT TO:<other@example.com>"} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("Expected command %q, got:\n%s", want, joined)
+		}
+	}
+
+	mail := <-server.mails
+	for _, want := range []string{
+		"Subject: PIA port forwarding: 2 notifications\r\n",
+		"To: me@example.com, Other <other@example.com>\r\n",
+		"X-Priority: 1\r\n",
+		"2024-03-01 10:00:00 PIA port changed\r\nForwarded port is now 12345\r\n",
+		"2024-03-01 10:05:00 PIA port forwarding failing\r\n",
+	} {
+		if !strings.Contains(mail, want) {
+			t.Errorf("Expected mail to contain %q, got:\n%s", want, mail)
+		}
+	}
+}
+
+func TestMailerStartTLSRequired(t *testing.T) {
+	server := startFakeSMTP(t)
+	m := &Mailer{Server: server.addr, From: "pia@example.com", To: []string{"me@example.com"}}
+	if err := m.Send(context.Background(), []Message{{Title: "t", Body: "b"}}); err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("Expected a missing STARTTLS to be an error, got %v", err)
+	}
+}
+
+func TestComposeSingleMessage(t *testing.T) {
+	m := &Mailer{From: "pia@example.com", To: []string{"me@example.com"}}
+	mail := string(m.compose([]Message{{Title: "PIA port changed", Body: "Forwarded port is now 12345"}}, time.Now()))
+	if !strings.Contains(mail, "Subject: PIA port changed\r\n") || !strings.HasSuffix(mail, "\r\n\r\nForwarded port is now 12345\r\n") {
+		t.Errorf("Expected the message under its own title, got:\n%s", mail)
+	}
+	if strings.Contains(mail, "X-Priority") {
+		t.Errorf("Expected normal priority, got:\n%s", mail)
+	}
+}
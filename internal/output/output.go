@@ -0,0 +1,283 @@
+// Package output publishes the forwarded port to every place that needs it,
+// such as the output file, dynamic DNS or D-Bus, so that one failing target
+// neither holds up nor hides the others
+package output
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/events"
+)
+
+// Output publishes the forwarded port somewhere
+type Output interface {
+	// Name identifies the output in logs, metrics and the status command
+	Name() string
+	// Write publishes the port the event is about
+	Write(ctx context.Context, e events.Event) error
+}
+
+// funcOutput is an Output backed by a function
+type funcOutput struct {
+	name  string
+	write func(ctx context.Context, e events.Event) error
+}
+
+// Func returns an Output called name that publishes the port with write
+func Func(name string, write func(ctx context.Context, e events.Event) error) Output {
+	return funcOutput{name: name, write: write}
+}
+
+func (o funcOutput) Name() string {
+	return o.name
+}
+
+func (o funcOutput) Write(ctx context.Context, e events.Event) error {
+	return o.write(ctx, e)
+}
+
+// RetryPolicy says how a failed write is retried
+type RetryPolicy struct {
+	// Retries after the first failed attempt, 0 to give up right away
+	Retries int
+	// Wait before the first retry, doubled before each one after it
+	Delay time.Duration
+}
+
+// DefaultRetryPolicy is used for outputs without a policy of their own
+var DefaultRetryPolicy = RetryPolicy{Retries: 3, Delay: 5 * time.Second}
+
+// String returns the policy as ParseRetryPolicies reads it
+func (p RetryPolicy) String() string {
+	return fmt.Sprintf("%d/%s", p.Retries, p.Delay)
+}
+
+// ParseRetryPolicies parses a comma-separated list of NAME=RETRIES[/DELAY]
+// policies by output name, e.g. "ddns=5/1m,ubus=0". Without a delay, the
+// default one is used.
+func ParseRetryPolicies(spec string) (map[string]RetryPolicy, error) {
+	policies := make(map[string]RetryPolicy)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid retry policy %q, expected NAME=RETRIES[/DELAY]", pair)
+		}
+		retries, delay, hasDelay := strings.Cut(strings.TrimSpace(value), "/")
+		policy := RetryPolicy{Delay: DefaultRetryPolicy.Delay}
+		var err error
+		if policy.Retries, err = strconv.Atoi(retries); err != nil || policy.Retries < 0 {
+			return nil, fmt.Errorf("invalid retry policy %q, retries must be a number of at least 0", pair)
+		}
+		if hasDelay {
+			if policy.Delay, err = time.ParseDuration(delay); err != nil || policy.Delay <= 0 {
+				return nil, fmt.Errorf("invalid retry policy %q, delay must be a positive duration such as 10s", pair)
+			}
+		}
+		policies[name] = policy
+	}
+	return policies, nil
+}
+
+// Result reports one attempt to write the port to an output
+type Result struct {
+	Output string
+	Port   int
+	// Attempt number, 1 for the first write of a port
+	Attempt  int
+	Duration time.Duration
+	// Error the attempt failed with, nil on success
+	Err error
+	// Failed attempts since the output's last success
+	ConsecutiveFailures int
+}
+
+// firstAttemptWait bounds how long Dispatch waits for an output's first
+// attempt, replaceable for tests. An output that takes longer carries on in
+// the background.
+var firstAttemptWait = 30 * time.Second
+
+// Dispatcher writes each port to all its outputs at once. Each output gets its
+// own goroutine and retries, so a slow or failing one doesn't hold up the
+// others.
+type Dispatcher struct {
+	report  func(Result)
+	mu      sync.Mutex
+	targets []*target
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// target is an output with its retry policy and the state of its writes
+type target struct {
+	out    Output
+	policy RetryPolicy
+
+	// Serializes writes, so an output never writes two ports at once
+	writing sync.Mutex
+
+	mu sync.Mutex
+	// Cancels the retries of the previous port
+	cancel              context.CancelFunc
+	consecutiveFailures int
+}
+
+// NewDispatcher returns a dispatcher without outputs that passes the result
+// of every write attempt to report, which may be nil
+func NewDispatcher(report func(Result)) *Dispatcher {
+	return &Dispatcher{report: report}
+}
+
+// Add adds an output, retried according to policy
+func (d *Dispatcher) Add(out Output, policy RetryPolicy) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.targets = append(d.targets, &target{out: out, policy: policy})
+}
+
+// Len returns the number of outputs
+func (d *Dispatcher) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.targets)
+}
+
+// Dispatch writes the port from e to every output at once, and returns once
+// each has made its first attempt or firstAttemptWait has passed, so the
+// outputs are usually current by the time it returns. Failed outputs are
+// retried in the background until they succeed, run out of retries, or a
+// newer port is dispatched.
+func (d *Dispatcher) Dispatch(e events.Event) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	targets := append([]*target(nil), d.targets...)
+	d.wg.Add(len(targets))
+	d.mu.Unlock()
+
+	firstAttempts := make([]chan struct{}, len(targets))
+	for i, t := range targets {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.mu.Lock()
+		if t.cancel != nil {
+			t.cancel()
+		}
+		t.cancel = cancel
+		t.mu.Unlock()
+
+		firstAttempts[i] = make(chan struct{})
+		go func() {
+			defer d.wg.Done()
+			defer cancel()
+			d.write(ctx, t, e, firstAttempts[i])
+		}()
+	}
+
+	timeout := time.NewTimer(firstAttemptWait)
+	defer timeout.Stop()
+	expired := false
+	for i, done := range firstAttempts {
+		if !expired {
+			select {
+			case <-done:
+				continue
+			case <-timeout.C:
+				expired = true
+			}
+		}
+		select {
+		case <-done:
+		default:
+			log.Printf("Warning: writing port %d to %s is taking longer than %s, continuing in the background", e.Port, targets[i].out.Name(), firstAttemptWait)
+		}
+	}
+}
+
+// write writes e to t, retrying according to its policy until ctx is
+// cancelled. firstAttempt is closed once the first attempt is over.
+func (d *Dispatcher) write(ctx context.Context, t *target, e events.Event, firstAttempt chan struct{}) {
+	defer func() {
+		select {
+		case <-firstAttempt:
+		default:
+			close(firstAttempt)
+		}
+	}()
+
+	t.writing.Lock()
+	defer t.writing.Unlock()
+
+	delay := t.policy.Delay
+	for attempt := 1; ; attempt++ {
+		// A newer port replaced this one while waiting
+		if ctx.Err() != nil {
+			return
+		}
+		started := time.Now()
+		err := t.out.Write(ctx, e)
+		result := Result{Output: t.out.Name(), Port: e.Port, Attempt: attempt, Duration: time.Since(started), Err: err}
+
+		t.mu.Lock()
+		if err != nil {
+			t.consecutiveFailures++
+		} else {
+			t.consecutiveFailures = 0
+		}
+		result.ConsecutiveFailures = t.consecutiveFailures
+		t.mu.Unlock()
+
+		if d.report != nil {
+			d.report(result)
+		}
+		if attempt == 1 {
+			close(firstAttempt)
+		}
+		if err == nil {
+			return
+		}
+		if attempt > t.policy.Retries {
+			log.Printf("Failed to write port %d to %s: %v", e.Port, t.out.Name(), err)
+			return
+		}
+		log.Printf("Failed to write port %d to %s, retrying in %s: %v", e.Port, t.out.Name(), delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		delay *= 2
+	}
+}
+
+// Close cancels pending retries and waits for writes in progress to finish.
+// Ports dispatched after Close are dropped.
+func (d *Dispatcher) Close() {
+	d.mu.Lock()
+	d.closed = true
+	targets := append([]*target(nil), d.targets...)
+	d.mu.Unlock()
+
+	for _, t := range targets {
+		t.mu.Lock()
+		if t.cancel != nil {
+			t.cancel()
+		}
+		t.mu.Unlock()
+	}
+	d.wg.Wait()
+}
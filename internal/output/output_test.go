@@ -0,0 +1,187 @@
+package output
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/events"
+)
+
+func TestParseRetryPolicies(t *testing.T) {
+	testCases := []struct {
+		spec        string
+		expected    map[string]RetryPolicy
+		expectError bool
+	}{
+		{spec: "", expected: map[string]RetryPolicy{}},
+		{spec: "ddns=5/1m", expected: map[string]RetryPolicy{"ddns": {Retries: 5, Delay: time.Minute}}},
+		{spec: "file=0, ubus = 2,", expected: map[string]RetryPolicy{"file": {Retries: 0, Delay: DefaultRetryPolicy.Delay}, "ubus": {Retries: 2, Delay: DefaultRetryPolicy.Delay}}},
+		{spec: "ddns", expectError: true},
+		{spec: "=3", expectError: true},
+		{spec: "ddns=-1", expectError: true},
+		{spec: "ddns=3/soon", expectError: true},
+		{spec: "ddns=3/0s", expectError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.spec, func(t *testing.T) {
+			policies, err := ParseRetryPolicies(tc.spec)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(policies, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, policies)
+			}
+		})
+	}
+}
+
+// recorder collects the results a dispatcher reports
+type recorder struct {
+	mu      sync.Mutex
+	results []Result
+}
+
+func (r *recorder) report(result Result) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.results = append(r.results, result)
+}
+
+// waitFor waits until n results have been reported
+func (r *recorder) waitFor(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mu.Lock()
+		got := len(r.results)
+		r.mu.Unlock()
+		if got >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %d results, got %d", n, got)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// failing returns an output that fails its first failures writes
+func failing(name string, failures int) Output {
+	var mu sync.Mutex
+	return Func(name, func(context.Context, events.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if failures > 0 {
+			failures--
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+}
+
+func TestDispatchIsolatesFailures(t *testing.T) {
+	rec := &recorder{}
+	d := NewDispatcher(rec.report)
+	var written []int
+	d.Add(Func("file", func(_ context.Context, e events.Event) error {
+		written = append(written, e.Port)
+		return nil
+	}), DefaultRetryPolicy)
+	d.Add(failing("ddns", 2), RetryPolicy{Retries: 2, Delay: time.Millisecond})
+	d.Add(failing("ubus", 5), RetryPolicy{Retries: 1, Delay: time.Millisecond})
+
+	d.Dispatch(events.Event{Type: events.PortBound, Port: 12345})
+
+	// The working output is written before Dispatch returns, whatever the others do
+	if !reflect.DeepEqual(written, []int{12345}) {
+		t.Errorf("Expected the file to be written, got %v", written)
+	}
+
+	// One file write, three ddns attempts and two ubus attempts
+	rec.waitFor(t, 6)
+	d.Close()
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	attempts := map[string]int{}
+	last := map[string]Result{}
+	for _, result := range rec.results {
+		attempts[result.Output]++
+		last[result.Output] = result
+	}
+	if attempts["file"] != 1 || last["file"].Err != nil {
+		t.Errorf("Expected one successful file write, got %d attempts, last %v", attempts["file"], last["file"].Err)
+	}
+	if attempts["ddns"] != 3 || last["ddns"].Err != nil || last["ddns"].ConsecutiveFailures != 0 {
+		t.Errorf("Expected ddns to succeed on its third attempt, got %d attempts, last %+v", attempts["ddns"], last["ddns"])
+	}
+	if attempts["ubus"] != 2 || last["ubus"].Err == nil || last["ubus"].ConsecutiveFailures != 2 {
+		t.Errorf("Expected ubus to give up after one retry, got %d attempts, last %+v", attempts["ubus"], last["ubus"])
+	}
+}
+
+func TestDispatchDoesNotWaitForSlowOutputs(t *testing.T) {
+	defer func(wait time.Duration) { firstAttemptWait = wait }(firstAttemptWait)
+	firstAttemptWait = 10 * time.Millisecond
+
+	release := make(chan struct{})
+	d := NewDispatcher(nil)
+	d.Add(Func("slow", func(context.Context, events.Event) error {
+		<-release
+		return nil
+	}), DefaultRetryPolicy)
+	fast := false
+	d.Add(Func("fast", func(context.Context, events.Event) error {
+		fast = true
+		return nil
+	}), DefaultRetryPolicy)
+
+	done := make(chan struct{})
+	go func() {
+		d.Dispatch(events.Event{Type: events.PortBound, Port: 12345})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Dispatch waited for the slow output")
+	}
+	if !fast {
+		t.Errorf("Expected the fast output to be written")
+	}
+	close(release)
+	d.Close()
+}
+
+func TestDispatchNewerPortStopsRetries(t *testing.T) {
+	rec := &recorder{}
+	d := NewDispatcher(rec.report)
+	d.Add(Func("ddns", func(_ context.Context, e events.Event) error {
+		if e.Port == 12345 {
+			return errors.New("unavailable")
+		}
+		return nil
+	}), RetryPolicy{Retries: 5, Delay: time.Hour})
+
+	d.Dispatch(events.Event{Type: events.PortBound, Port: 12345})
+	d.Dispatch(events.Event{Type: events.PortBound, Port: 54321})
+	d.Close()
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.results) != 2 || rec.results[0].Port != 12345 || rec.results[1].Port != 54321 || rec.results[1].Err != nil {
+		t.Errorf("Expected the failed port to be replaced by the new one, got %+v", rec.results)
+	}
+}
@@ -0,0 +1,65 @@
+package piaca
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPinnedHashMatchesEmbedded(t *testing.T) {
+	if !pinned(certificate) {
+		t.Errorf("Expected the pinned SHA-256 to be the built-in certificate's")
+	}
+}
+
+func TestFetch(t *testing.T) {
+	body := certificate
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), FileName)
+	downloaded, err := Fetch(context.Background(), server.Client(), server.URL, path)
+	if err != nil || !downloaded {
+		t.Fatalf("Expected the certificate to be downloaded, got %v (downloaded: %v)", err, downloaded)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != string(certificate) {
+		t.Fatalf("Expected the certificate to be saved, got %v", err)
+	}
+
+	// A saved certificate is used as is
+	if downloaded, err := Fetch(context.Background(), server.Client(), server.URL, path); err != nil || downloaded {
+		t.Errorf("Expected the saved certificate to be reused, got %v (downloaded: %v)", err, downloaded)
+	}
+	if requests != 1 {
+		t.Errorf("Expected 1 download, got %d", requests)
+	}
+}
+
+func TestFetchRejectsUnpinnedCertificate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("-----BEGIN CERTIFICATE-----\nnot PIA's\n-----END CERTIFICATE-----\n"))
+	}))
+	defer server.Close()
+
+	// A tampered copy on disk is replaced only by the pinned certificate
+	path := filepath.Join(t.TempDir(), FileName)
+	if err := os.WriteFile(path, []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Fetch(context.Background(), server.Client(), server.URL, path)
+	if err == nil || !strings.Contains(err.Error(), SHA256) {
+		t.Errorf("Expected a certificate with another hash to be rejected, got %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "tampered" {
+		t.Errorf("Expected the rejected certificate not to be saved, got %q", data)
+	}
+}
@@ -0,0 +1,22 @@
+// Package piaca holds a copy of the PIA CA certificate built into the binary,
+// for installs where there's no certificate file to read
+package piaca
+
+import (
+	_ "embed"
+	"os"
+)
+
+// Embedded is the CA certificate path that selects the built-in copy
+const Embedded = "embedded"
+
+//go:embed ca.rsa.4096.crt
+var certificate []byte
+
+// Read returns the PEM certificates in path, or the built-in ones if path is Embedded
+func Read(path string) ([]byte, error) {
+	if path == Embedded {
+		return certificate, nil
+	}
+	return os.ReadFile(path)
+}
@@ -0,0 +1,31 @@
+package piaca
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+)
+
+func TestEmbedded(t *testing.T) {
+	data, err := Read(Embedded)
+	if err != nil {
+		t.Fatalf("Failed to read the embedded certificate: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatal("Embedded certificate is not PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("Failed to parse the embedded certificate: %v", err)
+	}
+	if !cert.IsCA {
+		t.Errorf("Expected a CA certificate, got %s", cert.Subject)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	if _, err := Read("does-not-exist.crt"); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
@@ -0,0 +1,90 @@
+package portforwarding
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/atomicfile"
+)
+
+// Files written for tooling built around PIA's manual-connections scripts
+const (
+	// ManualConnectionsJSON holds the getSignature response
+	ManualConnectionsJSON = "port_forward.json"
+	// ManualConnectionsEnv can be sourced by shell scripts
+	ManualConnectionsEnv = "port_forward.env"
+)
+
+// manualConnectionsJSON is the getSignature response port_forwarding.sh keeps in
+// payload_and_signature, with the decoded payload and gateway added alongside
+type manualConnectionsJSON struct {
+	Status    string `json:"status"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+	Port      int    `json:"port"`
+	ExpiresAt string `json:"expires_at"`
+	Gateway   string `json:"gateway"`
+	Hostname  string `json:"hostname"`
+}
+
+// WriteManualConnectionsFiles writes port_forward.json and port_forward.env to
+// dir, using the field and variable names of PIA's manual-connections
+// port_forwarding.sh so scripts written for it keep working. The files contain
+// the signature and are only readable by the owner.
+func WriteManualConnectionsFiles(dir string, info *PortForwardingInfo, gateway, hostname string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	expiresAt := info.ExpiresAt.UTC().Format(time.RFC3339Nano)
+
+	// The response as returned by the gateway
+	payloadAndSignature, err := json.Marshal(struct {
+		Status    string `json:"status"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}{"OK", info.Payload, info.Signature})
+	if err != nil {
+		return fmt.Errorf("failed to encode signature: %w", err)
+	}
+
+	data, err := json.MarshalIndent(manualConnectionsJSON{
+		Status:    "OK",
+		Payload:   info.Payload,
+		Signature: info.Signature,
+		Port:      info.Port,
+		ExpiresAt: expiresAt,
+		Gateway:   gateway,
+		Hostname:  hostname,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", ManualConnectionsJSON, err)
+	}
+	if err := atomicfile.WriteFile(filepath.Join(dir, ManualConnectionsJSON), append(data, '\n'), 0600); err != nil {
+		return err
+	}
+
+	var env strings.Builder
+	for _, v := range []struct{ name, value string }{
+		{"PF_GATEWAY", gateway},
+		{"PF_HOSTNAME", hostname},
+		{"PAYLOAD_AND_SIGNATURE", string(payloadAndSignature)},
+		{"payload", info.Payload},
+		{"signature", info.Signature},
+		{"port", strconv.Itoa(info.Port)},
+		{"expires_at", expiresAt},
+	} {
+		fmt.Fprintf(&env, "%s=%s\n", v.name, shellQuote(v.value))
+	}
+	return atomicfile.WriteFile(filepath.Join(dir, ManualConnectionsEnv), []byte(env.String()), 0600)
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
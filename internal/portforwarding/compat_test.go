@@ -0,0 +1,77 @@
+package portforwarding
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteManualConnectionsFiles(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "pia")
+	info := &PortForwardingInfo{
+		Port:      47047,
+		ExpiresAt: time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC),
+		Payload:   "eyJwb3J0Ijo0NzA0N30=",
+		Signature: "it's-a-signature",
+	}
+
+	if err := WriteManualConnectionsFiles(dir, info, "10.8.110.1", "frankfurt404"); err != nil {
+		t.Fatalf("Failed to write files: %v", err)
+	}
+
+	// port_forward.json has the getSignature fields plus the decoded port
+	data, err := os.ReadFile(filepath.Join(dir, ManualConnectionsJSON))
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", ManualConnectionsJSON, err)
+	}
+	var decoded map[string]any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to parse %s: %v", ManualConnectionsJSON, err)
+	}
+	expected := map[string]any{
+		"status":     "OK",
+		"payload":    "eyJwb3J0Ijo0NzA0N30=",
+		"signature":  "it's-a-signature",
+		"port":       float64(47047),
+		"expires_at": "2024-05-01T12:00:00Z",
+		"gateway":    "10.8.110.1",
+		"hostname":   "frankfurt404",
+	}
+	for key, value := range expected {
+		if decoded[key] != value {
+			t.Errorf("Expected %s=%v, got %v", key, value, decoded[key])
+		}
+	}
+
+	if runtime.GOOS != "windows" {
+		if info, err := os.Stat(filepath.Join(dir, ManualConnectionsEnv)); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("Expected %s to be readable by the owner only, got %v (%v)", ManualConnectionsEnv, info.Mode(), err)
+		}
+	}
+
+	// port_forward.env can be sourced by a shell
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("No shell to source the environment file with")
+	}
+	out, err := exec.Command(sh, "-c", `. "$1" && printf '%s|%s|%s|%s|%s' "$PF_GATEWAY" "$PF_HOSTNAME" "$port" "$signature" "$PAYLOAD_AND_SIGNATURE"`, "sh", filepath.Join(dir, ManualConnectionsEnv)).Output()
+	if err != nil {
+		t.Fatalf("Failed to source %s: %v", ManualConnectionsEnv, err)
+	}
+	fields := strings.Split(string(out), "|")
+	if len(fields) != 5 {
+		t.Fatalf("Unexpected output: %q", out)
+	}
+	if fields[0] != "10.8.110.1" || fields[1] != "frankfurt404" || fields[2] != "47047" || fields[3] != "it's-a-signature" {
+		t.Errorf("Unexpected variables: %q", out)
+	}
+	var payloadAndSignature PayloadAndSignature
+	if err := json.Unmarshal([]byte(fields[4]), &payloadAndSignature); err != nil || payloadAndSignature.Signature != "it's-a-signature" {
+		t.Errorf("Expected PAYLOAD_AND_SIGNATURE to hold the response JSON, got %q (%v)", fields[4], err)
+	}
+}
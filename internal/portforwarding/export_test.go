@@ -0,0 +1,6 @@
+package portforwarding
+
+// PendingRenewals returns how many renewal requests wait for the loop
+func PendingRenewals(m *Manager) int {
+	return len(m.renewRequests)
+}
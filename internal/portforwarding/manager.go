@@ -0,0 +1,662 @@
+package portforwarding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/clock"
+	"github.com/meschansky/go-pia/internal/events"
+)
+
+// SignatureRenewBefore is how long before expiry a new signature is requested
+// by default
+const SignatureRenewBefore = 24 * time.Hour
+
+// minRetryDelay is the wait after the first failed bind; it doubles with each
+// further failure until it reaches the refresh interval
+const minRetryDelay = 5 * time.Second
+
+// PortReleasedAfter is how long PIA keeps a port that isn't bound. After a
+// longer gap, e.g. while the machine was suspended, binding the old signature
+// may succeed without the port being forwarded.
+const PortReleasedAfter = 15 * time.Minute
+
+// releaseGrace allows for timers firing late before a gap counts as releasing
+// the port, so a bind every PortReleasedAfter doesn't count as a release when
+// the timer fires a little late
+const releaseGrace = time.Minute
+
+// keepPortRetryDelay is the wait between signature requests made to keep the port
+const keepPortRetryDelay = 10 * time.Second
+
+// RenewsAt returns when a signature expiring at expiresAt is replaced with the
+// default policy, which usually changes the port
+func RenewsAt(expiresAt time.Time) time.Time {
+	return expiresAt.Add(-SignatureRenewBefore)
+}
+
+// RenewPolicy decides how long before a signature expires a new one is
+// requested. The zero value renews SignatureRenewBefore ahead.
+type RenewPolicy struct {
+	// Renew this long before expiry; 0 means SignatureRenewBefore, unless
+	// Remaining is set
+	Before time.Duration
+	// Renew once only this fraction of the validity the signature had when it
+	// was obtained is left, e.g. 0.5 halfway through; 0 disables it. With
+	// Before set too, the earlier of the two applies.
+	Remaining float64
+}
+
+// RenewsAt returns when a signature obtained at obtainedAt and expiring at
+// expiresAt is replaced. When obtainedAt isn't known, e.g. for a signature
+// bound by a previous process, Remaining can't be applied and Before is used,
+// or SignatureRenewBefore if it isn't set.
+func (p RenewPolicy) RenewsAt(obtainedAt, expiresAt time.Time) time.Time {
+	before := p.Before
+	if before == 0 && (p.Remaining == 0 || obtainedAt.IsZero()) {
+		before = SignatureRenewBefore
+	}
+	if p.Remaining > 0 && !obtainedAt.IsZero() {
+		remaining := time.Duration(float64(expiresAt.Sub(obtainedAt)) * p.Remaining)
+		before = max(before, remaining)
+	}
+	return expiresAt.Add(-before)
+}
+
+// PortForwarder obtains port forwarding signatures and binds the port; Client
+// implements it against the PIA gateway, pftest.Forwarder fakes it for tests
+type PortForwarder interface {
+	GetPortForwarding() (*PortForwardingInfo, error)
+	BindPort(payload, signature string) error
+}
+
+// EventSink receives what the manager does; events.Bus implements it
+type EventSink interface {
+	Publish(events.Event)
+}
+
+// PortStatus is a snapshot of the port a manager keeps bound
+type PortStatus struct {
+	// Port last bound successfully and when its signature expires; 0 until
+	// the first bind
+	Port      int
+	ExpiresAt time.Time
+	// When a new signature is requested, which usually changes the port
+	RenewsAt time.Time
+	// Signature bound, with the payload it signs, and when it was obtained
+	// (zero if it isn't known)
+	Payload    string
+	Signature  string
+	ObtainedAt time.Time
+	// When the port was last bound successfully
+	BoundAt time.Time
+	// Binds that failed since the last successful one
+	ConsecutiveFailures int
+	// Gateway IP and hostname the port is forwarded through
+	Gateway  string
+	Hostname string
+}
+
+// Manager keeps a forwarded port alive: it binds the port every refresh
+// interval, renews the signature before it expires and reports everything as
+// events. It has no side effects of its own beyond calling the forwarder.
+type Manager struct {
+	// Obtains signatures and binds the port
+	Forwarder PortForwarder
+	// Receives events about the port
+	Events EventSink
+	// Time source, the system clock by default
+	Clock clock.Clock
+	// How often the port is bound
+	RefreshInterval time.Duration
+	// Maximum random jitter subtracted from each refresh interval
+	RefreshJitter time.Duration
+	// Keepalive binds are skipped if the same signature was bound more recently
+	// than this. Requested rebinds are never skipped.
+	MinBindInterval time.Duration
+	// Makes sure the forwarder has a current token before a signature is
+	// requested. invalidate is true after the gateway rejected the token, so a
+	// new one must be obtained. Optional.
+	RefreshToken func(invalidate bool) error
+	// Checks whether the gateway still accepts connections, before binding
+	// again after a failure. Optional.
+	ProbeGateway func() error
+	// Detects the VPN connection again after the gateway stopped accepting
+	// connections and points the forwarder at its gateway. Optional.
+	Reconnect func() (gateway, hostname string, err error)
+	// Signatures requested again, at most this many times, when a renewal has
+	// a different port than the one it replaces. 0 takes the first port given.
+	KeepPortAttempts int
+	// When new signatures are requested; the zero value renews
+	// SignatureRenewBefore ahead of expiry
+	RenewPolicy RenewPolicy
+	// Inclusive range the port should be in, e.g. the ports a firewall lets
+	// through. 0 for both takes any port.
+	PortRangeMin int
+	PortRangeMax int
+	// Signatures requested again, at most this many times, when a new one has
+	// a port outside the range. 0 takes the first port given. A first port
+	// outside the range is bound before they're requested, so startup doesn't
+	// wait for them.
+	PortRangeAttempts int
+	// Signature already bound by a previous process, such as the version that
+	// handed over on upgrade. It's bound again right away instead of requesting
+	// a new one, and its port isn't reported as changed. Optional.
+	Resume *PortForwardingInfo
+	// Gateway IP and hostname included in events
+	Gateway  string
+	Hostname string
+	// Returns a random number in [0, n), replaceable for tests
+	randInt64N func(n int64) int64
+	// Wake the loop for a requested renewal or rebind
+	renewRequests  chan struct{}
+	rebindRequests chan struct{}
+
+	mu     sync.Mutex
+	status PortStatus
+	// Set while a signature is being requested; Renew requests made meanwhile
+	// are met by it
+	renewing bool
+	// Channels passed each new status by Subscribe
+	watchers map[chan PortStatus]struct{}
+}
+
+// NewManager creates a manager with the system clock and the given refresh interval
+func NewManager(forwarder PortForwarder, sink EventSink, refreshInterval time.Duration) *Manager {
+	return &Manager{
+		Forwarder:       forwarder,
+		Events:          sink,
+		Clock:           clock.Real,
+		RefreshInterval: refreshInterval,
+		randInt64N:      rand.Int64N,
+		renewRequests:   make(chan struct{}, 1),
+		rebindRequests:  make(chan struct{}, 1),
+	}
+}
+
+// Renew asks the running loop to obtain a new signature and bind it right away.
+// Requests made while one is pending are merged into it, and those made while
+// a signature is being requested, for whatever reason, are met by that one, so
+// triggers arriving together never request signatures in parallel or in a row.
+func (m *Manager) Renew() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.renewing {
+		log.Printf("Signature renewal requested while one is in progress, using its signature")
+		return
+	}
+	select {
+	case m.renewRequests <- struct{}{}:
+	default:
+	}
+}
+
+// Rebind asks the running loop to bind the current signature again right away,
+// e.g. after the connection tracking table was flushed. Requests made while one
+// is pending are merged into it, and into any bind the loop starts before
+// getting to it. One made while a bind is in progress is carried out after it,
+// since the bind may have reached the gateway before whatever prompted it.
+func (m *Manager) Rebind() {
+	select {
+	case m.rebindRequests <- struct{}{}:
+	default:
+	}
+}
+
+// Current returns the status of the port. It's safe to call from any
+// goroutine, while the loop runs and after it returned.
+func (m *Manager) Current() PortStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// Subscribe returns a channel passed the current status, then each change.
+// A reader that falls behind gets only the latest status, never a stale one.
+// The returned function closes the channel.
+func (m *Manager) Subscribe() (<-chan PortStatus, func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ch := make(chan PortStatus, 1)
+	ch <- m.status
+	if m.watchers == nil {
+		m.watchers = make(map[chan PortStatus]struct{})
+	}
+	m.watchers[ch] = struct{}{}
+	return ch, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if _, ok := m.watchers[ch]; ok {
+			delete(m.watchers, ch)
+			close(ch)
+		}
+	}
+}
+
+// setStatus changes the status and passes it on to subscribers
+func (m *Manager) setStatus(update func(*PortStatus)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	update(&m.status)
+	for ch := range m.watchers {
+		// Replace a status the reader hasn't taken yet; only this sends, so
+		// there's room afterwards
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- m.status
+	}
+}
+
+// Run obtains a port and keeps it bound until ctx is canceled. It only returns
+// an error if no signature could be obtained at all; later failures are
+// published as events and retried.
+func (m *Manager) Run(ctx context.Context) error {
+	// The last port bound successfully, 0 until the first bind
+	boundPort := 0
+	// Set when the first port is outside the range. It's bound anyway, so a
+	// port is forwarded while one in the range is looked for.
+	seekRange := false
+	m.setStatus(func(s *PortStatus) { s.Gateway, s.Hostname = m.Gateway, m.Hostname })
+
+	info := m.Resume
+	if info != nil {
+		log.Printf("Resuming port forwarding: port=%d, expires=%s", info.Port, info.ExpiresAt)
+		boundPort = info.Port
+	} else {
+		var err error
+		m.setRenewing(true)
+		info, err = m.getPortForwarding()
+		if err != nil {
+			m.setRenewing(false)
+			m.publish(events.Event{Type: events.SignatureFailed, Error: err.Error()})
+			return fmt.Errorf("failed to get initial port forwarding info: %w", err)
+		}
+		m.setRenewing(false)
+		log.Printf("Obtained port forwarding: port=%d, expires=%s", info.Port, info.ExpiresAt)
+		m.publish(events.Event{Type: events.SignatureRenewed, Port: info.Port, ExpiresAt: info.ExpiresAt, RenewsAt: m.renewsAt(info)})
+		seekRange = !m.inPortRange(info.Port)
+	}
+
+	consecutiveFailures := 0
+	// The signature last bound successfully and when
+	boundSignature := ""
+	var lastBindAt time.Time
+	// When the last successful bind returned, which renewals before it can
+	// put well after the start of its iteration
+	var boundAt time.Time
+	// Set when the wait was cut short by Renew or Rebind
+	forceRenew, forceBind := false, false
+	// Set after a reconnect until a signature from the new gateway is obtained
+	staleSignature := false
+
+	for {
+		iterationStart := m.Clock.Now()
+		// The next keepalive is scheduled from the last bind
+		scheduleFrom := iterationStart
+
+		// After a failed bind, find out whether the gateway is gone before trying again
+		var gatewayErr error
+		if consecutiveFailures > 0 && m.ProbeGateway != nil {
+			reconnected, err := m.checkGateway()
+			gatewayErr = err
+			staleSignature = staleSignature || reconnected
+		}
+
+		// A port left unbound too long was likely released, which the gateway
+		// may not report, so its signature is replaced
+		released := m.portReleased(info.Port, boundAt, iterationStart)
+
+		// Get a new signature if requested, the port was released or the current
+		// one is close to expiring
+		if forceRenew || staleSignature || released {
+			renewed := m.renew(ctx, info)
+			if renewed != info {
+				staleSignature = false
+			}
+			info = renewed
+		} else if iterationStart.After(m.renewsAt(info)) {
+			log.Printf("Port forwarding signature expiring soon, requesting a new one")
+			info = m.renew(ctx, info)
+		}
+
+		// Bind the port, unless the gateway is gone or the same signature was just bound
+		bindErr := gatewayErr
+		recentlyBound := !forceBind && info.Signature == boundSignature && iterationStart.Sub(lastBindAt) < m.MinBindInterval
+		if bindErr == nil && recentlyBound {
+			log.Printf("Skipping bind, port %d was bound %s ago", info.Port, iterationStart.Sub(lastBindAt).Round(time.Second))
+			scheduleFrom = lastBindAt
+		} else if bindErr == nil {
+			if drain(m.rebindRequests) {
+				log.Printf("Rebind requested, merged into this bind")
+			}
+			bindErr = m.Forwarder.BindPort(info.Payload, info.Signature)
+		}
+		if bindErr == nil && !recentlyBound {
+			consecutiveFailures = 0
+			boundSignature = info.Signature
+			lastBindAt = iterationStart
+			boundAt = m.Clock.Now()
+			log.Printf("Successfully bound port %d", info.Port)
+			m.setStatus(func(s *PortStatus) {
+				s.Port, s.ExpiresAt, s.RenewsAt = info.Port, info.ExpiresAt, m.renewsAt(info)
+				s.Payload, s.Signature, s.ObtainedAt = info.Payload, info.Signature, info.ObtainedAt
+				s.BoundAt = iterationStart
+				s.ConsecutiveFailures = 0
+			})
+			m.publish(events.Event{Type: events.PortBound, Port: info.Port, ExpiresAt: info.ExpiresAt, RenewsAt: m.renewsAt(info), Payload: info.Payload, Signature: info.Signature})
+
+			// A change is reported after the bind so the port is usable when handlers run
+			if info.Port != boundPort {
+				m.publish(events.Event{Type: events.PortChanged, Port: info.Port, PreviousPort: boundPort, ExpiresAt: info.ExpiresAt, RenewsAt: m.renewsAt(info)})
+				boundPort = info.Port
+			}
+		}
+		if bindErr != nil && ctx.Err() != nil {
+			// A bind cut short by shutdown isn't a failure
+			return nil
+		}
+		if bindErr != nil {
+			consecutiveFailures++
+			log.Printf("Failed to bind port: %v", bindErr)
+			m.setStatus(func(s *PortStatus) { s.ConsecutiveFailures = consecutiveFailures })
+			m.publish(events.Event{Type: events.BindFailed, Port: info.Port, Error: bindErr.Error(), ConsecutiveFailures: consecutiveFailures})
+		}
+
+		// Wait for the next refresh, sooner after a failure, or a request to act now
+		delay := m.nextRefreshDelay(scheduleFrom, m.renewsAt(info))
+		if consecutiveFailures > 0 {
+			delay = min(delay, retryDelay(consecutiveFailures))
+		}
+		forceRenew, forceBind = false, false
+
+		// Once the first port is bound, look for one in the range as a renewal
+		// would, and bind it right away
+		if seekRange && bindErr == nil {
+			seekRange = false
+			if fitted := m.refitPortRange(ctx, info); fitted != info {
+				info = fitted
+				continue
+			}
+		}
+
+		select {
+		case <-m.Clock.After(delay):
+		case <-m.renewRequests:
+			log.Printf("Signature renewal requested")
+			forceRenew = true
+		case <-m.rebindRequests:
+			log.Printf("Rebind requested")
+			forceBind = true
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// checkGateway probes the gateway after failed binds. A gateway that accepts
+// connections is only failing its API calls, so the bind is retried. One that
+// doesn't means the VPN went down or reconnected, so the connection is detected
+// again; reconnected reports that it was, and a new signature is needed.
+func (m *Manager) checkGateway() (reconnected bool, err error) {
+	probeErr := m.ProbeGateway()
+	if probeErr == nil {
+		log.Printf("Gateway %s is reachable, retrying the bind", m.Gateway)
+		return false, nil
+	}
+	if m.Reconnect == nil {
+		return false, fmt.Errorf("gateway unreachable: %w", probeErr)
+	}
+
+	log.Printf("Gateway %s is unreachable (%v), detecting the VPN connection again", m.Gateway, probeErr)
+	gateway, hostname, err := m.Reconnect()
+	if err != nil {
+		return false, fmt.Errorf("gateway unreachable and no VPN connection detected: %w", err)
+	}
+	m.Gateway = gateway
+	m.Hostname = hostname
+	m.setStatus(func(s *PortStatus) { s.Gateway, s.Hostname = gateway, hostname })
+	log.Printf("Detected VPN connection: gateway=%s, hostname=%s", gateway, hostname)
+	m.publish(events.Event{Type: events.VPNReconnected})
+	return true, nil
+}
+
+// portReleased reports whether port went unbound since boundAt for longer
+// than PIA keeps it, publishing PortReleased if so. The gap is measured by the
+// wall clock, which unlike the monotonic one counts time spent suspended.
+func (m *Manager) portReleased(port int, boundAt, now time.Time) bool {
+	if boundAt.IsZero() {
+		return false
+	}
+	gap := now.Round(0).Sub(boundAt.Round(0))
+	if gap <= PortReleasedAfter+releaseGrace {
+		return false
+	}
+	log.Printf("Port %d wasn't bound for %s and was likely released, requesting a new signature", port, gap.Round(time.Second))
+	m.publish(events.Event{Type: events.PortReleased, Port: port, Duration: gap})
+	return true
+}
+
+// retryDelay returns the wait before binding again after the given number of
+// failed binds in a row
+func retryDelay(failures int) time.Duration {
+	return minRetryDelay << min(failures-1, 16)
+}
+
+// renew gets a new signature, keeping the current one if that fails
+func (m *Manager) renew(ctx context.Context, info *PortForwardingInfo) *PortForwardingInfo {
+	m.setRenewing(true)
+	defer m.setRenewing(false)
+
+	// Use a current token; this is where changed credentials take effect
+	if m.RefreshToken != nil {
+		if err := m.RefreshToken(false); err != nil {
+			log.Printf("Failed to get authentication token: %v", err)
+			m.publish(events.Event{Type: events.SignatureFailed, Port: info.Port, Error: err.Error()})
+			return info
+		}
+	}
+
+	newInfo, err := m.getPortForwarding()
+	if err != nil {
+		log.Printf("Failed to get new port forwarding info: %v", err)
+		m.publish(events.Event{Type: events.SignatureFailed, Port: info.Port, Error: err.Error()})
+		return info
+	}
+	newInfo = m.keepPort(ctx, info.Port, newInfo)
+	newInfo = m.fitPortRange(ctx, newInfo)
+
+	log.Printf("Obtained new port forwarding: port=%d, expires=%s", newInfo.Port, newInfo.ExpiresAt)
+	m.publish(events.Event{Type: events.SignatureRenewed, Port: newInfo.Port, PreviousPort: info.Port, ExpiresAt: newInfo.ExpiresAt, RenewsAt: m.renewsAt(newInfo)})
+	return newInfo
+}
+
+// setRenewing marks a renewal as started or finished. Requests pending when
+// one starts are met by it, and those made until it finishes are too.
+func (m *Manager) setRenewing(renewing bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.renewing = renewing
+	if renewing && drain(m.renewRequests) {
+		log.Printf("Signature renewal requested, merged into this renewal")
+	}
+}
+
+// drain takes a pending request off requests, reporting whether there was one
+func drain(requests chan struct{}) bool {
+	select {
+	case <-requests:
+		return true
+	default:
+		return false
+	}
+}
+
+// keepPort requests signatures again, up to KeepPortAttempts times, until one
+// has the wanted port. PIA decides the port, so this is best effort: if none
+// has it, the last signature obtained is used and PortKeepFailed is published.
+// A wanted port outside the port range isn't worth keeping.
+func (m *Manager) keepPort(ctx context.Context, want int, info *PortForwardingInfo) *PortForwardingInfo {
+	if m.KeepPortAttempts <= 0 || want == 0 || info.Port == want || !m.inPortRange(want) {
+		return info
+	}
+
+	info, ok := m.retryPort(ctx, info, m.KeepPortAttempts, func(port int) bool { return port == want }, fmt.Sprintf("instead of %d", want))
+	if ok {
+		log.Printf("Kept port %d", want)
+		return info
+	}
+	if ctx.Err() != nil {
+		return info
+	}
+	log.Printf("Warning: couldn't keep port %d after %d attempts, moving to port %d", want, m.KeepPortAttempts, info.Port)
+	m.publish(events.Event{Type: events.PortKeepFailed, Port: info.Port, PreviousPort: want, ExpiresAt: info.ExpiresAt, RenewsAt: m.renewsAt(info)})
+	return info
+}
+
+// fitPortRange requests signatures again, up to PortRangeAttempts times, until
+// one has a port in the port range. If none does, the last signature obtained
+// is used and PortOutOfRange is published.
+func (m *Manager) fitPortRange(ctx context.Context, info *PortForwardingInfo) *PortForwardingInfo {
+	if m.inPortRange(info.Port) {
+		return info
+	}
+
+	portRange := fmt.Sprintf("%d-%d", m.PortRangeMin, m.PortRangeMax)
+	info, ok := m.retryPort(ctx, info, m.PortRangeAttempts, m.inPortRange, "outside "+portRange)
+	if ok {
+		log.Printf("Got port %d in %s", info.Port, portRange)
+		return info
+	}
+	if ctx.Err() != nil {
+		return info
+	}
+	log.Printf("Warning: no port in %s after %d attempts, using port %d", portRange, m.PortRangeAttempts, info.Port)
+	m.publish(events.Event{Type: events.PortOutOfRange, Port: info.Port, PortRange: portRange, ExpiresAt: info.ExpiresAt, RenewsAt: m.renewsAt(info)})
+	return info
+}
+
+// refitPortRange requests signatures until one has a port in the range, as
+// fitPortRange does, for a signature outside it that's already bound. It
+// returns info if none could be obtained.
+func (m *Manager) refitPortRange(ctx context.Context, info *PortForwardingInfo) *PortForwardingInfo {
+	m.setRenewing(true)
+	defer m.setRenewing(false)
+
+	fitted := m.fitPortRange(ctx, info)
+	if fitted == info {
+		return info
+	}
+	log.Printf("Obtained new port forwarding: port=%d, expires=%s", fitted.Port, fitted.ExpiresAt)
+	m.publish(events.Event{Type: events.SignatureRenewed, Port: fitted.Port, PreviousPort: info.Port, ExpiresAt: fitted.ExpiresAt, RenewsAt: m.renewsAt(fitted)})
+	return fitted
+}
+
+// inPortRange reports whether port is in the port range, or there's no range
+func (m *Manager) inPortRange(port int) bool {
+	return m.PortRangeMax == 0 || (port >= m.PortRangeMin && port <= m.PortRangeMax)
+}
+
+// retryPort requests signatures again, up to attempts times and
+// keepPortRetryDelay apart, until one's port is accepted, publishing
+// SignatureRetried for each. It returns the last signature obtained and
+// whether its port was accepted. why describes a rejected port in the log.
+func (m *Manager) retryPort(ctx context.Context, info *PortForwardingInfo, attempts int, accept func(port int) bool, why string) (*PortForwardingInfo, bool) {
+	for attempt := 1; attempt <= attempts; attempt++ {
+		log.Printf("Got port %d %s, requesting another signature (attempt %d of %d)", info.Port, why, attempt, attempts)
+		select {
+		case <-m.Clock.After(keepPortRetryDelay):
+		case <-ctx.Done():
+			return info, false
+		}
+
+		retry, err := m.getPortForwarding()
+		if err != nil {
+			log.Printf("Failed to get port forwarding info: %v", err)
+			m.publish(events.Event{Type: events.SignatureRetried, Port: info.Port, Attempt: attempt, Error: err.Error()})
+			continue
+		}
+		info = retry
+		m.publish(events.Event{Type: events.SignatureRetried, Port: info.Port, Attempt: attempt})
+		if accept(info.Port) {
+			return info, true
+		}
+	}
+	return info, false
+}
+
+// getPortForwarding requests a signature, re-authenticating and retrying once
+// if the gateway rejects the token. Other errors are returned for the caller to retry later.
+func (m *Manager) getPortForwarding() (*PortForwardingInfo, error) {
+	info, err := m.Forwarder.GetPortForwarding()
+	if errors.Is(err, ErrAuthRejected) && m.RefreshToken != nil {
+		// Discard the cached token and obtain a new one
+		log.Printf("Gateway rejected the authentication token (%v), re-authenticating", err)
+		if err := m.RefreshToken(true); err != nil {
+			return nil, fmt.Errorf("failed to re-authenticate: %w", err)
+		}
+		info, err = m.Forwarder.GetPortForwarding()
+	}
+	if err != nil {
+		return info, err
+	}
+
+	// The renewal policy may measure the validity from when it was obtained
+	obtained := *info
+	obtained.ObtainedAt = m.Clock.Now()
+	return &obtained, nil
+}
+
+// renewsAt returns when the signature in info is replaced
+func (m *Manager) renewsAt(info *PortForwardingInfo) time.Time {
+	return m.RenewPolicy.RenewsAt(info.ObtainedAt, info.ExpiresAt)
+}
+
+// nextRefreshDelay computes how long to wait before the next keepalive, measured
+// from the start of the current iteration so bind latency does not accumulate.
+// A random jitter of up to the configured amount is subtracted from the interval,
+// and the wait is shortened so the signature renewal happens on time.
+func (m *Manager) nextRefreshDelay(iterationStart time.Time, renewAt time.Time) time.Duration {
+	interval := m.RefreshInterval
+	if m.RefreshJitter > 0 {
+		jitter := m.RefreshJitter
+		if jitter >= interval {
+			jitter = interval / 2
+		}
+		interval -= time.Duration(m.randInt64N(int64(jitter) + 1))
+	}
+
+	next := iterationStart.Add(interval)
+
+	// Wake up in time to renew the signature instead of waiting for the next keepalive
+	if renewAt.After(iterationStart) && renewAt.Before(next) {
+		next = renewAt
+	}
+
+	delay := next.Sub(m.Clock.Now())
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
+// publish sends an event with the gateway details filled in
+func (m *Manager) publish(e events.Event) {
+	if m.Events == nil {
+		return
+	}
+	e.Gateway = m.Gateway
+	e.Hostname = m.Hostname
+	if e.Time.IsZero() {
+		e.Time = m.Clock.Now()
+	}
+	m.Events.Publish(e)
+}
@@ -0,0 +1,91 @@
+package portforwarding
+
+import (
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/clock"
+)
+
+func TestRetryDelay(t *testing.T) {
+	for failures, expected := range map[int]time.Duration{1: 5 * time.Second, 2: 10 * time.Second, 4: 40 * time.Second} {
+		if delay := retryDelay(failures); delay != expected {
+			t.Errorf("Expected %s after %d failures, got %s", expected, failures, delay)
+		}
+	}
+}
+
+// TestNextRefreshDelay tests the keepalive scheduling with jitter and renewal alignment
+func TestNextRefreshDelay(t *testing.T) {
+	testCases := []struct {
+		name      string
+		interval  time.Duration
+		jitter    time.Duration
+		expiresIn time.Duration
+		elapsed   time.Duration
+		expected  time.Duration
+	}{
+		{
+			name:      "No jitter, far expiry",
+			interval:  15 * time.Minute,
+			expiresIn: 60 * 24 * time.Hour,
+			expected:  15 * time.Minute,
+		},
+		{
+			name:      "Jitter shortens the interval",
+			interval:  15 * time.Minute,
+			jitter:    5 * time.Minute,
+			expiresIn: 60 * 24 * time.Hour,
+			expected:  10 * time.Minute,
+		},
+		{
+			name:      "Jitter larger than interval is capped",
+			interval:  10 * time.Minute,
+			jitter:    time.Hour,
+			expiresIn: 60 * 24 * time.Hour,
+			expected:  5 * time.Minute,
+		},
+		{
+			name:      "Renewal due before next keepalive",
+			interval:  6 * time.Hour,
+			expiresIn: 24*time.Hour + 30*time.Minute,
+			expected:  30 * time.Minute,
+		},
+		{
+			name:      "Renewal already due",
+			interval:  15 * time.Minute,
+			expiresIn: time.Hour,
+			expected:  15 * time.Minute,
+		},
+		{
+			name:      "Time spent binding is subtracted",
+			interval:  15 * time.Minute,
+			expiresIn: 60 * 24 * time.Hour,
+			elapsed:   time.Minute,
+			expected:  14 * time.Minute,
+		},
+		{
+			name:      "Overdue keepalive runs immediately",
+			interval:  15 * time.Minute,
+			expiresIn: 60 * 24 * time.Hour,
+			elapsed:   20 * time.Minute,
+			expected:  0,
+		},
+	}
+
+	start := time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewManager(nil, nil, tc.interval)
+			m.RefreshJitter = tc.jitter
+			m.Clock = clock.NewFake(start.Add(tc.elapsed))
+			// Always pick the largest jitter
+			m.randInt64N = func(n int64) int64 { return n - 1 }
+
+			delay := m.nextRefreshDelay(start, RenewsAt(start.Add(tc.expiresIn)))
+			if delay != tc.expected {
+				t.Errorf("Expected delay %s, got %s", tc.expected, delay)
+			}
+		})
+	}
+}
@@ -0,0 +1,867 @@
+package portforwarding_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/clock"
+	"github.com/meschansky/go-pia/internal/events"
+	"github.com/meschansky/go-pia/internal/portforwarding"
+	"github.com/meschansky/go-pia/internal/portforwarding/pftest"
+)
+
+// newForwarder returns a fake forwarder handing out the signature results in
+// order, with the results of its binds scripted
+func newForwarder(signatures []pftest.Result, binds ...error) *pftest.Forwarder {
+	f := pftest.NewForwarder(signatures...)
+	f.FailBinds(binds...)
+	return f
+}
+
+// eventRecorder collects published events
+type eventRecorder struct {
+	events []events.Event
+}
+
+func (r *eventRecorder) Publish(e events.Event) {
+	r.events = append(r.events, e)
+}
+
+func (r *eventRecorder) types() []events.Type {
+	var types []events.Type
+	for _, e := range r.events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+// testStart is when the fake clock starts
+var testStart = time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+
+// runManager runs a manager on a fake clock for the given number of iterations,
+// advancing the clock whenever the manager waits
+func runManager(t *testing.T, m *portforwarding.Manager, iterations int) error {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clk := clock.NewFake(testStart)
+	m.Clock = clk
+
+	done := make(chan error, 1)
+	go func() {
+		done <- m.Run(ctx)
+		cancel()
+	}()
+
+	for i := 0; i < iterations; i++ {
+		if clk.BlockUntil(ctx, 1) != nil {
+			break
+		}
+		if i == iterations-1 {
+			cancel()
+			break
+		}
+		// No wait is longer than the refresh interval
+		clk.Advance(m.RefreshInterval)
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Manager did not stop")
+		return nil
+	}
+}
+
+// signature returns port forwarding info expiring the given time after the test start
+func signature(port int, expiresIn time.Duration) pftest.Result {
+	return pftest.Signature(port, testStart.Add(expiresIn))
+}
+
+func TestManagerRun(t *testing.T) {
+	rejected := fmt.Errorf("%w: 401 Unauthorized", portforwarding.ErrAuthRejected)
+
+	testCases := []struct {
+		name           string
+		signatures     []pftest.Result
+		binds          []error
+		refreshToken   func(invalidate bool) error
+		iterations     int
+		expectedEvents []events.Type
+		expectedBound  []string
+		expectError    bool
+	}{
+		{
+			name:       "Binds every interval and reports the first port once",
+			signatures: []pftest.Result{signature(12345, 60*24*time.Hour)},
+			iterations: 3,
+			expectedEvents: []events.Type{
+				events.SignatureRenewed,
+				events.PortBound, events.PortChanged,
+				events.PortBound,
+				events.PortBound,
+			},
+			expectedBound: []string{"signature-12345", "signature-12345", "signature-12345"},
+		},
+		{
+			name:       "Renews an expiring signature and reports the new port",
+			signatures: []pftest.Result{signature(12345, 12*time.Hour), signature(54321, 60*24*time.Hour)},
+			iterations: 2,
+			expectedEvents: []events.Type{
+				events.SignatureRenewed,
+				events.SignatureRenewed,
+				events.PortBound, events.PortChanged,
+				events.PortBound,
+			},
+			expectedBound: []string{"signature-54321", "signature-54321"},
+		},
+		{
+			name:       "Renewal with the same port is not a change",
+			signatures: []pftest.Result{signature(12345, 12*time.Hour), signature(12345, 60*24*time.Hour)},
+			iterations: 1,
+			expectedEvents: []events.Type{
+				events.SignatureRenewed,
+				events.SignatureRenewed,
+				events.PortBound, events.PortChanged,
+			},
+			expectedBound: []string{"signature-12345"},
+		},
+		{
+			name:       "Failed renewal keeps the current signature",
+			signatures: []pftest.Result{signature(12345, 12*time.Hour), pftest.Failure(errors.New("gateway unreachable"))},
+			iterations: 2,
+			expectedEvents: []events.Type{
+				events.SignatureRenewed,
+				events.SignatureFailed,
+				events.PortBound, events.PortChanged,
+				events.SignatureFailed,
+				events.PortBound,
+			},
+			expectedBound: []string{"signature-12345", "signature-12345"},
+		},
+		{
+			name:       "Bind failures are reported and retried",
+			signatures: []pftest.Result{signature(12345, 60*24*time.Hour)},
+			binds:      []error{errors.New("bind failed"), errors.New("bind failed"), nil},
+			iterations: 3,
+			expectedEvents: []events.Type{
+				events.SignatureRenewed,
+				events.BindFailed,
+				events.BindFailed,
+				events.PortBound, events.PortChanged,
+			},
+			expectedBound: []string{"signature-12345"},
+		},
+		{
+			name:         "Rejected token is refreshed and the request retried",
+			signatures:   []pftest.Result{pftest.Failure(rejected), signature(12345, 60*24*time.Hour)},
+			refreshToken: func(invalidate bool) error { return nil },
+			iterations:   1,
+			expectedEvents: []events.Type{
+				events.SignatureRenewed,
+				events.PortBound, events.PortChanged,
+			},
+			expectedBound: []string{"signature-12345"},
+		},
+		{
+			name:       "Initial failure stops the manager",
+			signatures: []pftest.Result{pftest.Failure(errors.New("gateway unreachable"))},
+			iterations: 1,
+			expectedEvents: []events.Type{
+				events.SignatureFailed,
+			},
+			expectError: true,
+		},
+		{
+			name:         "Failed re-authentication stops the manager",
+			signatures:   []pftest.Result{pftest.Failure(rejected)},
+			refreshToken: func(invalidate bool) error { return errors.New("invalid credentials") },
+			iterations:   1,
+			expectedEvents: []events.Type{
+				events.SignatureFailed,
+			},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			forwarder := newForwarder(tc.signatures, tc.binds...)
+			recorder := &eventRecorder{}
+			m := portforwarding.NewManager(forwarder, recorder, 15*time.Minute)
+			m.RefreshToken = tc.refreshToken
+
+			err := runManager(t, m, tc.iterations)
+			if tc.expectError && err == nil {
+				t.Errorf("Expected error but got nil")
+			}
+			if !tc.expectError && err != nil {
+				t.Errorf("Expected no error but got: %v", err)
+			}
+
+			if !reflect.DeepEqual(recorder.types(), tc.expectedEvents) {
+				t.Errorf("Expected events %v, got %v", tc.expectedEvents, recorder.types())
+			}
+			if !reflect.DeepEqual(forwarder.Bound(), tc.expectedBound) {
+				t.Errorf("Expected bound signatures %v, got %v", tc.expectedBound, forwarder.Bound())
+			}
+		})
+	}
+}
+
+func TestManagerKeepPort(t *testing.T) {
+	testCases := []struct {
+		name           string
+		signatures     []pftest.Result
+		iterations     int
+		expectedEvents []events.Type
+		expectedBound  []string
+	}{
+		{
+			name:       "A renewal with another port is requested again",
+			signatures: []pftest.Result{signature(12345, 12*time.Hour), signature(54321, 60*24*time.Hour), signature(12345, 60*24*time.Hour)},
+			iterations: 2,
+			expectedEvents: []events.Type{
+				events.SignatureRenewed,
+				events.SignatureRetried,
+				events.SignatureRenewed,
+				events.PortBound, events.PortChanged,
+				events.PortBound,
+			},
+			expectedBound: []string{"signature-12345", "signature-12345"},
+		},
+		{
+			name:       "The last port is taken when the old one can't be kept",
+			signatures: []pftest.Result{signature(12345, 12*time.Hour), signature(54321, 60*24*time.Hour), pftest.Failure(errors.New("gateway unreachable")), signature(23456, 60*24*time.Hour)},
+			iterations: 3,
+			expectedEvents: []events.Type{
+				events.SignatureRenewed,
+				events.SignatureRetried, events.SignatureRetried,
+				events.PortKeepFailed,
+				events.SignatureRenewed,
+				events.PortBound, events.PortChanged,
+				events.PortBound,
+			},
+			expectedBound: []string{"signature-23456", "signature-23456"},
+		},
+		{
+			name:       "The first port is taken as it is",
+			signatures: []pftest.Result{signature(54321, 60*24*time.Hour), signature(12345, 60*24*time.Hour)},
+			iterations: 1,
+			expectedEvents: []events.Type{
+				events.SignatureRenewed,
+				events.PortBound, events.PortChanged,
+			},
+			expectedBound: []string{"signature-54321"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			forwarder := newForwarder(tc.signatures)
+			recorder := &eventRecorder{}
+			m := portforwarding.NewManager(forwarder, recorder, 15*time.Minute)
+			// runManager advances the clock a whole refresh interval during
+			// each retry wait, so the keepalive after a kept renewal is due at once
+			m.KeepPortAttempts = 2
+
+			if err := runManager(t, m, tc.iterations); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(recorder.types(), tc.expectedEvents) {
+				t.Errorf("Expected events %v, got %v", tc.expectedEvents, recorder.types())
+			}
+			if !reflect.DeepEqual(forwarder.Bound(), tc.expectedBound) {
+				t.Errorf("Expected bound signatures %v, got %v", tc.expectedBound, forwarder.Bound())
+			}
+			attempt := 0
+			for _, e := range recorder.events {
+				if e.Type == events.PortKeepFailed && (e.Port != 23456 || e.PreviousPort != 12345) {
+					t.Errorf("Expected the failure to name both ports, got %+v", e)
+				}
+				if e.Type != events.SignatureRetried {
+					continue
+				}
+				// A failed request reports the port held meanwhile
+				attempt++
+				if e.Attempt != attempt || (e.Error != "" && e.Port != 54321) {
+					t.Errorf("Expected retry %d, got %+v", attempt, e)
+				}
+			}
+		})
+	}
+}
+
+func TestManagerPortRange(t *testing.T) {
+	testCases := []struct {
+		name             string
+		keepPortAttempts int
+		signatures       []pftest.Result
+		iterations       int
+		expectedEvents   []events.Type
+		expectedBound    []string
+		expectedCalls    int
+	}{
+		{
+			name:       "A first port outside the range is bound, then requested again",
+			signatures: []pftest.Result{signature(12345, 60*24*time.Hour), signature(45000, 60*24*time.Hour)},
+			iterations: 2,
+			expectedEvents: []events.Type{
+				events.SignatureRenewed,
+				events.PortBound, events.PortChanged,
+				events.SignatureRetried,
+				events.SignatureRenewed,
+				events.PortBound, events.PortChanged,
+			},
+			expectedBound: []string{"signature-12345", "signature-45000"},
+			expectedCalls: 2,
+		},
+		{
+			name:       "The last port is taken when none is in range",
+			signatures: []pftest.Result{signature(12345, 60*24*time.Hour), pftest.Failure(errors.New("gateway unreachable")), signature(34567, 60*24*time.Hour)},
+			iterations: 3,
+			expectedEvents: []events.Type{
+				events.SignatureRenewed,
+				events.PortBound, events.PortChanged,
+				events.SignatureRetried, events.SignatureRetried,
+				events.PortOutOfRange,
+				events.SignatureRenewed,
+				events.PortBound, events.PortChanged,
+			},
+			expectedBound: []string{"signature-12345", "signature-34567"},
+			expectedCalls: 3,
+		},
+		{
+			name:       "A first port stays bound when no other can be obtained",
+			signatures: []pftest.Result{signature(12345, 60*24*time.Hour), pftest.Failure(errors.New("gateway unreachable"))},
+			iterations: 4,
+			expectedEvents: []events.Type{
+				events.SignatureRenewed,
+				events.PortBound, events.PortChanged,
+				events.SignatureRetried, events.SignatureRetried,
+				events.PortOutOfRange,
+				events.PortBound,
+			},
+			expectedBound: []string{"signature-12345", "signature-12345"},
+			expectedCalls: 3,
+		},
+		{
+			name:       "A renewal outside the range is requested again",
+			signatures: []pftest.Result{signature(45000, 12*time.Hour), signature(12345, 60*24*time.Hour), signature(46000, 60*24*time.Hour)},
+			iterations: 2,
+			expectedEvents: []events.Type{
+				events.SignatureRenewed,
+				events.SignatureRetried,
+				events.SignatureRenewed,
+				events.PortBound, events.PortChanged,
+				events.PortBound,
+			},
+			expectedBound: []string{"signature-46000", "signature-46000"},
+			expectedCalls: 3,
+		},
+		{
+			name:             "An old port outside the range isn't kept",
+			keepPortAttempts: 2,
+			signatures:       []pftest.Result{signature(12345, 12*time.Hour), signature(45000, 60*24*time.Hour)},
+			iterations:       1,
+			expectedEvents: []events.Type{
+				events.SignatureRenewed,
+				events.SignatureRenewed,
+				events.PortBound, events.PortChanged,
+			},
+			expectedBound: []string{"signature-45000"},
+			expectedCalls: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			forwarder := newForwarder(tc.signatures)
+			recorder := &eventRecorder{}
+			// As with keeping the port, the keepalive after a renewal that was
+			// requested again is due at once. A short interval keeps the retry
+			// waits from adding up to a released port.
+			m := portforwarding.NewManager(forwarder, recorder, time.Minute)
+			m.PortRangeMin = 40000
+			m.PortRangeMax = 49999
+			m.PortRangeAttempts = 2
+			m.KeepPortAttempts = tc.keepPortAttempts
+
+			if err := runManager(t, m, tc.iterations); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(recorder.types(), tc.expectedEvents) {
+				t.Errorf("Expected events %v, got %v", tc.expectedEvents, recorder.types())
+			}
+			if !reflect.DeepEqual(forwarder.Bound(), tc.expectedBound) {
+				t.Errorf("Expected bound signatures %v, got %v", tc.expectedBound, forwarder.Bound())
+			}
+			if forwarder.SignatureCalls() != tc.expectedCalls {
+				t.Errorf("Expected %d signature requests, got %d", tc.expectedCalls, forwarder.SignatureCalls())
+			}
+			for _, e := range recorder.events {
+				taken := fmt.Sprintf("signature-%d", e.Port) == tc.expectedBound[len(tc.expectedBound)-1]
+				if e.Type == events.PortOutOfRange && (!taken || e.PortRange != "40000-49999") {
+					t.Errorf("Expected the event to name the port taken and the range, got %+v", e)
+				}
+			}
+		})
+	}
+}
+
+func TestManagerEventDetails(t *testing.T) {
+	forwarder := newForwarder([]pftest.Result{signature(12345, 12*time.Hour), signature(54321, 60*24*time.Hour)}, errors.New("bind failed"), errors.New("bind failed"), nil)
+	recorder := &eventRecorder{}
+	m := portforwarding.NewManager(forwarder, recorder, 15*time.Minute)
+	m.Gateway = "10.8.110.1"
+	m.Hostname = "frankfurt404"
+
+	if err := runManager(t, m, 3); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var failures []int
+	for _, e := range recorder.events {
+		if e.Gateway != "10.8.110.1" || e.Hostname != "frankfurt404" {
+			t.Errorf("Expected gateway details on %s, got %q %q", e.Type, e.Gateway, e.Hostname)
+		}
+		if e.Time.IsZero() {
+			t.Errorf("Expected %s to have a time", e.Type)
+		}
+		switch e.Type {
+		case events.BindFailed:
+			failures = append(failures, e.ConsecutiveFailures)
+		case events.PortChanged:
+			if e.Port != 54321 || e.PreviousPort != 0 {
+				t.Errorf("Expected first change to port 54321 from 0, got %d from %d", e.Port, e.PreviousPort)
+			}
+		case events.SignatureRenewed:
+			if e.Port == 54321 && e.PreviousPort != 12345 {
+				t.Errorf("Expected renewal to report previous port 12345, got %d", e.PreviousPort)
+			}
+		}
+	}
+	if !reflect.DeepEqual(failures, []int{1, 2}) {
+		t.Errorf("Expected consecutive failure counts [1 2], got %v", failures)
+	}
+}
+
+func TestManagerPortReleased(t *testing.T) {
+	forwarder := newForwarder([]pftest.Result{signature(12345, 60*24*time.Hour), signature(54321, 60*24*time.Hour)}, nil, errors.New("bind failed"), nil)
+	recorder := &eventRecorder{}
+	m := portforwarding.NewManager(forwarder, recorder, 10*time.Minute)
+
+	// The bind after 20 minutes without one gets a new signature first
+	if err := runManager(t, m, 3); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []events.Type{
+		events.SignatureRenewed, events.PortBound, events.PortChanged,
+		events.BindFailed,
+		events.PortReleased, events.SignatureRenewed, events.PortBound, events.PortChanged,
+	}
+	if types := recorder.types(); !reflect.DeepEqual(types, expected) {
+		t.Errorf("Expected events %v, got %v", expected, types)
+	}
+	if !reflect.DeepEqual(forwarder.Bound(), []string{"signature-12345", "signature-54321"}) {
+		t.Errorf("Expected the new signature to be bound, got %v", forwarder.Bound())
+	}
+	for _, e := range recorder.events {
+		if e.Type == events.PortReleased && (e.Port != 12345 || e.Duration != 20*time.Minute) {
+			t.Errorf("Expected port 12345 released after 20m, got %d after %s", e.Port, e.Duration)
+		}
+	}
+}
+
+func TestManagerStatus(t *testing.T) {
+	forwarder := newForwarder([]pftest.Result{signature(12345, 12*time.Hour), signature(54321, 60*24*time.Hour)}, errors.New("bind failed"), errors.New("bind failed"), nil)
+	m := portforwarding.NewManager(forwarder, nil, 15*time.Minute)
+	m.Gateway = "10.8.110.1"
+	m.Hostname = "frankfurt404"
+
+	// A subscriber is given the status right away
+	statuses, unsubscribe := m.Subscribe()
+	if status := <-statuses; status != (portforwarding.PortStatus{}) {
+		t.Errorf("Expected an empty status before the loop runs, got %+v", status)
+	}
+
+	// Failures are counted while the status is taken as binds happen
+	var failures []int
+	m.Events = eventFunc(func(e events.Event) {
+		if e.Type == events.BindFailed {
+			failures = append(failures, m.Current().ConsecutiveFailures)
+		}
+	})
+	if err := runManager(t, m, 3); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(failures, []int{1, 2}) {
+		t.Errorf("Expected consecutive failure counts [1 2], got %v", failures)
+	}
+
+	expected := portforwarding.PortStatus{
+		Port:       54321,
+		ExpiresAt:  testStart.Add(60 * 24 * time.Hour),
+		RenewsAt:   testStart.Add(59 * 24 * time.Hour),
+		Payload:    "payload-54321",
+		Signature:  "signature-54321",
+		ObtainedAt: testStart,
+		BoundAt:    testStart.Add(30 * time.Minute),
+		Gateway:    "10.8.110.1",
+		Hostname:   "frankfurt404",
+	}
+	if status := m.Current(); status != expected {
+		t.Errorf("Expected status %+v, got %+v", expected, status)
+	}
+
+	// A subscriber that fell behind is given only the latest status
+	if status := <-statuses; status != expected {
+		t.Errorf("Expected the latest status %+v, got %+v", expected, status)
+	}
+	select {
+	case status := <-statuses:
+		t.Errorf("Expected no stale status, got %+v", status)
+	default:
+	}
+	unsubscribe()
+	if _, ok := <-statuses; ok {
+		t.Error("Expected the channel to be closed on unsubscribe")
+	}
+	unsubscribe()
+}
+
+// eventFunc publishes events to a function
+type eventFunc func(events.Event)
+
+func (f eventFunc) Publish(e events.Event) { f(e) }
+
+func TestManagerResume(t *testing.T) {
+	forwarder := newForwarder([]pftest.Result{signature(54321, 60*24*time.Hour)})
+	recorder := &eventRecorder{}
+	m := portforwarding.NewManager(forwarder, recorder, 15*time.Minute)
+	m.Resume = signature(12345, 60*24*time.Hour).Info
+
+	if err := runManager(t, m, 2); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The handed over signature is kept bound without a new one or a port change
+	if forwarder.SignatureCalls() != 0 {
+		t.Errorf("Expected no signature requests, got %d", forwarder.SignatureCalls())
+	}
+	if !reflect.DeepEqual(forwarder.Bound(), []string{"signature-12345", "signature-12345"}) {
+		t.Errorf("Expected the resumed signature to be bound twice, got %v", forwarder.Bound())
+	}
+	if expected := []events.Type{events.PortBound, events.PortBound}; !reflect.DeepEqual(recorder.types(), expected) {
+		t.Errorf("Expected events %v, got %v", expected, recorder.types())
+	}
+}
+
+func TestManagerRefreshTokenBeforeRenewal(t *testing.T) {
+	forwarder := newForwarder([]pftest.Result{signature(12345, 12*time.Hour), signature(54321, 60*24*time.Hour)})
+	var calls []bool
+	m := portforwarding.NewManager(forwarder, &eventRecorder{}, 15*time.Minute)
+	m.RefreshToken = func(invalidate bool) error {
+		calls = append(calls, invalidate)
+		return nil
+	}
+
+	if err := runManager(t, m, 1); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The token is checked, not discarded, before a routine renewal
+	if !reflect.DeepEqual(calls, []bool{false}) {
+		t.Errorf("Expected one token refresh without invalidation, got %v", calls)
+	}
+}
+
+func TestManagerRenewAndRebind(t *testing.T) {
+	forwarder := newForwarder([]pftest.Result{
+		signature(12345, 60*24*time.Hour),
+		pftest.Failure(errors.New("gateway unreachable")),
+		signature(54321, 60*24*time.Hour),
+	})
+	m := portforwarding.NewManager(forwarder, &eventRecorder{}, 15*time.Minute)
+	m.MinBindInterval = time.Minute
+
+	clk := clock.NewFake(testStart)
+	m.Clock = clk
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- m.Run(ctx) }()
+
+	// Waits cut short by a request stay registered with the fake clock until
+	// they're due, so each step says how many waits to expect afterwards
+	step := func(name string, action func(), waits int, expectedBound ...string) {
+		t.Helper()
+		action()
+		if err := clk.BlockUntil(ctx, waits); err != nil {
+			t.Fatalf("%s: manager stopped waiting: %v", name, err)
+		}
+		if !reflect.DeepEqual(forwarder.Bound(), expectedBound) {
+			t.Errorf("%s: expected bound signatures %v, got %v", name, expectedBound, forwarder.Bound())
+		}
+	}
+
+	step("Start", func() {}, 1, "signature-12345")
+	step("Rebind", m.Rebind, 2, "signature-12345", "signature-12345")
+
+	// A failed renewal keeps the signature, which was just bound
+	step("Failed renewal", func() {
+		clk.Advance(10 * time.Second)
+		m.Renew()
+	}, 3, "signature-12345", "signature-12345")
+
+	// The skipped bind doesn't push back the next keepalive
+	step("Keepalive", func() { clk.Advance(15*time.Minute - 10*time.Second) }, 1, "signature-12345", "signature-12345", "signature-12345")
+	step("Renewal", m.Renew, 2, "signature-12345", "signature-12345", "signature-12345", "signature-54321")
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestRenewPolicy(t *testing.T) {
+	obtainedAt := testStart
+	expiresAt := testStart.Add(60 * 24 * time.Hour)
+
+	testCases := []struct {
+		name       string
+		policy     portforwarding.RenewPolicy
+		obtainedAt time.Time
+		expected   time.Time
+	}{
+		{
+			name:       "Default",
+			obtainedAt: obtainedAt,
+			expected:   expiresAt.Add(-portforwarding.SignatureRenewBefore),
+		},
+		{
+			name:       "Before expiry",
+			policy:     portforwarding.RenewPolicy{Before: 72 * time.Hour},
+			obtainedAt: obtainedAt,
+			expected:   expiresAt.Add(-72 * time.Hour),
+		},
+		{
+			name:       "Validity left",
+			policy:     portforwarding.RenewPolicy{Remaining: 0.25},
+			obtainedAt: obtainedAt,
+			expected:   expiresAt.Add(-15 * 24 * time.Hour),
+		},
+		{
+			name:       "Earlier of both",
+			policy:     portforwarding.RenewPolicy{Before: 20 * 24 * time.Hour, Remaining: 0.25},
+			obtainedAt: obtainedAt,
+			expected:   expiresAt.Add(-20 * 24 * time.Hour),
+		},
+		{
+			name:     "Validity left without knowing when it was obtained",
+			policy:   portforwarding.RenewPolicy{Remaining: 0.25},
+			expected: expiresAt.Add(-portforwarding.SignatureRenewBefore),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if renewsAt := tc.policy.RenewsAt(tc.obtainedAt, expiresAt); !renewsAt.Equal(tc.expected) {
+				t.Errorf("Expected renewal at %s, got %s", tc.expected, renewsAt)
+			}
+		})
+	}
+}
+
+func TestManagerRenewPolicy(t *testing.T) {
+	forwarder := newForwarder([]pftest.Result{
+		signature(12345, 60*24*time.Hour),
+		signature(54321, 120*24*time.Hour),
+	})
+	var renewals []events.Event
+	m := portforwarding.NewManager(forwarder, eventFunc(func(e events.Event) {
+		if e.Type == events.SignatureRenewed {
+			renewals = append(renewals, e)
+		}
+	}), 40*24*time.Hour)
+	m.RenewPolicy = portforwarding.RenewPolicy{Remaining: 0.5}
+
+	// Halfway through its validity, well before the default renewal, the
+	// first signature is replaced
+	if err := runManager(t, m, 2); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := []string{"signature-12345", "signature-54321"}; !reflect.DeepEqual(forwarder.Bound(), expected) {
+		t.Errorf("Expected bound signatures %v, got %v", expected, forwarder.Bound())
+	}
+	if len(renewals) != 2 || !renewals[0].RenewsAt.Equal(testStart.Add(30*24*time.Hour)) {
+		t.Fatalf("Expected the first signature to renew after 30 days, got %+v", renewals)
+	}
+	// The second was obtained after 40 days, with 80 days of validity
+	if renewsAt := testStart.Add(80 * 24 * time.Hour); !renewals[1].RenewsAt.Equal(renewsAt) || !m.Current().RenewsAt.Equal(renewsAt) {
+		t.Errorf("Expected the second signature to renew at %s, got %s", renewsAt, renewals[1].RenewsAt)
+	}
+}
+
+// gatedForwarder holds each signature request until the test lets it through
+type gatedForwarder struct {
+	*pftest.Forwarder
+	requested chan struct{}
+	release   chan struct{}
+}
+
+func (f *gatedForwarder) GetPortForwarding() (*portforwarding.PortForwardingInfo, error) {
+	f.requested <- struct{}{}
+	<-f.release
+	return f.Forwarder.GetPortForwarding()
+}
+
+func TestManagerCoalescesRenewals(t *testing.T) {
+	forwarder := &gatedForwarder{
+		Forwarder: newForwarder([]pftest.Result{
+			signature(12345, portforwarding.SignatureRenewBefore+10*time.Minute),
+			signature(23456, 60*24*time.Hour),
+			signature(34567, 60*24*time.Hour),
+		}),
+		requested: make(chan struct{}),
+		release:   make(chan struct{}),
+	}
+	m := portforwarding.NewManager(forwarder, &eventRecorder{}, 15*time.Minute)
+
+	clk := clock.NewFake(testStart)
+	m.Clock = clk
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- m.Run(ctx) }()
+
+	// Renewals requested from many places at once while a signature is being
+	// requested are all met by it
+	renewConcurrently := func() {
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				m.Renew()
+			}()
+		}
+		wg.Wait()
+	}
+	inFlight := func(name string, waits int, expectedCalls int, expectedPort int) {
+		t.Helper()
+		<-forwarder.requested
+		renewConcurrently()
+		forwarder.release <- struct{}{}
+		if err := clk.BlockUntil(ctx, waits); err != nil {
+			t.Fatalf("%s: manager stopped waiting: %v", name, err)
+		}
+		if forwarder.SignatureCalls() != expectedCalls {
+			t.Errorf("%s: expected %d signature requests, got %d", name, expectedCalls, forwarder.SignatureCalls())
+		}
+		if port := m.Current().Port; port != expectedPort {
+			t.Errorf("%s: expected port %d, got %d", name, expectedPort, port)
+		}
+		if portforwarding.PendingRenewals(m) != 0 {
+			t.Errorf("%s: expected no renewal left pending", name)
+		}
+	}
+
+	inFlight("Initial signature", 1, 1, 12345)
+
+	// The signature is due for renewal on the next wake-up
+	clk.Advance(11 * time.Minute)
+	inFlight("Scheduled renewal", 1, 2, 23456)
+
+	// A request after the renewal finished gets a signature of its own, and
+	// those made while it's requested join it. The wait it cut short stays
+	// registered with the fake clock.
+	renewConcurrently()
+	inFlight("Requested renewal", 2, 3, 34567)
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestManagerGatewayProbe(t *testing.T) {
+	bindFailed := errors.New("failed to send request: connection refused")
+
+	testCases := []struct {
+		name           string
+		probe          error
+		reconnect      error
+		binds          []error
+		iterations     int
+		expectedBound  []string
+		expectedBinds  int
+		expectedEvents []events.Type
+	}{
+		{
+			name:           "Gateway up but API failing",
+			binds:          []error{bindFailed, nil},
+			iterations:     2,
+			expectedBound:  []string{"signature-12345"},
+			expectedBinds:  2,
+			expectedEvents: []events.Type{events.SignatureRenewed, events.BindFailed, events.PortBound, events.PortChanged},
+		},
+		{
+			name:           "Gateway gone after the VPN reconnected",
+			probe:          errors.New("connection timed out"),
+			binds:          []error{bindFailed, nil},
+			iterations:     2,
+			expectedBound:  []string{"signature-54321"},
+			expectedBinds:  2,
+			expectedEvents: []events.Type{events.SignatureRenewed, events.BindFailed, events.VPNReconnected, events.SignatureRenewed, events.PortBound, events.PortChanged},
+		},
+		{
+			name:           "Gateway gone with the VPN",
+			probe:          errors.New("connection timed out"),
+			reconnect:      errors.New("no tun interface"),
+			binds:          []error{bindFailed},
+			iterations:     3,
+			expectedBinds:  1,
+			expectedEvents: []events.Type{events.SignatureRenewed, events.BindFailed, events.BindFailed, events.BindFailed},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			forwarder := newForwarder([]pftest.Result{signature(12345, 60*24*time.Hour), signature(54321, 60*24*time.Hour)}, tc.binds...)
+			recorder := &eventRecorder{}
+			m := portforwarding.NewManager(forwarder, recorder, 15*time.Minute)
+			m.Gateway = "10.8.110.1"
+			m.ProbeGateway = func() error { return tc.probe }
+			m.Reconnect = func() (string, string, error) {
+				return "10.9.0.1", "berlin420", tc.reconnect
+			}
+
+			if err := runManager(t, m, tc.iterations); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if forwarder.BindCalls() != tc.expectedBinds {
+				t.Errorf("Expected %d bind calls, got %d", tc.expectedBinds, forwarder.BindCalls())
+			}
+			if !reflect.DeepEqual(forwarder.Bound(), tc.expectedBound) {
+				t.Errorf("Expected bound signatures %v, got %v", tc.expectedBound, forwarder.Bound())
+			}
+			if types := recorder.types(); !reflect.DeepEqual(types, tc.expectedEvents) {
+				t.Errorf("Expected events %v, got %v", tc.expectedEvents, types)
+			}
+			for _, e := range recorder.events {
+				if e.Type == events.VPNReconnected && (e.Gateway != "10.9.0.1" || e.Hostname != "berlin420") {
+					t.Errorf("Expected the reconnect to report the new gateway, got %q %q", e.Gateway, e.Hostname)
+				}
+			}
+		})
+	}
+}
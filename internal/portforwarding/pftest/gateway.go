@@ -0,0 +1,123 @@
+package pftest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/portforwarding"
+)
+
+// Gateway is an HTTPS server speaking the PIA port forwarding API, for tests
+// running the real client, or the whole program, against it. It hands out the
+// given ports in order, repeating the last one, and only binds signatures it
+// issued.
+type Gateway struct {
+	server   *httptest.Server
+	token    string
+	validity time.Duration
+
+	mu         sync.Mutex
+	ports      []int
+	signatures map[string]int
+	signCalls  int
+	bound      []int
+}
+
+// NewGateway starts a gateway accepting token, or any token if it's empty,
+// whose signatures are valid for validity
+func NewGateway(token string, validity time.Duration, ports ...int) *Gateway {
+	g := &Gateway{token: token, validity: validity, ports: ports, signatures: make(map[string]int)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+portforwarding.SignatureEndpoint, g.getSignature)
+	mux.HandleFunc("/"+portforwarding.BindPortEndpoint, g.bindPort)
+	g.server = httptest.NewTLSServer(mux)
+	return g
+}
+
+// Close shuts the gateway down
+func (g *Gateway) Close() {
+	g.server.Close()
+}
+
+// Addr returns the gateway's IP address and port
+func (g *Gateway) Addr() (ip string, port int) {
+	addr := g.server.Listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+// CACert returns the PEM certificate clients should trust the gateway with,
+// in place of the PIA CA
+func (g *Gateway) CACert() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: g.server.Certificate().Raw})
+}
+
+// SignatureCalls returns how many signatures were issued
+func (g *Gateway) SignatureCalls() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.signCalls
+}
+
+// Bound returns the ports of the signatures bound, in order, one per bind
+func (g *Gateway) Bound() []int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return append([]int(nil), g.bound...)
+}
+
+// getSignature issues a signature for the next port
+func (g *Gateway) getSignature(w http.ResponseWriter, r *http.Request) {
+	if g.token != "" && r.URL.Query().Get("token") != g.token {
+		writeJSON(w, portforwarding.PayloadAndSignature{Status: "ERROR", Message: "invalid token"})
+		return
+	}
+
+	g.mu.Lock()
+	port := 0
+	if len(g.ports) > 0 {
+		port = g.ports[min(g.signCalls, len(g.ports)-1)]
+	}
+	g.signCalls++
+	signature := "signature-" + strconv.Itoa(g.signCalls)
+	g.signatures[signature] = port
+	g.mu.Unlock()
+
+	data, _ := json.Marshal(portforwarding.PayloadData{Port: port, ExpiresAt: time.Now().Add(g.validity)})
+	writeJSON(w, portforwarding.PayloadAndSignature{
+		Status:    "OK",
+		Payload:   base64.StdEncoding.EncodeToString(data),
+		Signature: signature,
+	})
+}
+
+// bindPort binds the port of a signature the gateway issued
+func (g *Gateway) bindPort(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	port, ok := g.signatures[r.URL.Query().Get("signature")]
+	if ok {
+		g.bound = append(g.bound, port)
+	}
+	g.mu.Unlock()
+
+	if !ok {
+		writeJSON(w, portforwarding.BindPortResponse{Status: "ERROR", Message: "invalid signature"})
+		return
+	}
+	writeJSON(w, portforwarding.BindPortResponse{Status: "OK", Message: fmt.Sprintf("port %d scheduled for add", port)})
+}
+
+// writeJSON writes v as the JSON response
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,49 @@
+package pftest
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/portforwarding"
+)
+
+func TestGateway(t *testing.T) {
+	gateway := NewGateway("test-token", time.Hour, 40001, 40002)
+	defer gateway.Close()
+
+	caCert := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(caCert, gateway.CACert(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ip, port := gateway.Addr()
+	client := portforwarding.NewClient("test-token", ip, "mockgw", caCert)
+	defer client.Close()
+	client.SetAPIPort(port)
+
+	for _, want := range []int{40001, 40002, 40002} {
+		info, err := client.GetPortForwarding()
+		if err != nil {
+			t.Fatalf("Failed to get a signature: %v", err)
+		}
+		if info.Port != want || time.Until(info.ExpiresAt) <= 0 {
+			t.Errorf("Expected port %d valid for an hour, got %d until %v", want, info.Port, info.ExpiresAt)
+		}
+		if err := client.BindPort(info.Payload, info.Signature); err != nil {
+			t.Fatalf("Failed to bind port %d: %v", info.Port, err)
+		}
+	}
+	if err := client.BindPort("payload", "forged"); err == nil {
+		t.Errorf("Expected a signature the gateway didn't issue to be rejected")
+	}
+	if gateway.SignatureCalls() != 3 || !slices.Equal(gateway.Bound(), []int{40001, 40002, 40002}) {
+		t.Errorf("Expected 3 signatures and binds, got %d and %v", gateway.SignatureCalls(), gateway.Bound())
+	}
+
+	client.SetToken("wrong-token")
+	if _, err := client.GetPortForwarding(); err == nil {
+		t.Errorf("Expected a wrong token to be rejected")
+	}
+}
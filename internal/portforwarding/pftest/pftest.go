@@ -0,0 +1,168 @@
+// Package pftest provides a fake portforwarding.PortForwarder for tests of code
+// that drives a port forwarding manager, and a fake gateway for tests that go
+// through the real client
+package pftest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/portforwarding"
+)
+
+// Result is what one GetPortForwarding call returns
+type Result struct {
+	Info *portforwarding.PortForwardingInfo
+	Err  error
+}
+
+// Signature returns a result with port forwarding info for port expiring at
+// expiresAt, with a payload and signature naming the port
+func Signature(port int, expiresAt time.Time) Result {
+	return Result{Info: &portforwarding.PortForwardingInfo{
+		Port:      port,
+		ExpiresAt: expiresAt,
+		Payload:   fmt.Sprintf("payload-%d", port),
+		Signature: fmt.Sprintf("signature-%d", port),
+	}}
+}
+
+// Failure returns a result failing with err
+func Failure(err error) Result {
+	return Result{Err: err}
+}
+
+// Forwarder stands in for portforwarding.Client. It returns scripted results,
+// repeating the last one when it runs out, and records what it was asked to
+// do. It's safe for concurrent use, so tests can inspect it while a manager
+// runs.
+type Forwarder struct {
+	mu         sync.Mutex
+	signatures []Result
+	binds      []error
+	probe      error
+	signCalls  int
+	bindCalls  int
+	bound      []string
+	token      string
+	gateway    string
+	hostname   string
+}
+
+// NewForwarder returns a forwarder handing out the given signature results in order
+func NewForwarder(signatures ...Result) *Forwarder {
+	return &Forwarder{signatures: signatures}
+}
+
+// FailBinds scripts the results of the following BindPort calls, nil for
+// success. The last one repeats.
+func (f *Forwarder) FailBinds(errs ...error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.binds = errs
+	f.bindCalls = 0
+}
+
+// FailProbes makes ProbeGateway return err, nil for success
+func (f *Forwarder) FailProbes(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.probe = err
+}
+
+// GetPortForwarding returns the next scripted signature result
+func (f *Forwarder) GetPortForwarding() (*portforwarding.PortForwardingInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.signatures) == 0 {
+		return nil, errors.New("pftest: no signatures scripted")
+	}
+	r := f.signatures[min(f.signCalls, len(f.signatures)-1)]
+	f.signCalls++
+	return r.Info, r.Err
+}
+
+// BindPort returns the next scripted bind result, recording the signature if it succeeds
+func (f *Forwarder) BindPort(payload, signature string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var err error
+	if len(f.binds) > 0 {
+		err = f.binds[min(f.bindCalls, len(f.binds)-1)]
+	}
+	f.bindCalls++
+	if err == nil {
+		f.bound = append(f.bound, signature)
+	}
+	return err
+}
+
+// ProbeGateway returns the error set with FailProbes
+func (f *Forwarder) ProbeGateway() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.probe
+}
+
+// SetToken records the token
+func (f *Forwarder) SetToken(token string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.token = token
+}
+
+// SetGateway records the gateway
+func (f *Forwarder) SetGateway(gatewayIP, hostname string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.gateway, f.hostname = gatewayIP, hostname
+}
+
+// SignatureCalls returns how many signatures were requested
+func (f *Forwarder) SignatureCalls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.signCalls
+}
+
+// BindCalls returns how many binds were attempted
+func (f *Forwarder) BindCalls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.bindCalls
+}
+
+// Bound returns the signatures bound successfully, in order
+func (f *Forwarder) Bound() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.bound...)
+}
+
+// Token returns the token last set
+func (f *Forwarder) Token() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.token
+}
+
+// Gateway returns the gateway IP and hostname last set
+func (f *Forwarder) Gateway() (gatewayIP, hostname string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.gateway, f.hostname
+}
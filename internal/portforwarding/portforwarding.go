@@ -1,16 +1,31 @@
 package portforwarding
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/meschansky/go-pia/internal/atomicfile"
+	"github.com/meschansky/go-pia/internal/httpjson"
+	"github.com/meschansky/go-pia/internal/httplog"
+	"github.com/meschansky/go-pia/internal/metrics"
+	"github.com/meschansky/go-pia/internal/piaca"
+	"github.com/meschansky/go-pia/internal/redact"
+	"github.com/meschansky/go-pia/internal/resolver"
 )
 
 const (
@@ -22,18 +37,96 @@ const (
 	APIPort = "19999"
 )
 
+// probeTimeout bounds a gateway probe, replaceable for tests
+var probeTimeout = 3 * time.Second
+
+// lookupTimeout bounds resolving the gateway hostname for the fallback
+const lookupTimeout = 5 * time.Second
+
+// ErrAuthRejected is returned when the gateway rejects the authentication token;
+// a new token is needed rather than a retry
+var ErrAuthRejected = errors.New("authentication token rejected")
+
+// ErrUntrustedGateway is returned when the gateway's certificate isn't signed by
+// the PIA CA, so it may not be a PIA server and must not be sent the token
+var ErrUntrustedGateway = errors.New("gateway certificate is not signed by the PIA CA")
+
+// ErrNotNextGen is returned when the gateway doesn't serve the port forwarding
+// API, as legacy PIA servers don't
+var ErrNotNextGen = errors.New("gateway doesn't serve the next-gen port forwarding API")
+
+// tlsHandshakes counts TLS handshakes with the gateway, which should stay low when connections are reused
+var tlsHandshakes = metrics.Default.NewCounter("gopia_gateway_tls_handshakes_total", "Number of TLS handshakes with the port forwarding gateway")
+
+// LatencyQuantiles are the quantiles of gateway request latency reported in the
+// metrics, over the last LatencyWindow successful requests to each endpoint
+var LatencyQuantiles = []float64{0.5, 0.9, 0.99}
+
+// LatencyWindow is how many of the most recent requests latency quantiles cover
+const LatencyWindow = 100
+
+// requestLatency tracks recent round-trip times by endpoint, so a degrading
+// gateway shows up before requests start failing
+var requestLatency = metrics.Default.NewSummaryVec("gopia_gateway_request_duration_seconds", "Round-trip time of recent successful port forwarding gateway requests", "endpoint", LatencyWindow, LatencyQuantiles)
+
+// Latency returns the round-trip times of recent successful requests to
+// endpoint, or false if none succeeded yet
+func Latency(endpoint string) (*metrics.Summary, bool) {
+	return requestLatency.Lookup(endpoint)
+}
+
+// TransportOptions tunes connection reuse for gateway calls
+type TransportOptions struct {
+	// How long an idle keep-alive connection is kept open; it should exceed
+	// the refresh interval so each keepalive reuses the previous connection.
+	// Zero disables keep-alives.
+	IdleConnTimeout time.Duration
+	// Maximum number of idle connections kept open to the gateway
+	MaxIdleConns int
+}
+
+// DefaultTransportOptions returns transport settings suited to a 15 minute keepalive
+func DefaultTransportOptions() TransportOptions {
+	return TransportOptions{
+		IdleConnTimeout: 20 * time.Minute,
+		MaxIdleConns:    2,
+	}
+}
+
 // Client handles port forwarding operations
 type Client struct {
 	httpClient *http.Client
+	transport  *http.Transport
 	token      string
 	gatewayIP  string
 	hostname   string
 	caCertPath string
+	// The PIA CA that gateway certificates must be signed by, or why it couldn't be loaded
+	caPool  *x509.CertPool
+	caError error
+	apiPort string
+	// Sent on every request
+	headers http.Header
+	// Opens connections to the gateway
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// Opens connections when they aren't tunneled; its resolver resolves the
+	// hostname when it's dialed
+	dialer *net.Dialer
+	// Set when the hostname is dialed rather than the gateway IP
+	viaHostname bool
+	// Set when connections go through a tunnel that opens before the gateway is reached
+	tunneled bool
+	// Resolves the hostname when the gateway IP can't be reached
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+	// Canceled by Close to abort requests in flight
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // PayloadAndSignature represents the response from the getSignature endpoint
 type PayloadAndSignature struct {
 	Status    string `json:"status"`
+	Message   string `json:"message"`
 	Payload   string `json:"payload"`
 	Signature string `json:"signature"`
 }
@@ -56,30 +149,223 @@ type PortForwardingInfo struct {
 	ExpiresAt time.Time
 	Payload   string
 	Signature string
+	// When the manager obtained the signature, zero if it isn't known
+	ObtainedAt time.Time
 }
 
-// NewClient creates a new port forwarding client
+// NewClient creates a new port forwarding client. Gateways must present a
+// certificate signed by the CA in caCertPath.
 func NewClient(token, gatewayIP, hostname, caCertPath string) *Client {
-	// Create a custom TLS config that uses the PIA CA certificate
+	c := &Client{
+		token:      token,
+		gatewayIP:  gatewayIP,
+		hostname:   hostname,
+		caCertPath: caCertPath,
+		apiPort:    APIPort,
+		lookupHost: net.DefaultResolver.LookupHost,
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.caPool, c.caError = loadCACert(caCertPath)
+
+	// Gateway certificates are issued for the server's common name rather than
+	// the hostname we know, so only the chain is verified, against the PIA CA
 	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true, // We'll verify the cert manually with the CA
+		InsecureSkipVerify: true,
+		// Resume sessions so reconnects after the gateway drops an idle connection stay cheap
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			tlsHandshakes.Inc()
+			return c.verifyGateway(cs)
+		},
 	}
 
-	// Create a custom HTTP client with the TLS config
+	// Create a custom HTTP client with the TLS config, keeping connections
+	// alive between keepalives to avoid a new handshake on every bind
+	opts := DefaultTransportOptions()
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
 	transport := &http.Transport{
-		TLSClientConfig: tlsConfig,
+		TLSClientConfig:     tlsConfig,
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     opts.IdleConnTimeout,
+		MaxIdleConns:        opts.MaxIdleConns,
+		MaxIdleConnsPerHost: opts.MaxIdleConns,
 	}
 
-	return &Client{
-		httpClient: &http.Client{
-			Transport: transport,
-			Timeout:   10 * time.Second,
-		},
-		token:      token,
-		gatewayIP:  gatewayIP,
-		hostname:   hostname,
-		caCertPath: caCertPath,
+	redact.Default.Add("token", token)
+	c.httpClient = &http.Client{
+		Transport: transport,
+		Timeout:   10 * time.Second,
+	}
+	c.transport = transport
+	c.dial = dialer.DialContext
+	c.dialer = dialer
+	return c
+}
+
+// loadCACert loads the PEM certificates in path into a pool
+func loadCACert(path string) (*x509.CertPool, error) {
+	if path == "" {
+		return nil, errors.New("no PIA CA certificate configured")
+	}
+	data, err := piaca.Read(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PIA CA certificate: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// verifyGateway checks that the gateway's certificate chains up to the PIA CA.
+// It runs during the TLS handshake, before any request carries the token.
+func (c *Client) verifyGateway(cs tls.ConnectionState) error {
+	if c.caError != nil {
+		return fmt.Errorf("%w: %v", ErrUntrustedGateway, c.caError)
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("%w: no certificate presented", ErrUntrustedGateway)
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         c.caPool,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+		return fmt.Errorf("%w: %v", ErrUntrustedGateway, err)
+	}
+	return nil
+}
+
+// SetToken replaces the authentication token used to request signatures
+func (c *Client) SetToken(token string) {
+	redact.Default.Add("token", token)
+	c.token = token
+}
+
+// SetGateway points the client at a different gateway, after the VPN reconnected
+func (c *Client) SetGateway(gatewayIP, hostname string) {
+	c.gatewayIP = gatewayIP
+	c.hostname = hostname
+	c.transport.CloseIdleConnections()
+}
+
+// SetTunnel makes the client reach the gateway through connections opened by
+// dial, such as ones forwarded by another host. Such connections may open
+// before the gateway is reached and close right away if it can't be.
+func (c *Client) SetTunnel(dial func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	c.dial = dial
+	c.tunneled = true
+	c.transport.DialContext = dial
+	c.transport.CloseIdleConnections()
+}
+
+// ProbeGateway checks that the gateway accepts connections on the API port. It's
+// much cheaper than an API call and fails fast once the VPN connection is gone.
+func (c *Client) ProbeGateway() error {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	conn, err := c.dial(ctx, "tcp", net.JoinHostPort(c.target(), c.apiPort))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// The gateway waits for the TLS handshake, so a tunneled connection that
+	// stays open until the deadline reached it
+	if c.tunneled {
+		conn.SetReadDeadline(time.Now().Add(probeTimeout))
+		if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("tunneled connection closed: %v", err)
+		}
+	}
+	return nil
+}
+
+// CheckNextGen checks that the gateway is a next-gen PIA server, the only kind
+// that forwards ports, by probing the API port. It fails with ErrNotNextGen
+// rather than leaving requests to time out on a port nothing listens on.
+func (c *Client) CheckNextGen() error {
+	if err := c.ProbeGateway(); err != nil {
+		return fmt.Errorf("%w on port %s: %v", ErrNotNextGen, c.apiPort, err)
+	}
+	return nil
+}
+
+// Close aborts requests in flight and fails later ones, for shutdown
+func (c *Client) Close() {
+	c.cancel()
+	c.transport.CloseIdleConnections()
+}
+
+// UseResolver resolves the gateway hostname with resolver when the gateway
+// IP can't be reached, or when it's dialed with UseHostname
+func (c *Client) UseResolver(resolver *net.Resolver) {
+	c.lookupHost = resolver.LookupHost
+	c.dialer.Resolver = resolver
+}
+
+// UseResolverCache is like UseResolver, resolving the gateway hostname
+// through cache, which may be shared with other clients. Connections opened
+// through a tunnel are left alone.
+func (c *Client) UseResolverCache(cache *resolver.Cache) {
+	c.lookupHost = cache.LookupHost
+	if !c.tunneled {
+		c.dial = cache.Dialer(c.dialer)
+		c.transport.DialContext = c.dial
+		c.transport.CloseIdleConnections()
+	}
+}
+
+// UseHostname makes the client dial the gateway hostname, sending it in the
+// TLS handshake (SNI), instead of the gateway IP. It's for hosts that route
+// traffic to the hostname differently than to the IP, such as with policy
+// routing. The certificate is still checked against the PIA CA.
+func (c *Client) UseHostname() {
+	c.viaHostname = true
+	c.transport.CloseIdleConnections()
+}
+
+// target returns the host the gateway API is dialed at
+func (c *Client) target() string {
+	if c.viaHostname {
+		return c.hostname
 	}
+	return c.gatewayIP
+}
+
+// SetAPIPort changes the port the gateway API is reached on, for gateways that
+// aren't PIA's, such as a mock in tests
+func (c *Client) SetAPIPort(port int) {
+	c.apiPort = strconv.Itoa(port)
+}
+
+// SetHeaders sets headers, such as User-Agent, sent on every gateway request
+func (c *Client) SetHeaders(headers http.Header) {
+	c.headers = headers.Clone()
+}
+
+// UseTracer logs a summary of every gateway request with the given tracer
+func (c *Client) UseTracer(tracer *httplog.Tracer) {
+	c.httpClient.Transport = tracer.Wrap(c.transport)
+}
+
+// SetTransportOptions changes the connection reuse settings for gateway calls
+func (c *Client) SetTransportOptions(opts TransportOptions) {
+	c.transport.IdleConnTimeout = opts.IdleConnTimeout
+	c.transport.MaxIdleConns = opts.MaxIdleConns
+	c.transport.MaxIdleConnsPerHost = opts.MaxIdleConns
+	c.transport.DisableKeepAlives = opts.IdleConnTimeout == 0
 }
 
 // GetPortForwarding obtains port forwarding information from the PIA API
@@ -107,7 +393,7 @@ func (c *Client) GetPortForwarding() (*PortForwardingInfo, error) {
 // BindPort binds the port to the VPN connection
 func (c *Client) BindPort(payload, signature string) error {
 	// Build the URL
-	apiURL := fmt.Sprintf("https://%s:%s/%s", c.hostname, APIPort, BindPortEndpoint)
+	apiURL := fmt.Sprintf("https://%s/%s", net.JoinHostPort(c.hostname, c.apiPort), BindPortEndpoint)
 
 	// Create query parameters
 	params := url.Values{}
@@ -115,37 +401,30 @@ func (c *Client) BindPort(payload, signature string) error {
 	params.Add("signature", signature)
 
 	// Create request
-	req, err := http.NewRequest("GET", apiURL, nil)
+	req, err := http.NewRequestWithContext(c.ctx, "GET", apiURL, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 
-	// Add query parameters
+	// Add query parameters and headers
 	req.URL.RawQuery = params.Encode()
-
-	// Set up the host header for SNI
-	req.Host = c.hostname
-
-	// Modify the request to connect to the gateway IP instead of the hostname
-	req.URL.Host = fmt.Sprintf("%s:%s", c.gatewayIP, APIPort)
+	addHeaders(req, c.headers)
 
 	// Send the request
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.send(req)
 	if err != nil {
 		return fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	// Read the response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read response body: %w", err)
+	if resp.StatusCode != http.StatusOK {
+		return httpjson.StatusError(resp)
 	}
 
 	// Parse the response
 	var bindResp BindPortResponse
-	if err := json.Unmarshal(body, &bindResp); err != nil {
-		return fmt.Errorf("failed to parse response: %w", err)
+	if err := httpjson.Decode(resp, &bindResp); err != nil {
+		return err
 	}
 
 	// Check if the binding was successful
@@ -159,54 +438,111 @@ func (c *Client) BindPort(payload, signature string) error {
 // getSignature gets a port forwarding signature from the PIA API
 func (c *Client) getSignature() (*PayloadAndSignature, error) {
 	// Build the URL
-	apiURL := fmt.Sprintf("https://%s:%s/%s", c.hostname, APIPort, SignatureEndpoint)
+	apiURL := fmt.Sprintf("https://%s/%s", net.JoinHostPort(c.hostname, c.apiPort), SignatureEndpoint)
 
 	// Create query parameters
 	params := url.Values{}
 	params.Add("token", c.token)
 
 	// Create request
-	req, err := http.NewRequest("GET", apiURL, nil)
+	req, err := http.NewRequestWithContext(c.ctx, "GET", apiURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	// Add query parameters
+	// Add query parameters and headers
 	req.URL.RawQuery = params.Encode()
-
-	// Set up the host header for SNI
-	req.Host = c.hostname
-
-	// Modify the request to connect to the gateway IP instead of the hostname
-	req.URL.Host = fmt.Sprintf("%s:%s", c.gatewayIP, APIPort)
+	addHeaders(req, c.headers)
 
 	// Send the request
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.send(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	// Read the response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+	// The token is rejected with an HTTP status even if the body isn't JSON
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, fmt.Errorf("%w: %s", ErrAuthRejected, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, httpjson.StatusError(resp)
 	}
 
 	// Parse the response
 	var payloadAndSig PayloadAndSignature
-	if err := json.Unmarshal(body, &payloadAndSig); err != nil {
-		return nil, fmt.Errorf("failed to parse response: %w", err)
+	if err := httpjson.Decode(resp, &payloadAndSig); err != nil {
+		return nil, err
 	}
 
 	// Check if the request was successful
 	if payloadAndSig.Status != "OK" {
-		return nil, fmt.Errorf("failed to get signature: status=%s", payloadAndSig.Status)
+		if isAuthMessage(payloadAndSig.Message) {
+			return nil, fmt.Errorf("%w: status=%s, message=%s", ErrAuthRejected, payloadAndSig.Status, payloadAndSig.Message)
+		}
+		return nil, fmt.Errorf("failed to get signature: status=%s, message=%s", payloadAndSig.Status, payloadAndSig.Message)
 	}
 
+	// Keep the signature and the payload, which holds the token, out of the logs
+	redact.Default.Add("signature", payloadAndSig.Signature)
+	redact.Default.Add("payload", payloadAndSig.Payload)
 	return &payloadAndSig, nil
 }
 
+// send sends req to the gateway IP, with the hostname in the Host header. If
+// the gateway IP fails, because it's stale or the TLS handshake fails, the
+// addresses the hostname resolves to are tried before giving up. With
+// UseHostname, the hostname is dialed instead and there's nothing to fall
+// back to.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	req.Host = c.hostname
+	req.URL.Host = net.JoinHostPort(c.target(), c.apiPort)
+	resp, err := c.do(req)
+	if err == nil || req.Context().Err() != nil || c.viaHostname {
+		return resp, err
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), lookupTimeout)
+	addrs, lookupErr := c.lookupHost(ctx, c.hostname)
+	cancel()
+	if lookupErr != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if addr == c.gatewayIP {
+			continue
+		}
+		retry := req.Clone(req.Context())
+		retry.URL.Host = net.JoinHostPort(addr, c.apiPort)
+		if resp, retryErr := c.do(retry); retryErr == nil {
+			log.Printf("Gateway %s failed (%v), reached %s at %s instead", c.gatewayIP, err, c.hostname, addr)
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+// do sends req, recording how long the gateway took to respond if it did
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := c.httpClient.Do(req)
+	if err == nil {
+		requestLatency.With(path.Base(req.URL.Path)).Observe(time.Since(start).Seconds())
+	}
+	return resp, err
+}
+
+// isAuthMessage reports whether a gateway error message is about the token
+func isAuthMessage(message string) bool {
+	message = strings.ToLower(message)
+	for _, word := range []string{"token", "auth", "unauthorized", "forbidden"} {
+		if strings.Contains(message, word) {
+			return true
+		}
+	}
+	return false
+}
+
 // decodePayload decodes the base64-encoded payload
 func decodePayload(payload string) (*PayloadData, error) {
 	// Decode the payload from base64
@@ -239,3 +575,45 @@ func WritePortToFile(port int, filePath string) error {
 
 	return nil
 }
+
+// PortFile is what the json output format writes to the output file
+type PortFile struct {
+	Port int `json:"port"`
+	// When the signature expires and PIA stops honoring the port
+	ExpiresAt time.Time `json:"expires_at"`
+	// When a new signature, usually with a different port, is requested
+	RenewsAt time.Time `json:"renews_at"`
+	// Ports before it still in their grace period, newest first
+	PreviousPorts []int `json:"previous_ports,omitempty"`
+}
+
+// WritePortJSON writes the port, how long its signature is valid, when it's
+// renewed and the previous ports still in their grace period to a file as
+// JSON, replacing the file atomically so readers never see partial JSON
+func WritePortJSON(port int, expiresAt, renewsAt time.Time, previousPorts []int, filePath string) error {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	data, err := EncodePortJSON(port, expiresAt, renewsAt, previousPorts)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filePath, data, 0644)
+}
+
+// EncodePortJSON returns the JSON WritePortJSON writes
+func EncodePortJSON(port int, expiresAt, renewsAt time.Time, previousPorts []int) ([]byte, error) {
+	data, err := json.MarshalIndent(PortFile{Port: port, ExpiresAt: expiresAt, RenewsAt: renewsAt, PreviousPorts: previousPorts}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode port: %w", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// addHeaders sets the given headers on req, replacing any it already has
+func addHeaders(req *http.Request, headers http.Header) {
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+}
@@ -1,14 +1,37 @@
 package portforwarding
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/meschansky/go-pia/internal/redact"
 )
 
+// serverCA writes the test server's self-signed certificate to a file, so the
+// client trusts it the way it trusts the PIA CA
+func serverCA(t *testing.T, server *httptest.Server) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.crt")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to write CA certificate: %v", err)
+	}
+	return path
+}
+
 // mockClient is a test implementation of the Client
 type mockClient struct {
 	token      string
@@ -176,6 +199,41 @@ func TestWritePortToFile(t *testing.T) {
 	}
 }
 
+func TestWritePortJSON(t *testing.T) {
+	outputFile := filepath.Join(t.TempDir(), "port.json")
+	expiresAt := time.Date(2024, time.March, 3, 12, 0, 0, 0, time.UTC)
+
+	if err := WritePortJSON(12345, expiresAt, RenewsAt(expiresAt), []int{23456, 34567}, outputFile); err != nil {
+		t.Fatalf("Failed to write port to file: %v", err)
+	}
+
+	data, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("Failed to read output file: %v", err)
+	}
+	var decoded map[string]any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to parse output file: %v", err)
+	}
+	expected := map[string]any{
+		"port":           float64(12345),
+		"expires_at":     "2024-03-03T12:00:00Z",
+		"renews_at":      "2024-03-02T12:00:00Z",
+		"previous_ports": []any{float64(23456), float64(34567)},
+	}
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Errorf("Expected %v, got %v", expected, decoded)
+	}
+
+	// Without previous ports, the field is left out
+	if err := WritePortJSON(12345, expiresAt, RenewsAt(expiresAt), nil, outputFile); err != nil {
+		t.Fatalf("Failed to write port to file: %v", err)
+	}
+	if data, err := os.ReadFile(outputFile); err != nil || strings.Contains(string(data), "previous_ports") {
+		t.Errorf("Expected no previous ports, got %s (%v)", data, err)
+	}
+}
+
 func TestErrorHandling(t *testing.T) {
 	// This test is simplified since we're using mock clients
 	// In a real implementation, we would test error handling more thoroughly
@@ -214,3 +272,497 @@ func TestErrorHandling(t *testing.T) {
 		t.Errorf("Expected error from bindPort with invalid server but got nil")
 	}
 }
+
+func TestClientIPv6Gateway(t *testing.T) {
+	// Serve the PIA API on the IPv6 loopback address
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+
+	payload := base64.StdEncoding.EncodeToString([]byte(`{"port":12345,"expires_at":"2030-01-01T00:00:00Z"}`))
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "test.privacy.network" {
+			t.Errorf("Expected Host header test.privacy.network, got %s", r.Host)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/" + SignatureEndpoint:
+			w.Write([]byte(`{"status":"OK","payload":"` + payload + `","signature":"test-signature"}`))
+		case "/" + BindPortEndpoint:
+			w.Write([]byte(`{"status":"OK","message":"port scheduled for add"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	server.Listener = listener
+	server.StartTLS()
+	defer server.Close()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	client := NewClient("test-token", "::1", "test.privacy.network", serverCA(t, server))
+	client.apiPort = port
+
+	pfInfo, err := client.GetPortForwarding()
+	if err != nil {
+		t.Fatalf("Failed to get port forwarding over IPv6: %v", err)
+	}
+	if pfInfo.Port != 12345 {
+		t.Errorf("Expected port 12345, got %d", pfInfo.Port)
+	}
+
+	if err := client.BindPort(pfInfo.Payload, pfInfo.Signature); err != nil {
+		t.Errorf("Failed to bind port over IPv6: %v", err)
+	}
+}
+
+func TestClientReusesConnections(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"OK","message":"port scheduled for add"}`))
+	}))
+	defer server.Close()
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	testCases := []struct {
+		name               string
+		opts               TransportOptions
+		expectedHandshakes uint64
+	}{
+		{
+			name:               "Keep-alives enabled",
+			opts:               DefaultTransportOptions(),
+			expectedHandshakes: 1,
+		},
+		{
+			name:               "Keep-alives disabled",
+			opts:               TransportOptions{IdleConnTimeout: 0},
+			expectedHandshakes: 3,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := NewClient("test-token", "127.0.0.1", "test.privacy.network", serverCA(t, server))
+			client.apiPort = port
+			client.SetTransportOptions(tc.opts)
+
+			before := tlsHandshakes.Value()
+			for i := 0; i < 3; i++ {
+				if err := client.BindPort("test-payload", "test-signature"); err != nil {
+					t.Fatalf("Failed to bind port: %v", err)
+				}
+			}
+
+			if handshakes := tlsHandshakes.Value() - before; handshakes != tc.expectedHandshakes {
+				t.Errorf("Expected %d handshakes, got %d", tc.expectedHandshakes, handshakes)
+			}
+		})
+	}
+}
+
+func TestClientRecordsLatency(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"OK","message":"port scheduled for add"}`))
+	}))
+	defer server.Close()
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	client := NewClient("test-token", "127.0.0.1", "test.privacy.network", serverCA(t, server))
+	client.apiPort = port
+
+	latency := requestLatency.With(BindPortEndpoint)
+	count, sum := latency.Count(), latency.Sum()
+	for i := 0; i < 2; i++ {
+		if err := client.BindPort("test-payload", "test-signature"); err != nil {
+			t.Fatalf("Failed to bind port: %v", err)
+		}
+	}
+
+	if got := latency.Count() - count; got != 2 {
+		t.Errorf("Expected 2 bindPort round trips recorded, got %d", got)
+	}
+	if got := latency.Sum() - sum; got < 0.02 {
+		t.Errorf("Expected at least 20ms of bindPort round trips, got %vs", got)
+	}
+	if found, ok := Latency(BindPortEndpoint); !ok || found != latency {
+		t.Errorf("Expected Latency to return the bindPort summary")
+	}
+}
+
+func TestGetSignatureAuthErrors(t *testing.T) {
+	testCases := []struct {
+		name       string
+		statusCode int
+		body       string
+		expectAuth bool
+	}{
+		{
+			name:       "Unauthorized status",
+			statusCode: http.StatusUnauthorized,
+			body:       "Unauthorized",
+			expectAuth: true,
+		},
+		{
+			name:       "Forbidden status",
+			statusCode: http.StatusForbidden,
+			body:       `{"status":"ERROR"}`,
+			expectAuth: true,
+		},
+		{
+			name:       "Invalid token message",
+			statusCode: http.StatusOK,
+			body:       `{"status":"ERROR","message":"Invalid token"}`,
+			expectAuth: true,
+		},
+		{
+			name:       "Other error",
+			statusCode: http.StatusOK,
+			body:       `{"status":"ERROR","message":"port forwarding not supported on this server"}`,
+			expectAuth: false,
+		},
+		{
+			name:       "Server error",
+			statusCode: http.StatusInternalServerError,
+			body:       "internal error",
+			expectAuth: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.statusCode)
+				w.Write([]byte(tc.body))
+			}))
+			defer server.Close()
+
+			_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+			client := NewClient("test-token", "127.0.0.1", "test.privacy.network", serverCA(t, server))
+			client.apiPort = port
+
+			_, err := client.GetPortForwarding()
+			if err == nil {
+				t.Fatalf("Expected error but got nil")
+			}
+			if isAuth := errors.Is(err, ErrAuthRejected); isAuth != tc.expectAuth {
+				t.Errorf("Expected errors.Is(err, ErrAuthRejected)=%v, got %v (%v)", tc.expectAuth, isAuth, err)
+			}
+		})
+	}
+}
+
+func TestClientSendsHeaders(t *testing.T) {
+	payload := base64.StdEncoding.EncodeToString([]byte(`{"port":12345,"expires_at":"2030-01-01T00:00:00Z"}`))
+	var userAgents []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents = append(userAgents, r.Header.Get("User-Agent"))
+		if r.Header.Get("X-Debug") != "1" {
+			t.Errorf("Expected X-Debug header on %s, got %q", r.URL.Path, r.Header.Get("X-Debug"))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/" + SignatureEndpoint:
+			w.Write([]byte(`{"status":"OK","payload":"` + payload + `","signature":"test-signature"}`))
+		default:
+			w.Write([]byte(`{"status":"OK","message":"port scheduled for add"}`))
+		}
+	}))
+	defer server.Close()
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	client := NewClient("test-token", "127.0.0.1", "test.privacy.network", serverCA(t, server))
+	client.apiPort = port
+	client.SetHeaders(http.Header{"User-Agent": {"go-pia-port-forwarding/v1.2.3"}, "X-Debug": {"1"}})
+
+	pfInfo, err := client.GetPortForwarding()
+	if err != nil {
+		t.Fatalf("Failed to get port forwarding: %v", err)
+	}
+	if err := client.BindPort(pfInfo.Payload, pfInfo.Signature); err != nil {
+		t.Fatalf("Failed to bind port: %v", err)
+	}
+
+	// The signature and token are kept out of the logs
+	if line := redact.Default.String("test-signature test-token"); strings.Contains(line, "test-signature") || strings.Contains(line, "test-token") {
+		t.Errorf("Expected the signature and token to be redacted, got %q", line)
+	}
+
+	if len(userAgents) != 2 || userAgents[0] != "go-pia-port-forwarding/v1.2.3" || userAgents[1] != "go-pia-port-forwarding/v1.2.3" {
+		t.Errorf("Expected the User-Agent on both requests, got %v", userAgents)
+	}
+}
+
+func TestClientProbeGateway(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	client := NewClient("test-token", "127.0.0.2", "old.privacy.network", "")
+	client.apiPort = port
+	client.SetGateway("127.0.0.1", "test.privacy.network")
+	if client.hostname != "test.privacy.network" {
+		t.Errorf("Expected the new hostname, got %q", client.hostname)
+	}
+
+	if err := client.ProbeGateway(); err != nil {
+		t.Errorf("Expected the gateway to be reachable, got %v", err)
+	}
+
+	listener.Close()
+	if err := client.ProbeGateway(); err == nil {
+		t.Errorf("Expected an error once the gateway stopped listening")
+	}
+}
+
+func TestClientCheckNextGen(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	client := NewClient("test-token", "127.0.0.1", "test.privacy.network", "")
+	client.apiPort = port
+	if err := client.CheckNextGen(); err != nil {
+		t.Errorf("Expected a gateway serving the API to be next-gen, got %v", err)
+	}
+
+	// Legacy servers have nothing listening on the API port
+	listener.Close()
+	if err := client.CheckNextGen(); !errors.Is(err, ErrNotNextGen) {
+		t.Errorf("Expected ErrNotNextGen without the API, got %v", err)
+	}
+}
+
+func TestClientProbeGatewayTunneled(t *testing.T) {
+	origTimeout := probeTimeout
+	probeTimeout = 50 * time.Millisecond
+	defer func() { probeTimeout = origTimeout }()
+
+	testCases := []struct {
+		name        string
+		reachable   bool
+		expectError bool
+	}{
+		{name: "Gateway reached", reachable: true},
+		{name: "Tunnel closed by the far end", expectError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := NewClient("test-token", "10.8.110.1", "test.privacy.network", "")
+			var dialed string
+			client.SetTunnel(func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dialed = addr
+				local, far := net.Pipe()
+				if !tc.reachable {
+					far.Close()
+				}
+				t.Cleanup(func() { far.Close() })
+				return local, nil
+			})
+
+			err := client.ProbeGateway()
+			if tc.expectError != (err != nil) {
+				t.Errorf("Expected error: %v, got %v", tc.expectError, err)
+			}
+			if dialed != "10.8.110.1:19999" {
+				t.Errorf("Expected the tunnel to the gateway API, got %q", dialed)
+			}
+		})
+	}
+}
+
+func TestClientRejectsUntrustedGateway(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Untrusted gateway received a request: %s", r.URL.RequestURI())
+	}))
+	defer server.Close()
+
+	notPEM := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0644); err != nil {
+		t.Fatalf("Failed to write CA certificate: %v", err)
+	}
+
+	testCases := []struct {
+		name        string
+		caCertPath  string
+		expectError string
+	}{
+		{name: "Signed by another CA", caCertPath: filepath.Join("..", "..", "ca.rsa.4096.crt"), expectError: "unknown authority"},
+		{name: "No CA configured", caCertPath: "", expectError: "no PIA CA certificate configured"},
+		{name: "Unreadable CA", caCertPath: filepath.Join(t.TempDir(), "missing.crt"), expectError: "failed to read PIA CA certificate"},
+		{name: "CA without certificates", caCertPath: notPEM, expectError: "no certificates found"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+			client := NewClient("test-token", "127.0.0.1", "test.privacy.network", tc.caCertPath)
+			client.apiPort = port
+
+			_, err := client.GetPortForwarding()
+			if !errors.Is(err, ErrUntrustedGateway) || !strings.Contains(err.Error(), tc.expectError) {
+				t.Errorf("Expected ErrUntrustedGateway containing %q, got %v", tc.expectError, err)
+			}
+		})
+	}
+}
+
+func TestClientFallsBackToHostname(t *testing.T) {
+	payload := base64.StdEncoding.EncodeToString([]byte(`{"port":12345,"expires_at":"2030-01-01T00:00:00Z"}`))
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"OK","payload":"` + payload + `","signature":"test-signature"}`))
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	testCases := []struct {
+		name        string
+		addrs       []string
+		lookupErr   error
+		expectError bool
+	}{
+		{name: "Hostname resolves to the gateway", addrs: []string{"127.0.0.2", "127.0.0.1"}},
+		{name: "Hostname resolves to the stale IP only", addrs: []string{"127.0.0.2"}, expectError: true},
+		{name: "Hostname doesn't resolve", lookupErr: errors.New("no such host"), expectError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Nothing listens on the stale gateway IP
+			client := NewClient("test-token", "127.0.0.2", "test.privacy.network", serverCA(t, server))
+			client.apiPort = port
+			client.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+				if host != "test.privacy.network" {
+					t.Errorf("Expected the gateway hostname to be resolved, got %s", host)
+				}
+				return tc.addrs, tc.lookupErr
+			}
+
+			pfInfo, err := client.GetPortForwarding()
+			if tc.expectError {
+				if err == nil || !strings.Contains(err.Error(), "127.0.0.2") {
+					t.Errorf("Expected the gateway IP's error, got %v", err)
+				}
+			} else if err != nil || pfInfo.Port != 12345 {
+				t.Errorf("Expected port 12345 through the hostname, got %v (%v)", pfInfo, err)
+			}
+		})
+	}
+}
+
+func TestClientUseHostname(t *testing.T) {
+	payload := base64.StdEncoding.EncodeToString([]byte(`{"port":12345,"expires_at":"2030-01-01T00:00:00Z"}`))
+	var serverName string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"OK","payload":"` + payload + `","signature":"test-signature"}`))
+	}))
+	server.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		serverName = hello.ServerName
+		return nil, nil
+	}}
+	server.StartTLS()
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	// Nothing listens on the gateway IP, only where the hostname resolves to
+	client := NewClient("test-token", "127.0.0.2", "localhost", serverCA(t, server))
+	client.apiPort = port
+	client.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		t.Errorf("Expected no fallback lookup of %s", host)
+		return nil, errors.New("unexpected lookup")
+	}
+	client.UseHostname()
+
+	if err := client.ProbeGateway(); err != nil {
+		t.Errorf("Expected the hostname to be probed, got %v", err)
+	}
+	pfInfo, err := client.GetPortForwarding()
+	if err != nil || pfInfo.Port != 12345 {
+		t.Fatalf("Expected port 12345 through the hostname, got %v (%v)", pfInfo, err)
+	}
+	if serverName != "localhost" {
+		t.Errorf("Expected the hostname as SNI, got %q", serverName)
+	}
+}
+
+func TestGetSignatureUnexpectedResponses(t *testing.T) {
+	testCases := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		expectError string
+	}{
+		{name: "Gateway error", status: http.StatusBadGateway, contentType: "text/html", body: "<h1>502 Bad Gateway</h1>", expectError: `unexpected HTTP status 502 Bad Gateway: "<h1>502 Bad Gateway</h1>"`},
+		{name: "Block page", status: http.StatusOK, contentType: "text/html", body: "<html>Blocked by your network</html>", expectError: "expected JSON, got text/html"},
+		{name: "Truncated JSON", status: http.StatusOK, contentType: "application/json", body: `{"status":"OK","payl`, expectError: `failed to parse response (HTTP 200)`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tc.contentType)
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer server.Close()
+
+			_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+			client := NewClient("test-token", "127.0.0.1", "test.privacy.network", serverCA(t, server))
+			client.apiPort = port
+
+			_, err := client.GetPortForwarding()
+			if err == nil || !strings.Contains(err.Error(), tc.expectError) {
+				t.Errorf("Expected an error containing %q, got %v", tc.expectError, err)
+			}
+			if errors.Is(err, ErrAuthRejected) {
+				t.Errorf("Expected the token to be kept, got %v", err)
+			}
+		})
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	started := make(chan struct{})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	client := NewClient("test-token", "127.0.0.1", "test.privacy.network", serverCA(t, server))
+	client.apiPort = port
+
+	// Close aborts the request in flight rather than waiting for the timeout
+	result := make(chan error, 1)
+	go func() { result <- client.BindPort("test-payload", "test-signature") }()
+	<-started
+	client.Close()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected the bind to be canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected Close to abort the bind")
+	}
+
+	// Later requests fail right away
+	if err := client.BindPort("test-payload", "test-signature"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected binds after Close to fail, got %v", err)
+	}
+}
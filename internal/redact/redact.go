@@ -0,0 +1,124 @@
+package redact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// minSecretLen is the shortest value treated as a secret; shorter values would
+// redact ordinary words and numbers
+const minSecretLen = 6
+
+// maxSecrets bounds how many secrets are remembered, the oldest are forgotten
+// first. Tokens and signatures are replaced regularly, so old ones stop mattering.
+const maxSecrets = 64
+
+// Default is the redactor the log output is filtered through; clients add the
+// secrets they handle to it
+var Default = New()
+
+// secret is a value to hide and what to call it in its place
+type secret struct {
+	value       string
+	replacement string
+}
+
+// Redactor replaces known secret values with a label and fingerprint
+type Redactor struct {
+	mu sync.RWMutex
+	// Registered secrets, oldest first
+	secrets []secret
+	// The same secrets, longest first, so one containing another is hidden whole
+	byLength []secret
+}
+
+// New creates a redactor without secrets
+func New() *Redactor {
+	return &Redactor{}
+}
+
+// Fingerprint identifies a secret without revealing it, so two log lines can
+// be compared: the first 8 hex digits of its SHA-256 hash
+func Fingerprint(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:4])
+}
+
+// Add registers a secret, such as a token or password, under a label like
+// "token". Its URL-encoded form is hidden too. Values shorter than 6 characters
+// are ignored.
+func (r *Redactor) Add(label, value string) {
+	if len(value) < minSecretLen {
+		return
+	}
+	replacement := "[" + label + " " + Fingerprint(value) + "]"
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, v := range []string{value, url.QueryEscape(value)} {
+		if r.has(v) {
+			continue
+		}
+		r.secrets = append(r.secrets, secret{value: v, replacement: replacement})
+	}
+	if len(r.secrets) > maxSecrets {
+		r.secrets = append(r.secrets[:0:0], r.secrets[len(r.secrets)-maxSecrets:]...)
+	}
+
+	r.byLength = append(r.byLength[:0:0], r.secrets...)
+	sort.SliceStable(r.byLength, func(i, j int) bool {
+		return len(r.byLength[i].value) > len(r.byLength[j].value)
+	})
+}
+
+// has reports whether value is already registered; r.mu must be held
+func (r *Redactor) has(value string) bool {
+	for _, s := range r.secrets {
+		if s.value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// String replaces every registered secret in s
+func (r *Redactor) String(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, secret := range r.byLength {
+		if strings.Contains(s, secret.value) {
+			s = strings.ReplaceAll(s, secret.value, secret.replacement)
+		}
+	}
+	return s
+}
+
+// Writer returns a writer that redacts secrets before writing to w. The log
+// package writes each entry with a single call, so secrets aren't split
+// across writes.
+func (r *Redactor) Writer(w io.Writer) io.Writer {
+	if rw, ok := w.(*writer); ok && rw.r == r {
+		return w
+	}
+	return &writer{r: r, w: w}
+}
+
+// writer redacts everything written to it
+type writer struct {
+	r *Redactor
+	w io.Writer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, w.r.String(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,101 @@
+package redact
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestRedactorString(t *testing.T) {
+	r := New()
+	r.Add("token", "abcdef0123456789")
+	r.Add("password", "p@ss word!")
+	r.Add("token", "abcdef0123456789extended")
+	r.Add("password", "short")
+
+	token := "[token " + Fingerprint("abcdef0123456789") + "]"
+	extended := "[token " + Fingerprint("abcdef0123456789extended") + "]"
+	password := "[password " + Fingerprint("p@ss word!") + "]"
+
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "Token",
+			input:    "using token abcdef0123456789",
+			expected: "using token " + token,
+		},
+		{
+			name:     "Secret containing another is hidden whole",
+			input:    "token abcdef0123456789extended",
+			expected: "token " + extended,
+		},
+		{
+			name:     "URL-encoded password",
+			input:    "username=user&password=p%40ss+word%21",
+			expected: "username=user&password=" + password,
+		},
+		{
+			name:     "Several occurrences",
+			input:    "p@ss word! and p@ss word!",
+			expected: password + " and " + password,
+		},
+		{
+			name:     "Short values aren't secrets",
+			input:    "short circuit",
+			expected: "short circuit",
+		},
+		{
+			name:     "Nothing to redact",
+			input:    "Successfully bound port 12345",
+			expected: "Successfully bound port 12345",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if redacted := r.String(tc.input); redacted != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, redacted)
+			}
+		})
+	}
+}
+
+func TestRedactorForgetsOldestSecrets(t *testing.T) {
+	r := New()
+	for i := 0; i <= maxSecrets; i++ {
+		r.Add("token", fmt.Sprintf("token-%04d", i))
+	}
+
+	if redacted := r.String("token-0000"); redacted != "token-0000" {
+		t.Errorf("Expected the oldest token to be forgotten, got %q", redacted)
+	}
+	if redacted := r.String(fmt.Sprintf("token-%04d", maxSecrets)); !strings.HasPrefix(redacted, "[token ") {
+		t.Errorf("Expected the newest token to be redacted, got %q", redacted)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	r := New()
+	r.Add("signature", "c2lnbmF0dXJlLXZhbHVl")
+
+	var b bytes.Buffer
+	w := r.Writer(&b)
+	if r.Writer(w) != w {
+		t.Errorf("Expected wrapping a redacting writer again to return it unchanged")
+	}
+
+	logger := log.New(w, "", 0)
+	logger.Printf("Binding with signature %s", "c2lnbmF0dXJlLXZhbHVl")
+
+	if strings.Contains(b.String(), "c2lnbmF0dXJlLXZhbHVl") {
+		t.Errorf("Expected the signature to be redacted, got %q", b.String())
+	}
+	if !strings.Contains(b.String(), "[signature "+Fingerprint("c2lnbmF0dXJlLXZhbHVl")+"]") {
+		t.Errorf("Expected the signature fingerprint, got %q", b.String())
+	}
+}
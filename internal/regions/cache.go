@@ -0,0 +1,99 @@
+package regions
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/atomicfile"
+)
+
+// CachePathFor returns the server list cache used alongside the given output file
+func CachePathFor(outputFile string) string {
+	return outputFile + ".servers.json"
+}
+
+// Cache keeps the last server list downloaded in a file. It's used instead of
+// downloading while it's fresh, and whenever a download fails, so regions can
+// still be looked up while PIA's server list is unreachable.
+type Cache struct {
+	// File the server list is kept in, as downloaded; nothing is kept if empty
+	Path string
+	// How long the cached list is used without downloading it again; 0
+	// downloads every time and only falls back to the cache
+	TTL time.Duration
+	// Key the list must be signed with, usually PIAKey, or nil to trust it
+	// unchecked as PIA's own scripts do
+	PublicKey *rsa.PublicKey
+}
+
+// Fetch returns the cached server list if it's younger than TTL. Otherwise it
+// downloads the list from url and caches it. If that fails, the cached list is
+// used whatever its age, with a warning.
+func (c *Cache) Fetch(ctx context.Context, client *http.Client, url string) (*List, error) {
+	if c.TTL > 0 {
+		if list, age, err := c.load(); err == nil && age < c.TTL {
+			return list, nil
+		}
+	}
+
+	data, err := download(ctx, client, url)
+	if err == nil {
+		var list *List
+		if list, err = c.parse(data); err == nil {
+			if err := c.save(data); err != nil {
+				log.Printf("Warning: failed to cache the server list: %v", err)
+			}
+			return list, nil
+		}
+	}
+
+	list, age, cacheErr := c.load()
+	if cacheErr != nil {
+		return nil, err
+	}
+	log.Printf("Warning: %v; using the server list cached %s ago", err, age.Round(time.Second))
+	return list, nil
+}
+
+// load returns the cached server list and how old it is
+func (c *Cache) load() (*List, time.Duration, error) {
+	if c.Path == "" {
+		return nil, 0, errors.New("the server list isn't cached")
+	}
+	info, err := os.Stat(c.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := os.ReadFile(c.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+	list, err := c.parse(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return list, time.Since(info.ModTime()), nil
+}
+
+// parse verifies the server list's signature if there's a key, and parses it
+func (c *Cache) parse(data []byte) (*List, error) {
+	if c.PublicKey != nil {
+		if err := Verify(data, c.PublicKey); err != nil {
+			return nil, err
+		}
+	}
+	return Parse(data)
+}
+
+// save atomically replaces the cached server list with data
+func (c *Cache) save(data []byte) error {
+	if c.Path == "" {
+		return nil
+	}
+	return atomicfile.WriteFile(c.Path, data, 0644)
+}
@@ -0,0 +1,121 @@
+package regions
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	requests := 0
+	available := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if !available {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(testServerList))
+	}))
+	defer server.Close()
+
+	cache := &Cache{Path: filepath.Join(t.TempDir(), "servers.json"), TTL: time.Hour}
+	fetch := func() (*List, error) {
+		return cache.Fetch(context.Background(), server.Client(), server.URL)
+	}
+
+	// Nothing cached, and the download fails
+	available = false
+	if _, err := fetch(); err == nil {
+		t.Fatal("Expected an error without a cached list")
+	}
+
+	// The download is cached and used while it's fresh
+	available = true
+	if list, err := fetch(); err != nil || len(list.Regions) != 5 {
+		t.Fatalf("Expected the downloaded list, got %v (%v)", list, err)
+	}
+	if list, err := fetch(); err != nil || len(list.Regions) != 5 || requests != 2 {
+		t.Fatalf("Expected the cached list without a download, got %v (%v) after %d requests", list, err, requests)
+	}
+
+	// A stale cache is downloaded again, and used if that fails
+	stale := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(cache.Path, stale, stale)
+	available = false
+	if list, err := fetch(); err != nil || len(list.Regions) != 5 || requests != 3 {
+		t.Fatalf("Expected the stale list after a failed download, got %v (%v) after %d requests", list, err, requests)
+	}
+
+	// Without a TTL every fetch downloads
+	cache.TTL = 0
+	available = true
+	if _, err := fetch(); err != nil || requests != 4 {
+		t.Fatalf("Expected a download, got %v after %d requests", err, requests)
+	}
+}
+
+func TestCacheVerifiesSignature(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	body := signedServerList(t, key)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	cache := &Cache{Path: filepath.Join(t.TempDir(), "servers.json"), PublicKey: &key.PublicKey}
+	fetch := func() (*List, error) {
+		return cache.Fetch(context.Background(), server.Client(), server.URL)
+	}
+	if _, err := fetch(); err != nil {
+		t.Fatalf("Expected the signed list, got %v", err)
+	}
+
+	// A tampered download is rejected in favor of the verified copy
+	body = strings.Replace(body, "212.102.57.138", "203.0.113.1", 1)
+	list, err := fetch()
+	if err != nil {
+		t.Fatalf("Expected the cached list, got %v", err)
+	}
+	if region, _ := list.Find(GroupOpenVPN, "212.102.57.138"); region.ID != "de-frankfurt" {
+		t.Errorf("Expected the untampered server, got %+v", region)
+	}
+
+	// A tampered cache isn't used either
+	os.WriteFile(cache.Path, []byte(body), 0644)
+	if _, err := fetch(); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Expected ErrBadSignature, got %v", err)
+	}
+}
+
+func TestCacheWithoutPath(t *testing.T) {
+	available := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(testServerList))
+	}))
+	defer server.Close()
+
+	cache := &Cache{TTL: time.Hour}
+	if list, err := cache.Fetch(context.Background(), server.Client(), server.URL); err != nil || len(list.Regions) != 5 {
+		t.Fatalf("Expected the downloaded list, got %v (%v)", list, err)
+	}
+	available = false
+	if _, err := cache.Fetch(context.Background(), server.Client(), server.URL); err == nil {
+		t.Error("Expected the failed download's error with nothing cached")
+	}
+}
@@ -0,0 +1,195 @@
+// Package regions reads PIA's server list and ranks the regions that allow
+// port forwarding by latency
+package regions
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// ServerListURL is where PIA publishes its regions and servers
+	ServerListURL = "https://serverlist.piaservers.net/vpninfo/servers/v6"
+	// latencyTimeout is how long a region's server may take to accept a connection
+	latencyTimeout = 2 * time.Second
+	// maxConcurrentProbes bounds how many regions are measured at once
+	maxConcurrentProbes = 16
+	// maxServerListSize bounds the server list download
+	maxServerListSize = 4 << 20
+)
+
+// Server groups in the server list
+const (
+	GroupMeta       = "meta"
+	GroupWireGuard  = "wg"
+	GroupOpenVPN    = "ovpnudp"
+	GroupOpenVPNTCP = "ovpntcp"
+)
+
+// Server is a VPN server in a region
+type Server struct {
+	IP string `json:"ip"`
+	// Common name of the server's certificate, such as amsterdam407
+	CN string `json:"cn"`
+}
+
+// Region is a PIA location and its servers, keyed by group
+type Region struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Hostname that resolves to the region's OpenVPN servers
+	DNS         string              `json:"dns"`
+	PortForward bool                `json:"port_forward"`
+	Offline     bool                `json:"offline"`
+	Servers     map[string][]Server `json:"servers"`
+}
+
+// List is PIA's server list
+type List struct {
+	Regions []Region `json:"regions"`
+}
+
+// Fetch downloads the server list from url
+func Fetch(ctx context.Context, client *http.Client, url string) (*List, error) {
+	data, err := download(ctx, client, url)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// download returns the server list document at url
+func download(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the server list: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch the server list: HTTP %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxServerListSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the server list: %w", err)
+	}
+	return data, nil
+}
+
+// Parse parses the server list. Its first line is the JSON document; the
+// signature that follows is left to Verify.
+func Parse(data []byte) (*List, error) {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		data = data[:i]
+	}
+
+	var list List
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse the server list: %w", err)
+	}
+	return &list, nil
+}
+
+// Find returns the region with a server in group at host, or named host, or
+// whose DNS name is host
+func (l *List) Find(group, host string) (Region, bool) {
+	if host == "" {
+		return Region{}, false
+	}
+	for _, region := range l.Regions {
+		if region.DNS == host {
+			return region, true
+		}
+		for _, server := range region.Servers[group] {
+			if server.IP == host || server.CN == host {
+				return region, true
+			}
+		}
+	}
+	return Region{}, false
+}
+
+// Ranked is a region and how long its server took to accept a connection
+type Ranked struct {
+	Region  Region
+	Server  Server
+	Latency time.Duration
+}
+
+// MeasureFunc measures the latency to a server
+type MeasureFunc func(ctx context.Context, ip string) (time.Duration, error)
+
+// Rank returns the online regions that allow port forwarding and have servers
+// in group, fastest first, leaving out those in exclude and those that can't
+// be reached. Latency is measured to each region's meta server, as PIA's
+// scripts do, or its first server in group if it has none.
+func (l *List) Rank(ctx context.Context, group string, exclude []string, measure MeasureFunc) []Ranked {
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		ranked []Ranked
+	)
+	slots := make(chan struct{}, maxConcurrentProbes)
+	for _, region := range l.Regions {
+		servers := region.Servers[group]
+		if !region.PortForward || region.Offline || len(servers) == 0 || slices.Contains(exclude, region.ID) {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			target := servers[0].IP
+			if meta := region.Servers[GroupMeta]; len(meta) > 0 {
+				target = meta[0].IP
+			}
+			latency, err := measure(ctx, target)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			ranked = append(ranked, Ranked{Region: region, Server: servers[0], Latency: latency})
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Latency != ranked[j].Latency {
+			return ranked[i].Latency < ranked[j].Latency
+		}
+		return ranked[i].Region.ID < ranked[j].Region.ID
+	})
+	return ranked
+}
+
+// DialLatency measures how long a TCP connection to port 443 of ip takes to open
+func DialLatency(ctx context.Context, ip string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, latencyTimeout)
+	defer cancel()
+
+	start := time.Now()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip, "443"))
+	if err != nil {
+		return 0, err
+	}
+	conn.Close()
+	return time.Since(start), nil
+}
@@ -0,0 +1,107 @@
+package regions
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testServerList = `{"groups":{},"regions":[` +
+	`{"id":"nl_amsterdam","name":"Netherlands","dns":"nl-amsterdam.privacy.network","port_forward":true,"offline":false,"servers":{"meta":[{"ip":"158.173.21.194","cn":"amsterdam407"}],"ovpnudp":[{"ip":"158.173.21.201","cn":"amsterdam407"}],"wg":[{"ip":"158.173.21.200","cn":"amsterdam407"}]}},` +
+	`{"id":"de-frankfurt","name":"DE Frankfurt","dns":"de-frankfurt.privacy.network","port_forward":true,"offline":false,"servers":{"ovpnudp":[{"ip":"212.102.57.138","cn":"frankfurt411"}],"wg":[{"ip":"212.102.57.139","cn":"frankfurt411"}]}},` +
+	`{"id":"us_california","name":"US California","dns":"us-california.privacy.network","port_forward":false,"offline":false,"servers":{"ovpnudp":[{"ip":"91.207.175.20","cn":"losangeles402"}]}},` +
+	`{"id":"swiss","name":"Switzerland","dns":"swiss.privacy.network","port_forward":true,"offline":true,"servers":{"ovpnudp":[{"ip":"212.102.36.166","cn":"zurich405"}]}},` +
+	`{"id":"se","name":"Sweden","dns":"sweden.privacy.network","port_forward":true,"offline":false,"servers":{"ovpnudp":[{"ip":"46.246.3.220","cn":"stockholm404"}]}}` +
+	`]}` + "\n\nc2lnbmF0dXJl\n"
+
+func TestParse(t *testing.T) {
+	list, err := Parse([]byte(testServerList))
+	if err != nil {
+		t.Fatalf("Failed to parse server list: %v", err)
+	}
+	if len(list.Regions) != 5 {
+		t.Fatalf("Expected 5 regions, got %d", len(list.Regions))
+	}
+	if r := list.Regions[0]; r.ID != "nl_amsterdam" || !r.PortForward || r.Servers[GroupWireGuard][0].IP != "158.173.21.200" {
+		t.Errorf("Unexpected region %+v", r)
+	}
+
+	if _, err := Parse([]byte("<html>")); err == nil {
+		t.Error("Expected an error for a page that isn't a server list")
+	}
+}
+
+func TestFetch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testServerList))
+	}))
+	defer server.Close()
+
+	list, err := Fetch(context.Background(), server.Client(), server.URL)
+	if err != nil || len(list.Regions) != 5 {
+		t.Fatalf("Expected the server list, got %v (%v)", list, err)
+	}
+
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	if _, err := Fetch(context.Background(), missing.Client(), missing.URL); err == nil {
+		t.Error("Expected an error for HTTP 404")
+	}
+}
+
+func TestFind(t *testing.T) {
+	list, _ := Parse([]byte(testServerList))
+	testCases := []struct {
+		group    string
+		host     string
+		expected string
+	}{
+		{GroupOpenVPN, "nl-amsterdam.privacy.network", "nl_amsterdam"},
+		{GroupOpenVPN, "212.102.57.138", "de-frankfurt"},
+		{GroupWireGuard, "frankfurt411", "de-frankfurt"},
+		{GroupWireGuard, "212.102.57.138", ""},
+		{GroupOpenVPN, "", ""},
+	}
+
+	for _, tc := range testCases {
+		region, ok := list.Find(tc.group, tc.host)
+		if ok != (tc.expected != "") || region.ID != tc.expected {
+			t.Errorf("Find(%q, %q): expected %q, got %q (%v)", tc.group, tc.host, tc.expected, region.ID, ok)
+		}
+	}
+}
+
+func TestRank(t *testing.T) {
+	list, _ := Parse([]byte(testServerList))
+	latencies := map[string]time.Duration{
+		"158.173.21.194": 30 * time.Millisecond,
+		"212.102.57.138": 20 * time.Millisecond,
+	}
+	var measured []string
+	measure := func(ctx context.Context, ip string) (time.Duration, error) {
+		latency, ok := latencies[ip]
+		if !ok {
+			return 0, errors.New("timeout")
+		}
+		return latency, nil
+	}
+
+	// Amsterdam is measured at its meta server; Sweden can't be reached;
+	// California doesn't forward ports and Switzerland is offline
+	ranked := list.Rank(context.Background(), GroupOpenVPN, nil, measure)
+	for _, r := range ranked {
+		measured = append(measured, r.Region.ID+"@"+r.Server.IP)
+	}
+	if expected := []string{"de-frankfurt@212.102.57.138", "nl_amsterdam@158.173.21.201"}; !reflect.DeepEqual(measured, expected) {
+		t.Errorf("Expected %q, got %q", expected, measured)
+	}
+
+	ranked = list.Rank(context.Background(), GroupOpenVPN, []string{"de-frankfurt"}, measure)
+	if len(ranked) != 1 || ranked[0].Region.ID != "nl_amsterdam" || ranked[0].Latency != 30*time.Millisecond {
+		t.Errorf("Expected only Amsterdam, got %+v", ranked)
+	}
+}
@@ -0,0 +1,74 @@
+package regions
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	_ "embed"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// piaKey is the key PIA signs its server list with, as published in its
+// desktop client
+//
+//go:embed serverlist.pem
+var piaKey []byte
+
+// ErrBadSignature is returned for a server list whose signature doesn't match
+// its content, or that has none
+var ErrBadSignature = errors.New("server list signature verification failed")
+
+// PIAKey returns the key PIA signs its server list with, built into the binary
+func PIAKey() *rsa.PublicKey {
+	key, err := ParsePublicKey(piaKey)
+	if err != nil {
+		panic(fmt.Sprintf("regions: invalid built-in server list key: %v", err))
+	}
+	return key
+}
+
+// ParsePublicKey parses the PEM encoded RSA key server lists are signed with,
+// either a PUBLIC KEY or an RSA PUBLIC KEY block
+func ParsePublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an RSA key, got %T", key)
+	}
+	return rsaKey, nil
+}
+
+// Verify checks the signature that follows the JSON document of a server list:
+// a base64 RSA PKCS #1 v1.5 signature of the document's SHA-256 hash
+func Verify(data []byte, key *rsa.PublicKey) error {
+	document, signature, found := bytes.Cut(data, []byte("\n"))
+	if !found {
+		return fmt.Errorf("%w: the list isn't signed", ErrBadSignature)
+	}
+	raw, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(signature), nil)))
+	if err != nil || len(raw) == 0 {
+		return fmt.Errorf("%w: the signature isn't valid base64", ErrBadSignature)
+	}
+
+	hash := sha256.Sum256(document)
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], raw); err != nil {
+		return ErrBadSignature
+	}
+	return nil
+}
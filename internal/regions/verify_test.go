@@ -0,0 +1,89 @@
+package regions
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// signedServerList returns testServerList's document signed with key, as PIA
+// publishes it
+func signedServerList(t *testing.T, key *rsa.PrivateKey) string {
+	t.Helper()
+	document, _, _ := strings.Cut(testServerList, "\n")
+	hash := sha256.Sum256([]byte(document))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(signature)
+	// PIA wraps the signature over several lines
+	return document + "\n\n" + encoded[:64] + "\n" + encoded[64:] + "\n"
+}
+
+func TestVerify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	signed := signedServerList(t, key)
+
+	testCases := []struct {
+		name  string
+		data  string
+		key   *rsa.PublicKey
+		valid bool
+	}{
+		{name: "Signed", data: signed, key: &key.PublicKey, valid: true},
+		{name: "Tampered", data: strings.Replace(signed, "212.102.57.138", "203.0.113.1", 1), key: &key.PublicKey},
+		{name: "Other key", data: signed, key: &other.PublicKey},
+		{name: "Unsigned", data: strings.SplitN(signed, "\n", 2)[0], key: &key.PublicKey},
+		{name: "Garbled signature", data: testServerList[:strings.Index(testServerList, "\n")] + "\n\n%%%\n", key: &key.PublicKey},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Verify([]byte(tc.data), tc.key)
+			if tc.valid && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if !tc.valid && !errors.Is(err, ErrBadSignature) {
+				t.Errorf("Expected ErrBadSignature, got %v", err)
+			}
+		})
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	pkix, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+
+	for _, block := range []*pem.Block{
+		{Type: "PUBLIC KEY", Bytes: pkix},
+		{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)},
+	} {
+		parsed, err := ParsePublicKey(pem.EncodeToMemory(block))
+		if err != nil || !parsed.Equal(&key.PublicKey) {
+			t.Errorf("%s: expected the key, got %v", block.Type, err)
+		}
+	}
+
+	if _, err := ParsePublicKey([]byte("not a key")); err == nil {
+		t.Error("Expected an error for data without a PEM block")
+	}
+}
+
+func TestPIAKey(t *testing.T) {
+	key := PIAKey()
+	if key.N.BitLen() != 2048 || key.E != 65537 {
+		t.Errorf("Expected a 2048 bit RSA key, got %d bits with exponent %d", key.N.BitLen(), key.E)
+	}
+}
@@ -0,0 +1,166 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// Host is a machine reached over SSH with the system ssh client, such as a
+// router the VPN tunnel terminates on. Commands run in its login shell.
+type Host struct {
+	// Login name, empty for ssh's default
+	user string
+	// Hostname or IP address
+	hostname string
+	// SSH port, empty for ssh's default
+	port string
+	// The ssh executable, replaceable for tests
+	command string
+}
+
+// Parse parses a remote host URL of the form ssh://[user@]host[:port]
+func Parse(rawURL string) (*Host, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ssh" {
+		return nil, fmt.Errorf("unsupported scheme %q, expected ssh://[user@]host[:port]", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("missing host in %q, expected ssh://[user@]host[:port]", rawURL)
+	}
+	if _, hasPassword := u.User.Password(); hasPassword {
+		return nil, errors.New("passwords aren't supported, use an SSH key or agent")
+	}
+	if u.Path != "" && u.Path != "/" {
+		return nil, fmt.Errorf("unexpected path %q in %q", u.Path, rawURL)
+	}
+
+	return &Host{user: u.User.Username(), hostname: u.Hostname(), port: u.Port(), command: "ssh"}, nil
+}
+
+// String returns the host as a URL
+func (h *Host) String() string {
+	u := url.URL{Scheme: "ssh", Host: h.hostname}
+	if h.user != "" {
+		u.User = url.User(h.user)
+	}
+	if h.port != "" {
+		u.Host = net.JoinHostPort(h.hostname, h.port)
+	}
+	return u.String()
+}
+
+// sshArgs returns the ssh arguments to connect to the host, followed by extra.
+// BatchMode makes ssh fail instead of prompting, since there's nobody to answer.
+func (h *Host) sshArgs(extra ...string) []string {
+	args := []string{"-o", "BatchMode=yes"}
+	if h.port != "" {
+		args = append(args, "-p", h.port)
+	}
+	destination := h.hostname
+	if h.user != "" {
+		destination = h.user + "@" + destination
+	}
+	return append(append(args, destination), extra...)
+}
+
+// Output runs a shell command on the host and returns its standard output
+func (h *Host) Output(command string) ([]byte, error) {
+	return h.run(command, nil)
+}
+
+// WriteFile replaces a file on the host with data. It's written to a temporary
+// file that is renamed over path, so readers never see a partial file.
+func (h *Host) WriteFile(filePath string, data []byte) error {
+	tmp := path.Join(path.Dir(filePath), "."+path.Base(filePath)+".tmp")
+	command := fmt.Sprintf("cat > %s && mv -f %s %s", Quote(tmp), Quote(tmp), Quote(filePath))
+	if _, err := h.run(command, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to write %s on %s: %w", filePath, h, err)
+	}
+	return nil
+}
+
+// run runs a command on the host with the given standard input
+func (h *Host) run(command string, stdin io.Reader) ([]byte, error) {
+	cmd := exec.Command(h.command, h.sshArgs("--", command)...)
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+	return output, nil
+}
+
+// DialContext opens a connection to addr from the host, like ssh -W. The
+// connection opens before the far end is reached; if the host can't connect,
+// reads return io.EOF. The connection outlives ctx, so it can be kept alive
+// between requests.
+func (h *Host) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(h.command, h.sshArgs("-W", addr)...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ssh: %w", err)
+	}
+
+	// The pipe gives the connection deadlines; the other end is copied to ssh
+	local, far := net.Pipe()
+	go func() {
+		io.Copy(stdin, far)
+		stdin.Close()
+	}()
+	go func() {
+		io.Copy(far, stdout)
+		far.Close()
+		cmd.Wait()
+	}()
+
+	return &conn{Conn: local, cmd: cmd}, nil
+}
+
+// conn is a connection tunneled through an ssh process
+type conn struct {
+	net.Conn
+	cmd *exec.Cmd
+}
+
+// Close closes the connection and stops ssh
+func (c *conn) Close() error {
+	err := c.Conn.Close()
+	c.cmd.Process.Kill()
+	return err
+}
+
+// Quote quotes s for a POSIX shell
+func Quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,172 @@
+// Package render writes files from user templates whenever the forwarded port
+// changes, e.g. an nginx stream block or a firewall script, and tells the
+// service that reads them to reload
+package render
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/atomicfile"
+)
+
+// reloadTimeout bounds running systemctl to reload a service
+const reloadTimeout = 30 * time.Second
+
+// Data is what templates can use
+type Data struct {
+	// Forwarded port, and the one before it or 0 on the first bind
+	Port         int
+	PreviousPort int
+	// Ports before it still in their --previous-port-grace period, newest first
+	PreviousPorts []int
+	// When the port's signature expires, and when it will be renewed
+	ExpiresAt time.Time
+	RenewsAt  time.Time
+	// PIA gateway IP and server hostname
+	Gateway  string
+	Hostname string
+}
+
+// Template is a template file and the file it's rendered to
+type Template struct {
+	Source string
+	Target string
+}
+
+// ParseTemplates parses "SOURCE=TARGET" pairs separated by commas
+func ParseTemplates(spec string) ([]Template, error) {
+	var templates []Template
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		source, target, ok := strings.Cut(pair, "=")
+		source, target = strings.TrimSpace(source), strings.TrimSpace(target)
+		if !ok || source == "" || target == "" {
+			return nil, fmt.Errorf("invalid template %q, expected SOURCE=TARGET", pair)
+		}
+		templates = append(templates, Template{Source: source, Target: target})
+	}
+	return templates, nil
+}
+
+// Check parses the template file, reporting errors before the first render
+func (t Template) Check() error {
+	_, err := t.parse()
+	return err
+}
+
+// parse reads and parses the template. Missing keys are errors, so a typo
+// doesn't quietly render an empty port.
+func (t Template) parse() (*template.Template, error) {
+	data, err := os.ReadFile(t.Source)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(filepath.Base(t.Source)).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// Render renders the template with data to its target, reporting whether the
+// target changed. The template is read again every time, so edits take effect
+// on the next port change. A new target is created with mode 0644, an existing
+// one keeps its mode.
+func (t Template) Render(data Data) (bool, error) {
+	tmpl, err := t.parse()
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", t.Source, err)
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return false, fmt.Errorf("failed to render %s: %w", t.Source, err)
+	}
+
+	perm := os.FileMode(0644)
+	if info, err := os.Stat(t.Target); err == nil {
+		perm = info.Mode().Perm()
+		if existing, err := os.ReadFile(t.Target); err == nil && bytes.Equal(existing, out.Bytes()) {
+			return false, nil
+		}
+	}
+	if err := atomicfile.WriteFile(t.Target, out.Bytes(), perm); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Reload kinds
+const (
+	// ReloadPIDFile sends SIGHUP to the process in a PID file
+	ReloadPIDFile = "pidfile"
+	// ReloadSystemctl runs systemctl reload on a unit
+	ReloadSystemctl = "systemctl"
+)
+
+// Reload tells a service to reload the rendered files
+type Reload struct {
+	Kind string
+	// PID file or unit name
+	Target string
+}
+
+// ParseReload parses "pidfile:PATH" or "systemctl:UNIT"
+func ParseReload(spec string) (Reload, error) {
+	kind, target, ok := strings.Cut(spec, ":")
+	if !ok || target == "" || (kind != ReloadPIDFile && kind != ReloadSystemctl) {
+		return Reload{}, fmt.Errorf("invalid reload %q, expected %s:PATH or %s:UNIT", spec, ReloadPIDFile, ReloadSystemctl)
+	}
+	return Reload{Kind: kind, Target: target}, nil
+}
+
+// String returns the reload as it's configured
+func (r Reload) String() string {
+	return r.Kind + ":" + r.Target
+}
+
+// Run performs the reload
+func (r Reload) Run() error {
+	if r.Kind == ReloadSystemctl {
+		ctx, cancel := context.WithTimeout(context.Background(), reloadTimeout)
+		defer cancel()
+		output, err := exec.CommandContext(ctx, "systemctl", "reload", r.Target).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("systemctl reload %s failed: %w: %s", r.Target, err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+
+	data, err := os.ReadFile(r.Target)
+	if err != nil {
+		return fmt.Errorf("failed to read PID file: %w", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return fmt.Errorf("PID file %s doesn't hold a PID", r.Target)
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if err := process.Signal(syscall.SIGHUP); err != nil {
+		if errors.Is(err, os.ErrProcessDone) {
+			return fmt.Errorf("process %d from %s is not running", pid, r.Target)
+		}
+		return fmt.Errorf("failed to signal process %d: %w", pid, err)
+	}
+	return nil
+}
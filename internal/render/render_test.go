@@ -0,0 +1,139 @@
+package render
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTemplates(t *testing.T) {
+	testCases := []struct {
+		spec        string
+		expected    []Template
+		expectError bool
+	}{
+		{spec: "", expected: nil},
+		{spec: "/etc/go-pia/nginx.tmpl=/etc/nginx/stream.d/pia.conf", expected: []Template{{"/etc/go-pia/nginx.tmpl", "/etc/nginx/stream.d/pia.conf"}}},
+		{spec: "a.tmpl = a.conf, b.tmpl=b.sh,", expected: []Template{{"a.tmpl", "a.conf"}, {"b.tmpl", "b.sh"}}},
+		{spec: "a.tmpl", expectError: true},
+		{spec: "=a.conf", expectError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.spec, func(t *testing.T) {
+			templates, err := ParseTemplates(tc.spec)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(templates, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, templates)
+			}
+		})
+	}
+}
+
+func TestRender(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "nginx.tmpl")
+	target := filepath.Join(dir, "pia.conf")
+	os.WriteFile(source, []byte("server {\n    listen {{.Port}};\n    # via {{.Hostname}} ({{.Gateway}}) until {{.ExpiresAt.Format \"2006-01-02\"}}\n}\n"), 0644)
+	tmpl := Template{Source: source, Target: target}
+
+	if err := tmpl.Check(); err != nil {
+		t.Fatalf("Expected the template to parse: %v", err)
+	}
+
+	data := Data{Port: 12345, ExpiresAt: time.Date(2024, time.March, 3, 0, 0, 0, 0, time.UTC), Gateway: "10.0.0.1", Hostname: "amsterdam407"}
+	changed, err := tmpl.Render(data)
+	if err != nil || !changed {
+		t.Fatalf("Expected the target to be written, got changed=%v err=%v", changed, err)
+	}
+	got, _ := os.ReadFile(target)
+	expected := "server {\n    listen 12345;\n    # via amsterdam407 (10.0.0.1) until 2024-03-03\n}\n"
+	if string(got) != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	// Rendering the same data again leaves the target alone
+	if changed, err := tmpl.Render(data); err != nil || changed {
+		t.Errorf("Expected no change, got changed=%v err=%v", changed, err)
+	}
+
+	// A new port is written, keeping the target's mode
+	os.Chmod(target, 0600)
+	data.Port = 23456
+	if changed, err := tmpl.Render(data); err != nil || !changed {
+		t.Errorf("Expected the new port to be written, got changed=%v err=%v", changed, err)
+	}
+	if info, _ := os.Stat(target); info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the mode to be kept, got %v", info.Mode())
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "out.conf")
+	os.WriteFile(target, []byte("listen 1;\n"), 0644)
+
+	testCases := []struct {
+		name     string
+		template string
+	}{
+		{name: "Syntax error", template: "listen {{.Port};"},
+		{name: "Unknown field", template: "listen {{.Prot}};"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			source := filepath.Join(dir, "bad.tmpl")
+			os.WriteFile(source, []byte(tc.template), 0644)
+
+			if _, err := (Template{Source: source, Target: target}).Render(Data{Port: 12345}); err == nil {
+				t.Errorf("Expected an error")
+			}
+			if got, _ := os.ReadFile(target); string(got) != "listen 1;\n" {
+				t.Errorf("Expected the target to be left alone, got %q", got)
+			}
+		})
+	}
+}
+
+func TestParseReload(t *testing.T) {
+	testCases := []struct {
+		spec        string
+		expected    Reload
+		expectError bool
+	}{
+		{spec: "pidfile:/run/nginx.pid", expected: Reload{Kind: ReloadPIDFile, Target: "/run/nginx.pid"}},
+		{spec: "systemctl:haproxy.service", expected: Reload{Kind: ReloadSystemctl, Target: "haproxy.service"}},
+		{spec: "signal:nginx", expectError: true},
+		{spec: "pidfile:", expectError: true},
+		{spec: "nginx", expectError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.spec, func(t *testing.T) {
+			reload, err := ParseReload(tc.spec)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("Expected an error")
+				}
+				return
+			}
+			if err != nil || reload != tc.expected {
+				t.Errorf("Expected %v, got %v (%v)", tc.expected, reload, err)
+			}
+			if reload.String() != tc.spec {
+				t.Errorf("Expected %q, got %q", tc.spec, reload.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+//go:build unix
+
+package render
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestReloadPIDFile(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start process: %v", err)
+	}
+	defer cmd.Process.Kill()
+
+	pidFile := filepath.Join(t.TempDir(), "service.pid")
+	os.WriteFile(pidFile, []byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0644)
+
+	if err := (Reload{Kind: ReloadPIDFile, Target: pidFile}).Run(); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+
+	// sleep doesn't handle SIGHUP, so it's terminated by it
+	err := cmd.Wait()
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatalf("Expected the process to be signaled, got %v", err)
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); !ok || status.Signal() != syscall.SIGHUP {
+		t.Errorf("Expected SIGHUP, got %v", exitErr)
+	}
+
+	if err := (Reload{Kind: ReloadPIDFile, Target: filepath.Join(t.TempDir(), "missing.pid")}).Run(); err == nil {
+		t.Errorf("Expected an error for a missing PID file")
+	}
+}
@@ -0,0 +1,297 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/metrics"
+)
+
+// Bounds on how long the cache keeps lookups
+const (
+	// minCacheTTL keeps records with tiny TTLs from defeating the cache
+	minCacheTTL = 5 * time.Second
+	// maxCacheTTL picks up moved servers within minutes, whatever the TTL says
+	maxCacheTTL = 10 * time.Minute
+	// defaultCacheTTL is used when the TTL isn't known, e.g. for answers from
+	// the hosts file or over TCP
+	defaultCacheTTL = time.Minute
+	// negativeCacheTTL is how long a name that doesn't exist is remembered
+	negativeCacheTTL = 30 * time.Second
+	// staleCacheFor bounds how long expired addresses stand in while the
+	// resolver can't be reached
+	staleCacheFor = time.Hour
+)
+
+// cacheLookups counts cached lookups by how they were answered: "hit",
+// "negative" for a name cached as not existing, "miss" or "stale"
+var cacheLookups = metrics.Default.NewCounterVec("gopia_dns_cache_lookups_total", "Number of hostname lookups through the DNS cache, by how they were answered", "result")
+
+// Cache resolves hostnames, keeping the answers for as long as their TTL says.
+// Names that don't exist are remembered briefly too, and when the resolver
+// can't be reached, e.g. while a kill switch blocks it during a reconnect,
+// the last addresses are used past their TTL. It's safe for concurrent use,
+// so the API and gateway clients can share one.
+type Cache struct {
+	resolver *net.Resolver
+	now      func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	// Lowest TTL seen in answers for each name since its lookup started
+	ttls map[string]time.Duration
+}
+
+// cacheEntry is a cached lookup
+type cacheEntry struct {
+	addrs []string
+	// Set for a name that doesn't exist
+	err     error
+	expires time.Time
+}
+
+// NewCache returns a cache that sends queries to the given DNS server, or
+// the system-configured one when server is empty
+func NewCache(server string) *Cache {
+	c := &Cache{
+		now:     time.Now,
+		entries: make(map[string]*cacheEntry),
+		ttls:    make(map[string]time.Duration),
+	}
+	if server != "" {
+		server = ServerAddress(server)
+	}
+	c.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if server != "" {
+				address = server
+			}
+			dialer := net.Dialer{Timeout: dialTimeout}
+			conn, err := dialer.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			// Each read is a whole answer over UDP, so the TTLs can be read
+			// from it; the resolver relies on it still being a PacketConn
+			if udp, ok := conn.(*net.UDPConn); ok {
+				return &ttlConn{UDPConn: udp, record: c.recordTTL}, nil
+			}
+			return conn, nil
+		},
+	}
+	return c
+}
+
+// LookupHost returns the addresses of host, from the cache while they're fresh
+func (c *Cache) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	key := cacheKey(host)
+
+	c.mu.Lock()
+	entry := c.entries[key]
+	if entry != nil && c.now().Before(entry.expires) {
+		c.mu.Unlock()
+		if entry.err != nil {
+			cacheLookups.With("negative").Inc()
+			return nil, entry.err
+		}
+		cacheLookups.With("hit").Inc()
+		return slices.Clone(entry.addrs), nil
+	}
+	delete(c.ttls, key)
+	c.mu.Unlock()
+
+	addrs, err := c.resolver.LookupHost(ctx, host)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	ttl, known := c.ttls[key]
+	delete(c.ttls, key)
+	if err == nil {
+		if !known {
+			ttl = defaultCacheTTL
+		}
+		c.entries[key] = &cacheEntry{addrs: addrs, expires: now.Add(min(max(ttl, minCacheTTL), maxCacheTTL))}
+		cacheLookups.With("miss").Inc()
+		return slices.Clone(addrs), nil
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		c.entries[key] = &cacheEntry{err: err, expires: now.Add(negativeCacheTTL)}
+		cacheLookups.With("miss").Inc()
+		return nil, err
+	}
+	if ctx.Err() == nil && entry != nil && entry.err == nil && now.Sub(entry.expires) < staleCacheFor {
+		log.Printf("Warning: failed to resolve %s, using the addresses that expired %s ago: %v", host, now.Sub(entry.expires).Round(time.Second), err)
+		cacheLookups.With("stale").Inc()
+		return slices.Clone(entry.addrs), nil
+	}
+	return nil, err
+}
+
+// Dialer returns a dial function that resolves hostnames through the cache
+// and dials their addresses with d in turn until one connects
+func (c *Cache) Dialer(d *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return d.DialContext(ctx, network, address)
+		}
+
+		addrs, err := c.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var firstErr error
+		for _, addr := range addrs {
+			conn, err := d.DialContext(ctx, network, net.JoinHostPort(addr, port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, firstErr
+	}
+}
+
+// recordTTL notes the TTL of an answer for name, keeping the lowest seen
+// across the A and AAAA answers of a lookup
+func (c *Cache) recordTTL(name string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if seen, ok := c.ttls[name]; !ok || ttl < seen {
+		c.ttls[name] = ttl
+	}
+}
+
+// cacheKey is the form hostnames are cached under
+func cacheKey(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// ttlConn passes on the TTLs of the answers read from a DNS server
+type ttlConn struct {
+	*net.UDPConn
+	record func(name string, ttl time.Duration)
+}
+
+func (c *ttlConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	if err == nil {
+		if name, ttl, ok := answerTTL(b[:n]); ok {
+			c.record(name, ttl)
+		}
+	}
+	return n, err
+}
+
+// DNS record types whose TTLs bound how long an answer is cached
+const (
+	typeA     = 1
+	typeCNAME = 5
+	typeAAAA  = 28
+)
+
+// answerTTL returns the name asked about in a DNS response and the lowest TTL
+// of its address records, or false if it has none or can't be parsed
+func answerTTL(msg []byte) (name string, ttl time.Duration, ok bool) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return "", 0, false
+	}
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+
+	name, offset, ok := readName(msg, 12)
+	if !ok || offset+4 > len(msg) {
+		return "", 0, false
+	}
+	// Skip the question's type and class
+	offset += 4
+
+	found := false
+	var lowest uint32
+	for range answers {
+		if offset, ok = skipName(msg, offset); !ok || offset+10 > len(msg) {
+			return "", 0, false
+		}
+		recordType := binary.BigEndian.Uint16(msg[offset:])
+		recordTTL := binary.BigEndian.Uint32(msg[offset+4:])
+		length := int(binary.BigEndian.Uint16(msg[offset+8:]))
+		offset += 10 + length
+		if offset > len(msg) {
+			return "", 0, false
+		}
+		if recordType == typeA || recordType == typeAAAA || recordType == typeCNAME {
+			if !found || recordTTL < lowest {
+				lowest = recordTTL
+			}
+			found = true
+		}
+	}
+	if !found {
+		return "", 0, false
+	}
+	return cacheKey(name), time.Duration(lowest) * time.Second, true
+}
+
+// readName reads the uncompressed name at offset, as questions are sent, and
+// returns it with the offset after it
+func readName(msg []byte, offset int) (string, int, bool) {
+	var labels []string
+	for {
+		if offset >= len(msg) {
+			return "", 0, false
+		}
+		length := int(msg[offset])
+		offset++
+		if length == 0 {
+			return strings.Join(labels, "."), offset, true
+		}
+		if length&0xC0 != 0 || offset+length > len(msg) {
+			return "", 0, false
+		}
+		labels = append(labels, string(msg[offset:offset+length]))
+		offset += length
+	}
+}
+
+// skipName returns the offset after the possibly compressed name at offset
+func skipName(msg []byte, offset int) (int, bool) {
+	for {
+		if offset >= len(msg) {
+			return 0, false
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			return offset + 1, true
+		case length&0xC0 == 0xC0:
+			// A pointer ends the name
+			return offset + 2, offset+2 <= len(msg)
+		case length&0xC0 != 0:
+			return 0, false
+		}
+		offset += 1 + length
+	}
+}
@@ -0,0 +1,211 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// DNS response codes the fake server answers with
+const (
+	rcodeSuccess  = 0
+	rcodeServFail = 2
+	rcodeNXDomain = 3
+)
+
+// fakeDNS answers A queries with 127.0.0.1 and the configured TTL, or fails
+// them with the configured response code
+type fakeDNS struct {
+	conn net.PacketConn
+
+	mu      sync.Mutex
+	rcode   int
+	ttl     uint32
+	queries int
+}
+
+func newFakeDNS(t *testing.T) *fakeDNS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	s := &fakeDNS{conn: conn, ttl: 300}
+	go s.serve()
+	return s
+}
+
+func (s *fakeDNS) set(rcode int, ttl uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rcode, s.ttl = rcode, ttl
+}
+
+func (s *fakeDNS) queryCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.queries
+}
+
+func (s *fakeDNS) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.queries++
+		rcode, ttl := s.rcode, s.ttl
+		s.mu.Unlock()
+		s.conn.WriteTo(fakeResponse(buf[:n], rcode, ttl), addr)
+	}
+}
+
+// fakeResponse answers query, with an A record if it asks for one
+func fakeResponse(query []byte, rcode int, ttl uint32) []byte {
+	_, end, _ := readName(query, 12)
+	question := query[12 : end+4]
+	qtype := binary.BigEndian.Uint16(query[end:])
+
+	answers := 0
+	if rcode == rcodeSuccess && qtype == typeA {
+		answers = 1
+	}
+	msg := binary.BigEndian.AppendUint16(nil, binary.BigEndian.Uint16(query))
+	msg = binary.BigEndian.AppendUint16(msg, 0x8180|uint16(rcode))
+	msg = binary.BigEndian.AppendUint16(msg, 1)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(answers))
+	msg = binary.BigEndian.AppendUint32(msg, 0)
+	msg = append(msg, question...)
+	if answers == 1 {
+		// The name points back at the question's
+		msg = append(msg, 0xC0, 12)
+		msg = binary.BigEndian.AppendUint16(msg, typeA)
+		msg = binary.BigEndian.AppendUint16(msg, 1)
+		msg = binary.BigEndian.AppendUint32(msg, ttl)
+		msg = binary.BigEndian.AppendUint16(msg, 4)
+		msg = append(msg, 127, 0, 0, 1)
+	}
+	return msg
+}
+
+func TestCache(t *testing.T) {
+	server := newFakeDNS(t)
+	cache := NewCache(server.conn.LocalAddr().String())
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	lookup := func() ([]string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		return cache.LookupHost(ctx, "gateway.example.test.")
+	}
+	expected := []string{"127.0.0.1"}
+
+	// Fresh answers come from the cache until their TTL is up
+	server.set(rcodeSuccess, 120)
+	if addrs, err := lookup(); err != nil || !reflect.DeepEqual(addrs, expected) {
+		t.Fatalf("Expected %v, got %v (%v)", expected, addrs, err)
+	}
+	queries := server.queryCount()
+	now = now.Add(119 * time.Second)
+	if addrs, err := lookup(); err != nil || !reflect.DeepEqual(addrs, expected) || server.queryCount() != queries {
+		t.Fatalf("Expected the cached %v without a query, got %v (%v) after %d queries", expected, addrs, err, server.queryCount()-queries)
+	}
+
+	// Expired addresses stand in while the server fails
+	now = now.Add(2 * time.Second)
+	server.set(rcodeServFail, 0)
+	if addrs, err := lookup(); err != nil || !reflect.DeepEqual(addrs, expected) || server.queryCount() == queries {
+		t.Fatalf("Expected the stale %v after a query, got %v (%v)", expected, addrs, err)
+	}
+	now = now.Add(staleCacheFor)
+	if _, err := lookup(); err == nil {
+		t.Fatal("Expected an error once the addresses are too old to use")
+	}
+
+	// Names that don't exist are remembered too
+	server.set(rcodeNXDomain, 0)
+	if _, err := lookup(); err == nil {
+		t.Fatal("Expected an error for a name that doesn't exist")
+	}
+	queries = server.queryCount()
+	server.set(rcodeSuccess, 120)
+	if _, err := lookup(); err == nil || server.queryCount() != queries {
+		t.Fatalf("Expected the cached error without a query, got %v after %d queries", err, server.queryCount()-queries)
+	}
+	now = now.Add(negativeCacheTTL)
+	if addrs, err := lookup(); err != nil || !reflect.DeepEqual(addrs, expected) {
+		t.Fatalf("Expected %v once the error expired, got %v (%v)", expected, addrs, err)
+	}
+}
+
+func TestCacheBoundsTTL(t *testing.T) {
+	server := newFakeDNS(t)
+	cache := NewCache(server.conn.LocalAddr().String())
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	server.set(rcodeSuccess, 86400)
+	if _, err := cache.LookupHost(context.Background(), "gateway.example.test."); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expires := cache.entries["gateway.example.test"].expires; !expires.Equal(now.Add(maxCacheTTL)) {
+		t.Errorf("Expected a day's TTL to be cut to %s, got %s", maxCacheTTL, expires.Sub(now))
+	}
+}
+
+func TestCacheDialer(t *testing.T) {
+	server := newFakeDNS(t)
+	cache := NewCache(server.conn.LocalAddr().String())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	dial := cache.Dialer(&net.Dialer{Timeout: time.Second})
+
+	// Addresses are dialed without a lookup
+	conn, err := dial(context.Background(), "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected the address to be dialed, got %v", err)
+	}
+	conn.Close()
+	if server.queryCount() != 0 {
+		t.Errorf("Expected no lookup for an address, got %d queries", server.queryCount())
+	}
+
+	// Names are dialed at the addresses they resolve to
+	conn, err = dial(context.Background(), "tcp", net.JoinHostPort("gateway.example.test.", port))
+	if err != nil {
+		t.Fatalf("Expected the name to be dialed, got %v", err)
+	}
+	conn.Close()
+	if server.queryCount() == 0 {
+		t.Error("Expected the name to be looked up")
+	}
+}
+
+func TestAnswerTTL(t *testing.T) {
+	query := []byte{0, 1, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	query = append(query, 7, 'G', 'a', 't', 'e', 'w', 'a', 'y', 4, 't', 'e', 's', 't', 0, 0, typeA, 0, 1)
+
+	name, ttl, ok := answerTTL(fakeResponse(query, rcodeSuccess, 60))
+	if !ok || name != "gateway.test" || ttl != time.Minute {
+		t.Errorf("Expected gateway.test for 1m, got %q for %s (%v)", name, ttl, ok)
+	}
+	if _, _, ok := answerTTL(fakeResponse(query, rcodeNXDomain, 0)); ok {
+		t.Error("Expected no TTL without answers")
+	}
+	if _, _, ok := answerTTL(fakeResponse(query, rcodeSuccess, 60)[:40]); ok {
+		t.Error("Expected no TTL from a truncated answer")
+	}
+}
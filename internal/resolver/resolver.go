@@ -0,0 +1,52 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+const (
+	// DNSPort is the port used when the DNS server is given without one
+	DNSPort = "53"
+	// dialTimeout bounds how long connecting to the DNS server may take
+	dialTimeout = 5 * time.Second
+)
+
+// New returns a resolver that sends all queries to the given DNS server
+// (e.g. PIA's 10.0.0.243), or the system resolver when server is empty
+func New(server string) *net.Resolver {
+	if server == "" {
+		return net.DefaultResolver
+	}
+
+	address := ServerAddress(server)
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			// Ignore the system-configured server and always use ours
+			dialer := net.Dialer{Timeout: dialTimeout}
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// ServerAddress normalizes a DNS server to host:port form, adding the default port if needed
+func ServerAddress(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(server, DNSPort)
+}
+
+// Validate checks that a DNS server is an IP address with an optional port
+func Validate(server string) error {
+	host := server
+	if h, _, err := net.SplitHostPort(server); err == nil {
+		host = h
+	}
+	if net.ParseIP(host) == nil {
+		return &net.AddrError{Err: "DNS server must be an IP address", Addr: server}
+	}
+	return nil
+}
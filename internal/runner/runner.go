@@ -0,0 +1,23 @@
+// Package runner runs scripts detached from the service, in their own process
+// group, so a script and everything it starts can be stopped together. The
+// semantics are the same on every platform; only how the group is stopped
+// differs.
+package runner
+
+import (
+	"os/exec"
+	"time"
+)
+
+// Detach makes cmd run in its own process group, and makes canceling its
+// context stop the whole group: the group is asked to exit, and whatever still
+// runs after grace is killed. Wait returns at most grace after the context is
+// done, even if a process left behind holds the output open. Call it before
+// starting cmd.
+func Detach(cmd *exec.Cmd, grace time.Duration) {
+	cmd.SysProcAttr = detachedAttr()
+	cmd.Cancel = func() error {
+		return stopGroup(cmd.Process.Pid, grace)
+	}
+	cmd.WaitDelay = grace
+}
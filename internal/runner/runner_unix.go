@@ -0,0 +1,21 @@
+//go:build unix
+
+package runner
+
+import (
+	"syscall"
+	"time"
+)
+
+// detachedAttr starts the process as the leader of a new process group, which
+// its children join
+func detachedAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// stopGroup sends SIGTERM to the process group led by pid, then SIGKILL after
+// grace for whatever still runs
+func stopGroup(pid int, grace time.Duration) error {
+	time.AfterFunc(grace, func() { syscall.Kill(-pid, syscall.SIGKILL) })
+	return syscall.Kill(-pid, syscall.SIGTERM)
+}
@@ -0,0 +1,56 @@
+//go:build unix
+
+package runner
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetach(t *testing.T) {
+	testCases := []struct {
+		name   string
+		script string
+		signal string
+	}{
+		// The script's child would write the file after the group was stopped
+		{"Terminated", "(sleep 1; touch \"$1\") &\nexec sleep 30\n", "signal: terminated"},
+		// Ignoring SIGTERM is inherited by the script's children
+		{"Killed after grace", "trap '' TERM\n(sleep 1; touch \"$1\") &\nsleep 30\n", "signal: killed"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			script := filepath.Join(dir, "script.sh")
+			if err := os.WriteFile(script, []byte("#!/bin/sh\n"+tc.script), 0755); err != nil {
+				t.Fatalf("Failed to write script: %v", err)
+			}
+			out := filepath.Join(dir, "out")
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			cmd := exec.CommandContext(ctx, script, out)
+			Detach(cmd, 200*time.Millisecond)
+
+			started := time.Now()
+			err := cmd.Run()
+			if err == nil || !strings.Contains(err.Error(), tc.signal) {
+				t.Errorf("Expected %q, got %v", tc.signal, err)
+			}
+			if elapsed := time.Since(started); elapsed > 2*time.Second {
+				t.Errorf("Expected the script to stop soon after the grace period, took %s", elapsed)
+			}
+
+			time.Sleep(1500 * time.Millisecond)
+			if _, err := os.Stat(out); err == nil {
+				t.Errorf("Expected the script's child to be stopped with it")
+			}
+		})
+	}
+}
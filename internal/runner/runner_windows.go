@@ -0,0 +1,22 @@
+//go:build windows
+
+package runner
+
+import (
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// detachedAttr starts the process in a new process group, so console signals
+// meant for the service don't reach it
+func detachedAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// stopGroup kills the process tree rooted at pid right away. Windows has no
+// way to ask a console program without a console to exit, so there's no grace.
+func stopGroup(pid int, grace time.Duration) error {
+	return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(pid)).Run()
+}
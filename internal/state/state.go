@@ -0,0 +1,208 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/atomicfile"
+)
+
+// Version is the format of the state file, which the status command prints
+// as is. Fields are only added within a version; renaming, removing or
+// changing the meaning of one makes a new version, so scripts reading it can
+// check what they get.
+const Version = 1
+
+// State is the service's current port forwarding state, shared with other
+// processes through the state file
+type State struct {
+	// Format of the state, Version when written by this build
+	Version int `json:"version"`
+	// Process ID of the service that wrote the state
+	PID int `json:"pid"`
+	// Whether the service is still running. The service always stores false,
+	// since a stored true would outlive it; readers fill it in from the
+	// instance lock.
+	Running bool `json:"running"`
+	// Forwarded port, 0 until one has been obtained
+	Port int `json:"port"`
+	// Ports before it still in their --previous-port-grace period, newest first
+	PreviousPorts []int `json:"previous_ports,omitempty"`
+	// PIA gateway IP the port is bound on
+	Gateway string `json:"gateway"`
+	// PIA server hostname used for TLS verification
+	Hostname string `json:"hostname"`
+	// Region the managed VPN switched to, empty until it switches
+	Region string `json:"region,omitempty"`
+	// Gateway of the last successful bind, which a restart can reuse instead
+	// of detecting the VPN
+	KnownGateway *KnownGateway `json:"known_gateway,omitempty"`
+	// When the port forwarding signature expires
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	// When a new signature, usually with a different port, will be requested
+	RenewsAt time.Time `json:"renews_at,omitzero"`
+	// When the port was last bound successfully
+	LastBindAt time.Time `json:"last_bind_at,omitzero"`
+	// Error from the most recent failed bind or signature request
+	LastError string `json:"last_error,omitempty"`
+	// Total number of failed bind attempts
+	BindFailures int `json:"bind_failures"`
+	// Failed bind attempts since the last success
+	ConsecutiveFailures int `json:"consecutive_failures"`
+	// When the cached authentication token was obtained
+	TokenIssuedAt time.Time `json:"token_issued_at,omitzero"`
+	// When authentication last succeeded
+	LastAuthAt time.Time `json:"last_auth_at,omitzero"`
+	// Number of authentication tokens obtained
+	TokenRefreshes int `json:"token_refreshes"`
+	// Number of failed attempts to obtain a token
+	TokenRefreshFailures int `json:"token_refresh_failures"`
+	// Error from the most recent failed authentication, cleared on success
+	LastAuthError string `json:"last_auth_error,omitempty"`
+	// When UDP delivery to the port was last probed
+	LastUDPProbeAt time.Time `json:"last_udp_probe_at,omitzero"`
+	// Datagrams the last UDP probe had sent to the port and those that arrived
+	UDPProbesSent     int `json:"udp_probes_sent,omitempty"`
+	UDPProbesReceived int `json:"udp_probes_received,omitempty"`
+	// Why the last UDP probe couldn't run, cleared when one does
+	UDPProbeError string `json:"udp_probe_error,omitempty"`
+	// Execution statistics of each hook script that ran, by hook name
+	Hooks map[string]HookStats `json:"hooks,omitempty"`
+	// How writing the port to each output has been going, by output name
+	Outputs map[string]OutputStats `json:"outputs,omitempty"`
+	// Round-trip times of recent successful gateway requests, by endpoint
+	Latency map[string]LatencyStats `json:"latency,omitempty"`
+	// When tokens and signatures were requested within the last RequestHistory,
+	// oldest first, so restarts can tell if PIA's rate limit is near
+	TokenRequests     []time.Time `json:"token_requests,omitempty"`
+	SignatureRequests []time.Time `json:"signature_requests,omitempty"`
+	// When the state was last written
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// KnownGateway is a gateway the port was bound through
+type KnownGateway struct {
+	// PIA gateway IP, server hostname and the managed VPN's region, if known
+	Gateway  string `json:"gateway"`
+	Hostname string `json:"hostname"`
+	Region   string `json:"region,omitempty"`
+	// When the port was last bound through it
+	BoundAt time.Time `json:"bound_at"`
+}
+
+// HookStats records how a hook script has been doing
+type HookStats struct {
+	// Number of times the hook ran, how many of those failed, and how many
+	// of the failures were timeouts
+	Runs     int `json:"runs"`
+	Failures int `json:"failures"`
+	Timeouts int `json:"timeouts"`
+	// Failed runs since the last success
+	ConsecutiveFailures int `json:"consecutive_failures"`
+	// When the hook last ran, how long it took and its exit code, -1 if it
+	// didn't exit on its own
+	LastRunAt    time.Time     `json:"last_run_at"`
+	LastDuration time.Duration `json:"last_duration"`
+	LastExitCode int           `json:"last_exit_code"`
+	// Error from the most recent failed run, cleared on success
+	LastError string `json:"last_error,omitempty"`
+}
+
+// OutputStats records how writing the port to an output has been going
+type OutputStats struct {
+	// Attempts to write the port, including retries, and how many failed
+	Writes   int `json:"writes"`
+	Failures int `json:"failures"`
+	// Failed attempts since the last success
+	ConsecutiveFailures int `json:"consecutive_failures"`
+	// Port of the last attempt, and when it was made
+	LastPort    int       `json:"last_port"`
+	LastWriteAt time.Time `json:"last_write_at"`
+	// When an attempt last succeeded
+	LastSuccessAt time.Time `json:"last_success_at,omitzero"`
+	// Error from the last attempt, cleared on success
+	LastError string `json:"last_error,omitempty"`
+}
+
+// LatencyStats summarizes the round-trip times of the most recent successful
+// requests to one gateway endpoint
+type LatencyStats struct {
+	// Number of requests the percentiles cover
+	Samples int           `json:"samples"`
+	P50     time.Duration `json:"p50"`
+	P90     time.Duration `json:"p90"`
+	P99     time.Duration `json:"p99"`
+}
+
+// RequestHistory is how long request times are kept in the state
+const RequestHistory = time.Hour
+
+// RecordRequest appends a request made at t to times, dropping those older
+// than RequestHistory
+func RecordRequest(times []time.Time, t time.Time) []time.Time {
+	kept := times[:0:0]
+	for _, at := range times {
+		if t.Sub(at) < RequestHistory {
+			kept = append(kept, at)
+		}
+	}
+	return append(kept, t)
+}
+
+// RequestDelay returns how long to wait at now before another request, so
+// that no more than limit requests fall within window. times must be oldest
+// first.
+func RequestDelay(times []time.Time, now time.Time, limit int, window time.Duration) time.Duration {
+	var recent []time.Time
+	for _, at := range times {
+		if now.Sub(at) < window {
+			recent = append(recent, at)
+		}
+	}
+	if len(recent) < limit {
+		return 0
+	}
+	// Wait until enough of them have left the window
+	return recent[len(recent)-limit].Add(window).Sub(now)
+}
+
+// PathFor returns the state file used alongside the given output file
+func PathFor(outputFile string) string {
+	return outputFile + ".state.json"
+}
+
+// Save atomically writes the state to path, in the current Version
+func Save(path string, s *State) error {
+	versioned := *s
+	versioned.Version = Version
+	data, err := json.MarshalIndent(&versioned, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	// Readers never see a partial state
+	if err := atomicfile.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
+
+// Load reads the state from path
+func Load(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	var s State
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+	// Files from before the format was versioned are the first version
+	if s.Version == 0 {
+		s.Version = 1
+	}
+	return &s, nil
+}
@@ -0,0 +1,199 @@
+package state
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "port.txt.state.json")
+	expiresAt := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	saved := &State{
+		Version:             Version,
+		PID:                 1234,
+		Port:                51234,
+		Gateway:             "10.8.110.1",
+		Hostname:            "frankfurt404",
+		ExpiresAt:           expiresAt,
+		LastBindAt:          expiresAt.Add(-time.Hour),
+		BindFailures:        3,
+		ConsecutiveFailures: 1,
+		LastError:           "connection refused",
+		TokenRequests:       []time.Time{expiresAt.Add(-2 * time.Hour)},
+		UpdatedAt:           expiresAt.Add(-time.Minute),
+	}
+	if err := Save(path, saved); err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, saved) {
+		t.Errorf("Expected %+v, got %+v", saved, loaded)
+	}
+
+	// No temporary files are left behind
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("Expected only the state file, got %d entries", len(entries))
+	}
+}
+
+func TestSaveOmitsUnsetTimes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := Save(path, &State{PID: 1, UpdatedAt: time.Now()}); err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read state: %v", err)
+	}
+	for _, field := range []string{"expires_at", "last_bind_at", "last_error", "token_requests"} {
+		if strings.Contains(string(data), field) {
+			t.Errorf("Expected %s to be omitted, got:\n%s", field, data)
+		}
+	}
+}
+
+// TestFormatV1 pins the fields of the first version of the state, which
+// scripts read with the status command. A field may be added without a new
+// Version, but none of these may go or be renamed.
+func TestFormatV1(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	at := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	st := &State{
+		PID:           1234,
+		Running:       true,
+		Port:          51234,
+		PreviousPorts: []int{41234},
+		Gateway:       "10.8.110.1",
+		Hostname:      "frankfurt404",
+		Region:        "de-frankfurt",
+		KnownGateway:  &KnownGateway{Gateway: "10.8.110.1", Hostname: "frankfurt404", Region: "de-frankfurt", BoundAt: at},
+		ExpiresAt:     at.Add(48 * time.Hour),
+		RenewsAt:      at.Add(24 * time.Hour),
+		LastBindAt:    at,
+		LastError:     "connection refused",
+		Hooks:         map[string]HookStats{"port-change": {Runs: 1, LastRunAt: at, LastError: "exit status 1"}},
+		Outputs:       map[string]OutputStats{"output-file": {Writes: 1, LastWriteAt: at, LastSuccessAt: at, LastError: "disk full"}},
+		Latency:       map[string]LatencyStats{"bindPort": {Samples: 1}},
+		UpdatedAt:     at,
+	}
+	if err := Save(path, st); err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read state: %v", err)
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("Failed to parse state: %v", err)
+	}
+
+	if doc["version"] != float64(1) {
+		t.Errorf("Expected version 1, got %v", doc["version"])
+	}
+	expectKeys := func(name string, obj any, keys ...string) {
+		t.Helper()
+		m, ok := obj.(map[string]any)
+		if !ok {
+			t.Errorf("Expected %s to be an object, got %v", name, obj)
+			return
+		}
+		for _, key := range keys {
+			if _, ok := m[key]; !ok {
+				t.Errorf("Expected %s to have %q, got:\n%s", name, key, data)
+			}
+		}
+	}
+	expectKeys("the state", doc, "version", "pid", "running", "port", "previous_ports", "gateway", "hostname", "region",
+		"known_gateway", "expires_at", "renews_at", "last_bind_at", "last_error", "bind_failures",
+		"consecutive_failures", "token_refreshes", "token_refresh_failures", "hooks", "outputs",
+		"latency", "updated_at")
+	expectKeys("known_gateway", doc["known_gateway"], "gateway", "hostname", "region", "bound_at")
+	expectKeys("a hook", doc["hooks"].(map[string]any)["port-change"], "runs", "failures", "timeouts",
+		"consecutive_failures", "last_run_at", "last_duration", "last_exit_code", "last_error")
+	expectKeys("an output", doc["outputs"].(map[string]any)["output-file"], "writes", "failures",
+		"consecutive_failures", "last_port", "last_write_at", "last_success_at", "last_error")
+	expectKeys("latency", doc["latency"].(map[string]any)["bindPort"], "samples", "p50", "p90", "p99")
+}
+
+func TestLoadUnversioned(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	os.WriteFile(path, []byte(`{"pid": 1234, "port": 51234}`), 0644)
+
+	st, err := Load(path)
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	if st.Version != 1 || st.Port != 51234 {
+		t.Errorf("Expected version 1 with port 51234, got version %d with port %d", st.Version, st.Port)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Load(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("Expected error for missing file")
+	}
+
+	invalid := filepath.Join(dir, "invalid.json")
+	os.WriteFile(invalid, []byte("{not json"), 0644)
+	if _, err := Load(invalid); err == nil {
+		t.Errorf("Expected error for invalid JSON")
+	}
+}
+
+func TestRecordRequest(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	times := []time.Time{now.Add(-2 * time.Hour), now.Add(-30 * time.Minute)}
+	got := RecordRequest(times, now)
+	expected := []time.Time{now.Add(-30 * time.Minute), now}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+	if len(times) != 2 || !times[0].Equal(now.Add(-2*time.Hour)) {
+		t.Errorf("Expected the original times to be left alone, got %v", times)
+	}
+}
+
+func TestRequestDelay(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	ago := func(d ...time.Duration) []time.Time {
+		var times []time.Time
+		for _, a := range d {
+			times = append(times, now.Add(-a))
+		}
+		return times
+	}
+
+	testCases := []struct {
+		name     string
+		times    []time.Time
+		expected time.Duration
+	}{
+		{name: "No history", expected: 0},
+		{name: "Below the limit", times: ago(5*time.Minute, 4*time.Minute), expected: 0},
+		{name: "Old requests don't count", times: ago(20*time.Minute, 16*time.Minute, 15*time.Minute, time.Minute), expected: 0},
+		{name: "At the limit", times: ago(10*time.Minute, 5*time.Minute, time.Minute), expected: 5 * time.Minute},
+		{name: "Over the limit", times: ago(12*time.Minute, 10*time.Minute, 5*time.Minute, 2*time.Minute, time.Minute), expected: 10 * time.Minute},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := RequestDelay(tc.times, now, 3, 15*time.Minute); got != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+// Package systemd asks systemd over D-Bus to reload, restart or signal a unit,
+// and follows the state of one
+package systemd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/meschansky/go-pia/internal/dbus"
+)
+
+const (
+	// managerService, managerPath and managerInterface address the systemd manager
+	managerService   = "org.freedesktop.systemd1"
+	managerPath      = "/org/freedesktop/systemd1"
+	managerInterface = "org.freedesktop.systemd1.Manager"
+)
+
+// Caller makes D-Bus method calls, see dbus.Conn
+type Caller interface {
+	Call(destination, path, iface, member, signature string, args ...any) ([]any, error)
+}
+
+// signals maps the signal names accepted by ParseAction to their Linux numbers,
+// which is what systemd expects whatever platform this was built for
+var signals = map[string]int32{
+	"HUP":  1,
+	"INT":  2,
+	"QUIT": 3,
+	"USR1": 10,
+	"USR2": 12,
+	"TERM": 15,
+}
+
+// Action is what's done to a unit
+type Action struct {
+	// Manager method called: ReloadUnit, RestartUnit, ReloadOrRestartUnit or KillUnit
+	method string
+	// Signal sent to the unit's main process, for KillUnit
+	signal int32
+	// Name the action is logged as
+	name string
+}
+
+// ParseAction parses reload, restart, reload-or-restart or a signal name such
+// as HUP or SIGUSR1, which is sent to the unit's main process. An empty action
+// is a reload.
+func ParseAction(s string) (Action, error) {
+	switch s {
+	case "", "reload":
+		return Action{method: "ReloadUnit", name: "reload"}, nil
+	case "restart":
+		return Action{method: "RestartUnit", name: s}, nil
+	case "reload-or-restart":
+		return Action{method: "ReloadOrRestartUnit", name: s}, nil
+	}
+
+	name := strings.TrimPrefix(strings.ToUpper(s), "SIG")
+	if signal, ok := signals[name]; ok {
+		return Action{method: "KillUnit", signal: signal, name: "SIG" + name}, nil
+	}
+	return Action{}, fmt.Errorf("unknown action %q, expected reload, restart, reload-or-restart or a signal (HUP, INT, QUIT, USR1, USR2, TERM)", s)
+}
+
+// String returns the action's name
+func (a Action) String() string {
+	return a.name
+}
+
+// Run performs the action on unit. systemd queues reloads and restarts as jobs,
+// so Run returns once the job is queued, not when it's done.
+func (a Action) Run(bus Caller, unit string) error {
+	var err error
+	if a.method == "KillUnit" {
+		_, err = bus.Call(managerService, managerPath, managerInterface, a.method, "ssi", unit, "main", a.signal)
+	} else {
+		_, err = bus.Call(managerService, managerPath, managerInterface, a.method, "ss", unit, "replace")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to %s %s: %w", a, unit, err)
+	}
+	return nil
+}
+
+// RunOnSystemBus connects to the system bus and performs the action on unit
+func (a Action) RunOnSystemBus(unit string) error {
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return fmt.Errorf("failed to connect to systemd: %w", err)
+	}
+	defer bus.Close()
+	return a.Run(bus, unit)
+}
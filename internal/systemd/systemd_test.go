@@ -0,0 +1,74 @@
+package systemd
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/meschansky/go-pia/internal/dbus"
+)
+
+// fakeManager records the calls made to it and fails them with err
+type fakeManager struct {
+	calls [][]any
+	err   error
+}
+
+func (f *fakeManager) Call(destination, path, iface, member, signature string, args ...any) ([]any, error) {
+	if destination != managerService || path != managerPath || iface != managerInterface {
+		return nil, errors.New("unexpected destination")
+	}
+	f.calls = append(f.calls, append([]any{member, signature}, args...))
+	return []any{dbus.ObjectPath("/org/freedesktop/systemd1/job/1")}, f.err
+}
+
+func TestAction(t *testing.T) {
+	testCases := []struct {
+		action   string
+		name     string
+		expected []any
+	}{
+		{action: "reload", name: "reload", expected: []any{"ReloadUnit", "ss", "transmission-daemon.service", "replace"}},
+		{action: "restart", name: "restart", expected: []any{"RestartUnit", "ss", "transmission-daemon.service", "replace"}},
+		{action: "reload-or-restart", name: "reload-or-restart", expected: []any{"ReloadOrRestartUnit", "ss", "transmission-daemon.service", "replace"}},
+		{action: "HUP", name: "SIGHUP", expected: []any{"KillUnit", "ssi", "transmission-daemon.service", "main", int32(1)}},
+		{action: "sigusr1", name: "SIGUSR1", expected: []any{"KillUnit", "ssi", "transmission-daemon.service", "main", int32(10)}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.action, func(t *testing.T) {
+			action, err := ParseAction(tc.action)
+			if err != nil {
+				t.Fatalf("Failed to parse action: %v", err)
+			}
+			if action.String() != tc.name {
+				t.Errorf("Expected name %q, got %q", tc.name, action)
+			}
+
+			manager := &fakeManager{}
+			if err := action.Run(manager, "transmission-daemon.service"); err != nil {
+				t.Fatalf("Failed to run action: %v", err)
+			}
+			if len(manager.calls) != 1 || !reflect.DeepEqual(manager.calls[0], tc.expected) {
+				t.Errorf("Expected call %v, got %v", tc.expected, manager.calls)
+			}
+		})
+	}
+}
+
+func TestActionErrors(t *testing.T) {
+	for _, s := range []string{"stop", "SIGKILL", "9"} {
+		if _, err := ParseAction(s); err == nil {
+			t.Errorf("Expected an error for %q", s)
+		}
+	}
+
+	// Errors from systemd say what was attempted
+	action, _ := ParseAction("reload")
+	manager := &fakeManager{err: &dbus.Error{Name: "org.freedesktop.systemd1.NoSuchUnit", Message: "Unit foo.service not loaded."}}
+	err := action.Run(manager, "foo.service")
+	if err == nil || !strings.Contains(err.Error(), "failed to reload foo.service") || !strings.Contains(err.Error(), "not loaded") {
+		t.Errorf("Expected a descriptive error, got %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package systemd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/meschansky/go-pia/internal/dbus"
+)
+
+const (
+	// unitInterface holds the properties every unit has
+	unitInterface = "org.freedesktop.systemd1.Unit"
+	// propertiesInterface reads properties and signals their changes
+	propertiesInterface = "org.freedesktop.DBus.Properties"
+
+	// StateActive is the ActiveState of a unit that's up
+	StateActive = "active"
+)
+
+// WatchUnit passes on the ActiveState of unit, such as active, activating or
+// failed: the current one first, then each change. The channel is closed when
+// ctx is done or the connection to systemd is lost.
+func WatchUnit(ctx context.Context, unit string) (<-chan string, error) {
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to systemd: %w", err)
+	}
+	path, err := unitPath(bus, unit)
+	if err != nil {
+		bus.Close()
+		return nil, err
+	}
+	// systemd only broadcasts unit changes while a client is subscribed, which
+	// lasts as long as its connection
+	if _, err := bus.Call(managerService, managerPath, managerInterface, "Subscribe", ""); err != nil {
+		bus.Close()
+		return nil, fmt.Errorf("failed to subscribe to systemd: %w", err)
+	}
+	rule := fmt.Sprintf("type='signal',sender='%s',path='%s',interface='%s',member='PropertiesChanged'", managerService, path, propertiesInterface)
+	signals, err := bus.Watch(rule)
+	if err != nil {
+		bus.Close()
+		return nil, err
+	}
+
+	// The state is read once the changes are watched, so none is missed, and
+	// over another connection, since the watched one can't make calls
+	query, err := dbus.SystemBus()
+	if err != nil {
+		bus.Close()
+		return nil, fmt.Errorf("failed to connect to systemd: %w", err)
+	}
+	state, err := activeState(query, path)
+	query.Close()
+	if err != nil {
+		bus.Close()
+		return nil, fmt.Errorf("failed to get the state of %s: %w", unit, err)
+	}
+
+	states := make(chan string, 1)
+	stop := context.AfterFunc(ctx, func() { bus.Close() })
+	go func() {
+		defer close(states)
+		defer func() {
+			// Closing the connection ends the signals once those queued are read
+			stop()
+			bus.Close()
+			for range signals {
+			}
+		}()
+
+		send := func(state string) bool {
+			select {
+			case states <- state:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		if !send(state) {
+			return
+		}
+		for signal := range signals {
+			if changed, ok := stateChange(signal); ok && changed != state {
+				state = changed
+				if !send(state) {
+					return
+				}
+			}
+		}
+	}()
+	return states, nil
+}
+
+// unitPath returns the object path of unit, which systemd loads if it hasn't
+func unitPath(bus Caller, unit string) (dbus.ObjectPath, error) {
+	body, err := bus.Call(managerService, managerPath, managerInterface, "LoadUnit", "s", unit)
+	if err != nil {
+		return "", fmt.Errorf("failed to find %s: %w", unit, err)
+	}
+	if len(body) != 1 {
+		return "", fmt.Errorf("unexpected reply to LoadUnit %s", unit)
+	}
+	path, ok := body[0].(dbus.ObjectPath)
+	if !ok {
+		return "", fmt.Errorf("unexpected reply to LoadUnit %s", unit)
+	}
+	return path, nil
+}
+
+// activeState returns the ActiveState of the unit at path
+func activeState(bus Caller, path dbus.ObjectPath) (string, error) {
+	body, err := bus.Call(managerService, string(path), propertiesInterface, "Get", "ss", unitInterface, "ActiveState")
+	if err != nil {
+		return "", err
+	}
+	if len(body) == 1 {
+		if variant, ok := body[0].(dbus.Variant); ok {
+			if state, ok := variant.Value.(string); ok {
+				return state, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unexpected reply to Get ActiveState")
+}
+
+// stateChange returns the ActiveState a PropertiesChanged signal reports for
+// a unit, or false if it doesn't report one
+func stateChange(signal *dbus.Signal) (string, bool) {
+	if signal.Interface != propertiesInterface || signal.Member != "PropertiesChanged" || len(signal.Body) < 2 {
+		return "", false
+	}
+	if iface, _ := signal.Body[0].(string); iface != unitInterface {
+		return "", false
+	}
+	changed, _ := signal.Body[1].(map[string]any)
+	variant, ok := changed["ActiveState"].(dbus.Variant)
+	if !ok {
+		return "", false
+	}
+	state, ok := variant.Value.(string)
+	return state, ok
+}
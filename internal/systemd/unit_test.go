@@ -0,0 +1,89 @@
+package systemd
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/meschansky/go-pia/internal/dbus"
+)
+
+// fakeUnits answers LoadUnit and ActiveState reads for the units it knows
+type fakeUnits struct {
+	states map[dbus.ObjectPath]string
+}
+
+func (f *fakeUnits) Call(destination, path, iface, member, signature string, args ...any) ([]any, error) {
+	switch {
+	case destination != managerService:
+		return nil, errors.New("unexpected destination")
+	case iface == managerInterface && member == "LoadUnit":
+		unitPath := dbus.ObjectPath("/org/freedesktop/systemd1/unit/" + args[0].(string))
+		if _, ok := f.states[unitPath]; !ok {
+			return nil, &dbus.Error{Name: "org.freedesktop.systemd1.NoSuchUnit", Message: "Unit not found."}
+		}
+		return []any{unitPath}, nil
+	case iface == propertiesInterface && member == "Get" && args[0] == unitInterface && args[1] == "ActiveState":
+		return []any{dbus.Variant{Signature: "s", Value: f.states[dbus.ObjectPath(path)]}}, nil
+	}
+	return nil, errors.New("unexpected call")
+}
+
+func TestUnitState(t *testing.T) {
+	bus := &fakeUnits{states: map[dbus.ObjectPath]string{"/org/freedesktop/systemd1/unit/openvpn-client@pia.service": "activating"}}
+
+	path, err := unitPath(bus, "openvpn-client@pia.service")
+	if err != nil || path != "/org/freedesktop/systemd1/unit/openvpn-client@pia.service" {
+		t.Fatalf("Expected the unit's path, got %q (%v)", path, err)
+	}
+	if state, err := activeState(bus, path); err != nil || state != "activating" {
+		t.Errorf("Expected activating, got %q (%v)", state, err)
+	}
+
+	if _, err := unitPath(bus, "missing.service"); err == nil {
+		t.Errorf("Expected an error for a unit systemd can't find")
+	}
+}
+
+func TestStateChange(t *testing.T) {
+	changed := func(iface string, props map[string]any) *dbus.Signal {
+		return &dbus.Signal{
+			Path:      "/org/freedesktop/systemd1/unit/openvpn_2dclient_40pia_2eservice",
+			Interface: propertiesInterface,
+			Member:    "PropertiesChanged",
+			Body:      []any{iface, props, []any{}},
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		signal   *dbus.Signal
+		expected string
+	}{
+		{
+			name:     "active state",
+			signal:   changed(unitInterface, map[string]any{"ActiveState": dbus.Variant{Signature: "s", Value: "deactivating"}, "SubState": dbus.Variant{Signature: "s", Value: "stop-sigterm"}}),
+			expected: "deactivating",
+		},
+		{
+			name:   "other properties",
+			signal: changed(unitInterface, map[string]any{"SubState": dbus.Variant{Signature: "s", Value: "running"}}),
+		},
+		{
+			name:   "service properties",
+			signal: changed("org.freedesktop.systemd1.Service", map[string]any{"ActiveState": dbus.Variant{Signature: "s", Value: "failed"}}),
+		},
+		{
+			name:   "other signal",
+			signal: &dbus.Signal{Interface: managerInterface, Member: "JobRemoved", Body: []any{uint32(1), dbus.ObjectPath("/"), "x", "done"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			state, ok := stateChange(tc.signal)
+			if ok != (tc.expected != "") || state != tc.expected {
+				t.Errorf("Expected %q, got %q (%v)", tc.expected, state, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/clock"
+	"github.com/meschansky/go-pia/internal/vpn"
+)
+
+// openVPNStopTimeout is how long OpenVPN gets to remove its routes before it's killed
+const openVPNStopTimeout = 10 * time.Second
+
+// OpenVPN runs openvpn with a config file, restarting it whenever it exits
+type OpenVPN struct {
+	// Path to the OpenVPN config
+	Config string
+	// File with the username and password, in OpenVPN's auth-user-pass format
+	CredentialsFile string
+	// Address the management interface listens on, as host:port or a unix socket path
+	ManagementAddr string
+
+	Command CommandFunc
+	Clock   clock.Clock
+
+	mu sync.Mutex
+	// remote overrides the config's remotes after a switch
+	remote *vpn.Remote
+	// stop ends the running openvpn
+	stop context.CancelFunc
+	// switched is set when openvpn was stopped to connect elsewhere
+	switched bool
+}
+
+// NewOpenVPN returns a supervisor for openvpn with the given config
+func NewOpenVPN(config, credentialsFile, managementAddr string) *OpenVPN {
+	return &OpenVPN{
+		Config:          config,
+		CredentialsFile: credentialsFile,
+		ManagementAddr:  managementAddr,
+		Command:         exec.CommandContext,
+		Clock:           clock.Real,
+	}
+}
+
+// Run runs openvpn until ctx is canceled, restarting it with a growing delay
+// when it exits
+func (o *OpenVPN) Run(ctx context.Context) error {
+	var b backoff
+	for {
+		runCtx, stop := context.WithCancel(ctx)
+		o.mu.Lock()
+		o.stop = stop
+		o.mu.Unlock()
+
+		started := o.Clock.Now()
+		err := o.run(runCtx)
+		stop()
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		// A switch restarts right away, with a fresh backoff
+		o.mu.Lock()
+		switched := o.switched
+		o.switched = false
+		o.mu.Unlock()
+		if switched {
+			b = backoff{}
+			continue
+		}
+
+		delay := b.next(o.Clock.Now().Sub(started))
+		log.Printf("OpenVPN exited (%v), restarting in %s", err, delay)
+		select {
+		case <-o.Clock.After(delay):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// run runs openvpn once, until it exits or ctx is canceled
+func (o *OpenVPN) run(ctx context.Context) error {
+	// A socket left by a previous run would stop the management interface from starting
+	if strings.Contains(o.ManagementAddr, "/") {
+		os.Remove(o.ManagementAddr)
+	}
+
+	cmd := o.Command(ctx, "openvpn", o.args()...)
+	output := &logWriter{prefix: "openvpn: "}
+	cmd.Stdout, cmd.Stderr = output, output
+
+	// Let OpenVPN remove its routes on shutdown; Windows can only kill it
+	if runtime.GOOS != "windows" {
+		cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+		cmd.WaitDelay = openVPNStopTimeout
+	}
+
+	log.Printf("Starting OpenVPN with %s", o.Config)
+	return cmd.Run()
+}
+
+// args returns the openvpn command line
+func (o *OpenVPN) args() []string {
+	var args []string
+
+	// Remotes given before the config are tried before the config's own
+	o.mu.Lock()
+	if o.remote != nil {
+		args = append(args, "--remote", o.remote.Host, o.remote.Port, o.remote.Proto)
+	}
+	o.mu.Unlock()
+
+	args = append(args, "--config", o.Config, "--auth-user-pass", o.CredentialsFile, "--auth-nocache")
+	if strings.Contains(o.ManagementAddr, "/") {
+		return append(args, "--management", o.ManagementAddr, "unix")
+	}
+	host, port, _ := net.SplitHostPort(o.ManagementAddr)
+	return append(args, "--management", host, port)
+}
+
+// Switch restarts openvpn connected to the server at ip, with the port and
+// protocol of the config's first remote. hostname isn't needed since PIA's
+// OpenVPN configs don't pin the server's name.
+func (o *OpenVPN) Switch(ip, hostname string) error {
+	cfg, err := vpn.LoadOVPNConfig(o.Config)
+	if err != nil {
+		return err
+	}
+	if len(cfg.Remotes) == 0 {
+		return fmt.Errorf("no remote in %s to take the port and protocol from", o.Config)
+	}
+	remote := cfg.Remotes[0]
+	remote.Host = ip
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.remote = &remote
+	o.switched = true
+	if o.stop != nil {
+		o.stop()
+	}
+	return nil
+}
+
+// Configure lets detection ask the management interface which server OpenVPN
+// is connected to
+func (o *OpenVPN) Configure(d *vpn.Detector) {
+	d.ManagementAddr = o.ManagementAddr
+}
@@ -0,0 +1,115 @@
+package tunnel
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/clock"
+	"github.com/meschansky/go-pia/internal/vpn"
+)
+
+func TestOpenVPNArgs(t *testing.T) {
+	testCases := []struct {
+		management string
+		expected   []string
+	}{
+		{"/run/go-pia/openvpn.sock", []string{"--management", "/run/go-pia/openvpn.sock", "unix"}},
+		{"127.0.0.1:7505", []string{"--management", "127.0.0.1", "7505"}},
+	}
+
+	for _, tc := range testCases {
+		o := NewOpenVPN("/etc/openvpn/pia.ovpn", "/etc/pia.txt", tc.management)
+		expected := append([]string{"--config", "/etc/openvpn/pia.ovpn", "--auth-user-pass", "/etc/pia.txt", "--auth-nocache"}, tc.expected...)
+		if args := o.args(); !reflect.DeepEqual(args, expected) {
+			t.Errorf("Expected %q, got %q", expected, args)
+		}
+	}
+
+	d := &vpn.Detector{}
+	NewOpenVPN("/etc/openvpn/pia.ovpn", "/etc/pia.txt", "127.0.0.1:7505").Configure(d)
+	if d.ManagementAddr != "127.0.0.1:7505" {
+		t.Errorf("Expected detection to use the management interface, got %q", d.ManagementAddr)
+	}
+}
+
+func TestOpenVPNRestarts(t *testing.T) {
+	fake := clock.NewFake(time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC))
+	starts := make(chan []string, 10)
+	o := NewOpenVPN("/etc/openvpn/pia.ovpn", "/etc/pia.txt", "127.0.0.1:7505")
+	o.Clock = fake
+	o.Command = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		starts <- append([]string{name}, args...)
+		return exec.CommandContext(ctx, "sh", "-c", "echo 'Options error'; exit 1")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- o.Run(ctx) }()
+
+	// Each exit waits longer before the next start
+	for _, delay := range []time.Duration{minRestartDelay, 2 * minRestartDelay} {
+		if command := <-starts; command[0] != "openvpn" {
+			t.Fatalf("Expected openvpn to start, got %q", command)
+		}
+		if err := fake.BlockUntil(ctx, 1); err != nil {
+			t.Fatalf("OpenVPN was not restarted: %v", err)
+		}
+		fake.Advance(delay - time.Second)
+		select {
+		case command := <-starts:
+			t.Fatalf("Restarted %q before %s", command, delay)
+		default:
+		}
+		fake.Advance(time.Second)
+	}
+	<-starts
+
+	// Canceling stops the supervisor instead of restarting
+	if err := fake.BlockUntil(ctx, 1); err != nil {
+		t.Fatalf("OpenVPN was not restarted: %v", err)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected a clean stop, got %v", err)
+	}
+}
+
+func TestOpenVPNSwitch(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "pia.ovpn")
+	if err := os.WriteFile(config, []byte("client\nremote nl-amsterdam.privacy.network 1198 udp\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	starts := make(chan []string, 10)
+	o := NewOpenVPN(config, "/etc/pia.txt", "127.0.0.1:7505")
+	o.Clock = clock.NewFake(time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC))
+	o.Command = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		starts <- args
+		return exec.CommandContext(ctx, "sleep", "60")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go o.Run(ctx)
+	if args := <-starts; args[0] != "--config" {
+		t.Fatalf("Expected the config's remotes at first, got %q", args)
+	}
+
+	// The new server goes first, and openvpn restarts without waiting
+	if err := o.Switch("158.173.21.201", "amsterdam407"); err != nil {
+		t.Fatalf("Failed to switch: %v", err)
+	}
+	select {
+	case args := <-starts:
+		if expected := []string{"--remote", "158.173.21.201", "1198", "udp"}; !reflect.DeepEqual(args[:4], expected) {
+			t.Errorf("Expected %q first, got %q", expected, args)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OpenVPN was not restarted")
+	}
+}
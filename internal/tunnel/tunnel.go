@@ -0,0 +1,76 @@
+// Package tunnel brings up and supervises the VPN when go-pia manages it
+// itself, replacing openvpn and its scripts on headless machines
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/vpn"
+)
+
+const (
+	// minRestartDelay is how long to wait before restarting a VPN that went down
+	minRestartDelay = 5 * time.Second
+	// maxRestartDelay caps the delay for a VPN that keeps failing
+	maxRestartDelay = 5 * time.Minute
+	// stableRun is how long the VPN must stay up for the restart delay to reset
+	stableRun = 5 * time.Minute
+)
+
+// Tunnel is a VPN go-pia runs itself
+type Tunnel interface {
+	// Run brings the VPN up and keeps it up until ctx is canceled, then takes it down
+	Run(ctx context.Context) error
+	// Configure points VPN detection at the tunnel
+	Configure(d *vpn.Detector)
+	// Switch reconnects to another server, given by IP address and hostname
+	Switch(ip, hostname string) error
+}
+
+// CommandFunc creates commands; exec.CommandContext outside tests
+type CommandFunc func(ctx context.Context, name string, args ...string) *exec.Cmd
+
+// backoff doubles the delay between restarts of a VPN that keeps failing
+type backoff struct {
+	delay time.Duration
+}
+
+// next returns the delay before the next restart of a VPN that stayed up for upFor
+func (b *backoff) next(upFor time.Duration) time.Duration {
+	if b.delay == 0 || upFor >= stableRun {
+		b.delay = minRestartDelay
+	} else {
+		b.delay = min(2*b.delay, maxRestartDelay)
+	}
+	return b.delay
+}
+
+// logWriter logs each line written to it with a prefix
+type logWriter struct {
+	mu     sync.Mutex
+	prefix string
+	buf    []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if line := bytes.TrimRight(w.buf[:i], "\r"); len(line) > 0 {
+			log.Printf("%s%s", w.prefix, line)
+		}
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
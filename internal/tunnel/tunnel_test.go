@@ -0,0 +1,56 @@
+package tunnel
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	var b backoff
+	expected := []struct {
+		upFor time.Duration
+		delay time.Duration
+	}{
+		{0, minRestartDelay},
+		{time.Second, 2 * minRestartDelay},
+		{time.Second, 4 * minRestartDelay},
+		{stableRun, minRestartDelay},
+	}
+	for i, e := range expected {
+		if delay := b.next(e.upFor); delay != e.delay {
+			t.Errorf("Restart %d: expected %s, got %s", i, e.delay, delay)
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		b.next(0)
+	}
+	if b.delay != maxRestartDelay {
+		t.Errorf("Expected the delay to be capped at %s, got %s", maxRestartDelay, b.delay)
+	}
+}
+
+func TestLogWriter(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	})
+
+	w := &logWriter{prefix: "openvpn: "}
+	w.Write([]byte("Initialization Sequence "))
+	w.Write([]byte("Completed\r\n\nTUN/TAP device tun0 opened\npartial"))
+
+	if expected := "openvpn: Initialization Sequence Completed\nopenvpn: TUN/TAP device tun0 opened\n"; buf.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buf.String())
+	}
+	if !strings.HasPrefix(string(w.buf), "partial") {
+		t.Errorf("Expected the incomplete line to be kept, got %q", w.buf)
+	}
+}
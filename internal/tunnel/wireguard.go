@@ -0,0 +1,366 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/clock"
+	"github.com/meschansky/go-pia/internal/httpjson"
+	"github.com/meschansky/go-pia/internal/piaca"
+	"github.com/meschansky/go-pia/internal/vpn"
+)
+
+const (
+	// wireguardAPIPort is where PIA's WireGuard servers accept keys
+	wireguardAPIPort = "1337"
+	// addKeyTimeout bounds a request to register a key
+	addKeyTimeout = 30 * time.Second
+	// handshakeTimeout is how old the last handshake may get before the
+	// tunnel is considered down; WireGuard renews it every two minutes
+	handshakeTimeout = 3 * time.Minute
+	// healthInterval is how often the handshake is checked
+	healthInterval = time.Minute
+)
+
+// addKeyResponse is a PIA WireGuard server's reply to registering a key
+type addKeyResponse struct {
+	Status     string `json:"status"`
+	Message    string `json:"message"`
+	ServerKey  string `json:"server_key"`
+	ServerPort int    `json:"server_port"`
+	ServerIP   string `json:"server_ip"`
+	ServerVIP  string `json:"server_vip"`
+	PeerIP     string `json:"peer_ip"`
+}
+
+// WireGuard brings up a wg-quick interface to a PIA server, registering a
+// fresh key with it each time, and brings it back up when handshakes stop
+type WireGuard struct {
+	// IP address of the PIA WireGuard server
+	Server string
+	// Hostname of the server, the common name of its certificate
+	Hostname string
+	// Name of the WireGuard interface
+	Interface string
+	// Token returns a PIA authentication token
+	Token func() (string, error)
+	// Path to the PIA CA certificate the server's is checked against
+	CACertPath string
+	// Directory the interface config is written under (the system temporary
+	// directory if empty)
+	TempDir string
+
+	Command CommandFunc
+	Clock   clock.Clock
+
+	// apiPort is the port keys are registered on, changed by tests
+	apiPort string
+
+	mu   sync.Mutex
+	conn *vpn.ConnectionInfo
+	// switched is signaled to bring the tunnel up to a new server
+	switched chan struct{}
+}
+
+// errSwitched ends a tunnel that's being moved to another server
+var errSwitched = errors.New("switching servers")
+
+// NewWireGuard returns a supervisor for a WireGuard tunnel to the given server
+func NewWireGuard(server, hostname, iface, caCertPath string, token func() (string, error)) *WireGuard {
+	return &WireGuard{
+		Server:     server,
+		Hostname:   hostname,
+		Interface:  iface,
+		Token:      token,
+		CACertPath: caCertPath,
+		Command:    exec.CommandContext,
+		Clock:      clock.Real,
+		apiPort:    wireguardAPIPort,
+		switched:   make(chan struct{}, 1),
+	}
+}
+
+// Run keeps the tunnel up until ctx is canceled, then takes it down
+func (w *WireGuard) Run(ctx context.Context) error {
+	// wg-quick names the interface after the config file, which holds the private key
+	dir, err := os.MkdirTemp(w.TempDir, "go-pia-wireguard")
+	if err != nil {
+		return fmt.Errorf("failed to create WireGuard config directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, w.Interface+".conf")
+
+	var b backoff
+	for {
+		started := w.Clock.Now()
+		err := w.up(ctx, configPath)
+		if err == nil {
+			err = w.watch(ctx)
+			w.down(configPath)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, errSwitched) {
+			b = backoff{}
+			continue
+		}
+
+		delay := b.next(w.Clock.Now().Sub(started))
+		_, hostname := w.server()
+		log.Printf("WireGuard tunnel to %s is down (%v), reconnecting in %s", hostname, err, delay)
+		select {
+		case <-w.Clock.After(delay):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// up registers a new key with the server and brings the interface up
+func (w *WireGuard) up(ctx context.Context, configPath string) error {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate WireGuard key: %w", err)
+	}
+	token, err := w.Token()
+	if err != nil {
+		return fmt.Errorf("failed to get token: %w", err)
+	}
+	server, hostname := w.server()
+	reply, err := w.addKey(ctx, server, hostname, token, base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()))
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(configPath, []byte(wireguardConfig(key, reply, server)), 0600); err != nil {
+		return fmt.Errorf("failed to write WireGuard config: %w", err)
+	}
+	log.Printf("Bringing up WireGuard interface %s to %s (%s)", w.Interface, hostname, reply.ServerIP)
+	if output, err := w.Command(ctx, "wg-quick", "up", configPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("wg-quick up failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	// Port forwarding goes through the server's address inside the tunnel
+	w.mu.Lock()
+	w.conn = &vpn.ConnectionInfo{GatewayIP: reply.ServerVIP, Hostname: hostname}
+	w.mu.Unlock()
+	return nil
+}
+
+// down takes the interface down, even when ctx has been canceled
+func (w *WireGuard) down(configPath string) {
+	w.mu.Lock()
+	w.conn = nil
+	w.mu.Unlock()
+
+	if output, err := w.Command(context.Background(), "wg-quick", "down", configPath).CombinedOutput(); err != nil {
+		log.Printf("wg-quick down failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+}
+
+// watch returns when ctx is canceled or handshakes with the server stop
+func (w *WireGuard) watch(ctx context.Context) error {
+	upSince := w.Clock.Now()
+	ticker := w.Clock.NewTicker(healthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-w.switched:
+			return errSwitched
+		case <-ticker.C():
+		}
+
+		latest, err := w.latestHandshake(ctx)
+		if err != nil {
+			return err
+		}
+		// No handshake yet counts from when the interface came up
+		if latest.Before(upSince) {
+			latest = upSince
+		}
+		if age := w.Clock.Now().Sub(latest); age > handshakeTimeout {
+			return fmt.Errorf("no handshake for %s", age.Round(time.Second))
+		}
+	}
+}
+
+// latestHandshake returns when the interface last completed a handshake,
+// or the zero time if it never has
+func (w *WireGuard) latestHandshake(ctx context.Context) (time.Time, error) {
+	output, err := w.Command(ctx, "wg", "show", w.Interface, "latest-handshakes").Output()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read handshakes of %s: %w", w.Interface, err)
+	}
+
+	// One peer per line: its public key and the Unix time of its last handshake
+	var latest time.Time
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		seconds, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || seconds == 0 {
+			continue
+		}
+		if t := time.Unix(seconds, 0); t.After(latest) {
+			latest = t
+		}
+	}
+	return latest, nil
+}
+
+// addKey registers publicKey with the server at ip named hostname and returns
+// how to connect to it
+func (w *WireGuard) addKey(ctx context.Context, ip, hostname, token, publicKey string) (*addKeyResponse, error) {
+	client, err := w.apiClient(ip, hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{"pt": {token}, "pubkey": {publicKey}}
+	endpoint := fmt.Sprintf("https://%s/addKey?%s", net.JoinHostPort(hostname, w.apiPort), query.Encode())
+	ctx, cancel := context.WithTimeout(ctx, addKeyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register WireGuard key with %s: %w", hostname, err)
+	}
+	defer resp.Body.Close()
+
+	var reply addKeyResponse
+	if err := httpjson.Decode(resp, &reply); err != nil {
+		return nil, fmt.Errorf("invalid addKey response: %w", err)
+	}
+	if reply.Status != "OK" {
+		return nil, fmt.Errorf("%s rejected the WireGuard key: %s %s", hostname, reply.Status, reply.Message)
+	}
+	if net.ParseIP(reply.ServerVIP) == nil || reply.PeerIP == "" || reply.ServerKey == "" || reply.ServerPort == 0 {
+		return nil, errors.New("incomplete addKey response")
+	}
+	return &reply, nil
+}
+
+// apiClient returns an HTTP client that connects to the server at ip and
+// checks its certificate was issued by the PIA CA for hostname
+func (w *WireGuard) apiClient(ip, hostname string) (*http.Client, error) {
+	pem, err := piaca.Read(w.CACertPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", w.CACertPath)
+	}
+
+	addr := net.JoinHostPort(ip, w.apiPort)
+	dialer := &net.Dialer{Timeout: addKeyTimeout}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+			// PIA's certificates name the server only in the common name, which
+			// the standard verification ignores
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				VerifyConnection: func(cs tls.ConnectionState) error {
+					return verifyServer(cs, pool, hostname)
+				},
+			},
+		},
+	}, nil
+}
+
+// verifyServer checks the server's certificate chains to pool and names hostname
+func verifyServer(cs tls.ConnectionState, pool *x509.CertPool, hostname string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server sent no certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: pool, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		return fmt.Errorf("server certificate is not signed by the PIA CA: %w", err)
+	}
+	if leaf.Subject.CommonName != hostname && leaf.VerifyHostname(hostname) != nil {
+		return fmt.Errorf("server certificate is for %q, not %q", leaf.Subject.CommonName, hostname)
+	}
+	return nil
+}
+
+// wireguardConfig renders a wg-quick config that routes everything through the server
+func wireguardConfig(key *ecdh.PrivateKey, reply *addKeyResponse, server string) string {
+	endpoint := reply.ServerIP
+	if endpoint == "" {
+		endpoint = server
+	}
+	return fmt.Sprintf(`[Interface]
+Address = %s
+PrivateKey = %s
+
+[Peer]
+PersistentKeepalive = 25
+PublicKey = %s
+AllowedIPs = 0.0.0.0/0
+Endpoint = %s
+`, reply.PeerIP, base64.StdEncoding.EncodeToString(key.Bytes()), reply.ServerKey, net.JoinHostPort(endpoint, strconv.Itoa(reply.ServerPort)))
+}
+
+// server returns the IP address and hostname of the server to connect to
+func (w *WireGuard) server() (string, string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.Server, w.Hostname
+}
+
+// Switch brings the tunnel up to the server at ip named hostname instead
+func (w *WireGuard) Switch(ip, hostname string) error {
+	w.mu.Lock()
+	w.Server = ip
+	w.Hostname = hostname
+	w.mu.Unlock()
+
+	select {
+	case w.switched <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Configure hands detection the server's address inside the tunnel while it's up
+func (w *WireGuard) Configure(d *vpn.Detector) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn != nil {
+		d.Gateway = w.conn.GatewayIP
+		d.Hostname = w.conn.Hostname
+	}
+}
@@ -0,0 +1,131 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/vpn"
+)
+
+// testWireGuard returns a WireGuard supervisor registering keys with server,
+// whose certificate is for example.com, and recording the commands it runs
+func testWireGuard(t *testing.T, server *httptest.Server, commands *[]string) *WireGuard {
+	t.Helper()
+	caPath := filepath.Join(t.TempDir(), "ca.crt")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caPath, data, 0644); err != nil {
+		t.Fatalf("Failed to write CA certificate: %v", err)
+	}
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	w := NewWireGuard(host, "example.com", "pia", caPath, func() (string, error) { return "token123", nil })
+	w.apiPort = port
+	w.Command = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		*commands = append(*commands, name+" "+strings.Join(args, " "))
+		return exec.CommandContext(ctx, "true")
+	}
+	return w
+}
+
+func TestWireGuardUp(t *testing.T) {
+	var pubkey string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/addKey" || r.URL.Query().Get("pt") != "token123" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		pubkey = r.URL.Query().Get("pubkey")
+		json.NewEncoder(w).Encode(addKeyResponse{
+			Status:     "OK",
+			ServerKey:  "c2VydmVyLWtleQ==",
+			ServerPort: 1337,
+			ServerIP:   "158.173.21.201",
+			ServerVIP:  "10.7.128.1",
+			PeerIP:     "10.7.137.152",
+		})
+	}))
+	defer server.Close()
+
+	var commands []string
+	w := testWireGuard(t, server, &commands)
+	configPath := filepath.Join(t.TempDir(), "pia.conf")
+	if err := w.up(context.Background(), configPath); err != nil {
+		t.Fatalf("Failed to bring the tunnel up: %v", err)
+	}
+
+	config, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatalf("Failed to read the config: %v", err)
+	}
+	for _, line := range []string{"Address = 10.7.137.152", "PublicKey = c2VydmVyLWtleQ==", "Endpoint = 158.173.21.201:1337", "AllowedIPs = 0.0.0.0/0"} {
+		if !strings.Contains(string(config), line) {
+			t.Errorf("Expected %q in the config:\n%s", line, config)
+		}
+	}
+	if len(pubkey) != 44 {
+		t.Errorf("Expected a base64 public key, got %q", pubkey)
+	}
+	if info, err := os.Stat(configPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the config to be private, got %v (%v)", info.Mode(), err)
+	}
+
+	// Detection uses the server's address inside the tunnel while it's up
+	d := &vpn.Detector{}
+	w.Configure(d)
+	if d.Gateway != "10.7.128.1" || d.Hostname != "example.com" {
+		t.Errorf("Unexpected detector gateway %s (%s)", d.Gateway, d.Hostname)
+	}
+	w.down(configPath)
+	d = &vpn.Detector{}
+	w.Configure(d)
+	if d.Gateway != "" {
+		t.Errorf("Expected no gateway once down, got %s", d.Gateway)
+	}
+
+	if expected := "wg-quick up " + configPath + ",wg-quick down " + configPath; strings.Join(commands, ",") != expected {
+		t.Errorf("Expected %q, got %q", expected, commands)
+	}
+}
+
+func TestWireGuardAddKeyErrors(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"ERROR","message":"Login failed!"}`))
+	}))
+	defer server.Close()
+
+	var commands []string
+	w := testWireGuard(t, server, &commands)
+	if _, err := w.addKey(context.Background(), w.Server, w.Hostname, "token123", "key"); err == nil || !strings.Contains(err.Error(), "Login failed!") {
+		t.Errorf("Expected the server's message, got %v", err)
+	}
+
+	// The certificate must name the configured server
+	if _, err := w.addKey(context.Background(), w.Server, "amsterdam407", "token123", "key"); err == nil || !strings.Contains(err.Error(), `not "amsterdam407"`) {
+		t.Errorf("Expected a hostname mismatch, got %v", err)
+	}
+}
+
+func TestLatestHandshake(t *testing.T) {
+	w := NewWireGuard("158.173.21.201", "amsterdam407", "pia", "", nil)
+	w.Command = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "printf", "a2V5MQ==\t0\nb2V5Mg==\t1772323200\n")
+	}
+
+	latest, err := w.latestHandshake(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to read handshakes: %v", err)
+	}
+	if expected := time.Unix(1772323200, 0); !latest.Equal(expected) {
+		t.Errorf("Expected %s, got %s", expected, latest)
+	}
+}
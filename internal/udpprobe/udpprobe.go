@@ -0,0 +1,194 @@
+// Package udpprobe checks that UDP datagrams from the internet reach the
+// forwarded port. A reflector on another host is asked to send datagrams to
+// the port on the address the request came from, which is the VPN's exit IP,
+// and the ones that arrive are counted.
+package udpprobe
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultPort is the reflector's port if none is given
+	DefaultPort = "7787"
+	// requestPrefix starts a request to the reflector: "GOPIA-PROBE PORT NONCE"
+	requestPrefix = "GOPIA-PROBE"
+	// echoPrefix starts what the reflector sends to the port: "GOPIA-ECHO NONCE"
+	echoPrefix = "GOPIA-ECHO"
+	// maxDatagram is larger than any request or echo
+	maxDatagram = 128
+)
+
+// ErrPortInUse is returned when another program, usually the game server,
+// holds the port, so echoes can't be received
+var ErrPortInUse = errors.New("port is in use by another program")
+
+// Result is the outcome of a probe
+type Result struct {
+	// Datagrams the reflector was asked to send, and those that arrived
+	Sent     int
+	Received int
+}
+
+// Loss is the fraction of datagrams that didn't arrive
+func (r Result) Loss() float64 {
+	if r.Sent == 0 {
+		return 0
+	}
+	return float64(r.Sent-r.Received) / float64(r.Sent)
+}
+
+// Open reports whether any datagram arrived
+func (r Result) Open() bool {
+	return r.Received > 0
+}
+
+// Prober sends probes through a reflector
+type Prober struct {
+	// Reflector address as host[:port]
+	Reflector string
+	// Datagrams per probe, sent Interval apart
+	Count    int
+	Interval time.Duration
+	// How long to wait for echoes after the last request
+	Wait time.Duration
+}
+
+// NewProber returns a prober for reflector with the default count and timing
+func NewProber(reflector string) *Prober {
+	return &Prober{Reflector: reflector, Count: 10, Interval: 100 * time.Millisecond, Wait: 2 * time.Second}
+}
+
+// ReflectorAddress adds the default port to a reflector address without one
+func ReflectorAddress(reflector string) (string, error) {
+	if reflector == "" {
+		return "", errors.New("no reflector address")
+	}
+	if _, _, err := net.SplitHostPort(reflector); err == nil {
+		return reflector, nil
+	}
+	address := net.JoinHostPort(strings.Trim(reflector, "[]"), DefaultPort)
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", fmt.Errorf("invalid reflector address %q: %w", reflector, err)
+	}
+	return address, nil
+}
+
+// Probe asks the reflector to send Count datagrams to port and counts those
+// that arrive. The port must be free to listen on.
+func (p *Prober) Probe(ctx context.Context, port int) (Result, error) {
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		if errors.Is(err, syscall.EADDRINUSE) {
+			return Result{}, ErrPortInUse
+		}
+		return Result{}, fmt.Errorf("failed to listen on port %d: %w", port, err)
+	}
+	defer listener.Close()
+
+	address, err := ReflectorAddress(p.Reflector)
+	if err != nil {
+		return Result{}, err
+	}
+	var dialer net.Dialer
+	reflector, err := dialer.DialContext(ctx, "udp", address)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to reach reflector %s: %w", p.Reflector, err)
+	}
+	defer reflector.Close()
+
+	// Collect echoes while the requests go out
+	nonces := make(map[string]bool, p.Count)
+	received := make(chan string, p.Count)
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, _, err := listener.ReadFrom(buf)
+			if err != nil {
+				close(received)
+				return
+			}
+			// Anything beyond Count echoes is a duplicate or stray, and dropped
+			if nonce, ok := strings.CutPrefix(string(buf[:n]), echoPrefix+" "); ok {
+				select {
+				case received <- nonce:
+				default:
+				}
+			}
+		}
+	}()
+
+	result := Result{}
+	for i := 0; i < p.Count; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return result, ctx.Err()
+			case <-time.After(p.Interval):
+			}
+		}
+		nonce := newNonce()
+		nonces[nonce] = false
+		if _, err := fmt.Fprintf(reflector, "%s %d %s", requestPrefix, port, nonce); err != nil {
+			return result, fmt.Errorf("failed to send to reflector %s: %w", p.Reflector, err)
+		}
+		result.Sent++
+	}
+
+	listener.SetReadDeadline(time.Now().Add(p.Wait))
+	for nonce := range received {
+		if seen, ok := nonces[nonce]; ok && !seen {
+			nonces[nonce] = true
+			result.Received++
+		}
+	}
+	return result, nil
+}
+
+// Serve answers probe requests on conn until it's closed, sending an echo to
+// the requested port on the address each request came from
+func Serve(conn net.PacketConn) error {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		port, nonce, ok := parseRequest(string(buf[:n]))
+		source, isUDP := from.(*net.UDPAddr)
+		if !ok || !isUDP {
+			continue
+		}
+		target := &net.UDPAddr{IP: source.IP, Port: port, Zone: source.Zone}
+		conn.WriteTo([]byte(echoPrefix+" "+nonce), target)
+	}
+}
+
+// parseRequest parses "GOPIA-PROBE PORT NONCE"
+func parseRequest(request string) (port int, nonce string, ok bool) {
+	fields := strings.Fields(request)
+	if len(fields) != 3 || fields[0] != requestPrefix {
+		return 0, "", false
+	}
+	port, err := strconv.Atoi(fields[1])
+	if err != nil || port < 1 || port > 65535 || len(fields[2]) > 32 {
+		return 0, "", false
+	}
+	return port, fields[2], true
+}
+
+// newNonce returns a random token identifying one request's echo
+func newNonce() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
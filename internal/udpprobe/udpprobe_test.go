@@ -0,0 +1,103 @@
+package udpprobe
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// startReflector serves probe requests on a loopback port until the test ends
+func startReflector(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go Serve(conn)
+	return conn.LocalAddr().String()
+}
+
+// freePort returns a UDP port nothing listens on
+func freePort(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestProbe(t *testing.T) {
+	prober := &Prober{Reflector: startReflector(t), Count: 3, Interval: time.Millisecond, Wait: 500 * time.Millisecond}
+	result, err := prober.Probe(context.Background(), freePort(t))
+	if err != nil {
+		t.Fatalf("Probe failed: %v", err)
+	}
+	if result.Sent != 3 || result.Received != 3 || !result.Open() || result.Loss() != 0 {
+		t.Errorf("Expected every echo to arrive, got %+v", result)
+	}
+}
+
+func TestProbeDeadPort(t *testing.T) {
+	// A reflector that never answers looks like a port nothing reaches
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer silent.Close()
+
+	prober := &Prober{Reflector: silent.LocalAddr().String(), Count: 2, Interval: time.Millisecond, Wait: 50 * time.Millisecond}
+	result, err := prober.Probe(context.Background(), freePort(t))
+	if err != nil {
+		t.Fatalf("Probe failed: %v", err)
+	}
+	if result.Open() || result.Loss() != 1 {
+		t.Errorf("Expected the port to be dead, got %+v", result)
+	}
+}
+
+func TestProbePortInUse(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer server.Close()
+
+	prober := NewProber(startReflector(t))
+	if _, err := prober.Probe(context.Background(), server.LocalAddr().(*net.UDPAddr).Port); !errors.Is(err, ErrPortInUse) {
+		t.Errorf("Expected ErrPortInUse, got %v", err)
+	}
+}
+
+func TestReflectorAddress(t *testing.T) {
+	testCases := []struct {
+		reflector string
+		expected  string
+	}{
+		{reflector: "probe.example.com", expected: "probe.example.com:7787"},
+		{reflector: "probe.example.com:9000", expected: "probe.example.com:9000"},
+		{reflector: "2001:db8::1", expected: "[2001:db8::1]:7787"},
+		{reflector: "[2001:db8::1]:9000", expected: "[2001:db8::1]:9000"},
+	}
+
+	for _, tc := range testCases {
+		if got, err := ReflectorAddress(tc.reflector); err != nil || got != tc.expected {
+			t.Errorf("%s: expected %s, got %s (%v)", tc.reflector, tc.expected, got, err)
+		}
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	if port, nonce, ok := parseRequest("GOPIA-PROBE 12345 0123abcd"); !ok || port != 12345 || nonce != "0123abcd" {
+		t.Errorf("Expected a valid request, got %d %q %v", port, nonce, ok)
+	}
+	for _, request := range []string{"GOPIA-PROBE 0 abc", "GOPIA-PROBE 70000 abc", "HELLO 12345 abc", "GOPIA-PROBE 12345"} {
+		if _, _, ok := parseRequest(request); ok {
+			t.Errorf("Expected %q to be rejected", request)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package update
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRepository is the GitHub repository releases are fetched from
+	DefaultRepository = "meschansky/go-pia"
+	// DefaultAPIURL is the GitHub API endpoint
+	DefaultAPIURL = "https://api.github.com"
+	// ChecksumsAsset lists the SHA-256 of every release binary in sha256sum format
+	ChecksumsAsset = "checksums.txt"
+	// SignatureAsset holds the base64 ed25519 signature of ChecksumsAsset
+	SignatureAsset = ChecksumsAsset + ".sig"
+	// maxAssetSize bounds how much is downloaded for a single asset
+	maxAssetSize = 100 << 20
+)
+
+// Release is a GitHub release
+type Release struct {
+	TagName string  `json:"tag_name"`
+	Assets  []Asset `json:"assets"`
+}
+
+// Asset is a file attached to a GitHub release
+type Asset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+// Updater fetches and verifies release binaries
+type Updater struct {
+	// GitHub API endpoint
+	APIURL string
+	// Repository in owner/name form
+	Repository string
+	// HTTP client used for all requests
+	Client *http.Client
+	// Key the checksums file must be signed with; signatures aren't checked if nil
+	PublicKey ed25519.PublicKey
+}
+
+// NewUpdater returns an updater for the project's GitHub releases
+func NewUpdater(publicKey ed25519.PublicKey) *Updater {
+	return &Updater{
+		APIURL:     DefaultAPIURL,
+		Repository: DefaultRepository,
+		Client:     &http.Client{Timeout: 5 * time.Minute},
+		PublicKey:  publicKey,
+	}
+}
+
+// AssetName returns the release binary name for a platform
+func AssetName(goos, goarch string) string {
+	name := fmt.Sprintf("go-pia-port-forwarding_%s_%s", goos, goarch)
+	if goos == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// Latest returns the latest published release
+func (u *Updater) Latest(ctx context.Context) (*Release, error) {
+	data, err := u.get(ctx, fmt.Sprintf("%s/repos/%s/releases/latest", u.APIURL, u.Repository))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch latest release: %w", err)
+	}
+
+	var release Release
+	if err := json.Unmarshal(data, &release); err != nil {
+		return nil, fmt.Errorf("failed to parse release: %w", err)
+	}
+	return &release, nil
+}
+
+// Download fetches the binary for the running platform and verifies it against
+// the release checksums, and the checksums against their signature if a public key is set
+func (u *Updater) Download(ctx context.Context, release *Release) ([]byte, error) {
+	name := AssetName(runtime.GOOS, runtime.GOARCH)
+
+	checksums, err := u.downloadAsset(ctx, release, ChecksumsAsset)
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify the signature before trusting any checksum in the file
+	if u.PublicKey != nil {
+		signature, err := u.downloadAsset(ctx, release, SignatureAsset)
+		if err != nil {
+			return nil, err
+		}
+		if err := VerifySignature(u.PublicKey, checksums, signature); err != nil {
+			return nil, err
+		}
+	}
+
+	expected, err := FindChecksum(checksums, name)
+	if err != nil {
+		return nil, err
+	}
+
+	binary, err := u.downloadAsset(ctx, release, name)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(binary)
+	if hex.EncodeToString(sum[:]) != expected {
+		return nil, fmt.Errorf("checksum mismatch for %s", name)
+	}
+
+	return binary, nil
+}
+
+// downloadAsset downloads a named asset of a release
+func (u *Updater) downloadAsset(ctx context.Context, release *Release, name string) ([]byte, error) {
+	for _, asset := range release.Assets {
+		if asset.Name == name {
+			data, err := u.get(ctx, asset.URL)
+			if err != nil {
+				return nil, fmt.Errorf("failed to download %s: %w", name, err)
+			}
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("release %s has no asset %s", release.TagName, name)
+}
+
+// get performs a GET request and returns the response body
+func (u *Updater) get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := u.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxAssetSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxAssetSize {
+		return nil, fmt.Errorf("response from %s exceeds %d bytes", url, maxAssetSize)
+	}
+	return data, nil
+}
+
+// FindChecksum returns the SHA-256 listed for name in a sha256sum style file
+func FindChecksum(checksums []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(strings.NewReader(string(checksums)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// Binary mode entries prefix the file name with "*"
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("no checksum listed for %s", name)
+}
+
+// VerifySignature checks a base64 ed25519 signature of data
+func VerifySignature(publicKey ed25519.PublicKey, data, signature []byte) error {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	if !ed25519.Verify(publicKey, data, raw) {
+		return fmt.Errorf("signature verification failed for %s", ChecksumsAsset)
+	}
+	return nil
+}
+
+// Replace atomically swaps the executable at exePath for binary
+func Replace(exePath string, binary []byte) error {
+	// Replace the real file, not a symlink pointing at it
+	if resolved, err := filepath.EvalSymlinks(exePath); err == nil {
+		exePath = resolved
+	}
+
+	info, err := os.Stat(exePath)
+	if err != nil {
+		return fmt.Errorf("failed to stat executable: %w", err)
+	}
+
+	// Write next to the executable so the rename stays on one filesystem
+	tmp, err := os.CreateTemp(filepath.Dir(exePath), "."+filepath.Base(exePath)+".new-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write new binary: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync new binary: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close new binary: %w", err)
+	}
+	if err := os.Chmod(tmpPath, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to set permissions: %w", err)
+	}
+
+	// A running executable can't be overwritten on Windows, but it can be moved aside
+	if runtime.GOOS == "windows" {
+		oldPath := exePath + ".old"
+		os.Remove(oldPath)
+		if err := os.Rename(exePath, oldPath); err != nil {
+			return fmt.Errorf("failed to move old binary aside: %w", err)
+		}
+		if err := os.Rename(tmpPath, exePath); err != nil {
+			os.Rename(oldPath, exePath)
+			return fmt.Errorf("failed to replace binary: %w", err)
+		}
+		return nil
+	}
+
+	if err := os.Rename(tmpPath, exePath); err != nil {
+		return fmt.Errorf("failed to replace binary: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package update
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// newReleaseServer serves a release with the given assets
+func newReleaseServer(t *testing.T, assets map[string][]byte) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	release := Release{TagName: "v1.2.3"}
+	for name, data := range assets {
+		data := data
+		release.Assets = append(release.Assets, Asset{Name: name, URL: server.URL + "/download/" + name})
+		mux.HandleFunc("/download/"+name, func(w http.ResponseWriter, r *http.Request) {
+			w.Write(data)
+		})
+	}
+	mux.HandleFunc("/repos/meschansky/go-pia/releases/latest", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(release)
+	})
+
+	return server
+}
+
+func TestDownload(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	binary := []byte("new binary")
+	sum := sha256.Sum256(binary)
+	name := AssetName(runtime.GOOS, runtime.GOARCH)
+	checksums := []byte(hex.EncodeToString(sum[:]) + "  " + name + "\n")
+	signature := []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, checksums)))
+
+	testCases := []struct {
+		name        string
+		assets      map[string][]byte
+		publicKey   ed25519.PublicKey
+		expectError bool
+	}{
+		{
+			name:      "Valid signature and checksum",
+			assets:    map[string][]byte{name: binary, ChecksumsAsset: checksums, SignatureAsset: signature},
+			publicKey: publicKey,
+		},
+		{
+			name:   "Checksum only without public key",
+			assets: map[string][]byte{name: binary, ChecksumsAsset: checksums},
+		},
+		{
+			name:        "Tampered binary",
+			assets:      map[string][]byte{name: []byte("evil"), ChecksumsAsset: checksums, SignatureAsset: signature},
+			publicKey:   publicKey,
+			expectError: true,
+		},
+		{
+			name:        "Tampered checksums",
+			assets:      map[string][]byte{name: binary, ChecksumsAsset: append(checksums, '\n'), SignatureAsset: signature},
+			publicKey:   publicKey,
+			expectError: true,
+		},
+		{
+			name:        "Missing signature",
+			assets:      map[string][]byte{name: binary, ChecksumsAsset: checksums},
+			publicKey:   publicKey,
+			expectError: true,
+		},
+		{
+			name:        "Missing platform binary",
+			assets:      map[string][]byte{ChecksumsAsset: checksums},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newReleaseServer(t, tc.assets)
+			updater := NewUpdater(tc.publicKey)
+			updater.APIURL = server.URL
+
+			release, err := updater.Latest(context.Background())
+			if err != nil {
+				t.Fatalf("Failed to fetch release: %v", err)
+			}
+			if release.TagName != "v1.2.3" {
+				t.Errorf("Expected tag v1.2.3, got %s", release.TagName)
+			}
+
+			data, err := updater.Download(context.Background(), release)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("Expected error but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+			if string(data) != string(binary) {
+				t.Errorf("Expected %q, got %q", binary, data)
+			}
+		})
+	}
+}
+
+func TestFindChecksum(t *testing.T) {
+	checksums := []byte("ABCDEF  go-pia-port-forwarding_linux_amd64\n" +
+		"123456 *go-pia-port-forwarding_windows_amd64.exe\n")
+
+	if sum, err := FindChecksum(checksums, "go-pia-port-forwarding_linux_amd64"); err != nil || sum != "abcdef" {
+		t.Errorf("Expected abcdef, got %q (err: %v)", sum, err)
+	}
+	if sum, err := FindChecksum(checksums, "go-pia-port-forwarding_windows_amd64.exe"); err != nil || sum != "123456" {
+		t.Errorf("Expected 123456, got %q (err: %v)", sum, err)
+	}
+	if _, err := FindChecksum(checksums, "go-pia-port-forwarding_darwin_arm64"); err == nil {
+		t.Errorf("Expected error for missing entry")
+	}
+}
+
+func TestReplace(t *testing.T) {
+	dir := t.TempDir()
+	exePath := filepath.Join(dir, "go-pia-port-forwarding")
+	if err := os.WriteFile(exePath, []byte("old"), 0755); err != nil {
+		t.Fatalf("Failed to write executable: %v", err)
+	}
+
+	// Replacing through a symlink updates the target
+	linkPath := filepath.Join(dir, "link")
+	if err := os.Symlink(exePath, linkPath); err != nil {
+		t.Skipf("Symlinks not supported: %v", err)
+	}
+
+	if err := Replace(linkPath, []byte("new")); err != nil {
+		t.Fatalf("Replace failed: %v", err)
+	}
+
+	data, err := os.ReadFile(exePath)
+	if err != nil || string(data) != "new" {
+		t.Errorf("Expected new binary, got %q (err: %v)", data, err)
+	}
+	info, err := os.Stat(exePath)
+	if err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("Expected mode 0755 to be preserved, got %v", info.Mode())
+	}
+
+	// No temporary files are left behind
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), ".new-") {
+			t.Errorf("Leftover temporary file: %s", entry.Name())
+		}
+	}
+}
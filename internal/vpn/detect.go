@@ -0,0 +1,186 @@
+package vpn
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/meschansky/go-pia/internal/remote"
+)
+
+// ErrNotApplicable is returned by a detection strategy that doesn't apply here,
+// such as NetworkManager when it isn't running, so the next one is tried
+var ErrNotApplicable = errors.New("not applicable")
+
+// DefaultStrategies is the detection chain used unless another is configured
+var DefaultStrategies = []string{"static", "networkmanager", "openvpn-management", "wireguard", "routes"}
+
+// Detector detects the VPN connection by trying strategies in order
+type Detector struct {
+	// Strategies to try, in order (DefaultStrategies if empty)
+	Strategies []string
+	// Path to the OpenVPN config, on the remote host if Run is set
+	OpenVPNConfig string
+	// 1-based index of the OpenVPN remote to use (0 detects the connected one)
+	RemoteIndex int
+	// Interface of the tunnel (any tun interface if empty)
+	Interface string
+	// Address of the OpenVPN management interface, as host:port or a unix socket path
+	ManagementAddr string
+	// Gateway and its hostname, used as they are by the static strategy
+	Gateway  string
+	Hostname string
+	// Runs commands on the host the VPN runs on, or nil for this host
+	Run RunFunc
+	// Resolves remote hostnames
+	Resolver *net.Resolver
+}
+
+// strategy is one way of detecting the VPN connection
+type strategy func(d *Detector) (*ConnectionInfo, error)
+
+// strategies maps each strategy name to its implementation
+var strategies = map[string]strategy{
+	"static":             detectStatic,
+	"networkmanager":     detectNetworkManager,
+	"openvpn-management": detectManagement,
+	"wireguard":          detectWireGuard,
+	// routes tries every way of reading the routing table, the others just one
+	"routes":         routesStrategy(routeSources, remoteRouteSources),
+	"netlink-routes": routesStrategy([]routeSource{netlinkSource}, nil),
+	"proc-routes": routesStrategy([]routeSource{procNetSource}, func(run RunFunc) []routeSource {
+		return []routeSource{remoteProcNetSource(run)}
+	}),
+	"ip-route": routesStrategy([]routeSource{ipRouteSource}, func(run RunFunc) []routeSource {
+		return []routeSource{remoteIPRouteSource(run)}
+	}),
+	"route-n": routesStrategy([]routeSource{routeNSource}, func(run RunFunc) []routeSource {
+		return []routeSource{remoteRouteNSource(run)}
+	}),
+}
+
+// StrategyNames lists every detection strategy
+var StrategyNames = []string{"static", "networkmanager", "openvpn-management", "wireguard", "routes", "netlink-routes", "proc-routes", "ip-route", "route-n"}
+
+// ParseStrategies parses a comma-separated list of strategy names. An empty
+// list selects DefaultStrategies.
+func ParseStrategies(s string) ([]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return DefaultStrategies, nil
+	}
+
+	var names []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := strategies[name]; !ok {
+			return nil, fmt.Errorf("unknown detection strategy %q (known: %s)", name, strings.Join(StrategyNames, ", "))
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("detection strategy %q listed twice", name)
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Detect returns the connection found by the first strategy that applies, and
+// that strategy's name. Strategies that fail don't stop the chain; if none
+// succeeds, their errors are returned together.
+func (d *Detector) Detect() (*ConnectionInfo, string, error) {
+	return d.detect(strategies)
+}
+
+// detect runs the chain with the given strategy implementations
+func (d *Detector) detect(impls map[string]strategy) (*ConnectionInfo, string, error) {
+	names := d.Strategies
+	if len(names) == 0 {
+		names = DefaultStrategies
+	}
+
+	var failures []string
+	for _, name := range names {
+		detect, ok := impls[name]
+		if !ok {
+			return nil, "", fmt.Errorf("unknown detection strategy %q", name)
+		}
+		info, err := detect(d)
+		if err == nil {
+			return info, name, nil
+		}
+		if !errors.Is(err, ErrNotApplicable) {
+			failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+
+	if len(failures) == 0 {
+		return nil, "", fmt.Errorf("no VPN connection detected (tried %s)", strings.Join(names, ", "))
+	}
+	return nil, "", errors.New(strings.Join(failures, "; "))
+}
+
+// detectStatic uses the configured gateway instead of detecting one
+func detectStatic(d *Detector) (*ConnectionInfo, error) {
+	if d.Gateway == "" {
+		return nil, ErrNotApplicable
+	}
+
+	hostname := d.Hostname
+	if hostname == "" {
+		hostname = constructHostname(d.Gateway)
+	}
+	return &ConnectionInfo{GatewayIP: d.Gateway, Hostname: hostname}, nil
+}
+
+// routesStrategy detects an OpenVPN connection from the routing table read
+// from local sources, or from the sources remoteSources returns on the remote
+// host. A nil remoteSources means the strategy only applies to this host.
+func routesStrategy(local []routeSource, remoteSources func(RunFunc) []routeSource) strategy {
+	return func(d *Detector) (*ConnectionInfo, error) {
+		if d.Run != nil {
+			if remoteSources == nil {
+				return nil, ErrNotApplicable
+			}
+			// A route through a tun interface shows OpenVPN is connected there
+			return detectConnection(remoteSources(d.Run), d.loadRemotes, d.RemoteIndex, d.Interface, d.Resolver)
+		}
+
+		// Check if the tunnel interface exists
+		if !hasTunInterface(d.Interface) {
+			if d.Interface != "" {
+				return nil, fmt.Errorf("no active OpenVPN connection detected (no %s interface)", d.Interface)
+			}
+			return nil, fmt.Errorf("no active OpenVPN connection detected (no tun interface)")
+		}
+		return detectConnection(local, d.loadRemotes, d.RemoteIndex, d.Interface, d.Resolver)
+	}
+}
+
+// loadRemotes reads the remotes from the OpenVPN config, over Run if it's set
+func (d *Detector) loadRemotes() ([]Remote, error) {
+	if d.Run == nil {
+		return parseRemotes(d.OpenVPNConfig)
+	}
+
+	data, err := d.Run("cat " + remote.Quote(d.OpenVPNConfig))
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ParseOVPNConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return configRemotes(cfg)
+}
+
+// hostRouteSources returns the fallback chain for reading the routing table of
+// the host the VPN runs on
+func (d *Detector) hostRouteSources() []routeSource {
+	if d.Run != nil {
+		return remoteRouteSources(d.Run)
+	}
+	return routeSources
+}
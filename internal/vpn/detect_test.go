@@ -0,0 +1,99 @@
+package vpn
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDetectorChain(t *testing.T) {
+	found := &ConnectionInfo{GatewayIP: "10.8.110.1", Hostname: "nl-amsterdam.privacy.network"}
+	impls := map[string]strategy{
+		"skip":  func(*Detector) (*ConnectionInfo, error) { return nil, ErrNotApplicable },
+		"fail":  func(*Detector) (*ConnectionInfo, error) { return nil, errors.New("access denied") },
+		"found": func(*Detector) (*ConnectionInfo, error) { return found, nil },
+	}
+
+	testCases := []struct {
+		name             string
+		strategies       []string
+		expectedStrategy string
+		expectedError    string
+	}{
+		{name: "First that applies wins", strategies: []string{"skip", "found", "fail"}, expectedStrategy: "found"},
+		{name: "Failures don't stop the chain", strategies: []string{"fail", "found"}, expectedStrategy: "found"},
+		{name: "Failures are reported", strategies: []string{"skip", "fail"}, expectedError: "fail: access denied"},
+		{name: "Nothing applies", strategies: []string{"skip"}, expectedError: "no VPN connection detected (tried skip)"},
+		{name: "Unknown strategy", strategies: []string{"dhcp"}, expectedError: `unknown detection strategy "dhcp"`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &Detector{Strategies: tc.strategies}
+			info, name, err := d.detect(impls)
+			if tc.expectedError != "" {
+				if err == nil || err.Error() != tc.expectedError {
+					t.Errorf("Expected error %q, got %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil || info != found || name != tc.expectedStrategy {
+				t.Errorf("Expected %s, got %+v from %q (%v)", tc.expectedStrategy, info, name, err)
+			}
+		})
+	}
+}
+
+func TestParseStrategies(t *testing.T) {
+	testCases := []struct {
+		value         string
+		expected      []string
+		expectedError string
+	}{
+		{value: "", expected: DefaultStrategies},
+		{value: "static, wireguard,route-n", expected: []string{"static", "wireguard", "route-n"}},
+		{value: "routes,dhcp", expectedError: `unknown detection strategy "dhcp"`},
+		{value: "routes,,static", expectedError: `unknown detection strategy ""`},
+		{value: "routes,routes", expectedError: "listed twice"},
+	}
+
+	for _, tc := range testCases {
+		names, err := ParseStrategies(tc.value)
+		if tc.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+				t.Errorf("ParseStrategies(%q): expected error %q, got %v", tc.value, tc.expectedError, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(names, tc.expected) {
+			t.Errorf("ParseStrategies(%q) = %v, %v; expected %v", tc.value, names, err, tc.expected)
+		}
+	}
+
+	// Every listed strategy has an implementation
+	for _, name := range StrategyNames {
+		if _, ok := strategies[name]; !ok {
+			t.Errorf("Strategy %q has no implementation", name)
+		}
+	}
+	if len(StrategyNames) != len(strategies) {
+		t.Errorf("StrategyNames lists %d strategies, %d are implemented", len(StrategyNames), len(strategies))
+	}
+}
+
+func TestDetectStatic(t *testing.T) {
+	if _, err := detectStatic(&Detector{}); !errors.Is(err, ErrNotApplicable) {
+		t.Errorf("Expected ErrNotApplicable without a gateway, got %v", err)
+	}
+
+	info, err := detectStatic(&Detector{Gateway: "10.7.128.1"})
+	if err != nil || info.GatewayIP != "10.7.128.1" || info.Hostname != "10.7.128.1.privacy.network" {
+		t.Errorf("Unexpected connection info: %+v (%v)", info, err)
+	}
+
+	info, err = detectStatic(&Detector{Gateway: "10.7.128.1", Hostname: "amsterdam407"})
+	if err != nil || info.Hostname != "amsterdam407" {
+		t.Errorf("Expected the configured hostname, got %+v (%v)", info, err)
+	}
+}
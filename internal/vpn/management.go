@@ -0,0 +1,121 @@
+package vpn
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// managementTimeout bounds a query to the OpenVPN management interface
+const managementTimeout = 5 * time.Second
+
+// managementState is the current state reported by OpenVPN's management interface
+type managementState struct {
+	// State name, such as CONNECTED or RECONNECTING
+	State string
+	// Address inside the tunnel
+	LocalIP string
+	// Address of the server OpenVPN is connected to
+	RemoteIP string
+}
+
+// detectManagement asks OpenVPN's management interface which server it's
+// connected to, so the remote is known without relying on host routes
+func detectManagement(d *Detector) (*ConnectionInfo, error) {
+	if d.ManagementAddr == "" || d.Run != nil {
+		return nil, ErrNotApplicable
+	}
+
+	state, err := queryManagementState(d.ManagementAddr)
+	if err != nil {
+		return nil, err
+	}
+	if state.State != "CONNECTED" {
+		return nil, fmt.Errorf("OpenVPN is not connected (state %s)", state.State)
+	}
+
+	// The management interface doesn't report the gateway
+	routes, err := readRoutes(routeSources)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get VPN gateway IP: %w", err)
+	}
+	gatewayIP, err := findTunGateway(routes, d.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get VPN gateway IP: %w", err)
+	}
+
+	// Select the remote OpenVPN says it's connected to
+	hostname, err := connectedHostname(d.loadRemotes, []route{{Destination: state.RemoteIP}}, d.RemoteIndex, gatewayIP, d.Resolver)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ConnectionInfo{
+		GatewayIP: gatewayIP,
+		Hostname:  hostname,
+	}, nil
+}
+
+// queryManagementState connects to the management interface at addr, a
+// host:port or a unix socket path, and asks for the current state
+func queryManagementState(addr string) (*managementState, error) {
+	network := "tcp"
+	if strings.Contains(addr, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, addr, managementTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the OpenVPN management interface: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(managementTimeout))
+
+	if _, err := io.WriteString(conn, "state\r\n"); err != nil {
+		return nil, fmt.Errorf("failed to query the OpenVPN management interface: %w", err)
+	}
+	state, err := parseManagementState(conn)
+	if err != nil {
+		return nil, err
+	}
+	io.WriteString(conn, "quit\r\n")
+
+	return state, nil
+}
+
+// parseManagementState reads the reply to the state command. Lines starting
+// with > are notifications, such as the greeting, and are skipped.
+func parseManagementState(r io.Reader) (*managementState, error) {
+	scanner := bufio.NewScanner(r)
+	var state *managementState
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "END":
+			if state == nil {
+				return nil, fmt.Errorf("OpenVPN management interface reported no state")
+			}
+			return state, nil
+		case strings.HasPrefix(line, "ENTER PASSWORD:"):
+			return nil, fmt.Errorf("the OpenVPN management interface asks for a password, which isn't supported")
+		case strings.HasPrefix(line, "ERROR:"):
+			return nil, fmt.Errorf("OpenVPN management interface: %s", strings.TrimSpace(strings.TrimPrefix(line, "ERROR:")))
+		case line == "" || strings.HasPrefix(line, ">"):
+			continue
+		}
+
+		// time,state,description,local IP,remote IP,remote port,...
+		fields := strings.Split(line, ",")
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("unexpected OpenVPN management state %q", line)
+		}
+		state = &managementState{State: fields[1], LocalIP: fields[3], RemoteIP: fields[4]}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the OpenVPN management interface: %w", err)
+	}
+
+	return nil, fmt.Errorf("OpenVPN management interface closed the connection")
+}
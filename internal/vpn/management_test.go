@@ -0,0 +1,88 @@
+package vpn
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseManagementState(t *testing.T) {
+	testCases := []struct {
+		name          string
+		reply         string
+		expected      managementState
+		expectedError string
+	}{
+		{
+			name:     "Connected",
+			reply:    ">INFO:OpenVPN Management Interface Version 5 -- type 'help' for more info\r\n1700000000,CONNECTED,SUCCESS,10.8.110.6,158.173.21.201,1198,,\r\nEND\r\n",
+			expected: managementState{State: "CONNECTED", LocalIP: "10.8.110.6", RemoteIP: "158.173.21.201"},
+		},
+		{
+			name:     "Reconnecting",
+			reply:    "1700000000,RECONNECTING,ping-restart,,,,,\r\nEND\r\n",
+			expected: managementState{State: "RECONNECTING"},
+		},
+		{
+			name:          "Password required",
+			reply:         "ENTER PASSWORD:",
+			expectedError: "asks for a password",
+		},
+		{
+			name:          "Error reply",
+			reply:         "ERROR: unknown command, enter 'help' for more options\r\n",
+			expectedError: "unknown command",
+		},
+		{
+			name:          "Closed early",
+			reply:         ">INFO:OpenVPN Management Interface Version 5\r\n",
+			expectedError: "closed the connection",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			state, err := parseManagementState(strings.NewReader(tc.reply))
+			if tc.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+					t.Errorf("Expected error %q, got %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil || *state != tc.expected {
+				t.Errorf("Expected %+v, got %+v (%v)", tc.expected, state, err)
+			}
+		})
+	}
+}
+
+func TestQueryManagementState(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte(">INFO:OpenVPN Management Interface Version 5 -- type 'help' for more info\r\n"))
+		if command, _ := bufio.NewReader(conn).ReadString('\n'); command != "state\r\n" {
+			t.Errorf("Unexpected command %q", command)
+			return
+		}
+		conn.Write([]byte("1700000000,CONNECTED,SUCCESS,10.8.110.6,158.173.21.201,1198,,\r\nEND\r\n"))
+	}()
+
+	state, err := queryManagementState(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to query state: %v", err)
+	}
+	if state.State != "CONNECTED" || state.RemoteIP != "158.173.21.201" {
+		t.Errorf("Unexpected state: %+v", state)
+	}
+}
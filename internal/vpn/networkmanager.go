@@ -0,0 +1,240 @@
+package vpn
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/meschansky/go-pia/internal/dbus"
+)
+
+const (
+	// nmService is NetworkManager's bus name, also used as its object path and interface prefix
+	nmService = "org.freedesktop.NetworkManager"
+	nmPath    = "/org/freedesktop/NetworkManager"
+	// nmOpenVPNServiceType is the vpn.service-type of nm-openvpn connections
+	nmOpenVPNServiceType = nmService + ".openvpn"
+	// nmStateActivated is the State of a fully connected active connection
+	nmStateActivated = uint32(2)
+)
+
+var (
+	// errNetworkManagerUnavailable is returned when NetworkManager isn't running
+	errNetworkManagerUnavailable = fmt.Errorf("NetworkManager is not running: %w", ErrNotApplicable)
+	// errNoNetworkManagerVPN is returned when NetworkManager has no active OpenVPN connection
+	errNoNetworkManagerVPN = fmt.Errorf("NetworkManager has no active OpenVPN connection: %w", ErrNotApplicable)
+)
+
+// busConn is the part of a D-Bus connection used to query NetworkManager
+type busConn interface {
+	Call(destination, path, iface, member, signature string, args ...any) ([]any, error)
+	GetProperty(destination, path, iface, property string) (any, error)
+}
+
+// nmConnection is an active nm-openvpn connection
+type nmConnection struct {
+	// Connection name
+	ID string
+	// Gateway inside the tunnel
+	Gateway string
+	// The remotes configured in the connection
+	Remotes []Remote
+}
+
+// detectNetworkManager detects an OpenVPN connection made by NetworkManager's
+// nm-openvpn plugin, asking NetworkManager over D-Bus for its gateway and
+// servers instead of reading the routing table. The routes nm-openvpn sets up
+// can mislead the routing table heuristic.
+func detectNetworkManager(d *Detector) (*ConnectionInfo, error) {
+	// NetworkManager only knows this host's connections, and an explicit
+	// interface picks the tunnel from the routing table
+	if d.Run != nil || d.Interface != "" {
+		return nil, ErrNotApplicable
+	}
+
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNetworkManagerUnavailable, err)
+	}
+	defer bus.Close()
+
+	return detectNetworkManagerConnection(bus, routeSources, d.RemoteIndex, d.Resolver)
+}
+
+// detectNetworkManagerConnection detects the nm-openvpn connection through bus.
+// The routing table read from sources only picks among several remotes.
+func detectNetworkManagerConnection(bus busConn, sources []routeSource, remoteIndex int, resolver *net.Resolver) (*ConnectionInfo, error) {
+	conn, err := activeNetworkManagerVPN(bus)
+	if err != nil {
+		return nil, err
+	}
+
+	// OpenVPN adds a host route to the connected server
+	routes, _ := readRoutes(sources)
+	hostname, err := connectedHostname(func() ([]Remote, error) {
+		if len(conn.Remotes) == 0 {
+			return nil, fmt.Errorf("VPN server hostname not found in NetworkManager connection %q", conn.ID)
+		}
+		return conn.Remotes, nil
+	}, routes, remoteIndex, conn.Gateway, resolver)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ConnectionInfo{
+		GatewayIP: conn.Gateway,
+		Hostname:  hostname,
+	}, nil
+}
+
+// activeNetworkManagerVPN returns the first fully connected nm-openvpn connection
+func activeNetworkManagerVPN(bus busConn) (*nmConnection, error) {
+	value, err := bus.GetProperty(nmService, nmPath, nmService, "ActiveConnections")
+	if err != nil {
+		var dbusErr *dbus.Error
+		if errors.As(err, &dbusErr) && dbusErr.Name == dbus.ErrorServiceUnknown {
+			return nil, errNetworkManagerUnavailable
+		}
+		return nil, fmt.Errorf("failed to list NetworkManager connections: %w", err)
+	}
+	paths, _ := value.([]any)
+
+	for _, p := range paths {
+		path, ok := p.(dbus.ObjectPath)
+		if !ok {
+			continue
+		}
+		conn, err := networkManagerVPN(bus, string(path))
+		if err != nil {
+			return nil, err
+		}
+		if conn != nil {
+			return conn, nil
+		}
+	}
+
+	return nil, errNoNetworkManagerVPN
+}
+
+// networkManagerVPN returns the active connection at path if it's a connected
+// nm-openvpn connection, or nil otherwise
+func networkManagerVPN(bus busConn, path string) (*nmConnection, error) {
+	const active = nmService + ".Connection.Active"
+
+	if isVPN, err := bus.GetProperty(nmService, path, active, "Vpn"); err != nil || isVPN != true {
+		return nil, err
+	}
+	if state, err := bus.GetProperty(nmService, path, active, "State"); err != nil || state != nmStateActivated {
+		return nil, err
+	}
+
+	// The connection's settings say which VPN plugin made it and how it's configured
+	settingsPath, err := bus.GetProperty(nmService, path, active, "Connection")
+	if err != nil {
+		return nil, err
+	}
+	settingsObject, _ := settingsPath.(dbus.ObjectPath)
+	reply, err := bus.Call(nmService, string(settingsObject), nmService+".Settings.Connection", "GetSettings", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read NetworkManager connection settings: %w", err)
+	}
+	if len(reply) != 1 {
+		return nil, fmt.Errorf("unexpected NetworkManager connection settings")
+	}
+	settings, _ := reply[0].(map[string]any)
+	vpnSettings, _ := settings["vpn"].(map[string]any)
+	if settingValue(vpnSettings, "service-type") != nmOpenVPNServiceType {
+		return nil, nil
+	}
+	connectionSettings, _ := settings["connection"].(map[string]any)
+	id, _ := settingValue(connectionSettings, "id").(string)
+
+	gateway, err := networkManagerGateway(bus, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var data map[string]any
+	if v, ok := settingValue(vpnSettings, "data").(map[string]any); ok {
+		data = v
+	}
+	remote, _ := data["remote"].(string)
+	port, _ := data["port"].(string)
+	proto := "udp"
+	if tcp, _ := data["proto-tcp"].(string); tcp == "yes" {
+		proto = "tcp"
+	}
+
+	return &nmConnection{
+		ID:      id,
+		Gateway: gateway,
+		Remotes: parseNetworkManagerRemotes(remote, port, proto),
+	}, nil
+}
+
+// networkManagerGateway returns the tunnel gateway of an active connection,
+// preferring IPv4
+func networkManagerGateway(bus busConn, path string) (string, error) {
+	for _, family := range []string{"4", "6"} {
+		config, err := bus.GetProperty(nmService, path, nmService+".Connection.Active", "Ip"+family+"Config")
+		if err != nil {
+			return "", err
+		}
+		configPath, _ := config.(dbus.ObjectPath)
+		if configPath == "" || configPath == "/" {
+			continue
+		}
+
+		gateway, err := bus.GetProperty(nmService, string(configPath), nmService+".IP"+family+"Config", "Gateway")
+		if err != nil {
+			return "", err
+		}
+		if s, _ := gateway.(string); s != "" {
+			return s, nil
+		}
+	}
+
+	return "", fmt.Errorf("VPN gateway IP not reported by NetworkManager")
+}
+
+// settingValue returns the value of a setting from GetSettings, unwrapping its variant
+func settingValue(settings map[string]any, key string) any {
+	if variant, ok := settings[key].(dbus.Variant); ok {
+		return variant.Value
+	}
+	return nil
+}
+
+// parseNetworkManagerRemotes parses nm-openvpn's remote setting, a list of
+// host[:port[:proto]] separated by commas or spaces. port and proto are the
+// connection's defaults.
+func parseNetworkManagerRemotes(value, port, proto string) []Remote {
+	var remotes []Remote
+	for _, entry := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		r := Remote{Host: entry, Port: firstNonEmpty(port, defaultOpenVPNPort), Proto: proto}
+
+		// IPv6 addresses are bracketed when a port follows
+		rest := ""
+		if strings.HasPrefix(entry, "[") {
+			if end := strings.Index(entry, "]"); end > 0 {
+				r.Host, rest = entry[1:end], strings.TrimPrefix(entry[end+1:], ":")
+			}
+		} else if strings.Count(entry, ":") <= 2 {
+			r.Host, rest, _ = strings.Cut(entry, ":")
+		}
+
+		if rest != "" {
+			entryPort, entryProto, _ := strings.Cut(rest, ":")
+			if entryPort != "" {
+				r.Port = entryPort
+			}
+			if entryProto != "" {
+				r.Proto = entryProto
+			}
+		}
+		remotes = append(remotes, r)
+	}
+
+	return remotes
+}
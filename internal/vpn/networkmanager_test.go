@@ -0,0 +1,172 @@
+package vpn
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/meschansky/go-pia/internal/dbus"
+)
+
+// fakeNetworkManager serves NetworkManager properties and connection settings,
+// keyed by object path and name
+type fakeNetworkManager struct {
+	properties map[string]any
+	settings   map[string]map[string]any
+	err        error
+}
+
+func (f *fakeNetworkManager) GetProperty(destination, path, iface, property string) (any, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	value, ok := f.properties[path+" "+property]
+	if !ok {
+		return nil, &dbus.Error{Name: "org.freedesktop.DBus.Error.UnknownProperty"}
+	}
+	return value, nil
+}
+
+func (f *fakeNetworkManager) Call(destination, path, iface, member, signature string, args ...any) ([]any, error) {
+	settings, ok := f.settings[path]
+	if !ok || member != "GetSettings" {
+		return nil, &dbus.Error{Name: "org.freedesktop.DBus.Error.UnknownMethod"}
+	}
+	return []any{settings}, nil
+}
+
+// vpnSettings returns GetSettings output for a VPN connection
+func vpnSettings(id, serviceType string, data map[string]any) map[string]any {
+	return map[string]any{
+		"connection": map[string]any{"id": dbus.Variant{Signature: "s", Value: id}},
+		"vpn": map[string]any{
+			"service-type": dbus.Variant{Signature: "s", Value: serviceType},
+			"data":         dbus.Variant{Signature: "a{ss}", Value: data},
+		},
+	}
+}
+
+func TestDetectNetworkManagerConnection(t *testing.T) {
+	const (
+		wifi    = "/org/freedesktop/NetworkManager/ActiveConnection/1"
+		vpnc    = "/org/freedesktop/NetworkManager/ActiveConnection/2"
+		openvpn = "/org/freedesktop/NetworkManager/ActiveConnection/3"
+	)
+	nm := func(active ...string) *fakeNetworkManager {
+		paths := []any{}
+		for _, path := range active {
+			paths = append(paths, dbus.ObjectPath(path))
+		}
+		return &fakeNetworkManager{
+			properties: map[string]any{
+				"/org/freedesktop/NetworkManager ActiveConnections": paths,
+				wifi + " Vpn":           false,
+				vpnc + " Vpn":           true,
+				vpnc + " State":         uint32(2),
+				vpnc + " Connection":    dbus.ObjectPath("/org/freedesktop/NetworkManager/Settings/2"),
+				openvpn + " Vpn":        true,
+				openvpn + " State":      uint32(2),
+				openvpn + " Connection": dbus.ObjectPath("/org/freedesktop/NetworkManager/Settings/3"),
+				openvpn + " Ip4Config":  dbus.ObjectPath("/org/freedesktop/NetworkManager/IP4Config/9"),
+				"/org/freedesktop/NetworkManager/IP4Config/9 Gateway": "10.8.110.1",
+			},
+			settings: map[string]map[string]any{
+				"/org/freedesktop/NetworkManager/Settings/2": vpnSettings("Office", "org.freedesktop.NetworkManager.vpnc", nil),
+				"/org/freedesktop/NetworkManager/Settings/3": vpnSettings("PIA Netherlands", "org.freedesktop.NetworkManager.openvpn", map[string]any{
+					"remote":    "nl-amsterdam.privacy.network:1198",
+					"proto-tcp": "no",
+				}),
+			},
+		}
+	}
+	noRoutes := []routeSource{{name: "none", routes: func() ([]route, error) { return nil, nil }}}
+
+	testCases := []struct {
+		name             string
+		bus              *fakeNetworkManager
+		expectedGateway  string
+		expectedHostname string
+		expectedError    error
+	}{
+		{
+			name:             "OpenVPN connection among others",
+			bus:              nm(wifi, vpnc, openvpn),
+			expectedGateway:  "10.8.110.1",
+			expectedHostname: "nl-amsterdam.privacy.network",
+		},
+		{
+			name:          "Only other VPN types",
+			bus:           nm(wifi, vpnc),
+			expectedError: errNoNetworkManagerVPN,
+		},
+		{
+			name:          "NetworkManager not running",
+			bus:           &fakeNetworkManager{err: &dbus.Error{Name: dbus.ErrorServiceUnknown}},
+			expectedError: errNetworkManagerUnavailable,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			info, err := detectNetworkManagerConnection(tc.bus, noRoutes, 0, net.DefaultResolver)
+			if tc.expectedError != nil {
+				if !errors.Is(err, tc.expectedError) {
+					t.Errorf("Expected %v, got %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if info.GatewayIP != tc.expectedGateway || info.Hostname != tc.expectedHostname {
+				t.Errorf("Expected %s (%s), got %s (%s)", tc.expectedGateway, tc.expectedHostname, info.GatewayIP, info.Hostname)
+			}
+		})
+	}
+}
+
+func TestParseNetworkManagerRemotes(t *testing.T) {
+	testCases := []struct {
+		name     string
+		value    string
+		port     string
+		proto    string
+		expected []Remote
+	}{
+		{
+			name:     "Host only",
+			value:    "nl-amsterdam.privacy.network",
+			proto:    "udp",
+			expected: []Remote{{Host: "nl-amsterdam.privacy.network", Port: "1194", Proto: "udp"}},
+		},
+		{
+			name:  "Several with ports and protocols",
+			value: "nl-amsterdam.privacy.network:1198, 158.173.21.201:443:tcp",
+			port:  "1197",
+			proto: "udp",
+			expected: []Remote{
+				{Host: "nl-amsterdam.privacy.network", Port: "1198", Proto: "udp"},
+				{Host: "158.173.21.201", Port: "443", Proto: "tcp"},
+			},
+		},
+		{
+			name:  "IPv6",
+			value: "[2001:db8::1]:1198 2001:db8::2",
+			proto: "udp",
+			expected: []Remote{
+				{Host: "2001:db8::1", Port: "1198", Proto: "udp"},
+				{Host: "2001:db8::2", Port: "1194", Proto: "udp"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			remotes := parseNetworkManagerRemotes(tc.value, tc.port, tc.proto)
+			if !reflect.DeepEqual(remotes, tc.expected) {
+				t.Errorf("Expected %+v, got %+v", tc.expected, remotes)
+			}
+		})
+	}
+}
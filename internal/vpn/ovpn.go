@@ -0,0 +1,187 @@
+package vpn
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/lines"
+)
+
+// defaultOpenVPNPort is the port OpenVPN uses when a config doesn't specify one
+const defaultOpenVPNPort = "1194"
+
+// Remote is a "remote" entry from an OpenVPN config
+type Remote struct {
+	Host  string
+	Port  string
+	Proto string
+}
+
+// OVPNConfig holds the parts of an OpenVPN client config relevant to port forwarding
+type OVPNConfig struct {
+	// Protocol set by the top-level "proto" directive
+	Proto string
+	// Port set by the top-level "port" or "rport" directive
+	Port string
+	// All remotes, including those inside <connection> blocks, with
+	// port and protocol resolved from the enclosing defaults
+	Remotes []Remote
+	// Whether OpenVPN picks remotes in random order
+	RemoteRandom bool
+	// How long OpenVPN waits for a server response before trying the next remote
+	ServerPollTimeout time.Duration
+	// Contents of inline blocks such as <ca> and <crl-verify>, keyed by tag
+	Inline map[string]string
+}
+
+// connectionBlock tracks the options of a single <connection> block while parsing
+type connectionBlock struct {
+	proto   string
+	port    string
+	remotes []Remote
+}
+
+// LoadOVPNConfig reads and parses an OpenVPN config file
+func LoadOVPNConfig(path string) (*OVPNConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open OpenVPN config: %w", err)
+	}
+	defer file.Close()
+
+	return ParseOVPNConfig(file)
+}
+
+// ParseOVPNConfig parses an OpenVPN config
+func ParseOVPNConfig(r io.Reader) (*OVPNConfig, error) {
+	cfg := &OVPNConfig{Inline: make(map[string]string)}
+
+	// Remotes are resolved at the end since "proto" and "port" may follow them
+	var topLevel connectionBlock
+	var blocks []*connectionBlock
+	var current *connectionBlock
+
+	var inlineTag string
+	var inlineContent []string
+
+	scanner := lines.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+
+		// Collect the contents of inline blocks such as <ca>
+		if inlineTag != "" {
+			if line == "</"+inlineTag+">" {
+				cfg.Inline[inlineTag] = strings.Join(inlineContent, "\n")
+				inlineTag = ""
+				inlineContent = nil
+			} else {
+				inlineContent = append(inlineContent, line)
+			}
+			continue
+		}
+
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		// Handle block start and end tags
+		if strings.HasPrefix(line, "<") && strings.HasSuffix(line, ">") {
+			tag := strings.Trim(line, "<>")
+			switch {
+			case tag == "connection":
+				current = &connectionBlock{}
+				blocks = append(blocks, current)
+			case tag == "/connection":
+				if current == nil {
+					return nil, fmt.Errorf("line %d: </connection> without matching <connection>", lineNum)
+				}
+				current = nil
+			case strings.HasPrefix(tag, "/"):
+				return nil, fmt.Errorf("line %d: unexpected closing tag %s", lineNum, line)
+			default:
+				inlineTag = tag
+			}
+			continue
+		}
+
+		block := &topLevel
+		if current != nil {
+			block = current
+		}
+
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "remote":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("line %d: remote requires a host", lineNum)
+			}
+			remote := Remote{Host: fields[1]}
+			if len(fields) >= 3 {
+				remote.Port = fields[2]
+			}
+			if len(fields) >= 4 {
+				remote.Proto = fields[3]
+			}
+			block.remotes = append(block.remotes, remote)
+		case "proto":
+			if len(fields) >= 2 {
+				block.proto = fields[1]
+			}
+		case "port", "rport":
+			if len(fields) >= 2 {
+				block.port = fields[1]
+			}
+		case "remote-random":
+			cfg.RemoteRandom = true
+		case "server-poll-timeout":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("line %d: server-poll-timeout requires a value", lineNum)
+			}
+			seconds, err := strconv.Atoi(strings.TrimSuffix(fields[1], "s"))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid server-poll-timeout %q", lineNum, fields[1])
+			}
+			cfg.ServerPollTimeout = time.Duration(seconds) * time.Second
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading OpenVPN config: %w", err)
+	}
+	if inlineTag != "" {
+		return nil, fmt.Errorf("unterminated inline block <%s>", inlineTag)
+	}
+	if current != nil {
+		return nil, fmt.Errorf("unterminated <connection> block")
+	}
+
+	cfg.Proto = topLevel.proto
+	cfg.Port = topLevel.port
+
+	// Resolve remotes, with explicit values taking precedence over block and global defaults
+	for _, block := range append([]*connectionBlock{&topLevel}, blocks...) {
+		for _, remote := range block.remotes {
+			remote.Port = firstNonEmpty(remote.Port, block.port, topLevel.port, defaultOpenVPNPort)
+			remote.Proto = firstNonEmpty(remote.Proto, block.proto, topLevel.proto, "udp")
+			cfg.Remotes = append(cfg.Remotes, remote)
+		}
+	}
+
+	return cfg, nil
+}
+
+// firstNonEmpty returns the first non-empty string
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
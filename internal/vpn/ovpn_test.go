@@ -0,0 +1,155 @@
+package vpn
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadOVPNConfig(t *testing.T) {
+	testCases := []struct {
+		name              string
+		file              string
+		proto             string
+		port              string
+		remotes           []Remote
+		remoteRandom      bool
+		serverPollTimeout time.Duration
+		inline            []string
+	}{
+		{
+			name:  "PIA website config",
+			file:  "testdata/pia-strong.ovpn",
+			proto: "udp",
+			remotes: []Remote{
+				{Host: "de-frankfurt.privacy.network", Port: "1197", Proto: "udp"},
+			},
+			inline: []string{"ca", "crl-verify"},
+		},
+		{
+			name:  "PIA manual-connections config",
+			file:  "testdata/pia-manual-connections.ovpn",
+			proto: "udp",
+			remotes: []Remote{
+				{Host: "212.102.57.138", Port: "1198", Proto: "udp"},
+			},
+			inline: []string{"ca", "crl-verify"},
+		},
+		{
+			name: "Connection blocks",
+			file: "testdata/connection-blocks.ovpn",
+			port: "1198",
+			remotes: []Remote{
+				{Host: "212.102.57.138", Port: "1198", Proto: "udp"},
+				{Host: "195.181.170.225", Port: "502", Proto: "tcp-client"},
+				{Host: "de-frankfurt.privacy.network", Port: "8080", Proto: "tcp"},
+			},
+			remoteRandom:      true,
+			serverPollTimeout: 4 * time.Second,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := LoadOVPNConfig(tc.file)
+			if err != nil {
+				t.Fatalf("Failed to load config: %v", err)
+			}
+
+			if cfg.Proto != tc.proto {
+				t.Errorf("Expected proto %q, got %q", tc.proto, cfg.Proto)
+			}
+			if cfg.Port != tc.port {
+				t.Errorf("Expected port %q, got %q", tc.port, cfg.Port)
+			}
+			if cfg.RemoteRandom != tc.remoteRandom {
+				t.Errorf("Expected remote-random %v, got %v", tc.remoteRandom, cfg.RemoteRandom)
+			}
+			if cfg.ServerPollTimeout != tc.serverPollTimeout {
+				t.Errorf("Expected server-poll-timeout %s, got %s", tc.serverPollTimeout, cfg.ServerPollTimeout)
+			}
+
+			if len(cfg.Remotes) != len(tc.remotes) {
+				t.Fatalf("Expected %d remotes, got %d: %+v", len(tc.remotes), len(cfg.Remotes), cfg.Remotes)
+			}
+			for i, remote := range cfg.Remotes {
+				if remote != tc.remotes[i] {
+					t.Errorf("Remote %d: expected %+v, got %+v", i, tc.remotes[i], remote)
+				}
+			}
+
+			if len(cfg.Inline) != len(tc.inline) {
+				t.Errorf("Expected %d inline blocks, got %d", len(tc.inline), len(cfg.Inline))
+			}
+			for _, tag := range tc.inline {
+				if !strings.HasPrefix(cfg.Inline[tag], "-----BEGIN") {
+					t.Errorf("Expected inline block <%s> to contain PEM data, got %q", tag, cfg.Inline[tag])
+				}
+			}
+		})
+	}
+}
+
+func TestParseOVPNConfigErrors(t *testing.T) {
+	testCases := []struct {
+		name    string
+		content string
+	}{
+		{name: "Unterminated inline block", content: "<ca>\n-----BEGIN CERTIFICATE-----\n"},
+		{name: "Unterminated connection block", content: "<connection>\nremote example.com\n"},
+		{name: "Unmatched closing tag", content: "</connection>\n"},
+		{name: "Remote without host", content: "remote\n"},
+		{name: "Invalid server-poll-timeout", content: "server-poll-timeout soon\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := ParseOVPNConfig(strings.NewReader(tc.content)); err == nil {
+				t.Errorf("Expected error but got nil")
+			}
+		})
+	}
+}
+
+func TestParseOVPNConfigLineEndings(t *testing.T) {
+	data, err := os.ReadFile("testdata/pia-strong.ovpn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ParseOVPNConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Saved by a Windows editor, and with old Mac line endings
+	for name, content := range map[string]string{
+		"BOM and CRLF": "\uFEFF" + strings.ReplaceAll(string(data), "\n", "\r\n"),
+		"Lone CR":      strings.ReplaceAll(string(data), "\n", "\r"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := ParseOVPNConfig(strings.NewReader(content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cfg, expected) {
+				t.Errorf("Expected %+v, got %+v", expected, cfg)
+			}
+		})
+	}
+}
+
+func BenchmarkParseOVPNConfig(b *testing.B) {
+	data, err := os.ReadFile("testdata/pia-strong.ovpn")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(data)))
+	for b.Loop() {
+		if _, err := ParseOVPNConfig(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package vpn
+
+// RunFunc runs a shell command on the host the VPN runs on and returns its output
+type RunFunc func(command string) ([]byte, error)
+
+// remoteRouteSources reads the routing table of the host commands are run on.
+// The text output of ip and route is preferred since /proc/net/route is in the
+// host's byte order, which may not match ours.
+func remoteRouteSources(run RunFunc) []routeSource {
+	return []routeSource{remoteIPRouteSource(run), remoteRouteNSource(run), remoteProcNetSource(run)}
+}
+
+// remoteIPRouteSource reads the remote routing table with ip route
+func remoteIPRouteSource(run RunFunc) routeSource {
+	return routeSource{name: "ip route", routes: func() ([]route, error) {
+		output, err := run("ip route")
+		if err != nil {
+			return nil, err
+		}
+		return parseIPRoute(string(output)), nil
+	}}
+}
+
+// remoteRouteNSource reads the remote routing table with route -n
+func remoteRouteNSource(run RunFunc) routeSource {
+	return routeSource{name: "route -n", routes: func() ([]route, error) {
+		output, err := run("route -n")
+		if err != nil {
+			return nil, err
+		}
+		return parseRouteN(string(output)), nil
+	}}
+}
+
+// remoteProcNetSource reads the remote /proc/net/route
+func remoteProcNetSource(run RunFunc) routeSource {
+	return routeSource{name: procNetRoutePath, routes: func() ([]route, error) {
+		output, err := run("cat " + procNetRoutePath)
+		if err != nil {
+			return nil, err
+		}
+		return parseProcNetRoute(string(output))
+	}}
+}
@@ -0,0 +1,47 @@
+package vpn
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDetectRemoteConnection(t *testing.T) {
+	config, err := os.ReadFile(filepath.Join("testdata", "pia-strong.ovpn"))
+	if err != nil {
+		t.Fatalf("Failed to read test config: %v", err)
+	}
+
+	// A router without ip, answering like busybox route
+	var commands []string
+	run := func(command string) ([]byte, error) {
+		commands = append(commands, command)
+		switch command {
+		case "route -n":
+			return []byte(`Kernel IP routing table
+Destination     Gateway         Genmask         Flags Metric Ref    Use Iface
+0.0.0.0         10.8.110.1      128.0.0.0       UG    0      0        0 tun0
+192.168.1.0     0.0.0.0         255.255.255.0   U     0      0        0 br-lan
+`), nil
+		case "cat '/etc/openvpn/pia.ovpn'":
+			return config, nil
+		}
+		return nil, errors.New("sh: not found")
+	}
+
+	// Only strategies that work over SSH run commands
+	detector := &Detector{Run: run, OpenVPNConfig: "/etc/openvpn/pia.ovpn", Resolver: net.DefaultResolver}
+	info, strategy, err := detector.Detect()
+	if err != nil {
+		t.Fatalf("Failed to detect connection: %v", err)
+	}
+	if info.GatewayIP != "10.8.110.1" || info.Hostname != "de-frankfurt.privacy.network" || strategy != "routes" {
+		t.Errorf("Unexpected connection info: %+v (%s)", info, strategy)
+	}
+	if strings.Join(commands, ",") != "grep -l '^DEVTYPE=wireguard$' /sys/class/net/*/uevent,ip route,route -n,cat '/etc/openvpn/pia.ovpn'" {
+		t.Errorf("Unexpected commands: %q", commands)
+	}
+}
@@ -0,0 +1,72 @@
+package vpn
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// lookupFunc resolves remote hostnames when matching them against the routing table
+type lookupFunc func(host string) ([]string, error)
+
+// parseRemotes returns every remote in an OpenVPN config, including those inside <connection> blocks
+func parseRemotes(configPath string) ([]Remote, error) {
+	cfg, err := LoadOVPNConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return configRemotes(cfg)
+}
+
+// configRemotes returns the remotes of a parsed config, which must have at least one
+func configRemotes(cfg *OVPNConfig) ([]Remote, error) {
+	if len(cfg.Remotes) == 0 {
+		return nil, fmt.Errorf("VPN server hostname not found in OpenVPN config")
+	}
+
+	return cfg.Remotes, nil
+}
+
+// selectRemote picks the remote in use. An explicit 1-based index wins; otherwise the
+// remote whose address has a host route (OpenVPN adds one for the connected server) is
+// chosen, falling back to the first remote.
+func selectRemote(remotes []Remote, routes []route, remoteIndex int, lookup lookupFunc) (Remote, error) {
+	if remoteIndex > 0 {
+		if remoteIndex > len(remotes) {
+			return Remote{}, fmt.Errorf("remote index %d out of range: OpenVPN config has %d remote(s)", remoteIndex, len(remotes))
+		}
+		return remotes[remoteIndex-1], nil
+	}
+
+	if len(remotes) == 1 {
+		return remotes[0], nil
+	}
+
+	// Collect the destinations of all host routes
+	hostRoutes := make(map[string]bool)
+	for _, r := range routes {
+		destination := strings.TrimSuffix(strings.TrimSuffix(r.Destination, "/32"), "/128")
+		if net.ParseIP(destination) != nil {
+			hostRoutes[destination] = true
+		}
+	}
+
+	for _, remote := range remotes {
+		addrs := []string{remote.Host}
+		if net.ParseIP(remote.Host) == nil {
+			resolved, err := lookup(remote.Host)
+			if err != nil {
+				continue
+			}
+			addrs = resolved
+		}
+
+		for _, addr := range addrs {
+			if hostRoutes[addr] {
+				return remote, nil
+			}
+		}
+	}
+
+	return remotes[0], nil
+}
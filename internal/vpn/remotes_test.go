@@ -0,0 +1,126 @@
+package vpn
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const multiRemoteConfig = `client
+dev tun
+proto udp
+remote-random
+remote de-frankfurt.privacy.network 1198 udp
+<connection>
+remote 212.102.57.138 1198 udp
+</connection>
+<connection>
+remote 195.181.170.225 502 tcp
+</connection>
+<ca>
+-----BEGIN CERTIFICATE-----
+remote this-is-not-a-remote 1 udp
+-----END CERTIFICATE-----
+</ca>
+`
+
+func TestParseRemotes(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "multi.ovpn")
+	if err := os.WriteFile(configFile, []byte(multiRemoteConfig), 0644); err != nil {
+		t.Fatalf("Failed to write test config file: %v", err)
+	}
+
+	remotes, err := parseRemotes(configFile)
+	if err != nil {
+		t.Fatalf("Failed to parse remotes: %v", err)
+	}
+
+	expected := []Remote{
+		{Host: "de-frankfurt.privacy.network", Port: "1198", Proto: "udp"},
+		{Host: "212.102.57.138", Port: "1198", Proto: "udp"},
+		{Host: "195.181.170.225", Port: "502", Proto: "tcp"},
+	}
+	if len(remotes) != len(expected) {
+		t.Fatalf("Expected %d remotes, got %d: %+v", len(expected), len(remotes), remotes)
+	}
+	for i, remote := range remotes {
+		if remote != expected[i] {
+			t.Errorf("Remote %d: expected %+v, got %+v", i, expected[i], remote)
+		}
+	}
+}
+
+func TestSelectRemote(t *testing.T) {
+	// Avoid real DNS lookups
+	lookup := func(host string) ([]string, error) {
+		if host == "de-frankfurt.privacy.network" {
+			return []string{"212.102.57.1"}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+
+	remotes := []Remote{
+		{Host: "de-frankfurt.privacy.network"},
+		{Host: "212.102.57.138"},
+		{Host: "195.181.170.225"},
+	}
+
+	testCases := []struct {
+		name        string
+		routes      []route
+		remoteIndex int
+		expected    string
+		expectError bool
+	}{
+		{
+			name:     "No host route falls back to first remote",
+			routes:   []route{{Destination: "default", Gateway: "192.168.1.1", Interface: "eth0"}},
+			expected: "de-frankfurt.privacy.network",
+		},
+		{
+			name:     "Host route matches IP remote",
+			routes:   []route{{Destination: "195.181.170.225", Gateway: "192.168.1.1", Interface: "eth0"}},
+			expected: "195.181.170.225",
+		},
+		{
+			name:     "Netlink style host route matches IP remote",
+			routes:   []route{{Destination: "212.102.57.138/32", Gateway: "192.168.1.1", Interface: "eth0"}},
+			expected: "212.102.57.138",
+		},
+		{
+			name:     "Host route matches resolved hostname",
+			routes:   []route{{Destination: "212.102.57.1", Gateway: "192.168.1.1", Interface: "eth0"}},
+			expected: "de-frankfurt.privacy.network",
+		},
+		{
+			name:        "Explicit index",
+			routes:      []route{{Destination: "195.181.170.225", Gateway: "192.168.1.1", Interface: "eth0"}},
+			remoteIndex: 2,
+			expected:    "212.102.57.138",
+		},
+		{
+			name:        "Index out of range",
+			remoteIndex: 4,
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			remote, err := selectRemote(remotes, tc.routes, tc.remoteIndex, lookup)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("Expected error but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+			if remote.Host != tc.expected {
+				t.Errorf("Expected remote %q, got %q", tc.expected, remote.Host)
+			}
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package vpn
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	// procNetRoutePath is the kernel's IPv4 routing table
+	procNetRoutePath = "/proc/net/route"
+	// procNetIPv6RoutePath is the kernel's IPv6 routing table
+	procNetIPv6RoutePath = "/proc/net/ipv6_route"
+)
+
+// errSourceUnavailable is returned by a route source that can't run on this system
+var errSourceUnavailable = errors.New("not available")
+
+// route is a single routing table entry
+type route struct {
+	Destination string
+	Gateway     string
+	Interface   string
+}
+
+// routeSource is one way of reading the routing table
+type routeSource struct {
+	name   string
+	routes func() ([]route, error)
+}
+
+// Ways of reading this host's routing table
+var (
+	netlinkSource = routeSource{name: "netlink", routes: netlinkRoutes}
+	procNetSource = routeSource{name: procNetRoutePath, routes: procNetRoutes}
+	ipRouteSource = routeSource{name: "ip route", routes: ipRouteRoutes}
+	routeNSource  = routeSource{name: "route -n", routes: routeNRoutes}
+)
+
+// routeSources is the fallback chain used to read the routing table, in order of preference
+var routeSources = []routeSource{netlinkSource, procNetSource, ipRouteSource, routeNSource}
+
+// readRoutes reads the routing table using the first source that works
+func readRoutes(sources []routeSource) ([]route, error) {
+	var failures []string
+	for _, source := range sources {
+		routes, err := source.routes()
+		if err == nil {
+			return routes, nil
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", source.name, err))
+	}
+
+	return nil, fmt.Errorf("unable to read the routing table (%s); install iproute2 (ip) or net-tools (route), or make %s available",
+		strings.Join(failures, "; "), procNetRoutePath)
+}
+
+// piaVirtualNetwork holds the gateways PIA assigns inside its tunnels
+var piaVirtualNetwork = &net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}
+
+// gatewayRoute is a candidate VPN gateway and the interface it's reached through
+type gatewayRoute struct {
+	gateway string
+	iface   string
+}
+
+// findTunGateway returns the VPN gateway from the routes through tun interfaces,
+// or through iface alone if it's set. IPv4 gateways are preferred; link-local
+// IPv6 gateways are skipped since they can't be reached without an interface
+// zone. With several tunnels up, such as PIA next to another VPN, gateways in
+// PIA's 10.0.0.0/8 range win, and it's an error if that still leaves several.
+func findTunGateway(routes []route, iface string) (string, error) {
+	var ipv4, ipv6 []gatewayRoute
+	seen := make(map[gatewayRoute]bool)
+	for _, r := range routes {
+		if r.Gateway == "" || !isVPNInterface(r.Interface, iface) {
+			continue
+		}
+
+		ip := net.ParseIP(r.Gateway)
+		if ip == nil || ip.IsUnspecified() || ip.IsLinkLocalUnicast() {
+			continue
+		}
+
+		candidate := gatewayRoute{gateway: r.Gateway, iface: r.Interface}
+		if seen[candidate] {
+			continue
+		}
+		seen[candidate] = true
+		if ip.To4() != nil {
+			ipv4 = append(ipv4, candidate)
+		} else {
+			ipv6 = append(ipv6, candidate)
+		}
+	}
+
+	candidates := ipv4
+	if len(candidates) == 0 {
+		candidates = ipv6
+	}
+	if len(candidates) > 1 {
+		var pia []gatewayRoute
+		for _, c := range candidates {
+			if piaVirtualNetwork.Contains(net.ParseIP(c.gateway)) {
+				pia = append(pia, c)
+			}
+		}
+		if len(pia) > 0 {
+			candidates = pia
+		}
+	}
+
+	switch {
+	case len(candidates) == 1:
+		return candidates[0].gateway, nil
+	case len(candidates) > 1:
+		var found []string
+		for _, c := range candidates {
+			found = append(found, fmt.Sprintf("%s via %s", c.gateway, c.iface))
+		}
+		return "", fmt.Errorf("found several VPN gateways (%s); set the interface of the PIA tunnel to pick one", strings.Join(found, ", "))
+	case iface != "":
+		return "", fmt.Errorf("VPN gateway IP not found in routing table for interface %s", iface)
+	default:
+		return "", fmt.Errorf("VPN gateway IP not found in routing table")
+	}
+}
+
+// isVPNInterface reports whether name is iface, or a tun interface if iface is empty
+func isVPNInterface(name, iface string) bool {
+	if iface != "" {
+		return name == iface
+	}
+	return strings.HasPrefix(name, "tun")
+}
+
+// procNetRoutes reads the IPv4 and IPv6 routing tables from /proc
+func procNetRoutes() ([]route, error) {
+	data, err := os.ReadFile(procNetRoutePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errSourceUnavailable
+		}
+		return nil, err
+	}
+
+	routes, err := parseProcNetRoute(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	// The IPv6 table is missing when IPv6 is disabled
+	data, err = os.ReadFile(procNetIPv6RoutePath)
+	if err != nil {
+		return routes, nil
+	}
+
+	ipv6Routes, err := parseProcNetIPv6Route(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	return append(routes, ipv6Routes...), nil
+}
+
+// parseProcNetRoute parses the contents of /proc/net/route
+func parseProcNetRoute(content string) ([]route, error) {
+	var routes []route
+	scanner := bufio.NewScanner(strings.NewReader(content))
+
+	// Skip the header line
+	scanner.Scan()
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+
+		destination, err := parseProcNetRouteAddr(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		gateway, err := parseProcNetRouteAddr(fields[2])
+		if err != nil {
+			return nil, err
+		}
+
+		routes = append(routes, route{
+			Destination: destination,
+			Gateway:     gateway,
+			Interface:   fields[0],
+		})
+	}
+
+	return routes, scanner.Err()
+}
+
+// parseProcNetRouteAddr decodes a hex address in host byte order
+func parseProcNetRouteAddr(value string) (string, error) {
+	addr, err := strconv.ParseUint(value, 16, 32)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %q in %s: %w", value, procNetRoutePath, err)
+	}
+
+	ip := make(net.IP, net.IPv4len)
+	binary.NativeEndian.PutUint32(ip, uint32(addr))
+	return ip.String(), nil
+}
+
+// parseProcNetIPv6Route parses the contents of /proc/net/ipv6_route
+func parseProcNetIPv6Route(content string) ([]route, error) {
+	var routes []route
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+
+		destination, err := parseProcNetIPv6Addr(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		prefixLen, err := strconv.ParseUint(fields[1], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix length %q in %s: %w", fields[1], procNetIPv6RoutePath, err)
+		}
+		gateway, err := parseProcNetIPv6Addr(fields[4])
+		if err != nil {
+			return nil, err
+		}
+
+		routes = append(routes, route{
+			Destination: fmt.Sprintf("%s/%d", destination, prefixLen),
+			Gateway:     gateway,
+			Interface:   fields[9],
+		})
+	}
+
+	return routes, scanner.Err()
+}
+
+// parseProcNetIPv6Addr decodes a 32-digit hex IPv6 address in network byte order
+func parseProcNetIPv6Addr(value string) (string, error) {
+	raw, err := hex.DecodeString(value)
+	if err != nil || len(raw) != net.IPv6len {
+		return "", fmt.Errorf("invalid address %q in %s", value, procNetIPv6RoutePath)
+	}
+	return net.IP(raw).String(), nil
+}
+
+// ipRouteRoutes reads the routing table using the "ip route" command
+func ipRouteRoutes() ([]route, error) {
+	if _, err := exec.LookPath("ip"); err != nil {
+		return nil, errSourceUnavailable
+	}
+
+	output, err := exec.Command("ip", "route").Output()
+	if err != nil {
+		return nil, err
+	}
+	routes := parseIPRoute(string(output))
+
+	// IPv6 routes are listed separately and may be unavailable
+	if output, err := exec.Command("ip", "-6", "route").Output(); err == nil {
+		routes = append(routes, parseIPRoute(string(output))...)
+	}
+
+	return routes, nil
+}
+
+// parseIPRoute parses the output of "ip route"
+func parseIPRoute(output string) []route {
+	var routes []route
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		r := route{Destination: fields[0]}
+		for i := 1; i < len(fields)-1; i++ {
+			switch fields[i] {
+			case "via":
+				r.Gateway = fields[i+1]
+			case "dev":
+				r.Interface = fields[i+1]
+			}
+		}
+		routes = append(routes, r)
+	}
+
+	return routes
+}
+
+// routeNRoutes reads the routing table using the legacy "route -n" command
+func routeNRoutes() ([]route, error) {
+	if _, err := exec.LookPath("route"); err != nil {
+		return nil, errSourceUnavailable
+	}
+
+	output, err := exec.Command("route", "-n").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	return parseRouteN(string(output)), nil
+}
+
+// parseRouteN parses the output of "route -n"
+func parseRouteN(output string) []route {
+	var routes []route
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		// Skip the title and header lines
+		if len(fields) < 8 || net.ParseIP(fields[0]) == nil {
+			continue
+		}
+
+		routes = append(routes, route{
+			Destination: fields[0],
+			Gateway:     fields[1],
+			Interface:   fields[len(fields)-1],
+		})
+	}
+
+	return routes
+}
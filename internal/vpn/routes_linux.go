@@ -0,0 +1,57 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// netlinkRoutes reads the routing table directly from the kernel over netlink
+func netlinkRoutes() ([]route, error) {
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, fmt.Errorf("netlink request failed: %w", err)
+	}
+
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse netlink response: %w", err)
+	}
+
+	var routes []route
+	for _, msg := range msgs {
+		if msg.Header.Type == syscall.NLMSG_DONE {
+			break
+		}
+		if msg.Header.Type != syscall.RTM_NEWROUTE || len(msg.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+
+		attrs, err := syscall.ParseNetlinkRouteAttr(&msg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse route attributes: %w", err)
+		}
+
+		// The destination prefix length is the second byte of the rtmsg header
+		r := route{Destination: "default"}
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.RTA_DST:
+				r.Destination = fmt.Sprintf("%s/%d", net.IP(attr.Value), msg.Data[1])
+			case syscall.RTA_GATEWAY:
+				r.Gateway = net.IP(attr.Value).String()
+			case syscall.RTA_OIF:
+				if len(attr.Value) < 4 {
+					continue
+				}
+				if iface, err := net.InterfaceByIndex(int(binary.NativeEndian.Uint32(attr.Value))); err == nil {
+					r.Interface = iface.Name
+				}
+			}
+		}
+		routes = append(routes, r)
+	}
+
+	return routes, nil
+}
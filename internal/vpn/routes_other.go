@@ -0,0 +1,8 @@
+//go:build !linux
+
+package vpn
+
+// netlinkRoutes is only available on Linux
+func netlinkRoutes() ([]route, error) {
+	return nil, errSourceUnavailable
+}
@@ -0,0 +1,257 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseIPRoute(t *testing.T) {
+	output := `default via 192.168.1.1 dev eth0 proto dhcp metric 100
+0.0.0.0/1 via 10.8.110.1 dev tun0
+10.8.110.0/24 dev tun0 proto kernel scope link src 10.8.110.6
+128.0.0.0/1 via 10.8.110.1 dev tun0
+`
+	routes := parseIPRoute(output)
+	if len(routes) != 4 {
+		t.Fatalf("Expected 4 routes, got %d", len(routes))
+	}
+
+	if routes[1].Gateway != "10.8.110.1" || routes[1].Interface != "tun0" {
+		t.Errorf("Unexpected route: %+v", routes[1])
+	}
+	if routes[2].Gateway != "" || routes[2].Interface != "tun0" {
+		t.Errorf("Expected link route without gateway, got %+v", routes[2])
+	}
+
+	gateway, err := findTunGateway(routes, "")
+	if err != nil {
+		t.Fatalf("Expected gateway, got error: %v", err)
+	}
+	if gateway != "10.8.110.1" {
+		t.Errorf("Expected gateway 10.8.110.1, got %s", gateway)
+	}
+}
+
+func TestParseProcNetRoute(t *testing.T) {
+	// Addresses are in host byte order; build the fixture the same way the kernel would
+	content := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+		"eth0\t00000000\t" + hostOrderHex("192.168.1.1") + "\t0003\t0\t0\t0\t00000000\t0\t0\t0\n" +
+		"tun0\t" + hostOrderHex("10.8.110.0") + "\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n" +
+		"tun0\t00000000\t" + hostOrderHex("10.8.110.1") + "\t0003\t0\t0\t0\t00000080\t0\t0\t0\n"
+
+	routes, err := parseProcNetRoute(content)
+	if err != nil {
+		t.Fatalf("Failed to parse routes: %v", err)
+	}
+	if len(routes) != 3 {
+		t.Fatalf("Expected 3 routes, got %d", len(routes))
+	}
+
+	gateway, err := findTunGateway(routes, "")
+	if err != nil {
+		t.Fatalf("Expected gateway, got error: %v", err)
+	}
+	if gateway != "10.8.110.1" {
+		t.Errorf("Expected gateway 10.8.110.1, got %s", gateway)
+	}
+
+	// Invalid hex should be reported
+	if _, err := parseProcNetRoute("header\ntun0\tzzzz\t00000000\n"); err == nil {
+		t.Errorf("Expected error for invalid address")
+	}
+}
+
+func TestParseRouteN(t *testing.T) {
+	output := `Kernel IP routing table
+Destination     Gateway         Genmask         Flags Metric Ref    Use Iface
+0.0.0.0         192.168.1.1     0.0.0.0         UG    100    0        0 eth0
+0.0.0.0         10.8.110.1      128.0.0.0       UG    0      0        0 tun0
+10.8.110.0      0.0.0.0         255.255.255.0   U     0      0        0 tun0
+`
+	routes := parseRouteN(output)
+	if len(routes) != 3 {
+		t.Fatalf("Expected 3 routes, got %d", len(routes))
+	}
+
+	gateway, err := findTunGateway(routes, "")
+	if err != nil {
+		t.Fatalf("Expected gateway, got error: %v", err)
+	}
+	if gateway != "10.8.110.1" {
+		t.Errorf("Expected gateway 10.8.110.1, got %s", gateway)
+	}
+}
+
+func TestFindTunGatewayNotFound(t *testing.T) {
+	routes := []route{
+		{Destination: "default", Gateway: "192.168.1.1", Interface: "eth0"},
+		{Destination: "10.8.110.0/24", Gateway: "0.0.0.0", Interface: "tun0"},
+	}
+
+	if _, err := findTunGateway(routes, ""); err == nil {
+		t.Errorf("Expected error when no tun gateway exists")
+	}
+}
+
+func TestReadRoutesFallback(t *testing.T) {
+	var called []string
+	source := func(name string, routes []route, err error) routeSource {
+		return routeSource{name: name, routes: func() ([]route, error) {
+			called = append(called, name)
+			return routes, err
+		}}
+	}
+
+	// The first working source wins
+	routes, err := readRoutes([]routeSource{
+		source("first", nil, errSourceUnavailable),
+		source("second", []route{{Gateway: "10.0.0.1", Interface: "tun0"}}, nil),
+		source("third", nil, nil),
+	})
+	if err != nil {
+		t.Fatalf("Expected routes, got error: %v", err)
+	}
+	if len(routes) != 1 || strings.Join(called, ",") != "first,second" {
+		t.Errorf("Unexpected fallback behavior: routes=%v called=%v", routes, called)
+	}
+
+	// When nothing works, the error names every source that was tried
+	_, err = readRoutes([]routeSource{
+		source("netlink", nil, errors.New("permission denied")),
+		source("ip route", nil, errSourceUnavailable),
+	})
+	if err == nil {
+		t.Fatalf("Expected error when no source works")
+	}
+	for _, want := range []string{"netlink: permission denied", "ip route: not available", "iproute2"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to contain %q, got %q", want, err.Error())
+		}
+	}
+}
+
+// hostOrderHex encodes an IPv4 address the way /proc/net/route does
+func hostOrderHex(ip string) string {
+	return fmt.Sprintf("%08X", binary.NativeEndian.Uint32(net.ParseIP(ip).To4()))
+}
+
+func TestParseProcNetIPv6Route(t *testing.T) {
+	content := "00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000001 00000000 00000003 tun0\n" +
+		"20010db8000000000000000000000000 20 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001 tun0\n" +
+		"00000000000000000000000000000000 00 00000000000000000000000000000000 00 20010db8000000000000000000000001 00000400 00000001 00000000 00000003 tun0\n"
+
+	routes, err := parseProcNetIPv6Route(content)
+	if err != nil {
+		t.Fatalf("Failed to parse routes: %v", err)
+	}
+	if len(routes) != 3 {
+		t.Fatalf("Expected 3 routes, got %d", len(routes))
+	}
+	if routes[1].Destination != "2001:db8::/32" {
+		t.Errorf("Expected destination 2001:db8::/32, got %s", routes[1].Destination)
+	}
+
+	// The link-local gateway is skipped in favor of the global one
+	gateway, err := findTunGateway(routes, "")
+	if err != nil {
+		t.Fatalf("Expected gateway, got error: %v", err)
+	}
+	if gateway != "2001:db8::1" {
+		t.Errorf("Expected gateway 2001:db8::1, got %s", gateway)
+	}
+
+	if _, err := parseProcNetIPv6Route("zz 00 00 00 00 00 00 00 00 tun0\n"); err == nil {
+		t.Errorf("Expected error for invalid address")
+	}
+}
+
+func TestFindTunGatewayPrefersIPv4(t *testing.T) {
+	routes := parseIPRoute(`default via 2001:db8::1 dev tun0 metric 1024 pref medium
+0.0.0.0/1 via 10.8.110.1 dev tun0
+`)
+
+	gateway, err := findTunGateway(routes, "")
+	if err != nil {
+		t.Fatalf("Expected gateway, got error: %v", err)
+	}
+	if gateway != "10.8.110.1" {
+		t.Errorf("Expected IPv4 gateway 10.8.110.1, got %s", gateway)
+	}
+}
+
+func TestFindTunGatewayMultipleTunnels(t *testing.T) {
+	testCases := []struct {
+		name            string
+		routes          string
+		iface           string
+		expectedGateway string
+		expectError     string
+	}{
+		{
+			name: "Split default routes through one tunnel",
+			routes: `0.0.0.0/1 via 10.8.110.1 dev tun0
+128.0.0.0/1 via 10.8.110.1 dev tun0
+`,
+			expectedGateway: "10.8.110.1",
+		},
+		{
+			name: "PIA next to a tunnel outside its range",
+			routes: `100.64.0.0/10 via 100.100.100.100 dev tun0
+0.0.0.0/1 via 10.12.45.1 dev tun1
+`,
+			expectedGateway: "10.12.45.1",
+		},
+		{
+			name: "Two tunnels in PIA's range",
+			routes: `0.0.0.0/1 via 10.8.110.1 dev tun0
+10.20.0.0/16 via 10.20.0.1 dev tun1
+`,
+			expectError: "10.8.110.1 via tun0, 10.20.0.1 via tun1",
+		},
+		{
+			name: "Configured interface",
+			routes: `0.0.0.0/1 via 10.8.110.1 dev tun0
+10.20.0.0/16 via 10.20.0.1 dev tun1
+`,
+			iface:           "tun1",
+			expectedGateway: "10.20.0.1",
+		},
+		{
+			name: "Configured interface without a tun prefix",
+			routes: `default via 192.168.1.1 dev eth0
+0.0.0.0/1 via 10.8.110.1 dev pia
+`,
+			iface:           "pia",
+			expectedGateway: "10.8.110.1",
+		},
+		{
+			name: "Configured interface without a gateway",
+			routes: `0.0.0.0/1 via 10.8.110.1 dev tun0
+`,
+			iface:       "tun1",
+			expectError: "for interface tun1",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gateway, err := findTunGateway(parseIPRoute(tc.routes), tc.iface)
+			if tc.expectError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectError) {
+					t.Errorf("Expected error containing %q, got %v (gateway %s)", tc.expectError, err, gateway)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if gateway != tc.expectedGateway {
+				t.Errorf("Expected gateway %s, got %s", tc.expectedGateway, gateway)
+			}
+		})
+	}
+}
@@ -1,38 +1,41 @@
 package vpn
 
 import (
-	"bufio"
+	"context"
 	"fmt"
 	"net"
-	"os"
-	"os/exec"
-	"strings"
+	"time"
 )
 
+// lookupTimeout bounds resolving a remote's hostname to match it against the
+// routes, replaceable for tests
+var lookupTimeout = 5 * time.Second
+
 // ConnectionInfo holds information about the VPN connection
 type ConnectionInfo struct {
 	GatewayIP string
 	Hostname  string
 }
 
-// DetectOpenVPNConnection detects an active OpenVPN connection and returns connection info
-func DetectOpenVPNConnection(ovpnConfigPath string) (*ConnectionInfo, error) {
-	// Check if tun interface exists
-	if !hasTunInterface() {
-		return nil, fmt.Errorf("no active OpenVPN connection detected (no tun interface)")
+// detectConnection finds the gateway in the routing table read from sources
+// and the hostname of the connected remote among those loadRemotes returns
+func detectConnection(sources []routeSource, loadRemotes func() ([]Remote, error), remoteIndex int, iface string, resolver *net.Resolver) (*ConnectionInfo, error) {
+	// Read the routing table once, it's used for both the gateway and the remote selection
+	routes, err := readRoutes(sources)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get VPN gateway IP: %w", err)
 	}
 
 	// Get gateway IP from routing table
-	gatewayIP, err := getVPNGatewayIP()
+	gatewayIP, err := findTunGateway(routes, iface)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get VPN gateway IP: %w", err)
 	}
 
 	// Get hostname from OpenVPN config
-	hostname, err := getVPNHostname(ovpnConfigPath)
+	hostname, err := connectedHostname(loadRemotes, routes, remoteIndex, gatewayIP, resolver)
 	if err != nil {
-		// If we can't get the hostname from the config, try to construct it from the gateway IP
-		hostname = constructHostname(gatewayIP)
+		return nil, err
 	}
 
 	return &ConnectionInfo{
@@ -41,15 +44,35 @@ func DetectOpenVPNConnection(ovpnConfigPath string) (*ConnectionInfo, error) {
 	}, nil
 }
 
-// hasTunInterface checks if a tun interface exists
-func hasTunInterface() bool {
+// connectedHostname returns the hostname of the remote selected by remoteIndex,
+// or of the one with a host route among routes. With no remote index, a
+// hostname is made up from the gateway if the remotes can't be read.
+func connectedHostname(loadRemotes func() ([]Remote, error), routes []route, remoteIndex int, gatewayIP string, resolver *net.Resolver) (string, error) {
+	lookup := func(host string) ([]string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+		defer cancel()
+		return resolver.LookupHost(ctx, host)
+	}
+	hostname, err := remoteHostname(loadRemotes, routes, remoteIndex, lookup)
+	if err != nil {
+		if remoteIndex > 0 {
+			return "", err
+		}
+		// If we can't get the hostname from the config, try to construct it from the gateway IP
+		hostname = constructHostname(gatewayIP)
+	}
+	return hostname, nil
+}
+
+// hasTunInterface checks if the named interface exists, or any tun interface if name is empty
+func hasTunInterface(name string) bool {
 	interfaces, err := net.Interfaces()
 	if err != nil {
 		return false
 	}
 
 	for _, iface := range interfaces {
-		if strings.HasPrefix(iface.Name, "tun") {
+		if isVPNInterface(iface.Name, name) {
 			return true
 		}
 	}
@@ -57,64 +80,27 @@ func hasTunInterface() bool {
 	return false
 }
 
-// getVPNGatewayIP gets the VPN gateway IP from the routing table
-func getVPNGatewayIP() (string, error) {
-	// Run "ip route" command and parse the output to find the gateway IP for the tun interface
-	cmd := exec.Command("ip", "route")
-	output, err := cmd.Output()
+// remoteHostname gets the VPN server hostname from the remotes loadRemotes reads
+// from the OpenVPN config
+func remoteHostname(loadRemotes func() ([]Remote, error), routes []route, remoteIndex int, lookup lookupFunc) (string, error) {
+	remotes, err := loadRemotes()
 	if err != nil {
-		return "", fmt.Errorf("failed to get routing table: %w", err)
-	}
-
-	// Parse the output to find the gateway IP
-	// Look for lines containing "tun" and extract the gateway IP
-	scanner := bufio.NewScanner(strings.NewReader(string(output)))
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.Contains(line, "tun") {
-			fields := strings.Fields(line)
-			if len(fields) >= 3 {
-				return fields[2], nil // The gateway IP is typically the 3rd field
-			}
-		}
+		return "", err
 	}
 
-	return "", fmt.Errorf("VPN gateway IP not found in routing table")
-}
-
-// getVPNHostname gets the VPN server hostname from the OpenVPN config
-func getVPNHostname(configPath string) (string, error) {
-	// Read the OpenVPN config file
-	file, err := os.Open(configPath)
+	remote, err := selectRemote(remotes, routes, remoteIndex, lookup)
 	if err != nil {
-		return "", fmt.Errorf("failed to open OpenVPN config: %w", err)
-	}
-	defer file.Close()
-
-	// Parse the config to find the remote server entry
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "remote ") {
-			fields := strings.Fields(line)
-			if len(fields) >= 2 {
-				// Check if the second field is an IP or hostname
-				if net.ParseIP(fields[1]) != nil {
-					// It's an IP, so we need to determine the hostname
-					return constructHostname(fields[1]), nil
-				} else {
-					// It's already a hostname
-					return fields[1], nil
-				}
-			}
-		}
+		return "", err
 	}
 
-	if err := scanner.Err(); err != nil {
-		return "", fmt.Errorf("error reading OpenVPN config: %w", err)
+	// Check if the remote is an IP or hostname
+	if net.ParseIP(remote.Host) != nil {
+		// It's an IP, so we need to determine the hostname
+		return constructHostname(remote.Host), nil
 	}
 
-	return "", fmt.Errorf("VPN server hostname not found in OpenVPN config")
+	// It's already a hostname
+	return remote.Host, nil
 }
 
 // constructHostname constructs a PIA hostname from an IP address
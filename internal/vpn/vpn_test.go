@@ -1,11 +1,13 @@
 package vpn
 
 import (
+	"context"
 	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 // mockNetInterfaces is a helper function for testing that returns mock network interfaces
@@ -133,7 +135,7 @@ func TestGetVPNHostname(t *testing.T) {
 			}
 
 			// Call the function
-			result, err := getVPNHostname(configFile)
+			result, err := remoteHostname(func() ([]Remote, error) { return parseRemotes(configFile) }, nil, 0, net.LookupHost)
 
 			// Verify error
 			if tc.expectError && err == nil {
@@ -177,3 +179,30 @@ func TestConstructHostname(t *testing.T) {
 		}
 	}
 }
+
+func TestConnectedHostnameLookupTimeout(t *testing.T) {
+	orig := lookupTimeout
+	lookupTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { lookupTimeout = orig })
+
+	// A DNS server that never answers
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	remotes := []Remote{{Host: "nl-amsterdam.privacy.network"}, {Host: "de-frankfurt.privacy.network"}}
+	routes := []route{{Destination: "212.102.35.1/32"}}
+
+	// The lookups give up, leaving the first remote
+	start := time.Now()
+	hostname, err := connectedHostname(func() ([]Remote, error) { return remotes, nil }, routes, 0, "10.8.110.1", resolver)
+	if err != nil || hostname != "nl-amsterdam.privacy.network" {
+		t.Errorf("Expected the first remote, got %q, %v", hostname, err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the lookups to time out, took %s", elapsed)
+	}
+}
@@ -0,0 +1,110 @@
+package vpn
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// sysClassNetPath lists the network interfaces of a Linux host with their device types
+const sysClassNetPath = "/sys/class/net"
+
+// detectWireGuard detects a PIA WireGuard tunnel from the route through a
+// WireGuard interface. wg-quick routes without a gateway, in which case PIA's
+// server_vip has to be configured with the static strategy.
+func detectWireGuard(d *Detector) (*ConnectionInfo, error) {
+	ifaces, err := d.wireguardInterfaces()
+	if err != nil || len(ifaces) == 0 {
+		return nil, ErrNotApplicable
+	}
+	if d.Interface != "" {
+		if !slices.Contains(ifaces, d.Interface) {
+			return nil, ErrNotApplicable
+		}
+		ifaces = []string{d.Interface}
+	}
+
+	routes, err := readRoutes(d.hostRouteSources())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get VPN gateway IP: %w", err)
+	}
+	gatewayIP, err := wireguardGateway(routes, ifaces)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ConnectionInfo{
+		GatewayIP: gatewayIP,
+		Hostname:  constructHostname(gatewayIP),
+	}, nil
+}
+
+// wireguardGateway finds the gateway routed through one of the WireGuard interfaces
+func wireguardGateway(routes []route, ifaces []string) (string, error) {
+	var found []gatewayRoute
+	for _, iface := range ifaces {
+		if gateway, err := findTunGateway(routes, iface); err == nil {
+			found = append(found, gatewayRoute{gateway: gateway, iface: iface})
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no gateway routed through %s; set the gateway (PIA's server_vip) for the static strategy", strings.Join(ifaces, ", "))
+	case 1:
+		return found[0].gateway, nil
+	}
+	var names []string
+	for _, g := range found {
+		names = append(names, g.gateway+" via "+g.iface)
+	}
+	return "", fmt.Errorf("found several WireGuard gateways (%s); set the interface of the PIA tunnel to pick one", strings.Join(names, ", "))
+}
+
+// wireguardInterfaces lists the WireGuard interfaces of the host the VPN runs on
+func (d *Detector) wireguardInterfaces() ([]string, error) {
+	if d.Run == nil {
+		return localWireGuardInterfaces(sysClassNetPath)
+	}
+
+	// grep fails when nothing matches, which just means there are none
+	output, err := d.Run("grep -l '^DEVTYPE=wireguard$' " + sysClassNetPath + "/*/uevent")
+	if err != nil {
+		return nil, nil
+	}
+	var ifaces []string
+	for _, line := range strings.Fields(string(output)) {
+		ifaces = append(ifaces, path.Base(path.Dir(line)))
+	}
+	return ifaces, nil
+}
+
+// localWireGuardInterfaces lists the interfaces under dir whose uevent says
+// they're WireGuard devices
+func localWireGuardInterfaces(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ifaces []string
+	for _, entry := range entries {
+		file, err := os.Open(filepath.Join(dir, entry.Name(), "uevent"))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if scanner.Text() == "DEVTYPE=wireguard" {
+				ifaces = append(ifaces, entry.Name())
+				break
+			}
+		}
+		file.Close()
+	}
+	return ifaces, nil
+}
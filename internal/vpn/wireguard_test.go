@@ -0,0 +1,68 @@
+package vpn
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLocalWireGuardInterfaces(t *testing.T) {
+	dir := t.TempDir()
+	for name, uevent := range map[string]string{
+		"eth0": "INTERFACE=eth0\nIFINDEX=2\n",
+		"tun0": "DEVTYPE=tun\nINTERFACE=tun0\n",
+		"pia":  "DEVTYPE=wireguard\nINTERFACE=pia\n",
+		"wg0":  "DEVTYPE=wireguard\nINTERFACE=wg0\n",
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name, "uevent"), []byte(uevent), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ifaces, err := localWireGuardInterfaces(dir)
+	if err != nil {
+		t.Fatalf("Failed to list interfaces: %v", err)
+	}
+	if expected := []string{"pia", "wg0"}; !reflect.DeepEqual(ifaces, expected) {
+		t.Errorf("Expected %v, got %v", expected, ifaces)
+	}
+}
+
+func TestWireGuardGateway(t *testing.T) {
+	routes := []route{
+		{Destination: "0.0.0.0", Gateway: "192.168.1.1", Interface: "eth0"},
+		{Destination: "0.0.0.0", Gateway: "10.7.128.1", Interface: "pia"},
+		{Destination: "0.0.0.0", Interface: "wg0"},
+		{Destination: "0.0.0.0", Gateway: "10.9.0.1", Interface: "wg1"},
+	}
+
+	testCases := []struct {
+		name        string
+		ifaces      []string
+		expected    string
+		expectError bool
+	}{
+		{name: "Routed through a gateway", ifaces: []string{"pia", "wg0"}, expected: "10.7.128.1"},
+		{name: "wg-quick route without a gateway", ifaces: []string{"wg0"}, expectError: true},
+		{name: "Several gateways", ifaces: []string{"pia", "wg1"}, expectError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gateway, err := wireguardGateway(routes, tc.ifaces)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("Expected an error, got %s", gateway)
+				}
+				return
+			}
+			if err != nil || gateway != tc.expected {
+				t.Errorf("Expected %s, got %s (%v)", tc.expected, gateway, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,360 @@
+// Package piapf runs go-pia's port forwarding loop inside another Go program.
+// It does what the go-pia-port-forwarding command does, minus the files,
+// scripts and service integration: it authenticates, detects the VPN, keeps
+// the port bound and reports what happens through callbacks.
+//
+//	err := piapf.Run(ctx, piapf.Options{
+//		Username: "p1234567",
+//		Password: "secret",
+//		OnPortChange: func(port int, expiresAt time.Time) {
+//			torrentClient.SetListenPort(port)
+//		},
+//	})
+package piapf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/auth"
+	"github.com/meschansky/go-pia/internal/clock"
+	"github.com/meschansky/go-pia/internal/config"
+	"github.com/meschansky/go-pia/internal/events"
+	"github.com/meschansky/go-pia/internal/portforwarding"
+	"github.com/meschansky/go-pia/internal/resolver"
+	"github.com/meschansky/go-pia/internal/vpn"
+)
+
+// Event describes something that happened while forwarding the port
+type Event = events.Event
+
+// PortStatus is a snapshot of the port the daemon keeps bound
+type PortStatus = portforwarding.PortStatus
+
+// EventType identifies what happened
+type EventType = events.Type
+
+// Event types, see the internal events package for when each is published
+const (
+	PortChanged      = events.PortChanged
+	PortBound        = events.PortBound
+	BindFailed       = events.BindFailed
+	SignatureRenewed = events.SignatureRenewed
+	SignatureFailed  = events.SignatureFailed
+	VPNReconnected   = events.VPNReconnected
+	TokenRefreshed   = events.TokenRefreshed
+	PortKeepFailed   = events.PortKeepFailed
+	PortOutOfRange   = events.PortOutOfRange
+	SignatureRetried = events.SignatureRetried
+	PortReleased     = events.PortReleased
+)
+
+// Options configures a Daemon. Only the credentials are required.
+type Options struct {
+	// PIA account username and password
+	Username string
+	Password string
+	// Path to the PIA CA certificate; relative paths are also looked up in
+	// /etc/openvpn/client, and "embedded" selects the copy built into the
+	// binary (default: ca.rsa.4096.crt)
+	CACertFile string
+	// Path to the OpenVPN config, used to tell which server the VPN is
+	// connected to (default: /etc/openvpn/client/pia.ovpn)
+	OpenVPNConfigFile string
+	// Comma-separated VPN detection strategies to try in order (default: all)
+	Detect string
+	// Interface of the PIA tunnel, needed when several tunnels are up
+	Interface string
+	// Gateway IP and hostname to use instead of detecting the VPN
+	Gateway         string
+	GatewayHostname string
+	// DNS server for hostname lookups (default: the system resolver)
+	DNSServer string
+	// Cache hostname lookups for as long as their TTLs allow, and use them
+	// past it while the DNS server can't be reached
+	DNSCache bool
+	// How often the port is bound (default: 15m)
+	RefreshInterval time.Duration
+	// How long to wait between attempts to authenticate and detect the VPN
+	// (default: 60s)
+	RetryInterval time.Duration
+	// Request a new signature this long before the current one expires
+	// (default: 24h, or only RenewRemaining if that's set)
+	RenewBefore time.Duration
+	// Request a new signature once only this fraction of the validity the
+	// current one had when obtained is left, e.g. 0.25. With RenewBefore set
+	// too, the earlier of the two applies.
+	RenewRemaining float64
+	// When a new signature has a different port, request another up to this
+	// many times to keep the old one (default: 0, any port is taken)
+	KeepPortAttempts int
+	// Inclusive range the port should be in; when a signature's port is
+	// outside it, request another up to PortRangeAttempts times (default: 0,
+	// any port is taken)
+	PortRangeMin      int
+	PortRangeMax      int
+	PortRangeAttempts int
+	// Called from the daemon's goroutine whenever a different port is bound,
+	// including the first bind. Optional.
+	OnPortChange func(port int, expiresAt time.Time)
+}
+
+// gatewayClient is the part of portforwarding.Client the daemon uses
+type gatewayClient interface {
+	portforwarding.PortForwarder
+	SetToken(token string)
+	SetGateway(gatewayIP, hostname string)
+	ProbeGateway() error
+}
+
+// Daemon keeps a port forwarded through the PIA VPN
+type Daemon struct {
+	opts  Options
+	bus   *events.Bus
+	auth  *auth.Client
+	clock clock.Clock
+
+	// Replaced by tests
+	token      func() (string, error)
+	detect     func() (*vpn.ConnectionInfo, error)
+	newGateway func(token string, conn *vpn.ConnectionInfo) gatewayClient
+
+	mu      sync.Mutex
+	running bool
+	manager *portforwarding.Manager
+}
+
+// Run runs the port forwarding loop with opts until ctx is canceled
+func Run(ctx context.Context, opts Options) error {
+	d, err := New(opts)
+	if err != nil {
+		return err
+	}
+	return d.Run(ctx)
+}
+
+// New checks opts and returns a daemon that is started with Run
+func New(opts Options) (*Daemon, error) {
+	defaults := config.BuiltinConfig()
+	if opts.CACertFile == "" {
+		opts.CACertFile = defaults.CACertFile
+	}
+	if opts.OpenVPNConfigFile == "" {
+		opts.OpenVPNConfigFile = defaults.OpenVPNConfigFile
+	}
+	if opts.RefreshInterval == 0 {
+		opts.RefreshInterval = defaults.RefreshInterval
+	}
+	if opts.RetryInterval == 0 {
+		opts.RetryInterval = defaults.VPNRetryInterval
+	}
+
+	if opts.Username == "" || opts.Password == "" {
+		return nil, errors.New("PIA username and password are required")
+	}
+	if opts.RefreshInterval < 0 || opts.RefreshInterval > config.MaxRefreshInterval {
+		return nil, fmt.Errorf("refresh interval must be positive and at most %s, got %s", config.MaxRefreshInterval, opts.RefreshInterval)
+	}
+	if opts.RetryInterval < 0 {
+		return nil, fmt.Errorf("retry interval must be positive, got %s", opts.RetryInterval)
+	}
+	if opts.RenewBefore < 0 || opts.RenewBefore > config.MaxRenewBefore {
+		return nil, fmt.Errorf("renew before must be positive and at most %s, got %s", config.MaxRenewBefore, opts.RenewBefore)
+	}
+	if opts.RenewRemaining < 0 || opts.RenewRemaining >= 1 {
+		return nil, fmt.Errorf("renew remaining must be a fraction from 0 to 1, got %v", opts.RenewRemaining)
+	}
+	if opts.KeepPortAttempts < 0 || opts.KeepPortAttempts > config.MaxKeepPortAttempts {
+		return nil, fmt.Errorf("keep port attempts must be between 0 and %d, got %d", config.MaxKeepPortAttempts, opts.KeepPortAttempts)
+	}
+	if opts.PortRangeMin != 0 || opts.PortRangeMax != 0 {
+		if opts.PortRangeMin < 1 || opts.PortRangeMax > 65535 || opts.PortRangeMin > opts.PortRangeMax {
+			return nil, fmt.Errorf("%d-%d is not a range of ports from 1 to 65535", opts.PortRangeMin, opts.PortRangeMax)
+		}
+	}
+	if opts.PortRangeAttempts < 0 || opts.PortRangeAttempts > config.MaxKeepPortAttempts {
+		return nil, fmt.Errorf("port range attempts must be between 0 and %d, got %d", config.MaxKeepPortAttempts, opts.PortRangeAttempts)
+	}
+	strategies, err := vpn.ParseStrategies(opts.Detect)
+	if err != nil {
+		return nil, fmt.Errorf("invalid detection strategies: %w", err)
+	}
+	caCertPath, err := config.ResolveCACertPath(opts.CACertFile)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Daemon{
+		opts:  opts,
+		bus:   events.NewBus(),
+		auth:  auth.NewClient(opts.Username, opts.Password),
+		clock: clock.Real,
+	}
+	var cache *resolver.Cache
+	if opts.DNSCache {
+		cache = resolver.NewCache(opts.DNSServer)
+		d.auth.UseResolverCache(cache)
+	} else if opts.DNSServer != "" {
+		d.auth.UseResolver(resolver.New(opts.DNSServer))
+	}
+	d.token = d.auth.GetToken
+
+	detector := &vpn.Detector{
+		Strategies:    strategies,
+		OpenVPNConfig: opts.OpenVPNConfigFile,
+		Interface:     opts.Interface,
+		Gateway:       opts.Gateway,
+		Hostname:      opts.GatewayHostname,
+		Resolver:      resolver.New(opts.DNSServer),
+	}
+	d.detect = func() (*vpn.ConnectionInfo, error) {
+		conn, _, err := detector.Detect()
+		return conn, err
+	}
+	d.newGateway = func(token string, conn *vpn.ConnectionInfo) gatewayClient {
+		client := portforwarding.NewClient(token, conn.GatewayIP, conn.Hostname, caCertPath)
+		if cache != nil {
+			client.UseResolverCache(cache)
+		} else if opts.DNSServer != "" {
+			client.UseResolver(resolver.New(opts.DNSServer))
+		}
+		return client
+	}
+
+	if opts.OnPortChange != nil {
+		d.bus.Subscribe(func(e Event) {
+			opts.OnPortChange(e.Port, e.ExpiresAt)
+		}, PortChanged)
+	}
+	return d, nil
+}
+
+// Subscribe calls handler for events of the given types, or for every event if
+// no types are given. Handlers run in the daemon's goroutine and should return
+// quickly. The returned function removes the subscription.
+func (d *Daemon) Subscribe(handler func(Event), types ...EventType) (unsubscribe func()) {
+	return d.bus.Subscribe(handler, types...)
+}
+
+// Port returns the port last bound and when its signature expires, or 0 if
+// none has been bound yet
+func (d *Daemon) Port() (int, time.Time) {
+	status := d.Status()
+	return status.Port, status.ExpiresAt
+}
+
+// Status returns a consistent snapshot of the port, its signature and the
+// gateway it's forwarded through, empty until Run has found the VPN
+func (d *Daemon) Status() PortStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.manager == nil {
+		return PortStatus{}
+	}
+	return d.manager.Current()
+}
+
+// Renew asks the running daemon to obtain a new signature, and usually a new
+// port, right away. It does nothing until Run has found the VPN.
+func (d *Daemon) Renew() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.manager != nil {
+		d.manager.Renew()
+	}
+}
+
+// Run authenticates, waits for the VPN and keeps the port bound until ctx is
+// canceled, retrying failures along the way. It returns nil once ctx is
+// canceled, or an error if no port could be obtained at all. A daemon can only
+// be run once.
+func (d *Daemon) Run(ctx context.Context) error {
+	d.mu.Lock()
+	if d.running {
+		d.mu.Unlock()
+		return errors.New("daemon is already running")
+	}
+	d.running = true
+	d.mu.Unlock()
+
+	d.auth.OnRefresh(func(issuedAt time.Time) {
+		d.bus.Publish(Event{Type: TokenRefreshed, Time: issuedAt})
+	})
+
+	// Authenticate and find the gateway, retrying until both work
+	token, err := retry(ctx, d.clock, d.opts.RetryInterval, "get authentication token", d.token)
+	if err != nil {
+		return nilIfCanceled(ctx, err)
+	}
+	conn, err := retry(ctx, d.clock, d.opts.RetryInterval, "detect VPN connection", d.detect)
+	if err != nil {
+		return nilIfCanceled(ctx, err)
+	}
+	d.bus.Publish(Event{Type: VPNReconnected, Gateway: conn.GatewayIP, Hostname: conn.Hostname})
+
+	gateway := d.newGateway(token, conn)
+	manager := portforwarding.NewManager(gateway, d.bus, d.opts.RefreshInterval)
+	manager.Clock = d.clock
+	manager.RenewPolicy = portforwarding.RenewPolicy{Before: d.opts.RenewBefore, Remaining: d.opts.RenewRemaining}
+	manager.KeepPortAttempts = d.opts.KeepPortAttempts
+	manager.PortRangeMin = d.opts.PortRangeMin
+	manager.PortRangeMax = d.opts.PortRangeMax
+	manager.PortRangeAttempts = d.opts.PortRangeAttempts
+	manager.Gateway = conn.GatewayIP
+	manager.Hostname = conn.Hostname
+	manager.RefreshToken = func(invalidate bool) error {
+		if invalidate {
+			d.auth.Invalidate()
+		}
+		token, err := d.token()
+		if err != nil {
+			return err
+		}
+		gateway.SetToken(token)
+		return nil
+	}
+	manager.ProbeGateway = gateway.ProbeGateway
+	manager.Reconnect = func() (string, string, error) {
+		conn, err := d.detect()
+		if err != nil {
+			return "", "", err
+		}
+		gateway.SetGateway(conn.GatewayIP, conn.Hostname)
+		return conn.GatewayIP, conn.Hostname, nil
+	}
+
+	d.mu.Lock()
+	d.manager = manager
+	d.mu.Unlock()
+	return nilIfCanceled(ctx, manager.Run(ctx))
+}
+
+// retry calls fn until it succeeds or ctx is canceled, waiting interval
+// between attempts
+func retry[T any](ctx context.Context, clk clock.Clock, interval time.Duration, what string, fn func() (T, error)) (T, error) {
+	for {
+		v, err := fn()
+		if err == nil {
+			return v, nil
+		}
+		log.Printf("Failed to %s: %v. Retrying in %s...", what, err, interval)
+
+		select {
+		case <-clk.After(interval):
+		case <-ctx.Done():
+			return v, fmt.Errorf("failed to %s: %w", what, err)
+		}
+	}
+}
+
+// nilIfCanceled hides the error of a run that ended because ctx was canceled
+func nilIfCanceled(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
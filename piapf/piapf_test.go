@@ -0,0 +1,119 @@
+package piapf
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meschansky/go-pia/internal/clock"
+	"github.com/meschansky/go-pia/internal/portforwarding"
+	"github.com/meschansky/go-pia/internal/vpn"
+)
+
+// fakeGateway hands out a fixed port and accepts every bind
+type fakeGateway struct {
+	port      int
+	expiresAt time.Time
+}
+
+func (g *fakeGateway) GetPortForwarding() (*portforwarding.PortForwardingInfo, error) {
+	return &portforwarding.PortForwardingInfo{Port: g.port, ExpiresAt: g.expiresAt, Payload: "payload", Signature: "signature"}, nil
+}
+func (g *fakeGateway) BindPort(payload, signature string) error { return nil }
+func (g *fakeGateway) SetToken(token string)                    {}
+func (g *fakeGateway) SetGateway(gatewayIP, hostname string)    {}
+func (g *fakeGateway) ProbeGateway() error                      { return nil }
+
+func TestNew(t *testing.T) {
+	testCases := []struct {
+		name     string
+		opts     Options
+		expected string
+	}{
+		{"Valid", Options{Username: "p1234567", Password: "secret", CACertFile: "/etc/pia/ca.crt"}, ""},
+		{"No credentials", Options{CACertFile: "/etc/pia/ca.crt"}, "username and password are required"},
+		{"Refresh too slow", Options{Username: "p1234567", Password: "secret", CACertFile: "/etc/pia/ca.crt", RefreshInterval: time.Hour}, "refresh interval"},
+		{"Whole validity left", Options{Username: "p1234567", Password: "secret", CACertFile: "/etc/pia/ca.crt", RenewRemaining: 1}, "renew remaining"},
+		{"Inverted port range", Options{Username: "p1234567", Password: "secret", CACertFile: "/etc/pia/ca.crt", PortRangeMin: 50000, PortRangeMax: 40000}, "not a range of ports"},
+		{"Unknown strategy", Options{Username: "p1234567", Password: "secret", CACertFile: "/etc/pia/ca.crt", Detect: "dhcp"}, "invalid detection strategies"},
+		{"Missing CA certificate", Options{Username: "p1234567", Password: "secret", CACertFile: "missing.crt"}, "CA certificate file not found"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := New(tc.opts)
+			if tc.expected == "" {
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				if d.opts.RefreshInterval != 15*time.Minute || d.opts.OpenVPNConfigFile != "/etc/openvpn/client/pia.ovpn" {
+					t.Errorf("Expected the defaults, got %+v", d.opts)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("Expected an error containing %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	expiresAt := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+	changed := make(chan int, 1)
+	d, err := New(Options{
+		Username:     "p1234567",
+		Password:     "secret",
+		CACertFile:   "/etc/pia/ca.crt",
+		OnPortChange: func(port int, _ time.Time) { changed <- port },
+	})
+	if err != nil {
+		t.Fatalf("Failed to create daemon: %v", err)
+	}
+	fake := clock.NewFake(time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC))
+	d.clock = fake
+
+	// The VPN comes up after the first attempt
+	attempts := 0
+	d.token = func() (string, error) { return "token123", nil }
+	d.detect = func() (*vpn.ConnectionInfo, error) {
+		if attempts++; attempts == 1 {
+			return nil, errors.New("no VPN connection detected")
+		}
+		return &vpn.ConnectionInfo{GatewayIP: "10.7.128.1", Hostname: "amsterdam407"}, nil
+	}
+	d.newGateway = func(token string, conn *vpn.ConnectionInfo) gatewayClient {
+		return &fakeGateway{port: 47000, expiresAt: expiresAt}
+	}
+	var seen []EventType
+	d.Subscribe(func(e Event) { seen = append(seen, e.Type) }, VPNReconnected, PortBound)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- d.Run(ctx) }()
+
+	if err := fake.BlockUntil(ctx, 1); err != nil {
+		t.Fatalf("Run didn't wait to retry: %v", err)
+	}
+	fake.Advance(time.Minute)
+	if port := <-changed; port != 47000 {
+		t.Errorf("Expected port 47000, got %d", port)
+	}
+	if port, expires := d.Port(); port != 47000 || !expires.Equal(expiresAt) {
+		t.Errorf("Expected port 47000 until %s, got %d until %s", expiresAt, port, expires)
+	}
+	if status := d.Status(); status.Signature != "signature" || status.BoundAt.IsZero() {
+		t.Errorf("Expected the bound signature in the status, got %+v", status)
+	}
+	if err := d.Run(ctx); err == nil {
+		t.Error("Expected a second Run to fail")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected a clean stop, got %v", err)
+	}
+	if len(seen) != 2 || seen[0] != VPNReconnected || seen[1] != PortBound {
+		t.Errorf("Unexpected events %v", seen)
+	}
+}